@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"gorefer.go/pkg/migrations"
+)
+
+// Коды завершения команд. Значения стабильны: на них опираются скрипты
+// развертывания.
+const (
+	exitOK        = 0 // успех
+	exitFailure   = 1 // прочие ошибки: сбой БД, ввода-вывода и т.п.
+	exitConfig    = 2 // ошибка конфигурации или аргументов
+	exitMigration = 3 // миграции не выполнены
+	exitUnhealthy = 4 // проверка healthcheck не пройдена
+)
+
+const helpText = `Использование: gorefer [команда] [параметры]
+
+Без команды запускается сервер.
+
+Команды:
+  migrate      применить миграции БД
+  seed         загрузить тестовые данные: --profile minimal|demo
+  import       перенести пользователей и связи из прежней системы:
+               --file users.csv --links links.csv [--rejects файл]
+  healthcheck  проверить /healthz и /readyz запущенного сервиса:
+               [--url http://localhost] [--timeout 5s]
+  config       schema - вывести JSON Schema файла конфигурации;
+               validate [--file config.json] - проверить конфигурацию
+  help         показать эту справку
+
+С параметром --json команды выводят результат в stdout одним
+JSON-объектом; журнал пишется в stderr.
+
+Коды завершения:
+  0  успех
+  1  прочие ошибки (сбой БД, ввода-вывода)
+  2  ошибка конфигурации или аргументов
+  3  миграции не выполнены
+  4  сервис не прошел healthcheck
+`
+
+// configError - ошибка конфигурации или аргументов командной строки
+type configError struct{ err error }
+
+func (e *configError) Error() string { return e.err.Error() }
+func (e *configError) Unwrap() error { return e.err }
+
+// errUnhealthy возвращается healthcheck, если сервис не готов
+var errUnhealthy = errors.New("сервис не прошел проверку")
+
+// exitCode возвращает код завершения для ошибки команды.
+func exitCode(err error) int {
+	var cfgErr *configError
+	switch {
+	case err == nil, errors.Is(err, flag.ErrHelp):
+		return exitOK
+	case errors.As(err, &cfgErr):
+		return exitConfig
+	case errors.Is(err, migrations.ErrFailed), errors.Is(err, migrations.ErrLocked):
+		return exitMigration
+	case errors.Is(err, errUnhealthy):
+		return exitUnhealthy
+	}
+	return exitFailure
+}
+
+// command выполняет команду args[0] с параметрами args[1:]; без команды
+// запускается сервер. Результат команды выводится в stdout.
+func command(configPath string, args []string, stdout io.Writer) error {
+	if len(args) == 0 {
+		return run(configPath)
+	}
+	switch name, args := args[0], args[1:]; name {
+	case "migrate":
+		return migrate(configPath, args, stdout)
+	case "seed":
+		return seed(configPath, args, stdout)
+	case "import":
+		return importData(configPath, args, stdout)
+	case "healthcheck":
+		return healthcheck(args, stdout)
+	case "config":
+		return configCommand(configPath, args, stdout)
+	case "help", "-h", "--help":
+		_, err := io.WriteString(stdout, helpText)
+		return err
+	default:
+		return &configError{fmt.Errorf("неизвестная команда %q, см. gorefer help", name)}
+	}
+}
+
+// parseFlags разбирает параметры команды. Лишние аргументы - ошибка.
+func parseFlags(flags *flag.FlagSet, args []string) error {
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return &configError{err}
+	}
+	if flags.NArg() > 0 {
+		return &configError{fmt.Errorf("%s: лишние аргументы %q", flags.Name(), flags.Args())}
+	}
+	return nil
+}
+
+// commandResult - результат команды для stdout
+type commandResult interface {
+	text() string // результат для человека
+}
+
+// writeResult выводит результат команды в JSON или текстом.
+func writeResult(w io.Writer, asJSON bool, res commandResult) error {
+	if asJSON {
+		return json.NewEncoder(w).Encode(res)
+	}
+	_, err := fmt.Fprintln(w, res.text())
+	return err
+}
+
+// migrateResult - результат команды migrate
+type migrateResult struct {
+	migrations.Result
+}
+
+func (r migrateResult) text() string {
+	if len(r.Applied) == 0 {
+		return fmt.Sprintf("Схема БД актуальна, версия %d", r.To)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Схема БД обновлена с версии %d до %d, применено миграций: %d", r.From, r.To, len(r.Applied))
+	for _, m := range r.Applied {
+		fmt.Fprintf(&b, "\n  %d %s", m.Version, m.Name)
+	}
+	return b.String()
+}
+
+// migrate выполняет команду "gorefer migrate": применяет миграции БД.
+func migrate(configPath string, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "вывести результат в JSON")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	config, err := loadConfig(configPath)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, migrationTimeout)
+	defer cancel()
+
+	res, err := migrations.ApplyMigrations(ctx, dsn(config.DB))
+	if err != nil {
+		return err
+	}
+	return writeResult(stdout, *asJSON, migrateResult{res})
+}
+
+// Проверка одной конечной точки в healthcheck
+type healthCheck struct {
+	Name      string  `json:"name"`
+	Status    int     `json:"status"` // код ответа; 0 - ответа нет
+	LatencyMs float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// healthResult - результат команды healthcheck
+type healthResult struct {
+	Healthy bool          `json:"healthy"`
+	Checks  []healthCheck `json:"checks"`
+}
+
+func (r healthResult) text() string {
+	var b strings.Builder
+	if r.Healthy {
+		b.WriteString("Сервис готов")
+	} else {
+		b.WriteString("Сервис не готов")
+	}
+	for _, c := range r.Checks {
+		fmt.Fprintf(&b, "\n  %s %d %.1f мс", c.Name, c.Status, c.LatencyMs)
+		if c.Error != "" {
+			fmt.Fprintf(&b, " %s", c.Error)
+		}
+	}
+	return b.String()
+}
+
+// healthcheck выполняет команду "gorefer healthcheck": запрашивает
+// /healthz и /readyz запущенного сервиса. Сервис готов, если обе
+// проверки ответили 200; иначе результат выводится и возвращается
+// errUnhealthy.
+func healthcheck(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("healthcheck", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "вывести результат в JSON")
+	baseURL := flags.String("url", "http://localhost", "адрес сервиса")
+	timeout := flags.Duration("timeout", 5*time.Second, "время ожидания каждой проверки")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: *timeout}
+	res := healthResult{Healthy: true}
+	for _, name := range []string{"healthz", "readyz"} {
+		check := healthCheck{Name: name}
+		start := time.Now()
+		resp, err := client.Get(strings.TrimRight(*baseURL, "/") + "/" + name)
+		check.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+		if err != nil {
+			check.Error = err.Error()
+		} else {
+			resp.Body.Close()
+			check.Status = resp.StatusCode
+		}
+		if check.Status != http.StatusOK {
+			res.Healthy = false
+		}
+		res.Checks = append(res.Checks, check)
+	}
+	if err := writeResult(stdout, *asJSON, res); err != nil {
+		return err
+	}
+	if !res.Healthy {
+		return errUnhealthy
+	}
+	return nil
+}
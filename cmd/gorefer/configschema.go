@@ -0,0 +1,369 @@
+package main
+
+//go:generate sh -c "go run . config schema > config.schema.json"
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gorefer.go/pkg/api"
+	"gorefer.go/pkg/onboarding"
+)
+
+// Файл схемы конфигурации рядом с config.json, см. go:generate выше
+const configSchemaFile = "config.schema.json"
+
+// Обязательные поля объектов конфигурации по пути объекта
+var schemaRequired = map[string][]string{
+	"":   {"db"},
+	"db": {"host", "user", "dbname", "port"},
+}
+
+// Допустимые значения строковых полей по пути поля
+var schemaEnums = map[string][]string{
+	"db.sslmode":                {"disable", "allow", "prefer", "require", "verify-ca", "verify-full"},
+	"registration.invalid_code": {api.InvalidCodeReject, api.InvalidCodeIgnore},
+	"rewards.required_steps[]":  onboarding.Steps,
+}
+
+// Границы числовых полей по пути поля
+var schemaBounds = map[string][2]float64{
+	"db.port":                    {1, 65535},
+	"faults.rules[].probability": {0, 1},
+}
+
+// Ограничения между полями, которые схема не выражает. Ошибка
+// относится к разделу path.
+var configChecks = []struct {
+	path     string
+	validate func(c config) error
+}{
+	{"server", func(c config) error { return c.Server.validate() }},
+	{"rewards", func(c config) error { return c.Rewards.validate(c.MagicLink.Enabled) }},
+	{"magic_link", func(c config) error { return c.MagicLink.validate() }},
+	{"registration.queue", func(c config) error { return c.Registration.Queue.validate(c.API.MaxAuthInFlight > 0) }},
+	{"reminders", func(c config) error { return c.Reminders.validate() }},
+	{"statements", func(c config) error { return c.Statements.validate() }},
+	{"retention", func(c config) error { return c.Retention.validate() }},
+	{"widget", func(c config) error { return c.Widget.validate() }},
+	{"quotas", func(c config) error { return c.Quotas.validate() }},
+	{"link_preview", func(c config) error { return c.LinkPreview.validate() }},
+	{"faults.rules", func(c config) error { return c.Faults.validate() }},
+}
+
+// jsonSchema - подмножество JSON Schema (draft 2020-12), которого
+// достаточно для описания конфигурации
+type jsonSchema struct {
+	Schema               string                 `json:"$schema,omitempty"`
+	Title                string                 `json:"title,omitempty"`
+	Type                 schemaType             `json:"type"`
+	Properties           map[string]*jsonSchema `json:"properties,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	AdditionalProperties *bool                  `json:"additionalProperties,omitempty"`
+	Items                *jsonSchema            `json:"items,omitempty"`
+	Enum                 []string               `json:"enum,omitempty"`
+	Minimum              *float64               `json:"minimum,omitempty"`
+	Maximum              *float64               `json:"maximum,omitempty"`
+}
+
+// schemaType - допустимые типы значения; один тип выводится строкой
+type schemaType []string
+
+func (t schemaType) MarshalJSON() ([]byte, error) {
+	if len(t) == 1 {
+		return json.Marshal(t[0])
+	}
+	return json.Marshal([]string(t))
+}
+
+func (t schemaType) allows(name string) bool {
+	for _, v := range t {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+// configSchema возвращает схему config.json, построенную по структуре
+// config.
+func configSchema() *jsonSchema {
+	s := schemaFor(reflect.TypeOf(config{}), "")
+	s.Schema = "https://json-schema.org/draft/2020-12/schema"
+	s.Title = "gorefer config.json"
+	return s
+}
+
+// schemaFor строит схему значения типа t, расположенного по пути path.
+func schemaFor(t reflect.Type, path string) *jsonSchema {
+	switch t.Kind() {
+	case reflect.Ptr:
+		s := schemaFor(t.Elem(), path)
+		s.Type = append(s.Type, "null")
+		return s
+	case reflect.Struct:
+		closed := false
+		s := &jsonSchema{
+			Type:                 schemaType{"object"},
+			Properties:           map[string]*jsonSchema{},
+			Required:             schemaRequired[path],
+			AdditionalProperties: &closed,
+		}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if !f.IsExported() || name == "" || name == "-" {
+				continue
+			}
+			s.Properties[name] = schemaFor(f.Type, joinPath(path, name))
+		}
+		return s
+	case reflect.Slice:
+		return &jsonSchema{Type: schemaType{"array"}, Items: schemaFor(t.Elem(), path+"[]")}
+	case reflect.String:
+		return &jsonSchema{Type: schemaType{"string"}, Enum: schemaEnums[path]}
+	case reflect.Bool:
+		return &jsonSchema{Type: schemaType{"boolean"}}
+	}
+	s := &jsonSchema{Type: schemaType{"number"}}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		s.Type = schemaType{"integer"}
+	case reflect.Float32, reflect.Float64:
+	default:
+		panic("configSchema: неподдерживаемый тип " + t.String())
+	}
+	if b, ok := schemaBounds[path]; ok {
+		s.Minimum, s.Maximum = &b[0], &b[1]
+	}
+	return s
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// configIssue - ошибка конфигурации в поле path, например db.port;
+// пустой path - файл целиком
+type configIssue struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// configIssues - все ошибки конфигурации
+type configIssues []configIssue
+
+func (issues configIssues) Error() string {
+	msgs := make([]string, len(issues))
+	for i, issue := range issues {
+		msgs[i] = issue.Message
+		if issue.Path != "" {
+			msgs[i] = issue.Path + ": " + issue.Message
+		}
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// checkConfig разбирает конфигурацию: сначала проверяет структуру по
+// configSchema, чтобы сообщить обо всех ошибках с путями полей, затем
+// ограничения configChecks.
+func checkConfig(b []byte) (config, configIssues) {
+	var c config
+	var raw interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil {
+		return c, configIssues{{Message: "некорректный JSON: " + syntaxError(b, err)}}
+	}
+	if dec.More() {
+		return c, configIssues{{Message: "некорректный JSON: данные после конфигурации"}}
+	}
+	if issues := checkValue(configSchema(), raw, ""); len(issues) > 0 {
+		return c, issues
+	}
+
+	// схема уже проверена, строгий разбор - на случай расхождения с ней
+	dec = json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&c); err != nil {
+		return c, configIssues{{Message: err.Error()}}
+	}
+	var issues configIssues
+	for _, check := range configChecks {
+		if err := check.validate(c); err != nil {
+			issues = append(issues, configIssue{Path: check.path, Message: err.Error()})
+		}
+	}
+	return c, issues
+}
+
+// syntaxError дополняет ошибку разбора JSON строкой и столбцом.
+func syntaxError(b []byte, err error) string {
+	var syntax *json.SyntaxError
+	if !errors.As(err, &syntax) {
+		return err.Error()
+	}
+	before := b[:syntax.Offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	col := len(before) - bytes.LastIndexByte(before, '\n')
+	return fmt.Sprintf("строка %d, столбец %d: %v", line, col, err)
+}
+
+// checkValue проверяет значение v, разобранное с UseNumber, по схеме s.
+func checkValue(s *jsonSchema, v interface{}, path string) configIssues {
+	issue := func(format string, args ...interface{}) configIssues {
+		return configIssues{{Path: path, Message: fmt.Sprintf(format, args...)}}
+	}
+	got := jsonType(v)
+	if !s.Type.allows(got) && !(got == "integer" && s.Type.allows("number")) {
+		return issue("ожидается %s, получено %s", strings.Join(s.Type, " или "), got)
+	}
+
+	var issues configIssues
+	switch v := v.(type) {
+	case map[string]interface{}:
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			prop, ok := s.Properties[name]
+			if !ok {
+				issues = append(issues, configIssue{Path: joinPath(path, name), Message: "неизвестное поле"})
+				continue
+			}
+			issues = append(issues, checkValue(prop, v[name], joinPath(path, name))...)
+		}
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				issues = append(issues, configIssue{Path: joinPath(path, name), Message: "обязательное поле"})
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			issues = append(issues, checkValue(s.Items, item, fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	case string:
+		if len(s.Enum) > 0 && !contains(s.Enum, v) {
+			return issue("значение %q не из списка %s", v, strings.Join(s.Enum, ", "))
+		}
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return issue("число %s вне допустимого диапазона", v)
+		}
+		if (s.Minimum != nil && f < *s.Minimum) || (s.Maximum != nil && f > *s.Maximum) {
+			return issue("значение %s вне [%v, %v]", v, *s.Minimum, *s.Maximum)
+		}
+	}
+	return issues
+}
+
+// jsonType возвращает тип значения в терминах JSON Schema.
+func jsonType(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	case json.Number:
+		if _, err := strconv.ParseInt(v.String(), 10, 64); err == nil {
+			return "integer"
+		}
+		return "number"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func contains(values []string, v string) bool {
+	for _, s := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// validateResult - результат команды config validate
+type validateResult struct {
+	File   string       `json:"file"`
+	Valid  bool         `json:"valid"`
+	Errors configIssues `json:"errors"`
+}
+
+func (r validateResult) text() string {
+	if r.Valid {
+		return "Конфигурация " + r.File + " корректна"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Конфигурация %s некорректна:", r.File)
+	for _, issue := range r.Errors {
+		if issue.Path == "" {
+			fmt.Fprintf(&b, "\n  %s", issue.Message)
+		} else {
+			fmt.Fprintf(&b, "\n  %s: %s", issue.Path, issue.Message)
+		}
+	}
+	return b.String()
+}
+
+// configCommand выполняет команды "gorefer config schema" (схема
+// config.json для редакторов) и "gorefer config validate --file
+// config.json" (проверка без запуска сервиса).
+func configCommand(configPath string, args []string, stdout io.Writer) error {
+	if len(args) == 0 {
+		return &configError{errors.New("config: нужна подкоманда schema или validate")}
+	}
+	switch name, args := args[0], args[1:]; name {
+	case "schema":
+		flags := flag.NewFlagSet("config schema", flag.ContinueOnError)
+		if err := parseFlags(flags, args); err != nil {
+			return err
+		}
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(configSchema())
+	case "validate":
+		flags := flag.NewFlagSet("config validate", flag.ContinueOnError)
+		file := flags.String("file", configPath, "файл конфигурации")
+		asJSON := flags.Bool("json", false, "вывести результат в JSON")
+		if err := parseFlags(flags, args); err != nil {
+			return err
+		}
+		b, err := os.ReadFile(*file)
+		if err != nil {
+			return &configError{fmt.Errorf("чтение конфигурации %s: %w", *file, err)}
+		}
+		_, issues := checkConfig(b)
+		res := validateResult{File: *file, Valid: len(issues) == 0, Errors: configIssues{}}
+		res.Errors = append(res.Errors, issues...)
+		if err := writeResult(stdout, *asJSON, res); err != nil {
+			return err
+		}
+		if !res.Valid {
+			return &configError{fmt.Errorf("конфигурация %s некорректна, ошибок: %d", *file, len(issues))}
+		}
+		return nil
+	default:
+		return &configError{fmt.Errorf("config: неизвестная подкоманда %q", name)}
+	}
+}
@@ -1,47 +1,1039 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"encoding/csv"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"gorefer.go/pkg/api"
+	"gorefer.go/pkg/api/pagination"
+	"gorefer.go/pkg/auth"
+	"gorefer.go/pkg/fraud"
+	"gorefer.go/pkg/mailer"
 	"gorefer.go/pkg/migrations"
+	"gorefer.go/pkg/onboarding"
+	"gorefer.go/pkg/reminders"
+	"gorefer.go/pkg/retention"
+	"gorefer.go/pkg/rewards"
+	"gorefer.go/pkg/statements"
 	"gorefer.go/pkg/storage"
+	"gorefer.go/pkg/webhooks"
 )
 
+// Время на завершение активных запросов при остановке сервера.
+const shutdownTimeout = 10 * time.Second
+
+// Предельное время миграций, включая ожидание другого экземпляра.
+const migrationTimeout = 5 * time.Minute
+
 // конфигурация приложения
 type config struct {
-	DB storage.DBConfig `json:"db"`
+	// путь к схеме файла для редакторов, см. configSchemaFile
+	Schema string           `json:"$schema"`
+	DB     storage.DBConfig `json:"db"`
+	// HTTP-сервер
+	Server  serverConfig  `json:"server"`
+	API     apiConfig     `json:"api"`
+	Fraud   fraudConfig   `json:"fraud"`
+	Rewards rewardsConfig `json:"rewards"`
+	// ограничения реферальных цепочек
+	Referrals referralsConfig `json:"referrals"`
+	// вход по одноразовой ссылке из письма
+	MagicLink magicLinkConfig `json:"magic_link"`
+	// шаблоны писем
+	Emails emailsConfig `json:"emails"`
+	// токены входа
+	Auth authConfig `json:"auth"`
+	// доступные способы регистрации
+	Registration registrationConfig `json:"registration"`
+	// доставка событий внешним получателям
+	Webhooks webhooksConfig `json:"webhooks"`
+	// напоминания об истечении срока кодов
+	Reminders remindersConfig `json:"reminders"`
+	// ежемесячные выписки по вознаграждениям
+	Statements statementsConfig `json:"statements"`
+	// очистка устаревших IP-адресов и User-Agent
+	Retention retentionConfig `json:"retention"`
+	// виджет реферального кода для сайтов партнеров
+	Widget widgetConfig `json:"widget"`
+	// квоты пользователей на создание кодов и приглашения
+	Quotas quotasConfig `json:"quotas"`
+	// превью реферальных ссылок в мессенджерах
+	LinkPreview linkPreviewConfig `json:"link_preview"`
+	// внедрение сбоев хранилища для проверки устойчивости; только для
+	// тестовых стендов
+	Faults faultsConfig `json:"faults"`
+	// отладочный вывод при запуске, в том числе списка маршрутов, и
+	// заголовок Server-Timing в ответах на регистрацию и вход
+	Debug bool `json:"debug"`
+}
+
+// конфигурация HTTP-сервера. Сертификат и ключ задаются вместе: с ними
+// сервис принимает HTTPS на порту 443, без них - HTTP на порту 80.
+type serverConfig struct {
+	TLSCertFile string `json:"tls_cert_file"`
+	TLSKeyFile  string `json:"tls_key_file"`
+}
+
+// validate проверяет, что сертификат и ключ TLS заданы вместе
+func (c serverConfig) validate() error {
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return errors.New("tls_cert_file и tls_key_file задаются вместе")
+	}
+	return nil
+}
+
+// tls сообщает, включен ли HTTPS
+func (c serverConfig) tls() bool {
+	return c.TLSCertFile != ""
+}
+
+// addr возвращает адрес сервера
+func (c serverConfig) addr() string {
+	if c.tls() {
+		return ":443"
+	}
+	return ":80"
+}
+
+// listen запускает srv с HTTPS или HTTP в зависимости от конфигурации
+func (c serverConfig) listen(srv *http.Server) error {
+	if c.tls() {
+		return srv.ListenAndServeTLS(c.TLSCertFile, c.TLSKeyFile)
+	}
+	return srv.ListenAndServe()
+}
+
+// конфигурация API
+type apiConfig struct {
+	RetryAfterSeconds int `json:"retry_after_seconds"`
+	PageSize          int `json:"page_size"`
+	MaxPageSize       int `json:"max_page_size"`
+	// ограничение ошибок разбора тела запроса с одного IP; 0 - выключено
+	MaxDecodeFailures          int `json:"max_decode_failures"`
+	DecodeFailureWindowSeconds int `json:"decode_failure_window_seconds"`
+	// адрес перенаправления после перехода по реферальной ссылке /r/{code}
+	ClickRedirectURL string `json:"click_redirect_url"`
+	// больше 1 - несколько действующих кодов на пользователя с подписями
+	MaxCodesPerUser int `json:"max_codes_per_user"`
+	// ответы короче порога не сжимаются gzip; 0 - 1 КБ
+	CompressMinBytes int `json:"compress_min_bytes"`
+	// предел тела запроса после распаковки gzip; 0 - 1 МБ
+	MaxRequestBodyBytes int64 `json:"max_request_body_bytes"`
+	// минимальная длина пароля; 0 - пароль только не пустой
+	PasswordMinLength int `json:"password_min_length"`
+	// максимальная длина реферального кода; 0 - 50
+	MaxCodeLength int `json:"max_code_length"`
+	// наибольший срок действия реферального кода в днях; 0 - 365
+	MaxCodeLifetimeDays int `json:"max_code_lifetime_days"`
+	// одновременно обрабатываемые регистрации и входы и очередь к ним;
+	// сверх очереди - 503. 0 - без ограничения
+	MaxAuthInFlight int `json:"max_auth_in_flight"`
+	MaxAuthQueue    int `json:"max_auth_queue"`
+	// потолки бюджета времени, который клиент может запросить заголовком
+	// X-Request-Timeout, по группам маршрутов; 0 - значение по умолчанию
+	MaxAuthTimeoutSeconds  int `json:"max_auth_timeout_seconds"`
+	MaxUserTimeoutSeconds  int `json:"max_user_timeout_seconds"`
+	MaxAdminTimeoutSeconds int `json:"max_admin_timeout_seconds"`
+}
+
+// codeLifetime возвращает наибольший срок действия кода; 0 - по умолчанию
+func (c apiConfig) codeLifetime() time.Duration {
+	return time.Duration(c.MaxCodeLifetimeDays) * 24 * time.Hour
+}
+
+// options возвращает параметры API, заданные в конфигурации
+func (c apiConfig) options() []api.Option {
+	var opts []api.Option
+	if c.RetryAfterSeconds > 0 {
+		opts = append(opts, api.WithRetryAfter(time.Duration(c.RetryAfterSeconds)*time.Second))
+	}
+	if c.PageSize > 0 || c.MaxPageSize > 0 {
+		opts = append(opts, api.WithPagination(pagination.Defaults{Limit: c.PageSize, MaxLimit: c.MaxPageSize}))
+	}
+	if c.MaxDecodeFailures > 0 && c.DecodeFailureWindowSeconds > 0 {
+		opts = append(opts, api.WithDecodeFailureLimit(c.MaxDecodeFailures, time.Duration(c.DecodeFailureWindowSeconds)*time.Second))
+	}
+	if c.ClickRedirectURL != "" {
+		opts = append(opts, api.WithClickRedirect(c.ClickRedirectURL))
+	}
+	if c.MaxCodesPerUser > 1 {
+		opts = append(opts, api.WithMultipleCodes(c.MaxCodesPerUser))
+	}
+	if c.CompressMinBytes > 0 || c.MaxRequestBodyBytes > 0 {
+		opts = append(opts, api.WithCompression(c.CompressMinBytes, c.MaxRequestBodyBytes))
+	}
+	if c.PasswordMinLength > 0 || c.MaxCodeLength > 0 || c.MaxCodeLifetimeDays > 0 {
+		opts = append(opts, api.WithPolicy(api.Policy{
+			PasswordMinLength: c.PasswordMinLength,
+			CodeMaxLength:     c.MaxCodeLength,
+			CodeMaxLifetime:   c.codeLifetime(),
+		}))
+	}
+	if c.MaxAuthInFlight > 0 {
+		opts = append(opts, api.WithAuthConcurrency(c.MaxAuthInFlight, c.MaxAuthQueue))
+	}
+	opts = append(opts, api.WithTimeouts(api.Timeouts{
+		AuthMax:  time.Duration(c.MaxAuthTimeoutSeconds) * time.Second,
+		UserMax:  time.Duration(c.MaxUserTimeoutSeconds) * time.Second,
+		AdminMax: time.Duration(c.MaxAdminTimeoutSeconds) * time.Second,
+	}))
+	return opts
+}
+
+// конфигурация анализа подозрительной реферальной активности
+type fraudConfig struct {
+	MaxSignups       int `json:"max_signups"`
+	MaxSubnetSignups int `json:"max_subnet_signups"`
+	WindowHours      int `json:"window_hours"`
+	IntervalMinutes  int `json:"interval_minutes"`
+}
+
+// thresholds возвращает пороги анализа; незаданные значения берутся
+// из fraud.DefaultThresholds
+func (c fraudConfig) thresholds() fraud.Thresholds {
+	return fraud.Thresholds{
+		MaxSignups:       c.MaxSignups,
+		MaxSubnetSignups: c.MaxSubnetSignups,
+		Window:           time.Duration(c.WindowHours) * time.Hour,
+		Interval:         time.Duration(c.IntervalMinutes) * time.Minute,
+	}
+}
+
+// конфигурация вознаграждений рефереров
+type rewardsConfig struct {
+	// ступени по возрастанию накопительной границы up_to
+	Tiers rewards.Tiers `json:"tiers"`
+	// шаги, которые приглашенный должен выполнить, чтобы вознаграждение
+	// за него зачислилось: email_verified, first_login, profile_completed.
+	// Пусто - вознаграждение зачисляется сразу
+	RequiredSteps onboarding.Rules `json:"required_steps"`
+}
+
+// validate проверяет ступени и шаги. Подтвердить email можно только
+// входом по ссылке, поэтому без magic_link этот шаг недостижим.
+func (c rewardsConfig) validate(magicLink bool) error {
+	if err := c.Tiers.Validate(); err != nil {
+		return err
+	}
+	if err := c.RequiredSteps.Validate(); err != nil {
+		return err
+	}
+	for _, step := range c.RequiredSteps {
+		if step == onboarding.StepEmailVerified && !magicLink {
+			return fmt.Errorf("шаг %s требует включенного magic_link", step)
+		}
+	}
+	return nil
+}
+
+// конфигурация реферальных цепочек; 0 - значение по умолчанию
+type referralsConfig struct {
+	// регистрация по коду реферера, цепочка которого глубже, отклоняется
+	MaxChainDepth int `json:"max_chain_depth"`
+	// начиная с этой глубины регистрация пишет предупреждение в журнал
+	ChainDepthAlert int `json:"chain_depth_alert"`
+	// текущая версия условий программы: пока реферер ее не принял, он не
+	// может создавать коды, а его коды не действуют. Пусто - без условий
+	TermsVersion string `json:"terms_version"`
+}
+
+// storageOptions возвращает параметры хранилища, заданные в конфигурации
+func (c config) storageOptions() []storage.Option {
+	return []storage.Option{
+		storage.WithRewardTiers(c.Rewards.Tiers),
+		storage.WithOnboarding(c.Rewards.RequiredSteps),
+		storage.WithChainDepth(storage.ChainDepth{Max: c.Referrals.MaxChainDepth, Alert: c.Referrals.ChainDepthAlert}),
+		storage.WithTermsVersion(c.Referrals.TermsVersion),
+		storage.WithReadReplica(c.DB.ReadReplica),
+		storage.WithMaxCodeLifetime(c.API.codeLifetime()),
+	}
+}
+
+// конфигурация входа по одноразовой ссылке. Без почтового сервера
+// функцию нужно оставить выключенной.
+type magicLinkConfig struct {
+	Enabled            bool       `json:"enabled"`
+	BaseURL            string     `json:"base_url"` // внешний адрес сервиса для ссылок
+	MaxRequestsPerHour int        `json:"max_requests_per_hour"`
+	SMTP               smtpConfig `json:"smtp"`
+}
+
+// конфигурация токенов входа
+type authConfig struct {
+	// файл с секретом подписи токенов. Перечитывается по SIGHUP и
+	// POST /admin/keys/reload; пустой - секрет из JWT_SECRET без ротации
+	SecretFile string `json:"secret_file"`
+	// сколько минут после смены секрета принимаются токены прежнего
+	// ключа; 0 - весь срок жизни токена
+	RotationGraceMinutes int `json:"rotation_grace_minutes"`
+}
+
+// конфигурация регистрации. Незаданный флаг - способ включен.
+type registrationConfig struct {
+	// регистрация без реферального кода
+	OpenEnabled *bool `json:"open_enabled"`
+	// регистрация по реферальному коду
+	ReferralEnabled *bool `json:"referral_enabled"`
+	// недействительный код из заголовка X-Referral-Code или параметра
+	// ?ref= при регистрации через /register: reject (по умолчанию) -
+	// ошибка, ignore - регистрация без реферала с предупреждением
+	InvalidCode string `json:"invalid_code"`
+	// очередь регистраций по коду при пиковой нагрузке
+	Queue registrationQueueConfig `json:"queue"`
+}
+
+// options возвращает параметры API для регистрации
+func (c registrationConfig) options() []api.Option {
+	enabled := func(flag *bool) bool { return flag == nil || *flag }
+	invalidCode := c.InvalidCode
+	if invalidCode == "" {
+		invalidCode = api.InvalidCodeReject
+	}
+	opts := []api.Option{api.WithRegistration(api.Registration{
+		Open:        enabled(c.OpenEnabled),
+		Referral:    enabled(c.ReferralEnabled),
+		InvalidCode: invalidCode,
+	})}
+	if c.Queue.Enabled {
+		opts = append(opts, api.WithRegistrationQueue(c.Queue.queue()))
+	}
+	return opts
+}
+
+// конфигурация очереди регистраций: когда заняты все места
+// api.max_auth_in_flight и очередь к ним, регистрация по коду ставится в
+// очередь вместо ответа 503. 0 - значение по умолчанию
+type registrationQueueConfig struct {
+	Enabled        bool `json:"enabled"`
+	MaxPending     int  `json:"max_pending"` // сверх предела - 429
+	Workers        int  `json:"workers"`
+	PollIntervalMs int  `json:"poll_interval_ms"`
+	LeaseSeconds   int  `json:"lease_seconds"`    // повтор прерванной регистрации
+	ResultTTLHours int  `json:"result_ttl_hours"` // хранение итога для опроса статуса
+}
+
+func (c registrationQueueConfig) queue() api.RegistrationQueue {
+	return api.RegistrationQueue{
+		MaxPending:   c.MaxPending,
+		Workers:      c.Workers,
+		PollInterval: time.Duration(c.PollIntervalMs) * time.Millisecond,
+		Lease:        time.Duration(c.LeaseSeconds) * time.Second,
+		ResultTTL:    time.Duration(c.ResultTTLHours) * time.Hour,
+	}
+}
+
+// validate проверяет, что для включенной очереди задан ограничитель,
+// при заполнении которого регистрации ставятся в очередь
+func (c registrationQueueConfig) validate(authLimited bool) error {
+	if c.Enabled && !authLimited {
+		return errors.New("для registration.queue нужен api.max_auth_in_flight")
+	}
+	return nil
+}
+
+// конфигурация доставки событий; без получателей доставка выключена,
+// 0 - значение по умолчанию
+type webhooksConfig struct {
+	Targets         []webhookTarget `json:"targets"`
+	MaxAttempts     int             `json:"max_attempts"`
+	BackoffSeconds  int             `json:"backoff_seconds"`
+	IntervalSeconds int             `json:"interval_seconds"`
+	TimeoutSeconds  int             `json:"timeout_seconds"`
+}
+
+// получатель событий
+type webhookTarget struct {
+	URL    string `json:"url"`
+	Secret string `json:"secret"` // ключ подписи; пусто - без подписи
+}
+
+// dispatcher возвращает компонент доставки событий или nil, если
+// получатели не заданы
+func (c webhooksConfig) dispatcher(store storage.WebhookStore) *webhooks.Dispatcher {
+	if len(c.Targets) == 0 {
+		return nil
+	}
+	targets := make([]webhooks.Target, len(c.Targets))
+	for i, t := range c.Targets {
+		targets[i] = webhooks.Target{URL: t.URL, Secret: t.Secret}
+	}
+	return webhooks.NewDispatcher(store, webhooks.Config{
+		Targets:     targets,
+		MaxAttempts: c.MaxAttempts,
+		Backoff:     time.Duration(c.BackoffSeconds) * time.Second,
+		Interval:    time.Duration(c.IntervalSeconds) * time.Second,
+		Timeout:     time.Duration(c.TimeoutSeconds) * time.Second,
+	})
+}
+
+// конфигурация напоминаний об истечении срока кодов. Без почтового
+// сервера функцию нужно оставить выключенной; 0 - значение по умолчанию
+type remindersConfig struct {
+	Enabled         bool       `json:"enabled"`
+	WindowHours     int        `json:"window_hours"` // напоминать о кодах, истекающих в пределах окна
+	IntervalMinutes int        `json:"interval_minutes"`
+	BaseURL         string     `json:"base_url"` // внешний адрес сервиса для ссылки продления; пусто - без ссылки
+	SMTP            smtpConfig `json:"smtp"`
+}
+
+// validate проверяет, что для включенной функции задан почтовый сервер
+func (c remindersConfig) validate() error {
+	if c.Enabled && (c.SMTP.Addr == "" || c.SMTP.From == "") {
+		return errors.New("для reminders нужны smtp.addr и smtp.from")
+	}
+	return nil
+}
+
+// reminder возвращает компонент напоминаний или nil, если они выключены
+func (c remindersConfig) reminder(store storage.ReminderStore, templates *mailer.Templates) *reminders.Reminder {
+	if !c.Enabled {
+		return nil
+	}
+	return reminders.New(store,
+		mailer.SMTP{Addr: c.SMTP.Addr, From: c.SMTP.From, Username: c.SMTP.Username, Password: c.SMTP.Password},
+		templates,
+		reminders.Config{
+			Window:   time.Duration(c.WindowHours) * time.Hour,
+			Interval: time.Duration(c.IntervalMinutes) * time.Minute,
+			BaseURL:  c.BaseURL,
+		})
+}
+
+// конфигурация ежемесячных выписок по вознаграждениям. Без почтового
+// сервера функцию нужно оставить выключенной; 0 - значение по умолчанию
+type statementsConfig struct {
+	Enabled         bool       `json:"enabled"`
+	IntervalMinutes int        `json:"interval_minutes"`
+	SMTP            smtpConfig `json:"smtp"`
+}
+
+// validate проверяет, что для включенной функции задан почтовый сервер
+func (c statementsConfig) validate() error {
+	if c.Enabled && (c.SMTP.Addr == "" || c.SMTP.From == "") {
+		return errors.New("для statements нужны smtp.addr и smtp.from")
+	}
+	return nil
+}
+
+// sender возвращает компонент выписок или nil, если они выключены
+func (c statementsConfig) sender(store storage.StatementStore, templates *mailer.Templates) *statements.Sender {
+	if !c.Enabled {
+		return nil
+	}
+	return statements.New(store,
+		mailer.SMTP{Addr: c.SMTP.Addr, From: c.SMTP.From, Username: c.SMTP.Username, Password: c.SMTP.Password},
+		templates,
+		statements.Config{Interval: time.Duration(c.IntervalMinutes) * time.Minute})
+}
+
+// конфигурация очистки устаревших IP-адресов и User-Agent, завершенных
+// доставок событий и архива удаленных кодов; 0 - значение по умолчанию.
+// Срок хранения меньше retention.MinMaxAge не допускается.
+type retentionConfig struct {
+	Enabled           bool `json:"enabled"`
+	MaxAgeDays        int  `json:"max_age_days"`         // срок хранения персональных данных и доставок событий
+	ArchiveMaxAgeDays int  `json:"archive_max_age_days"` // срок хранения удаленных кодов
+	IntervalMinutes   int  `json:"interval_minutes"`
+	BatchSize         int  `json:"batch_size"`       // строк в одном запросе
+	MaxRowsPerRun     int  `json:"max_rows_per_run"` // предел строк за проход
+}
+
+func (c retentionConfig) config() retention.Config {
+	return retention.Config{
+		MaxAge:        time.Duration(c.MaxAgeDays) * 24 * time.Hour,
+		ArchiveMaxAge: time.Duration(c.ArchiveMaxAgeDays) * 24 * time.Hour,
+		Interval:      time.Duration(c.IntervalMinutes) * time.Minute,
+		BatchSize:     c.BatchSize,
+		MaxRows:       c.MaxRowsPerRun,
+	}
+}
+
+// validate проверяет срок хранения включенной очистки
+func (c retentionConfig) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	return c.config().Validate()
+}
+
+// scrubber возвращает компонент очистки или nil, если она выключена
+func (c retentionConfig) scrubber(store storage.RetentionStore) (*retention.Scrubber, error) {
+	if !c.Enabled {
+		return nil, nil
+	}
+	return retention.New(store, c.config())
+}
+
+// конфигурация виджета реферального кода; 0 - значение по умолчанию
+type widgetConfig struct {
+	Enabled bool `json:"enabled"`
+	// сайты партнеров, которым разрешено читать данные виджета; "*" - любые
+	Origins              []string `json:"origins"`
+	BaseURL              string   `json:"base_url"` // внешний адрес сервиса для ссылок
+	MaxRequestsPerMinute int      `json:"max_requests_per_minute"`
+}
+
+// validate проверяет, что для включенной функции задан адрес сервиса
+func (c widgetConfig) validate() error {
+	if c.Enabled && c.BaseURL == "" {
+		return errors.New("для widget нужен base_url")
+	}
+	return nil
+}
+
+// options возвращает параметры API для виджета
+func (c widgetConfig) options() []api.Option {
+	if !c.Enabled {
+		return nil
+	}
+	return []api.Option{api.WithWidget(api.Widget{
+		Origins:     c.Origins,
+		BaseURL:     c.BaseURL,
+		MaxRequests: c.MaxRequestsPerMinute,
+		Window:      time.Minute,
+	})}
+}
+
+// конфигурация квот пользователей; 0 - без ограничения
+type quotasConfig struct {
+	Enabled       bool `json:"enabled"`
+	CodesPerDay   int  `json:"codes_per_day"`
+	InvitesPerDay int  `json:"invites_per_day"`
+	ActiveCodes   int  `json:"active_codes"`
+}
+
+// validate проверяет, что квоты не отрицательные
+func (c quotasConfig) validate() error {
+	if c.CodesPerDay < 0 || c.InvitesPerDay < 0 || c.ActiveCodes < 0 {
+		return errors.New("квоты quotas не могут быть отрицательными")
+	}
+	return nil
+}
+
+// options возвращает параметры API для квот
+func (c quotasConfig) options() []api.Option {
+	if !c.Enabled {
+		return nil
+	}
+	return []api.Option{api.WithQuotas(api.Quotas{
+		CodesPerDay:   c.CodesPerDay,
+		InvitesPerDay: c.InvitesPerDay,
+		ActiveCodes:   c.ActiveCodes,
+	})}
+}
+
+// конфигурация превью реферальных ссылок /r/{code}
+type linkPreviewConfig struct {
+	Enabled     bool   `json:"enabled"`
+	Title       string `json:"title"`       // название программы
+	Description string `json:"description"` // описание программы в превью
+	ImageURL    string `json:"image_url"`
+	BaseURL     string `json:"base_url"` // внешний адрес сервиса для ссылок
+	// заголовок превью действующего кода, {name} - имя реферера
+	InviteTitle string `json:"invite_title"`
+}
+
+// validate проверяет, что для включенной функции заданы название и адрес
+func (c linkPreviewConfig) validate() error {
+	if c.Enabled && (c.Title == "" || c.BaseURL == "") {
+		return errors.New("для link_preview нужны title и base_url")
+	}
+	return nil
+}
+
+// options возвращает параметры API для превью ссылок
+func (c linkPreviewConfig) options() []api.Option {
+	if !c.Enabled {
+		return nil
+	}
+	return []api.Option{api.WithLinkPreview(api.LinkPreview{
+		Title:       c.Title,
+		Description: c.Description,
+		ImageURL:    c.ImageURL,
+		BaseURL:     c.BaseURL,
+		InviteTitle: c.InviteTitle,
+	})}
+}
+
+// конфигурация внедрения сбоев хранилища
+type faultsConfig struct {
+	Enabled bool               `json:"enabled"`
+	Rules   storage.FaultRules `json:"rules"` // начальные правила, меняются через /admin/faults
+}
+
+// validate проверяет начальные правила сбоев
+func (c faultsConfig) validate() error {
+	return c.Rules.Validate()
+}
+
+// конфигурация шаблонов писем
+type emailsConfig struct {
+	// каталог с файлами, заменяющими встроенные шаблоны; пусто - только встроенные
+	TemplatesDir string `json:"templates_dir"`
+	// название сервиса в письмах; пусто - gorefer
+	Brand string `json:"brand"`
+}
+
+// параметры SMTP-сервера
+type smtpConfig struct {
+	Addr     string `json:"addr"` // host:port
+	From     string `json:"from"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// validate проверяет, что для включенной функции заданы адреса
+func (c magicLinkConfig) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.BaseURL == "" || c.SMTP.Addr == "" || c.SMTP.From == "" {
+		return errors.New("для magic_link нужны base_url, smtp.addr и smtp.from")
+	}
+	return nil
+}
+
+// options возвращает параметры API для входа по ссылке
+func (c magicLinkConfig) options() []api.Option {
+	if !c.Enabled {
+		return nil
+	}
+	return []api.Option{api.WithMagicLinks(api.MagicLinks{
+		Mailer:      mailer.SMTP{Addr: c.SMTP.Addr, From: c.SMTP.From, Username: c.SMTP.Username, Password: c.SMTP.Password},
+		BaseURL:     c.BaseURL,
+		MaxRequests: c.MaxRequestsPerHour,
+		Window:      time.Hour,
+	})}
 }
 
 func main() {
+	err := command("./config.json", os.Args[1:], os.Stdout)
+	if err != nil && !errors.Is(err, flag.ErrHelp) {
+		log.Print(err)
+	}
+	os.Exit(exitCode(err))
+}
+
+// dsn возвращает строку подключения к БД
+func dsn(c storage.DBConfig) string {
+	return fmt.Sprintf("host=%s user=%s password=%s dbname=%s port=%d sslmode=%s", c.Host, c.User, c.Password, c.DBName, c.Port, c.SSLMode)
+}
+
+// seed выполняет команду "gorefer seed --profile <профиль>": применяет
+// миграции и загружает тестовые данные профиля. Повторный запуск
+// ничего не меняет.
+func seed(configPath string, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("seed", flag.ContinueOnError)
+	profile := flags.String("profile", storage.SeedMinimal, "профиль тестовых данных: minimal или demo")
+	asJSON := flags.Bool("json", false, "вывести результат в JSON")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	// профиль проверяется до подключения к БД
+	data, err := storage.SeedProfile(*profile)
+	if err != nil {
+		return &configError{err}
+	}
+
+	config, err := loadConfig(configPath)
+	if err != nil {
+		return err
+	}
+	dbInfo := dsn(config.DB)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	migrateCtx, cancel := context.WithTimeout(ctx, migrationTimeout)
+	defer cancel()
+	if err := migrations.RunMigrations(migrateCtx, dbInfo); err != nil {
+		return err
+	}
+	db, err := storage.New(dbInfo, config.storageOptions()...)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := db.Seed(ctx, *profile); err != nil {
+		return err
+	}
+	res := seedResult{Profile: *profile, Password: storage.SeedPassword}
+	for _, u := range data.Users {
+		if u.Role == storage.RoleAdmin {
+			admin, err := db.GetUserByEmail(ctx, u.Email)
+			if err != nil {
+				return err
+			}
+			res.AdminID = admin.ID
+			break
+		}
+	}
+	return writeResult(stdout, *asJSON, res)
+}
+
+// seedResult - результат команды seed
+type seedResult struct {
+	Profile  string `json:"profile"`
+	AdminID  int    `json:"admin_id,omitempty"` // 0 - в профиле нет администратора
+	Password string `json:"password"`
+}
+
+func (r seedResult) text() string {
+	s := fmt.Sprintf("Тестовые данные профиля %s загружены, пароль пользователей: %s", r.Profile, r.Password)
+	if r.AdminID != 0 {
+		s += fmt.Sprintf(", ID администратора: %d", r.AdminID)
+	}
+	return s
+}
+
+// importData выполняет команду "gorefer import --file users.csv --links
+// links.csv": переносит пользователей и реферальные связи из прежней
+// системы, см. storage.BulkImport. Отклоненные строки записываются в файл
+// --rejects; повторный запуск пропускает уже загруженное.
+func importData(configPath string, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	usersPath := flags.String("file", "", "CSV-файл пользователей: username,email,password_hash[,created_at,role]")
+	linksPath := flags.String("links", "", "CSV-файл связей: referrer_email,referee_email[,created_at,code]")
+	rejectsPath := flags.String("rejects", "import_rejects.csv", "файл отклоненных строк")
+	asJSON := flags.Bool("json", false, "вывести результат в JSON")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if *usersPath == "" && *linksPath == "" {
+		return &configError{errors.New("import: нужен --file или --links")}
+	}
+
+	// файлы разбираются до подключения к БД: ошибка в заголовке
+	// обнаружится сразу
+	var (
+		data    storage.ImportData
+		rejects []storage.ImportReject
+	)
+	if *usersPath != "" {
+		f, err := os.Open(*usersPath)
+		if err != nil {
+			return err
+		}
+		users, r, err := storage.ReadImportUsers(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		data.Users, rejects = users, append(rejects, r...)
+	}
+	if *linksPath != "" {
+		f, err := os.Open(*linksPath)
+		if err != nil {
+			return err
+		}
+		links, r, err := storage.ReadImportLinks(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		data.Links, rejects = links, append(rejects, r...)
+	}
+
+	config, err := loadConfig(configPath)
+	if err != nil {
+		return err
+	}
+	dbInfo := dsn(config.DB)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	migrateCtx, cancel := context.WithTimeout(ctx, migrationTimeout)
+	defer cancel()
+	if err := migrations.RunMigrations(migrateCtx, dbInfo); err != nil {
+		return err
+	}
+	db, err := storage.New(dbInfo, config.storageOptions()...)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	res, importErr := db.BulkImport(ctx, data)
+	rejects = append(rejects, res.Rejects...)
+	if err := writeImportRejects(*rejectsPath, rejects); err != nil {
+		return err
+	}
+	out := importResult{
+		UsersImported: res.UsersImported,
+		UsersSkipped:  res.UsersSkipped,
+		LinksImported: res.LinksImported,
+		LinksSkipped:  res.LinksSkipped,
+		Rejected:      len(rejects),
+	}
+	if len(rejects) > 0 {
+		out.RejectsFile = *rejectsPath
+	}
+	if importErr != nil {
+		// часть данных могла загрузиться до ошибки
+		log.Print(out.text())
+		return importErr
+	}
+	return writeResult(stdout, *asJSON, out)
+}
+
+// importResult - результат команды import
+type importResult struct {
+	UsersImported int    `json:"users_imported"`
+	UsersSkipped  int    `json:"users_skipped"`
+	LinksImported int    `json:"links_imported"`
+	LinksSkipped  int    `json:"links_skipped"`
+	Rejected      int    `json:"rejected"`
+	RejectsFile   string `json:"rejects_file,omitempty"` // пусто - отклоненных строк нет
+}
+
+func (r importResult) text() string {
+	s := fmt.Sprintf("Импорт: пользователей загружено %d, пропущено %d; связей загружено %d, пропущено %d; отклонено строк %d",
+		r.UsersImported, r.UsersSkipped, r.LinksImported, r.LinksSkipped, r.Rejected)
+	if r.RejectsFile != "" {
+		s += "\nОтклоненные строки записаны в " + r.RejectsFile
+	}
+	return s
+}
+
+// writeImportRejects записывает отклоненные строки импорта в CSV-файл
+// path. Без отклоненных строк файл не создается.
+func writeImportRejects(path string, rejects []storage.ImportReject) error {
+	if len(rejects) == 0 {
+		return nil
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"file", "line", "key", "reason"})
+	for _, r := range rejects {
+		w.Write([]string{r.File, strconv.Itoa(r.Line), r.Key, r.Reason})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// run инициализирует зависимости и запускает сервер. Все ошибки
+// инициализации возвращаются наверх, а ресурсы освобождаются здесь же.
+func run(configPath string) error {
 	// чтение и раскодирование файла конфигурации
-	b, err := os.ReadFile("./config.json")
+	config, err := loadConfig(configPath)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	var config config
-	err = json.Unmarshal(b, &config)
+
+	if config.Auth.SecretFile != "" {
+		keys, err := auth.NewKeyStore(auth.FileSecret(config.Auth.SecretFile))
+		if err != nil {
+			return err
+		}
+		auth.Keys = keys
+	}
+	auth.Keys.SetRotationGrace(time.Duration(config.Auth.RotationGraceMinutes) * time.Minute)
+
+	// шаблоны писем проверяются до запуска: ошибка в шаблоне
+	// обнаружится сразу, а не при первой отправке
+	templates, err := mailer.LoadTemplates(config.Emails.TemplatesDir, config.Emails.Brand)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+
 	// инициализация зависимостей приложения
-	dbInfo := fmt.Sprintf("host=%s user=%s password=%s dbname=%s port=%d sslmode=%s", config.DB.Host, config.DB.User, config.DB.Password, config.DB.DBName, config.DB.Port, config.DB.SSLMode)
+	dbInfo := dsn(config.DB)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// веб-сервер запускается сразу, до готовности зависимостей,
+	// чтобы проверки /healthz и /readyz отвечали во время миграций
+	rd := newReadiness()
+	srv := &http.Server{Addr: config.Server.addr(), Handler: rd}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- config.Server.listen(srv)
+	}()
+
+	var (
+		db *storage.DB
+		a  *api.API
+	)
+	warmupDone := make(chan struct{})
+	go func() {
+		defer close(warmupDone)
+		err := rd.warmUp(ctx, []warmupStep{
+			{"миграции", stateMigrating, func(ctx context.Context) error {
+				ctx, cancel := context.WithTimeout(ctx, migrationTimeout)
+				defer cancel()
+				return migrations.RunMigrations(ctx, dbInfo)
+			}},
+			{"подключение к БД", stateWarmingUp, func(ctx context.Context) (err error) {
+				db, err = storage.New(dbInfo, config.storageOptions()...)
+				return err
+			}},
+			{"проверка БД", stateWarmingUp, func(ctx context.Context) error {
+				return db.Ping(ctx)
+			}},
+			{"проверка схемы БД", stateWarmingUp, func(ctx context.Context) error {
+				return db.VerifySchema(ctx)
+			}},
+			{"проверка аутентификации", stateWarmingUp, func(ctx context.Context) error {
+				return auth.SelfCheck()
+			}},
+		})
+		if err != nil {
+			log.Printf("Сервис не готов: %v", err)
+			return
+		}
 
-	migrations.RunMigrations(dbInfo)
+		opts := append(config.API.options(), config.MagicLink.options()...)
+		opts = append(opts, config.Registration.options()...)
+		opts = append(opts, config.Widget.options()...)
+		opts = append(opts, config.Quotas.options()...)
+		opts = append(opts, config.LinkPreview.options()...)
+		opts = append(opts, api.WithEmailTemplates(templates))
+		opts = append(opts, api.WithServerTiming(config.Debug))
+		opts = append(opts, api.WithTermsVersion(config.Referrals.TermsVersion))
+		opts = append(opts, api.WithOverviewSource("db_pool", func(ctx context.Context) (interface{}, error) {
+			return db.PoolStats(), nil
+		}))
+		scrubber, err := config.Retention.scrubber(db)
+		if err != nil {
+			log.Printf("Сервис не готов: %v", err)
+			return
+		}
+		if scrubber != nil {
+			opts = append(opts, api.WithRetention(scrubber))
+		}
+		dispatcher := config.Webhooks.dispatcher(db)
+		if dispatcher != nil {
+			opts = append(opts, api.WithWebhooks(dispatcher), api.WithHooks(dispatcher.Hooks()))
+		}
+		// сбои внедряются только в вызовы хранилища из обработчиков API;
+		// фоновые компоненты работают с БД напрямую
+		var store storage.DBInterface = db
+		if config.Faults.Enabled {
+			log.Printf("Внимание: включено внедрение сбоев хранилища, правил: %d", len(config.Faults.Rules))
+			faulty := storage.NewFaulty(db, config.Faults.Rules)
+			store = faulty
+			opts = append(opts, api.WithFaultInjection(faulty))
+		}
+		a = api.New(store, opts...)
+		a.Register(api.ComponentFunc(reloadKeysOnHUP))
+		a.Register(fraud.NewAnalyzer(db, config.Fraud.thresholds()))
+		if dispatcher != nil {
+			a.Register(dispatcher)
+		}
+		if reminder := config.Reminders.reminder(db, templates); reminder != nil {
+			a.Register(reminder)
+		}
+		if sender := config.Statements.sender(db, templates); sender != nil {
+			a.Register(sender)
+		}
+		if scrubber != nil {
+			a.Register(scrubber)
+		}
+		a.Start(ctx)
+		rd.markReady(a.Router())
+		logBanner(srv.Addr, a.Routes(), config.Debug)
+	}()
+
+	// освобождение ресурсов после завершения прогрева
+	defer func() {
+		stop()
+		<-warmupDone
+		if a != nil {
+			if err := a.Close(); err != nil {
+				log.Println(err)
+			}
+		}
+		if db != nil {
+			db.Close()
+		}
+	}()
+
+	select {
+	case err := <-errCh:
+		return fmt.Errorf("веб-сервер: %w", err)
+	case <-ctx.Done():
+	}
 
-	db, err := storage.New(dbInfo)
+	// корректная остановка по сигналу
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("остановка веб-сервера: %w", err)
+	}
+	return nil
+}
+
+// logBanner выводит сводку запуска, а в режиме отладки - все маршруты
+// с цепочками middleware.
+func logBanner(addr string, routes []api.RouteInfo, debug bool) {
+	log.Printf("gorefer готов: addr=%s routes=%d debug=%t", addr, len(routes), debug)
+	if !debug {
+		return
+	}
+	for _, r := range routes {
+		log.Printf("route method=%s pattern=%s middleware=%s", r.Method, r.Pattern, strings.Join(r.Middleware, ","))
+	}
+}
+
+// reloadKeysOnHUP перечитывает секрет подписи токенов по сигналу SIGHUP.
+func reloadKeysOnHUP(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			if err := auth.Keys.Reload(); err != nil {
+				log.Printf("Ошибка перезагрузки ключей подписи: %v", err)
+				continue
+			}
+			log.Println("Ключи подписи токенов перезагружены")
+		}
+	}
+}
+
+// loadConfig читает файл конфигурации по указанному пути. Ошибки
+// оборачиваются в *configError.
+func loadConfig(path string) (config, error) {
+	c, err := readConfig(path)
 	if err != nil {
-		log.Fatal(err)
+		return c, &configError{err}
 	}
-	api := api.New(db)
+	return c, nil
+}
 
-	// запуск веб-сервера с API и приложением
-	err = http.ListenAndServe(":80", api.Router())
+func readConfig(path string) (config, error) {
+	b, err := os.ReadFile(path)
 	if err != nil {
-		log.Fatal(err)
+		return config{}, fmt.Errorf("чтение конфигурации %s: %w", path, err)
+	}
+	c, issues := checkConfig(b)
+	if len(issues) > 0 {
+		return c, fmt.Errorf("конфигурация %s: %w", path, issues)
 	}
+	return c, nil
 }
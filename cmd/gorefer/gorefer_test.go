@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"gorefer.go/pkg/api"
+	"gorefer.go/pkg/migrations"
+	"gorefer.go/pkg/storage"
+)
+
+func TestRun_BadConfigPath(t *testing.T) {
+	err := run("./nonexistent.json")
+	if err == nil {
+		t.Fatal("run() error = nil, want error")
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("run() error = %v, want wrapped fs.ErrNotExist", err)
+	}
+	if !strings.Contains(err.Error(), "nonexistent.json") {
+		t.Errorf("run() error = %q, want path in message", err)
+	}
+}
+
+// probe выполняет GET-запрос к readiness и возвращает код и тело ответа
+func probe(t *testing.T, h http.Handler, path string) (int, map[string]string) {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+	body := map[string]string{}
+	json.NewDecoder(rr.Body).Decode(&body)
+	return rr.Code, body
+}
+
+func TestReadiness_WarmUp(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	rd := newReadiness()
+
+	// во время миграций сервис жив, но не готов
+	migrating := make(chan struct{})
+	proceed := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- rd.warmUp(context.Background(), []warmupStep{
+			{"миграции", stateMigrating, func(ctx context.Context) error {
+				close(migrating)
+				<-proceed
+				return nil
+			}},
+			{"проверка БД", stateWarmingUp, func(ctx context.Context) error { return nil }},
+		})
+	}()
+	<-migrating
+
+	if code, _ := probe(t, rd, "/healthz"); code != http.StatusOK {
+		t.Errorf("/healthz = %d, want 200", code)
+	}
+	if code, body := probe(t, rd, "/readyz"); code != http.StatusServiceUnavailable || body["status"] != stateMigrating {
+		t.Errorf("/readyz = %d %v, want 503 migrating", code, body)
+	}
+	if code, _ := probe(t, rd, "/login"); code != http.StatusServiceUnavailable {
+		t.Errorf("/login before ready = %d, want 503", code)
+	}
+
+	close(proceed)
+	if err := <-done; err != nil {
+		t.Fatalf("warmUp() error = %v", err)
+	}
+	rd.markReady(api.New(storage.NewMockDBInterface(ctrl)).Router())
+
+	if code, body := probe(t, rd, "/readyz"); code != http.StatusOK || body["status"] != stateReady {
+		t.Errorf("/readyz = %d %v, want 200 ready", code, body)
+	}
+	// запросы передаются API: неверный метод обрабатывает маршрутизатор
+	if code, _ := probe(t, rd, "/login"); code != http.StatusMethodNotAllowed {
+		t.Errorf("/login after ready = %d, want 405 from router", code)
+	}
+}
+
+func TestReadiness_WarmUpFailure(t *testing.T) {
+	rd := newReadiness()
+
+	err := rd.warmUp(context.Background(), []warmupStep{
+		{"миграции", stateMigrating, func(ctx context.Context) error { return nil }},
+		{"проверка БД", stateWarmingUp, func(ctx context.Context) error { return errors.New("connection refused") }},
+		{"проверка аутентификации", stateWarmingUp, func(ctx context.Context) error {
+			t.Error("step after failure must not run")
+			return nil
+		}},
+	})
+	if err == nil {
+		t.Fatal("warmUp() error = nil, want error")
+	}
+
+	code, body := probe(t, rd, "/readyz")
+	if code != http.StatusServiceUnavailable || body["status"] != stateFailed {
+		t.Errorf("/readyz = %d %v, want 503 failed", code, body)
+	}
+	if body["reason"] != "проверка БД: connection refused" {
+		t.Errorf("reason = %q", body["reason"])
+	}
+	if code, _ := probe(t, rd, "/healthz"); code != http.StatusOK {
+		t.Errorf("/healthz = %d, want 200", code)
+	}
+}
+
+func TestSeed_Arguments(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr error
+	}{
+		{"Unknown profile", []string{"--profile", "huge"}, storage.ErrUnknownSeedProfile},
+		{"Unknown flag", []string{"--force"}, nil},
+		{"Extra argument", []string{"--profile", "demo", "now"}, nil},
+		// профиль корректен, ошибка - чтение конфигурации
+		{"Missing config", []string{"--profile=demo"}, fs.ErrNotExist},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := seed("./nonexistent.json", tt.args, io.Discard)
+			if err == nil {
+				t.Fatal("seed() error = nil, want error")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("seed() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestImport_Arguments(t *testing.T) {
+	dir := t.TempDir()
+	badHeader := filepath.Join(dir, "bad.csv")
+	users := filepath.Join(dir, "users.csv")
+	if err := os.WriteFile(badHeader, []byte("name,mail\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(users, []byte("username,email,password_hash\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr error
+	}{
+		{"No files", nil, nil},
+		{"Unknown flag", []string{"--force"}, nil},
+		{"Extra argument", []string{"--file", users, "now"}, nil},
+		{"Missing file", []string{"--file", filepath.Join(dir, "none.csv")}, fs.ErrNotExist},
+		{"Bad header", []string{"--file", badHeader}, nil},
+		// файлы корректны, ошибка - чтение конфигурации
+		{"Missing config", []string{"--file", users}, fs.ErrNotExist},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := importData("./nonexistent.json", tt.args, io.Discard)
+			if err == nil {
+				t.Fatal("importData() error = nil, want error")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("importData() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWriteImportRejects(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rejects.csv")
+	if err := writeImportRejects(path, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("rejects file created without rejects: %v", err)
+	}
+
+	err := writeImportRejects(path, []storage.ImportReject{
+		{File: "users", Line: 3, Key: "a@example.com", Reason: "email повторяется, см. строку 2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "file,line,key,reason\nusers,3,a@example.com,\"email повторяется, см. строку 2\"\n"
+	if string(got) != want {
+		t.Errorf("rejects file = %q, want %q", got, want)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"Success", nil, exitOK},
+		{"Help", flag.ErrHelp, exitOK},
+		{"Other", errors.New("boom"), exitFailure},
+		{"Config", &configError{errors.New("bad")}, exitConfig},
+		{"Wrapped config", fmt.Errorf("seed: %w", &configError{fs.ErrNotExist}), exitConfig},
+		{"Migration failed", fmt.Errorf("%w: syntax error", migrations.ErrFailed), exitMigration},
+		{"Migration locked", migrations.ErrLocked, exitMigration},
+		{"Unhealthy", errUnhealthy, exitUnhealthy},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exitCode(tt.err); got != tt.want {
+				t.Errorf("exitCode(%v) = %d, want %d", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCommand_ExitCodes(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want int
+	}{
+		{"Unknown command", []string{"deploy"}, exitConfig},
+		{"Unknown flag", []string{"migrate", "--force"}, exitConfig},
+		{"Extra argument", []string{"healthcheck", "now"}, exitConfig},
+		{"Missing config", []string{"migrate", "--json"}, exitConfig},
+		{"Unknown seed profile", []string{"seed", "--profile", "huge"}, exitConfig},
+		{"Import without files", []string{"import"}, exitConfig},
+		{"Flag help", []string{"seed", "-h"}, exitOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := command("./nonexistent.json", tt.args, &out)
+			if got := exitCode(err); got != tt.want {
+				t.Errorf("exit code = %d (%v), want %d", got, err, tt.want)
+			}
+			if out.Len() != 0 {
+				t.Errorf("stdout = %q, want empty", out.String())
+			}
+		})
+	}
+}
+
+func TestCommand_Help(t *testing.T) {
+	var out bytes.Buffer
+	if err := command("./nonexistent.json", []string{"help"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"migrate", "seed", "import", "healthcheck", "--json", "Коды завершения"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("help has no %q", want)
+		}
+	}
+}
+
+func TestHealthcheck(t *testing.T) {
+	ready := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/readyz" && !ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	var out bytes.Buffer
+	if err := healthcheck([]string{"--url", srv.URL + "/", "--json"}, &out); err != nil {
+		t.Fatalf("healthcheck() error = %v", err)
+	}
+	var res healthResult
+	if err := json.Unmarshal(out.Bytes(), &res); err != nil {
+		t.Fatalf("stdout is not JSON: %v: %q", err, out.String())
+	}
+	if !res.Healthy || len(res.Checks) != 2 || res.Checks[0].Name != "healthz" || res.Checks[1].Status != http.StatusOK {
+		t.Errorf("result = %+v", res)
+	}
+
+	ready = false
+	out.Reset()
+	err := healthcheck([]string{"--url", srv.URL, "--json"}, &out)
+	if exitCode(err) != exitUnhealthy {
+		t.Fatalf("exit code = %d (%v), want %d", exitCode(err), err, exitUnhealthy)
+	}
+	if err := json.Unmarshal(out.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Healthy || res.Checks[1].Status != http.StatusServiceUnavailable {
+		t.Errorf("result = %+v", res)
+	}
+
+	// сервис недоступен: результат выводится текстом
+	srv.Close()
+	out.Reset()
+	err = healthcheck([]string{"--url", srv.URL, "--timeout", "1s"}, &out)
+	if exitCode(err) != exitUnhealthy {
+		t.Fatalf("exit code = %d (%v), want %d", exitCode(err), err, exitUnhealthy)
+	}
+	if !strings.HasPrefix(out.String(), "Сервис не готов") {
+		t.Errorf("stdout = %q", out.String())
+	}
+}
+
+func TestWriteResult(t *testing.T) {
+	res := migrateResult{migrations.Result{From: 1, To: 3, Applied: []migrations.Migration{
+		{Version: 2, Name: "2_b.sql"}, {Version: 3, Name: "3_c.sql"},
+	}}}
+
+	var out bytes.Buffer
+	if err := writeResult(&out, true, res); err != nil {
+		t.Fatal(err)
+	}
+	want := `{"from":1,"to":3,"applied":[{"version":2,"name":"2_b.sql"},{"version":3,"name":"3_c.sql"}]}` + "\n"
+	if out.String() != want {
+		t.Errorf("JSON = %s, want %s", out.String(), want)
+	}
+
+	out.Reset()
+	if err := writeResult(&out, false, res); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "с версии 1 до 3") || !strings.Contains(out.String(), "3 3_c.sql") {
+		t.Errorf("text = %q", out.String())
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	const db = `"db": {"host": "localhost", "user": "postgres", "dbname": "postgres", "port": 5432}`
+	tests := []struct {
+		name      string
+		config    string
+		wantPaths []string
+	}{
+		{"Minimal", `{` + db + `}`, nil},
+		{"Syntax error", "{\n  " + db + ",\n}", []string{""}},
+		{"Trailing data", `{` + db + `} {}`, []string{""}},
+		{"Missing db", `{}`, []string{"db"}},
+		{"Missing required field", `{"db": {"host": "localhost", "user": "postgres", "port": 5432}}`, []string{"db.dbname"}},
+		{"Typo", `{"db": {"host": "localhost", "user": "postgres", "dbname": "postgres", "port": 5432, "slmode": "disable"}}`, []string{"db.slmode"}},
+		{"Unknown section", `{` + db + `, "tls": {}}`, []string{"tls"}},
+		{"Wrong types", `{` + db + `, "debug": "yes", "api": {"page_size": 1.5, "retry_after_seconds": "5"}}`,
+			[]string{"api.page_size", "api.retry_after_seconds", "debug"}},
+		{"Port out of range", `{"db": {"host": "localhost", "user": "postgres", "dbname": "postgres", "port": 70000}}`, []string{"db.port"}},
+		{"Unknown sslmode", `{"db": {"host": "localhost", "user": "postgres", "dbname": "postgres", "port": 5432, "sslmode": "on"}}`, []string{"db.sslmode"}},
+		{"Array items", `{` + db + `, "rewards": {"tiers": [{"up_to": 5, "amount": 500}, {"upto": 25}], "required_steps": ["first_login", "kyc"]}}`,
+			[]string{"rewards.required_steps[1]", "rewards.tiers[1].upto"}},
+		{"Nullable flag", `{` + db + `, "registration": {"open_enabled": null}}`, nil},
+		{"Cross-field constraint", `{` + db + `, "magic_link": {"enabled": true}, "widget": {"enabled": true}}`, []string{"magic_link", "widget"}},
+		{"Queue needs auth limiter", `{` + db + `, "registration": {"queue": {"enabled": true}}}`, []string{"registration.queue"}},
+		{"Queue with auth limiter", `{` + db + `, "api": {"max_auth_in_flight": 8}, "registration": {"queue": {"enabled": true}}}`, nil},
+		{"Step needs magic link", `{` + db + `, "rewards": {"required_steps": ["email_verified"]}}`, []string{"rewards"}},
+		{"TLS cert without key", `{` + db + `, "server": {"tls_cert_file": "cert.pem"}}`, []string{"server"}},
+		{"TLS key without cert", `{` + db + `, "server": {"tls_key_file": "key.pem"}}`, []string{"server"}},
+		{"TLS cert and key", `{` + db + `, "server": {"tls_cert_file": "cert.pem", "tls_key_file": "key.pem"}}`, nil},
+		{"Fault rules", `{` + db + `, "faults": {"rules": [{"method": "", "probability": 0.5}]}}`, []string{"faults.rules"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, issues := checkConfig([]byte(tt.config))
+			var paths []string
+			for _, issue := range issues {
+				paths = append(paths, issue.Path)
+			}
+			if !reflect.DeepEqual(paths, tt.wantPaths) {
+				t.Errorf("paths = %q, want %q (%v)", paths, tt.wantPaths, issues)
+			}
+		})
+	}
+}
+
+func TestCheckConfig_Sample(t *testing.T) {
+	b, err := os.ReadFile("config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, issues := checkConfig(b); len(issues) > 0 {
+		t.Errorf("config.json: %v", issues)
+	}
+}
+
+// config.schema.json обновляется go generate при изменении config
+func TestConfigSchema_UpToDate(t *testing.T) {
+	var out bytes.Buffer
+	if err := command("./config.json", []string{"config", "schema"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(configSchemaFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), b) {
+		t.Errorf("%s is out of date, run go generate ./cmd/gorefer", configSchemaFile)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"db": {"host": "localhost", "port": "5432"}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	err := command("./config.json", []string{"config", "validate", "--file", path, "--json"}, &out)
+	if exitCode(err) != exitConfig {
+		t.Fatalf("exit code = %d (%v), want %d", exitCode(err), err, exitConfig)
+	}
+	var res validateResult
+	if err := json.Unmarshal(out.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	want := configIssues{
+		{Path: "db.port", Message: "ожидается integer, получено string"},
+		{Path: "db.user", Message: "обязательное поле"},
+		{Path: "db.dbname", Message: "обязательное поле"},
+	}
+	if res.Valid || !reflect.DeepEqual(res.Errors, want) {
+		t.Errorf("result = %+v, want errors %v", res, want)
+	}
+
+	// loadConfig сообщает те же ошибки
+	if _, err := loadConfig(path); exitCode(err) != exitConfig || !strings.Contains(err.Error(), "db.port: ожидается integer") {
+		t.Errorf("loadConfig() error = %v", err)
+	}
+
+	out.Reset()
+	if err := command("./config.json", []string{"config", "validate"}, &out); err != nil {
+		t.Fatalf("sample config: %v", err)
+	}
+	if !strings.Contains(out.String(), "корректна") {
+		t.Errorf("stdout = %q", out.String())
+	}
+	if err := command("./config.json", []string{"config", "lint"}, &out); exitCode(err) != exitConfig {
+		t.Errorf("unknown subcommand: exit code = %d, want %d", exitCode(err), exitConfig)
+	}
+}
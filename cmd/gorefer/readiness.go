@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// Состояния готовности сервиса
+const (
+	stateStarting  = "starting"
+	stateMigrating = "migrating"
+	stateWarmingUp = "warming_up"
+	stateReady     = "ready"
+	stateFailed    = "failed"
+)
+
+// readiness хранит состояние запуска сервиса и отдает /healthz и /readyz.
+// Остальные запросы передаются обработчику API только после готовности.
+type readiness struct {
+	mu     sync.RWMutex
+	state  string
+	reason string
+	next   http.Handler
+}
+
+// Шаг прогрева сервиса
+type warmupStep struct {
+	name  string
+	state string
+	run   func(ctx context.Context) error
+}
+
+func newReadiness() *readiness {
+	return &readiness{state: stateStarting}
+}
+
+// set переводит сервис в указанное состояние
+func (rd *readiness) set(state, reason string) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	rd.state, rd.reason = state, reason
+}
+
+// markReady открывает доступ к обработчику API
+func (rd *readiness) markReady(next http.Handler) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	rd.state, rd.reason, rd.next = stateReady, "", next
+}
+
+// status возвращает текущее состояние и причину неготовности
+func (rd *readiness) status() (string, string, http.Handler) {
+	rd.mu.RLock()
+	defer rd.mu.RUnlock()
+	return rd.state, rd.reason, rd.next
+}
+
+// warmUp последовательно выполняет шаги прогрева. При ошибке сервис
+// остается неготовым, а причина сохраняется для /readyz.
+func (rd *readiness) warmUp(ctx context.Context, steps []warmupStep) error {
+	for _, step := range steps {
+		rd.set(step.state, "")
+		if err := step.run(ctx); err != nil {
+			err = fmt.Errorf("%s: %w", step.name, err)
+			rd.set(stateFailed, err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+func (rd *readiness) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	state, reason, next := rd.status()
+
+	switch r.URL.Path {
+	case "/healthz":
+		writeStatus(w, http.StatusOK, "alive", "")
+		return
+	case "/readyz":
+		if state == stateReady {
+			writeStatus(w, http.StatusOK, state, "")
+			return
+		}
+		writeStatus(w, http.StatusServiceUnavailable, state, reason)
+		return
+	}
+
+	if state != stateReady {
+		writeStatus(w, http.StatusServiceUnavailable, state, reason)
+		return
+	}
+	next.ServeHTTP(w, r)
+}
+
+// writeStatus отправляет состояние сервиса в формате JSON
+func writeStatus(w http.ResponseWriter, code int, state, reason string) {
+	response := struct {
+		Status string `json:"status"`
+		Reason string `json:"reason,omitempty"`
+	}{state, reason}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,23 @@
+-- +goose Up
+ALTER TABLE users ADD COLUMN IF NOT EXISTS role VARCHAR(20) NOT NULL DEFAULT 'user';
+
+ALTER TABLE referral_codes ADD COLUMN IF NOT EXISTS uses INT NOT NULL DEFAULT 0;
+ALTER TABLE referral_codes ADD COLUMN IF NOT EXISTS max_uses INT;
+ALTER TABLE referral_codes ADD COLUMN IF NOT EXISTS revoked_at TIMESTAMP WITH TIME ZONE;
+
+CREATE TABLE IF NOT EXISTS referral_clicks (
+    id SERIAL PRIMARY KEY,
+    referral_code_id INT NOT NULL REFERENCES referral_codes(id) ON DELETE CASCADE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Индекс для подсчета переходов по коду
+CREATE INDEX IF NOT EXISTS idx_referral_clicks_code_id ON referral_clicks(referral_code_id);
+
+
+-- +goose Down
+DROP TABLE IF EXISTS referral_clicks;
+ALTER TABLE referral_codes DROP COLUMN IF EXISTS revoked_at;
+ALTER TABLE referral_codes DROP COLUMN IF EXISTS max_uses;
+ALTER TABLE referral_codes DROP COLUMN IF EXISTS uses;
+ALTER TABLE users DROP COLUMN IF EXISTS role;
@@ -0,0 +1,13 @@
+-- +goose Up
+-- Код, по которому пришел реферал. Сохраняется строкой, так как
+-- сами коды удаляются при ротации.
+ALTER TABLE referral_links ADD COLUMN IF NOT EXISTS code VARCHAR(50);
+
+CREATE INDEX IF NOT EXISTS idx_referral_links_created_at ON referral_links(created_at);
+CREATE INDEX IF NOT EXISTS idx_users_created_at ON users(created_at);
+
+
+-- +goose Down
+DROP INDEX IF EXISTS idx_users_created_at;
+DROP INDEX IF EXISTS idx_referral_links_created_at;
+ALTER TABLE referral_links DROP COLUMN IF EXISTS code;
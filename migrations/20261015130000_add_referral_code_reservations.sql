@@ -0,0 +1,20 @@
+-- +goose Up
+-- Зарезервированный код привязан к email и не имеет владельца до
+-- регистрации пользователя с этим email.
+ALTER TABLE referral_codes ADD COLUMN IF NOT EXISTS status VARCHAR(20) NOT NULL DEFAULT 'active';
+ALTER TABLE referral_codes ADD COLUMN IF NOT EXISTS reserved_email VARCHAR(100);
+ALTER TABLE referral_codes ALTER COLUMN user_id DROP NOT NULL;
+ALTER TABLE referral_codes ADD CONSTRAINT referral_codes_owner_check
+    CHECK ((status = 'reserved' AND reserved_email IS NOT NULL) OR (status = 'active' AND user_id IS NOT NULL));
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_referral_codes_reserved_email
+    ON referral_codes(lower(reserved_email)) WHERE status = 'reserved';
+
+
+-- +goose Down
+DROP INDEX IF EXISTS idx_referral_codes_reserved_email;
+DELETE FROM referral_codes WHERE status = 'reserved';
+ALTER TABLE referral_codes DROP CONSTRAINT IF EXISTS referral_codes_owner_check;
+ALTER TABLE referral_codes ALTER COLUMN user_id SET NOT NULL;
+ALTER TABLE referral_codes DROP COLUMN IF EXISTS reserved_email;
+ALTER TABLE referral_codes DROP COLUMN IF EXISTS status;
@@ -0,0 +1,11 @@
+-- +goose Up
+-- Токен клиента для распознавания повторной отправки запроса на создание кода.
+ALTER TABLE referral_codes ADD COLUMN IF NOT EXISTS client_token VARCHAR(100);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_referral_codes_client_token
+    ON referral_codes(user_id, client_token) WHERE client_token IS NOT NULL;
+
+
+-- +goose Down
+DROP INDEX IF EXISTS idx_referral_codes_client_token;
+ALTER TABLE referral_codes DROP COLUMN IF EXISTS client_token;
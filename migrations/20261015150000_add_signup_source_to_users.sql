@@ -0,0 +1,9 @@
+-- +goose Up
+-- Платформа и клиент, с которых пользователь зарегистрировался.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS signup_source VARCHAR(20) NOT NULL DEFAULT 'unknown';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS user_agent VARCHAR(512);
+
+
+-- +goose Down
+ALTER TABLE users DROP COLUMN IF EXISTS user_agent;
+ALTER TABLE users DROP COLUMN IF EXISTS signup_source;
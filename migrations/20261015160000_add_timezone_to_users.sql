@@ -0,0 +1,7 @@
+-- +goose Up
+-- Часовой пояс пользователя (имя IANA) для отображения времени.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS timezone VARCHAR(64) NOT NULL DEFAULT 'UTC';
+
+
+-- +goose Down
+ALTER TABLE users DROP COLUMN IF EXISTS timezone;
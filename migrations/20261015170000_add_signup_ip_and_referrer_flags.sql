@@ -0,0 +1,23 @@
+-- +goose Up
+-- IP-адрес регистрации для поиска подозрительных скоплений рефералов.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS signup_ip INET;
+
+-- Отметки о подозрительной активности рефереров.
+CREATE TABLE IF NOT EXISTS referrer_flags (
+    id SERIAL PRIMARY KEY,
+    referrer_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    score NUMERIC(6, 2) NOT NULL,
+    reasons TEXT[] NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    reviewed_at TIMESTAMP WITH TIME ZONE
+);
+
+-- Не больше одной непросмотренной отметки на реферера
+CREATE UNIQUE INDEX IF NOT EXISTS idx_referrer_flags_open
+    ON referrer_flags(referrer_id) WHERE reviewed_at IS NULL;
+
+
+-- +goose Down
+DROP TABLE IF EXISTS referrer_flags;
+ALTER TABLE users DROP COLUMN IF EXISTS signup_ip;
@@ -0,0 +1,12 @@
+-- +goose Up
+-- Произвольные метаданные кода для учета кампаний (тираж, команда, статья затрат)
+ALTER TABLE referral_codes ADD COLUMN IF NOT EXISTS metadata JSONB NOT NULL DEFAULT '{}';
+
+-- Фильтрация списка кодов по вхождению (@>)
+CREATE INDEX IF NOT EXISTS idx_referral_codes_metadata
+    ON referral_codes USING GIN (metadata jsonb_path_ops);
+
+
+-- +goose Down
+DROP INDEX IF EXISTS idx_referral_codes_metadata;
+ALTER TABLE referral_codes DROP COLUMN IF EXISTS metadata;
@@ -0,0 +1,16 @@
+-- +goose Up
+-- Начисленные вознаграждения рефереров: одно на приглашенного пользователя.
+CREATE TABLE IF NOT EXISTS referral_rewards (
+    id SERIAL PRIMARY KEY,
+    referrer_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    referee_id INT NOT NULL UNIQUE REFERENCES users(id) ON DELETE CASCADE,
+    tier INT NOT NULL,
+    amount BIGINT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_referral_rewards_referrer_id ON referral_rewards(referrer_id);
+
+
+-- +goose Down
+DROP TABLE IF EXISTS referral_rewards;
@@ -0,0 +1,9 @@
+-- +goose Up
+-- Канал атрибуции: код введен вручную или сохранен при переходе по ссылке.
+ALTER TABLE referral_links ADD COLUMN IF NOT EXISTS channel VARCHAR(20) NOT NULL DEFAULT 'manual_code';
+ALTER TABLE referral_links ADD COLUMN IF NOT EXISTS click_id INT REFERENCES referral_clicks(id) ON DELETE SET NULL;
+
+
+-- +goose Down
+ALTER TABLE referral_links DROP COLUMN IF EXISTS click_id;
+ALTER TABLE referral_links DROP COLUMN IF EXISTS channel;
@@ -0,0 +1,15 @@
+-- +goose Up
+-- Использованные одноразовые ссылки входа. Запись хранится до истечения
+-- срока ссылки, после чего повторное использование отсекается подписью.
+CREATE TABLE IF NOT EXISTS magic_link_tokens (
+    jti VARCHAR(64) PRIMARY KEY,
+    email VARCHAR(100) NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    consumed_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_magic_link_tokens_expires_at ON magic_link_tokens(expires_at);
+
+
+-- +goose Down
+DROP TABLE IF EXISTS magic_link_tokens;
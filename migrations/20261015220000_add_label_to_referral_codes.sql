@@ -0,0 +1,7 @@
+-- +goose Up
+-- Подпись кода, когда у пользователя их несколько (например, канал продвижения)
+ALTER TABLE referral_codes ADD COLUMN IF NOT EXISTS label VARCHAR(50);
+
+
+-- +goose Down
+ALTER TABLE referral_codes DROP COLUMN IF EXISTS label;
@@ -0,0 +1,22 @@
+-- +goose Up
+-- Имена пользователей проверяются при регистрации и смене имени: 3-32
+-- символа, буквы, цифры и . _ -, первый символ - буква или цифра,
+-- форма NFC, не зарезервированное имя (admin, support, root).
+-- Существующие имена, нарушающие правила, не меняются: они только
+-- отмечаются, чтобы поддержка могла попросить владельцев сменить имя.
+-- Отметка снимается при смене имени через PATCH /p/me. Проверка здесь
+-- приблизительная: похожие символы в зарезервированных именах
+-- распознаются только кодом сервиса.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS username_flagged_at TIMESTAMPTZ;
+
+UPDATE users SET username_flagged_at = NOW()
+WHERE anonymized_at IS NULL AND (
+    char_length(username) NOT BETWEEN 3 AND 32
+    OR username !~ '^[[:alnum:]][[:alnum:]._-]*$'
+    OR username IS NFC NORMALIZED IS NOT TRUE
+    OR lower(username) IN ('admin', 'support', 'root')
+);
+
+
+-- +goose Down
+ALTER TABLE users DROP COLUMN IF EXISTS username_flagged_at;
@@ -0,0 +1,20 @@
+-- +goose Up
+-- Время последнего успешного входа для поиска неактивных учетных записей.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS last_login_at TIMESTAMP WITH TIME ZONE;
+
+-- История входов, включая неудачные попытки.
+CREATE TABLE IF NOT EXISTS login_events (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    ip INET,
+    user_agent VARCHAR(512),
+    success BOOLEAN NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_login_events_user ON login_events(user_id, created_at DESC);
+
+
+-- +goose Down
+DROP TABLE IF EXISTS login_events;
+ALTER TABLE users DROP COLUMN IF EXISTS last_login_at;
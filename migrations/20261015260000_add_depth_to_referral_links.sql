@@ -0,0 +1,25 @@
+-- +goose Up
+-- Глубина связи в реферальной цепочке: 1 для реферера без собственного
+-- реферера, далее на единицу больше глубины связи реферера. Хранится,
+-- чтобы при регистрации ограничивать глубину без обхода цепочки.
+ALTER TABLE referral_links ADD COLUMN IF NOT EXISTS depth INT NOT NULL DEFAULT 1;
+
+-- Заполнение для существующих связей. Ограничение по числу связей
+-- гарантирует завершение даже при цикле в данных.
+WITH RECURSIVE chain AS (
+    SELECT rl.id, rl.referee_id, 1 AS depth
+    FROM referral_links rl
+    WHERE NOT EXISTS (SELECT 1 FROM referral_links p WHERE p.referee_id = rl.referrer_id)
+    UNION ALL
+    SELECT rl.id, rl.referee_id, c.depth + 1
+    FROM referral_links rl
+    JOIN chain c ON rl.referrer_id = c.referee_id
+    WHERE c.depth < (SELECT COUNT(*) FROM referral_links)
+)
+UPDATE referral_links rl SET depth = c.depth
+FROM (SELECT id, MAX(depth) AS depth FROM chain GROUP BY id) c
+WHERE c.id = rl.id;
+
+
+-- +goose Down
+ALTER TABLE referral_links DROP COLUMN IF EXISTS depth;
@@ -0,0 +1,17 @@
+-- +goose Up
+-- Списания вознаграждений: отрицательные записи баланса пользователя.
+-- balance_after - остаток после списания, для сверки.
+CREATE TABLE IF NOT EXISTS reward_redemptions (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    amount BIGINT NOT NULL CHECK (amount < 0),
+    balance_after BIGINT NOT NULL CHECK (balance_after >= 0),
+    note TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_reward_redemptions_user_id ON reward_redemptions(user_id);
+
+
+-- +goose Down
+DROP TABLE IF EXISTS reward_redemptions;
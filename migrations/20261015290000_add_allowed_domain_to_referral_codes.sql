@@ -0,0 +1,10 @@
+-- +goose Up
+-- Коды партнерских программ: регистрироваться по коду можно только с
+-- email в домене allowed_domain, а при allow_subdomains - и в его поддоменах.
+ALTER TABLE referral_codes ADD COLUMN IF NOT EXISTS allowed_domain TEXT;
+ALTER TABLE referral_codes ADD COLUMN IF NOT EXISTS allow_subdomains BOOLEAN NOT NULL DEFAULT FALSE;
+
+
+-- +goose Down
+ALTER TABLE referral_codes DROP COLUMN IF EXISTS allow_subdomains;
+ALTER TABLE referral_codes DROP COLUMN IF EXISTS allowed_domain;
@@ -0,0 +1,22 @@
+-- +goose Up
+-- Ссылки вида /r/@username находят пользователя по имени без учета
+-- регистра, поэтому имена уникальны в нижнем регистре. Совпадающие имена,
+-- заведенные раньше, кроме самого старого, получают суффикс с id и
+-- отметку username_flagged_at, как имена вне правил.
+UPDATE users u
+SET username = left(u.username, 50 - length('-' || u.id)) || '-' || u.id,
+    username_flagged_at = NOW()
+WHERE EXISTS (
+    SELECT 1 FROM users o WHERE lower(o.username) = lower(u.username) AND o.id < u.id
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS users_username_lower_key ON users (lower(username));
+
+-- Пользователь может отключить ссылку по имени: /r/@username отвечает 404
+ALTER TABLE users ADD COLUMN IF NOT EXISTS vanity_link_opt_out BOOLEAN NOT NULL DEFAULT FALSE;
+
+
+-- +goose Down
+-- Переименованные при миграции имена не восстанавливаются
+ALTER TABLE users DROP COLUMN IF EXISTS vanity_link_opt_out;
+DROP INDEX IF EXISTS users_username_lower_key;
@@ -0,0 +1,16 @@
+-- +goose Up
+-- Принятие условий реферальной программы: код реферера действует, только
+-- если он принял текущую версию условий. Повторное принятие той же
+-- версии сохраняет время и IP первого.
+CREATE TABLE IF NOT EXISTS terms_acceptances (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    version TEXT NOT NULL,
+    accepted_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    ip INET,
+    UNIQUE (user_id, version)
+);
+
+
+-- +goose Down
+DROP TABLE IF EXISTS terms_acceptances;
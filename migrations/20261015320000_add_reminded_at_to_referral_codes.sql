@@ -0,0 +1,11 @@
+-- +goose Up
+-- Время отправки напоминания об истечении срока кода; NULL - не
+-- отправлялось. Частичный индекс покрывает выбор кодов для напоминания.
+ALTER TABLE referral_codes ADD COLUMN IF NOT EXISTS reminded_at TIMESTAMP WITH TIME ZONE;
+CREATE INDEX IF NOT EXISTS referral_codes_reminder_idx ON referral_codes (expires_at)
+    WHERE reminded_at IS NULL AND status = 'active' AND revoked_at IS NULL;
+
+
+-- +goose Down
+DROP INDEX IF EXISTS referral_codes_reminder_idx;
+ALTER TABLE referral_codes DROP COLUMN IF EXISTS reminded_at;
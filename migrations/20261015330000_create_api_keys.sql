@@ -0,0 +1,19 @@
+-- +goose Up
+-- Ключи API для вызовов между сервисами. Хранится только SHA-256 ключа;
+-- сам ключ показывается один раз при создании. Отозванный ключ
+-- остается в таблице для истории.
+CREATE TABLE IF NOT EXISTS api_keys (
+    id SERIAL PRIMARY KEY,
+    name TEXT NOT NULL,
+    prefix TEXT NOT NULL,
+    key_hash TEXT NOT NULL UNIQUE,
+    scopes TEXT[] NOT NULL,
+    created_by INT REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_used_at TIMESTAMP WITH TIME ZONE,
+    revoked_at TIMESTAMP WITH TIME ZONE
+);
+
+
+-- +goose Down
+DROP TABLE IF EXISTS api_keys;
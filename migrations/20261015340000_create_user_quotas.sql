@@ -0,0 +1,25 @@
+-- +goose Up
+-- Создания реферальных кодов для квоты codes_per_day. Коды удаляются при
+-- замене, поэтому создания учитываются отдельно от referral_codes.
+CREATE TABLE IF NOT EXISTS code_creations (
+    id BIGSERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_code_creations_user_created ON code_creations(user_id, created_at);
+
+-- Квоты пользователя, заданные администратором вместо общих. NULL -
+-- действует общая квота.
+CREATE TABLE IF NOT EXISTS user_limits (
+    user_id INT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    codes_per_day INT,
+    invites_per_day INT,
+    active_codes INT,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+
+-- +goose Down
+DROP TABLE IF EXISTS user_limits;
+DROP TABLE IF EXISTS code_creations;
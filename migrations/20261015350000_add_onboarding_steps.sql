@@ -0,0 +1,20 @@
+-- +goose Up
+-- Выполненные приглашенным шаги знакомства с сервисом, см. пакет
+-- onboarding.
+CREATE TABLE IF NOT EXISTS onboarding_steps (
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    step VARCHAR(30) NOT NULL,
+    completed_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, step)
+);
+
+-- Время зачисления вознаграждения. NULL - вознаграждение ожидает, пока
+-- приглашенный выполнит обязательные шаги. Начисленные ранее
+-- вознаграждения считаются зачисленными.
+ALTER TABLE referral_rewards ADD COLUMN IF NOT EXISTS vested_at TIMESTAMP WITH TIME ZONE;
+UPDATE referral_rewards SET vested_at = created_at WHERE vested_at IS NULL;
+
+
+-- +goose Down
+ALTER TABLE referral_rewards DROP COLUMN IF EXISTS vested_at;
+DROP TABLE IF EXISTS onboarding_steps;
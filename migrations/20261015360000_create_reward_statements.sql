@@ -0,0 +1,27 @@
+-- +goose Up
+-- Ежемесячные выписки по вознаграждениям: одна на пользователя и месяц.
+-- Итоги фиксируются при создании выписки; операции для вложения CSV
+-- берутся из referral_rewards и reward_redemptions. claimed_until -
+-- выписку отправляет экземпляр сервиса, sent_at - письмо отправлено.
+CREATE TABLE IF NOT EXISTS reward_statements (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    period DATE NOT NULL,
+    earned BIGINT NOT NULL,
+    redeemed BIGINT NOT NULL,
+    entries INT NOT NULL,
+    claimed_until TIMESTAMP WITH TIME ZONE,
+    sent_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (user_id, period)
+);
+
+CREATE INDEX IF NOT EXISTS idx_reward_statements_unsent ON reward_statements(id) WHERE sent_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_reward_redemptions_created_at ON reward_redemptions(created_at);
+CREATE INDEX IF NOT EXISTS idx_referral_rewards_vested_at ON referral_rewards(vested_at);
+
+
+-- +goose Down
+DROP INDEX IF EXISTS idx_referral_rewards_vested_at;
+DROP INDEX IF EXISTS idx_reward_redemptions_created_at;
+DROP TABLE IF EXISTS reward_statements;
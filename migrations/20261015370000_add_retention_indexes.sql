@@ -0,0 +1,15 @@
+-- +goose Up
+-- Частичные индексы для очистки устаревших IP-адресов и User-Agent:
+-- проход выбирает только еще не очищенные строки по времени записи.
+CREATE INDEX IF NOT EXISTS idx_login_events_unscrubbed ON login_events(created_at)
+    WHERE ip IS NOT NULL OR user_agent IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_users_unscrubbed ON users(created_at)
+    WHERE signup_ip IS NOT NULL OR user_agent IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_terms_acceptances_unscrubbed ON terms_acceptances(accepted_at)
+    WHERE ip IS NOT NULL;
+
+
+-- +goose Down
+DROP INDEX IF EXISTS idx_terms_acceptances_unscrubbed;
+DROP INDEX IF EXISTS idx_users_unscrubbed;
+DROP INDEX IF EXISTS idx_login_events_unscrubbed;
@@ -0,0 +1,33 @@
+-- +goose Up
+-- Удаленные реферальные коды: те же столбцы, что у referral_codes, плюс
+-- время удаления и число переходов, удаленных вместе с кодом. История
+-- кодов нужна статистике и сравнению кодов. Ограничений уникальности нет:
+-- одно значение кода может быть удалено несколько раз.
+CREATE TABLE IF NOT EXISTS referral_codes_archive (
+    id INT PRIMARY KEY,
+    user_id INT,
+    code VARCHAR(50) NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE,
+    uses INT NOT NULL DEFAULT 0,
+    max_uses INT,
+    revoked_at TIMESTAMP WITH TIME ZONE,
+    status VARCHAR(20) NOT NULL,
+    reserved_email VARCHAR(100),
+    client_token VARCHAR(100),
+    metadata JSONB NOT NULL DEFAULT '{}',
+    label VARCHAR(50),
+    allowed_domain TEXT,
+    allow_subdomains BOOLEAN NOT NULL DEFAULT FALSE,
+    reminded_at TIMESTAMP WITH TIME ZONE,
+    clicks INT NOT NULL DEFAULT 0,
+    archived_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_referral_codes_archive_user_id ON referral_codes_archive(user_id);
+-- для удаления устаревших записей заданием очистки
+CREATE INDEX IF NOT EXISTS idx_referral_codes_archive_archived_at ON referral_codes_archive(archived_at);
+
+
+-- +goose Down
+DROP TABLE IF EXISTS referral_codes_archive;
@@ -0,0 +1,24 @@
+-- +goose Up
+-- Очередь регистраций при пиковой нагрузке: запрос принимается и
+-- обрабатывается позже, клиент опрашивает статус по случайному ID.
+-- payload - данные регистрации с уже хешированным паролем; после
+-- обработки удаляется, остаются только результат или код ошибки.
+CREATE TABLE IF NOT EXISTS registration_queue (
+    id VARCHAR(32) PRIMARY KEY,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    payload JSONB,
+    result JSONB,
+    error_code VARCHAR(50),
+    attempts INT NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_registration_queue_due ON registration_queue(next_attempt_at) WHERE status = 'pending';
+-- для удаления обработанных записей
+CREATE INDEX IF NOT EXISTS idx_registration_queue_updated_at ON registration_queue(updated_at) WHERE status <> 'pending';
+
+
+-- +goose Down
+DROP TABLE IF EXISTS registration_queue;
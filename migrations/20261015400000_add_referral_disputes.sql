@@ -0,0 +1,28 @@
+-- +goose Up
+-- Споры об атрибуции: реферал или владелец кода сообщает, что
+-- регистрация по коду не засчиталась. Администратор разбирает спор и
+-- создает недостающую связь, отклоняет спор или закрывает его с
+-- комментарием.
+CREATE TABLE IF NOT EXISTS referral_disputes (
+    id SERIAL PRIMARY KEY,
+    filed_by INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    referrer_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    referee_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    code VARCHAR(50) NOT NULL,
+    message TEXT NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'open',
+    resolution VARCHAR(20),
+    resolution_note TEXT,
+    resolved_by INT REFERENCES users(id) ON DELETE SET NULL,
+    resolved_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- у реферала может быть только один реферер, поэтому и открытый спор о
+-- нем - только один
+CREATE UNIQUE INDEX IF NOT EXISTS referral_disputes_open_referee_key ON referral_disputes(referee_id) WHERE status = 'open';
+CREATE INDEX IF NOT EXISTS idx_referral_disputes_status ON referral_disputes(status, id);
+
+
+-- +goose Down
+DROP TABLE IF EXISTS referral_disputes;
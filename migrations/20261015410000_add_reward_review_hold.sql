@@ -0,0 +1,17 @@
+-- +goose Up
+-- Вознаграждения рефереров с открытой отметкой о подозрительной
+-- активности удерживаются до ее разбора: review_status 'pending_review'.
+-- Разбор отметки снимает удержание или аннулирует вознаграждения
+-- ('forfeited'). NULL - вознаграждение не удерживалось.
+ALTER TABLE referral_rewards ADD COLUMN IF NOT EXISTS review_status VARCHAR(20);
+CREATE INDEX IF NOT EXISTS idx_referral_rewards_held
+    ON referral_rewards(referrer_id) WHERE review_status = 'pending_review';
+
+-- Решение администратора по отметке: release или forfeit
+ALTER TABLE referrer_flags ADD COLUMN IF NOT EXISTS resolution VARCHAR(20);
+
+
+-- +goose Down
+ALTER TABLE referrer_flags DROP COLUMN IF EXISTS resolution;
+DROP INDEX IF EXISTS idx_referral_rewards_held;
+ALTER TABLE referral_rewards DROP COLUMN IF EXISTS review_status;
@@ -0,0 +1,13 @@
+-- +goose Up
+-- Email сравнивается без учета регистра: при регистрации, входе и поиске
+-- кода по email. Уникальность в нижнем регистре заменяет прежнее
+-- ограничение. Если в таблице уже есть email, различающиеся только
+-- регистром, индекс не создастся: такие учетные записи нужно объединить
+-- вручную до миграции.
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_lower_key ON users (lower(email));
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_email_key;
+
+
+-- +goose Down
+ALTER TABLE users ADD CONSTRAINT users_email_key UNIQUE (email);
+DROP INDEX IF EXISTS users_email_lower_key;
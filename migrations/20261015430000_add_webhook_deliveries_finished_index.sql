@@ -0,0 +1,7 @@
+-- +goose Up
+-- Завершенные доставки удаляются очисткой по времени последней попытки
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_finished ON webhook_deliveries(updated_at) WHERE status <> 'pending';
+
+
+-- +goose Down
+DROP INDEX IF EXISTS idx_webhook_deliveries_finished;
@@ -0,0 +1,17 @@
+-- +goose Up
+-- Использованные токены действий из писем, например продления кода.
+-- Запись хранится до истечения срока токена, после чего повтор
+-- отсекается проверкой срока в подписи.
+CREATE TABLE IF NOT EXISTS action_tokens (
+    nonce VARCHAR(64) PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    action VARCHAR(50) NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_action_tokens_expires_at ON action_tokens(expires_at);
+
+
+-- +goose Down
+DROP TABLE IF EXISTS action_tokens;
@@ -0,0 +1,156 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"gorefer.go/pkg/auth"
+	"gorefer.go/pkg/reqctx"
+	"gorefer.go/pkg/storage"
+)
+
+// Действия по ссылкам из писем, выполняемые без входа, см. auth.ActionToken
+const (
+	ActionExtendCode = "extend_code" // продление реферального кода
+)
+
+// ExtendCodeBy - на сколько продлевает код ссылка из напоминания
+const ExtendCodeBy = 30 * 24 * time.Hour
+
+// ExtendCodeLink возвращает одноразовую ссылку продления кода c на
+// ExtendCodeBy. baseURL - внешний адрес API вместе с префиксом
+// монтирования. Ссылка действует до истечения кода.
+func ExtendCodeLink(baseURL string, c storage.ExpiringCode) (string, error) {
+	token, err := auth.NewActionToken(c.UserID, ActionExtendCode, c.ID, c.ExpiresAt)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(baseURL, "/") + "/actions/extend-code?token=" + url.QueryEscape(token), nil
+}
+
+// actionPage - данные страницы результата действия
+type actionPage struct {
+	Title string
+	Text  string
+}
+
+var actionTemplate = template.Must(template.New("action").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="robots" content="noindex">
+<title>{{.Title}}</title>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Text}}</p>
+</body>
+</html>
+`))
+
+// writeActionPage отвечает страницей результата действия со статусом
+// status: ссылку открывает человек в браузере, а не клиент API.
+func (api *API) writeActionPage(w http.ResponseWriter, r *http.Request, status int, page actionPage) {
+	var buf bytes.Buffer
+	if err := actionTemplate.Execute(&buf, page); err != nil {
+		api.writeError(w, r, CodeInternal, fmt.Errorf("failed to render action page: %w", err))
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+// writeActionError отвечает страницей ошибки действия с сообщением и
+// статусом кода ошибки code. Причина логируется, как в writeError.
+func (api *API) writeActionError(w http.ResponseWriter, r *http.Request, code string, cause error) {
+	reqID, _ := reqctx.RequestIDFrom(r.Context())
+	log.Printf("[%s] %s %s: %s: %v", reqID, r.Method, r.URL.Path, code, cause)
+	api.writeActionPage(w, r, errorStatus(code), actionPage{
+		Title: "Действие не выполнено",
+		Text:  message(code, language(r)),
+	})
+}
+
+// Обработчик ссылки продления кода из письма-напоминания: проверяет
+// подпись и срок токена, отмечает его использованным и продлевает код
+// на ExtendCodeBy от большего из текущего срока и текущего момента.
+// Повторный переход по той же ссылке отклоняется.
+func (api *API) ExtendCodeByLink(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	now := api.now()
+
+	token, err := auth.ParseActionToken(r.URL.Query().Get("token"), ActionExtendCode, now)
+	if errors.Is(err, auth.ErrActionTokenExpired) {
+		api.writeActionError(w, r, CodeActionLinkUsed, err)
+		return
+	}
+	if err != nil {
+		api.writeActionError(w, r, CodeActionLinkInvalid, err)
+		return
+	}
+
+	resultChan := make(chan time.Time)
+	errorChan := make(chan error)
+
+	go func() {
+		codes, err := api.db.ListUserReferralCodes(ctx, token.UserID)
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		var code *storage.ReferralCode
+		for i := range codes {
+			if codes[i].ID == token.Subject {
+				code = &codes[i]
+			}
+		}
+		if code == nil {
+			errorChan <- storage.ErrNotFound
+			return
+		}
+		if err := api.db.ConsumeActionToken(ctx, token.Nonce, token.UserID, token.Action, token.Expiry()); err != nil {
+			errorChan <- err
+			return
+		}
+		expiresAt := code.ExpiresAt
+		if expiresAt.Before(now) {
+			expiresAt = now
+		}
+		expiresAt = expiresAt.Add(ExtendCodeBy)
+		unix := expiresAt.Unix()
+		if err := api.db.UpdateReferralCode(ctx, token.UserID, storage.ReferralCodeUpdate{CodeID: code.ID, ExpiresAt: &unix}); err != nil {
+			errorChan <- err
+			return
+		}
+		resultChan <- expiresAt
+	}()
+
+	select {
+	case expiresAt := <-resultChan:
+		api.writeActionPage(w, r, http.StatusOK, actionPage{
+			Title: "Код продлен",
+			Text:  "Реферальный код действует до " + expiresAt.UTC().Format("02.01.2006 15:04 MST") + ".",
+		})
+
+	case err := <-errorChan:
+		switch {
+		case errors.Is(err, storage.ErrTokenUsed):
+			api.writeActionError(w, r, CodeActionLinkUsed, err)
+		case errors.Is(err, storage.ErrNotFound):
+			api.writeActionError(w, r, CodeReferralCodeNotFound, err)
+		case errors.Is(err, storage.ErrExpiryTooFar):
+			api.writeActionError(w, r, CodeExpiryTooFar, err)
+		default:
+			api.writeError(w, r, CodeInternal, fmt.Errorf("failed to extend referral code by link: %w", err))
+		}
+	}
+}
@@ -4,26 +4,198 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"gorefer.go/pkg/api/middlware"
+	"gorefer.go/pkg/api/pagination"
 	"gorefer.go/pkg/auth"
+	"gorefer.go/pkg/mailer"
+	"gorefer.go/pkg/reqctx"
 	"gorefer.go/pkg/storage"
+	"gorefer.go/pkg/timing"
 )
 
+// Время ожидания остановки фоновых компонентов при Close.
+const closeTimeout = 5 * time.Second
+
+// Component - фоновый компонент API (планировщик, рассыльщик и т.п.).
+// Run должен завершаться после отмены переданного контекста.
+type Component interface {
+	Run(ctx context.Context)
+}
+
+// ComponentFunc позволяет использовать функцию как Component.
+type ComponentFunc func(ctx context.Context)
+
+// Run вызывает f(ctx).
+func (f ComponentFunc) Run(ctx context.Context) {
+	f(ctx)
+}
+
 // API структура.
 type API struct {
 	db storage.DBInterface
 	r  *chi.Mux
+
+	// retryAfter - значение Retry-After по умолчанию для ответов 503/504
+	retryAfter time.Duration
+	// clickRedirect - адрес перенаправления после перехода по /r/{code}
+	clickRedirect string
+	// maxCodes - предел активных кодов пользователя; 0 - один код,
+	// заменяемый при создании нового
+	maxCodes int
+	// registration - доступные способы регистрации
+	registration Registration
+	// policy - ограничения данных пользователей
+	policy Policy
+
+	hooks    Hooks
+	hooksWG  sync.WaitGroup
+	timeouts Timeouts
+	pages    pagination.Defaults
+
+	metrics       errorMetrics
+	cohorts       cohortCache
+	decodeLimiter *windowLimiter // nil - ограничение выключено
+	// authLimiter - одновременная обработка регистрации и входа; nil -
+	// без ограничения
+	authLimiter *middlware.Limiter
+	// regQueue - очередь регистраций сверх authLimiter; nil - выключена
+	regQueue *RegistrationQueue
+
+	// compressMinSize - порог сжатия ответов, maxRequestBody - предел
+	// распакованного тела запроса
+	compressMinSize int
+	maxRequestBody  int64
+
+	magicLinks       *MagicLinks // nil - вход по ссылке выключен
+	magicLinkLimiter *windowLimiter
+	emails           *mailer.Templates
+
+	widget        *Widget // nil - маршрут виджета выключен
+	widgetLimiter *windowLimiter
+	widgets       widgetCache
+
+	linkPreview *LinkPreview // nil - /r/{code} всегда перенаправляет
+
+	faults FaultInjector // nil - маршруты /admin/faults выключены
+
+	webhooks WebhookRedeliverer // nil - маршруты доставок событий выключены
+
+	retention RetentionReporter // nil - маршрут итогов очистки персональных данных выключен
+
+	quotas *Quotas // nil - квоты пользователей не проверяются
+	// now - часы окон квот, см. WithClock
+	now func() time.Time
+
+	// serverTiming - Server-Timing для всех запросов регистрации и входа
+	serverTiming bool
+	// termsVersion - версия условий программы, которую должен принять
+	// реферер; пусто - проверка выключена, см. WithTermsVersion
+	termsVersion string
+
+	// overviewSources - дополнительные разделы сводки /admin/overview
+	overviewSources map[string]OverviewSource
+
+	mu         sync.Mutex
+	components []Component
+	cancel     context.CancelFunc
+	wg         sync.WaitGroup
+}
+
+// Timeouts - бюджеты времени на обработку запроса по группам маршрутов.
+// Клиент может запросить другой бюджет заголовком X-Request-Timeout, но
+// не больше потолка группы, см. middlware.Timeout.
+type Timeouts struct {
+	Auth  time.Duration // регистрация, вход и переходы по ссылкам
+	User  time.Duration // маршруты /p
+	Admin time.Duration // маршруты /admin, включая выгрузки
+
+	// потолки бюджета, запрошенного клиентом; меньше бюджета группы -
+	// клиент может только сократить бюджет
+	AuthMax  time.Duration
+	UserMax  time.Duration
+	AdminMax time.Duration
+}
+
+// Бюджеты времени по умолчанию. Дольше обычного разрешено ждать
+// выгрузкам и отчетам.
+var defaultTimeouts = Timeouts{
+	Auth:  5 * time.Second,
+	User:  5 * time.Second,
+	Admin: 30 * time.Second,
+
+	AuthMax:  5 * time.Second,
+	UserMax:  60 * time.Second,
+	AdminMax: 120 * time.Second,
+}
+
+// Option настраивает API при создании.
+type Option func(*API)
+
+// WithTimeouts задает бюджеты времени для групп маршрутов.
+// Нулевые значения заменяются значениями по умолчанию.
+func WithTimeouts(t Timeouts) Option {
+	return func(a *API) {
+		if t.Auth > 0 {
+			a.timeouts.Auth = t.Auth
+		}
+		if t.User > 0 {
+			a.timeouts.User = t.User
+		}
+		if t.Admin > 0 {
+			a.timeouts.Admin = t.Admin
+		}
+		if t.AuthMax > 0 {
+			a.timeouts.AuthMax = t.AuthMax
+		}
+		if t.UserMax > 0 {
+			a.timeouts.UserMax = t.UserMax
+		}
+		if t.AdminMax > 0 {
+			a.timeouts.AdminMax = t.AdminMax
+		}
+	}
+}
+
+// WithPagination задает размер страницы по умолчанию и максимальный
+// размер для постраничных списков.
+func WithPagination(d pagination.Defaults) Option {
+	return func(a *API) {
+		a.pages = d
+	}
+}
+
+// WithRetryAfter задает значение Retry-After по умолчанию для ответов 503/504.
+func WithRetryAfter(d time.Duration) Option {
+	return func(a *API) {
+		a.retryAfter = d
+	}
 }
 
 // Конструктор API.
-func New(db storage.DBInterface) *API {
-	a := API{db: db, r: chi.NewRouter()}
+func New(db storage.DBInterface, opts ...Option) *API {
+	a := API{db: db, r: chi.NewRouter(), retryAfter: defaultRetryAfter, clickRedirect: defaultClickRedirect, timeouts: defaultTimeouts, pages: pagination.DefaultDefaults,
+		compressMinSize: defaultCompressMinSize, maxRequestBody: defaultMaxRequestBody, registration: defaultRegistration, policy: defaultPolicy,
+		now: time.Now}
+	for _, opt := range opts {
+		opt(&a)
+	}
+	if a.emails == nil {
+		a.emails = mailer.DefaultTemplates()
+	}
+	if a.regQueue != nil {
+		a.components = append(a.components, ComponentFunc(a.processRegistrations))
+	}
 	a.endpoints()
 	return &a
 }
@@ -34,83 +206,285 @@ func (api *API) Router() *chi.Mux {
 	return api.r
 }
 
+// Register добавляет фоновый компонент. Компоненты запускаются в Start
+// и останавливаются в Close; регистрация после Start не допускается.
+func (api *API) Register(c Component) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	if api.cancel != nil {
+		panic("api: Register после Start")
+	}
+	api.components = append(api.components, c)
+}
+
+// Start запускает зарегистрированные фоновые компоненты.
+// Маршрутизатор доступен и без вызова Start.
+func (api *API) Start(ctx context.Context) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	if api.cancel != nil {
+		return
+	}
+	ctx, api.cancel = context.WithCancel(ctx)
+	for _, c := range api.components {
+		api.wg.Add(1)
+		go func(c Component) {
+			defer api.wg.Done()
+			c.Run(ctx)
+		}(c)
+	}
+}
+
+// Close останавливает фоновые компоненты, дожидается их и запущенных
+// обработчиков событий, но не дольше closeTimeout.
+func (api *API) Close() error {
+	api.mu.Lock()
+	cancel := api.cancel
+	api.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		api.wg.Wait()
+		api.hooksWG.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(closeTimeout):
+		return errors.New("api: фоновые компоненты не остановились за отведенное время")
+	}
+}
+
+// timeout - middleware бюджета времени группы маршрутов: d по умолчанию,
+// не больше ceiling по запросу клиента.
+func (api *API) timeout(d, ceiling time.Duration) func(http.Handler) http.Handler {
+	return middlware.Timeout(d, ceiling, func(w http.ResponseWriter, r *http.Request, err error) {
+		api.writeError(w, r, CodeInvalidRequestTimeout, err)
+	})
+}
+
 // Регистрация методов API в маршрутизаторе запросов.
 func (api *API) endpoints() {
+	api.r.Use(middleware.RequestID)
+	api.r.Use(middlware.RequestContext)
 	api.r.Use(middleware.Logger)
+	// "/register/" и "//login" ведут туда же, куда "/register" и "/login"
+	api.r.Use(middlware.CleanSlashes)
+	api.r.Use(middlware.Compress(api.compressMinSize, api.maxRequestBody))
+	api.r.Use(middlware.TrackWrites)
+	api.r.Use(api.countErrors)
+	api.r.Use(middlware.Recoverer(api.recoverPanic))
+	// ответы на неизвестные пути и методы - в общем формате ошибок;
+	// обработчики наследуются вложенными маршрутизаторами
+	api.r.NotFound(api.routeNotFound)
+	api.r.MethodNotAllowed(api.methodNotAllowed)
+
+	api.r.Group(func(r chi.Router) {
+		r.Use(middlware.ServerTiming(api.serverTimingEnabled))
+		r.Use(api.timeout(api.timeouts.Auth, api.timeouts.AuthMax))
+		r.With(api.limitAuth).Post("/register", api.RegisterUser)
+		r.With(api.limitReferralSignup).Post("/register-with-referral", api.RegisterWithReferralCode)
+		if api.regQueue != nil {
+			r.Get("/registrations/{id}", api.GetRegistrationStatus)
+		}
+		r.With(api.limitAuth).Post("/login", api.LoginUser)
+		r.Get("/r/{code}", api.FollowReferralLink)
+		r.Get("/r/@{username}", api.FollowVanityLink)
+		r.Get("/actions/extend-code", api.ExtendCodeByLink)
+		r.Get("/config/public", api.GetPublicConfig)
+		r.Get("/.well-known/gorefer-configuration", api.GetDiscovery)
+		r.Get("/v"+APIVersion+"/meta/error-codes", api.GetErrorCodes)
+		if api.magicLinks != nil {
+			r.Post("/login/magic-link", api.RequestMagicLink)
+			r.Get("/login/magic", api.MagicLinkLogin)
+		}
+		if api.widget != nil {
+			r.With(api.widgetCORS).Get("/widget/{code}", api.GetWidget)
+			r.With(api.widgetCORS).Options("/widget/{code}", api.WidgetPreflight)
+		}
+	})
 
-	api.r.Post("/register", api.RegisterUser)
-	api.r.Post("/register-with-referral", api.RegisterWithReferralCode)
-	api.r.Post("/login", api.LoginUser)
+	api.r.Group(func(r chi.Router) {
+		r.Use(api.timeout(api.timeouts.Auth, api.timeouts.AuthMax))
+		r.Use(middlware.TokenAuthMiddleware)
+		r.Use(middlware.DenyImpersonation)
+		r.Post("/refresh", api.RefreshToken)
+	})
 
 	api.r.Route("/p", func(r chi.Router) {
+		r.Use(api.timeout(api.timeouts.User, api.timeouts.UserMax))
 		r.Use(middlware.TokenAuthMiddleware)
 		r.Post("/referral-code", api.CreateReferralCode)
+		r.Get("/referral-code", api.GetMyReferralCode)
+		r.Patch("/referral-code", api.UpdateMyReferralCode)
+		r.Head("/referral-code", api.GetMyReferralCode)
 		r.Delete("/referral-code", api.DeleteReferralCode)
 		r.Get("/referral-code/{email}", api.GetReferralCodeByEmail)
-		r.Get("/referrals/{referrerID}", api.GetReferralsByReferrerID)
+		if api.multipleCodes() {
+			r.Get("/referral-codes", api.ListMyReferralCodes)
+		}
+		r.Get("/referral-codes/compare", api.CompareMyReferralCodes)
+		r.Get("/referrals", api.GetMyReferrals)
+		r.Post("/referrals/disputes", api.FileDispute)
+		r.Get("/stats", api.GetMyStats)
+		r.Post("/rewards/redeem", api.RedeemReward)
+		r.Get("/rewards/statements", api.ListMyStatements)
+		r.Get("/rewards/statements/{period}", api.DownloadMyStatement)
+		r.Get("/me", api.GetMyProfile)
+		r.Get("/me/logins", api.GetMyLogins)
+		r.Get("/me/export", api.ExportMyData)
+		r.Patch("/me", api.UpdateProfile)
+		if api.termsVersion != "" {
+			r.Post("/terms/accept", api.AcceptTerms)
+		}
+		if api.quotas != nil {
+			r.Get("/limits", api.GetMyLimits)
+		}
 	})
-}
 
-// Функция для обработки ошибок
-func (api *API) writeError(w http.ResponseWriter, err error, code int) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(code)
-	response := map[string]string{"error": err.Error()}
-	json.NewEncoder(w).Encode(response)
+	api.r.Route("/admin", func(r chi.Router) {
+		r.Use(api.timeout(api.timeouts.Admin, api.timeouts.AdminMax))
+
+		// маршруты, которые другие сервисы вызывают и по ключу API с
+		// нужной областью
+		r.With(api.apiKeyOr(ScopeCodesRead)).Get("/referral-codes/{code}", api.GetReferralCodeDetails)
+		r.With(api.apiKeyOr(ScopeCodesWrite)).Post("/referral-codes/reserve", api.ReserveReferralCode)
+		r.With(api.apiKeyOr(ScopeCodesRead)).Get("/referral-codes", api.ListReferralCodes)
+		r.With(api.apiKeyOr(ScopeReportsRead)).Get("/reports/referrals", api.GetProgramReport)
+		r.With(api.apiKeyOr(ScopeReportsRead)).Get("/cohorts", api.GetCohorts)
+		r.With(api.apiKeyOr(ScopeReportsRead)).Get("/overview", api.GetOverview)
+
+		r.Group(func(r chi.Router) {
+			r.Use(middlware.TokenAuthMiddleware)
+			r.Use(middlware.RequireRole(storage.RoleAdmin))
+			r.Delete("/referral-codes", api.DeleteReferralCodeByCode)
+			r.Post("/referral-codes/{code}/transfer", api.TransferReferralCode)
+			r.Get("/referrals/{referrerID}", api.GetReferralsByReferrerID)
+			r.Post("/users/{id}/anonymize", api.AnonymizeUser)
+			r.Get("/users/{id}/export", api.ExportUserData)
+			if api.quotas != nil {
+				r.Patch("/users/{id}/limits", api.SetUserLimits)
+			}
+			r.Post("/keys/reload", api.ReloadKeys)
+			r.Post("/impersonate/{userID}", api.Impersonate)
+			r.Get("/flags", api.GetReferrerFlags)
+			r.Post("/flags/{id}/review", api.ReviewReferrerFlag)
+			r.Get("/rewards/redemptions", api.ListRedemptions)
+			r.Get("/disputes", api.ListDisputes)
+			r.Post("/disputes/{id}/resolve", api.ResolveDispute)
+			r.Get("/metrics/errors", api.GetErrorMetrics)
+			r.Get("/metrics/keys", api.GetKeyStats)
+			r.Get("/emails/preview", api.PreviewEmail)
+			r.Get("/routes", api.GetRoutes)
+			r.Post("/api-keys", api.CreateAPIKey)
+			r.Get("/api-keys", api.ListAPIKeys)
+			r.Delete("/api-keys/{id}", api.RevokeAPIKey)
+			if api.webhooks != nil {
+				r.Get("/webhooks/deliveries", api.ListWebhookDeliveries)
+				r.Post("/webhooks/deliveries/{id}/retry", api.RetryWebhookDelivery)
+				r.Get("/metrics/webhooks", api.GetWebhookMetrics)
+			}
+			if api.retention != nil {
+				r.Get("/metrics/retention", api.GetRetentionMetrics)
+			}
+			r.Post("/maintenance/recount", api.RecountReferrals)
+			if api.faults != nil {
+				r.Get("/faults", api.GetFaultRules)
+				r.Put("/faults", api.SetFaultRules)
+			}
+		})
+	})
 }
 
-// Функция для создания контекста с таймаутом
-func (api *API) withTimeout(ctx context.Context, duration time.Duration) (context.Context, context.CancelFunc) {
-	return context.WithTimeout(ctx, duration)
+// Функция для сбора параметров регистрации. Платформа берется из тела
+// запроса, а при ее отсутствии - из параметра ?source.
+func signupParams(r *http.Request, user storage.User, source string) storage.CreateUserParams {
+	if source == "" {
+		source = r.URL.Query().Get("source")
+	}
+	ip, _ := reqctx.ClientIPFrom(r.Context())
+	return storage.CreateUserParams{
+		User:      user,
+		UserAgent: r.UserAgent(),
+		Source:    storage.NormalizeSource(source),
+		IP:        ip,
+	}
 }
 
-// Обработчик для регистрации пользователя
+// Обработчик для регистрации пользователя. Реферальный код можно
+// передать в заголовке X-Referral-Code или параметре ?ref=, не меняя
+// тело запроса; приоритет источников - см. resolveReferralCode.
 func (api *API) RegisterUser(w http.ResponseWriter, r *http.Request) {
-	var user storage.User
-	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
-		api.writeError(w, errors.New("invalid request payload"), http.StatusBadRequest)
+	ref := resolveReferralCode(r, "")
+	if !api.registration.allows(ref) {
+		api.writeError(w, r, CodeRegistrationDisabled, errRegistrationDisabled)
+		return
+	}
+	var request struct {
+		storage.User
+		Source string `json:"source"`
+	}
+	if !api.decodeJSON(w, r, &request) {
+		return
+	}
+	user := request.User
+
+	if dryRun(r) {
+		api.validateOnly(w, r, user, api.dryRunCode(ref))
+		return
+	}
+	stopValidate := timing.Start(r.Context(), phaseValidate)
+	code, err := api.validateUser(&user)
+	stopValidate()
+	if err != nil {
+		api.writeError(w, r, code, err)
 		return
 	}
 
-	ctx, cancel := api.withTimeout(r.Context(), 5*time.Second)
-	defer cancel()
+	ctx := r.Context()
 
-	resultChan := make(chan error)
+	resultChan := make(chan signupResult)
+	errorChan := make(chan error)
 	go func() {
-		hashedPassword, err := auth.HashPassword(user.Password)
+		res, err := api.signup(ctx, r, user, request.Source, ref)
 		if err != nil {
-			resultChan <- err
+			errorChan <- err
 			return
 		}
-		user.Password = hashedPassword
-		_, err = api.db.CreateUser(ctx, user)
-		resultChan <- err
+		resultChan <- res
 	}()
 
-	if err := <-resultChan; err != nil {
-		api.writeError(w, errors.New("failed to create user: "+err.Error()), http.StatusInternalServerError)
-		return
+	select {
+	case res := <-resultChan:
+		user.ID = res.id
+		api.registered(w, r, user, ref, res)
+		created(w, r, profileLocation, SignupResponse{ID: user.ID, Warning: res.warning})
+	case err := <-errorChan:
+		api.writeSignupError(w, r, err, "create user")
 	}
-
-	w.WriteHeader(http.StatusCreated)
 }
 
 // Обработчик для аутентификации пользователя
 func (api *API) LoginUser(w http.ResponseWriter, r *http.Request) {
 	var user storage.User
-	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
-		api.writeError(w, errors.New("invalid request payload"), http.StatusBadRequest)
+	if !api.decodeJSON(w, r, &user) {
 		return
 	}
 
-	ctx, cancel := api.withTimeout(r.Context(), 5*time.Second)
-	defer cancel()
+	ctx := r.Context()
 
 	resultChan := make(chan storage.User)
 	errorChan := make(chan error)
 
 	go func() {
+		stopDB := timing.Start(ctx, phaseDB)
 		existingUser, err := api.db.GetUserByEmail(ctx, user.Email)
+		stopDB()
 		if err != nil {
 			errorChan <- err
 			return
@@ -120,24 +494,28 @@ func (api *API) LoginUser(w http.ResponseWriter, r *http.Request) {
 
 	select {
 	case existingUser := <-resultChan:
-		if err := auth.CheckPasswordHash(user.Password, existingUser.Password); err != nil {
-			api.writeError(w, errors.New("invalid login credentials"), http.StatusUnauthorized)
+		stopHash := timing.Start(ctx, phaseHash)
+		err := auth.CheckPasswordHash(user.Password, existingUser.Password)
+		stopHash()
+		if err != nil {
+			api.loginFailed(r, user.Email)
+			api.writeError(w, r, CodeInvalidCredentials, err)
+			api.recordLogin(r, existingUser.ID, false)
 			return
 		}
 
-		token, err := auth.GenerateToken(existingUser.ID, existingUser.Username)
+		token, err := auth.GenerateToken(existingUser.ID, existingUser.Username, existingUser.Role)
 		if err != nil {
-			api.writeError(w, errors.New("failed to generate token: "+err.Error()), http.StatusInternalServerError)
+			api.writeError(w, r, CodeInternal, fmt.Errorf("failed to generate token: %w", err))
 			return
 		}
 
-		response := map[string]string{"token": token}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(response)
+		respond(w, http.StatusOK, TokenResponse{Token: token})
+		api.recordLogin(r, existingUser.ID, true)
 
 	case err := <-errorChan:
-		api.writeError(w, errors.New("failed to retrieve user: "+err.Error()), http.StatusUnauthorized)
+		api.loginFailed(r, user.Email)
+		api.writeError(w, r, CodeInvalidCredentials, fmt.Errorf("failed to retrieve user: %w", err))
 		return
 	}
 }
@@ -145,31 +523,129 @@ func (api *API) LoginUser(w http.ResponseWriter, r *http.Request) {
 // Обработчик для создания реферального кода
 func (api *API) CreateReferralCode(w http.ResponseWriter, r *http.Request) {
 	var request struct {
-		UserID    int    `json:"user_id"`
-		Code      string `json:"code"`
-		ExpiresAt int64  `json:"expires_at"`
+		UserID      int             `json:"user_id"`
+		Code        string          `json:"code"`
+		ExpiresAt   int64           `json:"expires_at"`
+		ClientToken string          `json:"client_token"` // повтор с тем же токеном возвращает уже созданный код
+		Metadata    json.RawMessage `json:"metadata"`     // необязательные метки кода
+		Label       string          `json:"label"`        // только при нескольких кодах, см. WithMultipleCodes
+		// регистрация по коду только с email в этом домене
+		AllowedDomain   string `json:"allowed_domain"`
+		AllowSubdomains bool   `json:"allow_subdomains"`
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-		api.writeError(w, errors.New("invalid request payload"), http.StatusBadRequest)
+	if !api.decodeJSON(w, r, &request) {
+		return
+	}
+	if err := validateMetadata(request.Metadata); err != nil {
+		api.writeError(w, r, CodeMetadataInvalid, err)
+		return
+	}
+	domain, err := domainRestriction(request.AllowedDomain, request.AllowSubdomains)
+	if err != nil {
+		api.writeError(w, r, CodeInvalidPayload, err)
+		return
+	}
+	if err := api.policy.validateCode(request.Code); err != nil {
+		api.writeError(w, r, CodeInvalidPayload, err)
+		return
+	}
+	if err := api.policy.validateExpiry(request.ExpiresAt); err != nil {
+		code, _ := expiryErrorCode(err)
+		api.writeError(w, r, code, err)
+		return
+	}
+	if api.multipleCodes() && utf8.RuneCountInString(request.Label) > maxCodeLabelLength {
+		api.writeError(w, r, CodeInvalidPayload, fmt.Errorf("label exceeds %d characters", maxCodeLabelLength))
 		return
 	}
 
-	ctx, cancel := api.withTimeout(r.Context(), 5*time.Second)
-	defer cancel()
+	ctx := r.Context()
+
+	resultChan := make(chan storage.ReferralCode)
+	errorChan := make(chan error)
 
-	resultChan := make(chan error)
 	go func() {
-		err := api.db.CreateReferralCode(ctx, request.UserID, request.Code, request.ExpiresAt)
-		resultChan <- err
+		if err := api.checkTerms(ctx, request.UserID); err != nil {
+			errorChan <- err
+			return
+		}
+		quotas := []string{QuotaCodesPerDay}
+		if api.multipleCodes() {
+			quotas = append(quotas, QuotaActiveCodes)
+		}
+		if err := api.checkQuotas(ctx, request.UserID, quotas...); err != nil {
+			errorChan <- err
+			return
+		}
+		var err error
+		if api.multipleCodes() {
+			err = api.db.AddReferralCode(ctx, storage.NewReferralCode{
+				UserID:      request.UserID,
+				Code:        request.Code,
+				Label:       request.Label,
+				ExpiresAt:   request.ExpiresAt,
+				ClientToken: request.ClientToken,
+				Metadata:    request.Metadata,
+				Domain:      domain,
+			}, api.maxCodes)
+		} else {
+			err = api.db.CreateReferralCode(ctx, request.UserID, request.Code, request.ExpiresAt, request.ClientToken, request.Metadata, domain)
+		}
+		if err != nil {
+			if !errors.Is(err, storage.ErrClientTokenUsed) {
+				errorChan <- err
+				return
+			}
+			// повторный запрос: отдаем код, созданный первым
+			code, err := api.db.GetReferralCodeByClientToken(ctx, request.UserID, request.ClientToken)
+			if err != nil {
+				errorChan <- err
+				return
+			}
+			resultChan <- code
+			return
+		}
+		close(resultChan)
 	}()
 
-	if err := <-resultChan; err != nil {
-		api.writeError(w, errors.New("failed to create referral code: "+err.Error()), http.StatusInternalServerError)
+	select {
+	case code, replayed := <-resultChan:
+		if replayed {
+			respond(w, http.StatusOK, code)
+			return
+		}
+		location := "/p/referral-code"
+		if api.multipleCodes() {
+			location = "/p/referral-codes"
+		}
+		created(w, r, location, nil, resourceLink{"/r/" + url.PathEscape(request.Code), "share"})
+
+	case err := <-errorChan:
+		if errors.Is(err, storage.ErrCodeTaken) {
+			api.writeError(w, r, CodeReferralCodeTaken, err)
+			return
+		}
+		if errors.Is(err, storage.ErrCodeLimit) {
+			api.writeError(w, r, CodeReferralCodeLimit, err)
+			return
+		}
+		if code, ok := expiryErrorCode(err); ok {
+			api.writeError(w, r, code, err)
+			return
+		}
+		if errors.Is(err, errTermsNotAccepted) {
+			api.writeError(w, r, CodeTermsNotAccepted, err)
+			return
+		}
+		var quota *QuotaError
+		if errors.As(err, &quota) {
+			api.writeError(w, r, CodeQuotaExceeded, err)
+			return
+		}
+		api.writeError(w, r, CodeInternal, fmt.Errorf("failed to create referral code: %w", err))
 		return
 	}
-
-	w.WriteHeader(http.StatusCreated)
 }
 
 // Обработчик для удаления реферального кода
@@ -178,13 +654,11 @@ func (api *API) DeleteReferralCode(w http.ResponseWriter, r *http.Request) {
 		UserID int `json:"user_id"`
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-		api.writeError(w, errors.New("invalid request payload"), http.StatusBadRequest)
+	if !api.decodeJSON(w, r, &request) {
 		return
 	}
 
-	ctx, cancel := api.withTimeout(r.Context(), 5*time.Second)
-	defer cancel()
+	ctx := r.Context()
 
 	resultChan := make(chan error)
 	go func() {
@@ -193,24 +667,86 @@ func (api *API) DeleteReferralCode(w http.ResponseWriter, r *http.Request) {
 	}()
 
 	if err := <-resultChan; err != nil {
-		api.writeError(w, errors.New("failed to delete referral code: "+err.Error()), http.StatusInternalServerError)
+		api.writeError(w, r, CodeInternal, fmt.Errorf("failed to delete referral code: %w", err))
 		return
 	}
 
-	w.WriteHeader(http.StatusNoContent)
+	respond(w, http.StatusNoContent, nil)
+}
+
+// Обработчик для удаления реферального кода по значению (admin). В ответе
+// возвращается удаленный код и его владелец. Удаление фиксируется в журнале
+// аудита.
+func (api *API) DeleteReferralCodeByCode(w http.ResponseWriter, r *http.Request) {
+	code := r.URL.Query().Get("code")
+	if code == "" {
+		api.writeError(w, r, CodeInvalidParameter, errors.New("code is required"))
+		return
+	}
+
+	claims, ok := reqctx.UserFrom(r.Context())
+	if !ok {
+		api.writeError(w, r, CodeUnauthorized, nil)
+		return
+	}
+
+	ctx := r.Context()
+
+	resultChan := make(chan storage.DeletedReferralCode)
+	errorChan := make(chan error)
+
+	go func() {
+		deleted, err := api.db.DeleteReferralCodeByCode(ctx, code, claims.ActorID())
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		resultChan <- deleted
+	}()
+
+	select {
+	case deleted := <-resultChan:
+		respond(w, http.StatusOK, deleted)
+
+	case err := <-errorChan:
+		if errors.Is(err, storage.ErrNotFound) {
+			api.writeError(w, r, CodeReferralCodeNotFound, err)
+			return
+		}
+		api.writeError(w, r, CodeInternal, fmt.Errorf("failed to delete referral code: %w", err))
+		return
+	}
 }
 
 // Обработчик для получения реферального кода по email
+// Обычный пользователь может запросить только код, привязанный к его email.
 func (api *API) GetReferralCodeByEmail(w http.ResponseWriter, r *http.Request) {
 	email := chi.URLParam(r, "email")
 
-	ctx, cancel := api.withTimeout(r.Context(), 5*time.Second)
-	defer cancel()
+	claims, ok := reqctx.UserFrom(r.Context())
+	if !ok {
+		api.writeError(w, r, CodeUnauthorized, nil)
+		return
+	}
+
+	ctx := r.Context()
 
 	resultChan := make(chan *storage.ReferralCode)
 	errorChan := make(chan error)
 
 	go func() {
+		if claims.Role != storage.RoleAdmin {
+			user, err := reqctx.CurrentUser(ctx, api.db)
+			if err != nil && !errors.Is(err, storage.ErrNotFound) {
+				errorChan <- err
+				return
+			}
+			if err != nil || !strings.EqualFold(user.Email, email) {
+				errorChan <- errForbidden
+				return
+			}
+		}
+
 		referralCode, err := api.db.GetReferralCodeByEmail(ctx, email)
 		if err != nil {
 			errorChan <- err
@@ -221,86 +757,227 @@ func (api *API) GetReferralCodeByEmail(w http.ResponseWriter, r *http.Request) {
 
 	select {
 	case referralCode := <-resultChan:
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(referralCode)
+		respond(w, http.StatusOK, referralCode)
 
 	case err := <-errorChan:
-		api.writeError(w, errors.New("failed to retrieve referral code: "+err.Error()), http.StatusNotFound)
+		switch {
+		case errors.Is(err, errForbidden):
+			api.writeError(w, r, CodeForbidden, err)
+		case errors.Is(err, storage.ErrNotFound):
+			api.writeError(w, r, CodeReferralCodeNotFound, err)
+		default:
+			api.writeError(w, r, CodeInternal, fmt.Errorf("failed to retrieve referral code: %w", err))
+		}
 		return
 	}
 }
 
-// Обработчик для регистрации по реферальному коду
-func (api *API) RegisterWithReferralCode(w http.ResponseWriter, r *http.Request) {
-	var request struct {
-		ReferralCode string       `json:"referral_code,omitempty"` // Позволяет отсутствовать
-		User         storage.User `json:"user"`
+// Обработчик для получения собственного реферального кода
+func (api *API) GetMyReferralCode(w http.ResponseWriter, r *http.Request) {
+	claims, ok := reqctx.UserFrom(r.Context())
+	if !ok {
+		api.writeError(w, r, CodeUnauthorized, nil)
+		return
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-		api.writeError(w, errors.New("invalid request payload"), http.StatusBadRequest)
+	ctx := r.Context()
+
+	resultChan := make(chan storage.ReferralCode)
+	errorChan := make(chan error)
+
+	go func() {
+		referralCode, err := api.db.GetReferralCodeByUserID(ctx, claims.UserID)
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		resultChan <- referralCode
+	}()
+
+	select {
+	case referralCode := <-resultChan:
+		api.writeCacheable(w, r, referralCode)
+
+	case err := <-errorChan:
+		if errors.Is(err, storage.ErrNotFound) {
+			api.writeError(w, r, CodeReferralCodeNotFound, err)
+			return
+		}
+		api.writeError(w, r, CodeInternal, fmt.Errorf("failed to retrieve referral code: %w", err))
 		return
 	}
+}
 
-	ctx, cancel := api.withTimeout(r.Context(), 5*time.Second)
-	defer cancel()
+// Обработчик для регистрации по реферальному коду. Код из тела
+// запроса имеет приоритет над заголовком, параметром и cookie
+// атрибуции, см. resolveReferralCode.
+func (api *API) RegisterWithReferralCode(w http.ResponseWriter, r *http.Request) {
+	request, ok := api.referralSignupRequest(w, r)
+	if !ok {
+		return
+	}
+	ref := request.ref
 
-	if request.ReferralCode == "" {
-		// Если реферальный код не указан, регистрируем пользователя
-		resultChan := make(chan error)
-		go func() {
-			hashedPassword, err := auth.HashPassword(request.User.Password)
-			if err != nil {
-				resultChan <- err
-				return
-			}
-			request.User.Password = hashedPassword
-			_, err = api.db.CreateUser(ctx, request.User)
-			resultChan <- err
-		}()
+	ctx := r.Context()
 
-		if err := <-resultChan; err != nil {
-			api.writeError(w, errors.New("failed to create user: "+err.Error()), http.StatusInternalServerError)
+	resultChan := make(chan signupResult)
+	errorChan := make(chan error)
+	go func() {
+		res, err := api.signup(ctx, r, request.user, request.source, ref)
+		if err != nil {
+			errorChan <- err
 			return
 		}
+		resultChan <- res
+	}()
 
-		w.WriteHeader(http.StatusCreated)
+	select {
+	case res := <-resultChan:
+		request.user.ID = res.id
+		api.registered(w, r, request.user, ref, res)
+		response := newReferralSignupResponse(request.user, res.referrer)
+		response.Warning = res.warning
+		created(w, r, profileLocation, response)
+	case err := <-errorChan:
+		api.writeSignupError(w, r, err, "register with referral code")
+	}
+}
+
+// Обработчик для изменения профиля текущего пользователя: часовой пояс
+// (имя IANA; время в ответах API по-прежнему отдается в UTC) и имя
+// пользователя, которое проверяется так же, как при регистрации, а также
+// отключение ссылки /r/@username. Отсутствующие поля не меняются;
+// переданные применяются вместе: если имя занято, не меняется ничего.
+func (api *API) UpdateProfile(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Timezone         *string `json:"timezone"`
+		Username         *string `json:"username"`
+		VanityLinkOptOut *bool   `json:"vanity_link_opt_out"`
+	}
+	if !api.decodeJSON(w, r, &request) {
 		return
 	}
 
-	// Если реферальный код указан, регистрируем с реферальным кодом
+	claims, ok := reqctx.UserFrom(r.Context())
+	if !ok {
+		api.writeError(w, r, CodeUnauthorized, nil)
+		return
+	}
+
+	var timezone, username string
+	if request.Username != nil {
+		name, err := normalizeUsername(*request.Username)
+		if err != nil {
+			api.writeError(w, r, CodeValidationFailed, err)
+			return
+		}
+		username = name
+	}
+	if request.Timezone != nil {
+		// пустое имя LoadLocation трактует как UTC, поэтому отклоняется отдельно
+		if *request.Timezone == "" {
+			api.writeError(w, r, CodeInvalidTimezone, errors.New("empty time zone"))
+			return
+		}
+		loc, err := time.LoadLocation(*request.Timezone)
+		if err != nil {
+			api.writeError(w, r, CodeInvalidTimezone, err)
+			return
+		}
+		timezone = loc.String()
+	}
+
+	ctx := r.Context()
+
 	resultChan := make(chan error)
 	go func() {
-		err := api.db.RegisterWithReferralCode(ctx, request.ReferralCode, request.User)
-		resultChan <- err
+		resultChan <- api.db.UpdateProfile(ctx, claims.UserID, storage.ProfileUpdate{
+			Username:         username,
+			Timezone:         timezone,
+			VanityLinkOptOut: request.VanityLinkOptOut,
+		})
 	}()
 
 	if err := <-resultChan; err != nil {
-		api.writeError(w, errors.New("failed to register with referral code: "+err.Error()), http.StatusInternalServerError)
+		if errors.Is(err, storage.ErrNotFound) {
+			api.writeError(w, r, CodeUserNotFound, err)
+			return
+		}
+		if errors.Is(err, storage.ErrUsernameTaken) {
+			api.writeError(w, r, CodeUsernameTaken, err)
+			return
+		}
+		api.writeError(w, r, CodeInternal, fmt.Errorf("failed to update profile: %w", err))
 		return
 	}
 
-	w.WriteHeader(http.StatusCreated)
+	respond(w, http.StatusNoContent, nil)
 }
 
-// Обработчик для получения рефералов по ID реферера
+// Обработчик для получения рефералов текущего пользователя с ходом
+// знакомства каждого с сервисом и состоянием вознаграждения за него.
+// Email приглашенных не раскрывается. Поддерживает limit/offset.
+func (api *API) GetMyReferrals(w http.ResponseWriter, r *http.Request) {
+	claims, ok := reqctx.UserFrom(r.Context())
+	if !ok {
+		api.writeError(w, r, CodeUnauthorized, nil)
+		return
+	}
+
+	referrals, ok := api.loadReferrals(w, r, claims.UserID)
+	if !ok {
+		return
+	}
+
+	response := make([]ReferralResponse, 0, len(referrals))
+	for _, ref := range referrals {
+		response = append(response, ReferralResponse{
+			Username:   ref.Username,
+			JoinedAt:   ref.JoinedAt,
+			Onboarding: ref.Onboarding,
+			Reward:     ref.Reward,
+		})
+	}
+
+	respond(w, http.StatusOK, response)
+}
+
+// Обработчик для получения рефералов по ID реферера (admin): ID, имя
+// и дата регистрации, без контактных данных. Поддерживает limit/offset.
 func (api *API) GetReferralsByReferrerID(w http.ResponseWriter, r *http.Request) {
 	referrerID := chi.URLParam(r, "referrerID")
 
 	id, err := strconv.Atoi(referrerID)
 	if err != nil {
-		api.writeError(w, errors.New("invalid referrer ID"), http.StatusBadRequest)
+		api.writeError(w, r, CodeInvalidID, err)
 		return
 	}
 
-	ctx, cancel := api.withTimeout(r.Context(), 5*time.Second)
-	defer cancel()
+	referrals, ok := api.loadReferrals(w, r, id)
+	if !ok {
+		return
+	}
+
+	respond(w, http.StatusOK, referrals)
+}
+
+// Функция для загрузки страницы рефералов; выставляет заголовок Link.
+// При ошибке ответ уже отправлен
+func (api *API) loadReferrals(w http.ResponseWriter, r *http.Request, referrerID int) ([]storage.ReferralSummary, bool) {
+	page, err := pagination.Parse(r, api.pages)
+	if err != nil {
+		api.writeError(w, r, CodeInvalidParameter, err)
+		return nil, false
+	}
+
+	ctx := r.Context()
 
-	resultChan := make(chan []storage.User)
+	resultChan := make(chan []storage.ReferralSummary)
 	errorChan := make(chan error)
 
 	go func() {
-		referrals, err := api.db.GetReferralsByReferrerID(ctx, id)
+		// лишняя запись показывает, есть ли следующая страница
+		referrals, err := api.db.GetReferralsByReferrerID(ctx, referrerID, page.Limit+1, page.Offset)
 		if err != nil {
 			errorChan <- err
 			return
@@ -310,11 +987,279 @@ func (api *API) GetReferralsByReferrerID(w http.ResponseWriter, r *http.Request)
 
 	select {
 	case referrals := <-resultChan:
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(referrals)
+		hasMore := len(referrals) > page.Limit
+		if hasMore {
+			referrals = referrals[:page.Limit]
+		}
+		pagination.SetLink(w, r, page, hasMore)
+		return referrals, true
+
+	case err := <-errorChan:
+		api.writeError(w, r, CodeInternal, fmt.Errorf("failed to retrieve referrals: %w", err))
+		return nil, false
+	}
+}
+
+// Обработчик для получения подробной информации о реферальном коде
+func (api *API) GetReferralCodeDetails(w http.ResponseWriter, r *http.Request) {
+	code := chi.URLParam(r, "code")
+
+	ctx := r.Context()
+
+	resultChan := make(chan storage.ReferralCodeDetails)
+	errorChan := make(chan error)
+
+	go func() {
+		details, err := api.db.GetReferralCodeDetails(ctx, code)
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		resultChan <- details
+	}()
+
+	select {
+	case details := <-resultChan:
+		now := time.Now()
+		response := ReferralCodeDetailsResponse{
+			ReferralCodeDetails: details,
+			Expired:             details.Expired(now),
+			Revoked:             details.Revoked(),
+			Exhausted:           details.Exhausted(),
+			Reserved:            details.Reserved(),
+		}
+		response.Active = !response.Expired && !response.Revoked && !response.Exhausted && !response.Reserved
+
+		respond(w, http.StatusOK, response)
 
 	case err := <-errorChan:
-		api.writeError(w, errors.New("failed to retrieve referrals: "+err.Error()), http.StatusInternalServerError)
+		if errors.Is(err, storage.ErrNotFound) {
+			api.writeError(w, r, CodeReferralCodeNotFound, err)
+			return
+		}
+		api.writeError(w, r, CodeInternal, fmt.Errorf("failed to retrieve referral code: %w", err))
 		return
 	}
 }
+
+// Обработчик для резервирования реферального кода за email до регистрации
+// пользователя. Код активируется автоматически при регистрации с этим email.
+func (api *API) ReserveReferralCode(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Email           string `json:"email"`
+		Code            string `json:"code"`
+		ExpiresAt       int64  `json:"expires_at"`
+		AllowedDomain   string `json:"allowed_domain"`
+		AllowSubdomains bool   `json:"allow_subdomains"`
+	}
+
+	if !api.decodeJSON(w, r, &request) {
+		return
+	}
+	if request.Email == "" || request.Code == "" {
+		api.writeError(w, r, CodeInvalidPayload, errors.New("email and code are required"))
+		return
+	}
+	if err := api.policy.validateCode(request.Code); err != nil {
+		api.writeError(w, r, CodeInvalidPayload, err)
+		return
+	}
+	if err := api.policy.validateExpiry(request.ExpiresAt); err != nil {
+		code, _ := expiryErrorCode(err)
+		api.writeError(w, r, code, err)
+		return
+	}
+	domain, err := domainRestriction(request.AllowedDomain, request.AllowSubdomains)
+	if err != nil {
+		api.writeError(w, r, CodeInvalidPayload, err)
+		return
+	}
+
+	ctx := r.Context()
+
+	resultChan := make(chan error)
+	go func() {
+		err := api.db.ReserveReferralCode(ctx, request.Email, request.Code, request.ExpiresAt, domain)
+		resultChan <- err
+	}()
+
+	if err := <-resultChan; err != nil {
+		switch {
+		case errors.Is(err, storage.ErrCodeTaken):
+			api.writeError(w, r, CodeReferralCodeTaken, err)
+		case errors.Is(err, storage.ErrEmailTaken):
+			api.writeError(w, r, CodeEmailTaken, err)
+		case errors.Is(err, storage.ErrExpiryInPast):
+			api.writeError(w, r, CodeExpiryInPast, err)
+		case errors.Is(err, storage.ErrExpiryTooFar):
+			api.writeError(w, r, CodeExpiryTooFar, err)
+		default:
+			api.writeError(w, r, CodeInternal, fmt.Errorf("failed to reserve referral code: %w", err))
+		}
+		return
+	}
+
+	created(w, r, "/admin/referral-codes/"+url.PathEscape(request.Code), nil)
+}
+
+// Обработчик для перезагрузки ключей подписи токенов. Токены, подписанные
+// прежним ключом, остаются действительными до истечения срока.
+func (api *API) ReloadKeys(w http.ResponseWriter, r *http.Request) {
+	if err := auth.Keys.Reload(); err != nil {
+		api.writeError(w, r, CodeInternal, fmt.Errorf("failed to reload signing keys: %w", err))
+		return
+	}
+	respond(w, http.StatusNoContent, nil)
+}
+
+// Обработчик для обновления токена: выпускает токен текущим ключом
+// с актуальной ролью пользователя. Клиенты вызывают его, получив
+// заголовок X-Token-Rotate. Токен входа от имени пользователя не
+// обновляется.
+func (api *API) RefreshToken(w http.ResponseWriter, r *http.Request) {
+	if _, ok := reqctx.UserFrom(r.Context()); !ok {
+		api.writeError(w, r, CodeUnauthorized, nil)
+		return
+	}
+
+	ctx := r.Context()
+
+	resultChan := make(chan storage.User)
+	errorChan := make(chan error)
+
+	go func() {
+		user, err := reqctx.CurrentUser(ctx, api.db)
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		resultChan <- user
+	}()
+
+	select {
+	case user := <-resultChan:
+		token, err := auth.GenerateToken(user.ID, user.Username, user.Role)
+		if err != nil {
+			api.writeError(w, r, CodeInternal, fmt.Errorf("failed to generate token: %w", err))
+			return
+		}
+		// новый токен подписан текущим ключом
+		w.Header().Del(middlware.TokenRotateHeader)
+		respond(w, http.StatusOK, TokenResponse{Token: token})
+
+	case err := <-errorChan:
+		if errors.Is(err, storage.ErrNotFound) {
+			api.writeError(w, r, CodeUnauthorized, err)
+			return
+		}
+		api.writeError(w, r, CodeInternal, fmt.Errorf("failed to refresh token: %w", err))
+		return
+	}
+}
+
+// Обработчик для получения состояния ключей подписи (admin): когда
+// счетчик проверок токенов прежнего ключа перестает расти, ключ можно
+// удалять, не дожидаясь конца периода ротации.
+func (api *API) GetKeyStats(w http.ResponseWriter, r *http.Request) {
+	respond(w, http.StatusOK, auth.Keys.KeyStats())
+}
+
+// Обработчик для выпуска токена входа от имени пользователя (admin).
+// Токен короткоживущий, в утверждении act указан администратор;
+// вход от имени другого администратора запрещен. Выпуск фиксируется
+// в журнале аудита.
+func (api *API) Impersonate(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		api.writeError(w, r, CodeInvalidID, err)
+		return
+	}
+
+	claims, ok := reqctx.UserFrom(r.Context())
+	if !ok {
+		api.writeError(w, r, CodeUnauthorized, nil)
+		return
+	}
+
+	ctx := r.Context()
+
+	resultChan := make(chan storage.User)
+	errorChan := make(chan error)
+
+	go func() {
+		user, err := api.db.GetUserByID(ctx, id)
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		if user.Role == storage.RoleAdmin {
+			errorChan <- errForbidden
+			return
+		}
+		err = api.db.RecordAudit(ctx, claims.ActorID(), storage.AuditUserImpersonated, user.ID, nil)
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		resultChan <- user
+	}()
+
+	select {
+	case user := <-resultChan:
+		token, err := auth.GenerateImpersonationToken(user.ID, user.Username, user.Role,
+			auth.Actor{UserID: claims.ActorID(), Username: claims.Username})
+		if err != nil {
+			api.writeError(w, r, CodeInternal, fmt.Errorf("failed to generate token: %w", err))
+			return
+		}
+		respond(w, http.StatusOK, TokenResponse{Token: token})
+
+	case err := <-errorChan:
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			api.writeError(w, r, CodeUserNotFound, err)
+		case errors.Is(err, errForbidden):
+			api.writeError(w, r, CodeForbidden, err)
+		default:
+			api.writeError(w, r, CodeInternal, fmt.Errorf("failed to impersonate user: %w", err))
+		}
+		return
+	}
+}
+
+// Обработчик для анонимизации пользователя (удаление персональных данных)
+func (api *API) AnonymizeUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		api.writeError(w, r, CodeInvalidID, err)
+		return
+	}
+
+	claims, ok := reqctx.UserFrom(r.Context())
+	if !ok {
+		api.writeError(w, r, CodeUnauthorized, nil)
+		return
+	}
+
+	ctx := r.Context()
+
+	resultChan := make(chan error)
+	go func() {
+		err := api.db.AnonymizeUser(ctx, id, claims.ActorID())
+		resultChan <- err
+	}()
+
+	if err := <-resultChan; err != nil {
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			api.writeError(w, r, CodeUserNotFound, err)
+		case errors.Is(err, storage.ErrAlreadyAnonymized):
+			api.writeError(w, r, CodeUserAlreadyAnonymized, err)
+		default:
+			api.writeError(w, r, CodeInternal, fmt.Errorf("failed to anonymize user: %w", err))
+		}
+		return
+	}
+
+	respond(w, http.StatusNoContent, nil)
+}
@@ -2,15 +2,36 @@ package api_test
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/golang/mock/gomock"
 	"gorefer.go/pkg/api"
+	"gorefer.go/pkg/api/apitest"
+	"gorefer.go/pkg/api/middlware"
+	"gorefer.go/pkg/api/pagination"
 	"gorefer.go/pkg/auth"
+	"gorefer.go/pkg/mailer"
+	"gorefer.go/pkg/onboarding"
+	"gorefer.go/pkg/retention"
+	"gorefer.go/pkg/rewards"
 	"gorefer.go/pkg/storage"
 )
 
@@ -96,6 +117,7 @@ func TestAPI_LoginUser(t *testing.T) {
 						Username: "testuser",
 						Password: hashedPassword, // Hashed password
 					}, nil)
+				mockDB.EXPECT().RecordLogin(gomock.Any(), storage.LoginEvent{UserID: 1, Success: true}).Return(nil)
 			},
 		},
 		{
@@ -128,6 +150,7 @@ func TestAPI_LoginUser(t *testing.T) {
 						Username: "testuser",
 						Password: hashedPassword, // Hashed password
 					}, nil)
+				mockDB.EXPECT().RecordLogin(gomock.Any(), storage.LoginEvent{UserID: 1, Success: false}).Return(nil)
 			},
 		},
 	}
@@ -157,6 +180,11 @@ func TestAPI_LoginUser(t *testing.T) {
 			}
 		})
 	}
+
+	// попытки входа записываются в фоне
+	if err := apiHandler.Close(); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestAPI_RegisterWithReferralCode(t *testing.T) {
@@ -200,7 +228,13 @@ func TestAPI_RegisterWithReferralCode(t *testing.T) {
 			mockSetup: func() {
 				mockDB.EXPECT().
 					RegisterWithReferralCode(gomock.Any(), "REF123", gomock.Any()).
-					Return(nil) // успешное применение реферального кода
+					DoAndReturn(func(_ context.Context, _ string, params storage.CreateUserParams) (storage.ReferralRegistration, error) {
+						// пароль сохраняется только в виде хэша
+						if auth.CheckPasswordHash("password123", params.Password) != nil {
+							t.Errorf("stored password %q is not a hash of the submitted one", params.Password)
+						}
+						return storage.ReferralRegistration{UserID: 7, Referrer: storage.UserRef{ID: 3, Username: "alice"}}, nil
+					})
 			},
 		},
 		{
@@ -215,7 +249,7 @@ func TestAPI_RegisterWithReferralCode(t *testing.T) {
 			mockSetup: func() {
 				mockDB.EXPECT().
 					RegisterWithReferralCode(gomock.Any(), "REF123", gomock.Any()).
-					Return(errors.New("some database error")) // имитируем ошибку
+					Return(storage.ReferralRegistration{}, errors.New("some database error")) // имитируем ошибку
 			},
 		},
 		{
@@ -262,6 +296,6165 @@ func TestAPI_RegisterWithReferralCode(t *testing.T) {
 			handler := http.HandlerFunc(apiHandler.Router().ServeHTTP) // получаем обработчик
 			handler.ServeHTTP(rr, req)                                 // выполняем запрос
 
+			if rr.Code != tt.expectedCode {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, tt.expectedCode)
+			}
+			if rr.Code != http.StatusCreated {
+				return
+			}
+			var resp api.ReferralSignupResponse
+			if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.User.Username != tt.input.Username || resp.User.Email != tt.input.Email {
+				t.Errorf("user = %+v, want %s <%s>", resp.User, tt.input.Username, tt.input.Email)
+			}
+			if tt.referralCode == "" {
+				if resp.ReferredBy != nil {
+					t.Errorf("referred_by = %+v, want null", resp.ReferredBy)
+				}
+			} else if resp.ReferredBy == nil || *resp.ReferredBy != (storage.UserRef{ID: 3, Username: "alice"}) || resp.User.ID != 7 {
+				t.Errorf("response = %+v, want user 7 referred by alice", resp)
+			}
+		})
+	}
+}
+
+func TestAPI_StartClose(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	before := runtime.NumGoroutine()
+
+	apiHandler := api.New(storage.NewMockDBInterface(ctrl))
+	for i := 0; i < 3; i++ {
+		apiHandler.Register(api.ComponentFunc(func(ctx context.Context) {
+			<-ctx.Done()
+		}))
+	}
+	apiHandler.Start(context.Background())
+
+	if err := apiHandler.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	// даем планировщику время убрать завершенные горутины
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("goroutines leaked: before %d, after %d", before, after)
+	}
+}
+
+// Срок действия кодов, создаваемых в тестах: в пределах наибольшего срока
+// действия по умолчанию
+var codeExpiresAt = time.Now().AddDate(0, 6, 0).Unix()
+
+// bearer выпускает токен для тестового пользователя с указанной ролью
+func bearer(t *testing.T, userID int, role string) string {
+	t.Helper()
+	token, err := auth.GenerateToken(userID, "testuser", role)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "Bearer " + token
+}
+
+func TestAPI_GetReferralCodeDetails(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDB := storage.NewMockDBInterface(ctrl)
+	apiHandler := api.New(mockDB)
+
+	maxUses := 3
+	revokedAt := time.Now().Add(-time.Hour)
+
+	tests := []struct {
+		name          string
+		code          string
+		role          string
+		expectedCode  int
+		wantActive    bool
+		wantExpired   bool
+		wantRevoked   bool
+		wantExhausted bool
+		mockSetup     func()
+	}{
+		{
+			name:         "Active code",
+			code:         "ABC123",
+			role:         storage.RoleAdmin,
+			expectedCode: http.StatusOK,
+			wantActive:   true,
+			mockSetup: func() {
+				mockDB.EXPECT().
+					GetReferralCodeDetails(gomock.Any(), "ABC123").
+					Return(storage.ReferralCodeDetails{
+						ReferralCode:  storage.ReferralCode{ID: 1, UserID: 2, Code: "ABC123", ExpiresAt: time.Now().Add(time.Hour)},
+						OwnerUsername: "owner",
+						OwnerEmail:    "owner@example.com",
+					}, nil)
+			},
+		},
+		{
+			name:          "Expired, revoked and exhausted code",
+			code:          "OLD123",
+			role:          storage.RoleAdmin,
+			expectedCode:  http.StatusOK,
+			wantExpired:   true,
+			wantRevoked:   true,
+			wantExhausted: true,
+			mockSetup: func() {
+				mockDB.EXPECT().
+					GetReferralCodeDetails(gomock.Any(), "OLD123").
+					Return(storage.ReferralCodeDetails{
+						ReferralCode: storage.ReferralCode{ID: 2, UserID: 2, Code: "OLD123", ExpiresAt: time.Now().Add(-time.Hour), Uses: 3},
+						MaxUses:      &maxUses,
+						RevokedAt:    &revokedAt,
+					}, nil)
+			},
+		},
+		{
+			name:         "Reserved code is not active",
+			code:         "ALICE2024",
+			role:         storage.RoleAdmin,
+			expectedCode: http.StatusOK,
+			mockSetup: func() {
+				mockDB.EXPECT().
+					GetReferralCodeDetails(gomock.Any(), "ALICE2024").
+					Return(storage.ReferralCodeDetails{
+						ReferralCode: storage.ReferralCode{ID: 3, Code: "ALICE2024", ExpiresAt: time.Now().Add(time.Hour)},
+						Status:       storage.CodeStatusReserved,
+						OwnerEmail:   "alice@example.com",
+					}, nil)
+			},
+		},
+		{
+			name:         "Unknown code",
+			code:         "NOPE",
+			role:         storage.RoleAdmin,
+			expectedCode: http.StatusNotFound,
+			mockSetup: func() {
+				mockDB.EXPECT().
+					GetReferralCodeDetails(gomock.Any(), "NOPE").
+					Return(storage.ReferralCodeDetails{}, storage.ErrNotFound)
+			},
+		},
+		{
+			name:         "Non-admin caller",
+			code:         "ABC123",
+			role:         storage.RoleUser,
+			expectedCode: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.mockSetup != nil {
+				tt.mockSetup()
+			}
+
+			req, err := http.NewRequest("GET", "/admin/referral-codes/"+tt.code, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", bearer(t, 1, tt.role))
+
+			rr := httptest.NewRecorder()
+			apiHandler.Router().ServeHTTP(rr, req)
+
+			if status := rr.Code; status != tt.expectedCode {
+				t.Fatalf("handler returned wrong status code: got %v want %v", status, tt.expectedCode)
+			}
+			if tt.expectedCode != http.StatusOK {
+				return
+			}
+
+			var got struct {
+				Active    bool `json:"active"`
+				Expired   bool `json:"expired"`
+				Revoked   bool `json:"revoked"`
+				Exhausted bool `json:"exhausted"`
+			}
+			if err := json.NewDecoder(rr.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Active != tt.wantActive || got.Expired != tt.wantExpired || got.Revoked != tt.wantRevoked || got.Exhausted != tt.wantExhausted {
+				t.Errorf("unexpected status flags: %+v", got)
+			}
+		})
+	}
+}
+
+func TestAPI_GetMyReferralCode_ETag(t *testing.T) {
+	srv := apitest.NewServer(t)
+	ctx := context.Background()
+
+	expiresAt := time.Now().Add(time.Hour).Unix()
+	if err := srv.Store.CreateReferralCode(ctx, srv.User.ID, "REF123", expiresAt, "", nil, storage.DomainRestriction{}); err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(method, ifNoneMatch string) (*http.Response, string) {
+		req := srv.NewRequest(t, method, "/p/referral-code", nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, string(body)
+	}
+
+	first, body := do("GET", "")
+	etag := first.Header.Get("ETag")
+	if first.StatusCode != http.StatusOK || etag == "" || body == "" {
+		t.Fatalf("first GET: code %d, etag %q, body %q", first.StatusCode, etag, body)
+	}
+
+	second, body := do("GET", etag)
+	if second.StatusCode != http.StatusNotModified || body != "" {
+		t.Fatalf("conditional GET: code %d, body %q", second.StatusCode, body)
+	}
+
+	head, body := do("HEAD", "")
+	if head.StatusCode != http.StatusOK || body != "" || head.Header.Get("ETag") != etag {
+		t.Fatalf("HEAD: code %d, body %q, etag %q", head.StatusCode, body, head.Header.Get("ETag"))
+	}
+
+	// регистрация по коду увеличивает число использований
+	referee := storage.CreateUserParams{User: storage.User{Username: "referee", Email: "referee@example.com"}}
+	if _, err := srv.Store.RegisterWithReferralCode(ctx, "REF123", referee); err != nil {
+		t.Fatal(err)
+	}
+	third, _ := do("GET", etag)
+	if third.StatusCode != http.StatusOK || third.Header.Get("ETag") == etag {
+		t.Fatalf("GET after change: code %d, etag %q", third.StatusCode, third.Header.Get("ETag"))
+	}
+}
+
+// unavailableError имитирует ошибку открытого предохранителя
+type unavailableError struct{}
+
+func (unavailableError) Error() string             { return "circuit open" }
+func (unavailableError) RetryAfter() time.Duration { return 7 * time.Second }
+
+func TestAPI_RetryAfter(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDB := storage.NewMockDBInterface(ctrl)
+	apiHandler := api.New(mockDB, api.WithRetryAfter(3*time.Second))
+
+	tests := []struct {
+		name           string
+		dbErr          error
+		expectedCode   int
+		wantRetryAfter string
+	}{
+		{"Deadline exceeded", context.DeadlineExceeded, http.StatusGatewayTimeout, "3"},
+		{"Dependency unavailable", unavailableError{}, http.StatusServiceUnavailable, "7"},
+		{"Other error", errors.New("boom"), http.StatusInternalServerError, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockDB.EXPECT().
+				GetReferralCodeDetails(gomock.Any(), "ABC123").
+				Return(storage.ReferralCodeDetails{}, tt.dbErr)
+
+			req, err := http.NewRequest("GET", "/admin/referral-codes/ABC123", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", bearer(t, 1, storage.RoleAdmin))
+
+			rr := httptest.NewRecorder()
+			apiHandler.Router().ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedCode {
+				t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, tt.expectedCode)
+			}
+			if got := rr.Header().Get("Retry-After"); got != tt.wantRetryAfter {
+				t.Errorf("Retry-After = %q, want %q", got, tt.wantRetryAfter)
+			}
+
+			var body struct {
+				RetryAfterSeconds int `json:"retry_after_seconds"`
+			}
+			if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			want := 0
+			if tt.wantRetryAfter != "" {
+				want, _ = strconv.Atoi(tt.wantRetryAfter)
+			}
+			if body.RetryAfterSeconds != want {
+				t.Errorf("retry_after_seconds = %d, want %d", body.RetryAfterSeconds, want)
+			}
+		})
+	}
+}
+
+func TestAPI_AnonymizeUser(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDB := storage.NewMockDBInterface(ctrl)
+	apiHandler := api.New(mockDB)
+
+	tests := []struct {
+		name         string
+		path         string
+		role         string
+		expectedCode int
+		mockSetup    func()
+	}{
+		{
+			name:         "Successful anonymization",
+			path:         "/admin/users/5/anonymize",
+			role:         storage.RoleAdmin,
+			expectedCode: http.StatusNoContent,
+			mockSetup: func() {
+				mockDB.EXPECT().AnonymizeUser(gomock.Any(), 5, 1).Return(nil)
+			},
+		},
+		{
+			name:         "Already anonymized",
+			path:         "/admin/users/5/anonymize",
+			role:         storage.RoleAdmin,
+			expectedCode: http.StatusConflict,
+			mockSetup: func() {
+				mockDB.EXPECT().AnonymizeUser(gomock.Any(), 5, 1).Return(storage.ErrAlreadyAnonymized)
+			},
+		},
+		{
+			name:         "Unknown user",
+			path:         "/admin/users/404/anonymize",
+			role:         storage.RoleAdmin,
+			expectedCode: http.StatusNotFound,
+			mockSetup: func() {
+				mockDB.EXPECT().AnonymizeUser(gomock.Any(), 404, 1).Return(storage.ErrNotFound)
+			},
+		},
+		{
+			name:         "Invalid user ID",
+			path:         "/admin/users/abc/anonymize",
+			role:         storage.RoleAdmin,
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "Non-admin caller",
+			path:         "/admin/users/5/anonymize",
+			role:         storage.RoleUser,
+			expectedCode: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.mockSetup != nil {
+				tt.mockSetup()
+			}
+
+			req, err := http.NewRequest("POST", tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", bearer(t, 1, tt.role))
+
+			rr := httptest.NewRecorder()
+			apiHandler.Router().ServeHTTP(rr, req)
+
+			if status := rr.Code; status != tt.expectedCode {
+				t.Errorf("handler returned wrong status code: got %v want %v", status, tt.expectedCode)
+			}
+		})
+	}
+}
+
+func TestAPI_ErrorLocalization(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDB := storage.NewMockDBInterface(ctrl)
+	apiHandler := api.New(mockDB)
+
+	tests := []struct {
+		name           string
+		acceptLanguage string
+		wantMessage    string
+	}{
+		{"Default language", "", "referral code not found"},
+		{"English", "en-US,en;q=0.9", "referral code not found"},
+		{"Russian", "ru-RU,ru;q=0.9,en;q=0.8", "реферальный код не найден"},
+		{"Weighted preference", "en;q=0.3, ru;q=0.7", "реферальный код не найден"},
+		{"Unknown language falls back", "de-DE,fr;q=0.5", "referral code not found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockDB.EXPECT().
+				GetReferralCodeDetails(gomock.Any(), "NOPE").
+				Return(storage.ReferralCodeDetails{}, storage.ErrNotFound)
+
+			req, err := http.NewRequest("GET", "/admin/referral-codes/NOPE", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", bearer(t, 1, storage.RoleAdmin))
+			if tt.acceptLanguage != "" {
+				req.Header.Set("Accept-Language", tt.acceptLanguage)
+			}
+
+			rr := httptest.NewRecorder()
+			apiHandler.Router().ServeHTTP(rr, req)
+
+			var body struct {
+				Error string `json:"error"`
+				Code  string `json:"code"`
+			}
+			if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Code != api.CodeReferralCodeNotFound {
+				t.Errorf("code = %q, want %q", body.Code, api.CodeReferralCodeNotFound)
+			}
+			if body.Error != tt.wantMessage {
+				t.Errorf("error = %q, want %q", body.Error, tt.wantMessage)
+			}
 		})
 	}
 }
+
+func TestAPI_GetReferralCodeByEmail_Authorization(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDB := storage.NewMockDBInterface(ctrl)
+	apiHandler := api.New(mockDB)
+
+	tests := []struct {
+		name         string
+		email        string
+		role         string
+		expectedCode int
+		mockSetup    func()
+	}{
+		{
+			name:         "Own email",
+			email:        "self@example.com",
+			role:         storage.RoleUser,
+			expectedCode: http.StatusOK,
+			mockSetup: func() {
+				mockDB.EXPECT().
+					GetUserByID(gomock.Any(), 3).
+					Return(storage.User{ID: 3, Email: "Self@example.com"}, nil)
+				mockDB.EXPECT().
+					GetReferralCodeByEmail(gomock.Any(), "self@example.com").
+					Return(storage.ReferralCode{ID: 1, UserID: 3, Code: "REF123"}, nil)
+			},
+		},
+		{
+			name:         "Other user's email",
+			email:        "other@example.com",
+			role:         storage.RoleUser,
+			expectedCode: http.StatusForbidden,
+			mockSetup: func() {
+				mockDB.EXPECT().
+					GetUserByID(gomock.Any(), 3).
+					Return(storage.User{ID: 3, Email: "self@example.com"}, nil)
+			},
+		},
+		{
+			name:         "Admin reads any email",
+			email:        "other@example.com",
+			role:         storage.RoleAdmin,
+			expectedCode: http.StatusOK,
+			mockSetup: func() {
+				mockDB.EXPECT().
+					GetReferralCodeByEmail(gomock.Any(), "other@example.com").
+					Return(storage.ReferralCode{ID: 2, UserID: 4, Code: "REF456"}, nil)
+			},
+		},
+		{
+			name:         "No code for email",
+			email:        "nocode@example.com",
+			role:         storage.RoleAdmin,
+			expectedCode: http.StatusNotFound,
+			mockSetup: func() {
+				mockDB.EXPECT().
+					GetReferralCodeByEmail(gomock.Any(), "nocode@example.com").
+					Return(storage.ReferralCode{}, fmt.Errorf("storage: get referral code: %w", storage.ErrNotFound))
+			},
+		},
+		{
+			name:         "Storage failure is not reported as missing code",
+			email:        "other@example.com",
+			role:         storage.RoleAdmin,
+			expectedCode: http.StatusInternalServerError,
+			mockSetup: func() {
+				mockDB.EXPECT().
+					GetReferralCodeByEmail(gomock.Any(), "other@example.com").
+					Return(storage.ReferralCode{}, errors.New("connection refused"))
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.mockSetup()
+
+			req, err := http.NewRequest("GET", "/p/referral-code/"+tt.email, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", bearer(t, 3, tt.role))
+
+			rr := httptest.NewRecorder()
+			apiHandler.Router().ServeHTTP(rr, req)
+
+			if status := rr.Code; status != tt.expectedCode {
+				t.Errorf("handler returned wrong status code: got %v want %v", status, tt.expectedCode)
+			}
+		})
+	}
+}
+
+func TestAPI_Hooks(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDB := storage.NewMockDBInterface(ctrl)
+	recorder := &api.HookRecorder{}
+	apiHandler := api.New(mockDB, api.WithHooks(recorder.Hooks()))
+
+	do := func(path string, body interface{}) int {
+		b, _ := json.Marshal(body)
+		req, err := http.NewRequest("POST", path, bytes.NewBuffer(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		apiHandler.Router().ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	mockDB.EXPECT().CreateUser(gomock.Any(), gomock.Any()).Return(10, nil)
+	mockDB.EXPECT().CreateUser(gomock.Any(), gomock.Any()).Return(0, errors.New("duplicate"))
+	mockDB.EXPECT().RegisterWithReferralCode(gomock.Any(), "REF123", gomock.Any()).Return(storage.ReferralRegistration{UserID: 2, Referrer: storage.UserRef{ID: 1, Username: "alice"}}, nil)
+	mockDB.EXPECT().GetUserByEmail(gomock.Any(), "ghost@example.com").Return(storage.User{}, storage.ErrNotFound)
+
+	do("/register", storage.User{Username: "first", Email: "first@example.com", Password: "password123"})
+	do("/register", storage.User{Username: "dup", Email: "dup@example.com", Password: "password123"})
+	do("/register-with-referral", map[string]interface{}{
+		"referral_code": "REF123",
+		"user":          storage.User{Username: "second", Email: "second@example.com", Password: "password123"},
+	})
+	do("/login", storage.User{Email: "ghost@example.com", Password: "password123"})
+
+	if err := apiHandler.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(recorder.Registered) != 2 {
+		t.Fatalf("OnUserRegistered called %d times, want 2", len(recorder.Registered))
+	}
+	for _, u := range recorder.Registered {
+		if u.Password != "" {
+			t.Errorf("hook received password for %s", u.Email)
+		}
+		if u.Email == "first@example.com" && u.ID != 10 {
+			t.Errorf("hook received user ID %d, want 10", u.ID)
+		}
+	}
+	if len(recorder.Referrals) != 1 || recorder.Referrals[0].Code != "REF123" {
+		t.Errorf("OnReferralCreated calls = %+v", recorder.Referrals)
+	}
+	if len(recorder.FailedLogins) != 1 || recorder.FailedLogins[0] != "ghost@example.com" {
+		t.Errorf("OnLoginFailed calls = %v", recorder.FailedLogins)
+	}
+}
+
+func TestAPI_HookPanicRecovered(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDB := storage.NewMockDBInterface(ctrl)
+	apiHandler := api.New(mockDB, api.WithHooks(api.Hooks{
+		OnUserRegistered: func(ctx context.Context, user storage.User) {
+			panic("bad hook")
+		},
+	}))
+
+	mockDB.EXPECT().CreateUser(gomock.Any(), gomock.Any()).Return(1, nil)
+
+	body, _ := json.Marshal(storage.User{Username: "testuser", Email: "test@example.com", Password: "password123"})
+	req, err := http.NewRequest("POST", "/register", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	apiHandler.Router().ServeHTTP(rr, req)
+
+	if err := apiHandler.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if rr.Code != http.StatusCreated {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+	}
+}
+
+func TestAPI_Referrals(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDB := storage.NewMockDBInterface(ctrl)
+	apiHandler := api.New(mockDB)
+
+	referees := []storage.ReferralSummary{
+		{ID: 8, Username: "friend", JoinedAt: time.Now()},
+	}
+
+	tests := []struct {
+		name         string
+		path         string
+		role         string
+		expectedCode int
+		wantKeys     []string // ключи элемента списка; контактных данных нет ни в одном
+		mockSetup    func()
+	}{
+		{
+			name:         "Own referrals without ids",
+			path:         "/p/referrals",
+			role:         storage.RoleUser,
+			expectedCode: http.StatusOK,
+			wantKeys:     []string{"joined_at", "username"},
+			mockSetup: func() {
+				mockDB.EXPECT().GetReferralsByReferrerID(gomock.Any(), 3, gomock.Any(), gomock.Any()).Return(referees, nil)
+			},
+		},
+		{
+			name:         "Admin lists any referrer",
+			path:         "/admin/referrals/5",
+			role:         storage.RoleAdmin,
+			expectedCode: http.StatusOK,
+			wantKeys:     []string{"id", "joined_at", "username"},
+			mockSetup: func() {
+				mockDB.EXPECT().GetReferralsByReferrerID(gomock.Any(), 5, gomock.Any(), gomock.Any()).Return(referees, nil)
+			},
+		},
+		{
+			name:         "Non-admin cannot list another referrer",
+			path:         "/admin/referrals/5",
+			role:         storage.RoleUser,
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			name:         "Old per-referrer route is gone",
+			path:         "/p/referrals/5",
+			role:         storage.RoleUser,
+			expectedCode: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.mockSetup != nil {
+				tt.mockSetup()
+			}
+
+			req, err := http.NewRequest("GET", tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", bearer(t, 3, tt.role))
+
+			rr := httptest.NewRecorder()
+			apiHandler.Router().ServeHTTP(rr, req)
+
+			if status := rr.Code; status != tt.expectedCode {
+				t.Fatalf("handler returned wrong status code: got %v want %v", status, tt.expectedCode)
+			}
+			if tt.expectedCode != http.StatusOK {
+				return
+			}
+			var items []json.RawMessage
+			if err := json.Unmarshal(rr.Body.Bytes(), &items); err != nil || len(items) != 1 {
+				t.Fatalf("body = %s, want one referral", rr.Body.String())
+			}
+			if got := jsonKeys(t, items[0]); !reflect.DeepEqual(got, tt.wantKeys) {
+				t.Errorf("keys = %v, want %v", got, tt.wantKeys)
+			}
+		})
+	}
+}
+
+// jsonKeys возвращает отсортированный список ключей JSON-объекта
+func jsonKeys(t *testing.T, body []byte) []string {
+	t.Helper()
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(body, &m); err != nil {
+		t.Fatalf("invalid JSON object %q: %v", body, err)
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestAPI_ResponseShapes(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDB := storage.NewMockDBInterface(ctrl)
+	apiHandler := api.New(mockDB)
+
+	hashedPassword, _ := auth.HashPassword("password123")
+	joinedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		body        interface{}
+		role        string
+		mockSetup   func()
+		wantCode    int
+		wantKeys    []string
+		wantBody    string
+		contentType string
+	}{
+		{
+			name:   "Register",
+			method: "POST",
+			path:   "/register",
+			body:   storage.User{Username: "testuser", Email: "test@example.com", Password: "password123"},
+			mockSetup: func() {
+				mockDB.EXPECT().CreateUser(gomock.Any(), gomock.Any()).Return(42, nil)
+			},
+			wantCode: http.StatusCreated,
+			wantBody: `{"id":42}`,
+		},
+		{
+			name:   "Login",
+			method: "POST",
+			path:   "/login",
+			body:   storage.User{Email: "test@example.com", Password: "password123"},
+			mockSetup: func() {
+				mockDB.EXPECT().GetUserByEmail(gomock.Any(), "test@example.com").
+					Return(storage.User{ID: 1, Username: "testuser", Password: hashedPassword}, nil)
+				mockDB.EXPECT().RecordLogin(gomock.Any(), gomock.Any()).Return(nil)
+			},
+			wantCode: http.StatusOK,
+			wantKeys: []string{"token"},
+		},
+		{
+			name:     "Error envelope",
+			method:   "POST",
+			path:     "/login",
+			body:     "not an object",
+			wantCode: http.StatusBadRequest,
+			wantBody: `{"error":"invalid request payload","code":"INVALID_PAYLOAD"}`,
+		},
+		{
+			name:   "My referrals",
+			method: "GET",
+			path:   "/p/referrals",
+			role:   storage.RoleUser,
+			mockSetup: func() {
+				mockDB.EXPECT().GetReferralsByReferrerID(gomock.Any(), 1, gomock.Any(), gomock.Any()).
+					Return([]storage.ReferralSummary{{ID: 2, Username: "friend", JoinedAt: joinedAt}}, nil)
+			},
+			wantCode: http.StatusOK,
+			wantBody: `[{"username":"friend","joined_at":"2024-01-02T03:04:05Z"}]`,
+		},
+		{
+			name:   "Referral code details",
+			method: "GET",
+			path:   "/admin/referral-codes/ABC123",
+			role:   storage.RoleAdmin,
+			mockSetup: func() {
+				mockDB.EXPECT().GetReferralCodeDetails(gomock.Any(), "ABC123").
+					Return(storage.ReferralCodeDetails{ReferralCode: storage.ReferralCode{Code: "ABC123"}}, nil)
+			},
+			wantCode: http.StatusOK,
+			wantKeys: []string{"active", "clicks", "code", "created_at", "exhausted", "expired", "expires_at", "id",
+				"max_uses", "owner_email", "owner_username", "reserved", "revoked", "revoked_at", "status", "user_id", "uses"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.mockSetup != nil {
+				tt.mockSetup()
+			}
+
+			var body bytes.Buffer
+			if tt.body != nil {
+				json.NewEncoder(&body).Encode(tt.body)
+			}
+			req, err := http.NewRequest(tt.method, tt.path, &body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.role != "" {
+				req.Header.Set("Authorization", bearer(t, 1, tt.role))
+			}
+
+			rr := httptest.NewRecorder()
+			apiHandler.Router().ServeHTTP(rr, req)
+
+			if rr.Code != tt.wantCode {
+				t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, tt.wantCode)
+			}
+			if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", ct)
+			}
+			if tt.wantBody != "" {
+				if got := strings.TrimSpace(rr.Body.String()); got != tt.wantBody {
+					t.Errorf("body = %s, want %s", got, tt.wantBody)
+				}
+			}
+			if tt.wantKeys != nil {
+				if got := jsonKeys(t, rr.Body.Bytes()); !reflect.DeepEqual(got, tt.wantKeys) {
+					t.Errorf("keys = %v, want %v", got, tt.wantKeys)
+				}
+			}
+		})
+	}
+
+	if err := apiHandler.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAPI_RouteTimeouts(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDB := storage.NewMockDBInterface(ctrl)
+	apiHandler := api.New(mockDB, api.WithTimeouts(api.Timeouts{
+		User:  20 * time.Millisecond,
+		Admin: time.Second,
+	}))
+
+	// медленное хранилище, уважающее контекст
+	slow := func(ctx context.Context, userID, limit, offset int) ([]storage.ReferralSummary, error) {
+		select {
+		case <-time.After(100 * time.Millisecond):
+			return nil, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	tests := []struct {
+		name         string
+		path         string
+		role         string
+		expectedCode int
+	}{
+		{"Slow DB trips the user route timeout", "/p/referrals", storage.RoleUser, http.StatusGatewayTimeout},
+		{"Admin route has a larger budget", "/admin/referrals/1", storage.RoleAdmin, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockDB.EXPECT().GetReferralsByReferrerID(gomock.Any(), 1, gomock.Any(), gomock.Any()).DoAndReturn(slow)
+
+			req, err := http.NewRequest("GET", tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", bearer(t, 1, tt.role))
+
+			rr := httptest.NewRecorder()
+			apiHandler.Router().ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedCode {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, tt.expectedCode)
+			}
+		})
+	}
+}
+
+func TestAPI_AuthConcurrency(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDB := storage.NewMockDBInterface(ctrl)
+	apiHandler := api.New(mockDB, api.WithAuthConcurrency(1, 0))
+
+	// первый вход держит единственное место, пока тест его не отпустит
+	started, release := make(chan struct{}), make(chan struct{})
+	mockDB.EXPECT().GetUserByEmail(gomock.Any(), "slow@example.com").DoAndReturn(func(ctx context.Context, email string) (storage.User, error) {
+		close(started)
+		<-release
+		return storage.User{}, storage.ErrNotFound
+	})
+	admitted := make(chan int)
+	go func() {
+		rr := httptest.NewRecorder()
+		apiHandler.Router().ServeHTTP(rr, httptest.NewRequest("POST", "/login", strings.NewReader(`{"email":"slow@example.com","password":"secret"}`)))
+		admitted <- rr.Code
+	}()
+	<-started
+
+	tests := []struct {
+		name string
+		path string
+		body string
+		want int
+	}{
+		{"Login is shed", "/login", `{"email":"other@example.com","password":"secret"}`, http.StatusServiceUnavailable},
+		{"Registration shares the limit", "/register", `{"username":"other","email":"other@example.com","password":"secret"}`, http.StatusServiceUnavailable},
+		{"Other public routes are not limited", "/config/public", "", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := "POST"
+			if tt.body == "" {
+				method = "GET"
+			}
+			rr := httptest.NewRecorder()
+			apiHandler.Router().ServeHTTP(rr, httptest.NewRequest(method, tt.path, strings.NewReader(tt.body)))
+			if rr.Code != tt.want {
+				t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, tt.want)
+			}
+			if tt.want != http.StatusServiceUnavailable {
+				return
+			}
+			var body api.ErrorResponse
+			if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Code != api.CodeServiceUnavailable || rr.Header().Get("Retry-After") == "" {
+				t.Errorf("shed response = %+v, Retry-After %q; want %s with Retry-After", body, rr.Header().Get("Retry-After"), api.CodeServiceUnavailable)
+			}
+		})
+	}
+
+	close(release)
+	if code := <-admitted; code != http.StatusUnauthorized {
+		t.Errorf("admitted login = %d, want 401", code)
+	}
+}
+
+func TestAPI_GetProgramReport(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDB := storage.NewMockDBInterface(ctrl)
+	apiHandler := api.New(mockDB)
+
+	from := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2026, 1, 3, 0, 0, 0, 0, time.UTC)
+	report := storage.ProgramReport{
+		From:            from,
+		To:              to,
+		TotalSignups:    4,
+		ReferralSignups: 1,
+		ConversionRate:  0.25,
+		TopCodes:        []storage.CodeStat{{Code: "ABC", Signups: 1}},
+		Days: []storage.DayStat{
+			{Date: from, Signups: 3, ReferralSignups: 1},
+			{Date: from.AddDate(0, 0, 1), Signups: 1},
+		},
+	}
+
+	tests := []struct {
+		name         string
+		query        string
+		expectedCode int
+		expectedBody string
+		mockSetup    func()
+	}{
+		{
+			name:         "JSON report",
+			query:        "from=2026-01-01&to=2026-01-02",
+			expectedCode: http.StatusOK,
+			expectedBody: `"conversion_rate":0.25`,
+			mockSetup: func() {
+				mockDB.EXPECT().GetProgramReport(gomock.Any(), from, to).Return(report, nil)
+			},
+		},
+		{
+			name:         "CSV report",
+			query:        "from=2026-01-01&to=2026-01-02&format=csv",
+			expectedCode: http.StatusOK,
+			expectedBody: "date,signups,referral_signups\n2026-01-01,3,1\n2026-01-02,1,0\n",
+			mockSetup: func() {
+				mockDB.EXPECT().GetProgramReport(gomock.Any(), from, to).Return(report, nil)
+			},
+		},
+		{
+			name:         "Full leap year is allowed",
+			query:        "from=2028-01-01&to=2028-12-31",
+			expectedCode: http.StatusOK,
+			mockSetup: func() {
+				mockDB.EXPECT().GetProgramReport(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.ProgramReport{}, nil)
+			},
+		},
+		{
+			name:         "Range too long",
+			query:        "from=2025-01-01&to=2026-01-02",
+			expectedCode: http.StatusBadRequest,
+			expectedBody: api.CodeInvalidDateRange,
+		},
+		{
+			name:         "From after to",
+			query:        "from=2026-01-02&to=2026-01-01",
+			expectedCode: http.StatusBadRequest,
+			expectedBody: api.CodeInvalidDateRange,
+		},
+		{
+			name:         "Missing dates",
+			query:        "",
+			expectedCode: http.StatusBadRequest,
+			expectedBody: api.CodeInvalidDateRange,
+		},
+		{
+			name:         "Unsupported format",
+			query:        "from=2026-01-01&to=2026-01-02&format=xml",
+			expectedCode: http.StatusBadRequest,
+			expectedBody: api.CodeInvalidParameter,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.mockSetup != nil {
+				tt.mockSetup()
+			}
+
+			req, err := http.NewRequest("GET", "/admin/reports/referrals?"+tt.query, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", bearer(t, 1, storage.RoleAdmin))
+
+			rr := httptest.NewRecorder()
+			apiHandler.Router().ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedCode {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, tt.expectedCode)
+			}
+			if !strings.Contains(rr.Body.String(), tt.expectedBody) {
+				t.Errorf("body = %q, want it to contain %q", rr.Body.String(), tt.expectedBody)
+			}
+		})
+	}
+}
+
+func TestAPI_GetReferrerFlags(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDB := storage.NewMockDBInterface(ctrl)
+	apiHandler := api.New(mockDB)
+
+	tests := []struct {
+		name         string
+		role         string
+		expectedCode int
+		expectedBody string
+		mockSetup    func()
+	}{
+		{
+			name:         "Open flags",
+			role:         storage.RoleAdmin,
+			expectedCode: http.StatusOK,
+			expectedBody: `"reasons":["subnet: 8 signups from 192.0.2.0/24"]`,
+			mockSetup: func() {
+				mockDB.EXPECT().ListReferrerFlags(gomock.Any()).Return([]storage.ReferrerFlag{
+					{ID: 1, ReferrerID: 2, Score: 1.6, Reasons: []string{"subnet: 8 signups from 192.0.2.0/24"}},
+				}, nil)
+			},
+		},
+		{
+			name:         "Storage error",
+			role:         storage.RoleAdmin,
+			expectedCode: http.StatusInternalServerError,
+			mockSetup: func() {
+				mockDB.EXPECT().ListReferrerFlags(gomock.Any()).Return(nil, errors.New("db down"))
+			},
+		},
+		{
+			name:         "Not an admin",
+			role:         storage.RoleUser,
+			expectedCode: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.mockSetup != nil {
+				tt.mockSetup()
+			}
+
+			req, err := http.NewRequest("GET", "/admin/flags", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", bearer(t, 1, tt.role))
+
+			rr := httptest.NewRecorder()
+			apiHandler.Router().ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedCode {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, tt.expectedCode)
+			}
+			if !strings.Contains(rr.Body.String(), tt.expectedBody) {
+				t.Errorf("body = %q, want it to contain %q", rr.Body.String(), tt.expectedBody)
+			}
+		})
+	}
+}
+
+// Вознаграждения реферера с открытой отметкой удерживаются до ее
+// разбора: release зачисляет их, forfeit аннулирует.
+func TestAPI_ReviewReferrerFlag(t *testing.T) {
+	srv := apitest.NewServer(t, apitest.WithAdmin())
+	srv.Store.SetRewardTiers(rewards.Tiers{{UpTo: 5, Amount: 100}})
+	ctx := context.Background()
+
+	bob, err := srv.Store.CreateUser(ctx, storage.CreateUserParams{User: storage.User{Username: "bob", Email: "bob@example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Store.CreateReferralCode(ctx, bob, "BOB", 1893456000, "", nil, storage.DomainRestriction{}); err != nil {
+		t.Fatal(err)
+	}
+	// flag отмечает bob и возвращает ID отметки, refer регистрирует
+	// приглашенного по его коду
+	flag := func(t *testing.T) int {
+		t.Helper()
+		if err := srv.Store.FlagReferrer(ctx, storage.ReferrerFlag{ReferrerID: bob, Score: 2, Reasons: []string{"burst"}}); err != nil {
+			t.Fatal(err)
+		}
+		flags, _ := srv.Store.ListReferrerFlags(ctx)
+		if len(flags) != 1 {
+			t.Fatalf("flags = %+v, want one open flag", flags)
+		}
+		return flags[0].ID
+	}
+	refer := func(t *testing.T, name string) {
+		t.Helper()
+		params := storage.CreateUserParams{User: storage.User{Username: name, Email: name + "@example.com"}}
+		if _, err := srv.Store.RegisterWithReferralCode(ctx, "BOB", params); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wantStats := func(t *testing.T, held, balance int64) {
+		t.Helper()
+		stats, _ := srv.Store.GetReferralStats(ctx, bob)
+		if stats.RewardHeld != held || stats.Balance != balance {
+			t.Errorf("held = %d, balance = %d, want %d, %d", stats.RewardHeld, stats.Balance, held, balance)
+		}
+	}
+	review := func(t *testing.T, id int, action string) *http.Response {
+		t.Helper()
+		body := strings.NewReader(`{"action":"` + action + `"}`)
+		resp, err := srv.Client().Do(srv.NewRequest(t, "POST", fmt.Sprintf("/admin/flags/%d/review", id), body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	wantStatus := func(t *testing.T, resp *http.Response, status int) {
+		t.Helper()
+		if resp.StatusCode != status {
+			body, _ := io.ReadAll(resp.Body)
+			t.Fatalf("status = %d, want %d: %s", resp.StatusCode, status, body)
+		}
+	}
+
+	id := flag(t)
+	refer(t, "alice")
+	wantStats(t, 100, 0)
+	if _, err := srv.Store.RedeemReward(ctx, bob, 100, "payout"); !errors.Is(err, storage.ErrInsufficientBalance) {
+		t.Errorf("redeem held reward error = %v, want ErrInsufficientBalance", err)
+	}
+
+	wantStatus(t, review(t, id, "approve"), http.StatusBadRequest)
+	wantStatus(t, review(t, 999, storage.FlagRelease), http.StatusNotFound)
+
+	resp := review(t, id, storage.FlagRelease)
+	wantStatus(t, resp, http.StatusOK)
+	var reviewed storage.ReferrerFlag
+	if err := json.NewDecoder(resp.Body).Decode(&reviewed); err != nil {
+		t.Fatal(err)
+	}
+	if reviewed.Resolution != storage.FlagRelease || reviewed.ReviewedAt == nil {
+		t.Errorf("flag = %+v, want reviewed with release", reviewed)
+	}
+	wantStats(t, 0, 100)
+	wantStatus(t, review(t, id, storage.FlagForfeit), http.StatusConflict)
+	if log := srv.Store.AuditLog(bob); len(log) != 1 || log[0].Action != storage.AuditFlagReviewed {
+		t.Errorf("audit log = %+v, want %s", log, storage.AuditFlagReviewed)
+	}
+
+	// новая отметка удерживает следующее вознаграждение, forfeit его аннулирует
+	id = flag(t)
+	refer(t, "carol")
+	wantStats(t, 100, 100)
+	wantStatus(t, review(t, id, storage.FlagForfeit), http.StatusOK)
+	wantStats(t, 0, 100)
+	referrals, _ := srv.Store.GetReferralsByReferrerID(ctx, bob, 10, 0)
+	if len(referrals) != 2 || referrals[0].Reward != storage.RewardVested || referrals[1].Reward != storage.RewardForfeited {
+		t.Errorf("referrals = %+v, want alice vested and carol forfeited", referrals)
+	}
+}
+
+func TestAPI_ReserveReferralCode(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDB := storage.NewMockDBInterface(ctrl)
+	apiHandler := api.New(mockDB)
+
+	tests := []struct {
+		name         string
+		payload      string
+		role         string
+		expectedCode int
+		mockSetup    func()
+	}{
+		{
+			name:         "Successful reservation",
+			payload:      fmt.Sprintf(`{"email":"alice@example.com","code":"ALICE2024","expires_at":%d}`, codeExpiresAt),
+			role:         storage.RoleAdmin,
+			expectedCode: http.StatusCreated,
+			mockSetup: func() {
+				mockDB.EXPECT().ReserveReferralCode(gomock.Any(), "alice@example.com", "ALICE2024", codeExpiresAt, storage.DomainRestriction{}).Return(nil)
+			},
+		},
+		{
+			name:         "Code already taken",
+			payload:      fmt.Sprintf(`{"email":"alice@example.com","code":"ALICE2024","expires_at":%d}`, codeExpiresAt),
+			role:         storage.RoleAdmin,
+			expectedCode: http.StatusConflict,
+			mockSetup: func() {
+				mockDB.EXPECT().ReserveReferralCode(gomock.Any(), "alice@example.com", "ALICE2024", codeExpiresAt, storage.DomainRestriction{}).Return(storage.ErrCodeTaken)
+			},
+		},
+		{
+			name:         "Email already registered",
+			payload:      fmt.Sprintf(`{"email":"bob@example.com","code":"BOB2024","expires_at":%d}`, codeExpiresAt),
+			role:         storage.RoleAdmin,
+			expectedCode: http.StatusConflict,
+			mockSetup: func() {
+				mockDB.EXPECT().ReserveReferralCode(gomock.Any(), "bob@example.com", "BOB2024", codeExpiresAt, storage.DomainRestriction{}).Return(storage.ErrEmailTaken)
+			},
+		},
+		{
+			name:         "Missing code",
+			payload:      `{"email":"alice@example.com"}`,
+			role:         storage.RoleAdmin,
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "Non-admin caller",
+			payload:      `{"email":"alice@example.com","code":"ALICE2024"}`,
+			role:         storage.RoleUser,
+			expectedCode: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.mockSetup != nil {
+				tt.mockSetup()
+			}
+
+			req, err := http.NewRequest("POST", "/admin/referral-codes/reserve", strings.NewReader(tt.payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", bearer(t, 1, tt.role))
+
+			rr := httptest.NewRecorder()
+			apiHandler.Router().ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedCode {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, tt.expectedCode)
+			}
+		})
+	}
+}
+
+func TestAPI_CreateReferralCode_ClientToken(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDB := storage.NewMockDBInterface(ctrl)
+	apiHandler := api.New(mockDB)
+
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	tests := []struct {
+		name         string
+		payload      string
+		expectedCode int
+		expectedBody string
+		mockSetup    func()
+	}{
+		{
+			name:         "First request creates a code",
+			payload:      fmt.Sprintf(`{"user_id":1,"code":"FIRST","expires_at":%d,"client_token":"tok-1"}`, codeExpiresAt),
+			expectedCode: http.StatusCreated,
+			mockSetup: func() {
+				mockDB.EXPECT().CreateReferralCode(gomock.Any(), 1, "FIRST", codeExpiresAt, "tok-1", gomock.Nil(), storage.DomainRestriction{}).Return(nil)
+			},
+		},
+		{
+			name:         "Retry with the same token returns the first code",
+			payload:      fmt.Sprintf(`{"user_id":1,"code":"SECOND","expires_at":%d,"client_token":"tok-1"}`, codeExpiresAt),
+			expectedCode: http.StatusOK,
+			expectedBody: `"code":"FIRST"`,
+			mockSetup: func() {
+				mockDB.EXPECT().CreateReferralCode(gomock.Any(), 1, "SECOND", codeExpiresAt, "tok-1", gomock.Nil(), storage.DomainRestriction{}).
+					Return(storage.ErrClientTokenUsed)
+				mockDB.EXPECT().GetReferralCodeByClientToken(gomock.Any(), 1, "tok-1").
+					Return(storage.ReferralCode{ID: 7, UserID: 1, Code: "FIRST", ExpiresAt: expiresAt}, nil)
+			},
+		},
+		{
+			name:         "Request without token always rotates",
+			payload:      fmt.Sprintf(`{"user_id":1,"code":"THIRD","expires_at":%d}`, codeExpiresAt),
+			expectedCode: http.StatusCreated,
+			mockSetup: func() {
+				mockDB.EXPECT().CreateReferralCode(gomock.Any(), 1, "THIRD", codeExpiresAt, "", gomock.Nil(), storage.DomainRestriction{}).Return(nil)
+			},
+		},
+		{
+			name:         "Code held by another user",
+			payload:      fmt.Sprintf(`{"user_id":1,"code":"REF123","expires_at":%d}`, codeExpiresAt),
+			expectedCode: http.StatusConflict,
+			expectedBody: api.CodeReferralCodeTaken,
+			mockSetup: func() {
+				mockDB.EXPECT().CreateReferralCode(gomock.Any(), 1, "REF123", codeExpiresAt, "", gomock.Nil(), storage.DomainRestriction{}).
+					Return(storage.ErrCodeTaken)
+			},
+		},
+		{
+			name:         "Storage failure",
+			payload:      fmt.Sprintf(`{"user_id":1,"code":"FOURTH","expires_at":%d,"client_token":"tok-2"}`, codeExpiresAt),
+			expectedCode: http.StatusInternalServerError,
+			mockSetup: func() {
+				mockDB.EXPECT().CreateReferralCode(gomock.Any(), 1, "FOURTH", codeExpiresAt, "tok-2", gomock.Nil(), storage.DomainRestriction{}).
+					Return(errors.New("db down"))
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.mockSetup()
+
+			req, err := http.NewRequest("POST", "/p/referral-code", strings.NewReader(tt.payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", bearer(t, 1, storage.RoleUser))
+
+			rr := httptest.NewRecorder()
+			apiHandler.Router().ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedCode {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, tt.expectedCode)
+			}
+			if !strings.Contains(rr.Body.String(), tt.expectedBody) {
+				t.Errorf("body = %q, want it to contain %q", rr.Body.String(), tt.expectedBody)
+			}
+		})
+	}
+}
+
+func TestAPI_SignupSource(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDB := storage.NewMockDBInterface(ctrl)
+	apiHandler := api.New(mockDB)
+
+	tests := []struct {
+		name       string
+		path       string
+		payload    string
+		wantSource string
+	}{
+		{"Source from JSON", "/register", `{"username":"alice","email":"a@example.com","password":"p","source":"ios"}`, storage.SourceIOS},
+		{"Source from query", "/register?source=android", `{"username":"alice","email":"a@example.com","password":"p"}`, storage.SourceAndroid},
+		{"JSON wins over query", "/register?source=android", `{"username":"alice","email":"a@example.com","password":"p","source":"web"}`, storage.SourceWeb},
+		{"Unknown source is not an error", "/register?source=fridge", `{"username":"alice","email":"a@example.com","password":"p"}`, storage.SourceUnknown},
+		{"Absent source", "/register-with-referral", `{"user":{"username":"alice","email":"a@example.com","password":"p"}}`, storage.SourceUnknown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got storage.CreateUserParams
+			mockDB.EXPECT().CreateUser(gomock.Any(), gomock.Any()).
+				DoAndReturn(func(ctx context.Context, params storage.CreateUserParams) (int, error) {
+					got = params
+					return 1, nil
+				})
+
+			req, err := http.NewRequest("POST", tt.path, strings.NewReader(tt.payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("User-Agent", "gorefer-test/1.0")
+
+			rr := httptest.NewRecorder()
+			apiHandler.Router().ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusCreated {
+				t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+			}
+			if got.Source != tt.wantSource || got.UserAgent != "gorefer-test/1.0" {
+				t.Errorf("CreateUser params = source %q, user agent %q", got.Source, got.UserAgent)
+			}
+		})
+	}
+}
+
+func TestAPI_RegisterDryRun(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// ожидания на CreateUser и RegisterWithReferralCode не задаются:
+	// любой вызов пишущих методов провалит тест
+	mockDB := storage.NewMockDBInterface(ctrl)
+	apiHandler := api.New(mockDB)
+
+	active := storage.ReferralCodeDetails{ReferralCode: storage.ReferralCode{Code: "REF123", ExpiresAt: time.Now().Add(time.Hour)}}
+	expired := storage.ReferralCodeDetails{ReferralCode: storage.ReferralCode{Code: "OLD", ExpiresAt: time.Now().Add(-time.Hour)}}
+	user := `{"username":"new","email":"new@example.com","password":"password123"}`
+
+	tests := []struct {
+		name         string
+		path         string
+		payload      string
+		expectedCode int
+		expectedBody string
+		mockSetup    func()
+	}{
+		{
+			name:         "Valid plain registration",
+			path:         "/register?dry_run=true",
+			payload:      user,
+			expectedCode: http.StatusOK,
+			expectedBody: `{"valid":true}`,
+			mockSetup: func() {
+				mockDB.EXPECT().EmailExists(gomock.Any(), "new@example.com").Return(false, nil)
+			},
+		},
+		{
+			name:         "Email already registered",
+			path:         "/register?dry_run=true",
+			payload:      user,
+			expectedCode: http.StatusConflict,
+			expectedBody: api.CodeEmailTaken,
+			mockSetup: func() {
+				mockDB.EXPECT().EmailExists(gomock.Any(), "new@example.com").Return(true, nil)
+			},
+		},
+		{
+			name:         "Missing password",
+			path:         "/register?dry_run=true",
+			payload:      `{"username":"new","email":"new@example.com"}`,
+			expectedCode: http.StatusBadRequest,
+			expectedBody: api.CodeInvalidPayload,
+		},
+		{
+			name:         "Valid referral registration",
+			path:         "/register-with-referral?dry_run=true",
+			payload:      `{"referral_code":"REF123","user":` + user + `}`,
+			expectedCode: http.StatusOK,
+			expectedBody: `{"valid":true}`,
+			mockSetup: func() {
+				mockDB.EXPECT().EmailExists(gomock.Any(), "new@example.com").Return(false, nil)
+				mockDB.EXPECT().GetReferralCodeDetails(gomock.Any(), "REF123").Return(active, nil)
+			},
+		},
+		{
+			name:         "Expired referral code",
+			path:         "/register-with-referral?dry_run=true",
+			payload:      `{"referral_code":"OLD","user":` + user + `}`,
+			expectedCode: http.StatusUnprocessableEntity,
+			expectedBody: api.CodeReferralCodeInvalid,
+			mockSetup: func() {
+				mockDB.EXPECT().EmailExists(gomock.Any(), "new@example.com").Return(false, nil)
+				mockDB.EXPECT().GetReferralCodeDetails(gomock.Any(), "OLD").Return(expired, nil)
+			},
+		},
+		{
+			name:         "Unknown referral code",
+			path:         "/register-with-referral?dry_run=true",
+			payload:      `{"referral_code":"NOPE","user":` + user + `}`,
+			expectedCode: http.StatusNotFound,
+			expectedBody: api.CodeReferralCodeNotFound,
+			mockSetup: func() {
+				mockDB.EXPECT().EmailExists(gomock.Any(), "new@example.com").Return(false, nil)
+				mockDB.EXPECT().GetReferralCodeDetails(gomock.Any(), "NOPE").Return(storage.ReferralCodeDetails{}, storage.ErrNotFound)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.mockSetup != nil {
+				tt.mockSetup()
+			}
+
+			req, err := http.NewRequest("POST", tt.path, strings.NewReader(tt.payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			apiHandler.Router().ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedCode {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, tt.expectedCode)
+			}
+			if !strings.Contains(rr.Body.String(), tt.expectedBody) {
+				t.Errorf("body = %q, want it to contain %q", rr.Body.String(), tt.expectedBody)
+			}
+		})
+	}
+}
+
+func TestAPI_ReferralsPagination(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDB := storage.NewMockDBInterface(ctrl)
+	apiHandler := api.New(mockDB, api.WithPagination(pagination.Defaults{Limit: 2, MaxLimit: 5}))
+
+	page := func(n int) []storage.ReferralSummary {
+		referees := make([]storage.ReferralSummary, n)
+		for i := range referees {
+			referees[i] = storage.ReferralSummary{ID: i + 1, Username: "friend" + strconv.Itoa(i)}
+		}
+		return referees
+	}
+
+	tests := []struct {
+		name         string
+		query        string
+		expectedCode int
+		wantItems    int
+		wantLink     string
+		mockSetup    func()
+	}{
+		{
+			name:         "Default page with more results",
+			expectedCode: http.StatusOK,
+			wantItems:    2,
+			wantLink:     `</p/referrals?limit=2&offset=2>; rel="next"`,
+			mockSetup: func() {
+				mockDB.EXPECT().GetReferralsByReferrerID(gomock.Any(), 1, 3, 0).Return(page(3), nil)
+			},
+		},
+		{
+			name:         "Limit clamped to maximum",
+			query:        "?limit=50&offset=5",
+			expectedCode: http.StatusOK,
+			wantItems:    1,
+			wantLink:     `</p/referrals?limit=5&offset=0>; rel="prev"`,
+			mockSetup: func() {
+				mockDB.EXPECT().GetReferralsByReferrerID(gomock.Any(), 1, 6, 5).Return(page(1), nil)
+			},
+		},
+		{
+			name:         "Negative offset",
+			query:        "?offset=-1",
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.mockSetup != nil {
+				tt.mockSetup()
+			}
+
+			req, err := http.NewRequest("GET", "/p/referrals"+tt.query, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", bearer(t, 1, storage.RoleUser))
+
+			rr := httptest.NewRecorder()
+			apiHandler.Router().ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedCode {
+				t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, tt.expectedCode)
+			}
+			if tt.expectedCode != http.StatusOK {
+				return
+			}
+			var items []api.ReferralResponse
+			if err := json.NewDecoder(rr.Body).Decode(&items); err != nil {
+				t.Fatal(err)
+			}
+			if len(items) != tt.wantItems {
+				t.Errorf("got %d items, want %d", len(items), tt.wantItems)
+			}
+			if got := rr.Header().Get("Link"); got != tt.wantLink {
+				t.Errorf("Link = %q, want %q", got, tt.wantLink)
+			}
+		})
+	}
+}
+
+func TestAPI_ExportUserData(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDB := storage.NewMockDBInterface(ctrl)
+	apiHandler := api.New(mockDB)
+
+	export := storage.UserExport{
+		Profile:       storage.ExportProfile{ID: 3, Username: "alice", Email: "alice@example.com"},
+		ReferralCodes: []storage.ReferralCode{{ID: 1, UserID: 3, Code: "ALICE"}},
+		Referrals:     []storage.ExportReferral{{Username: "bob"}},
+		Rewards:       []storage.ExportReward{{Referee: "bob", Tier: 1, Amount: 100, Status: storage.RewardPending}},
+		Redemptions:   []storage.Redemption{{ID: 1, UserID: 3, Amount: -50, BalanceAfter: 50}},
+		AuditLog:      []storage.AuditEntry{},
+	}
+
+	tests := []struct {
+		name         string
+		path         string
+		role         string
+		expectedCode int
+		mockSetup    func()
+	}{
+		{
+			name:         "Own data",
+			path:         "/p/me/export",
+			role:         storage.RoleUser,
+			expectedCode: http.StatusOK,
+			mockSetup: func() {
+				mockDB.EXPECT().ExportUserData(gomock.Any(), 3).Return(export, nil)
+			},
+		},
+		{
+			name:         "Admin exports any user",
+			path:         "/admin/users/3/export",
+			role:         storage.RoleAdmin,
+			expectedCode: http.StatusOK,
+			mockSetup: func() {
+				mockDB.EXPECT().ExportUserData(gomock.Any(), 3).Return(export, nil)
+			},
+		},
+		{
+			name:         "Unknown user",
+			path:         "/admin/users/404/export",
+			role:         storage.RoleAdmin,
+			expectedCode: http.StatusNotFound,
+			mockSetup: func() {
+				mockDB.EXPECT().ExportUserData(gomock.Any(), 404).Return(storage.UserExport{}, storage.ErrNotFound)
+			},
+		},
+		{
+			name:         "Non-admin cannot export another user",
+			path:         "/admin/users/3/export",
+			role:         storage.RoleUser,
+			expectedCode: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.mockSetup != nil {
+				tt.mockSetup()
+			}
+
+			req, err := http.NewRequest("GET", tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", bearer(t, 3, tt.role))
+
+			rr := httptest.NewRecorder()
+			apiHandler.Router().ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedCode {
+				t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, tt.expectedCode)
+			}
+			if tt.expectedCode != http.StatusOK {
+				return
+			}
+			if got := rr.Header().Get("Content-Disposition"); got != `attachment; filename="user-3-export.json"` {
+				t.Errorf("Content-Disposition = %q", got)
+			}
+			var got storage.UserExport
+			if err := json.NewDecoder(rr.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Profile.Email != "alice@example.com" || len(got.ReferralCodes) != 1 || len(got.Referrals) != 1 {
+				t.Errorf("unexpected export: %+v", got)
+			}
+			if len(got.Rewards) != 1 || got.Rewards[0].Referee != "bob" || len(got.Redemptions) != 1 || got.Redemptions[0].Amount != -50 {
+				t.Errorf("export rewards = %+v, redemptions = %+v", got.Rewards, got.Redemptions)
+			}
+		})
+	}
+}
+
+func TestAPI_Impersonate(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDB := storage.NewMockDBInterface(ctrl)
+	apiHandler := api.New(mockDB)
+
+	tests := []struct {
+		name         string
+		path         string
+		role         string
+		expectedCode int
+		mockSetup    func()
+	}{
+		{
+			name:         "Admin impersonates a user",
+			path:         "/admin/impersonate/5",
+			role:         storage.RoleAdmin,
+			expectedCode: http.StatusOK,
+			mockSetup: func() {
+				mockDB.EXPECT().GetUserByID(gomock.Any(), 5).
+					Return(storage.User{ID: 5, Username: "user", Role: storage.RoleUser}, nil)
+				mockDB.EXPECT().RecordAudit(gomock.Any(), 1, storage.AuditUserImpersonated, 5, nil).Return(nil)
+			},
+		},
+		{
+			name:         "Admins cannot be impersonated",
+			path:         "/admin/impersonate/2",
+			role:         storage.RoleAdmin,
+			expectedCode: http.StatusForbidden,
+			mockSetup: func() {
+				mockDB.EXPECT().GetUserByID(gomock.Any(), 2).
+					Return(storage.User{ID: 2, Username: "other-admin", Role: storage.RoleAdmin}, nil)
+			},
+		},
+		{
+			name:         "Unknown user",
+			path:         "/admin/impersonate/404",
+			role:         storage.RoleAdmin,
+			expectedCode: http.StatusNotFound,
+			mockSetup: func() {
+				mockDB.EXPECT().GetUserByID(gomock.Any(), 404).Return(storage.User{}, storage.ErrNotFound)
+			},
+		},
+		{
+			name:         "Non-admin caller",
+			path:         "/admin/impersonate/5",
+			role:         storage.RoleUser,
+			expectedCode: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.mockSetup != nil {
+				tt.mockSetup()
+			}
+
+			req, err := http.NewRequest("POST", tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", bearer(t, 1, tt.role))
+
+			rr := httptest.NewRecorder()
+			apiHandler.Router().ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedCode {
+				t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, tt.expectedCode)
+			}
+			if tt.expectedCode != http.StatusOK {
+				return
+			}
+
+			var resp api.TokenResponse
+			if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			claims, err := auth.ValidateToken(resp.Token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claims.UserID != 5 || !claims.Impersonated() || claims.ActorID() != 1 {
+				t.Errorf("unexpected claims: %+v", claims)
+			}
+			if ttl := time.Until(time.Unix(claims.ExpiresAt, 0)); ttl > 15*time.Minute {
+				t.Errorf("impersonation token lives %v, want at most 15m", ttl)
+			}
+		})
+	}
+}
+
+func TestAPI_UpdateProfileTimezone(t *testing.T) {
+	srv := apitest.NewServer(t)
+
+	tests := []struct {
+		name         string
+		payload      string
+		expectedCode int
+		wantTimezone string
+	}{
+		{
+			name:         "Valid IANA zone",
+			payload:      `{"timezone":"Asia/Kolkata"}`,
+			expectedCode: http.StatusNoContent,
+			wantTimezone: "Asia/Kolkata",
+		},
+		{
+			name:         "Unknown zone",
+			payload:      `{"timezone":"Mars/Olympus_Mons"}`,
+			expectedCode: http.StatusBadRequest,
+			wantTimezone: "Asia/Kolkata",
+		},
+		{
+			name:         "Empty zone",
+			payload:      `{"timezone":""}`,
+			expectedCode: http.StatusBadRequest,
+			wantTimezone: "Asia/Kolkata",
+		},
+		{
+			name:         "Nothing to change",
+			payload:      `{}`,
+			expectedCode: http.StatusNoContent,
+			wantTimezone: "Asia/Kolkata",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := srv.Do(t, "PATCH", "/p/me", strings.NewReader(tt.payload))
+			if resp.StatusCode != tt.expectedCode {
+				t.Errorf("handler returned wrong status code: got %v want %v", resp.StatusCode, tt.expectedCode)
+			}
+
+			export, err := srv.Store.ExportUserData(context.Background(), srv.User.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if export.Profile.Timezone != tt.wantTimezone {
+				t.Errorf("stored timezone = %q, want %q", export.Profile.Timezone, tt.wantTimezone)
+			}
+		})
+	}
+}
+
+func TestAPI_UpdateProfileAtomic(t *testing.T) {
+	srv := apitest.NewServer(t)
+	ctx := context.Background()
+	if _, err := srv.Store.CreateUser(ctx, storage.CreateUserParams{User: storage.User{Username: "bob", Email: "bob@example.com"}}); err != nil {
+		t.Fatal(err)
+	}
+	before, err := srv.Store.GetProfile(ctx, srv.User.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// занятое имя отклоняет весь запрос: пояс и ссылка не меняются
+	resp := srv.Do(t, "PATCH", "/p/me", strings.NewReader(`{"username":"bob","timezone":"Asia/Tokyo","vanity_link_opt_out":true}`))
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("handler returned wrong status code: got %v want %v", resp.StatusCode, http.StatusConflict)
+	}
+	if got, err := srv.Store.GetProfile(ctx, srv.User.ID); err != nil || !reflect.DeepEqual(got, before) {
+		t.Errorf("profile after failed update = %+v, %v; want unchanged %+v", got, err, before)
+	}
+
+	resp = srv.Do(t, "PATCH", "/p/me", strings.NewReader(`{"username":"carol","timezone":"Asia/Tokyo","vanity_link_opt_out":true}`))
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("handler returned wrong status code: got %v want %v", resp.StatusCode, http.StatusNoContent)
+	}
+	got, err := srv.Store.GetProfile(ctx, srv.User.ID)
+	if err != nil || got.Username != "carol" || got.Timezone != "Asia/Tokyo" || !got.VanityLinkOptOut {
+		t.Errorf("profile after update = %+v, %v; want all fields changed", got, err)
+	}
+}
+
+func TestAPI_ErrorMetrics(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDB := storage.NewMockDBInterface(ctrl)
+	apiHandler := api.New(mockDB)
+
+	requests := []struct {
+		method, path, body string
+	}{
+		{"POST", "/login", "{garbage"},
+		{"POST", "/login", "not json"},
+		{"POST", "/register", `{"username":"","email":"","password":""}`},
+		{"GET", "/p/referral-code", ""},
+		{"GET", "/no-such-route", ""},
+	}
+	for _, tr := range requests {
+		req := httptest.NewRequest(tr.method, tr.path, strings.NewReader(tr.body))
+		apiHandler.Router().ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	want := api.ErrorCounts{
+		"POST /login":          {api.ReasonDecode: 2},
+		"POST /register":       {api.ReasonValidation: 1},
+		"GET /p/referral-code": {api.ReasonAuth: 1},
+		"GET unmatched":        {api.ReasonOther: 1},
+	}
+	if got := apiHandler.ErrorCounts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("ErrorCounts() = %v, want %v", got, want)
+	}
+}
+
+func TestAPI_DecodeFailureLimit(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDB := storage.NewMockDBInterface(ctrl)
+	apiHandler := api.New(mockDB, api.WithDecodeFailureLimit(3, time.Minute))
+
+	login := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/login", strings.NewReader("{garbage"))
+		req.RemoteAddr = remoteAddr
+		rr := httptest.NewRecorder()
+		apiHandler.Router().ServeHTTP(rr, req)
+		return rr
+	}
+
+	for i := 1; i <= 3; i++ {
+		if rr := login("203.0.113.7:1000"); rr.Code != http.StatusBadRequest {
+			t.Fatalf("garbage body #%d: status %d, want %d", i, rr.Code, http.StatusBadRequest)
+		}
+	}
+
+	rr := login("203.0.113.7:2000")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("after limit: status %d, want %d", rr.Code, http.StatusTooManyRequests)
+	}
+	if rr.Header().Get("Retry-After") == "" || !strings.Contains(rr.Body.String(), api.CodeTooManyRequests) {
+		t.Errorf("after limit: Retry-After %q, body %q", rr.Header().Get("Retry-After"), rr.Body.String())
+	}
+
+	// другие адреса не затронуты
+	if rr := login("198.51.100.1:1000"); rr.Code != http.StatusBadRequest {
+		t.Errorf("other IP: status %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+
+	counts := apiHandler.ErrorCounts()["POST /login"]
+	if counts[api.ReasonDecode] != 4 || counts[api.ReasonOther] != 1 {
+		t.Errorf("POST /login counts = %v, want 4 decode errors and 1 other", counts)
+	}
+}
+
+func TestAPI_DeleteReferralCodeByCode(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDB := storage.NewMockDBInterface(ctrl)
+	apiHandler := api.New(mockDB)
+
+	tests := []struct {
+		name         string
+		query        string
+		role         string
+		expectedCode int
+		expectedBody string
+		mockSetup    func()
+	}{
+		{
+			name:         "Deleted by code",
+			query:        "?code=ALICE2024",
+			role:         storage.RoleAdmin,
+			expectedCode: http.StatusOK,
+			expectedBody: `"owner_email":"alice@example.com"`,
+			mockSetup: func() {
+				mockDB.EXPECT().DeleteReferralCodeByCode(gomock.Any(), "ALICE2024", 1).Return(storage.DeletedReferralCode{
+					ReferralCode: storage.ReferralCode{ID: 3, UserID: 7, Code: "ALICE2024"},
+					Status:       storage.CodeStatusActive,
+					OwnerEmail:   "alice@example.com",
+				}, nil)
+			},
+		},
+		{
+			name:         "Unknown code",
+			query:        "?code=NOPE",
+			role:         storage.RoleAdmin,
+			expectedCode: http.StatusNotFound,
+			expectedBody: api.CodeReferralCodeNotFound,
+			mockSetup: func() {
+				mockDB.EXPECT().DeleteReferralCodeByCode(gomock.Any(), "NOPE", 1).Return(storage.DeletedReferralCode{}, storage.ErrNotFound)
+			},
+		},
+		{
+			name:         "Missing code",
+			query:        "",
+			role:         storage.RoleAdmin,
+			expectedCode: http.StatusBadRequest,
+			expectedBody: api.CodeInvalidParameter,
+		},
+		{
+			name:         "Not an admin",
+			query:        "?code=ALICE2024",
+			role:         storage.RoleUser,
+			expectedCode: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.mockSetup != nil {
+				tt.mockSetup()
+			}
+
+			req, err := http.NewRequest("DELETE", "/admin/referral-codes"+tt.query, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", bearer(t, 1, tt.role))
+
+			rr := httptest.NewRecorder()
+			apiHandler.Router().ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedCode {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, tt.expectedCode)
+			}
+			if !strings.Contains(rr.Body.String(), tt.expectedBody) {
+				t.Errorf("body = %q, want it to contain %q", rr.Body.String(), tt.expectedBody)
+			}
+		})
+	}
+}
+
+func TestAPI_ReferralCodeMetadata(t *testing.T) {
+	srv := apitest.NewServer(t)
+
+	nested := `{"a":{"b":{"c":{"d":{"e":1}}}}}`
+	oversized := `{"note":"` + strings.Repeat("x", 4096) + `"}`
+
+	tests := []struct {
+		name         string
+		method       string
+		payload      string
+		expectedCode int
+		wantMetadata string
+	}{
+		{
+			name:         "Create with metadata",
+			method:       "POST",
+			payload:      fmt.Sprintf(`{"user_id":%%d,"code":"Q3FLYER","expires_at":%d,"metadata":{"campaign":"q3-flyers","team":"growth"}}`, codeExpiresAt),
+			expectedCode: http.StatusCreated,
+			wantMetadata: `{"campaign":"q3-flyers","team":"growth"}`,
+		},
+		{
+			name:         "Oversized metadata",
+			method:       "PATCH",
+			payload:      `{"metadata":` + oversized + `}`,
+			expectedCode: http.StatusUnprocessableEntity,
+			wantMetadata: `{"campaign":"q3-flyers","team":"growth"}`,
+		},
+		{
+			name:         "Too deeply nested",
+			method:       "PATCH",
+			payload:      `{"metadata":` + nested + `}`,
+			expectedCode: http.StatusUnprocessableEntity,
+			wantMetadata: `{"campaign":"q3-flyers","team":"growth"}`,
+		},
+		{
+			name:         "Not an object",
+			method:       "PATCH",
+			payload:      `{"metadata":["q3"]}`,
+			expectedCode: http.StatusUnprocessableEntity,
+			wantMetadata: `{"campaign":"q3-flyers","team":"growth"}`,
+		},
+		{
+			name:         "Replace metadata",
+			method:       "PATCH",
+			payload:      `{"metadata":{"cost_center":"cc-42"}}`,
+			expectedCode: http.StatusNoContent,
+			wantMetadata: `{"cost_center":"cc-42"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := tt.payload
+			if strings.Contains(payload, "%d") {
+				payload = fmt.Sprintf(payload, srv.User.ID)
+			}
+			resp := srv.Do(t, tt.method, "/p/referral-code", strings.NewReader(payload))
+			if resp.StatusCode != tt.expectedCode {
+				t.Errorf("handler returned wrong status code: got %v want %v", resp.StatusCode, tt.expectedCode)
+			}
+
+			code, err := srv.Store.GetReferralCodeByUserID(context.Background(), srv.User.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(code.Metadata) != tt.wantMetadata {
+				t.Errorf("stored metadata = %s, want %s", code.Metadata, tt.wantMetadata)
+			}
+		})
+	}
+}
+
+func TestAPI_ListReferralCodesByMetadata(t *testing.T) {
+	srv := apitest.NewServer(t, apitest.WithAdmin())
+	ctx := context.Background()
+
+	for i, campaign := range []string{"q3-flyers", "podcast", "q3-flyers"} {
+		params := storage.CreateUserParams{User: storage.User{Username: fmt.Sprint("owner", i), Email: fmt.Sprintf("owner%d@example.com", i)}}
+		id, err := srv.Store.CreateUser(ctx, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		metadata := json.RawMessage(`{"campaign":"` + campaign + `"}`)
+		if err := srv.Store.CreateReferralCode(ctx, id, fmt.Sprint("CODE", i), 1893456000, "", metadata, storage.DomainRestriction{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name         string
+		query        string
+		expectedCode int
+		wantCodes    []string
+	}{
+		{"All codes", "", http.StatusOK, []string{"CODE0", "CODE1", "CODE2"}},
+		{"Filter by campaign", "?meta_key=campaign&meta_value=q3-flyers", http.StatusOK, []string{"CODE0", "CODE2"}},
+		{"No matches", "?meta_key=campaign&meta_value=tv", http.StatusOK, []string{}},
+		{"Value without key", "?meta_value=tv", http.StatusBadRequest, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := srv.Do(t, "GET", "/admin/referral-codes"+tt.query, nil)
+			if resp.StatusCode != tt.expectedCode {
+				t.Fatalf("handler returned wrong status code: got %v want %v", resp.StatusCode, tt.expectedCode)
+			}
+			if tt.wantCodes == nil {
+				return
+			}
+			var codes []storage.ReferralCode
+			if err := json.NewDecoder(resp.Body).Decode(&codes); err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, c := range codes {
+				got = append(got, c.Code)
+			}
+			if !reflect.DeepEqual(got, tt.wantCodes) {
+				t.Errorf("codes = %v, want %v", got, tt.wantCodes)
+			}
+		})
+	}
+}
+
+func TestAPI_GetMyStats(t *testing.T) {
+	srv := apitest.NewServer(t)
+	srv.Store.SetRewardTiers(rewards.Tiers{{UpTo: 2, Amount: 100}, {UpTo: 3, Amount: 30}})
+	ctx := context.Background()
+	if err := srv.Store.CreateReferralCode(ctx, srv.User.ID, "TIERS", 1893456000, "", nil, storage.DomainRestriction{}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		referrals int // общее число рефералов к моменту запроса
+		want      storage.ReferralStats
+	}{
+		{"No referrals", 0, storage.ReferralStats{ActiveTier: &rewards.Active{Tier: 1, UpTo: 2, Amount: 100, Remaining: 2}}},
+		{"First tier filled", 2, storage.ReferralStats{Referrals: 2, RewardTotal: 200, Balance: 200, ActiveTier: &rewards.Active{Tier: 2, UpTo: 3, Amount: 30, Remaining: 1}}},
+		{"Last tier filled", 3, storage.ReferralStats{Referrals: 3, RewardTotal: 230, Balance: 230}},
+		{"Beyond tiers", 4, storage.ReferralStats{Referrals: 4, RewardTotal: 230, Balance: 230}},
+	}
+
+	registered := 0
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for ; registered < tt.referrals; registered++ {
+				params := storage.CreateUserParams{User: storage.User{Username: fmt.Sprint("referee", registered), Email: fmt.Sprintf("referee%d@example.com", registered)}}
+				if _, err := srv.Store.RegisterWithReferralCode(ctx, "TIERS", params); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			resp := srv.Do(t, "GET", "/p/stats", nil)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("handler returned wrong status code: got %v want %v", resp.StatusCode, http.StatusOK)
+			}
+			var got storage.ReferralStats
+			if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("stats = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAPI_Routes(t *testing.T) {
+	srv := apitest.NewServer(t, apitest.WithAdmin())
+
+	resp := srv.Do(t, "GET", "/admin/routes", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", resp.StatusCode, http.StatusOK)
+	}
+	var routes []api.RouteInfo
+	if err := json.NewDecoder(resp.Body).Decode(&routes); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(routes, srv.API.Routes()) {
+		t.Errorf("GET /admin/routes differs from API.Routes()")
+	}
+
+	// маршруты /p требуют токена, /admin - еще и роли администратора
+	// либо ключа API с областью маршрута
+	has := func(r api.RouteInfo, name string) bool {
+		for _, mw := range r.Middleware {
+			if mw == name {
+				return true
+			}
+		}
+		return false
+	}
+	found := false
+	for _, r := range routes {
+		if r.Method == "GET" && r.Pattern == "/p/stats" {
+			found = true
+		}
+		if strings.HasPrefix(r.Pattern, "/p/") && !has(r, "middlware.TokenAuthMiddleware") {
+			t.Errorf("%s %s middleware = %v, want middlware.TokenAuthMiddleware", r.Method, r.Pattern, r.Middleware)
+		}
+		if strings.HasPrefix(r.Pattern, "/admin/") && !has(r, "middlware.RequireRole") && !has(r, "api.apiKeyOr") {
+			t.Errorf("%s %s middleware = %v, want middlware.RequireRole or api.apiKeyOr", r.Method, r.Pattern, r.Middleware)
+		}
+	}
+	if !found {
+		t.Error("GET /p/stats is missing from routes")
+	}
+}
+
+func TestAPI_RouterErrors(t *testing.T) {
+	srv := apitest.NewServer(t)
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		wantStatus int
+		wantCode   string
+		wantAllow  string
+	}{
+		{"Unknown path", "GET", "/no/such/route", http.StatusNotFound, api.CodeRouteNotFound, ""},
+		{"Unknown path under /p", "GET", "/p/no-such-route", http.StatusNotFound, api.CodeRouteNotFound, ""},
+		{"GET on /register", "GET", "/register", http.StatusMethodNotAllowed, api.CodeMethodNotAllowed, "POST"},
+		{"PUT on /p/referral-code", "PUT", "/p/referral-code", http.StatusMethodNotAllowed, api.CodeMethodNotAllowed, "GET, HEAD, POST, PATCH, DELETE"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := srv.Do(t, tt.method, tt.path, nil)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("%s %s status = %d, want %d", tt.method, tt.path, resp.StatusCode, tt.wantStatus)
+			}
+			if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+				t.Errorf("Content-Type = %q, want application/json", ct)
+			}
+			if got := resp.Header.Get("Allow"); got != tt.wantAllow {
+				t.Errorf("Allow = %q, want %q", got, tt.wantAllow)
+			}
+			var body api.ErrorResponse
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Code != tt.wantCode || body.Error == "" {
+				t.Errorf("body = %+v, want code %s", body, tt.wantCode)
+			}
+		})
+	}
+
+	// под префиксом Allow вычисляется по маршрутам без префикса
+	parent := chi.NewRouter()
+	parent.Mount("/referrals", srv.API.Handler("/referrals"))
+	rr := httptest.NewRecorder()
+	parent.ServeHTTP(rr, httptest.NewRequest("GET", "/referrals/login", nil))
+	if rr.Code != http.StatusMethodNotAllowed || rr.Header().Get("Allow") != "POST" {
+		t.Errorf("mounted GET /referrals/login = %d, Allow %q, want 405, POST", rr.Code, rr.Header().Get("Allow"))
+	}
+}
+
+func TestAPI_ReferralAttribution(t *testing.T) {
+	srv := apitest.NewServer(t)
+	ctx := context.Background()
+	if err := srv.Store.CreateReferralCode(ctx, srv.User.ID, "CLICK", 1893456000, "", nil, storage.DomainRestriction{}); err != nil {
+		t.Fatal(err)
+	}
+	otherID, err := srv.Store.CreateUser(ctx, storage.CreateUserParams{User: storage.User{Username: "other", Email: "other@example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Store.CreateReferralCode(ctx, otherID, "TYPED", 1893456000, "", nil, storage.DomainRestriction{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// клиент без перехода по перенаправлениям
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	follow := func(t *testing.T, code string) *http.Cookie {
+		t.Helper()
+		resp, err := client.Get(srv.URL + "/r/" + code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/" {
+			t.Fatalf("GET /r/%s = %d to %q, want 302 to /", code, resp.StatusCode, resp.Header.Get("Location"))
+		}
+		for _, c := range resp.Cookies() {
+			if c.Name == "gorefer_ref" {
+				if !c.HttpOnly {
+					t.Error("attribution cookie is not HttpOnly")
+				}
+				return c
+			}
+		}
+		return nil
+	}
+
+	if c := follow(t, "NOPE"); c != nil {
+		t.Errorf("unknown code set cookie %v", c)
+	}
+	cookie := follow(t, "CLICK")
+	if cookie == nil {
+		t.Fatal("GET /r/CLICK did not set attribution cookie")
+	}
+	tampered := *cookie
+	tampered.Value = "eyJjb2RlIjoiVFlQRUQifQ" + cookie.Value[strings.Index(cookie.Value, "."):]
+
+	tests := []struct {
+		name        string
+		path        string
+		payload     string // %s - имя пользователя, он же email в example.com
+		cookie      *http.Cookie
+		wantCode    string // "" - без реферальной связи
+		wantChannel string
+	}{
+		{"Cookie on register", "/register", `{"username":"%[1]s","email":"%[1]s@example.com","password":"password123"}`, cookie, "CLICK", storage.ChannelLinkClick},
+		{"Cookie without explicit code", "/register-with-referral", `{"user":{"username":"%[1]s","email":"%[1]s@example.com","password":"password123"}}`, cookie, "CLICK", storage.ChannelLinkClick},
+		{"Explicit code wins", "/register-with-referral", `{"referral_code":"TYPED","user":{"username":"%[1]s","email":"%[1]s@example.com","password":"password123"}}`, cookie, "TYPED", storage.ChannelManualCode},
+		{"Tampered cookie ignored", "/register", `{"username":"%[1]s","email":"%[1]s@example.com","password":"password123"}`, &tampered, "", ""},
+		{"No cookie", "/register", `{"username":"%[1]s","email":"%[1]s@example.com","password":"password123"}`, nil, "", ""},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := fmt.Sprintf("attributed%d", i)
+			email := name + "@example.com"
+			req := srv.NewRequest(t, "POST", tt.path, strings.NewReader(fmt.Sprintf(tt.payload, name)))
+			if tt.cookie != nil {
+				req.AddCookie(tt.cookie)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusCreated {
+				t.Fatalf("handler returned wrong status code: got %v want %v", resp.StatusCode, http.StatusCreated)
+			}
+
+			user, err := srv.Store.GetUserByEmail(ctx, email)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got apitest.Link
+			for _, l := range srv.Store.Links() {
+				if l.RefereeID == user.ID {
+					got = l
+				}
+			}
+			if got.Code != tt.wantCode || got.Channel != tt.wantChannel {
+				t.Errorf("link = %q via %q, want %q via %q", got.Code, got.Channel, tt.wantCode, tt.wantChannel)
+			}
+			if tt.wantChannel == storage.ChannelLinkClick && got.ClickID == 0 {
+				t.Error("link_click attribution has no click ID")
+			}
+		})
+	}
+}
+
+// mailbox - почтовый сервис для тестов, сохраняющий отправленные письма
+type mailbox struct {
+	mu   sync.Mutex
+	sent map[string][]string // тексты писем по адресу
+}
+
+func TestAPI_VanityLink(t *testing.T) {
+	srv := apitest.NewServer(t)
+	ctx := context.Background()
+	if err := srv.Store.CreateReferralCode(ctx, srv.User.ID, "SECRET42", 1893456000, "", nil, storage.DomainRestriction{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Store.SetUsername(ctx, srv.User.ID, "Alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.Store.CreateUser(ctx, storage.CreateUserParams{User: storage.User{Username: "nocode", Email: "nocode@example.com"}}); err != nil {
+		t.Fatal(err)
+	}
+	expiredID, err := srv.Store.CreateUser(ctx, storage.CreateUserParams{User: storage.User{Username: "expired", Email: "expired@example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Store.CreateReferralCode(ctx, expiredID, "OLD", 946684800, "", nil, storage.DomainRestriction{}); err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	follow := func(t *testing.T, username string) (int, string) {
+		t.Helper()
+		resp, err := client.Get(srv.URL + "/r/@" + username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		for _, c := range resp.Cookies() {
+			if c.Name == "gorefer_ref" {
+				return resp.StatusCode, c.Value
+			}
+		}
+		return resp.StatusCode, ""
+	}
+
+	tests := []struct {
+		name       string
+		username   string
+		wantStatus int
+	}{
+		{"Exact case", "Alice", http.StatusFound},
+		{"Different case", "aLICE", http.StatusFound},
+		{"Unknown user", "bob", http.StatusNotFound},
+		{"User without code", "nocode", http.StatusNotFound},
+		{"Expired code only", "expired", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, cookie := follow(t, tt.username)
+			if status != tt.wantStatus {
+				t.Fatalf("GET /r/@%s = %d, want %d", tt.username, status, tt.wantStatus)
+			}
+			if (cookie != "") != (tt.wantStatus == http.StatusFound) {
+				t.Errorf("attribution cookie set = %t, want %t", cookie != "", tt.wantStatus == http.StatusFound)
+			}
+		})
+	}
+
+	// переходы учитываются по коду, как для /r/{code}
+	details, err := srv.Store.GetReferralCodeDetails(ctx, "SECRET42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if details.Clicks != 2 {
+		t.Errorf("clicks = %d, want 2", details.Clicks)
+	}
+
+	resp := srv.Do(t, "PATCH", "/p/me", strings.NewReader(`{"vanity_link_opt_out":true}`))
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("opt out: status = %d, want 204", resp.StatusCode)
+	}
+	if status, _ := follow(t, "alice"); status != http.StatusNotFound {
+		t.Errorf("after opt-out: status = %d, want 404", status)
+	}
+	// код по-прежнему работает напрямую
+	direct, err := client.Get(srv.URL + "/r/SECRET42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	direct.Body.Close()
+	if direct.StatusCode != http.StatusFound {
+		t.Errorf("GET /r/SECRET42 after opt-out = %d, want 302", direct.StatusCode)
+	}
+	var profile storage.Profile
+	resp = srv.Do(t, "GET", "/p/me", nil)
+	if err := json.NewDecoder(resp.Body).Decode(&profile); err != nil || !profile.VanityLinkOptOut {
+		t.Errorf("profile = %+v, %v; want vanity_link_opt_out", profile, err)
+	}
+
+	resp = srv.Do(t, "PATCH", "/p/me", strings.NewReader(`{"vanity_link_opt_out":false}`))
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("opt in: status = %d, want 204", resp.StatusCode)
+	}
+	if status, _ := follow(t, "ALICE"); status != http.StatusFound {
+		t.Errorf("after opt-in: status = %d, want 302", status)
+	}
+
+	// имя, совпадающее с точностью до регистра, занято
+	resp = srv.Do(t, "POST", "/register", strings.NewReader(`{"username":"alice","email":"alice2@example.com","password":"secret1"}`))
+	var body api.ErrorResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || resp.StatusCode != http.StatusConflict || body.Code != api.CodeUsernameTaken {
+		t.Errorf("register taken username = %d %+v, want 409 %s", resp.StatusCode, body, api.CodeUsernameTaken)
+	}
+}
+
+func (m *mailbox) Send(ctx context.Context, to string, msg mailer.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.sent == nil {
+		m.sent = map[string][]string{}
+	}
+	m.sent[to] = append(m.sent[to], msg.Text)
+	return nil
+}
+
+func TestAPI_MagicLink(t *testing.T) {
+	t.Run("Disabled", func(t *testing.T) {
+		srv := apitest.NewServer(t)
+		if resp := srv.Do(t, "POST", "/login/magic-link", strings.NewReader(`{"email":"testuser@example.com"}`)); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("POST /login/magic-link = %d, want 404 when disabled", resp.StatusCode)
+		}
+	})
+
+	mail := &mailbox{}
+	srv := apitest.NewServer(t, apitest.WithAPIOptions(api.WithMagicLinks(api.MagicLinks{
+		Mailer:      mail,
+		BaseURL:     "https://gorefer.test/",
+		MaxRequests: 2,
+	})))
+
+	request := func(email string) *http.Response {
+		return srv.Do(t, "POST", "/login/magic-link", strings.NewReader(`{"email":"`+email+`"}`))
+	}
+	for _, email := range []string{srv.User.Email, "nobody@example.com"} {
+		if resp := request(email); resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("request for %s = %d, want 202", email, resp.StatusCode)
+		}
+	}
+	// отправка идет в фоне; Close дожидается ее завершения
+	if err := srv.API.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(mail.sent["nobody@example.com"]); n != 0 {
+		t.Errorf("mails to unknown email = %d, want 0", n)
+	}
+	if n := len(mail.sent[srv.User.Email]); n != 1 {
+		t.Fatalf("mails to %s = %d, want 1", srv.User.Email, n)
+	}
+
+	body := mail.sent[srv.User.Email][0]
+	start := strings.Index(body, "https://gorefer.test/login/magic?token=")
+	if start < 0 {
+		t.Fatalf("mail body has no login link: %q", body)
+	}
+	link := strings.Fields(body[start:])[0]
+	path := strings.TrimPrefix(link, "https://gorefer.test")
+
+	tests := []struct {
+		name         string
+		path         string
+		expectedCode int
+		wantToken    bool
+	}{
+		{"Valid link", path, http.StatusOK, true},
+		{"Reused link", path, http.StatusUnauthorized, false},
+		{"Tampered link", path[:len(path)-3] + "abc", http.StatusUnauthorized, false},
+		{"No token", "/login/magic", http.StatusUnauthorized, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := srv.Do(t, "GET", tt.path, nil)
+			if resp.StatusCode != tt.expectedCode {
+				t.Fatalf("handler returned wrong status code: got %v want %v", resp.StatusCode, tt.expectedCode)
+			}
+			var body map[string]string
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantToken {
+				claims, err := auth.ValidateToken(body["token"])
+				if err != nil || claims.UserID != srv.User.ID {
+					t.Errorf("token claims = %+v, %v, want user %d", claims, err, srv.User.ID)
+				}
+			} else if body["code"] != api.CodeMagicLinkInvalid {
+				t.Errorf("error code = %q, want %q", body["code"], api.CodeMagicLinkInvalid)
+			}
+		})
+	}
+
+	t.Run("Rate limited per email", func(t *testing.T) {
+		// лимит 2 запроса: первый уже выполнен выше, регистр email не важен
+		if resp := request(strings.ToUpper(srv.User.Email)); resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("second request = %d, want 202", resp.StatusCode)
+		}
+		resp := request(srv.User.Email)
+		if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+			t.Errorf("third request = %d, Retry-After %q, want 429 with Retry-After", resp.StatusCode, resp.Header.Get("Retry-After"))
+		}
+		// другой email лимитом не затронут
+		if resp := request("other@example.com"); resp.StatusCode != http.StatusAccepted {
+			t.Errorf("request for another email = %d, want 202", resp.StatusCode)
+		}
+	})
+}
+
+func TestAPI_ExtendCodeByLink(t *testing.T) {
+	srv := apitest.NewServer(t)
+	ctx := context.Background()
+	expiresAt := time.Now().Add(48 * time.Hour).Truncate(time.Second)
+	if err := srv.Store.CreateReferralCode(ctx, srv.User.ID, "REF123", expiresAt.Unix(), "", nil, storage.DomainRestriction{}); err != nil {
+		t.Fatal(err)
+	}
+	codes, err := srv.Store.ListUserReferralCodes(ctx, srv.User.ID)
+	if err != nil || len(codes) != 1 {
+		t.Fatalf("ListUserReferralCodes() = %v, %v", codes, err)
+	}
+	code := storage.ExpiringCode{ID: codes[0].ID, UserID: srv.User.ID, Code: "REF123", ExpiresAt: expiresAt}
+
+	link, err := api.ExtendCodeLink("https://gorefer.test/", code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := strings.TrimPrefix(link, "https://gorefer.test")
+	expired, err := auth.NewActionToken(srv.User.ID, api.ActionExtendCode, code.ID, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherUser, err := auth.NewActionToken(srv.User.ID+1, api.ActionExtendCode, code.ID, expiresAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		path         string
+		expectedCode int
+	}{
+		{"Tampered link", path[:len(path)-3] + "abc", http.StatusBadRequest},
+		{"No token", "/actions/extend-code", http.StatusBadRequest},
+		{"Expired link", "/actions/extend-code?token=" + url.QueryEscape(expired), http.StatusGone},
+		{"Other user's code", "/actions/extend-code?token=" + url.QueryEscape(otherUser), http.StatusNotFound},
+		{"Valid link", path, http.StatusOK},
+		{"Reused link", path, http.StatusGone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := srv.Do(t, "GET", tt.path, nil)
+			if resp.StatusCode != tt.expectedCode {
+				t.Fatalf("handler returned wrong status code: got %v want %v", resp.StatusCode, tt.expectedCode)
+			}
+			if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+				t.Errorf("Content-Type = %q, want text/html", ct)
+			}
+		})
+	}
+
+	// продлен ровно один раз, от текущего срока кода
+	codes, err = srv.Store.ListUserReferralCodes(ctx, srv.User.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := expiresAt.Add(api.ExtendCodeBy); !codes[0].ExpiresAt.Equal(want) {
+		t.Errorf("ExpiresAt = %v, want %v", codes[0].ExpiresAt, want)
+	}
+}
+
+func TestAPI_Handler_Mounted(t *testing.T) {
+	mail := &mailbox{}
+	srv := apitest.NewServer(t, apitest.WithAPIOptions(api.WithMagicLinks(api.MagicLinks{
+		Mailer:  mail,
+		BaseURL: "https://example.com",
+	})))
+
+	parent := chi.NewRouter()
+	parent.Get("/users/{email}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	parent.Mount("/referrals", srv.API.Handler("/referrals/"))
+	app := httptest.NewServer(parent)
+	defer app.Close()
+
+	do := func(method, path, token, body string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, app.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := app.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	// вход через родительский маршрутизатор
+	resp := do("POST", "/referrals/login", "", `{"email":"`+srv.User.Email+`","password":"`+apitest.DefaultPassword+`"}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /referrals/login = %d, want 200", resp.StatusCode)
+	}
+	var login api.TokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&login); err != nil {
+		t.Fatal(err)
+	}
+
+	payload := fmt.Sprintf(`{"user_id":%d,"code":"MOUNTED1","expires_at":%d}`, srv.User.ID, time.Now().Add(time.Hour).Unix())
+	resp = do("POST", "/referrals/p/referral-code", login.Token, payload)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST /referrals/p/referral-code = %d, want 201", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Location"); got != "/referrals/p/referral-code" {
+		t.Errorf("Location = %q, want /referrals/p/referral-code", got)
+	}
+
+	tests := []struct {
+		name         string
+		method       string
+		path         string
+		token        string
+		expectedCode int
+	}{
+		{"URL param", "GET", "/referrals/p/referral-code/" + srv.User.Email, login.Token, http.StatusOK},
+		{"Own code", "GET", "/referrals/p/referral-code", login.Token, http.StatusOK},
+		{"URL param with slashes", "GET", "/referrals//p/referral-code/" + srv.User.Email + "/", login.Token, http.StatusOK},
+		{"No token", "GET", "/referrals/p/referral-code", "", http.StatusUnauthorized},
+		{"Unprefixed path", "POST", "/login", "", http.StatusNotFound},
+		{"Parent route", "GET", "/users/" + srv.User.Email, "", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if resp := do(tt.method, tt.path, tt.token, ""); resp.StatusCode != tt.expectedCode {
+				t.Errorf("%s %s = %d, want %d", tt.method, tt.path, resp.StatusCode, tt.expectedCode)
+			}
+		})
+	}
+
+	t.Run("Error metrics use API patterns", func(t *testing.T) {
+		counts := srv.API.ErrorCounts()
+		if counts["GET /p/referral-code"][api.ReasonAuth] != 1 {
+			t.Errorf("ErrorCounts() = %v, want GET /p/referral-code auth error", counts)
+		}
+	})
+
+	t.Run("Magic link includes prefix", func(t *testing.T) {
+		if resp := do("POST", "/referrals/login/magic-link", "", `{"email":"`+srv.User.Email+`"}`); resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("POST /referrals/login/magic-link = %d, want 202", resp.StatusCode)
+		}
+		if err := srv.API.Close(); err != nil {
+			t.Fatal(err)
+		}
+		body := strings.Join(mail.sent[srv.User.Email], "\n")
+		start := strings.Index(body, "https://example.com/referrals/login/magic?token=")
+		if start < 0 {
+			t.Fatalf("mail body has no prefixed login link: %q", body)
+		}
+		link := strings.Fields(body[start:])[0]
+		if resp := do("GET", strings.TrimPrefix(link, "https://example.com"), "", ""); resp.StatusCode != http.StatusOK {
+			t.Errorf("GET magic link = %d, want 200", resp.StatusCode)
+		}
+	})
+}
+
+func TestAPI_CreatedHeaders(t *testing.T) {
+	srv := apitest.NewServer(t, apitest.WithAdmin())
+	expiresAt := time.Now().Add(time.Hour).Unix()
+
+	tests := []struct {
+		name         string
+		path         string
+		payload      string
+		wantLocation string
+		wantLinks    []string
+	}{
+		{
+			name:         "Register",
+			path:         "/register",
+			payload:      `{"username":"alice","email":"alice@example.com","password":"password123"}`,
+			wantLocation: "/p/me",
+		},
+		{
+			name:         "Register without referral code",
+			path:         "/register-with-referral",
+			payload:      `{"user":{"username":"bob","email":"bob@example.com","password":"password123"}}`,
+			wantLocation: "/p/me",
+		},
+		{
+			name:         "Create referral code",
+			path:         "/p/referral-code",
+			payload:      fmt.Sprintf(`{"user_id":%d,"code":"SHARE 1","expires_at":%d}`, srv.User.ID, expiresAt),
+			wantLocation: "/p/referral-code",
+			wantLinks:    []string{`</r/SHARE%201>; rel="share"`},
+		},
+		{
+			name:         "Reserve referral code",
+			path:         "/admin/referral-codes/reserve",
+			payload:      fmt.Sprintf(`{"email":"carol@example.com","code":"CAROL1","expires_at":%d}`, expiresAt),
+			wantLocation: "/admin/referral-codes/CAROL1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := srv.Do(t, "POST", tt.path, strings.NewReader(tt.payload))
+			if resp.StatusCode != http.StatusCreated {
+				t.Fatalf("handler returned wrong status code: got %v want %v", resp.StatusCode, http.StatusCreated)
+			}
+			if got := resp.Header.Get("Location"); got != tt.wantLocation {
+				t.Errorf("Location = %q, want %q", got, tt.wantLocation)
+			}
+			if got := resp.Header.Values("Link"); !reflect.DeepEqual(got, tt.wantLinks) {
+				t.Errorf("Link = %q, want %q", got, tt.wantLinks)
+			}
+		})
+	}
+}
+
+func TestAPI_RecountReferrals(t *testing.T) {
+	srv := apitest.NewServer(t, apitest.WithAdmin())
+	srv.Store.SetRewardTiers(rewards.Tiers{{UpTo: 5, Amount: 100}})
+	ctx := context.Background()
+	if err := srv.Store.CreateReferralCode(ctx, srv.User.ID, "RECOUNT", 1893456000, "", nil, storage.DomainRestriction{}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		params := storage.CreateUserParams{User: storage.User{Username: fmt.Sprint("referee", i), Email: fmt.Sprintf("referee%d@example.com", i)}}
+		if _, err := srv.Store.RegisterWithReferralCode(ctx, "RECOUNT", params); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// связь без вознаграждения и учета использования, вознаграждение без связи
+	lost, err := srv.Store.CreateUser(ctx, storage.CreateUserParams{User: storage.User{Username: "lost", Email: "lost@example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Store.AddLink(apitest.Link{ReferrerID: srv.User.ID, RefereeID: lost, Code: "RECOUNT"})
+	srv.Store.AddReward(srv.User.ID, 999, 100)
+
+	want := storage.ConsistencyReport{
+		LinksWithoutRewards: []storage.MissingReward{{ReferrerID: srv.User.ID, RefereeID: lost, Tier: 1, Amount: 100}},
+		RewardsWithoutLinks: []storage.OrphanReward{{ReferrerID: srv.User.ID, RefereeID: 999, Amount: 100}},
+		CodeUsageMismatches: []storage.CodeUsageMismatch{{Code: "RECOUNT", Uses: 2, Links: 3}},
+	}
+	consistent := storage.ConsistencyReport{
+		LinksWithoutRewards: []storage.MissingReward{},
+		RewardsWithoutLinks: []storage.OrphanReward{},
+		CodeUsageMismatches: []storage.CodeUsageMismatch{},
+	}
+
+	tests := []struct {
+		name string
+		path string
+		want storage.ConsistencyReport
+	}{
+		{"Report only", "/admin/maintenance/recount", want},
+		{"Report is not a fix", "/admin/maintenance/recount?fix=false", want},
+		{"Fix", "/admin/maintenance/recount?fix=true", want},
+		{"Consistent after fix", "/admin/maintenance/recount", consistent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := srv.Do(t, "POST", tt.path, nil)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("handler returned wrong status code: got %v want %v", resp.StatusCode, http.StatusOK)
+			}
+			if got := resp.Header.Get("Content-Disposition"); !strings.HasPrefix(got, `attachment; filename="consistency-`) {
+				t.Errorf("Content-Disposition = %q, want attachment", got)
+			}
+			var got storage.ConsistencyReport
+			if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			// ID и время проверки зависят от порядка создания записей
+			for i := range got.RewardsWithoutLinks {
+				got.RewardsWithoutLinks[i].ID = 0
+			}
+			for i := range got.CodeUsageMismatches {
+				got.CodeUsageMismatches[i].ID = 0
+			}
+			if got.CheckedAt.IsZero() {
+				t.Error("checked_at is empty")
+			}
+			wantFixed := strings.HasSuffix(tt.path, "fix=true")
+			if got.Fixed != wantFixed {
+				t.Errorf("fixed = %v, want %v", got.Fixed, wantFixed)
+			}
+			got.CheckedAt, got.Fixed = time.Time{}, false
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("report = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("Rewards credited by fix", func(t *testing.T) {
+		stats, err := srv.Store.GetReferralStats(ctx, srv.User.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Referrals != 3 || stats.RewardTotal != 300 {
+			t.Errorf("stats = %+v, want 3 referrals and 300 total", stats)
+		}
+	})
+
+	t.Run("Requires admin", func(t *testing.T) {
+		srv := apitest.NewServer(t)
+		if resp := srv.Do(t, "POST", "/admin/maintenance/recount", nil); resp.StatusCode != http.StatusForbidden {
+			t.Errorf("handler returned wrong status code: got %v want %v", resp.StatusCode, http.StatusForbidden)
+		}
+	})
+}
+
+func TestAPI_MultipleReferralCodes(t *testing.T) {
+	ctx := context.Background()
+	createCode := func(srv *apitest.Server, code, label string) *http.Response {
+		payload := fmt.Sprintf(`{"user_id":%d,"code":%q,"label":%q,"expires_at":%d}`, srv.User.ID, code, label, codeExpiresAt)
+		return srv.Do(t, "POST", "/p/referral-code", strings.NewReader(payload))
+	}
+
+	t.Run("Single code by default", func(t *testing.T) {
+		srv := apitest.NewServer(t)
+		for _, code := range []string{"FIRST", "SECOND"} {
+			if resp := createCode(srv, code, "youtube"); resp.StatusCode != http.StatusCreated {
+				t.Fatalf("create %s = %d, want 201", code, resp.StatusCode)
+			}
+		}
+		if resp := srv.Do(t, "GET", "/p/referral-codes", nil); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("GET /p/referral-codes = %d, want 404", resp.StatusCode)
+		}
+
+		resp := srv.Do(t, "GET", "/p/referral-code", nil)
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var code storage.ReferralCode
+		if err := json.Unmarshal(body, &code); err != nil {
+			t.Fatal(err)
+		}
+		if code.Code != "SECOND" || strings.Contains(string(body), `"label"`) {
+			t.Errorf("GET /p/referral-code = %s, want SECOND without label", body)
+		}
+
+		resp = srv.Do(t, "GET", "/p/stats", nil)
+		body, err = io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keys, want := jsonKeys(t, body), []string{"active_tier", "balance", "referrals", "reward_total"}; !reflect.DeepEqual(keys, want) {
+			t.Errorf("stats keys = %v, want %v", keys, want)
+		}
+	})
+
+	t.Run("Multiple codes", func(t *testing.T) {
+		srv := apitest.NewServer(t, apitest.WithAPIOptions(api.WithMultipleCodes(2)))
+		tests := []struct {
+			name         string
+			code         string
+			label        string
+			expectedCode int
+			wantError    string
+		}{
+			{"First code", "YOUTUBE", "YouTube", http.StatusCreated, ""},
+			{"Label too long", "LONG", strings.Repeat("я", 51), http.StatusBadRequest, api.CodeInvalidPayload},
+			{"Second code", "NEWSLETTER", "Newsletter", http.StatusCreated, ""},
+			{"Over the limit", "THIRD", "", http.StatusConflict, api.CodeReferralCodeLimit},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				resp := createCode(srv, tt.code, tt.label)
+				if resp.StatusCode != tt.expectedCode {
+					t.Fatalf("handler returned wrong status code: got %v want %v", resp.StatusCode, tt.expectedCode)
+				}
+				if tt.wantError == "" {
+					if got := resp.Header.Get("Location"); got != "/p/referral-codes" {
+						t.Errorf("Location = %q, want /p/referral-codes", got)
+					}
+					return
+				}
+				var body api.ErrorResponse
+				if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+					t.Fatal(err)
+				}
+				if body.Code != tt.wantError {
+					t.Errorf("error code = %q, want %q", body.Code, tt.wantError)
+				}
+			})
+		}
+
+		resp := srv.Do(t, "GET", "/p/referral-codes", nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET /p/referral-codes = %d, want 200", resp.StatusCode)
+		}
+		var codes []storage.ReferralCode
+		if err := json.NewDecoder(resp.Body).Decode(&codes); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, c := range codes {
+			got = append(got, c.Code+"/"+c.Label)
+		}
+		if want := []string{"YOUTUBE/YouTube", "NEWSLETTER/Newsletter"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("codes = %v, want %v", got, want)
+		}
+
+		// два реферала по первому коду и переход по второму
+		for i := 0; i < 2; i++ {
+			params := storage.CreateUserParams{User: storage.User{Username: fmt.Sprint("referee", i), Email: fmt.Sprintf("referee%d@example.com", i)}}
+			if _, err := srv.Store.RegisterWithReferralCode(ctx, "YOUTUBE", params); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := srv.Store.RecordClick(ctx, "NEWSLETTER"); err != nil {
+			t.Fatal(err)
+		}
+
+		resp = srv.Do(t, "GET", "/p/stats", nil)
+		var stats storage.ReferralStats
+		if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+			t.Fatal(err)
+		}
+		want := []storage.ReferralCodeStats{
+			{Code: "YOUTUBE", Label: "YouTube", Referrals: 2},
+			{Code: "NEWSLETTER", Label: "Newsletter", Clicks: 1},
+		}
+		if stats.Referrals != 2 || !reflect.DeepEqual(stats.Codes, want) {
+			t.Errorf("stats = %+v, want 2 referrals and codes %+v", stats, want)
+		}
+	})
+}
+
+func TestAPI_WrappedStorageErrors(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDB := storage.NewMockDBInterface(ctrl)
+	apiHandler := api.New(mockDB)
+
+	var logs bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&logs)
+
+	tests := []struct {
+		name         string
+		method       string
+		path         string
+		body         string
+		expectedCode int
+		wantCode     string
+		wantLog      string
+		mockSetup    func()
+	}{
+		{
+			name:         "Not found",
+			method:       "GET",
+			path:         "/admin/referral-codes/GONE",
+			expectedCode: http.StatusNotFound,
+			wantCode:     api.CodeReferralCodeNotFound,
+			wantLog:      "storage: get referral code details code=GONE: запись не найдена",
+			mockSetup: func() {
+				mockDB.EXPECT().GetReferralCodeDetails(gomock.Any(), "GONE").
+					Return(storage.ReferralCodeDetails{}, fmt.Errorf("storage: get referral code details code=GONE: %w", storage.ErrNotFound))
+			},
+		},
+		{
+			name:         "Conflict",
+			method:       "POST",
+			path:         "/admin/referral-codes/reserve",
+			body:         fmt.Sprintf(`{"email":"alice@example.com","code":"ALICE","expires_at":%d}`, codeExpiresAt),
+			expectedCode: http.StatusConflict,
+			wantCode:     api.CodeReferralCodeTaken,
+			wantLog:      "storage: reserve referral code code=ALICE email=a***@example.com: реферальный код уже занят",
+			mockSetup: func() {
+				mockDB.EXPECT().ReserveReferralCode(gomock.Any(), "alice@example.com", "ALICE", codeExpiresAt, storage.DomainRestriction{}).
+					Return(fmt.Errorf("storage: reserve referral code code=ALICE email=a***@example.com: %w", storage.ErrCodeTaken))
+			},
+		},
+		{
+			name:         "Internal error",
+			method:       "GET",
+			path:         "/admin/referral-codes/BROKEN",
+			expectedCode: http.StatusInternalServerError,
+			wantCode:     api.CodeInternal,
+			wantLog:      "storage: get referral code details code=BROKEN: connection refused",
+			mockSetup: func() {
+				mockDB.EXPECT().GetReferralCodeDetails(gomock.Any(), "BROKEN").
+					Return(storage.ReferralCodeDetails{}, fmt.Errorf("storage: get referral code details code=BROKEN: %w", errors.New("connection refused")))
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs.Reset()
+			tt.mockSetup()
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Authorization", bearer(t, 1, storage.RoleAdmin))
+			rr := httptest.NewRecorder()
+			apiHandler.Router().ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedCode {
+				t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, tt.expectedCode)
+			}
+			var body api.ErrorResponse
+			if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Code != tt.wantCode {
+				t.Errorf("error code = %q, want %q", body.Code, tt.wantCode)
+			}
+			// клиент видит только конверт ошибки, лог - всю цепочку
+			if strings.Contains(rr.Body.String(), "storage:") {
+				t.Errorf("response body leaks storage context: %s", rr.Body.String())
+			}
+			if !strings.Contains(logs.String(), tt.wantLog) {
+				t.Errorf("log = %q, want it to contain %q", logs.String(), tt.wantLog)
+			}
+		})
+	}
+}
+
+func TestAPI_GetOverview(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDB := storage.NewMockDBInterface(ctrl)
+	apiHandler := api.New(mockDB,
+		api.WithOverviewSource("db_pool", func(ctx context.Context) (interface{}, error) {
+			return map[string]int{"total": 4}, nil
+		}),
+		api.WithOverviewSource("outbox", func(ctx context.Context) (interface{}, error) {
+			return nil, errors.New("outbox is down")
+		}),
+	)
+
+	tests := []struct {
+		name         string
+		mockSetup    func()
+		wantSections []string
+		wantErrors   []api.OverviewError
+	}{
+		{
+			name: "One source fails",
+			mockSetup: func() {
+				mockDB.EXPECT().CountSignups(gomock.Any(), gomock.Any()).Return(7, nil)
+				mockDB.EXPECT().CountActiveCodes(gomock.Any()).Return(3, nil)
+			},
+			wantSections: []string{"active_codes", "db_pool", "panics_total", "requests", "signups_today"},
+			wantErrors:   []api.OverviewError{{Section: "outbox", Error: "unavailable"}},
+		},
+		{
+			name: "Storage fails",
+			mockSetup: func() {
+				mockDB.EXPECT().CountSignups(gomock.Any(), gomock.Any()).Return(7, nil)
+				mockDB.EXPECT().CountActiveCodes(gomock.Any()).Return(0, errors.New("connection refused"))
+			},
+			wantSections: []string{"db_pool", "panics_total", "requests", "signups_today"},
+			wantErrors: []api.OverviewError{
+				{Section: "active_codes", Error: "unavailable"},
+				{Section: "outbox", Error: "unavailable"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.mockSetup()
+			req := httptest.NewRequest("GET", "/admin/overview", nil)
+			req.Header.Set("Authorization", bearer(t, 1, storage.RoleAdmin))
+			rr := httptest.NewRecorder()
+			apiHandler.Router().ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusOK {
+				t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+			}
+			var got struct {
+				GeneratedAt time.Time                  `json:"generated_at"`
+				Sections    map[string]json.RawMessage `json:"sections"`
+				Errors      []api.OverviewError        `json:"errors"`
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			var sections []string
+			for name := range got.Sections {
+				sections = append(sections, name)
+			}
+			sort.Strings(sections)
+			if !reflect.DeepEqual(sections, tt.wantSections) {
+				t.Errorf("sections = %v, want %v", sections, tt.wantSections)
+			}
+			if !reflect.DeepEqual(got.Errors, tt.wantErrors) {
+				t.Errorf("errors = %v, want %v", got.Errors, tt.wantErrors)
+			}
+			if string(got.Sections["signups_today"]) != "7" {
+				t.Errorf("signups_today = %s, want 7", got.Sections["signups_today"])
+			}
+			if got.GeneratedAt.IsZero() {
+				t.Error("generated_at is empty")
+			}
+		})
+	}
+}
+
+func TestAPI_PreviewEmail(t *testing.T) {
+	srv := apitest.NewServer(t, apitest.WithAdmin())
+
+	tests := []struct {
+		name         string
+		query        string
+		expectedCode int
+		wantType     string
+		wantBody     string
+	}{
+		{"JSON", "?template=invite", http.StatusOK, "application/json", `"subject":"alice приглашает вас в gorefer"`},
+		{"HTML", "?template=invite&format=html", http.StatusOK, "text/html; charset=utf-8", `href="https://gorefer.example/r/SAMPLE42"`},
+		{"Unknown template", "?template=welcome", http.StatusNotFound, "application/json", api.CodeEmailTemplateNotFound},
+		{"No template", "", http.StatusBadRequest, "application/json", api.CodeInvalidParameter},
+		{"Unknown format", "?template=invite&format=pdf", http.StatusBadRequest, "application/json", api.CodeInvalidParameter},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := srv.Do(t, "GET", "/admin/emails/preview"+tt.query, nil)
+			if resp.StatusCode != tt.expectedCode {
+				t.Fatalf("handler returned wrong status code: got %v want %v", resp.StatusCode, tt.expectedCode)
+			}
+			if got := resp.Header.Get("Content-Type"); got != tt.wantType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.wantType)
+			}
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(body), tt.wantBody) {
+				t.Errorf("body = %s, want it to contain %s", body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestAPI_RegisterDuplicateEmail(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDB := storage.NewMockDBInterface(ctrl)
+	apiHandler := api.New(mockDB)
+
+	// ошибка хранилища при нарушении уникальности, как ее возвращает storage.DB
+	taken := fmt.Errorf("storage: create user email=b***@example.com: %w", storage.ErrEmailTaken)
+
+	tests := []struct {
+		name      string
+		path      string
+		body      string
+		mockSetup func()
+	}{
+		{
+			name: "Register",
+			path: "/register",
+			body: `{"username":"bob","email":"bob@example.com","password":"password123"}`,
+			mockSetup: func() {
+				mockDB.EXPECT().CreateUser(gomock.Any(), gomock.Any()).Return(0, taken)
+			},
+		},
+		{
+			name: "Register with referral code",
+			path: "/register-with-referral",
+			body: `{"referral_code":"ALICE","user":{"username":"bob","email":"bob@example.com","password":"password123"}}`,
+			mockSetup: func() {
+				mockDB.EXPECT().RegisterWithReferralCode(gomock.Any(), "ALICE", gomock.Any()).Return(storage.ReferralRegistration{}, taken)
+			},
+		},
+		{
+			name: "Register with referral, no code",
+			path: "/register-with-referral",
+			body: `{"user":{"username":"bob","email":"bob@example.com","password":"password123"}}`,
+			mockSetup: func() {
+				mockDB.EXPECT().CreateUser(gomock.Any(), gomock.Any()).Return(0, taken)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.mockSetup()
+			req := httptest.NewRequest("POST", tt.path, strings.NewReader(tt.body))
+			rr := httptest.NewRecorder()
+			apiHandler.Router().ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusConflict {
+				t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusConflict)
+			}
+			var body api.ErrorResponse
+			if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Code != api.CodeEmailTaken {
+				t.Errorf("error code = %q, want %q", body.Code, api.CodeEmailTaken)
+			}
+		})
+	}
+}
+
+func TestAPI_CompareMyReferralCodes(t *testing.T) {
+	srv := apitest.NewServer(t, apitest.WithAPIOptions(api.WithMultipleCodes(3)))
+	ctx := context.Background()
+	for _, c := range []storage.NewReferralCode{
+		{UserID: srv.User.ID, Code: "SPRING", Label: "youtube", ExpiresAt: 1893456000},
+		{UserID: srv.User.ID, Code: "QUIET", ExpiresAt: 1893456000},
+	} {
+		if err := srv.Store.AddReferralCode(ctx, c, 3); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var clickID int
+	for i := 0; i < 4; i++ {
+		var err error
+		if clickID, err = srv.Store.RecordClick(ctx, "SPRING"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, params := range []storage.CreateUserParams{
+		{User: storage.User{Username: "clicked", Email: "clicked@example.com"}, Channel: storage.ChannelLinkClick, ClickID: clickID},
+		{User: storage.User{Username: "typed", Email: "typed@example.com"}},
+	} {
+		if _, err := srv.Store.RegisterWithReferralCode(ctx, "SPRING", params); err != nil {
+			t.Fatalf("registration %d: %v", i, err)
+		}
+	}
+	// связь по коду, замененному до перехода на несколько кодов
+	srv.Store.AddLink(apitest.Link{ReferrerID: srv.User.ID, RefereeID: 999, Code: "WINTER", Channel: storage.ChannelManualCode})
+
+	rate := 0.25
+	want := []storage.CodeComparison{
+		{Code: "SPRING", Label: "youtube", Current: true, Clicks: 4, Signups: 2, LinkSignups: 1, ConversionRate: &rate},
+		{Code: "WINTER", Signups: 1},
+		{Code: "QUIET", Current: true},
+	}
+
+	resp := srv.Do(t, "GET", "/p/referral-codes/compare", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", resp.StatusCode, http.StatusOK)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []storage.CodeComparison
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GET /p/referral-codes/compare = %s", body)
+	}
+	// у кода без переходов конверсия не определена
+	if !strings.Contains(string(body), `"code":"QUIET","current":true,"clicks":0,"signups":0,"link_signups":0,"conversion_rate":null`) {
+		t.Errorf("zero-activity code = %s, want explicit zeros and null conversion", body)
+	}
+}
+
+func TestAPI_TokenRotation(t *testing.T) {
+	srv := apitest.NewServer(t)
+
+	secret := "before-rotation"
+	keys, err := auth.NewKeyStore(func() ([]byte, error) { return []byte(secret), nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := auth.Keys
+	auth.Keys = keys
+	t.Cleanup(func() { auth.Keys = prev })
+
+	oldToken, err := auth.GenerateToken(srv.User.ID, srv.User.Username, srv.User.Role)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret = "after-rotation"
+	if err := keys.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(method, path, token string) *http.Response {
+		t.Helper()
+		req := srv.NewRequest(t, method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	resp := do("GET", "/p/stats", oldToken)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get(middlware.TokenRotateHeader) != "true" {
+		t.Fatalf("old token: status %d, %s = %q, want 200 with rotate prompt", resp.StatusCode, middlware.TokenRotateHeader, resp.Header.Get(middlware.TokenRotateHeader))
+	}
+
+	resp = do("POST", "/refresh", oldToken)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /refresh = %d, want 200", resp.StatusCode)
+	}
+	if got := resp.Header.Get(middlware.TokenRotateHeader); got != "" {
+		t.Errorf("POST /refresh %s = %q, want none", middlware.TokenRotateHeader, got)
+	}
+	var refreshed api.TokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&refreshed); err != nil {
+		t.Fatal(err)
+	}
+
+	resp = do("GET", "/p/stats", refreshed.Token)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get(middlware.TokenRotateHeader) != "" {
+		t.Errorf("refreshed token: status %d, %s = %q, want 200 without rotate prompt", resp.StatusCode, middlware.TokenRotateHeader, resp.Header.Get(middlware.TokenRotateHeader))
+	}
+}
+
+func TestAPI_RegisterRetryWithOwnCode(t *testing.T) {
+	srv := apitest.NewServer(t)
+	ctx := context.Background()
+	if err := srv.Store.ReserveReferralCode(ctx, "owner@example.com", "OWNER", 1893456000, storage.DomainRestriction{}); err != nil {
+		t.Fatal(err)
+	}
+	// прерванная попытка создала пользователя, и зарезервированный код стал его собственным
+	hash, err := auth.HashPassword("secret1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.Store.CreateUser(ctx, storage.CreateUserParams{
+		User: storage.User{Username: "owner", Email: "owner@example.com", Password: hash},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := srv.Do(t, "POST", "/register-with-referral", strings.NewReader(
+		`{"referral_code":"OWNER","user":{"username":"owner","email":"owner@example.com","password":"secret1"}}`))
+	var body api.ErrorResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusConflict || body.Code != api.CodeSelfReferral {
+		t.Errorf("retry with own code = %d %s, want 409 %s", resp.StatusCode, body.Code, api.CodeSelfReferral)
+	}
+}
+
+func TestAPI_ReferralSignupResponse(t *testing.T) {
+	srv := apitest.NewServer(t)
+	if err := srv.Store.CreateReferralCode(context.Background(), srv.User.ID, "WELCOME", 1893456000, "", nil, storage.DomainRestriction{}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := srv.Do(t, "POST", "/register-with-referral", strings.NewReader(
+		`{"referral_code":"WELCOME","user":{"username":"invitee","email":"invitee@example.com","password":"secret1"}}`))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("status = %d, want 201", resp.StatusCode)
+	}
+	var body map[string]json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if _, leaked := body["password"]; leaked || strings.Contains(string(body["user"]), "password") {
+		t.Errorf("response exposes the password: %s", body["user"])
+	}
+	var referredBy storage.UserRef
+	if err := json.Unmarshal(body["referred_by"], &referredBy); err != nil {
+		t.Fatal(err)
+	}
+	if referredBy != (storage.UserRef{ID: srv.User.ID, Username: srv.User.Username}) {
+		t.Errorf("referred_by = %+v, want %s", referredBy, srv.User.Username)
+	}
+
+	// пользователь, зарегистрированный по коду, входит с тем же паролем
+	resp = srv.Do(t, "POST", "/login", strings.NewReader(`{"email":"invitee@example.com","password":"secret1"}`))
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("login after referral signup = %d, want 200", resp.StatusCode)
+	}
+}
+
+// PATCH /p/referral-code меняет только текущий код пользователя
+func TestAPI_UpdateMyReferralCodeCurrentOnly(t *testing.T) {
+	srv := apitest.NewServer(t)
+	ctx := context.Background()
+	for _, code := range []string{"OLDER", "CURRENT"} {
+		c := storage.NewReferralCode{UserID: srv.User.ID, Code: code, ExpiresAt: codeExpiresAt, Metadata: json.RawMessage(`{"v":1}`)}
+		if err := srv.Store.AddReferralCode(ctx, c, 5); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expiresAt := codeExpiresAt + 3600
+	resp := srv.Do(t, "PATCH", "/p/referral-code", strings.NewReader(fmt.Sprintf(
+		`{"metadata":{"v":2},"allowed_domain":"acme.com","expires_at":%d}`, expiresAt)))
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("status = %d, want 204", resp.StatusCode)
+	}
+
+	current, err := srv.Store.GetReferralCodeDetails(ctx, "CURRENT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(current.Metadata) != `{"v":2}` || current.Domain != "acme.com" || current.ExpiresAt.Unix() != expiresAt {
+		t.Errorf("current code = %+v, want all changes applied", current)
+	}
+	older, err := srv.Store.GetReferralCodeDetails(ctx, "OLDER")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(older.Metadata) != `{"v":1}` || older.Domain != "" || older.ExpiresAt.Unix() != codeExpiresAt {
+		t.Errorf("older code = %+v, want it unchanged", older)
+	}
+}
+
+func TestAPI_ReferralCodeDomain(t *testing.T) {
+	srv := apitest.NewServer(t)
+	resp := srv.Do(t, "POST", "/p/referral-code", strings.NewReader(fmt.Sprintf(
+		`{"user_id":%d,"code":"PARTNER","expires_at":%d,"allowed_domain":"Acme.COM"}`, srv.User.ID, codeExpiresAt)))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create: status = %d, want 201", resp.StatusCode)
+	}
+
+	signup := func(email string) string {
+		return fmt.Sprintf(`{"referral_code":"PARTNER","user":{"username":%q,"email":%q,"password":"secret1"}}`,
+			strings.ReplaceAll(strings.Split(email, "@")[0], ".", "_"), email)
+	}
+	errorCode := func(t *testing.T, resp *http.Response) api.ErrorResponse {
+		t.Helper()
+		var body api.ErrorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		return body
+	}
+
+	// форма регистрации узнает об ограничении до отправки
+	resp = srv.Do(t, "POST", "/register-with-referral?dry_run=true", strings.NewReader(signup("anna@acme.com")))
+	var valid api.ValidationResponse
+	if err := json.NewDecoder(resp.Body).Decode(&valid); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || valid.Domain != "acme.com" || valid.Subdomains {
+		t.Errorf("dry run = %d %+v, want 200 with allowed_domain acme.com", resp.StatusCode, valid)
+	}
+	resp = srv.Do(t, "POST", "/register-with-referral?dry_run=true", strings.NewReader(signup("anna@example.com")))
+	if body := errorCode(t, resp); resp.StatusCode != http.StatusUnprocessableEntity || body.Code != api.CodeDomainMismatch ||
+		len(body.Fields) != 1 || body.Fields[0].Field != "email" {
+		t.Errorf("dry run mismatch = %d %+v, want 422 %s on email", resp.StatusCode, body, api.CodeDomainMismatch)
+	}
+
+	tests := []struct {
+		name       string
+		subdomains bool
+		email      string
+		want       int
+	}{
+		{"Exact match", false, "bob@acme.com", http.StatusCreated},
+		{"Exact match ignores case", false, "Carol@ACME.com", http.StatusCreated},
+		{"Subdomain not allowed", false, "dave@eu.acme.com", http.StatusUnprocessableEntity},
+		{"Subdomain allowed", true, "erin@eu.acme.com", http.StatusCreated},
+		{"Mismatch", true, "frank@example.com", http.StatusUnprocessableEntity},
+		{"Lookalike domain", true, "grace@notacme.com", http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := srv.Do(t, "PATCH", "/p/referral-code", strings.NewReader(fmt.Sprintf(
+				`{"allowed_domain":"acme.com","allow_subdomains":%t}`, tt.subdomains)))
+			if resp.StatusCode != http.StatusNoContent {
+				t.Fatalf("patch: status = %d, want 204", resp.StatusCode)
+			}
+			before, err := srv.Store.GetReferralCodeDetails(context.Background(), "PARTNER")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp = srv.Do(t, "POST", "/register-with-referral", strings.NewReader(signup(tt.email)))
+			if resp.StatusCode != tt.want {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+			after, err := srv.Store.GetReferralCodeDetails(context.Background(), "PARTNER")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want == http.StatusCreated {
+				if after.Uses != before.Uses+1 {
+					t.Errorf("uses = %d, want %d", after.Uses, before.Uses+1)
+				}
+				return
+			}
+			if body := errorCode(t, resp); body.Code != api.CodeDomainMismatch {
+				t.Errorf("code = %s, want %s", body.Code, api.CodeDomainMismatch)
+			}
+			if after.Uses != before.Uses {
+				t.Errorf("rejected signup counted a use: %d -> %d", before.Uses, after.Uses)
+			}
+		})
+	}
+
+	// некорректный домен и снятие ограничения
+	resp = srv.Do(t, "PATCH", "/p/referral-code", strings.NewReader(`{"allowed_domain":"acme"}`))
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("patch with invalid domain: status = %d, want 400", resp.StatusCode)
+	}
+	resp = srv.Do(t, "PATCH", "/p/referral-code", strings.NewReader(`{"allowed_domain":""}`))
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("patch clearing domain: status = %d, want 204", resp.StatusCode)
+	}
+	resp = srv.Do(t, "POST", "/register-with-referral", strings.NewReader(signup("heidi@example.com")))
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("signup after clearing domain: status = %d, want 201", resp.StatusCode)
+	}
+}
+
+func TestAPI_RegistrationToggles(t *testing.T) {
+	tests := []struct {
+		open, referral bool
+	}{
+		{true, true},
+		{true, false},
+		{false, true},
+		{false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("open=%t referral=%t", tt.open, tt.referral), func(t *testing.T) {
+			reg := api.Registration{Open: tt.open, Referral: tt.referral}
+			srv := apitest.NewServer(t, apitest.WithAPIOptions(api.WithRegistration(reg)))
+			if err := srv.Store.CreateReferralCode(context.Background(), srv.User.ID, "INVITE", 1893456000, "", nil, storage.DomainRestriction{}); err != nil {
+				t.Fatal(err)
+			}
+
+			// настройки доступны без токена
+			resp, err := http.Get(srv.URL + "/config/public")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			var cfg api.PublicConfig
+			if err := json.NewDecoder(resp.Body).Decode(&cfg); err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusOK || cfg.Registration != reg {
+				t.Errorf("GET /config/public = %d %+v, want 200 %+v", resp.StatusCode, cfg.Registration, reg)
+			}
+
+			status := func(enabled bool) int {
+				if enabled {
+					return http.StatusCreated
+				}
+				return http.StatusForbidden
+			}
+			requests := []struct {
+				name string
+				path string
+				body string
+				want int
+			}{
+				{"Open registration", "/register", `{"username":"open","email":"open@example.com","password":"secret"}`, status(tt.open)},
+				{"Referral registration", "/register-with-referral", `{"referral_code":"INVITE","user":{"username":"invited","email":"invited@example.com","password":"secret"}}`, status(tt.referral)},
+				{"Referral endpoint without code", "/register-with-referral", `{"user":{"username":"nocode","email":"nocode@example.com","password":"secret"}}`, status(tt.open && tt.referral)},
+			}
+			for _, rq := range requests {
+				resp := srv.Do(t, "POST", rq.path, strings.NewReader(rq.body))
+				if resp.StatusCode != rq.want {
+					t.Errorf("%s: status = %d, want %d", rq.name, resp.StatusCode, rq.want)
+					continue
+				}
+				if rq.want == http.StatusForbidden {
+					var body api.ErrorResponse
+					if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.Code != api.CodeRegistrationDisabled {
+						t.Errorf("%s: code = %q, %v, want %s", rq.name, body.Code, err, api.CodeRegistrationDisabled)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestAPI_UsernamePolicy(t *testing.T) {
+	srv := apitest.NewServer(t)
+
+	tests := []struct {
+		name         string
+		method, path string
+		body         string
+		expectedCode int
+		wantField    string // код нарушения в поле username
+	}{
+		{
+			name:         "Register with control character",
+			method:       "POST",
+			path:         "/register",
+			body:         `{"username":"bob\u0007","email":"bell@example.com","password":"password123"}`,
+			expectedCode: http.StatusUnprocessableEntity,
+			wantField:    "invalid_characters",
+		},
+		{
+			name:         "Register with referral, oversized name",
+			method:       "POST",
+			path:         "/register-with-referral",
+			body:         `{"user":{"username":"` + strings.Repeat("x", 10240) + `","email":"big@example.com","password":"password123"}}`,
+			expectedCode: http.StatusUnprocessableEntity,
+			wantField:    "too_long",
+		},
+		{
+			name:         "Dry run with spoofed admin",
+			method:       "POST",
+			path:         "/register?dry_run=true",
+			body:         `{"username":"\u0410dmin","email":"spoof@example.com","password":"password123"}`,
+			expectedCode: http.StatusUnprocessableEntity,
+			wantField:    "reserved",
+		},
+		{
+			name:         "Profile update to reserved name",
+			method:       "PATCH",
+			path:         "/p/me",
+			body:         `{"username":"support"}`,
+			expectedCode: http.StatusUnprocessableEntity,
+			wantField:    "reserved",
+		},
+		{
+			name:         "Profile update to decomposed name",
+			method:       "PATCH",
+			path:         "/p/me",
+			body:         `{"username":"jose\u0301"}`,
+			expectedCode: http.StatusNoContent,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := srv.Do(t, tt.method, tt.path, strings.NewReader(tt.body))
+			if resp.StatusCode != tt.expectedCode {
+				t.Fatalf("handler returned wrong status code: got %v want %v", resp.StatusCode, tt.expectedCode)
+			}
+			if tt.wantField == "" {
+				return
+			}
+			var body api.ErrorResponse
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Code != api.CodeValidationFailed || len(body.Fields) != 1 {
+				t.Fatalf("response = %+v, want %s with one field", body, api.CodeValidationFailed)
+			}
+			if f := body.Fields[0]; f.Field != "username" || f.Code != tt.wantField {
+				t.Errorf("field error = %+v, want username/%s", f, tt.wantField)
+			}
+		})
+	}
+
+	// имя сохраняется в форме NFC
+	export, err := srv.Store.ExportUserData(context.Background(), srv.User.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if export.Profile.Username != "jos\u00e9" {
+		t.Errorf("stored username = %q, want NFC form", export.Profile.Username)
+	}
+}
+
+func TestAPI_LoginHistory(t *testing.T) {
+	srv := apitest.NewServer(t)
+
+	login := func(password string) int {
+		body, _ := json.Marshal(storage.User{Email: srv.User.Email, Password: password})
+		req := srv.NewRequest(t, "POST", "/login", bytes.NewReader(body))
+		req.Header.Set("User-Agent", "history-test/1.0")
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := login("wrong-password"); code != http.StatusUnauthorized {
+		t.Fatalf("failed login status = %d", code)
+	}
+	if code := login(apitest.DefaultPassword); code != http.StatusOK {
+		t.Fatalf("login status = %d", code)
+	}
+	// дожидаемся фоновой записи попыток
+	if err := srv.API.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := srv.Do(t, "GET", "/p/me/logins?limit=1", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", resp.StatusCode, http.StatusOK)
+	}
+	if link := resp.Header.Get("Link"); !strings.Contains(link, `rel="next"`) {
+		t.Errorf("Link = %q, want next page", link)
+	}
+	var events []storage.LoginEvent
+	if err := json.NewDecoder(resp.Body).Decode(&events); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || !events[0].Success || events[0].UserAgent != "history-test/1.0" {
+		t.Fatalf("events = %+v, want the latest successful login", events)
+	}
+
+	resp = srv.Do(t, "GET", "/p/me/logins?offset=1", nil)
+	events = nil
+	if err := json.NewDecoder(resp.Body).Decode(&events); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Success {
+		t.Fatalf("events = %+v, want the failed attempt", events)
+	}
+
+	resp = srv.Do(t, "GET", "/p/me", nil)
+	var profile storage.Profile
+	if err := json.NewDecoder(resp.Body).Decode(&profile); err != nil {
+		t.Fatal(err)
+	}
+	if profile.ID != srv.User.ID || profile.LastLoginAt == nil {
+		t.Errorf("profile = %+v, want last_login_at set", profile)
+	}
+}
+
+func TestAPI_CompressedRequests(t *testing.T) {
+	srv := apitest.NewServer(t, apitest.WithAPIOptions(api.WithCompression(0, 4<<10)))
+
+	gz := func(b []byte) *bytes.Buffer {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(b)
+		zw.Close()
+		return &buf
+	}
+
+	tests := []struct {
+		name         string
+		encoding     string
+		body         io.Reader
+		expectedCode int
+		wantCode     string
+	}{
+		{
+			name:         "Gzip body",
+			encoding:     "gzip",
+			body:         gz([]byte(`{"username":"gzipped","email":"gzip@example.com","password":"password123"}`)),
+			expectedCode: http.StatusCreated,
+		},
+		{
+			name:         "Zip bomb",
+			encoding:     "gzip",
+			body:         gz(bytes.Repeat([]byte(" "), 64<<20)),
+			expectedCode: http.StatusRequestEntityTooLarge,
+			wantCode:     api.CodePayloadTooLarge,
+		},
+		{
+			name:         "Unsupported encoding",
+			encoding:     "br",
+			body:         strings.NewReader(`{}`),
+			expectedCode: http.StatusUnsupportedMediaType,
+			wantCode:     api.CodeUnsupportedEncoding,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := srv.NewRequest(t, "POST", "/register", tt.body)
+			req.Header.Set("Content-Encoding", tt.encoding)
+			resp, err := srv.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tt.expectedCode {
+				t.Fatalf("handler returned wrong status code: got %v want %v", resp.StatusCode, tt.expectedCode)
+			}
+			if tt.wantCode == "" {
+				return
+			}
+			var body api.ErrorResponse
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Code != tt.wantCode {
+				t.Errorf("error code = %q, want %q", body.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+// BenchmarkLoginUser измеряет полный путь входа через маршрутизатор с
+// хранилищем в памяти. Время определяется bcrypt (DefaultCost = 10,
+// около 52 мс на запрос); при стоимости 12 одна проверка пароля занимает
+// около 210 мс, поэтому задержку входа задает стоимость bcrypt, а не
+// обработчик. Выпуск токена без jwt-go и общий срез Content-Type
+// сократили аллокации с 123 до 100 на запрос (19.1 КБ -> 17.7 КБ).
+func BenchmarkLoginUser(b *testing.B) {
+	srv := apitest.NewServer(b)
+	h := srv.API.Router()
+	payload := `{"email":"` + srv.User.Email + `","password":"` + apitest.DefaultPassword + `"}`
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest("POST", "/login", strings.NewReader(payload)))
+		if rr.Code != http.StatusOK {
+			b.Fatalf("login status = %d", rr.Code)
+		}
+	}
+}
+
+func TestAPI_Discovery(t *testing.T) {
+	policy := api.Policy{PasswordMinLength: 10, CodeMaxLength: 12, CodeMaxLifetime: 30 * 24 * time.Hour}
+	srv := apitest.NewServer(t, apitest.WithAPIOptions(
+		api.WithPolicy(policy),
+		api.WithPagination(pagination.Defaults{Limit: 10, MaxLimit: 75}),
+		api.WithRegistration(api.Registration{Open: true}),
+	))
+
+	// правила доступны без токена
+	resp, err := http.Get(srv.URL + "/.well-known/gorefer-configuration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var got api.Discovery
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	want := api.Discovery{
+		APIVersion:   api.APIVersion,
+		Password:     api.PasswordRules{MinLength: 10},
+		ReferralCode: api.ReferralCodeRules{MaxLength: 12, MaxLifetimeDays: 30},
+		Registration: api.Registration{Open: true},
+		MaxPageSize:  75,
+	}
+	if resp.StatusCode != http.StatusOK || got != want {
+		t.Fatalf("GET /.well-known/gorefer-configuration = %d %+v, want 200 %+v", resp.StatusCode, got, want)
+	}
+
+	// опубликованные значения совпадают с проверяемыми при запросах
+	expiresAt := time.Now().Add(time.Hour).Unix()
+	tests := []struct {
+		name string
+		path string
+		body string
+		want int
+	}{
+		{"Password below minimum", "/register", `{"username":"short","email":"short@example.com","password":"` + strings.Repeat("p", got.Password.MinLength-1) + `"}`, http.StatusUnprocessableEntity},
+		{"Password at minimum", "/register", `{"username":"exact","email":"exact@example.com","password":"` + strings.Repeat("p", got.Password.MinLength) + `"}`, http.StatusCreated},
+		{"Code above maximum", "/p/referral-code", fmt.Sprintf(`{"user_id":%d,"code":"%s","expires_at":%d}`, srv.User.ID, strings.Repeat("C", got.ReferralCode.MaxLength+1), expiresAt), http.StatusBadRequest},
+		{"Code at maximum", "/p/referral-code", fmt.Sprintf(`{"user_id":%d,"code":"%s","expires_at":%d}`, srv.User.ID, strings.Repeat("C", got.ReferralCode.MaxLength), expiresAt), http.StatusCreated},
+		{"Lifetime above maximum", "/p/referral-code", fmt.Sprintf(`{"user_id":%d,"code":"LONG","expires_at":%d}`, srv.User.ID, time.Now().AddDate(0, 0, got.ReferralCode.MaxLifetimeDays).Add(time.Minute).Unix()), http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := srv.Do(t, "POST", tt.path, strings.NewReader(tt.body))
+			if resp.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+func TestAPI_ReferralChainDepth(t *testing.T) {
+	srv := apitest.NewServer(t)
+	srv.Store.SetChainDepth(storage.ChainDepth{Max: 3, Alert: 2})
+	ctx := context.Background()
+
+	// цепочка srv.User -> chain1 -> chain2 -> chain3, у каждого звена свой код
+	referrerID := srv.User.ID
+	for depth := 1; depth <= 3; depth++ {
+		code := fmt.Sprintf("CHAIN%d", depth-1)
+		if err := srv.Store.CreateReferralCode(ctx, referrerID, code, 1893456000, "", nil, storage.DomainRestriction{}); err != nil {
+			t.Fatal(err)
+		}
+		reg, err := srv.Store.RegisterWithReferralCode(ctx, code, storage.CreateUserParams{User: storage.User{
+			Username: fmt.Sprintf("chain%d", depth), Email: fmt.Sprintf("chain%d@example.com", depth), Password: "x",
+		}})
+		if err != nil {
+			t.Fatalf("depth %d: %v", depth, err)
+		}
+		referrerID = reg.UserID
+	}
+	links := srv.Store.Links()
+	for i, l := range links {
+		if l.Depth != i+1 {
+			t.Errorf("link %d -> %d depth = %d, want %d", l.ReferrerID, l.RefereeID, l.Depth, i+1)
+		}
+	}
+	if err := srv.Store.CreateReferralCode(ctx, referrerID, "CHAIN3", 1893456000, "", nil, storage.DomainRestriction{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// четвертое звено отклоняется, код не расходуется
+	resp := srv.Do(t, "POST", "/register-with-referral", strings.NewReader(
+		`{"referral_code":"CHAIN3","user":{"username":"chain4","email":"chain4@example.com","password":"secret1"}}`))
+	var body api.ErrorResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusUnprocessableEntity || body.Code != api.CodeReferralChainTooDeep {
+		t.Fatalf("status = %d, code = %q, want 422 %s", resp.StatusCode, body.Code, api.CodeReferralChainTooDeep)
+	}
+	if n := len(srv.Store.Links()); n != len(links) {
+		t.Errorf("links after rejected signup = %d, want %d", n, len(links))
+	}
+	if details, err := srv.Store.GetReferralCodeDetails(ctx, "CHAIN3"); err != nil || details.Uses != 0 {
+		t.Errorf("CHAIN3 uses = %d, %v, want 0", details.Uses, err)
+	}
+	if exists, _ := srv.Store.EmailExists(ctx, "chain4@example.com"); exists {
+		t.Error("rejected signup created the user")
+	}
+
+	// по ссылке реферера на пределе пользователь регистрируется без реферала
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(srv.URL + "/r/CHAIN3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	var cookie *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == "gorefer_ref" {
+			cookie = c
+		}
+	}
+	if cookie == nil {
+		t.Fatal("no attribution cookie")
+	}
+	req, err := http.NewRequest("POST", srv.URL+"/register", strings.NewReader(`{"username":"viaLink","email":"vialink@example.com","password":"secret1"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(cookie)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || len(srv.Store.Links()) != len(links) {
+		t.Errorf("attributed signup = %d with %d links, want 201 without a new link", resp.StatusCode, len(srv.Store.Links()))
+	}
+}
+
+func TestAPI_RedeemReward(t *testing.T) {
+	srv := apitest.NewServer(t)
+	srv.Store.AddReward(srv.User.ID, 999, 300)
+
+	tests := []struct {
+		name        string
+		body        string
+		wantStatus  int
+		wantCode    string
+		wantBalance int64
+	}{
+		{"Zero amount", `{"amount":0}`, http.StatusBadRequest, api.CodeInvalidPayload, 300},
+		{"Negative amount", `{"amount":-50}`, http.StatusBadRequest, api.CodeInvalidPayload, 300},
+		{"Note too long", `{"amount":10,"note":"` + strings.Repeat("n", 501) + `"}`, http.StatusBadRequest, api.CodeInvalidPayload, 300},
+		{"Above balance", `{"amount":301}`, http.StatusConflict, api.CodeInsufficientBalance, 300},
+		{"Partial", `{"amount":120,"note":"gift card"}`, http.StatusCreated, "", 180},
+		{"Rest of balance", `{"amount":180}`, http.StatusCreated, "", 0},
+		{"Empty balance", `{"amount":1}`, http.StatusConflict, api.CodeInsufficientBalance, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := srv.Do(t, "POST", "/p/rewards/redeem", strings.NewReader(tt.body))
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if tt.wantCode != "" {
+				var body api.ErrorResponse
+				if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.Code != tt.wantCode {
+					t.Errorf("error code = %q, %v, want %s", body.Code, err, tt.wantCode)
+				}
+			} else {
+				var redemption storage.Redemption
+				if err := json.NewDecoder(resp.Body).Decode(&redemption); err != nil {
+					t.Fatal(err)
+				}
+				if redemption.BalanceAfter != tt.wantBalance || redemption.Amount >= 0 {
+					t.Errorf("redemption = %+v, want negative amount and balance %d", redemption, tt.wantBalance)
+				}
+			}
+
+			var stats storage.ReferralStats
+			if err := json.NewDecoder(srv.Do(t, "GET", "/p/stats", nil).Body).Decode(&stats); err != nil {
+				t.Fatal(err)
+			}
+			if stats.Balance != tt.wantBalance || stats.RewardTotal != 300 {
+				t.Errorf("stats balance = %d, total = %d, want %d, 300", stats.Balance, stats.RewardTotal, tt.wantBalance)
+			}
+		})
+	}
+
+	admin := apitest.NewServer(t, apitest.WithAdmin())
+	admin.Store.AddReward(admin.User.ID, 998, 50)
+	if resp := admin.Do(t, "POST", "/p/rewards/redeem", strings.NewReader(`{"amount":20,"note":"admin"}`)); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("admin redeem status = %d", resp.StatusCode)
+	}
+	var redemptions []storage.Redemption
+	resp := admin.Do(t, "GET", fmt.Sprintf("/admin/rewards/redemptions?user_id=%d", admin.User.ID), nil)
+	if err := json.NewDecoder(resp.Body).Decode(&redemptions); err != nil {
+		t.Fatal(err)
+	}
+	if len(redemptions) != 1 || redemptions[0].Amount != -20 || redemptions[0].Note != "admin" {
+		t.Errorf("redemptions = %+v, want one of -20", redemptions)
+	}
+	if resp := admin.Do(t, "GET", "/admin/rewards/redemptions?user_id=abc", nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid user_id status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+	if resp := srv.Do(t, "GET", "/admin/rewards/redemptions", nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("non-admin status = %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+}
+
+func TestAPI_RedeemRewardConcurrent(t *testing.T) {
+	srv := apitest.NewServer(t)
+	srv.Store.AddReward(srv.User.ID, 999, 1000)
+
+	// 20 списаний по 70 при балансе 1000: проходят ровно 14
+	const workers = 20
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		statuses = map[int]int{}
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := srv.NewRequest(t, "POST", "/p/rewards/redeem", strings.NewReader(`{"amount":70}`))
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+			mu.Lock()
+			statuses[resp.StatusCode]++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if statuses[http.StatusCreated] != 14 || statuses[http.StatusConflict] != 6 {
+		t.Errorf("statuses = %v, want 14 created and 6 conflicts", statuses)
+	}
+	stats, err := srv.Store.GetReferralStats(context.Background(), srv.User.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Balance != 20 {
+		t.Errorf("balance = %d, want 20", stats.Balance)
+	}
+}
+
+// timingPhases разбирает заголовок Server-Timing в имена этапов по
+// порядку; длительности должны быть неотрицательными числами.
+func timingPhases(t *testing.T, header string) []string {
+	t.Helper()
+	if header == "" {
+		return nil
+	}
+	var names []string
+	for _, metric := range strings.Split(header, ", ") {
+		name, dur, ok := strings.Cut(metric, ";dur=")
+		if !ok {
+			t.Fatalf("metric %q has no duration", metric)
+		}
+		if ms, err := strconv.ParseFloat(dur, 64); err != nil || ms < 0 {
+			t.Fatalf("metric %q duration = %v, %v", metric, ms, err)
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+func TestAPI_ServerTiming(t *testing.T) {
+	signup := func(i int) string {
+		return fmt.Sprintf(`{"username":"timed%d","email":"timed%d@example.com","password":"secret1"}`, i, i)
+	}
+	login := func(srv *apitest.Server) string {
+		return `{"email":"` + srv.User.Email + `","password":"` + apitest.DefaultPassword + `"}`
+	}
+
+	tests := []struct {
+		name    string
+		opts    []apitest.Option
+		path    string
+		body    func(srv *apitest.Server) string
+		token   bool // запрос с токеном srv.User
+		debug   bool // запрос с DebugHeader
+		want    []string
+		wantSts int
+	}{
+		{"Off by default", nil, "/register", func(*apitest.Server) string { return signup(1) }, false, false, nil, http.StatusCreated},
+		{"Header without token", nil, "/register", func(*apitest.Server) string { return signup(2) }, false, true, nil, http.StatusCreated},
+		{"Header from regular user", nil, "/login", login, true, true, nil, http.StatusOK},
+		{"Admin token without header", []apitest.Option{apitest.WithAdmin()}, "/login", login, true, false, nil, http.StatusOK},
+		{"Admin login", []apitest.Option{apitest.WithAdmin()}, "/login", login, true, true, []string{"deadline", "decode", "db", "hash", "encode"}, http.StatusOK},
+		{"Admin wrong password", []apitest.Option{apitest.WithAdmin()}, "/login", func(srv *apitest.Server) string {
+			return `{"email":"` + srv.User.Email + `","password":"wrong"}`
+		}, true, true, []string{"deadline", "decode", "db", "hash", "encode"}, http.StatusUnauthorized},
+		{"Config flag, signup", []apitest.Option{apitest.WithAPIOptions(api.WithServerTiming(true))}, "/register",
+			func(*apitest.Server) string { return signup(3) }, false, false, []string{"deadline", "decode", "validate", "hash", "db", "encode"}, http.StatusCreated},
+		{"Config flag, referral signup", []apitest.Option{apitest.WithAPIOptions(api.WithServerTiming(true))}, "/register-with-referral",
+			func(*apitest.Server) string { return `{"user":` + signup(4) + `}` }, false, false, []string{"deadline", "decode", "validate", "hash", "db", "encode"}, http.StatusCreated},
+		{"Config flag, invalid payload", []apitest.Option{apitest.WithAPIOptions(api.WithServerTiming(true))}, "/register",
+			func(*apitest.Server) string { return `{` }, false, false, []string{"deadline", "decode", "encode"}, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := apitest.NewServer(t, tt.opts...)
+			req := srv.NewRequest(t, "POST", tt.path, strings.NewReader(tt.body(srv)))
+			if !tt.token {
+				req.Header.Del("Authorization")
+			}
+			if tt.debug {
+				req.Header.Set(api.DebugHeader, api.DebugTiming)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.wantSts {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.wantSts, body)
+			}
+			if !json.Valid(body) {
+				t.Errorf("body is not JSON: %q", body)
+			}
+			if got := timingPhases(t, resp.Header.Get("Server-Timing")); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Server-Timing phases = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAPI_TermsAcceptance(t *testing.T) {
+	srv := apitest.NewServer(t, apitest.WithAPIOptions(api.WithTermsVersion("2026-01")))
+	srv.Store.SetTermsVersion("2026-01")
+
+	do := func(t *testing.T, base, method, path, payload string) *http.Response {
+		t.Helper()
+		var body io.Reader
+		if payload != "" {
+			body = strings.NewReader(payload)
+		}
+		req := srv.NewRequest(t, method, path, body)
+		req.URL.Host = strings.TrimPrefix(base, "http://")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	createCode := func(t *testing.T, base, code string) *http.Response {
+		return do(t, base, "POST", "/p/referral-code", fmt.Sprintf(`{"user_id":%d,"code":%q,"expires_at":%d}`, srv.User.ID, code, codeExpiresAt))
+	}
+	register := func(t *testing.T, base, code, email string) *http.Response {
+		return do(t, base, "POST", "/register-with-referral", fmt.Sprintf(
+			`{"referral_code":%q,"user":{"username":%q,"email":%q,"password":"password123"}}`, code, strings.Split(email, "@")[0], email))
+	}
+	wantError := func(t *testing.T, resp *http.Response, status int, code string) {
+		t.Helper()
+		if resp.StatusCode != status {
+			t.Fatalf("status = %d, want %d", resp.StatusCode, status)
+		}
+		var body api.ErrorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Code != code {
+			t.Errorf("error code = %q, want %q", body.Code, code)
+		}
+	}
+
+	wantError(t, createCode(t, srv.URL, "TERMS1"), http.StatusPreconditionRequired, api.CodeTermsNotAccepted)
+
+	resp := do(t, srv.URL, "POST", "/p/terms/accept", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /p/terms/accept = %d, want 200", resp.StatusCode)
+	}
+	var acceptance storage.TermsAcceptance
+	if err := json.NewDecoder(resp.Body).Decode(&acceptance); err != nil {
+		t.Fatal(err)
+	}
+	if acceptance.Version != "2026-01" || acceptance.AcceptedAt.IsZero() {
+		t.Errorf("acceptance = %+v, want version 2026-01 with a timestamp", acceptance)
+	}
+	if resp := createCode(t, srv.URL, "TERMS1"); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create after acceptance = %d, want 201", resp.StatusCode)
+	}
+	if resp := register(t, srv.URL, "TERMS1", "before@example.com"); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("referral signup after acceptance = %d, want 201", resp.StatusCode)
+	}
+
+	// новая версия условий снова закрывает создание кодов, а код реферера
+	// перестает действовать, пока он не примет условия заново
+	bumped := api.New(srv.Store, api.WithTermsVersion("2026-02"))
+	srv.Store.SetTermsVersion("2026-02")
+	next := httptest.NewServer(bumped.Router())
+	t.Cleanup(next.Close)
+
+	wantError(t, createCode(t, next.URL, "TERMS2"), http.StatusPreconditionRequired, api.CodeTermsNotAccepted)
+	wantError(t, register(t, next.URL, "TERMS1", "after@example.com"), http.StatusUnprocessableEntity, api.CodeReferralCodeInvalid)
+
+	if resp := do(t, next.URL, "POST", "/p/terms/accept", ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /p/terms/accept = %d, want 200", resp.StatusCode)
+	}
+	if resp := createCode(t, next.URL, "TERMS2"); resp.StatusCode != http.StatusCreated {
+		t.Errorf("create after re-acceptance = %d, want 201", resp.StatusCode)
+	}
+	// код TERMS2 заменил TERMS1
+	if resp := register(t, next.URL, "TERMS2", "after@example.com"); resp.StatusCode != http.StatusCreated {
+		t.Errorf("referral signup after re-acceptance = %d, want 201", resp.StatusCode)
+	}
+
+	t.Run("Disabled without version", func(t *testing.T) {
+		srv := apitest.NewServer(t)
+		if resp := srv.Do(t, "POST", "/p/terms/accept", nil); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("POST /p/terms/accept = %d, want 404", resp.StatusCode)
+		}
+	})
+}
+
+func TestAPI_PanicRecovered(t *testing.T) {
+	apiHandler := api.New(apitest.NewStore())
+	router := apiHandler.Router()
+	router.Get("/test/panic", func(w http.ResponseWriter, r *http.Request) {
+		panic("broken handler")
+	})
+	router.Get("/test/panic-after-write", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("partial"))
+		panic("broken stream")
+	})
+
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+		wantBody   string // пусто - ответ в общем формате ошибок
+	}{
+		{"Before writing", "/test/panic", http.StatusInternalServerError, ""},
+		{"After partial write", "/test/panic-after-write", http.StatusOK, "partial"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, httptest.NewRequest("GET", tt.path, nil))
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rr.Code, tt.wantStatus)
+			}
+			if tt.wantBody != "" {
+				if rr.Body.String() != tt.wantBody {
+					t.Errorf("body = %q, want %q untouched", rr.Body.String(), tt.wantBody)
+				}
+				return
+			}
+			var body api.ErrorResponse
+			if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+				t.Fatalf("body %q is not an error envelope: %v", rr.Body.String(), err)
+			}
+			if body.Code != api.CodeInternalPanic || body.Error == "" {
+				t.Errorf("error = %+v, want %s with a message", body, api.CodeInternalPanic)
+			}
+		})
+	}
+
+	want := api.PanicCounts{"GET /test/panic": 1, "GET /test/panic-after-write": 1}
+	if got := apiHandler.PanicCounts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("panic counts = %v, want %v", got, want)
+	}
+}
+
+func TestAPI_Cohorts(t *testing.T) {
+	srv := apitest.NewServer(t, apitest.WithAdmin())
+	ctx := context.Background()
+	now := time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+	srv.Store.SetNow(func() time.Time { return now })
+
+	if err := srv.Store.CreateReferralCode(ctx, srv.User.ID, "COHORT", 1893456000, "", nil, storage.DomainRestriction{}); err != nil {
+		t.Fatal(err)
+	}
+	refer := func(name string) int {
+		t.Helper()
+		reg, err := srv.Store.RegisterWithReferralCode(ctx, "COHORT", storage.CreateUserParams{User: storage.User{Username: name, Email: name + "@example.com"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reg.UserID
+	}
+	createCode := func(userID int, code string) {
+		t.Helper()
+		if err := srv.Store.CreateReferralCode(ctx, userID, code, 1893456000, "", nil, storage.DomainRestriction{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// январь: четверо приглашенных, один создал код вовремя, один - поздно
+	jan := []int{refer("jan1"), refer("jan2"), refer("jan3"), refer("jan4")}
+	now = now.AddDate(0, 0, 10)
+	createCode(jan[0], "JAN1")
+	// февраль: двое приглашенных, один создал код на следующий день
+	now = time.Date(2024, 2, 5, 0, 0, 0, 0, time.UTC)
+	feb := []int{refer("feb1"), refer("feb2")}
+	now = now.AddDate(0, 0, 1)
+	createCode(feb[0], "FEB1")
+	now = time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	createCode(jan[1], "JAN2") // через 50 дней после приглашения
+
+	get := func(t *testing.T, query string) (int, api.CohortReport) {
+		t.Helper()
+		resp := srv.Do(t, "GET", "/admin/cohorts?"+query, nil)
+		var report api.CohortReport
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode, report
+	}
+
+	tests := []struct {
+		name        string
+		query       string
+		wantStatus  int
+		wantCohorts []storage.CohortStat
+	}{
+		{"Range", "from=2024-01&to=2024-03", http.StatusOK, []storage.CohortStat{
+			{Month: "2024-01", Referred: 4, Converted: 1, ConversionRate: 0.25},
+			{Month: "2024-02", Referred: 2, Converted: 1, ConversionRate: 0.5},
+		}},
+		{"Single month", "month=2024-02", http.StatusOK, []storage.CohortStat{
+			{Month: "2024-02", Referred: 2, Converted: 1, ConversionRate: 0.5},
+		}},
+		{"No referrals", "month=2023-12", http.StatusOK, []storage.CohortStat{}},
+		{"Bad month", "month=2024-13", http.StatusBadRequest, nil},
+		{"Month with range", "month=2024-01&from=2024-01&to=2024-02", http.StatusBadRequest, nil},
+		{"Reversed range", "from=2024-03&to=2024-01", http.StatusBadRequest, nil},
+		{"Too long", "from=2022-01&to=2024-01", http.StatusBadRequest, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, report := get(t, tt.query)
+			if status != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", status, tt.wantStatus)
+			}
+			if status == http.StatusOK && !reflect.DeepEqual(report.Cohorts, tt.wantCohorts) {
+				t.Errorf("cohorts = %+v, want %+v", report.Cohorts, tt.wantCohorts)
+			}
+		})
+	}
+
+	// повторный запрос в течение часа отдается из кэша
+	_, before := get(t, "month=2024-02")
+	createCode(feb[1], "FEB2")
+	_, after := get(t, "month=2024-02")
+	if !reflect.DeepEqual(after, before) {
+		t.Errorf("cached report = %+v, want %+v", after, before)
+	}
+}
+
+func TestAPI_RequestTimeoutHint(t *testing.T) {
+	srv := apitest.NewServer(t, apitest.WithAdmin(), apitest.WithAPIOptions(api.WithTimeouts(api.Timeouts{Auth: 2 * time.Second, AuthMax: 10 * time.Second})))
+	login := `{"email":"` + srv.User.Email + `","password":"` + apitest.DefaultPassword + `"}`
+
+	tests := []struct {
+		name         string
+		header       string
+		wantStatus   int
+		wantDeadline string // значение этапа deadline в Server-Timing
+	}{
+		{"Without hint", "", http.StatusOK, "deadline;dur=2000"},
+		{"Longer than budget", "8", http.StatusOK, "deadline;dur=8000"},
+		{"Above ceiling", "60", http.StatusOK, "deadline;dur=10000"},
+		{"Below floor", "0.1", http.StatusOK, "deadline;dur=500"},
+		{"Unparsable", "ten", http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := srv.NewRequest(t, "POST", "/login", strings.NewReader(login))
+			req.Header.Set(api.DebugHeader, api.DebugTiming)
+			if tt.header != "" {
+				req.Header.Set(middlware.RequestTimeoutHeader, tt.header)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusBadRequest {
+				var body api.ErrorResponse
+				if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+					t.Fatal(err)
+				}
+				if body.Code != api.CodeInvalidRequestTimeout {
+					t.Errorf("error code = %q, want %q", body.Code, api.CodeInvalidRequestTimeout)
+				}
+				return
+			}
+			if got := strings.Split(resp.Header.Get("Server-Timing"), ", ")[0]; got != tt.wantDeadline {
+				t.Errorf("Server-Timing deadline = %q, want %q", got, tt.wantDeadline)
+			}
+		})
+	}
+}
+
+func TestAPI_TransferReferralCode(t *testing.T) {
+	srv := apitest.NewServer(t, apitest.WithAdmin())
+	ctx := context.Background()
+	newUser := func(name string) int {
+		t.Helper()
+		id, err := srv.Store.CreateUser(ctx, storage.CreateUserParams{User: storage.User{Username: name, Email: name + "@example.com"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	newCode := func(userID int, code string) {
+		t.Helper()
+		if err := srv.Store.CreateReferralCode(ctx, userID, code, 1893456000, "", nil, storage.DomainRestriction{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// у уходящего сотрудника двое приглашенных по коду PARTNER и один по
+	// старому коду; за каждого начислено 100
+	leaver, heir, busy := newUser("leaver"), newUser("heir"), newUser("busy")
+	newCode(leaver, "PARTNER")
+	newCode(busy, "BUSY")
+	for i, code := range []string{"PARTNER", "PARTNER", "OLD"} {
+		referee := newUser(fmt.Sprintf("referee%d", i))
+		srv.Store.AddLink(apitest.Link{ReferrerID: leaver, RefereeID: referee, Code: code, Depth: 1})
+		srv.Store.AddReward(leaver, referee, 100)
+	}
+
+	transfer := func(t *testing.T, code, query string, newOwnerID int) *http.Response {
+		t.Helper()
+		return srv.Do(t, "POST", "/admin/referral-codes/"+code+"/transfer"+query,
+			strings.NewReader(fmt.Sprintf(`{"new_owner_id":%d}`, newOwnerID)))
+	}
+	wantError := func(t *testing.T, resp *http.Response, status int, code string) {
+		t.Helper()
+		defer resp.Body.Close()
+		var body api.ErrorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != status || body.Code != code {
+			t.Errorf("response = %d %s, want %d %s", resp.StatusCode, body.Code, status, code)
+		}
+	}
+
+	t.Run("Rejected", func(t *testing.T) {
+		wantError(t, transfer(t, "PARTNER", "", busy), http.StatusConflict, api.CodeNewOwnerHasCode)
+		wantError(t, transfer(t, "PARTNER", "", leaver), http.StatusConflict, api.CodeTransferInvalid)
+		wantError(t, transfer(t, "PARTNER", "", 9999), http.StatusNotFound, api.CodeUserNotFound)
+		wantError(t, transfer(t, "NOPE", "", heir), http.StatusNotFound, api.CodeReferralCodeNotFound)
+		wantError(t, transfer(t, "PARTNER", "?include_history=maybe", heir), http.StatusBadRequest, api.CodeInvalidParameter)
+		wantError(t, transfer(t, "PARTNER", "", 0), http.StatusBadRequest, api.CodeInvalidPayload)
+	})
+
+	t.Run("Redeemed rewards stay", func(t *testing.T) {
+		spender, referee, heir := newUser("spender"), newUser("spent"), newUser("heir2")
+		newCode(spender, "SPENT")
+		srv.Store.AddLink(apitest.Link{ReferrerID: spender, RefereeID: referee, Code: "SPENT", Depth: 1})
+		srv.Store.AddReward(spender, referee, 100)
+		if _, err := srv.Store.RedeemReward(ctx, spender, 60, "payout"); err != nil {
+			t.Fatal(err)
+		}
+		wantError(t, transfer(t, "SPENT", "?include_history=true", heir), http.StatusConflict, api.CodeTransferBalance)
+		wantError(t, transfer(t, "SPENT", "?include_history=true", referee), http.StatusConflict, api.CodeTransferInvalid)
+	})
+
+	t.Run("With history", func(t *testing.T) {
+		resp := transfer(t, "PARTNER", "?include_history=true", heir)
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d, want 200", resp.StatusCode)
+		}
+		var got storage.CodeTransfer
+		if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		want := storage.CodeTransfer{
+			Code: "PARTNER", FromUserID: leaver, ToUserID: heir, IncludeHistory: true,
+			LinksMoved: 2, RewardsMoved: 2, AmountMoved: 200,
+		}
+		if got != want {
+			t.Errorf("transfer = %+v, want %+v", got, want)
+		}
+
+		if c, err := srv.Store.GetReferralCodeByUserID(ctx, heir); err != nil || c.Code != "PARTNER" {
+			t.Errorf("heir code = %+v, %v, want PARTNER", c, err)
+		}
+		for who, want := range map[int][2]int64{leaver: {1, 100}, heir: {2, 200}} {
+			stats, err := srv.Store.GetReferralStats(ctx, who)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.Referrals != int(want[0]) || stats.Balance != want[1] {
+				t.Errorf("user %d stats = %+v, want %d referrals and balance %d", who, stats, want[0], want[1])
+			}
+		}
+		audit := srv.Store.AuditLog(leaver)
+		if len(audit) != 1 || audit[0].Action != storage.AuditCodeTransferred || *audit[0].ActorID != srv.User.ID {
+			t.Errorf("audit = %+v, want one transfer by the admin", audit)
+		}
+	})
+}
+
+func TestAPI_ErrorCodes(t *testing.T) {
+	srv := apitest.NewServer(t)
+
+	get := func() []byte {
+		t.Helper()
+		// каталог доступен без токена
+		resp, err := http.Get(srv.URL + "/v1/meta/error-codes")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET /v1/meta/error-codes = %d, want 200", resp.StatusCode)
+		}
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return body
+	}
+
+	first := get()
+	var codes []api.ErrorCodeInfo
+	if err := json.Unmarshal(first, &codes); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(codes, api.ErrorCodes()) {
+		t.Error("GET /v1/meta/error-codes differs from api.ErrorCodes()")
+	}
+	for _, c := range codes {
+		if c.Code == api.CodeReferralCodeNotFound && (c.Status != http.StatusNotFound || c.Messages["ru"] == "") {
+			t.Errorf("%s = %+v, want 404 with a Russian message", c.Code, c)
+		}
+	}
+	// вывод побайтно стабилен, чтобы его можно было сравнивать diff
+	for i := 0; i < 5; i++ {
+		if again := get(); !bytes.Equal(again, first) {
+			t.Fatalf("response %d differs from the first one", i+2)
+		}
+	}
+}
+
+func TestAPI_Widget(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDB := storage.NewMockDBInterface(ctrl)
+	apiHandler := api.New(mockDB, api.WithWidget(api.Widget{
+		Origins:     []string{"https://partner.example"},
+		BaseURL:     "https://gorefer.example.com/",
+		MaxRequests: 3,
+	}))
+	maxUses := 10
+	details := func(code string, expiresAt time.Time) storage.ReferralCodeDetails {
+		return storage.ReferralCodeDetails{
+			ReferralCode:  storage.ReferralCode{ID: 5, UserID: 7, Code: code, ExpiresAt: expiresAt, Uses: 4},
+			Status:        storage.CodeStatusActive,
+			OwnerUsername: "alice",
+			OwnerEmail:    "alice@example.com",
+			MaxUses:       &maxUses,
+		}
+	}
+	// повторные запросы берут код из кэша
+	mockDB.EXPECT().GetReferralCodeDetails(gomock.Any(), "ALICE").Return(details("ALICE", time.Now().Add(time.Hour)), nil).Times(1)
+	mockDB.EXPECT().GetReferralCodeDetails(gomock.Any(), "OLD").Return(details("OLD", time.Now().Add(-time.Hour)), nil).Times(1)
+
+	do := func(method, code, origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/widget/"+code, nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		rr := httptest.NewRecorder()
+		apiHandler.Router().ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("Active", func(t *testing.T) {
+		rr := do("GET", "ALICE", "https://partner.example")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200", rr.Code)
+		}
+		if got := rr.Header().Get("Access-Control-Allow-Origin"); got != "https://partner.example" {
+			t.Errorf("Access-Control-Allow-Origin = %q, want the partner origin", got)
+		}
+		if got := rr.Header().Get("Cache-Control"); !strings.HasPrefix(got, "public, max-age=") {
+			t.Errorf("Cache-Control = %q, want a public max-age", got)
+		}
+		for _, leak := range []string{"alice@example.com", `"id"`, "user_id"} {
+			if strings.Contains(rr.Body.String(), leak) {
+				t.Errorf("body %s exposes %s", rr.Body.String(), leak)
+			}
+		}
+		var got api.WidgetData
+		if err := json.NewDecoder(rr.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got.State != api.WidgetActive || got.DisplayName != "alice" || got.RemainingUses == nil || *got.RemainingUses != 6 ||
+			got.SignupURL != "https://gorefer.example.com/r/ALICE" {
+			t.Errorf("widget = %+v, want active alice with 6 uses left and a signup URL", got)
+		}
+	})
+
+	t.Run("Unknown origin", func(t *testing.T) {
+		rr := do("GET", "ALICE", "https://evil.example")
+		if rr.Code != http.StatusOK || rr.Header().Get("Access-Control-Allow-Origin") != "" {
+			t.Errorf("response = %d with Access-Control-Allow-Origin %q, want 200 without it",
+				rr.Code, rr.Header().Get("Access-Control-Allow-Origin"))
+		}
+	})
+
+	t.Run("Preflight", func(t *testing.T) {
+		rr := do("OPTIONS", "ALICE", "https://partner.example")
+		if rr.Code != http.StatusNoContent {
+			t.Fatalf("status = %d, want 204", rr.Code)
+		}
+		if rr.Header().Get("Access-Control-Allow-Origin") != "https://partner.example" ||
+			!strings.Contains(rr.Header().Get("Access-Control-Allow-Methods"), "GET") {
+			t.Errorf("preflight headers = %v", rr.Header())
+		}
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		rr := do("GET", "OLD", "https://partner.example")
+		if rr.Code != http.StatusGone {
+			t.Fatalf("status = %d, want 410", rr.Code)
+		}
+		var got api.WidgetData
+		if err := json.NewDecoder(rr.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got.State != api.WidgetExpired || got.SignupURL != "" {
+			t.Errorf("widget = %+v, want expired without a signup URL", got)
+		}
+	})
+
+	t.Run("Rate limited", func(t *testing.T) {
+		if rr := do("GET", "ALICE", ""); rr.Code != http.StatusOK {
+			t.Fatalf("third request = %d, want 200", rr.Code)
+		}
+		rr := do("GET", "ALICE", "")
+		if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") == "" {
+			t.Errorf("fourth request = %d with Retry-After %q, want 429 with it", rr.Code, rr.Header().Get("Retry-After"))
+		}
+	})
+}
+
+func TestAPI_APIKeys(t *testing.T) {
+	srv := apitest.NewServer(t, apitest.WithAdmin())
+
+	resp := srv.Do(t, "POST", "/admin/api-keys", strings.NewReader(`{"name":"billing","scopes":["reports:read"]}`))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST /admin/api-keys = %d, want 201", resp.StatusCode)
+	}
+	var created api.APIKeyCreated
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(created.Key, created.Prefix) || len(created.Key) <= len(created.Prefix) {
+		t.Fatalf("created key %q does not start with prefix %q", created.Key, created.Prefix)
+	}
+
+	// запрос сервиса: только ключ, без токена пользователя
+	withKey := func(t *testing.T, method, path, key string) *http.Response {
+		t.Helper()
+		req := srv.NewRequest(t, method, path, nil)
+		req.Header.Del("Authorization")
+		req.Header.Set(api.APIKeyHeader, key)
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	errorCode := func(t *testing.T, resp *http.Response) string {
+		t.Helper()
+		var body api.ErrorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		return body.Code
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		key      string
+		wantCode int
+		wantErr  string
+	}{
+		{"Scope granted", "GET", "/admin/cohorts?month=2026-01", created.Key, http.StatusOK, ""},
+		{"Scope missing", "GET", "/admin/referral-codes", created.Key, http.StatusForbidden, api.CodeAPIKeyScopeMissing},
+		{"Unknown key", "GET", "/admin/cohorts?month=2026-01", "grk_nope", http.StatusUnauthorized, api.CodeAPIKeyInvalid},
+		// управление ключами и прочие маршруты - только с токеном администратора
+		{"Route without scope", "POST", "/admin/api-keys", created.Key, http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := withKey(t, tt.method, tt.path, tt.key)
+			if resp.StatusCode != tt.wantCode {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.wantCode)
+			}
+			if tt.wantErr != "" {
+				if code := errorCode(t, resp); code != tt.wantErr {
+					t.Errorf("error code = %q, want %q", code, tt.wantErr)
+				}
+			}
+		})
+	}
+
+	// в списке нет самого ключа, но видно время использования
+	resp = srv.Do(t, "GET", "/admin/api-keys", nil)
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(body), created.Key) {
+		t.Error("GET /admin/api-keys exposes the plaintext key")
+	}
+	var keys []storage.APIKey
+	if err := json.Unmarshal(body, &keys); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].LastUsedAt == nil || keys[0].RevokedAt != nil {
+		t.Errorf("keys = %+v, want one used, active key", keys)
+	}
+
+	// отзыв действует со следующего же запроса
+	path := fmt.Sprintf("/admin/api-keys/%d", created.ID)
+	if resp := srv.Do(t, "DELETE", path, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("DELETE %s = %d, want 204", path, resp.StatusCode)
+	}
+	resp = withKey(t, "GET", "/admin/cohorts?month=2026-01", created.Key)
+	if resp.StatusCode != http.StatusUnauthorized || errorCode(t, resp) != api.CodeAPIKeyInvalid {
+		t.Errorf("request after revocation = %d, want 401 %s", resp.StatusCode, api.CodeAPIKeyInvalid)
+	}
+	if resp := srv.Do(t, "DELETE", path, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("second DELETE %s = %d, want 404", path, resp.StatusCode)
+	}
+	if audit := srv.Store.AuditLog(0); len(audit) != 2 ||
+		audit[0].Action != storage.AuditAPIKeyCreated || audit[1].Action != storage.AuditAPIKeyRevoked {
+		t.Errorf("audit = %+v, want key creation and revocation", audit)
+	}
+}
+
+func TestAPI_CreateAPIKeyValidation(t *testing.T) {
+	srv := apitest.NewServer(t, apitest.WithAdmin())
+
+	for _, body := range []string{
+		`{"name":"","scopes":["reports:read"]}`,
+		`{"name":"billing","scopes":[]}`,
+		`{"name":"billing","scopes":["users:delete"]}`,
+	} {
+		if resp := srv.Do(t, "POST", "/admin/api-keys", strings.NewReader(body)); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("POST /admin/api-keys %s = %d, want 400", body, resp.StatusCode)
+		}
+	}
+}
+
+func TestAPI_Quotas(t *testing.T) {
+	ctx := context.Background()
+	// за час до сброса суточных квот
+	now := time.Date(2024, 5, 1, 23, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	srv := apitest.NewServer(t, apitest.WithAdmin(), apitest.WithAPIOptions(
+		api.WithQuotas(api.Quotas{CodesPerDay: 2, InvitesPerDay: 1, ActiveCodes: 2}),
+		api.WithMultipleCodes(5),
+		api.WithClock(clock),
+	))
+	srv.Store.SetNow(clock)
+
+	createCode := func(t *testing.T, code string) *http.Response {
+		t.Helper()
+		return srv.Do(t, "POST", "/p/referral-code",
+			strings.NewReader(fmt.Sprintf(`{"user_id":%d,"code":%q,"expires_at":%d}`, srv.User.ID, code, codeExpiresAt)))
+	}
+	register := func(t *testing.T, name string) *http.Response {
+		t.Helper()
+		return srv.Do(t, "POST", "/register-with-referral", strings.NewReader(fmt.Sprintf(
+			`{"referral_code":"INVITE","user":{"username":%q,"email":"%s@example.com","password":"password123"}}`, name, name)))
+	}
+	wantQuota := func(t *testing.T, resp *http.Response, quota string, retryAfter int) {
+		t.Helper()
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusTooManyRequests {
+			t.Fatalf("status = %d, want 429", resp.StatusCode)
+		}
+		var body api.ErrorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Code != api.CodeQuotaExceeded || body.Quota == nil || body.Quota.Name != quota {
+			t.Fatalf("error = %+v, want %s for %s", body, api.CodeQuotaExceeded, quota)
+		}
+		if got := resp.Header.Get("Retry-After"); retryAfter > 0 && got != strconv.Itoa(retryAfter) {
+			t.Errorf("Retry-After = %q, want %d", got, retryAfter)
+		}
+	}
+	wantStatus := func(t *testing.T, resp *http.Response, status int) {
+		t.Helper()
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Fatalf("status = %d, want %d", resp.StatusCode, status)
+		}
+	}
+	limits := func(t *testing.T) map[string]api.QuotaState {
+		t.Helper()
+		resp := srv.Do(t, "GET", "/p/limits", nil)
+		defer resp.Body.Close()
+		var states []api.QuotaState
+		if err := json.NewDecoder(resp.Body).Decode(&states); err != nil {
+			t.Fatal(err)
+		}
+		byName := map[string]api.QuotaState{}
+		for _, s := range states {
+			byName[s.Name] = s
+		}
+		return byName
+	}
+
+	t.Run("codes_per_day resets at midnight UTC", func(t *testing.T) {
+		wantStatus(t, createCode(t, "DAY1"), http.StatusCreated)
+		wantStatus(t, createCode(t, "DAY2"), http.StatusCreated)
+		wantQuota(t, createCode(t, "DAY3"), api.QuotaCodesPerDay, 3600)
+
+		q := limits(t)[api.QuotaCodesPerDay]
+		if q.Used != 2 || q.Remaining == nil || *q.Remaining != 0 || q.ResetAt == nil || !q.ResetAt.Equal(time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC)) {
+			t.Errorf("codes_per_day = %+v, want used 2, none remaining, reset at midnight", q)
+		}
+
+		now = time.Date(2024, 5, 1, 23, 59, 59, 0, time.UTC)
+		wantQuota(t, createCode(t, "DAY3"), api.QuotaCodesPerDay, 1)
+		now = time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC)
+		// суточная квота сброшена, но действующих кодов уже два
+		wantQuota(t, createCode(t, "DAY3"), api.QuotaActiveCodes, 0)
+	})
+
+	t.Run("active_codes resets with the next expiry", func(t *testing.T) {
+		if err := srv.Store.AddReferralCode(ctx, storage.NewReferralCode{UserID: srv.User.ID, Code: "SOON", ExpiresAt: now.Add(time.Hour).Unix()}, 5); err != nil {
+			t.Fatal(err)
+		}
+		q := limits(t)[api.QuotaActiveCodes]
+		if q.Used != 3 || q.ResetAt == nil || !q.ResetAt.Equal(now.Add(time.Hour)) {
+			t.Errorf("active_codes = %+v, want 3 used, reset when SOON expires", q)
+		}
+		// код SOON истекает, но остаются два действующих кода
+		now = now.Add(2 * time.Hour)
+		wantQuota(t, createCode(t, "DAY3"), api.QuotaActiveCodes, 0)
+	})
+
+	t.Run("invites_per_day", func(t *testing.T) {
+		if err := srv.Store.AddReferralCode(ctx, storage.NewReferralCode{UserID: srv.User.ID, Code: "INVITE", ExpiresAt: 1893456000}, 10); err != nil {
+			t.Fatal(err)
+		}
+		wantStatus(t, register(t, "invited1"), http.StatusCreated)
+		wantQuota(t, register(t, "invited2"), api.QuotaInvitesPerDay, 22*3600)
+
+		now = time.Date(2024, 5, 3, 0, 0, 0, 0, time.UTC)
+		wantStatus(t, register(t, "invited2"), http.StatusCreated)
+	})
+
+	t.Run("admin override", func(t *testing.T) {
+		patch := func(t *testing.T, userID int, body string) *http.Response {
+			t.Helper()
+			return srv.Do(t, "PATCH", fmt.Sprintf("/admin/users/%d/limits", userID), strings.NewReader(body))
+		}
+		wantStatus(t, patch(t, srv.User.ID, `{"active_codes":0}`), http.StatusOK)
+		q := limits(t)[api.QuotaActiveCodes]
+		if !q.Overridden || q.Limit != nil {
+			t.Errorf("active_codes = %+v, want unlimited override", q)
+		}
+		wantStatus(t, createCode(t, "OVER"), http.StatusCreated)
+
+		// поле, которого нет в запросе, не меняется; null возвращает общую квоту
+		wantStatus(t, patch(t, srv.User.ID, `{"codes_per_day":1}`), http.StatusOK)
+		if q := limits(t); q[api.QuotaActiveCodes].Limit != nil || *q[api.QuotaCodesPerDay].Limit != 1 {
+			t.Errorf("limits = %+v, want active_codes override kept", q)
+		}
+		wantQuota(t, createCode(t, "OVER2"), api.QuotaCodesPerDay, 0)
+		wantStatus(t, patch(t, srv.User.ID, `{"codes_per_day":null,"active_codes":null}`), http.StatusOK)
+		if q := limits(t)[api.QuotaCodesPerDay]; q.Overridden || *q.Limit != 2 {
+			t.Errorf("codes_per_day = %+v, want global quota", q)
+		}
+
+		wantStatus(t, patch(t, srv.User.ID, `{"invites_per_day":-1}`), http.StatusUnprocessableEntity)
+		wantStatus(t, patch(t, 9999, `{"invites_per_day":5}`), http.StatusNotFound)
+		if entries := srv.Store.AuditLog(srv.User.ID); len(entries) != 3 || entries[0].Action != storage.AuditUserLimitsSet {
+			t.Errorf("audit = %+v, want 3 limit changes", entries)
+		}
+	})
+}
+
+func TestAPI_QuotasDisabled(t *testing.T) {
+	srv := apitest.NewServer(t, apitest.WithAdmin())
+	for _, path := range []string{"/p/limits", "/admin/users/1/limits"} {
+		method := "GET"
+		if strings.HasPrefix(path, "/admin") {
+			method = "PATCH"
+		}
+		resp := srv.Do(t, method, path, strings.NewReader(`{}`))
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound && resp.StatusCode != http.StatusMethodNotAllowed {
+			t.Errorf("%s %s = %d, want route to be absent", method, path, resp.StatusCode)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		resp := srv.Do(t, "POST", "/p/referral-code",
+			strings.NewReader(fmt.Sprintf(`{"user_id":%d,"code":"FREE%d","expires_at":%d}`, srv.User.ID, i, codeExpiresAt)))
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("code %d: status = %d, want 201 without quotas", i, resp.StatusCode)
+		}
+	}
+}
+
+func TestAPI_LinkPreview(t *testing.T) {
+	srv := apitest.NewServer(t, apitest.WithAPIOptions(api.WithLinkPreview(api.LinkPreview{
+		Title:       "Acme",
+		Description: "Join & get a bonus",
+		ImageURL:    "https://cdn.example.com/og.png",
+		BaseURL:     "https://acme.example.com/",
+		InviteTitle: "{name} invites you to Acme",
+	})))
+	ctx := context.Background()
+	alice, err := srv.Store.CreateUser(ctx, storage.CreateUserParams{User: storage.User{Username: "alice", Email: "alice@private.example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := srv.Store.CreateUser(ctx, storage.CreateUserParams{User: storage.User{Username: "bob", Email: "bob@private.example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Store.CreateReferralCode(ctx, alice, "ALICE", 1893456000, "", nil, storage.DomainRestriction{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Store.CreateReferralCode(ctx, bob, "STALE", 946684800, "", nil, storage.DomainRestriction{}); err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		browser = "Mozilla/5.0 (Macintosh; Intel Mac OS X 14_0) AppleWebKit/605.1.15 Safari/605.1.15"
+		slack   = "Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)"
+		html    = "text/html,application/xhtml+xml"
+	)
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	tests := []struct {
+		name       string
+		path       string
+		agent      string
+		accept     string
+		wantStatus int
+		wantBody   []string // фрагменты страницы превью
+	}{
+		{"Browser is redirected", "/r/ALICE", browser, html, http.StatusFound, nil},
+		{"Bot without HTML Accept is redirected", "/r/ALICE", slack, "*/*", http.StatusFound, nil},
+		{"Unfurl bot", "/r/ALICE", slack, html, http.StatusOK, []string{
+			`<meta property="og:title" content="alice invites you to Acme">`,
+			`<meta property="og:description" content="Join &amp; get a bonus">`,
+			`<meta property="og:image" content="https://cdn.example.com/og.png">`,
+			`<meta property="og:url" content="https://acme.example.com/r/ALICE">`,
+		}},
+		{"WhatsApp", "/r/ALICE", "WhatsApp/2.23.20.0", html, http.StatusOK, []string{`content="alice invites you to Acme"`}},
+		{"Preview parameter", "/r/ALICE?preview=1", browser, "*/*", http.StatusOK, []string{`content="alice invites you to Acme"`}},
+		{"Expired code is neutral", "/r/STALE?preview=1", browser, html, http.StatusOK, []string{`<meta property="og:title" content="Acme">`}},
+		{"Unknown code is neutral", "/r/NOPE", slack, html, http.StatusNotFound, []string{`<meta property="og:title" content="Acme">`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", srv.URL+tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("User-Agent", tt.agent)
+			req.Header.Set("Accept", tt.accept)
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d; body %s", resp.StatusCode, tt.wantStatus, body)
+			}
+			if vary := strings.Join(resp.Header.Values("Vary"), ", "); !strings.Contains(vary, "User-Agent") {
+				t.Errorf("Vary = %q, want User-Agent", vary)
+			}
+			if tt.wantBody == nil {
+				return
+			}
+			if ct := resp.Header.Get("Content-Type"); ct != "text/html; charset=utf-8" {
+				t.Errorf("Content-Type = %q, want HTML", ct)
+			}
+			for _, want := range tt.wantBody {
+				if !bytes.Contains(body, []byte(want)) {
+					t.Errorf("page lacks %s:\n%s", want, body)
+				}
+			}
+			for _, leak := range []string{"private.example.com", "bob"} {
+				if bytes.Contains(body, []byte(leak)) {
+					t.Errorf("page leaks %q:\n%s", leak, body)
+				}
+			}
+		})
+	}
+
+	// превью запрашивают боты, переходы по ним не учитываются: засчитаны
+	// только два перенаправления
+	details, err := srv.Store.GetReferralCodeDetails(ctx, "ALICE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if details.Clicks != 2 {
+		t.Errorf("clicks = %d, want 2 redirects only", details.Clicks)
+	}
+}
+
+func TestAPI_OnboardingVesting(t *testing.T) {
+	srv := apitest.NewServer(t)
+	srv.Store.SetRewardTiers(rewards.Tiers{{UpTo: 5, Amount: 100}})
+	srv.Store.SetOnboarding(onboarding.Rules{onboarding.StepFirstLogin, onboarding.StepProfileCompleted})
+	ctx := context.Background()
+	if err := srv.Store.CreateReferralCode(ctx, srv.User.ID, "VEST", 1893456000, "", nil, storage.DomainRestriction{}); err != nil {
+		t.Fatal(err)
+	}
+	reg, err := srv.Store.RegisterWithReferralCode(ctx, "VEST", storage.CreateUserParams{User: storage.User{
+		Username: "newbie", Email: "newbie@example.com", Password: "x",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(t *testing.T, wantVested, wantPending int64, wantReward string, wantRemaining []string) {
+		t.Helper()
+		var stats storage.ReferralStats
+		if err := json.NewDecoder(srv.Do(t, "GET", "/p/stats", nil).Body).Decode(&stats); err != nil {
+			t.Fatal(err)
+		}
+		if stats.RewardTotal != wantVested || stats.RewardPending != wantPending || stats.Balance != wantVested {
+			t.Errorf("stats = %+v, want vested %d, pending %d", stats, wantVested, wantPending)
+		}
+
+		resp := srv.Do(t, "GET", "/p/referrals", nil)
+		var raw []map[string]interface{}
+		if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+			t.Fatal(err)
+		}
+		if len(raw) != 1 {
+			t.Fatalf("referrals = %v, want one", raw)
+		}
+		for key := range raw[0] {
+			if key != "username" && key != "joined_at" && key != "onboarding" && key != "reward" {
+				t.Errorf("referral exposes %q", key)
+			}
+		}
+		b, _ := json.Marshal(raw[0])
+		var ref api.ReferralResponse
+		if err := json.Unmarshal(b, &ref); err != nil {
+			t.Fatal(err)
+		}
+		if ref.Reward != wantReward || ref.Onboarding == nil || !reflect.DeepEqual(ref.Onboarding.Remaining, wantRemaining) {
+			t.Errorf("referral = %+v, want reward %q, remaining %v", ref, wantReward, wantRemaining)
+		}
+	}
+
+	// после регистрации вознаграждение ожидает
+	check(t, 0, 100, storage.RewardPending, []string{onboarding.StepFirstLogin, onboarding.StepProfileCompleted})
+
+	// неудачный вход шагом не считается
+	if err := srv.Store.RecordLogin(ctx, storage.LoginEvent{UserID: reg.UserID}); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Store.RecordLogin(ctx, storage.LoginEvent{UserID: reg.UserID, Success: true}); err != nil {
+		t.Fatal(err)
+	}
+	check(t, 0, 100, storage.RewardPending, []string{onboarding.StepProfileCompleted})
+
+	// последний шаг приглашенный выполняет сам и вознаграждение зачисляется
+	token, err := auth.GenerateToken(reg.UserID, "newbie", storage.RoleUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("PATCH", srv.URL+"/p/me", strings.NewReader(`{"timezone":"Europe/Berlin"}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("PATCH /p/me = %d, want 204", resp.StatusCode)
+	}
+	check(t, 100, 0, storage.RewardVested, []string{})
+
+	// повтор шага ничего не меняет
+	if err := srv.Store.SetTimezone(ctx, reg.UserID, "UTC"); err != nil {
+		t.Fatal(err)
+	}
+	check(t, 100, 0, storage.RewardVested, []string{})
+	if steps := srv.Store.Steps(reg.UserID); len(steps) != 2 {
+		t.Errorf("steps = %v, want each step recorded once", steps)
+	}
+}
+
+func TestAPI_OnboardingDisabled(t *testing.T) {
+	srv := apitest.NewServer(t)
+	srv.Store.SetRewardTiers(rewards.Tiers{{UpTo: 5, Amount: 100}})
+	ctx := context.Background()
+	if err := srv.Store.CreateReferralCode(ctx, srv.User.ID, "NOW", 1893456000, "", nil, storage.DomainRestriction{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.Store.RegisterWithReferralCode(ctx, "NOW", storage.CreateUserParams{User: storage.User{
+		Username: "newbie", Email: "newbie@example.com",
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var refs []api.ReferralResponse
+	if err := json.NewDecoder(srv.Do(t, "GET", "/p/referrals", nil).Body).Decode(&refs); err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 1 || refs[0].Onboarding != nil || refs[0].Reward != storage.RewardVested {
+		t.Errorf("referrals = %+v, want a vested reward without onboarding progress", refs)
+	}
+}
+
+func TestAPI_RewardStatements(t *testing.T) {
+	ctx := context.Background()
+	srv := apitest.NewServer(t)
+	now := time.Date(2026, 9, 3, 10, 0, 0, 0, time.UTC)
+	srv.Store.SetNow(func() time.Time { return now })
+	referee, err := srv.Store.CreateUser(ctx, storage.CreateUserParams{User: storage.User{Username: "bob", Email: "bob@example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Store.AddReward(srv.User.ID, referee, 300)
+	if resp := srv.Do(t, "POST", "/p/rewards/redeem", strings.NewReader(`{"amount":100,"note":"gift, card"}`)); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("redeem status = %d", resp.StatusCode)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := srv.Store.GenerateStatements(ctx, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var list []storage.RewardStatement
+	if err := json.NewDecoder(srv.Do(t, "GET", "/p/rewards/statements", nil).Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Period != "2026-09" || list[0].Earned != 300 || list[0].Redeemed != 100 || list[0].Entries != 2 {
+		t.Errorf("statements = %+v, want one for 2026-09", list)
+	}
+
+	tests := []struct {
+		name       string
+		period     string
+		wantStatus int
+		wantCode   string
+	}{
+		{"Generated", "2026-09", http.StatusOK, ""},
+		{"No statement", "2026-08", http.StatusNotFound, api.CodeStatementNotFound},
+		{"Invalid period", "2026-9", http.StatusBadRequest, api.CodeInvalidParameter},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := srv.Do(t, "GET", "/p/rewards/statements/"+tt.period, nil)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if tt.wantCode != "" {
+				var body api.ErrorResponse
+				if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.Code != tt.wantCode {
+					t.Errorf("error code = %q, %v, want %s", body.Code, err, tt.wantCode)
+				}
+				return
+			}
+			if got := resp.Header.Get("Content-Disposition"); got != `attachment; filename="rewards_2026-09.csv"` {
+				t.Errorf("Content-Disposition = %q", got)
+			}
+			b, _ := io.ReadAll(resp.Body)
+			want := "date,type,amount,details\n" +
+				"2026-09-03T10:00:00Z,redemption,-100,\"gift, card\"\n" +
+				"2026-09-03T10:00:00Z,reward,300,bob\n"
+			if string(b) != want {
+				t.Errorf("csv = %q, want %q", b, want)
+			}
+		})
+	}
+
+	// даты выводятся в часовом поясе пользователя, неизвестный пояс - UTC
+	for timezone, want := range map[string]string{
+		"Europe/Berlin": "2026-09-03T12:00:00+02:00,reward,300,bob\n",
+		"Not/A_Zone":    "2026-09-03T10:00:00Z,reward,300,bob\n",
+	} {
+		if err := srv.Store.SetTimezone(ctx, srv.User.ID, timezone); err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(srv.Do(t, "GET", "/p/rewards/statements/2026-09", nil).Body)
+		if !strings.HasSuffix(string(b), want) {
+			t.Errorf("timezone %s: csv = %q, want it to end with %q", timezone, b, want)
+		}
+	}
+}
+
+func TestAPI_ReferralCodePrecedence(t *testing.T) {
+	srv := apitest.NewServer(t)
+	ctx := context.Background()
+	for _, code := range []string{"BODY", "HEADER", "QUERY", "CLICK"} {
+		id, err := srv.Store.CreateUser(ctx, storage.CreateUserParams{User: storage.User{Username: "owner" + code, Email: "owner" + code + "@example.com"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := srv.Store.CreateReferralCode(ctx, id, code, 1893456000, "", nil, storage.DomainRestriction{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(srv.URL + "/r/CLICK")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	var cookie *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == "gorefer_ref" {
+			cookie = c
+		}
+	}
+	if cookie == nil {
+		t.Fatal("GET /r/CLICK did not set attribution cookie")
+	}
+
+	// источники кода: тело > заголовок > параметр > cookie
+	tests := []struct {
+		name                        string
+		body, header, query, cookie bool
+		wantCode                    string
+	}{
+		{"None", false, false, false, false, ""},
+		{"Cookie", false, false, false, true, "CLICK"},
+		{"Query", false, false, true, false, "QUERY"},
+		{"Query over cookie", false, false, true, true, "QUERY"},
+		{"Header", false, true, false, false, "HEADER"},
+		{"Header over query", false, true, true, false, "HEADER"},
+		{"Header over cookie", false, true, false, true, "HEADER"},
+		{"Header over all", false, true, true, true, "HEADER"},
+		{"Body", true, false, false, false, "BODY"},
+		{"Body over header", true, true, false, false, "BODY"},
+		{"Body over query", true, false, true, false, "BODY"},
+		{"Body over all", true, true, true, true, "BODY"},
+	}
+
+	for _, path := range []string{"/register", "/register-with-referral"} {
+		for i, tt := range tests {
+			if tt.body && path == "/register" {
+				continue // в теле /register кода нет
+			}
+			t.Run(path+"/"+tt.name, func(t *testing.T) {
+				name := fmt.Sprintf("prec%d%d", i, len(path))
+				user := fmt.Sprintf(`{"username":%q,"email":"%s@example.com","password":"password123"}`, name, name)
+				payload := user
+				if path == "/register-with-referral" {
+					payload = `{"user":` + user + `}`
+					if tt.body {
+						payload = `{"referral_code":"BODY","user":` + user + `}`
+					}
+				}
+				target := path
+				if tt.query {
+					target += "?ref=QUERY"
+				}
+				req := srv.NewRequest(t, "POST", target, strings.NewReader(payload))
+				if tt.header {
+					req.Header.Set("X-Referral-Code", "HEADER")
+				}
+				if tt.cookie {
+					req.AddCookie(cookie)
+				}
+				resp, err := client.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusCreated {
+					t.Fatalf("status = %d, want 201", resp.StatusCode)
+				}
+
+				u, err := srv.Store.GetUserByEmail(ctx, name+"@example.com")
+				if err != nil {
+					t.Fatal(err)
+				}
+				var got string
+				for _, l := range srv.Store.Links() {
+					if l.RefereeID == u.ID {
+						got = l.Code
+					}
+				}
+				if got != tt.wantCode {
+					t.Errorf("referral code = %q, want %q", got, tt.wantCode)
+				}
+			})
+		}
+	}
+}
+
+func TestAPI_RegisterInvalidCodeMode(t *testing.T) {
+	tests := []struct {
+		name         string
+		reg          api.Registration
+		path         string
+		header       string
+		wantStatus   int
+		wantCode     string // код ошибки или предупреждения
+		wantReferred bool
+	}{
+		{"Valid code", api.Registration{Open: true, Referral: true}, "/register?ref=GOOD", "", http.StatusCreated, "", true},
+		{"Reject by default", api.Registration{Open: true, Referral: true}, "/register?ref=NOPE", "", http.StatusUnprocessableEntity, api.CodeReferralCodeInvalid, false},
+		{"Reject header", api.Registration{Open: true, Referral: true, InvalidCode: api.InvalidCodeReject}, "/register", "NOPE", http.StatusUnprocessableEntity, api.CodeReferralCodeInvalid, false},
+		{"Ignore query", api.Registration{Open: true, Referral: true, InvalidCode: api.InvalidCodeIgnore}, "/register?ref=NOPE", "", http.StatusCreated, api.CodeReferralCodeInvalid, false},
+		{"Ignore header", api.Registration{Open: true, Referral: true, InvalidCode: api.InvalidCodeIgnore}, "/register", "NOPE", http.StatusCreated, api.CodeReferralCodeInvalid, false},
+		{"Ignore on referral endpoint", api.Registration{Open: true, Referral: true, InvalidCode: api.InvalidCodeIgnore}, "/register-with-referral?ref=NOPE", "", http.StatusCreated, api.CodeReferralCodeInvalid, false},
+		{"Ignore needs open registration", api.Registration{Referral: true, InvalidCode: api.InvalidCodeIgnore}, "/register?ref=NOPE", "", http.StatusUnprocessableEntity, api.CodeReferralCodeInvalid, false},
+		{"Code with open registration off", api.Registration{Referral: true}, "/register?ref=GOOD", "", http.StatusCreated, "", true},
+		{"Code with referral registration off", api.Registration{Open: true}, "/register?ref=GOOD", "", http.StatusForbidden, api.CodeRegistrationDisabled, false},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := apitest.NewServer(t, apitest.WithAPIOptions(api.WithRegistration(tt.reg)))
+			if err := srv.Store.CreateReferralCode(context.Background(), srv.User.ID, "GOOD", 1893456000, "", nil, storage.DomainRestriction{}); err != nil {
+				t.Fatal(err)
+			}
+			name := fmt.Sprintf("mode%d", i)
+			user := fmt.Sprintf(`{"username":%q,"email":"%s@example.com","password":"password123"}`, name, name)
+			payload := user
+			if strings.HasPrefix(tt.path, "/register-with-referral") {
+				payload = `{"user":` + user + `}`
+			}
+			req := srv.NewRequest(t, "POST", tt.path, strings.NewReader(payload))
+			if tt.header != "" {
+				req.Header.Set("X-Referral-Code", tt.header)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+
+			var body struct {
+				Code    string             `json:"code"`
+				Warning *api.SignupWarning `json:"warning"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			got := body.Code
+			if tt.wantStatus == http.StatusCreated {
+				got = ""
+				if body.Warning != nil {
+					got = body.Warning.Code
+				}
+			}
+			if got != tt.wantCode {
+				t.Errorf("code = %q, want %q", got, tt.wantCode)
+			}
+			if tt.wantStatus != http.StatusCreated {
+				return
+			}
+			referred := false
+			for _, l := range srv.Store.Links() {
+				if l.Code == "GOOD" {
+					referred = true
+				}
+			}
+			if referred != tt.wantReferred {
+				t.Errorf("referred = %v, want %v", referred, tt.wantReferred)
+			}
+		})
+	}
+}
+
+func TestAPI_RetentionMetrics(t *testing.T) {
+	ctx := context.Background()
+	store := apitest.NewStore()
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	store.SetNow(func() time.Time { return now.AddDate(0, 0, -100) })
+	if _, err := store.CreateUser(ctx, storage.CreateUserParams{User: storage.User{Username: "old", Email: "old@example.com"}, IP: "203.0.113.7"}); err != nil {
+		t.Fatal(err)
+	}
+	store.SetNow(func() time.Time { return now })
+	scrubber, err := retention.New(store, retention.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := scrubber.ScrubDue(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		opts       []api.Option
+		wantStatus int
+	}{
+		{"Disabled", nil, http.StatusNotFound},
+		{"Enabled", []api.Option{api.WithRetention(scrubber)}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := apitest.NewServer(t, apitest.WithAdmin(), apitest.WithAPIOptions(tt.opts...))
+			resp := srv.Do(t, "GET", "/admin/metrics/retention", nil)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			var overview struct {
+				Sections map[string]json.RawMessage `json:"sections"`
+			}
+			if err := json.NewDecoder(srv.Do(t, "GET", "/admin/overview", nil).Body).Decode(&overview); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := overview.Sections["retention"]; ok != (tt.opts != nil) {
+				t.Errorf("overview has retention section = %v, want %v", ok, tt.opts != nil)
+			}
+			if resp.StatusCode != http.StatusOK {
+				return
+			}
+			var stats api.RetentionStats
+			if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+				t.Fatal(err)
+			}
+			if stats.MaxAgeDays != 90 || stats.LastRunAt == nil || stats.Total[storage.ScrubSignups] != 1 {
+				t.Errorf("stats = %+v, want one signup scrubbed with 90 days retention", stats)
+			}
+		})
+	}
+}
+
+func TestAPI_ReferralCodeExpiry(t *testing.T) {
+	srv := apitest.NewServer(t)
+	now := time.Now()
+	beyondMax := now.Add(storage.DefaultCodeLifetime + time.Minute).Unix()
+
+	tests := []struct {
+		name       string
+		method     string
+		expiresAt  int64
+		wantStatus int
+		wantCode   string
+	}{
+		{"Create zero", "POST", 0, http.StatusUnprocessableEntity, api.CodeExpiryInPast},
+		{"Create past", "POST", now.Add(-time.Hour).Unix(), http.StatusUnprocessableEntity, api.CodeExpiryInPast},
+		{"Create now", "POST", now.Unix(), http.StatusUnprocessableEntity, api.CodeExpiryInPast},
+		{"Create beyond maximum", "POST", beyondMax, http.StatusUnprocessableEntity, api.CodeExpiryTooFar},
+		{"Create", "POST", now.Add(time.Hour).Unix(), http.StatusCreated, ""},
+		{"Extend zero", "PATCH", 0, http.StatusUnprocessableEntity, api.CodeExpiryInPast},
+		{"Extend now", "PATCH", now.Unix(), http.StatusUnprocessableEntity, api.CodeExpiryInPast},
+		{"Extend beyond maximum", "PATCH", beyondMax, http.StatusUnprocessableEntity, api.CodeExpiryTooFar},
+		{"Extend", "PATCH", now.AddDate(0, 3, 0).Unix(), http.StatusNoContent, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := fmt.Sprintf(`{"expires_at":%d}`, tt.expiresAt)
+			if tt.method == "POST" {
+				payload = fmt.Sprintf(`{"user_id":%d,"code":"EXPIRY","expires_at":%d}`, srv.User.ID, tt.expiresAt)
+			}
+			resp := srv.Do(t, tt.method, "/p/referral-code", strings.NewReader(payload))
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if tt.wantCode != "" {
+				var body api.ErrorResponse
+				if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.Code != tt.wantCode {
+					t.Errorf("error code = %q, %v, want %s", body.Code, err, tt.wantCode)
+				}
+				return
+			}
+			code, err := srv.Store.GetReferralCodeByUserID(context.Background(), srv.User.ID)
+			if err != nil || code.ExpiresAt.Unix() != tt.expiresAt {
+				t.Errorf("expires_at = %v, %v; want %v", code.ExpiresAt, err, time.Unix(tt.expiresAt, 0))
+			}
+		})
+	}
+}
+
+func TestAPI_ArchivedCodeHistory(t *testing.T) {
+	srv := apitest.NewServer(t, apitest.WithAPIOptions(api.WithMultipleCodes(3)))
+	ctx := context.Background()
+	if err := srv.Store.AddReferralCode(ctx, storage.NewReferralCode{UserID: srv.User.ID, Code: "AUTUMN", Label: "blog", ExpiresAt: codeExpiresAt}, 3); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := srv.Store.RecordClick(ctx, "AUTUMN"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := srv.Store.RegisterWithReferralCode(ctx, "AUTUMN", storage.CreateUserParams{User: storage.User{Username: "early", Email: "early@example.com"}}); err != nil {
+		t.Fatal(err)
+	}
+	resp := srv.Do(t, "DELETE", "/p/referral-code", strings.NewReader(fmt.Sprintf(`{"user_id":%d}`, srv.User.ID)))
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("DELETE /p/referral-code status = %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantLabel  string
+		wantClicks int
+		archived   bool
+	}{
+		{"Without archive", "", http.StatusOK, "", 0, false},
+		{"With archive", "?include_archived=true", http.StatusOK, "blog", 2, true},
+		{"Invalid flag", "?include_archived=bogus", http.StatusBadRequest, "", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := srv.Do(t, "GET", "/p/referral-codes/compare"+tt.query, nil)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var got []storage.CodeComparison
+			if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != 1 {
+				t.Fatalf("codes = %+v, want AUTUMN only", got)
+			}
+			c := got[0]
+			if c.Code != "AUTUMN" || c.Current || c.Label != tt.wantLabel || c.Clicks != tt.wantClicks || c.Signups != 1 || (c.ArchivedAt != nil) != tt.archived {
+				t.Errorf("code = %+v, want label %q, %d clicks, archived %v", c, tt.wantLabel, tt.wantClicks, tt.archived)
+			}
+		})
+	}
+
+	if _, err := srv.Store.RegisterWithReferralCode(ctx, "AUTUMN", storage.CreateUserParams{User: storage.User{Username: "late", Email: "late@example.com"}}); err == nil {
+		t.Error("registration with an archived code succeeded, want error")
+	}
+}
+
+func TestAPI_SlashNormalization(t *testing.T) {
+	srv := apitest.NewServer(t)
+	if err := srv.Store.CreateReferralCode(context.Background(), srv.User.ID, "SLASHES", codeExpiresAt, "", nil, storage.DomainRestriction{}); err != nil {
+		t.Fatal(err)
+	}
+	login := `{"email":"` + srv.User.Email + `","password":"` + apitest.DefaultPassword + `"}`
+	escapedEmail := strings.Replace(srv.User.Email, "@", "%40", 1)
+
+	tests := []struct {
+		name         string
+		method       string
+		path         string
+		body         string
+		wantStatus   int
+		wantLocation string
+	}{
+		{"GET trailing slash", "GET", "/p/stats/", "", http.StatusPermanentRedirect, "/p/stats"},
+		{"GET double slash", "GET", "//p//stats", "", http.StatusPermanentRedirect, "/p/stats"},
+		{"GET keeps query", "GET", "/p/referral-codes/compare/?include_archived=true", "", http.StatusPermanentRedirect, "/p/referral-codes/compare?include_archived=true"},
+		{"GET email param", "GET", "//p/referral-code/" + srv.User.Email + "/", "", http.StatusPermanentRedirect, "/p/referral-code/" + srv.User.Email},
+		{"GET escaped email param", "GET", "/p/referral-code/" + escapedEmail + "/", "", http.StatusPermanentRedirect, "/p/referral-code/" + escapedEmail},
+		{"POST trailing slash", "POST", "/register/", `{"username":"slash","email":"slash@example.com","password":"secret1"}`, http.StatusCreated, ""},
+		{"POST double slash", "POST", "//login", login, http.StatusOK, ""},
+		{"Canonical path", "GET", "/p/stats", "", http.StatusOK, ""},
+		{"Unknown path", "GET", "/no/such/route/", "", http.StatusPermanentRedirect, "/no/such/route"},
+	}
+	client := *srv.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body io.Reader
+			if tt.body != "" {
+				body = strings.NewReader(tt.body)
+			}
+			resp, err := client.Do(srv.NewRequest(t, tt.method, tt.path, body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("%s %s status = %d, want %d", tt.method, tt.path, resp.StatusCode, tt.wantStatus)
+			}
+			if got := resp.Header.Get("Location"); tt.wantLocation != "" && got != tt.wantLocation {
+				t.Errorf("Location = %q, want %q", got, tt.wantLocation)
+			}
+		})
+	}
+
+	// перенаправление на параметр с email приводит к коду владельца
+	resp := srv.Do(t, "GET", "/p/referral-code/"+srv.User.Email+"/", nil)
+	var code storage.ReferralCode
+	if err := json.NewDecoder(resp.Body).Decode(&code); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || code.Code != "SLASHES" {
+		t.Errorf("GET with trailing slash after redirect = %d %+v, want SLASHES", resp.StatusCode, code)
+	}
+}
+
+// holdingStore держит место ограничителя регистрации и входа: вход
+// slow@example.com ждет, пока тест не закроет release.
+type holdingStore struct {
+	storage.DBInterface
+	started, release chan struct{}
+}
+
+func (s *holdingStore) GetUserByEmail(ctx context.Context, email string) (storage.User, error) {
+	if email == "slow@example.com" {
+		close(s.started)
+		<-s.release
+	}
+	return s.DBInterface.GetUserByEmail(ctx, email)
+}
+
+// newQueueServer запускает API с очередью регистраций над store, в
+// котором единственное место ограничителя занято до вызова release.
+// Фоновые компоненты не запущены.
+func newQueueServer(t *testing.T, store storage.DBInterface, q api.RegistrationQueue) (a *api.API, srv *httptest.Server, release func()) {
+	t.Helper()
+	held := &holdingStore{DBInterface: store, started: make(chan struct{}), release: make(chan struct{})}
+	a = api.New(held, api.WithAuthConcurrency(1, 0), api.WithRegistrationQueue(q))
+	srv = httptest.NewServer(a.Router())
+	t.Cleanup(func() {
+		srv.Close()
+		if err := a.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		resp, err := srv.Client().Post(srv.URL+"/login", "application/json", strings.NewReader(`{"email":"slow@example.com","password":"secret1"}`))
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-held.started
+	return a, srv, func() {
+		close(held.release)
+		<-done
+	}
+}
+
+// awaitRegistration опрашивает статус регистрации, пока она не будет
+// обработана.
+func awaitRegistration(t *testing.T, srv *httptest.Server, statusURL string) api.RegistrationStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := srv.Client().Get(srv.URL + statusURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var status api.RegistrationStatus
+		err = json.NewDecoder(resp.Body).Decode(&status)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s = %d, %v", statusURL, resp.StatusCode, err)
+		}
+		if status.Status != storage.RegistrationPending {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("registration %s is still pending", status.ID)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAPI_RegistrationQueue(t *testing.T) {
+	ctx := context.Background()
+	store := apitest.NewStore()
+	aliceID, _ := store.CreateUser(ctx, storage.CreateUserParams{User: storage.User{Username: "alice", Email: "alice@example.com"}})
+	if err := store.CreateReferralCode(ctx, aliceID, "PEAK", codeExpiresAt, "", nil, storage.DomainRestriction{}); err != nil {
+		t.Fatal(err)
+	}
+	a, srv, release := newQueueServer(t, store, api.RegistrationQueue{MaxPending: 2, PollInterval: 10 * time.Millisecond})
+
+	signup := func(username, email string) string {
+		return fmt.Sprintf(`{"referral_code":"PEAK","user":{"username":%q,"email":%q,"password":"secret1"}}`, username, email)
+	}
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantCode   string
+	}{
+		{"Queued", signup("bob", "bob@example.com"), http.StatusAccepted, ""},
+		{"Queued with email taken", signup("mallory", "alice@example.com"), http.StatusAccepted, ""},
+		{"Invalid before queueing", `{"referral_code":"PEAK","user":{"username":"eve","email":"eve@example.com"}}`, http.StatusBadRequest, api.CodeInvalidPayload},
+		{"Queue full", signup("carol", "carol@example.com"), http.StatusTooManyRequests, api.CodeRegistrationQueueFull},
+	}
+	var queued []api.RegistrationStatus
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := srv.Client().Post(srv.URL+"/register-with-referral", "application/json", strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusAccepted {
+				var body api.ErrorResponse
+				if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.Code != tt.wantCode {
+					t.Errorf("error = %+v, %v; want %s", body, err, tt.wantCode)
+				}
+				if tt.wantStatus == http.StatusTooManyRequests && resp.Header.Get("Retry-After") == "" {
+					t.Error("queue full response has no Retry-After")
+				}
+				return
+			}
+			var status api.RegistrationStatus
+			if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+				t.Fatal(err)
+			}
+			if status.Status != storage.RegistrationPending || status.StatusURL != "/registrations/"+status.ID || resp.Header.Get("Location") != status.StatusURL {
+				t.Errorf("accepted = %+v, Location %q; want pending with status URL", status, resp.Header.Get("Location"))
+			}
+			queued = append(queued, status)
+		})
+	}
+	if len(queued) != 2 {
+		t.Fatalf("queued %d registrations, want 2", len(queued))
+	}
+
+	// без фоновой обработки регистрации ждут
+	resp, err := srv.Client().Get(srv.URL + queued[0].StatusURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("pending status = %d, Retry-After %q; want 200 with Retry-After", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+
+	release()
+	a.Start(ctx)
+
+	done := awaitRegistration(t, srv, queued[0].StatusURL)
+	if done.Status != storage.RegistrationCompleted || done.User == nil || done.User.User.Email != "bob@example.com" ||
+		done.User.ReferredBy == nil || done.User.ReferredBy.ID != aliceID {
+		t.Errorf("completed registration = %+v, want bob referred by alice", done)
+	}
+	if bob, err := store.GetUserByEmail(ctx, "bob@example.com"); err != nil || bob.ID != done.User.User.ID {
+		t.Errorf("bob = %+v, %v; want user %d", bob, err, done.User.User.ID)
+	}
+
+	// занятый email обнаруживается только при обработке
+	failed := awaitRegistration(t, srv, queued[1].StatusURL)
+	if failed.Status != storage.RegistrationFailed || failed.User != nil || failed.Error == nil ||
+		failed.Error.Code != api.CodeEmailTaken || failed.Error.Error == "" {
+		t.Errorf("failed registration = %+v, want %s", failed, api.CodeEmailTaken)
+	}
+
+	resp, err = srv.Client().Get(srv.URL + "/registrations/unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body api.ErrorResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || resp.StatusCode != http.StatusNotFound || body.Code != api.CodeRegistrationNotFound {
+		t.Errorf("unknown registration = %d %+v, want 404 %s", resp.StatusCode, body, api.CodeRegistrationNotFound)
+	}
+}
+
+func TestAPI_RegistrationQueueResume(t *testing.T) {
+	ctx := context.Background()
+	store := apitest.NewStore()
+	faulty := storage.NewFaulty(store, nil)
+	a, srv, release := newQueueServer(t, faulty, api.RegistrationQueue{PollInterval: 10 * time.Millisecond, Lease: 20 * time.Millisecond})
+
+	resp, err := srv.Client().Post(srv.URL+"/register-with-referral", "application/json",
+		strings.NewReader(`{"user":{"username":"dave","email":"dave@example.com","password":"secret1"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var queued api.RegistrationStatus
+	err = json.NewDecoder(resp.Body).Decode(&queued)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("register = %d, %v; want 202", resp.StatusCode, err)
+	}
+	release()
+
+	// обработчик создает пользователя и падает, не записав итог
+	if err := faulty.SetRules(storage.FaultRules{{Method: "FinishRegistration", Probability: 1, Error: storage.FaultUnavailable}}); err != nil {
+		t.Fatal(err)
+	}
+	a.Start(ctx)
+	var dave storage.User
+	deadline := time.Now().Add(5 * time.Second)
+	for dave, err = store.GetUserByEmail(ctx, "dave@example.com"); err != nil; dave, err = store.GetUserByEmail(ctx, "dave@example.com") {
+		if time.Now().After(deadline) {
+			t.Fatal("queued user was not created")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := faulty.SetRules(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// повторная попытка находит созданного пользователя, а не EMAIL_TAKEN
+	done := awaitRegistration(t, srv, queued.StatusURL)
+	if done.Status != storage.RegistrationCompleted || done.User == nil || done.User.User.ID != dave.ID {
+		t.Errorf("resumed registration = %+v, want completed for user %d", done, dave.ID)
+	}
+}
+
+func TestAPI_ReferralDisputes(t *testing.T) {
+	srv := apitest.NewServer(t, apitest.WithAdmin())
+	srv.Store.SetRewardTiers(rewards.Tiers{{UpTo: 5, Amount: 100}})
+	ctx := context.Background()
+	newUser := func(name string) int {
+		t.Helper()
+		id, err := srv.Store.CreateUser(ctx, storage.CreateUserParams{User: storage.User{Username: name, Email: name + "@example.com"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	newCode := func(userID int, code string) {
+		t.Helper()
+		if err := srv.Store.CreateReferralCode(ctx, userID, code, 1893456000, "", nil, storage.DomainRestriction{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// alice регистрировалась по коду bob, но связь не создана; у alice
+	// уже есть свой приглашенный gina. carol засчитана другому рефереру.
+	bob, alice, carol, dave, gina := newUser("bob"), newUser("alice"), newUser("carol"), newUser("dave"), newUser("gina")
+	newCode(bob, "BOB")
+	newCode(alice, "ALICE")
+	srv.Store.AddLink(apitest.Link{ReferrerID: dave, RefereeID: carol, Code: "DAVE", Depth: 1})
+	srv.Store.AddLink(apitest.Link{ReferrerID: alice, RefereeID: gina, Code: "ALICE", Depth: 1})
+
+	do := func(t *testing.T, userID int, method, path, body string) *http.Response {
+		t.Helper()
+		req := srv.NewRequest(t, method, path, strings.NewReader(body))
+		if userID != srv.User.ID {
+			req.Header.Set("Authorization", bearer(t, userID, storage.RoleUser))
+		}
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	decode := func(t *testing.T, resp *http.Response, status int, v interface{}) {
+		t.Helper()
+		if resp.StatusCode != status {
+			body, _ := io.ReadAll(resp.Body)
+			t.Fatalf("status = %d, want %d: %s", resp.StatusCode, status, body)
+		}
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wantError := func(t *testing.T, resp *http.Response, status int, code string) {
+		t.Helper()
+		var body api.ErrorResponse
+		decode(t, resp, status, &body)
+		if body.Code != code {
+			t.Errorf("error code = %s, want %s", body.Code, code)
+		}
+	}
+	resolve := func(t *testing.T, id int, body string) *http.Response {
+		t.Helper()
+		return do(t, srv.User.ID, "POST", fmt.Sprintf("/admin/disputes/%d/resolve", id), body)
+	}
+
+	var aliceDispute, carolDispute storage.ReferralDispute
+	t.Run("File", func(t *testing.T) {
+		decode(t, do(t, alice, "POST", "/p/referrals/disputes", `{"code":"BOB","message":"I used Bob's code"}`),
+			http.StatusCreated, &aliceDispute)
+		if aliceDispute.ReferrerID != bob || aliceDispute.RefereeID != alice || aliceDispute.FiledBy != alice ||
+			aliceDispute.Status != storage.DisputeOpen {
+			t.Errorf("dispute = %+v, want open dispute of alice against bob", aliceDispute)
+		}
+		// владелец кода указывает реферала по email
+		decode(t, do(t, bob, "POST", "/p/referrals/disputes", `{"code":"BOB","referee_email":"CAROL@example.com","message":"Carol is mine"}`),
+			http.StatusCreated, &carolDispute)
+		if carolDispute.ReferrerID != bob || carolDispute.RefereeID != carol || carolDispute.FiledBy != bob {
+			t.Errorf("dispute = %+v, want dispute of bob about carol", carolDispute)
+		}
+	})
+
+	t.Run("File rejected", func(t *testing.T) {
+		tests := []struct {
+			name       string
+			userID     int
+			body       string
+			wantStatus int
+			wantCode   string
+		}{
+			{"No message", alice, `{"code":"BOB","message":"  "}`, http.StatusBadRequest, api.CodeInvalidPayload},
+			{"No code", alice, `{"message":"hi"}`, http.StatusBadRequest, api.CodeInvalidPayload},
+			{"Message too long", alice, `{"code":"BOB","message":"` + strings.Repeat("m", 2001) + `"}`, http.StatusBadRequest, api.CodeInvalidPayload},
+			{"Unknown code", alice, `{"code":"NOPE","message":"hi"}`, http.StatusNotFound, api.CodeReferralCodeNotFound},
+			{"Already open", alice, `{"code":"BOB","message":"again"}`, http.StatusConflict, api.CodeDisputeExists},
+			{"Own code", bob, `{"code":"BOB","message":"hi"}`, http.StatusConflict, api.CodeSelfReferral},
+			{"Not the owner", dave, `{"code":"BOB","referee_email":"gina@example.com","message":"hi"}`, http.StatusForbidden, api.CodeDisputeNotParty},
+			{"Unknown referee", bob, `{"code":"BOB","referee_email":"nobody@example.com","message":"hi"}`, http.StatusNotFound, api.CodeUserNotFound},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				wantError(t, do(t, tt.userID, "POST", "/p/referrals/disputes", tt.body), tt.wantStatus, tt.wantCode)
+			})
+		}
+	})
+
+	t.Run("List", func(t *testing.T) {
+		var open []storage.ReferralDispute
+		decode(t, do(t, srv.User.ID, "GET", "/admin/disputes?status=open", ""), http.StatusOK, &open)
+		if len(open) != 2 || open[0].ID != carolDispute.ID || open[1].ID != aliceDispute.ID {
+			t.Errorf("open disputes = %+v, want carol's and alice's, newest first", open)
+		}
+		wantError(t, do(t, srv.User.ID, "GET", "/admin/disputes?status=closed", ""), http.StatusBadRequest, api.CodeInvalidParameter)
+		if resp := do(t, alice, "GET", "/admin/disputes", ""); resp.StatusCode != http.StatusForbidden {
+			t.Errorf("list by user: status = %d, want 403", resp.StatusCode)
+		}
+	})
+
+	t.Run("Resolve rejected", func(t *testing.T) {
+		wantError(t, resolve(t, aliceDispute.ID, `{"action":"approve"}`), http.StatusBadRequest, api.CodeInvalidPayload)
+		wantError(t, resolve(t, aliceDispute.ID, `{"action":"note"}`), http.StatusBadRequest, api.CodeInvalidPayload)
+		wantError(t, resolve(t, 9999, `{"action":"reject"}`), http.StatusNotFound, api.CodeDisputeNotFound)
+		resp := do(t, alice, "POST", fmt.Sprintf("/admin/disputes/%d/resolve", aliceDispute.ID), `{"action":"attach"}`)
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("resolve by user: status = %d, want 403", resp.StatusCode)
+		}
+		// у carol уже есть реферер: связь не создается, спор остается открытым
+		wantError(t, resolve(t, carolDispute.ID, `{"action":"attach"}`), http.StatusConflict, api.CodeAlreadyReferred)
+	})
+
+	t.Run("Reject", func(t *testing.T) {
+		var got storage.ReferralDispute
+		decode(t, resolve(t, carolDispute.ID, `{"action":"reject","note":"counted for dave"}`), http.StatusOK, &got)
+		if got.Status != storage.DisputeResolved || got.Resolution != storage.DisputeReject ||
+			got.ResolutionNote != "counted for dave" || got.ResolvedBy == nil || *got.ResolvedBy != srv.User.ID {
+			t.Errorf("dispute = %+v, want resolved by reject", got)
+		}
+		wantError(t, resolve(t, carolDispute.ID, `{"action":"attach"}`), http.StatusConflict, api.CodeDisputeResolved)
+	})
+
+	t.Run("Attach", func(t *testing.T) {
+		var got storage.ReferralDispute
+		decode(t, resolve(t, aliceDispute.ID, `{"action":"attach"}`), http.StatusOK, &got)
+		if got.Status != storage.DisputeResolved || got.Resolution != storage.DisputeAttach {
+			t.Errorf("dispute = %+v, want resolved by attach", got)
+		}
+		wantError(t, resolve(t, aliceDispute.ID, `{"action":"attach"}`), http.StatusConflict, api.CodeDisputeResolved)
+
+		depths := map[int]int{}
+		var attached []apitest.Link
+		for _, l := range srv.Store.Links() {
+			depths[l.RefereeID] = l.Depth
+			if l.RefereeID == alice {
+				attached = append(attached, l)
+			}
+		}
+		if len(attached) != 1 || attached[0].ReferrerID != bob || attached[0].Code != "BOB" || attached[0].Channel != storage.ChannelDispute {
+			t.Errorf("links of alice = %+v, want one dispute link to bob by BOB", attached)
+		}
+		// цепочка alice продолжилась: gina стала на звено глубже
+		if depths[alice] != 1 || depths[gina] != 2 {
+			t.Errorf("depths alice=%d gina=%d, want 1 and 2", depths[alice], depths[gina])
+		}
+		stats, err := srv.Store.GetReferralStats(ctx, bob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Referrals != 1 || stats.RewardTotal != 100 {
+			t.Errorf("bob stats = %+v, want 1 referral and reward 100", stats)
+		}
+		code, err := srv.Store.GetReferralCodeDetails(ctx, "BOB")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code.Uses != 1 {
+			t.Errorf("BOB uses = %d, want 1", code.Uses)
+		}
+		if log := srv.Store.AuditLog(alice); len(log) != 1 || log[0].Action != storage.AuditDisputeResolved {
+			t.Errorf("audit log of alice = %+v, want dispute resolution", log)
+		}
+	})
+
+	t.Run("Attach closing a cycle", func(t *testing.T) {
+		// bob утверждает, что сам пришел по коду alice, которую пригласил
+		var d storage.ReferralDispute
+		decode(t, do(t, bob, "POST", "/p/referrals/disputes", `{"code":"ALICE","message":"I used Alice's code"}`),
+			http.StatusCreated, &d)
+		wantError(t, resolve(t, d.ID, `{"action":"attach"}`), http.StatusConflict, api.CodeSelfReferral)
+
+		var got storage.ReferralDispute
+		decode(t, resolve(t, d.ID, `{"action":"note","note":"bob invited alice"}`), http.StatusOK, &got)
+		if got.Status != storage.DisputeResolved || got.Resolution != storage.DisputeNote || got.ResolutionNote != "bob invited alice" {
+			t.Errorf("dispute = %+v, want resolved with note", got)
+		}
+		for _, l := range srv.Store.Links() {
+			if l.RefereeID == bob {
+				t.Errorf("bob got a referrer: %+v", l)
+			}
+		}
+	})
+
+	t.Run("List resolved", func(t *testing.T) {
+		var resolved []storage.ReferralDispute
+		decode(t, do(t, srv.User.ID, "GET", "/admin/disputes?status=resolved&limit=2", ""), http.StatusOK, &resolved)
+		if len(resolved) != 2 {
+			t.Errorf("resolved disputes = %d, want a page of 2", len(resolved))
+		}
+	})
+}
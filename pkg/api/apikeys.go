@@ -0,0 +1,232 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+
+	"gorefer.go/pkg/api/middlware"
+	"gorefer.go/pkg/reqctx"
+	"gorefer.go/pkg/storage"
+)
+
+// APIKeyHeader - заголовок с ключом API, которым другие сервисы
+// вызывают маршруты /admin вместо токена администратора
+const APIKeyHeader = "X-API-Key"
+
+// Области ключей API. Маршрут, не отнесенный ни к одной области, ключом
+// не вызывается.
+const (
+	ScopeReportsRead = "reports:read" // отчеты и сводка программы
+	ScopeCodesRead   = "codes:read"   // список и карточки кодов
+	ScopeCodesWrite  = "codes:write"  // резервирование кодов
+)
+
+// Все области ключей API
+var apiKeyScopes = []string{ScopeReportsRead, ScopeCodesRead, ScopeCodesWrite}
+
+// Ключ API: префикс и 32 случайных байта в base64url
+const (
+	apiKeyPrefix        = "grk_"
+	apiKeyBytes         = 32
+	apiKeyVisiblePart   = len(apiKeyPrefix) + 8 // начало ключа в списке ключей
+	maxAPIKeyNameLength = 100
+)
+
+// Созданный ключ API. Key возвращается только в ответе на создание.
+type APIKeyCreated struct {
+	storage.APIKey
+	Key string `json:"key"`
+}
+
+// hashAPIKey возвращает хэш ключа, под которым он хранится. Ключ
+// случайный и длинный, поэтому медленный хэш, как для паролей, не нужен.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// newAPIKey выпускает случайный ключ API.
+func newAPIKey() (string, error) {
+	b := make([]byte, apiKeyBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// apiKeyOr пропускает запрос с ключом API, если ключу разрешена область
+// scope; запрос без ключа проверяется как обычно - токен администратора.
+// Ключ ищется при каждом запросе, поэтому отзыв действует сразу.
+func (api *API) apiKeyOr(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		admin := middlware.TokenAuthMiddleware(middlware.RequireRole(storage.RoleAdmin)(next))
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			value := r.Header.Get(APIKeyHeader)
+			if value == "" {
+				admin.ServeHTTP(w, r)
+				return
+			}
+			key, err := api.db.UseAPIKey(r.Context(), hashAPIKey(value))
+			if errors.Is(err, storage.ErrNotFound) {
+				api.writeError(w, r, CodeAPIKeyInvalid, nil)
+				return
+			}
+			if err != nil {
+				api.writeError(w, r, CodeInternal, fmt.Errorf("failed to check api key: %w", err))
+				return
+			}
+			if !key.HasScope(scope) {
+				api.writeError(w, r, CodeAPIKeyScopeMissing, fmt.Errorf("api key %d lacks scope %s", key.ID, scope))
+				return
+			}
+			ctx := reqctx.WithAPIKey(r.Context(), reqctx.APIKey{ID: key.ID, Name: key.Name, Scopes: key.Scopes})
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// validateScopes проверяет, что области заданы и известны.
+func validateScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return errors.New("scopes are required")
+	}
+	for _, s := range scopes {
+		known := false
+		for _, k := range apiKeyScopes {
+			known = known || s == k
+		}
+		if !known {
+			return fmt.Errorf("unknown scope %q, expected one of %s", s, strings.Join(apiKeyScopes, ", "))
+		}
+	}
+	return nil
+}
+
+// Обработчик для создания ключа API (admin). Ключ показывается только в
+// этом ответе; сохраняется лишь его хэш.
+func (api *API) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+	}
+	if !api.decodeJSON(w, r, &request) {
+		return
+	}
+	name := strings.TrimSpace(request.Name)
+	if name == "" || utf8.RuneCountInString(name) > maxAPIKeyNameLength {
+		api.writeError(w, r, CodeInvalidPayload, fmt.Errorf("name must be 1 to %d characters", maxAPIKeyNameLength))
+		return
+	}
+	if err := validateScopes(request.Scopes); err != nil {
+		api.writeError(w, r, CodeInvalidPayload, err)
+		return
+	}
+
+	claims, ok := reqctx.UserFrom(r.Context())
+	if !ok {
+		api.writeError(w, r, CodeUnauthorized, nil)
+		return
+	}
+
+	ctx := r.Context()
+
+	resultChan := make(chan APIKeyCreated)
+	errorChan := make(chan error)
+
+	go func() {
+		value, err := newAPIKey()
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		key, err := api.db.CreateAPIKey(ctx, storage.NewAPIKey{
+			Name:      name,
+			Prefix:    value[:apiKeyVisiblePart],
+			KeyHash:   hashAPIKey(value),
+			Scopes:    request.Scopes,
+			CreatedBy: claims.ActorID(),
+		})
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		resultChan <- APIKeyCreated{APIKey: key, Key: value}
+	}()
+
+	select {
+	case created := <-resultChan:
+		respond(w, http.StatusCreated, created)
+
+	case err := <-errorChan:
+		api.writeError(w, r, CodeInternal, fmt.Errorf("failed to create api key: %w", err))
+	}
+}
+
+// Обработчик для получения списка ключей API (admin), включая отозванные
+func (api *API) ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	resultChan := make(chan []storage.APIKey)
+	errorChan := make(chan error)
+
+	go func() {
+		keys, err := api.db.ListAPIKeys(ctx)
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		resultChan <- keys
+	}()
+
+	select {
+	case keys := <-resultChan:
+		respond(w, http.StatusOK, keys)
+
+	case err := <-errorChan:
+		api.writeError(w, r, CodeInternal, fmt.Errorf("failed to list api keys: %w", err))
+	}
+}
+
+// Обработчик для отзыва ключа API (admin). Запросы с ключом отклоняются
+// сразу после отзыва.
+func (api *API) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		api.writeError(w, r, CodeInvalidID, err)
+		return
+	}
+
+	claims, ok := reqctx.UserFrom(r.Context())
+	if !ok {
+		api.writeError(w, r, CodeUnauthorized, nil)
+		return
+	}
+
+	ctx := r.Context()
+
+	resultChan := make(chan error)
+	go func() {
+		resultChan <- api.db.RevokeAPIKey(ctx, id, claims.ActorID())
+	}()
+
+	if err := <-resultChan; err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			api.writeError(w, r, CodeAPIKeyNotFound, err)
+			return
+		}
+		api.writeError(w, r, CodeInternal, fmt.Errorf("failed to revoke api key: %w", err))
+		return
+	}
+
+	respond(w, http.StatusNoContent, nil)
+}
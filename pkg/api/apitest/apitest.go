@@ -0,0 +1,178 @@
+// Пакет apitest поднимает API поверх хранилища в памяти для интеграционных
+// тестов: тестовый ключ подписи, зарегистрированный пользователь и его
+// токен. Ресурсы освобождаются через t.Cleanup.
+//
+// NewServer подменяет глобальное хранилище ключей auth.Keys, поэтому
+// тесты, использующие его, не должны выполняться параллельно (t.Parallel).
+package apitest
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gorefer.go/pkg/api"
+	"gorefer.go/pkg/auth"
+	"gorefer.go/pkg/storage"
+)
+
+// Секрет подписи токенов в тестовом сервере
+const testSecret = "apitest-secret"
+
+// Пароль пользователя, создаваемого по умолчанию
+const DefaultPassword = "password123"
+
+// Server - тестовый сервер API.
+type Server struct {
+	*httptest.Server
+	API   *api.API
+	Store *Store
+	User  storage.User // зарегистрированный пользователь; Password не хэширован
+	Token string       // токен User
+	// Faults - сбои хранилища, см. WithFaults; nil - без сбоев
+	Faults *storage.Faulty
+}
+
+type config struct {
+	user    storage.User
+	apiOpts []api.Option
+	seed    string
+	faults  storage.FaultRules // nil - хранилище без сбоев
+}
+
+// Option настраивает тестовый сервер.
+type Option func(*config)
+
+// WithUser задает зарегистрированного пользователя. Пустой пароль
+// заменяется DefaultPassword, пустая роль - storage.RoleUser.
+func WithUser(user storage.User) Option {
+	return func(c *config) {
+		c.user = user
+	}
+}
+
+// WithAdmin делает зарегистрированного пользователя администратором.
+func WithAdmin() Option {
+	return func(c *config) {
+		c.user.Role = storage.RoleAdmin
+	}
+}
+
+// WithSeed заполняет хранилище тестовыми данными профиля, см.
+// storage.SeedProfile. Пароль пользователей профиля -
+// storage.SeedPassword.
+func WithSeed(profile string) Option {
+	return func(c *config) {
+		c.seed = profile
+	}
+}
+
+// WithAPIOptions передает параметры в api.New.
+func WithAPIOptions(opts ...api.Option) Option {
+	return func(c *config) {
+		c.apiOpts = append(c.apiOpts, opts...)
+	}
+}
+
+// WithFaults оборачивает хранилище storage.Faulty с правилами rules и
+// включает маршруты /admin/faults. Store по-прежнему дает доступ к
+// данным в обход сбоев.
+func WithFaults(rules storage.FaultRules) Option {
+	return func(c *config) {
+		c.faults = append(storage.FaultRules{}, rules...)
+	}
+}
+
+// NewServer запускает API с хранилищем в памяти и регистрирует
+// пользователя с токеном. Фоновые компоненты API запущены.
+func NewServer(t testing.TB, opts ...Option) *Server {
+	t.Helper()
+
+	cfg := config{user: storage.User{Username: "testuser", Email: "testuser@example.com"}}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.user.Password == "" {
+		cfg.user.Password = DefaultPassword
+	}
+	if cfg.user.Role == "" {
+		cfg.user.Role = storage.RoleUser
+	}
+
+	keys, err := auth.NewKeyStore(func() ([]byte, error) { return []byte(testSecret), nil })
+	if err != nil {
+		t.Fatalf("apitest: %v", err)
+	}
+	prevKeys := auth.Keys
+	auth.Keys = keys
+	t.Cleanup(func() { auth.Keys = prevKeys })
+
+	store := NewStore()
+	if cfg.seed != "" {
+		if err := store.Seed(context.Background(), cfg.seed); err != nil {
+			t.Fatalf("apitest: %v", err)
+		}
+	}
+	user := cfg.user
+	hashed, err := auth.HashPassword(user.Password)
+	if err != nil {
+		t.Fatalf("apitest: %v", err)
+	}
+	stored := user
+	stored.Password = hashed
+	user.ID, err = store.CreateUser(context.Background(), storage.CreateUserParams{User: stored})
+	if err != nil {
+		t.Fatalf("apitest: %v", err)
+	}
+	token, err := auth.GenerateToken(user.ID, user.Username, user.Role)
+	if err != nil {
+		t.Fatalf("apitest: %v", err)
+	}
+
+	var db storage.DBInterface = store
+	var faulty *storage.Faulty
+	if cfg.faults != nil {
+		faulty = storage.NewFaulty(store, cfg.faults)
+		db = faulty
+		cfg.apiOpts = append(cfg.apiOpts, api.WithFaultInjection(faulty))
+	}
+	a := api.New(db, cfg.apiOpts...)
+	a.Start(context.Background())
+	srv := httptest.NewServer(a.Router())
+	t.Cleanup(func() {
+		srv.Close()
+		if err := a.Close(); err != nil {
+			t.Errorf("apitest: %v", err)
+		}
+	})
+
+	return &Server{Server: srv, API: a, Store: store, User: user, Token: token, Faults: faulty}
+}
+
+// NewRequest создает запрос к серверу от имени s.User.
+func (s *Server) NewRequest(t testing.TB, method, path string, body io.Reader) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest(method, s.URL+path, body)
+	if err != nil {
+		t.Fatalf("apitest: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+s.Token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req
+}
+
+// Do выполняет запрос от имени s.User. Тело ответа закрывается при
+// завершении теста.
+func (s *Server) Do(t testing.TB, method, path string, body io.Reader) *http.Response {
+	t.Helper()
+	resp, err := s.Client().Do(s.NewRequest(t, method, path, body))
+	if err != nil {
+		t.Fatalf("apitest: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
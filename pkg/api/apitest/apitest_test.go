@@ -0,0 +1,321 @@
+package apitest_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"gorefer.go/pkg/api/apitest"
+	"gorefer.go/pkg/auth"
+	"gorefer.go/pkg/storage"
+)
+
+func TestNewServer_SeededUserCanLogin(t *testing.T) {
+	srv := apitest.NewServer(t)
+
+	payload := `{"email":"` + srv.User.Email + `","password":"` + apitest.DefaultPassword + `"}`
+	resp := srv.Do(t, "POST", "/login", strings.NewReader(payload))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("login status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	var body struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.Token == "" {
+		t.Fatalf("login response token = %q, err = %v", body.Token, err)
+	}
+}
+
+func TestNewServer_Admin(t *testing.T) {
+	srv := apitest.NewServer(t, apitest.WithAdmin())
+
+	resp := srv.Do(t, "POST", "/admin/referral-codes/reserve",
+		strings.NewReader(fmt.Sprintf(`{"email":"new@example.com","code":"NEW1","expires_at":%d}`, time.Now().Add(time.Hour).Unix())))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("reserve status = %d, want %d", resp.StatusCode, http.StatusCreated)
+	}
+
+	d, err := srv.Store.GetReferralCodeDetails(context.Background(), "NEW1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !d.Reserved() || d.OwnerEmail != "new@example.com" {
+		t.Errorf("details = %+v, want code reserved for new@example.com", d)
+	}
+}
+
+func TestStore_CreateReferralCode(t *testing.T) {
+	ctx := context.Background()
+	store := apitest.NewStore()
+	alice, _ := store.CreateUser(ctx, storage.CreateUserParams{User: storage.User{Email: "alice@example.com"}})
+	bob, _ := store.CreateUser(ctx, storage.CreateUserParams{User: storage.User{Email: "bob@example.com"}})
+
+	if err := store.CreateReferralCode(ctx, alice, "ALICE", 1893456000, "t1", nil, storage.DomainRestriction{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateReferralCode(ctx, alice, "ALICE2", 1893456000, "t1", nil, storage.DomainRestriction{}); !errors.Is(err, storage.ErrClientTokenUsed) {
+		t.Errorf("replay error = %v, want ErrClientTokenUsed", err)
+	}
+	if err := store.CreateReferralCode(ctx, bob, "ALICE", 1893456000, "", nil, storage.DomainRestriction{}); !errors.Is(err, storage.ErrCodeTaken) {
+		t.Errorf("duplicate code error = %v, want ErrCodeTaken", err)
+	}
+}
+
+func TestStore_RegisterWithReferralCodeRetry(t *testing.T) {
+	ctx := context.Background()
+	store := apitest.NewStore()
+	referrer, _ := store.CreateUser(ctx, storage.CreateUserParams{User: storage.User{Email: "alice@example.com"}})
+	if err := store.CreateReferralCode(ctx, referrer, "ALICE", 1893456000, "", nil, storage.DomainRestriction{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// прерванная попытка успела создать только пользователя
+	hash, err := auth.HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := storage.CreateUserParams{User: storage.User{Username: "bob", Email: "bob@example.com", Password: hash}, PlainPassword: "secret"}
+	bobID, err := store.CreateUser(ctx, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// без пароля пользователя чужой запрос не достраивает связь
+	for _, plain := range []string{"", "guess"} {
+		other := params
+		other.PlainPassword = plain
+		if _, err := store.RegisterWithReferralCode(ctx, "ALICE", other); !errors.Is(err, storage.ErrEmailTaken) {
+			t.Errorf("retry with password %q error = %v, want ErrEmailTaken", plain, err)
+		}
+	}
+
+	reg, err := store.RegisterWithReferralCode(ctx, "ALICE", params)
+	if err != nil {
+		t.Fatalf("retry error = %v", err)
+	}
+	if reg.UserID != bobID || reg.Referrer.ID != referrer {
+		t.Errorf("registration = %+v, want user %d referred by %d", reg, bobID, referrer)
+	}
+	referrals, _ := store.GetReferralsByReferrerID(ctx, referrer, 10, 0)
+	if len(referrals) != 1 || referrals[0].Username != "bob" {
+		t.Errorf("referrals = %+v, want bob", referrals)
+	}
+	if _, err := store.RegisterWithReferralCode(ctx, "ALICE", params); err == nil {
+		t.Error("second registration of a linked user succeeded, want error")
+	}
+}
+
+func TestStore_RegisterWithOwnReservedCode(t *testing.T) {
+	ctx := context.Background()
+	store := apitest.NewStore()
+	if err := store.ReserveReferralCode(ctx, "bob@example.com", "BOB", 1893456000, storage.DomainRestriction{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// прерванная попытка создала пользователя, и код стал его собственным
+	hash, err := auth.HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := storage.CreateUserParams{User: storage.User{Username: "bob", Email: "bob@example.com", Password: hash}, PlainPassword: "secret"}
+	bobID, err := store.CreateUser(ctx, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.RegisterWithReferralCode(ctx, "BOB", params); !errors.Is(err, storage.ErrSelfReferral) {
+		t.Errorf("retry with own code error = %v, want ErrSelfReferral", err)
+	}
+	if referrals, _ := store.GetReferralsByReferrerID(ctx, bobID, 10, 0); len(referrals) != 0 {
+		t.Errorf("referrals = %+v, want none", referrals)
+	}
+}
+
+func TestStore_AnonymizeUserScrubsSignupData(t *testing.T) {
+	ctx := context.Background()
+	store := apitest.NewStore()
+	id, err := store.CreateUser(ctx, storage.CreateUserParams{
+		User:      storage.User{Username: "bob", Email: "bob@example.com"},
+		UserAgent: "test-agent",
+		IP:        "192.0.2.9",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.AcceptTerms(ctx, id, "v1", "192.0.2.10"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AnonymizeUser(ctx, id, id); err != nil {
+		t.Fatal(err)
+	}
+	if ip, userAgent := store.SignupMetadata(id); ip != "" || userAgent != "" {
+		t.Errorf("signup ip = %q, user agent = %q after anonymize, want empty", ip, userAgent)
+	}
+	if a, err := store.AcceptTerms(ctx, id, "v1", ""); err != nil || a.IP != "" {
+		t.Errorf("terms acceptance = %+v, %v after anonymize, want no IP", a, err)
+	}
+}
+
+func TestStore_RegisterWithStaleClickID(t *testing.T) {
+	ctx := context.Background()
+	store := apitest.NewStore()
+	for _, name := range []string{"alice", "carol"} {
+		id, _ := store.CreateUser(ctx, storage.CreateUserParams{User: storage.User{Username: name, Email: name + "@example.com"}})
+		if err := store.CreateReferralCode(ctx, id, strings.ToUpper(name), 1893456000, "", nil, storage.DomainRestriction{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	own, _ := store.RecordClick(ctx, "ALICE")
+	other, _ := store.RecordClick(ctx, "CAROL")
+
+	for name, tt := range map[string]struct{ clickID, want int }{
+		"own":     {own, own},
+		"other":   {other, 0},
+		"deleted": {999999, 0},
+	} {
+		reg, err := store.RegisterWithReferralCode(ctx, "ALICE", storage.CreateUserParams{
+			User:    storage.User{Username: name, Email: name + "@example.com"},
+			Channel: storage.ChannelLinkClick,
+			ClickID: tt.clickID,
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for _, l := range store.Links() {
+			if l.RefereeID == reg.UserID && l.ClickID != tt.want {
+				t.Errorf("%s: click ID = %d, want %d", name, l.ClickID, tt.want)
+			}
+		}
+	}
+}
+
+func TestStore_DeleteReferralCodeByCode(t *testing.T) {
+	ctx := context.Background()
+	store := apitest.NewStore()
+	alice, _ := store.CreateUser(ctx, storage.CreateUserParams{User: storage.User{Username: "alice", Email: "alice@example.com"}})
+	if err := store.CreateReferralCode(ctx, alice, "ALICE", 1893456000, "", nil, storage.DomainRestriction{}); err != nil {
+		t.Fatal(err)
+	}
+
+	deleted, err := store.DeleteReferralCodeByCode(ctx, "ALICE", 99)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted.UserID != alice || deleted.OwnerEmail != "alice@example.com" {
+		t.Errorf("deleted = %+v, want code owned by alice", deleted)
+	}
+	if log := store.AuditLog(alice); len(log) != 1 || log[0].Action != storage.AuditCodeDeleted {
+		t.Errorf("audit log = %+v, want one %s entry", log, storage.AuditCodeDeleted)
+	}
+	if _, err := store.DeleteReferralCodeByCode(ctx, "ALICE", 99); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("second delete error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestNewServer_WithSeed(t *testing.T) {
+	srv := apitest.NewServer(t, apitest.WithSeed(storage.SeedDemo))
+	ctx := context.Background()
+
+	// повторная загрузка ничего не меняет
+	if err := srv.Store.Seed(ctx, storage.SeedDemo); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(srv.Store.Links()); n != 5 {
+		t.Errorf("links after second seed = %d, want 5", n)
+	}
+	stats, err := srv.Store.GetCodeStats(ctx, mustUserID(t, srv.Store, "alice@demo.gorefer.test"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 1 || stats[0].Code != "ALICE2026" || stats[0].Clicks != 12 || stats[0].Referrals != 3 {
+		t.Errorf("alice code stats = %+v", stats)
+	}
+
+	payload := `{"email":"admin@demo.gorefer.test","password":"` + storage.SeedPassword + `"}`
+	resp := srv.Do(t, "POST", "/login", strings.NewReader(payload))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("seeded admin login status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	if err := srv.Store.Seed(ctx, "huge"); !errors.Is(err, storage.ErrUnknownSeedProfile) {
+		t.Errorf("Seed(huge) error = %v, want ErrUnknownSeedProfile", err)
+	}
+}
+
+// mustUserID возвращает ID пользователя по email
+func mustUserID(t *testing.T, s *apitest.Store, email string) int {
+	t.Helper()
+	u, err := s.GetUserByEmail(context.Background(), email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.ID
+}
+
+func TestStore_ExportUserDataRewards(t *testing.T) {
+	ctx := context.Background()
+	store := apitest.NewStore()
+	ids := map[string]int{}
+	for _, name := range []string{"alice", "bob"} {
+		id, err := store.CreateUser(ctx, storage.CreateUserParams{User: storage.User{Username: name, Email: name + "@example.com"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[name] = id
+	}
+	store.AddReward(ids["alice"], ids["bob"], 300)
+	if _, err := store.RedeemReward(ctx, ids["alice"], 120, "payout"); err != nil {
+		t.Fatal(err)
+	}
+
+	export, err := store.ExportUserData(ctx, ids["alice"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(export.Rewards) != 1 || export.Rewards[0].Referee != "bob" || export.Rewards[0].Status != storage.RewardVested {
+		t.Errorf("rewards = %+v, want one vested reward for bob", export.Rewards)
+	}
+	if len(export.Redemptions) != 1 || export.Redemptions[0].Amount != -120 {
+		t.Errorf("redemptions = %+v, want one of -120", export.Redemptions)
+	}
+}
+
+func TestStore_AnonymizeUserDropsWebhooksAndTokens(t *testing.T) {
+	ctx := context.Background()
+	store := apitest.NewStore()
+	id, err := store.CreateUser(ctx, storage.CreateUserParams{User: storage.User{Username: "bob", Email: "bob@example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payloads := []string{
+		fmt.Sprintf(`{"event": "user.registered", "data": {"id": %d, "email": "bob@example.com"}}`, id),
+		fmt.Sprintf(`{"event": "referral.created", "data": {"code": "X", "referee": {"id": %d}}}`, id),
+		`{"event": "user.registered", "data": {"id": 999999, "email": "carol@example.com"}}`,
+	}
+	for _, p := range payloads {
+		if err := store.EnqueueWebhook(ctx, "test", json.RawMessage(p), []string{"https://hooks.example.com"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expires := time.Now().Add(time.Hour)
+	if err := store.ConsumeMagicLinkToken(ctx, "jti-1", "Bob@example.com", expires); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.AnonymizeUser(ctx, id, id); err != nil {
+		t.Fatal(err)
+	}
+	deliveries, err := store.ListWebhookDeliveries(ctx, storage.WebhookDeliveryFilter{}, 10, 0)
+	if err != nil || len(deliveries) != 1 || !strings.Contains(string(deliveries[0].Payload), "carol") {
+		t.Errorf("deliveries after anonymize = %+v, %v; want only carol's event", deliveries, err)
+	}
+	// запись об использованной ссылке удалена вместе с email
+	if err := store.ConsumeMagicLinkToken(ctx, "jti-1", "bob@example.com", expires); err != nil {
+		t.Errorf("ConsumeMagicLinkToken() after anonymize = %v, want the record gone", err)
+	}
+}
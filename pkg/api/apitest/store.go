@@ -0,0 +1,2625 @@
+package apitest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gorefer.go/pkg/auth"
+	"gorefer.go/pkg/onboarding"
+	"gorefer.go/pkg/rewards"
+	"gorefer.go/pkg/storage"
+)
+
+// Store - хранилище в памяти, реализующее storage.DBInterface. Повторяет
+// поведение storage.DB в объеме, достаточном для тестов обработчиков:
+// ошибки ErrNotFound, ErrCodeTaken, ErrEmailTaken и ErrClientTokenUsed,
+// резервирование кодов и учет использований. Безопасно для конкурентного
+// использования.
+type Store struct {
+	mu     sync.Mutex
+	now    func() time.Time
+	nextID int
+
+	users  map[int]*storedUser
+	codes  map[int]*storedCode
+	links  []Link
+	clicks map[int]int // число переходов по ID кода
+	// ID кода по ID перехода
+	clickCodes map[int]int
+	// удаленные коды, см. storage.CodeArchive
+	archive []archivedCode
+	audit   []storedAudit
+	flags   map[int]storage.ReferrerFlag // непросмотренные, по ID реферера
+	// разобранные отметки, см. ReviewReferrerFlag
+	reviewedFlags []storage.ReferrerFlag
+
+	rewardTiers rewards.Tiers
+	onboarding  onboarding.Rules
+	rewards     []storedReward
+	redemptions []storage.Redemption
+	chainDepth  storage.ChainDepth
+
+	termsVersion string
+	terms        map[termsKey]storage.TermsAcceptance
+
+	consumedTokens map[string]string // jti -> email
+	usedActions    map[string]bool   // использованные nonce токенов действий
+	logins         []storage.LoginEvent
+	webhooks       []storage.WebhookDelivery
+	apiKeys        []storedAPIKey
+	codeCreations  map[int][]time.Time // времена создания кодов по ID пользователя
+	limits         map[int]storage.UserLimits
+	statements     []storedStatement
+	registrations  []storedRegistration
+	disputes       []storage.ReferralDispute
+}
+
+var _ storage.DBInterface = (*Store)(nil)
+
+// Окно повторной регистрации, как у storage.DB
+const registrationRetryWindow = 10 * time.Minute
+
+type storedUser struct {
+	storage.User
+	Source       string
+	IP           string
+	UserAgent    string
+	Timezone     string
+	CreatedAt    time.Time
+	LastLoginAt  *time.Time
+	AnonymizedAt *time.Time
+	// VanityLinkOptOut - ссылка /r/@username отключена
+	VanityLinkOptOut bool
+	// Steps - выполненные шаги знакомства с сервисом по порядку
+	Steps []string
+}
+
+type storedCode struct {
+	storage.ReferralCode
+	Status        string
+	ReservedEmail string
+	ClientToken   string
+	CreatedAt     time.Time
+	RemindedAt    *time.Time
+}
+
+type archivedCode struct {
+	storedCode
+	Clicks     int
+	ArchivedAt time.Time
+}
+
+type storedAudit struct {
+	storage.AuditEntry
+	TargetUserID int
+}
+
+type storedAPIKey struct {
+	storage.APIKey
+	Hash string
+}
+
+type termsKey struct {
+	UserID  int
+	Version string
+}
+
+type storedReward struct {
+	ID         int
+	ReferrerID int
+	RefereeID  int
+	Tier       int
+	Amount     int64
+	Vested     bool
+	VestedAt   time.Time
+	CreatedAt  time.Time
+	// storage.RewardPendingReview, storage.RewardForfeited или пусто
+	ReviewStatus string
+}
+
+// Link - реферальная связь, см. Store.Links.
+type Link struct {
+	ReferrerID int
+	RefereeID  int
+	Code       string
+	Channel    string
+	ClickID    int
+	Depth      int
+	CreatedAt  time.Time
+}
+
+// NewStore создает пустое хранилище.
+func NewStore() *Store {
+	return &Store{
+		now:        time.Now,
+		users:      map[int]*storedUser{},
+		codes:      map[int]*storedCode{},
+		flags:      map[int]storage.ReferrerFlag{},
+		clicks:     map[int]int{},
+		clickCodes: map[int]int{},
+		terms:      map[termsKey]storage.TermsAcceptance{},
+
+		consumedTokens: map[string]string{},
+		usedActions:    map[string]bool{},
+		codeCreations:  map[int][]time.Time{},
+		limits:         map[int]storage.UserLimits{},
+	}
+}
+
+func (s *Store) id() int {
+	s.nextID++
+	return s.nextID
+}
+
+func (s *Store) userByEmail(email string) *storedUser {
+	for _, u := range s.users {
+		if strings.EqualFold(u.Email, email) {
+			return u
+		}
+	}
+	return nil
+}
+
+// userByUsername ищет пользователя по имени без учета регистра, как
+// уникальный индекс users_username_lower_key.
+func (s *Store) userByUsername(username string) *storedUser {
+	for _, u := range s.users {
+		if strings.EqualFold(u.Username, username) {
+			return u
+		}
+	}
+	return nil
+}
+
+func (s *Store) codeByValue(code string) *storedCode {
+	for _, c := range s.codes {
+		if c.Code == code {
+			return c
+		}
+	}
+	return nil
+}
+
+// codeByUser возвращает последний созданный код пользователя.
+func (s *Store) codeByUser(userID int) *storedCode {
+	var last *storedCode
+	for _, c := range s.userCodes(userID) {
+		if c.Status == storage.CodeStatusActive {
+			last = c
+		}
+	}
+	return last
+}
+
+// userCodes возвращает коды пользователя в порядке создания.
+func (s *Store) userCodes(userID int) []*storedCode {
+	var codes []*storedCode
+	for _, c := range s.codes {
+		if c.UserID == userID {
+			codes = append(codes, c)
+		}
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i].ID < codes[j].ID })
+	return codes
+}
+
+// insertUser добавляет пользователя и активирует зарезервированный для
+// его email код. Вызывается под s.mu.
+func (s *Store) insertUser(params storage.CreateUserParams) (int, error) {
+	if s.userByEmail(params.Email) != nil {
+		return 0, storage.ErrEmailTaken
+	}
+	if s.userByUsername(params.Username) != nil {
+		return 0, storage.ErrUsernameTaken
+	}
+	u := &storedUser{
+		User:      params.User,
+		Source:    storage.NormalizeSource(params.Source),
+		IP:        params.IP,
+		UserAgent: params.UserAgent,
+		Timezone:  "UTC",
+		CreatedAt: s.now(),
+	}
+	u.ID = s.id()
+	if u.Role == "" {
+		u.Role = storage.RoleUser
+	}
+	s.users[u.ID] = u
+
+	for _, c := range s.codes {
+		if c.Status == storage.CodeStatusReserved && strings.EqualFold(c.ReservedEmail, u.Email) {
+			c.Status = storage.CodeStatusActive
+			c.UserID = u.ID
+			c.ReservedEmail = ""
+		}
+	}
+	return u.ID, nil
+}
+
+// CreateUser добавляет пользователя.
+func (s *Store) CreateUser(ctx context.Context, params storage.CreateUserParams) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.insertUser(params)
+}
+
+// GetUserByEmail возвращает пользователя по email.
+func (s *Store) GetUserByEmail(ctx context.Context, email string) (storage.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u := s.userByEmail(email); u != nil {
+		return u.User, nil
+	}
+	return storage.User{}, storage.ErrNotFound
+}
+
+// GetUserByID возвращает пользователя по ID.
+func (s *Store) GetUserByID(ctx context.Context, id int) (storage.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, ok := s.users[id]; ok {
+		return u.User, nil
+	}
+	return storage.User{}, storage.ErrNotFound
+}
+
+// EmailExists сообщает, зарегистрирован ли email.
+func (s *Store) EmailExists(ctx context.Context, email string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.userByEmail(email) != nil, nil
+}
+
+// SetTimezone сохраняет часовой пояс пользователя.
+func (s *Store) SetTimezone(ctx context.Context, userID int, timezone string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[userID]
+	if !ok {
+		return storage.ErrNotFound
+	}
+	u.Timezone = timezone
+	s.completeStep(userID, onboarding.StepProfileCompleted)
+	return nil
+}
+
+// SetUsername меняет имя пользователя.
+func (s *Store) SetUsername(ctx context.Context, userID int, username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[userID]
+	if !ok {
+		return storage.ErrNotFound
+	}
+	if other := s.userByUsername(username); other != nil && other.ID != userID {
+		return storage.ErrUsernameTaken
+	}
+	u.Username = username
+	return nil
+}
+
+// SetVanityLinkOptOut отключает или включает ссылку /r/@username.
+func (s *Store) SetVanityLinkOptOut(ctx context.Context, userID int, optOut bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[userID]
+	if !ok {
+		return storage.ErrNotFound
+	}
+	u.VanityLinkOptOut = optOut
+	return nil
+}
+
+// UpdateProfile меняет заданные поля профиля; если имя занято, не
+// меняет ничего.
+func (s *Store) UpdateProfile(ctx context.Context, userID int, p storage.ProfileUpdate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[userID]
+	if !ok {
+		return storage.ErrNotFound
+	}
+	if p.Username != "" {
+		if other := s.userByUsername(p.Username); other != nil && other.ID != userID {
+			return storage.ErrUsernameTaken
+		}
+		u.Username = p.Username
+	}
+	if p.Timezone != "" {
+		u.Timezone = p.Timezone
+		s.completeStep(userID, onboarding.StepProfileCompleted)
+	}
+	if p.VanityLinkOptOut != nil {
+		u.VanityLinkOptOut = *p.VanityLinkOptOut
+	}
+	return nil
+}
+
+// GetProfile возвращает профиль пользователя.
+func (s *Store) GetProfile(ctx context.Context, userID int) (storage.Profile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[userID]
+	if !ok {
+		return storage.Profile{}, storage.ErrNotFound
+	}
+	return storage.Profile{
+		ID:          u.ID,
+		Username:    u.Username,
+		Email:       u.Email,
+		Role:        u.Role,
+		Timezone:    u.Timezone,
+		CreatedAt:   u.CreatedAt,
+		LastLoginAt: u.LastLoginAt,
+
+		VanityLinkOptOut: u.VanityLinkOptOut,
+	}, nil
+}
+
+// RecordLogin запоминает попытку входа; успешная обновляет время
+// последнего входа.
+func (s *Store) RecordLogin(ctx context.Context, e storage.LoginEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[e.UserID]
+	if !ok {
+		return storage.ErrNotFound
+	}
+	s.nextID++
+	e.ID = s.nextID
+	e.CreatedAt = s.now()
+	s.logins = append(s.logins, e)
+	if e.Success {
+		u.LastLoginAt = &e.CreatedAt
+		s.completeStep(e.UserID, onboarding.StepFirstLogin)
+	}
+	return nil
+}
+
+// ListLoginEvents возвращает страницу попыток входа пользователя,
+// новые первыми.
+func (s *Store) ListLoginEvents(ctx context.Context, userID, limit, offset int) ([]storage.LoginEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events := []storage.LoginEvent{}
+	for i := len(s.logins) - 1; i >= 0 && len(events) < limit; i-- {
+		if s.logins[i].UserID != userID {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		events = append(events, s.logins[i])
+	}
+	return events, nil
+}
+
+// AnonymizeUser заменяет персональные данные пользователя заглушками.
+func (s *Store) AnonymizeUser(ctx context.Context, userID, actorID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[userID]
+	if !ok {
+		return storage.ErrNotFound
+	}
+	if u.AnonymizedAt != nil {
+		return storage.ErrAlreadyAnonymized
+	}
+	for jti, email := range s.consumedTokens {
+		if strings.EqualFold(email, u.Email) {
+			delete(s.consumedTokens, jti)
+		}
+	}
+	webhooks := s.webhooks[:0]
+	for _, d := range s.webhooks {
+		if !webhookAbout(d.Payload, userID) {
+			webhooks = append(webhooks, d)
+		}
+	}
+	s.webhooks = webhooks
+	now := s.now()
+	u.Username = fmt.Sprintf("deleted-user-%d", userID)
+	u.Email = fmt.Sprintf("deleted-%d@anonymized.invalid", userID)
+	u.Password = ""
+	u.IP, u.UserAgent = "", ""
+	u.AnonymizedAt = &now
+	for key, a := range s.terms {
+		if key.UserID == userID {
+			a.IP = ""
+			s.terms[key] = a
+		}
+	}
+	for id, c := range s.codes {
+		if c.UserID == userID {
+			delete(s.codes, id)
+		}
+	}
+	archive := s.archive[:0]
+	for _, a := range s.archive {
+		if a.UserID != userID {
+			archive = append(archive, a)
+		}
+	}
+	s.archive = archive
+	logins := s.logins[:0]
+	for _, e := range s.logins {
+		if e.UserID != userID {
+			logins = append(logins, e)
+		}
+	}
+	s.logins = logins
+	for i := range s.disputes {
+		d := &s.disputes[i]
+		if d.FiledBy == userID || d.ReferrerID == userID || d.RefereeID == userID {
+			d.Message, d.ResolutionNote = "", ""
+		}
+	}
+	for i := range s.audit {
+		e := &s.audit[i]
+		if e.TargetUserID == userID || *e.ActorID == userID {
+			e.Payload = nil
+		}
+	}
+	s.appendAudit(actorID, storage.AuditUserAnonymized, userID, nil)
+	return nil
+}
+
+// ExportUserData возвращает выгрузку данных пользователя.
+func (s *Store) ExportUserData(ctx context.Context, userID int) (storage.UserExport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[userID]
+	if !ok {
+		return storage.UserExport{}, storage.ErrNotFound
+	}
+	export := storage.UserExport{
+		Profile: storage.ExportProfile{
+			ID:           u.ID,
+			Username:     u.Username,
+			Email:        u.Email,
+			Role:         u.Role,
+			SignupSource: u.Source,
+			Timezone:     u.Timezone,
+			CreatedAt:    u.CreatedAt,
+			LastLoginAt:  u.LastLoginAt,
+			AnonymizedAt: u.AnonymizedAt,
+		},
+		ReferralCodes: []storage.ReferralCode{},
+		Referrals:     []storage.ExportReferral{},
+		Rewards:       []storage.ExportReward{},
+		Redemptions:   []storage.Redemption{},
+		AuditLog:      []storage.AuditEntry{},
+	}
+	if c := s.codeByUser(userID); c != nil {
+		export.ReferralCodes = append(export.ReferralCodes, c.ReferralCode)
+	}
+	for _, l := range s.links {
+		code := l.Code
+		switch userID {
+		case l.ReferrerID:
+			export.Referrals = append(export.Referrals, storage.ExportReferral{
+				Username: s.users[l.RefereeID].Username, Code: &code, JoinedAt: l.CreatedAt,
+			})
+		case l.RefereeID:
+			export.Referrer = &storage.ExportReferral{
+				Username: s.users[l.ReferrerID].Username, Code: &code, JoinedAt: l.CreatedAt,
+			}
+		}
+	}
+	for _, r := range s.rewards {
+		if r.ReferrerID != userID {
+			continue
+		}
+		reward := storage.ExportReward{
+			Referee: s.users[r.RefereeID].Username, Tier: r.Tier, Amount: r.Amount,
+			Status: storage.RewardPending, CreatedAt: r.CreatedAt,
+		}
+		switch {
+		case r.ReviewStatus != "":
+			reward.Status = r.ReviewStatus
+		case r.Vested:
+			vestedAt := r.VestedAt
+			reward.Status, reward.VestedAt = storage.RewardVested, &vestedAt
+		}
+		export.Rewards = append(export.Rewards, reward)
+	}
+	for _, r := range s.redemptions {
+		if r.UserID == userID {
+			export.Redemptions = append(export.Redemptions, r)
+		}
+	}
+	for _, e := range s.audit {
+		if e.TargetUserID == userID {
+			export.AuditLog = append(export.AuditLog, e.AuditEntry)
+		}
+	}
+	return export, nil
+}
+
+// CreateReferralCode заменяет реферальный код пользователя.
+func (s *Store) CreateReferralCode(ctx context.Context, userID int, code string, expiresAt int64, clientToken string, metadata json.RawMessage, domain storage.DomainRestriction) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if clientToken != "" {
+		for _, c := range s.codes {
+			if c.UserID == userID && c.ClientToken == clientToken {
+				return storage.ErrClientTokenUsed
+			}
+		}
+	}
+	if c := s.codeByValue(code); c != nil && c.UserID != userID {
+		return storage.ErrCodeTaken
+	}
+	for _, c := range s.userCodes(userID) {
+		s.archiveCode(c)
+	}
+	c := &storedCode{
+		ReferralCode: storage.ReferralCode{
+			UserID: userID, Code: code, ExpiresAt: time.Unix(expiresAt, 0).UTC(), Metadata: metadataOrEmpty(metadata),
+			DomainRestriction: domain,
+		},
+		Status:      storage.CodeStatusActive,
+		ClientToken: clientToken,
+		CreatedAt:   s.now(),
+	}
+	c.ID = s.id()
+	s.codes[c.ID] = c
+	s.codeCreations[userID] = append(s.codeCreations[userID], c.CreatedAt)
+	return nil
+}
+
+// AddReferralCode добавляет код, не заменяя существующие.
+func (s *Store) AddReferralCode(ctx context.Context, nc storage.NewReferralCode, limit int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	active := 0
+	for _, c := range s.userCodes(nc.UserID) {
+		if nc.ClientToken != "" && c.ClientToken == nc.ClientToken {
+			return storage.ErrClientTokenUsed
+		}
+		if c.Status == storage.CodeStatusActive && c.ExpiresAt.After(s.now()) {
+			active++
+		}
+	}
+	if active >= limit {
+		return storage.ErrCodeLimit
+	}
+	if s.codeByValue(nc.Code) != nil {
+		return storage.ErrCodeTaken
+	}
+	c := &storedCode{
+		ReferralCode: storage.ReferralCode{
+			UserID: nc.UserID, Code: nc.Code, Label: nc.Label,
+			ExpiresAt: time.Unix(nc.ExpiresAt, 0).UTC(), Metadata: metadataOrEmpty(nc.Metadata),
+			DomainRestriction: nc.Domain,
+		},
+		Status:      storage.CodeStatusActive,
+		ClientToken: nc.ClientToken,
+		CreatedAt:   s.now(),
+	}
+	c.ID = s.id()
+	s.codes[c.ID] = c
+	s.codeCreations[nc.UserID] = append(s.codeCreations[nc.UserID], c.CreatedAt)
+	return nil
+}
+
+// ListUserReferralCodes возвращает коды пользователя в порядке создания.
+func (s *Store) ListUserReferralCodes(ctx context.Context, userID int) ([]storage.ReferralCode, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	codes := []storage.ReferralCode{}
+	for _, c := range s.userCodes(userID) {
+		codes = append(codes, c.ReferralCode)
+	}
+	return codes, nil
+}
+
+// GetCodeStats возвращает переходы и рефералы по каждому коду
+// пользователя, с includeArchived - и по кодам из архива.
+func (s *Store) GetCodeStats(ctx context.Context, userID int, includeArchived bool) ([]storage.ReferralCodeStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := []storage.ReferralCodeStats{}
+	for _, c := range s.userCodes(userID) {
+		st := storage.ReferralCodeStats{Code: c.Code, Label: c.Label, Clicks: s.clicks[c.ID]}
+		for _, l := range s.links {
+			if l.Code == c.Code && !l.CreatedAt.Before(c.CreatedAt) {
+				st.Referrals++
+			}
+		}
+		stats = append(stats, st)
+	}
+	if includeArchived {
+		for _, a := range s.userArchive(userID) {
+			archivedAt := a.ArchivedAt
+			st := storage.ReferralCodeStats{Code: a.Code, Label: a.Label, Clicks: a.Clicks, ArchivedAt: &archivedAt}
+			for _, l := range s.links {
+				if l.ReferrerID == userID && l.Code == a.Code && a.active(l.CreatedAt) {
+					st.Referrals++
+				}
+			}
+			stats = append(stats, st)
+		}
+	}
+	return stats, nil
+}
+
+// userArchive возвращает архивные коды пользователя в порядке создания.
+func (s *Store) userArchive(userID int) []archivedCode {
+	var codes []archivedCode
+	for _, a := range s.archive {
+		if a.UserID == userID {
+			codes = append(codes, a)
+		}
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i].ID < codes[j].ID })
+	return codes
+}
+
+// active сообщает, действовал ли код в момент at.
+func (a archivedCode) active(at time.Time) bool {
+	return !at.Before(a.CreatedAt) && at.Before(a.ArchivedAt)
+}
+
+// CompareReferralCodes возвращает показатели текущих и прежних кодов
+// пользователя, как storage.DB.
+func (s *Store) CompareReferralCodes(ctx context.Context, userID int, includeArchived bool) ([]storage.CodeComparison, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	codes := []storage.CodeComparison{}
+	seen := map[string]bool{}
+	count := func(cmp *storage.CodeComparison, since time.Time) {
+		for _, l := range s.links {
+			if l.ReferrerID == userID && l.Code == cmp.Code && !l.CreatedAt.Before(since) {
+				cmp.Signups++
+				if l.Channel == storage.ChannelLinkClick {
+					cmp.LinkSignups++
+				}
+			}
+		}
+	}
+	for _, c := range s.userCodes(userID) {
+		cmp := storage.CodeComparison{Code: c.Code, Label: c.Label, Current: true, Clicks: s.clicks[c.ID]}
+		count(&cmp, c.CreatedAt)
+		seen[c.Code] = true
+		codes = append(codes, cmp)
+	}
+	if includeArchived {
+		for _, a := range s.userArchive(userID) {
+			archivedAt := a.ArchivedAt
+			cmp := storage.CodeComparison{Code: a.Code, Label: a.Label, Clicks: a.Clicks, ArchivedAt: &archivedAt}
+			for _, l := range s.links {
+				if l.ReferrerID == userID && l.Code == a.Code && a.active(l.CreatedAt) {
+					cmp.Signups++
+					if l.Channel == storage.ChannelLinkClick {
+						cmp.LinkSignups++
+					}
+				}
+			}
+			seen[a.Code] = true
+			codes = append(codes, cmp)
+		}
+	}
+	for _, l := range s.links {
+		if l.ReferrerID != userID || l.Code == "" || seen[l.Code] {
+			continue
+		}
+		cmp := storage.CodeComparison{Code: l.Code}
+		count(&cmp, time.Time{})
+		seen[l.Code] = true
+		codes = append(codes, cmp)
+	}
+	for i := range codes {
+		codes[i].ConversionRate = storage.ConversionRate(codes[i].LinkSignups, codes[i].Clicks)
+	}
+	sort.Slice(codes, func(i, j int) bool {
+		a, b := codes[i], codes[j]
+		if a.Signups != b.Signups {
+			return a.Signups > b.Signups
+		}
+		if a.Clicks != b.Clicks {
+			return a.Clicks > b.Clicks
+		}
+		return a.Code < b.Code
+	})
+	return codes, nil
+}
+
+// metadataOrEmpty повторяет значение по умолчанию столбца metadata.
+func metadataOrEmpty(metadata json.RawMessage) json.RawMessage {
+	if len(metadata) == 0 {
+		return json.RawMessage(`{}`)
+	}
+	return append(json.RawMessage(nil), metadata...)
+}
+
+// UpdateReferralCode меняет текущий код пользователя и при смене срока
+// снимает отметку напоминания. Срок не проверяется.
+func (s *Store) UpdateReferralCode(ctx context.Context, userID int, u storage.ReferralCodeUpdate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.codeByUser(userID)
+	if u.CodeID != 0 {
+		c = nil
+		for _, uc := range s.userCodes(userID) {
+			if uc.ID == u.CodeID {
+				c = uc
+			}
+		}
+	}
+	if c == nil {
+		return storage.ErrNotFound
+	}
+	if len(u.Metadata) > 0 {
+		c.Metadata = metadataOrEmpty(u.Metadata)
+	}
+	if u.Domain != nil {
+		c.DomainRestriction = *u.Domain
+	}
+	if u.ExpiresAt != nil {
+		c.ExpiresAt = time.Unix(*u.ExpiresAt, 0).UTC()
+		c.RemindedAt = nil
+	}
+	return nil
+}
+
+// ListReferralCodes возвращает страницу кодов в порядке создания.
+// Фильтр сравнивает только строковые значения верхнего уровня.
+func (s *Store) ListReferralCodes(ctx context.Context, filter storage.ReferralCodeFilter, limit, offset int) ([]storage.ReferralCode, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var matched []*storedCode
+	for _, c := range s.codes {
+		if filter.MetaKey != "" {
+			var m map[string]interface{}
+			if err := json.Unmarshal(c.Metadata, &m); err != nil || m[filter.MetaKey] != filter.MetaValue {
+				continue
+			}
+		}
+		matched = append(matched, c)
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i].ID < matched[j].ID })
+
+	codes := []storage.ReferralCode{}
+	for i := offset; i < len(matched) && len(codes) < limit; i++ {
+		codes = append(codes, matched[i].ReferralCode)
+	}
+	return codes, nil
+}
+
+// DeleteReferralCode переносит коды пользователя в архив.
+func (s *Store) DeleteReferralCode(ctx context.Context, userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.userCodes(userID) {
+		s.archiveCode(c)
+	}
+	return nil
+}
+
+// archiveCode переносит код в архив вместе с числом переходов.
+func (s *Store) archiveCode(c *storedCode) {
+	s.archive = append(s.archive, archivedCode{storedCode: *c, Clicks: s.clicks[c.ID], ArchivedAt: s.now()})
+	delete(s.codes, c.ID)
+	delete(s.clicks, c.ID)
+}
+
+// PurgeCodeArchive удаляет не более limit записей архива раньше before.
+func (s *Store) PurgeCodeArchive(ctx context.Context, before time.Time, limit int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	purged := 0
+	archive := s.archive[:0]
+	for _, a := range s.archive {
+		if purged < limit && a.ArchivedAt.Before(before) {
+			purged++
+			continue
+		}
+		archive = append(archive, a)
+	}
+	s.archive = archive
+	return purged, nil
+}
+
+// DeleteReferralCodeByCode удаляет код по значению и записывает аудит.
+func (s *Store) DeleteReferralCodeByCode(ctx context.Context, code string, actorID int) (storage.DeletedReferralCode, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.codeByValue(code)
+	if c == nil {
+		return storage.DeletedReferralCode{}, storage.ErrNotFound
+	}
+	s.archiveCode(c)
+	d := storage.DeletedReferralCode{ReferralCode: c.ReferralCode, Status: c.Status, OwnerEmail: c.ReservedEmail}
+	if u, ok := s.users[c.UserID]; ok {
+		d.OwnerUsername = u.Username
+		d.OwnerEmail = u.Email
+	}
+	payload, err := json.Marshal(map[string]string{"code": d.Code, "owner_email": d.OwnerEmail})
+	if err != nil {
+		return storage.DeletedReferralCode{}, err
+	}
+	s.appendAudit(actorID, storage.AuditCodeDeleted, c.UserID, payload)
+	return d, nil
+}
+
+// TransferReferralCode передает код newOwnerID, с includeHistory - вместе
+// со связями по нему и начислениями за них, и записывает аудит.
+func (s *Store) TransferReferralCode(ctx context.Context, code string, newOwnerID int, includeHistory bool, actorID int) (storage.CodeTransfer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.codeByValue(code)
+	if c == nil {
+		return storage.CodeTransfer{}, storage.ErrNotFound
+	}
+	if c.UserID == 0 || c.UserID == newOwnerID {
+		return storage.CodeTransfer{}, storage.ErrTransferInvalid
+	}
+	if _, ok := s.users[c.UserID]; !ok {
+		return storage.CodeTransfer{}, storage.ErrNotFound
+	}
+	if _, ok := s.users[newOwnerID]; !ok {
+		return storage.CodeTransfer{}, storage.ErrNotFound
+	}
+	for _, other := range s.userCodes(newOwnerID) {
+		if other.Status == storage.CodeStatusActive && other.ExpiresAt.After(s.now()) {
+			return storage.CodeTransfer{}, storage.ErrOwnerHasActiveCode
+		}
+	}
+
+	t := storage.CodeTransfer{Code: code, FromUserID: c.UserID, ToUserID: newOwnerID, IncludeHistory: includeHistory}
+	if includeHistory {
+		referees := map[int]bool{}
+		for _, l := range s.links {
+			if l.Code == code && l.ReferrerID == t.FromUserID {
+				if l.RefereeID == newOwnerID {
+					return storage.CodeTransfer{}, storage.ErrTransferInvalid
+				}
+				referees[l.RefereeID] = true
+			}
+		}
+		for _, r := range s.rewards {
+			if r.ReferrerID == t.FromUserID && referees[r.RefereeID] {
+				t.RewardsMoved++
+				t.AmountMoved += r.Amount
+			}
+		}
+		if s.balance(t.FromUserID) < t.AmountMoved {
+			return storage.CodeTransfer{}, storage.ErrInsufficientBalance
+		}
+		for i, l := range s.links {
+			if l.Code == code && l.ReferrerID == t.FromUserID {
+				s.links[i].ReferrerID = newOwnerID
+				t.LinksMoved++
+			}
+		}
+		for i, r := range s.rewards {
+			if r.ReferrerID == t.FromUserID && referees[r.RefereeID] {
+				s.rewards[i].ReferrerID = newOwnerID
+			}
+		}
+	}
+
+	c.UserID = newOwnerID
+	c.ClientToken = ""
+	payload, err := json.Marshal(t)
+	if err != nil {
+		return storage.CodeTransfer{}, err
+	}
+	s.appendAudit(actorID, storage.AuditCodeTransferred, t.FromUserID, payload)
+	return t, nil
+}
+
+// GetReferralCodeByEmail возвращает код пользователя с указанным email.
+func (s *Store) GetReferralCodeByEmail(ctx context.Context, email string) (storage.ReferralCode, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u := s.userByEmail(email); u != nil {
+		if c := s.codeByUser(u.ID); c != nil {
+			return c.ReferralCode, nil
+		}
+	}
+	return storage.ReferralCode{}, storage.ErrNotFound
+}
+
+// GetActiveReferralCodeByUsername возвращает последний действующий код
+// пользователя для ссылки /r/@username.
+func (s *Store) GetActiveReferralCodeByUsername(ctx context.Context, username string) (storage.ReferralCode, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.userByUsername(username)
+	if u == nil || u.VanityLinkOptOut || u.AnonymizedAt != nil {
+		return storage.ReferralCode{}, storage.ErrNotFound
+	}
+	var last *storedCode
+	for _, c := range s.userCodes(u.ID) {
+		if c.Status == storage.CodeStatusActive && c.ExpiresAt.After(s.now()) {
+			last = c
+		}
+	}
+	if last == nil {
+		return storage.ReferralCode{}, storage.ErrNotFound
+	}
+	return last.ReferralCode, nil
+}
+
+// GetReferralCodeByUserID возвращает код пользователя.
+func (s *Store) GetReferralCodeByUserID(ctx context.Context, userID int) (storage.ReferralCode, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c := s.codeByUser(userID); c != nil {
+		return c.ReferralCode, nil
+	}
+	return storage.ReferralCode{}, storage.ErrNotFound
+}
+
+// GetReferralCodeByClientToken возвращает код, созданный с токеном клиента.
+func (s *Store) GetReferralCodeByClientToken(ctx context.Context, userID int, clientToken string) (storage.ReferralCode, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.codes {
+		if c.UserID == userID && c.ClientToken == clientToken {
+			return c.ReferralCode, nil
+		}
+	}
+	return storage.ReferralCode{}, storage.ErrNotFound
+}
+
+// GetReferralCodeDetails возвращает подробности о коде.
+func (s *Store) GetReferralCodeDetails(ctx context.Context, code string) (storage.ReferralCodeDetails, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.codeByValue(code)
+	if c == nil {
+		return storage.ReferralCodeDetails{}, storage.ErrNotFound
+	}
+	d := storage.ReferralCodeDetails{
+		ReferralCode: c.ReferralCode,
+		Status:       c.Status,
+		OwnerEmail:   c.ReservedEmail,
+		Clicks:       s.clicks[c.ID],
+		CreatedAt:    c.CreatedAt,
+	}
+	if u, ok := s.users[c.UserID]; ok {
+		d.OwnerUsername = u.Username
+		d.OwnerEmail = u.Email
+	}
+	return d, nil
+}
+
+// ReserveReferralCode резервирует код для еще не зарегистрированного email.
+func (s *Store) ReserveReferralCode(ctx context.Context, email, code string, expiresAt int64, domain storage.DomainRestriction) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.userByEmail(email) != nil {
+		return storage.ErrEmailTaken
+	}
+	if s.codeByValue(code) != nil {
+		return storage.ErrCodeTaken
+	}
+	for _, c := range s.codes {
+		if c.Status == storage.CodeStatusReserved && strings.EqualFold(c.ReservedEmail, email) {
+			return storage.ErrEmailTaken
+		}
+	}
+	c := &storedCode{
+		ReferralCode: storage.ReferralCode{
+			Code: code, ExpiresAt: time.Unix(expiresAt, 0).UTC(), Metadata: metadataOrEmpty(nil),
+			DomainRestriction: domain,
+		},
+		Status:        storage.CodeStatusReserved,
+		ReservedEmail: email,
+		CreatedAt:     s.now(),
+	}
+	c.ID = s.id()
+	s.codes[c.ID] = c
+	return nil
+}
+
+// RegisterWithReferralCode регистрирует пользователя по действующему коду.
+func (s *Store) RegisterWithReferralCode(ctx context.Context, referralCode string, params storage.CreateUserParams) (storage.ReferralRegistration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.codeByValue(referralCode)
+	if c == nil || c.Status != storage.CodeStatusActive || !c.ExpiresAt.After(s.now()) || !s.termsAccepted(c.UserID) {
+		return storage.ReferralRegistration{}, fmt.Errorf("apitest: referral code %q: %w", referralCode, storage.ErrCodeInvalid)
+	}
+	if !c.Allows(params.Email) {
+		return storage.ReferralRegistration{}, fmt.Errorf("apitest: referral code %q: %w", referralCode, storage.ErrCodeDomainMismatch)
+	}
+	depth, err := s.linkDepth(c.UserID)
+	if err != nil {
+		return storage.ReferralRegistration{}, fmt.Errorf("apitest: referral code %q: %w", referralCode, err)
+	}
+	userID, ok := s.unlinkedUser(params)
+	switch {
+	case ok && s.inReferrerChain(c.UserID, userID):
+		return storage.ReferralRegistration{}, storage.ErrSelfReferral
+	case !ok:
+		if userID, err = s.insertUser(params); err != nil {
+			return storage.ReferralRegistration{}, err
+		}
+	}
+	s.addReferral(c, userID, depth, params.Channel, params.ClickID)
+	referrer := storage.UserRef{ID: c.UserID}
+	if u, ok := s.users[c.UserID]; ok {
+		referrer.Username = u.Username
+	}
+	return storage.ReferralRegistration{UserID: userID, Referrer: referrer}, nil
+}
+
+// linkDepth возвращает глубину новой связи реферера referrerID и
+// проверяет ее ограничениями хранилища. Вызывается под s.mu.
+func (s *Store) linkDepth(referrerID int) (int, error) {
+	depth := 0
+	for _, l := range s.links {
+		if l.RefereeID == referrerID && l.Depth > depth {
+			depth = l.Depth
+		}
+	}
+	depth++
+	return depth, s.chainDepth.Check(referrerID, depth)
+}
+
+// addReferral учитывает использование кода c, создает реферальную связь
+// глубины depth и начисляет вознаграждение. Вызывается под s.mu.
+func (s *Store) addReferral(c *storedCode, refereeID, depth int, channel string, clickID int) {
+	c.Uses++
+	if channel != storage.ChannelLinkClick {
+		channel = storage.ChannelManualCode
+	}
+	// переход другого или неизвестного кода не сохраняется
+	if s.clickCodes[clickID] != c.ID {
+		clickID = 0
+	}
+	s.links = append(s.links, Link{
+		ReferrerID: c.UserID, RefereeID: refereeID, Code: c.Code,
+		Channel: channel, ClickID: clickID, Depth: depth, CreatedAt: s.now(),
+	})
+	if tier, amount, ok := s.rewardTiers.For(s.referralCount(c.UserID)); ok {
+		s.insertReward(c.UserID, refereeID, tier, amount)
+	}
+}
+
+// Seed загружает тестовые данные профиля, как storage.DB.Seed:
+// пользователи, email которых уже есть, пропускаются. Пароль
+// пользователей - storage.SeedPassword.
+func (s *Store) Seed(ctx context.Context, profile string) error {
+	data, err := storage.SeedProfile(profile)
+	if err != nil {
+		return err
+	}
+	password, err := auth.HashPassword(storage.SeedPassword)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range data.Users {
+		if s.userByEmail(u.Email) != nil {
+			continue
+		}
+		if u.Code != "" && s.codeByValue(u.Code) != nil {
+			return fmt.Errorf("apitest: seed %s: %w", u.Username, storage.ErrCodeTaken)
+		}
+		var referrer *storedCode
+		var depth int
+		if u.Referrer != "" {
+			if referrer = s.codeByValue(u.Referrer); referrer == nil {
+				return fmt.Errorf("apitest: seed %s: %w", u.Username, storage.ErrCodeInvalid)
+			}
+			if depth, err = s.linkDepth(referrer.UserID); err != nil {
+				return fmt.Errorf("apitest: seed %s: %w", u.Username, err)
+			}
+		}
+
+		userID, err := s.insertUser(storage.CreateUserParams{
+			User:   storage.User{Username: u.Username, Email: u.Email, Password: password, Role: u.Role},
+			Source: storage.SourceWeb,
+		})
+		if err != nil {
+			return err
+		}
+		if u.Code != "" {
+			c := &storedCode{
+				ReferralCode: storage.ReferralCode{UserID: userID, Code: u.Code, ExpiresAt: storage.SeedCodeExpiresAt, Metadata: metadataOrEmpty(nil)},
+				Status:       storage.CodeStatusActive,
+				CreatedAt:    s.now(),
+			}
+			c.ID = s.id()
+			s.codes[c.ID] = c
+			s.clicks[c.ID] = u.Clicks
+		}
+		if referrer != nil {
+			s.addReferral(referrer, userID, depth, u.Channel, 0)
+		}
+	}
+	return nil
+}
+
+// SetChainDepth задает ограничения глубины реферальных цепочек, как
+// storage.WithChainDepth.
+func (s *Store) SetChainDepth(d storage.ChainDepth) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.chainDepth = d
+}
+
+// SetTermsVersion задает версию условий, которую должен принять
+// реферер, как storage.WithTermsVersion.
+func (s *Store) SetTermsVersion(version string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.termsVersion = version
+}
+
+// termsAccepted сообщает, действуют ли коды реферера при текущей версии
+// условий. Вызывается под s.mu.
+func (s *Store) termsAccepted(userID int) bool {
+	if s.termsVersion == "" {
+		return true
+	}
+	_, ok := s.terms[termsKey{userID, s.termsVersion}]
+	return ok
+}
+
+// AcceptTerms записывает принятие условий; повторное возвращает первое.
+func (s *Store) AcceptTerms(ctx context.Context, userID int, version, ip string) (storage.TermsAcceptance, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := termsKey{userID, version}
+	if a, ok := s.terms[key]; ok {
+		return a, nil
+	}
+	a := storage.TermsAcceptance{Version: version, AcceptedAt: s.now(), IP: ip}
+	s.terms[key] = a
+	return a, nil
+}
+
+// TermsAccepted сообщает, принял ли пользователь условия версии version.
+func (s *Store) TermsAccepted(ctx context.Context, userID int, version string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.terms[termsKey{userID, version}]
+	return ok, nil
+}
+
+// SetNow подменяет часы хранилища, например для проверки сроков.
+func (s *Store) SetNow(now func() time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.now = now
+}
+
+// ClaimExpiringCodes выбирает действующие коды, истекающие не позже
+// until, и помечает их напомненными.
+func (s *Store) ClaimExpiringCodes(ctx context.Context, until time.Time, limit int) ([]storage.ExpiringCode, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	var due []*storedCode
+	for _, c := range s.codes {
+		u, ok := s.users[c.UserID]
+		if !ok || u.AnonymizedAt != nil || c.RemindedAt != nil || c.Status != storage.CodeStatusActive ||
+			!c.ExpiresAt.After(now) || c.ExpiresAt.After(until) {
+			continue
+		}
+		due = append(due, c)
+	}
+	sort.Slice(due, func(i, j int) bool {
+		if !due[i].ExpiresAt.Equal(due[j].ExpiresAt) {
+			return due[i].ExpiresAt.Before(due[j].ExpiresAt)
+		}
+		return due[i].ID < due[j].ID
+	})
+	claimed := []storage.ExpiringCode{}
+	for _, c := range due {
+		if len(claimed) == limit {
+			break
+		}
+		c.RemindedAt = &now
+		u := s.users[c.UserID]
+		claimed = append(claimed, storage.ExpiringCode{
+			ID: c.ID, UserID: c.UserID, Code: c.Code, Label: c.Label, ExpiresAt: c.ExpiresAt,
+			Username: u.Username, Email: u.Email, Timezone: u.Timezone,
+		})
+	}
+	return claimed, nil
+}
+
+// ReleaseExpiringCode снимает отметку о напоминании.
+func (s *Store) ReleaseExpiringCode(ctx context.Context, codeID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.codes[codeID]; ok {
+		c.RemindedAt = nil
+	}
+	return nil
+}
+
+// SetRewardTiers задает ступени вознаграждения, как storage.WithRewardTiers.
+func (s *Store) SetRewardTiers(tiers rewards.Tiers) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rewardTiers = tiers
+}
+
+// SetOnboarding задает обязательные шаги знакомства с сервисом, как
+// storage.WithOnboarding.
+func (s *Store) SetOnboarding(rules onboarding.Rules) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onboarding = rules
+}
+
+// insertReward начисляет вознаграждение, удерживая его при открытой
+// отметке о реферере и иначе зачисляя, если приглашенный уже выполнил
+// обязательные шаги. Вызывается под s.mu.
+func (s *Store) insertReward(referrerID, refereeID, tier int, amount int64) {
+	var steps []string
+	if u, ok := s.users[refereeID]; ok {
+		steps = u.Steps
+	}
+	r := storedReward{ID: s.id(), ReferrerID: referrerID, RefereeID: refereeID, Tier: tier, Amount: amount, CreatedAt: s.now()}
+	if _, flagged := s.flags[referrerID]; flagged {
+		r.ReviewStatus = storage.RewardPendingReview
+	} else if s.onboarding.Done(steps) {
+		r.Vested, r.VestedAt = true, s.now()
+	}
+	s.rewards = append(s.rewards, r)
+}
+
+// completeStep отмечает шаг знакомства выполненным и зачисляет
+// вознаграждение за пользователя, если выполнены все обязательные шаги.
+// Вызывается под s.mu.
+func (s *Store) completeStep(userID int, step string) {
+	u, ok := s.users[userID]
+	if !ok {
+		return
+	}
+	for _, done := range u.Steps {
+		if done == step {
+			return
+		}
+	}
+	u.Steps = append(u.Steps, step)
+	if !s.onboarding.Done(u.Steps) {
+		return
+	}
+	s.vestRewards(userID)
+}
+
+// vestRewards зачисляет неудержанные вознаграждения за приглашенного
+// refereeID. Вызывается под s.mu.
+func (s *Store) vestRewards(refereeID int) {
+	for i, r := range s.rewards {
+		if r.RefereeID == refereeID && !r.Vested && r.ReviewStatus == "" {
+			s.rewards[i].Vested, s.rewards[i].VestedAt = true, s.now()
+		}
+	}
+}
+
+// Steps возвращает выполненные пользователем шаги знакомства с сервисом.
+func (s *Store) Steps(userID int) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, ok := s.users[userID]; ok {
+		return append([]string(nil), u.Steps...)
+	}
+	return nil
+}
+
+func (s *Store) referralCount(referrerID int) int {
+	n := 0
+	for _, l := range s.links {
+		if l.ReferrerID == referrerID {
+			n++
+		}
+	}
+	return n
+}
+
+// GetReferralStats возвращает число рефералов, сумму наград и текущую ступень.
+func (s *Store) GetReferralStats(ctx context.Context, userID int) (storage.ReferralStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := storage.ReferralStats{Referrals: s.referralCount(userID)}
+	for _, r := range s.rewards {
+		switch {
+		case r.ReferrerID != userID:
+		case r.Vested:
+			stats.RewardTotal += r.Amount
+		case r.ReviewStatus == storage.RewardPendingReview:
+			stats.RewardHeld += r.Amount
+		case r.ReviewStatus != "":
+		default:
+			stats.RewardPending += r.Amount
+		}
+	}
+	stats.Balance = s.balance(userID)
+	stats.ActiveTier = s.rewardTiers.Active(stats.Referrals)
+	return stats, nil
+}
+
+// balance возвращает зачисленные вознаграждения за вычетом списаний.
+func (s *Store) balance(userID int) int64 {
+	var balance int64
+	for _, r := range s.rewards {
+		if r.ReferrerID == userID && r.Vested {
+			balance += r.Amount
+		}
+	}
+	for _, r := range s.redemptions {
+		if r.UserID == userID {
+			balance += r.Amount
+		}
+	}
+	return balance
+}
+
+// RedeemReward списывает amount, если баланса достаточно.
+func (s *Store) RedeemReward(ctx context.Context, userID int, amount int64, note string) (storage.Redemption, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[userID]; !ok {
+		return storage.Redemption{}, storage.ErrNotFound
+	}
+	balance := s.balance(userID)
+	if balance < amount {
+		return storage.Redemption{}, storage.ErrInsufficientBalance
+	}
+	r := storage.Redemption{
+		ID: s.id(), UserID: userID, Amount: -amount, BalanceAfter: balance - amount, Note: note, CreatedAt: s.now(),
+	}
+	s.redemptions = append(s.redemptions, r)
+	return r, nil
+}
+
+// ListRedemptions возвращает списания, новые первыми.
+func (s *Store) ListRedemptions(ctx context.Context, userID, limit, offset int) ([]storage.Redemption, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	redemptions := []storage.Redemption{}
+	for i := len(s.redemptions) - 1; i >= 0 && len(redemptions) < limit; i-- {
+		if userID != 0 && s.redemptions[i].UserID != userID {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		redemptions = append(redemptions, s.redemptions[i])
+	}
+	return redemptions, nil
+}
+
+// RecordClick учитывает переход по действующему коду.
+func (s *Store) RecordClick(ctx context.Context, code string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.codeByValue(code)
+	if c == nil || c.Status != storage.CodeStatusActive || !c.ExpiresAt.After(s.now()) {
+		return 0, storage.ErrNotFound
+	}
+	s.clicks[c.ID]++
+	id := s.id()
+	s.clickCodes[id] = c.ID
+	return id, nil
+}
+
+// Links возвращает копию всех реферальных связей в порядке создания.
+func (s *Store) Links() []Link {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Link(nil), s.links...)
+}
+
+// AddLink добавляет реферальную связь без учета использования кода и
+// начисления вознаграждения - для моделирования рассогласованных данных.
+func (s *Store) AddLink(l Link) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if l.CreatedAt.IsZero() {
+		l.CreatedAt = s.now()
+	}
+	s.links = append(s.links, l)
+}
+
+// AddReward добавляет вознаграждение без проверки связи - для
+// моделирования рассогласованных данных.
+func (s *Store) AddReward(referrerID, refereeID int, amount int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	s.rewards = append(s.rewards, storedReward{
+		ID: s.id(), ReferrerID: referrerID, RefereeID: refereeID, Amount: amount, Vested: true, VestedAt: now, CreatedAt: now,
+	})
+}
+
+// SetCodeUses задает счетчик использований кода.
+func (s *Store) SetCodeUses(code string, uses int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c := s.codeByValue(code); c != nil {
+		c.Uses = uses
+	}
+}
+
+// ConsistencyCheck ищет и при fix исправляет те же расхождения, что и
+// storage.DB.ConsistencyCheck.
+func (s *Store) ConsistencyCheck(ctx context.Context, fix bool) (storage.ConsistencyReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	report := storage.ConsistencyReport{
+		LinksWithoutRewards: []storage.MissingReward{},
+		RewardsWithoutLinks: []storage.OrphanReward{},
+		CodeUsageMismatches: []storage.CodeUsageMismatch{},
+	}
+
+	rewarded := map[int]bool{}
+	for _, r := range s.rewards {
+		rewarded[r.RefereeID] = true
+	}
+	linked := map[[2]int]bool{}
+	counts := map[int]int{}
+	for _, l := range s.links {
+		linked[[2]int{l.ReferrerID, l.RefereeID}] = true
+		counts[l.ReferrerID]++
+		if rewarded[l.RefereeID] {
+			continue
+		}
+		if tier, amount, ok := s.rewardTiers.For(counts[l.ReferrerID]); ok {
+			report.LinksWithoutRewards = append(report.LinksWithoutRewards, storage.MissingReward{
+				ReferrerID: l.ReferrerID, RefereeID: l.RefereeID, Tier: tier, Amount: amount,
+			})
+		}
+	}
+	sort.SliceStable(report.LinksWithoutRewards, func(i, j int) bool {
+		return report.LinksWithoutRewards[i].ReferrerID < report.LinksWithoutRewards[j].ReferrerID
+	})
+
+	for _, r := range s.rewards {
+		if !linked[[2]int{r.ReferrerID, r.RefereeID}] {
+			report.RewardsWithoutLinks = append(report.RewardsWithoutLinks, storage.OrphanReward{
+				ID: r.ID, ReferrerID: r.ReferrerID, RefereeID: r.RefereeID, Amount: r.Amount,
+			})
+		}
+	}
+
+	for _, c := range s.codes {
+		n := 0
+		for _, l := range s.links {
+			if l.Code == c.Code && !l.CreatedAt.Before(c.CreatedAt) {
+				n++
+			}
+		}
+		if n != c.Uses {
+			report.CodeUsageMismatches = append(report.CodeUsageMismatches, storage.CodeUsageMismatch{
+				ID: c.ID, Code: c.Code, Uses: c.Uses, Links: n,
+			})
+		}
+	}
+	sort.Slice(report.CodeUsageMismatches, func(i, j int) bool {
+		return report.CodeUsageMismatches[i].Code < report.CodeUsageMismatches[j].Code
+	})
+
+	if fix {
+		for _, m := range report.LinksWithoutRewards {
+			s.insertReward(m.ReferrerID, m.RefereeID, m.Tier, m.Amount)
+		}
+		kept := s.rewards[:0]
+		for _, r := range s.rewards {
+			if linked[[2]int{r.ReferrerID, r.RefereeID}] {
+				kept = append(kept, r)
+			}
+		}
+		s.rewards = kept
+		for _, m := range report.CodeUsageMismatches {
+			s.codes[m.ID].Uses = m.Links
+		}
+		report.Fixed = true
+	}
+	report.CheckedAt = s.now().UTC()
+	return report, nil
+}
+
+// CountSignups возвращает число пользователей, созданных начиная с since.
+func (s *Store) CountSignups(ctx context.Context, since time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, u := range s.users {
+		if !u.CreatedAt.Before(since) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// CountActiveCodes возвращает число действующих кодов.
+func (s *Store) CountActiveCodes(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, c := range s.codes {
+		if c.Status == storage.CodeStatusActive && c.ExpiresAt.After(s.now()) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// ConsumeMagicLinkToken отмечает ссылку входа как использованную.
+func (s *Store) ConsumeMagicLinkToken(ctx context.Context, jti, email string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.consumedTokens[jti]; ok {
+		return storage.ErrTokenUsed
+	}
+	s.consumedTokens[jti] = email
+	if u := s.userByEmail(email); u != nil {
+		s.completeStep(u.ID, onboarding.StepEmailVerified)
+	}
+	return nil
+}
+
+// ConsumeActionToken отмечает токен действия как использованный.
+func (s *Store) ConsumeActionToken(ctx context.Context, nonce string, userID int, action string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.usedActions[nonce] {
+		return storage.ErrTokenUsed
+	}
+	s.usedActions[nonce] = true
+	return nil
+}
+
+// unlinkedUser находит пользователя, созданного прерванной попыткой
+// регистрации: тот же email и имя, недавнее создание, нет реферальной связи,
+// и пароль запроса подходит к его паролю.
+func (s *Store) unlinkedUser(params storage.CreateUserParams) (int, bool) {
+	u := s.userByEmail(params.Email)
+	if u == nil || u.Username != params.Username || s.now().Sub(u.CreatedAt) > registrationRetryWindow {
+		return 0, false
+	}
+	if params.PlainPassword == "" || auth.CheckPasswordHash(params.PlainPassword, u.Password) != nil {
+		return 0, false
+	}
+	for _, l := range s.links {
+		if l.RefereeID == u.ID {
+			return 0, false
+		}
+	}
+	return u.ID, true
+}
+
+// GetReferralsByReferrerID возвращает страницу рефералов реферера.
+func (s *Store) GetReferralsByReferrerID(ctx context.Context, referrerID, limit, offset int) ([]storage.ReferralSummary, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var referrals []storage.ReferralSummary
+	for _, l := range s.links {
+		if l.ReferrerID != referrerID {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		if len(referrals) == limit {
+			break
+		}
+		u := s.users[l.RefereeID]
+		summary := storage.ReferralSummary{ID: u.ID, Username: u.Username, JoinedAt: l.CreatedAt}
+		if len(s.onboarding) > 0 {
+			progress := s.onboarding.Progress(u.Steps)
+			summary.Onboarding = &progress
+		}
+		for _, r := range s.rewards {
+			if r.RefereeID == u.ID {
+				summary.Reward = storage.RewardPending
+				switch {
+				case r.ReviewStatus != "":
+					summary.Reward = r.ReviewStatus
+				case r.Vested:
+					summary.Reward = storage.RewardVested
+				}
+			}
+		}
+		referrals = append(referrals, summary)
+	}
+	return referrals, nil
+}
+
+// GetCohortStats группирует рефералов по месяцу приглашения и считает
+// тех, кто создал свой код в пределах storage.CohortConversionDays.
+func (s *Store) GetCohortStats(ctx context.Context, from, to time.Time) ([]storage.CohortStat, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	window := storage.CohortConversionDays * 24 * time.Hour
+	months := map[string]*storage.CohortStat{}
+	for _, l := range s.links {
+		if l.CreatedAt.Before(from) || !l.CreatedAt.Before(to) {
+			continue
+		}
+		month := l.CreatedAt.UTC().Format("2006-01")
+		if months[month] == nil {
+			months[month] = &storage.CohortStat{Month: month}
+		}
+		months[month].Referred++
+		for _, c := range s.codes {
+			if c.UserID == l.RefereeID && !c.CreatedAt.Before(l.CreatedAt) && c.CreatedAt.Before(l.CreatedAt.Add(window)) {
+				months[month].Converted++
+				break
+			}
+		}
+	}
+	cohorts := []storage.CohortStat{}
+	for _, c := range months {
+		if c.Referred > 0 {
+			c.ConversionRate = float64(c.Converted) / float64(c.Referred)
+		}
+		cohorts = append(cohorts, *c)
+	}
+	sort.Slice(cohorts, func(i, j int) bool { return cohorts[i].Month < cohorts[j].Month })
+	return cohorts, nil
+}
+
+// GetProgramReport возвращает итоги и разбивку по дням за период [from, to).
+func (s *Store) GetProgramReport(ctx context.Context, from, to time.Time) (storage.ProgramReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	report := storage.ProgramReport{From: from, To: to, TopCodes: []storage.CodeStat{}, Sources: []storage.SourceStat{}, Days: []storage.DayStat{}}
+	in := func(t time.Time) bool { return !t.Before(from) && t.Before(to) }
+
+	days := map[time.Time]*storage.DayStat{}
+	day := func(t time.Time) *storage.DayStat {
+		d := t.UTC().Truncate(24 * time.Hour)
+		if days[d] == nil {
+			days[d] = &storage.DayStat{Date: d}
+		}
+		return days[d]
+	}
+	sources := map[string]int{}
+	for _, u := range s.users {
+		if in(u.CreatedAt) {
+			report.TotalSignups++
+			sources[u.Source]++
+			day(u.CreatedAt).Signups++
+		}
+	}
+	codes := map[string]int{}
+	for _, l := range s.links {
+		if in(l.CreatedAt) {
+			report.ReferralSignups++
+			codes[l.Code]++
+			day(l.CreatedAt).ReferralSignups++
+		}
+	}
+	if report.TotalSignups > 0 {
+		report.ConversionRate = float64(report.ReferralSignups) / float64(report.TotalSignups)
+	}
+	for code, n := range codes {
+		report.TopCodes = append(report.TopCodes, storage.CodeStat{Code: code, Signups: n})
+	}
+	sort.Slice(report.TopCodes, func(i, j int) bool {
+		a, b := report.TopCodes[i], report.TopCodes[j]
+		return a.Signups > b.Signups || a.Signups == b.Signups && a.Code < b.Code
+	})
+	for source, n := range sources {
+		report.Sources = append(report.Sources, storage.SourceStat{Source: source, Signups: n})
+	}
+	sort.Slice(report.Sources, func(i, j int) bool { return report.Sources[i].Source < report.Sources[j].Source })
+	for _, d := range days {
+		report.Days = append(report.Days, *d)
+	}
+	sort.Slice(report.Days, func(i, j int) bool { return report.Days[i].Date.Before(report.Days[j].Date) })
+	return report, nil
+}
+
+// RecordAudit добавляет запись в журнал аудита.
+func (s *Store) RecordAudit(ctx context.Context, actorID int, action string, targetUserID int, payload interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var raw json.RawMessage
+	if payload != nil {
+		b, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		raw = b
+	}
+	s.appendAudit(actorID, action, targetUserID, raw)
+	return nil
+}
+
+func (s *Store) appendAudit(actorID int, action string, targetUserID int, payload json.RawMessage) {
+	s.audit = append(s.audit, storedAudit{
+		AuditEntry: storage.AuditEntry{
+			ID:        s.id(),
+			ActorID:   &actorID,
+			Action:    action,
+			Payload:   payload,
+			CreatedAt: s.now(),
+		},
+		TargetUserID: targetUserID,
+	})
+}
+
+// AuditLog возвращает записи журнала аудита о пользователе targetUserID
+// в порядке добавления.
+func (s *Store) AuditLog(targetUserID int) []storage.AuditEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var entries []storage.AuditEntry
+	for _, e := range s.audit {
+		if e.TargetUserID == targetUserID {
+			entries = append(entries, e.AuditEntry)
+		}
+	}
+	return entries
+}
+
+// GetReferrerActivity считает регистрации по рефереру после since.
+// Подсети не учитываются: IP в хранилище не разбирается.
+func (s *Store) GetReferrerActivity(ctx context.Context, since time.Time) ([]storage.ReferrerActivity, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	signups := map[int]int{}
+	for _, l := range s.links {
+		if !l.CreatedAt.Before(since) {
+			signups[l.ReferrerID]++
+		}
+	}
+	var activity []storage.ReferrerActivity
+	for id, n := range signups {
+		activity = append(activity, storage.ReferrerActivity{ReferrerID: id, Signups: n})
+	}
+	sort.Slice(activity, func(i, j int) bool { return activity[i].ReferrerID < activity[j].ReferrerID })
+	return activity, nil
+}
+
+// FlagReferrer создает или обновляет отметку о реферере.
+func (s *Store) FlagReferrer(ctx context.Context, flag storage.ReferrerFlag) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	if prev, ok := s.flags[flag.ReferrerID]; ok {
+		flag.ID, flag.CreatedAt = prev.ID, prev.CreatedAt
+	} else {
+		flag.ID, flag.CreatedAt = s.id(), now
+	}
+	flag.UpdatedAt = now
+	s.flags[flag.ReferrerID] = flag
+	return nil
+}
+
+// ListReferrerFlags возвращает отметки, начиная с самых подозрительных.
+func (s *Store) ListReferrerFlags(ctx context.Context) ([]storage.ReferrerFlag, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	flags := []storage.ReferrerFlag{}
+	for _, f := range s.flags {
+		flags = append(flags, f)
+	}
+	sort.Slice(flags, func(i, j int) bool {
+		return flags[i].Score > flags[j].Score || flags[i].Score == flags[j].Score && flags[i].ID < flags[j].ID
+	})
+	return flags, nil
+}
+
+// ReviewReferrerFlag разбирает отметку о реферере: снимает удержание с
+// его вознаграждений или аннулирует их.
+func (s *Store) ReviewReferrerFlag(ctx context.Context, id int, resolution string, actorID int) (storage.ReferrerFlag, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, f := range s.reviewedFlags {
+		if f.ID == id {
+			return storage.ReferrerFlag{}, storage.ErrFlagReviewed
+		}
+	}
+	var flag *storage.ReferrerFlag
+	for _, f := range s.flags {
+		if f.ID == id {
+			f := f
+			flag = &f
+		}
+	}
+	if flag == nil {
+		return storage.ReferrerFlag{}, storage.ErrNotFound
+	}
+
+	var released []int
+	n := 0
+	for i, r := range s.rewards {
+		if r.ReferrerID != flag.ReferrerID || r.ReviewStatus != storage.RewardPendingReview {
+			continue
+		}
+		n++
+		if resolution == storage.FlagRelease {
+			s.rewards[i].ReviewStatus = ""
+			released = append(released, r.RefereeID)
+		} else {
+			s.rewards[i].ReviewStatus = storage.RewardForfeited
+		}
+	}
+	for _, refereeID := range released {
+		var steps []string
+		if u, ok := s.users[refereeID]; ok {
+			steps = u.Steps
+		}
+		if s.onboarding.Done(steps) {
+			s.vestRewards(refereeID)
+		}
+	}
+
+	now := s.now()
+	flag.ReviewedAt, flag.Resolution = &now, resolution
+	delete(s.flags, flag.ReferrerID)
+	s.reviewedFlags = append(s.reviewedFlags, *flag)
+	payload, _ := json.Marshal(map[string]interface{}{"flag_id": flag.ID, "resolution": resolution, "rewards": n})
+	s.appendAudit(actorID, storage.AuditFlagReviewed, flag.ReferrerID, payload)
+	return *flag, nil
+}
+
+// EnqueueWebhook ставит событие в очередь доставки каждому получателю.
+func (s *Store) EnqueueWebhook(ctx context.Context, event string, payload json.RawMessage, targets []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	for _, target := range targets {
+		s.webhooks = append(s.webhooks, storage.WebhookDelivery{
+			ID: s.id(), Target: target, Event: event, Payload: payload,
+			Status: storage.WebhookPending, NextAttemptAt: now, CreatedAt: now, UpdatedAt: now,
+		})
+	}
+	return nil
+}
+
+// webhookAbout сообщает, относится ли событие к пользователю userID:
+// user.registered о нем или referral.created с ним в роли реферала.
+func webhookAbout(payload json.RawMessage, userID int) bool {
+	var event struct {
+		Data struct {
+			ID      int `json:"id"`
+			Referee struct {
+				ID int `json:"id"`
+			} `json:"referee"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return false
+	}
+	return event.Data.ID == userID || event.Data.Referee.ID == userID
+}
+
+// PurgeWebhookDeliveries удаляет не более limit завершенных доставок,
+// последняя попытка которых была раньше before.
+func (s *Store) PurgeWebhookDeliveries(ctx context.Context, before time.Time, limit int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	purged := 0
+	webhooks := s.webhooks[:0]
+	for _, d := range s.webhooks {
+		if purged < limit && d.Status != storage.WebhookPending && d.UpdatedAt.Before(before) {
+			purged++
+			continue
+		}
+		webhooks = append(webhooks, d)
+	}
+	s.webhooks = webhooks
+	return purged, nil
+}
+
+// ClaimWebhookDeliveries выбирает доставки, время попытки которых
+// наступило, и откладывает их на lease.
+func (s *Store) ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]storage.WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	claimed := []storage.WebhookDelivery{}
+	for i := range s.webhooks {
+		d := &s.webhooks[i]
+		if len(claimed) == limit {
+			break
+		}
+		if d.Status != storage.WebhookPending || d.NextAttemptAt.After(now) {
+			continue
+		}
+		d.NextAttemptAt = now.Add(lease)
+		claimed = append(claimed, *d)
+	}
+	return claimed, nil
+}
+
+// GetWebhookDelivery возвращает доставку по ID.
+func (s *Store) GetWebhookDelivery(ctx context.Context, id int) (storage.WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range s.webhooks {
+		if d.ID == id {
+			return d, nil
+		}
+	}
+	return storage.WebhookDelivery{}, storage.ErrNotFound
+}
+
+// RecordWebhookAttempt записывает результат попытки доставки.
+func (s *Store) RecordWebhookAttempt(ctx context.Context, id int, a storage.WebhookAttempt) (storage.WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.webhooks {
+		d := &s.webhooks[i]
+		if d.ID != id {
+			continue
+		}
+		d.Attempts++
+		d.Status = a.Status
+		if !a.NextAttemptAt.IsZero() {
+			d.NextAttemptAt = a.NextAttemptAt
+		}
+		d.LastStatusCode, d.LastResponse, d.LastError = a.StatusCode, a.Response, a.Error
+		d.UpdatedAt = s.now()
+		return *d, nil
+	}
+	return storage.WebhookDelivery{}, storage.ErrNotFound
+}
+
+// ListWebhookDeliveries возвращает страницу доставок, новые первыми.
+func (s *Store) ListWebhookDeliveries(ctx context.Context, filter storage.WebhookDeliveryFilter, limit, offset int) ([]storage.WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	deliveries := []storage.WebhookDelivery{}
+	for i := len(s.webhooks) - 1; i >= 0 && len(deliveries) < limit; i-- {
+		d := s.webhooks[i]
+		if (filter.Status != "" && d.Status != filter.Status) || (filter.Target != "" && d.Target != filter.Target) {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, nil
+}
+
+// WebhookStats возвращает число недоставленных событий по получателям.
+func (s *Store) WebhookStats(ctx context.Context) ([]storage.WebhookTargetStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	byTarget := map[string]*storage.WebhookTargetStats{}
+	for _, d := range s.webhooks {
+		if d.Status == storage.WebhookDelivered {
+			continue
+		}
+		st, ok := byTarget[d.Target]
+		if !ok {
+			st = &storage.WebhookTargetStats{Target: d.Target}
+			byTarget[d.Target] = st
+		}
+		if d.Status == storage.WebhookPending {
+			st.Pending++
+		} else {
+			st.Failed++
+		}
+	}
+	stats := []storage.WebhookTargetStats{}
+	for _, st := range byTarget {
+		stats = append(stats, *st)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Target < stats[j].Target })
+	return stats, nil
+}
+
+// CreateAPIKey добавляет ключ API и записывает аудит.
+func (s *Store) CreateAPIKey(ctx context.Context, k storage.NewAPIKey) (storage.APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	createdBy := k.CreatedBy
+	key := storage.APIKey{
+		ID:        s.id(),
+		Name:      k.Name,
+		Prefix:    k.Prefix,
+		Scopes:    append([]string(nil), k.Scopes...),
+		CreatedBy: &createdBy,
+		CreatedAt: s.now(),
+	}
+	s.apiKeys = append(s.apiKeys, storedAPIKey{APIKey: key, Hash: k.KeyHash})
+	payload, err := json.Marshal(map[string]interface{}{"key_id": key.ID, "name": key.Name, "scopes": key.Scopes})
+	if err != nil {
+		return storage.APIKey{}, err
+	}
+	s.appendAudit(k.CreatedBy, storage.AuditAPIKeyCreated, 0, payload)
+	return key, nil
+}
+
+// UseAPIKey возвращает действующий ключ по хэшу и отмечает его
+// использование.
+func (s *Store) UseAPIKey(ctx context.Context, keyHash string) (storage.APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.apiKeys {
+		k := &s.apiKeys[i]
+		if k.Hash == keyHash && k.RevokedAt == nil {
+			now := s.now()
+			k.LastUsedAt = &now
+			return k.APIKey, nil
+		}
+	}
+	return storage.APIKey{}, storage.ErrNotFound
+}
+
+// ListAPIKeys возвращает все ключи API в порядке создания.
+func (s *Store) ListAPIKeys(ctx context.Context) ([]storage.APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := []storage.APIKey{}
+	for _, k := range s.apiKeys {
+		keys = append(keys, k.APIKey)
+	}
+	return keys, nil
+}
+
+// RevokeAPIKey отзывает ключ API и записывает аудит.
+func (s *Store) RevokeAPIKey(ctx context.Context, id, actorID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.apiKeys {
+		k := &s.apiKeys[i]
+		if k.ID == id && k.RevokedAt == nil {
+			now := s.now()
+			k.RevokedAt = &now
+			payload, err := json.Marshal(map[string]interface{}{"key_id": id, "name": k.Name})
+			if err != nil {
+				return err
+			}
+			s.appendAudit(actorID, storage.AuditAPIKeyRevoked, 0, payload)
+			return nil
+		}
+	}
+	return storage.ErrNotFound
+}
+
+// GetQuotaUsage считает созданные коды и приглашенных начиная с since и
+// действующие коды пользователя.
+func (s *Store) GetQuotaUsage(ctx context.Context, userID int, since time.Time) (storage.QuotaUsage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var u storage.QuotaUsage
+	for _, at := range s.codeCreations[userID] {
+		if !at.Before(since) {
+			u.CodesCreated++
+		}
+	}
+	for _, l := range s.links {
+		if l.ReferrerID == userID && !l.CreatedAt.Before(since) {
+			u.Invites++
+		}
+	}
+	now := s.now()
+	for _, c := range s.userCodes(userID) {
+		if c.Status != storage.CodeStatusActive || !c.ExpiresAt.After(now) {
+			continue
+		}
+		u.ActiveCodes++
+		if u.NextCodeExpiry == nil || c.ExpiresAt.Before(*u.NextCodeExpiry) {
+			expiry := c.ExpiresAt
+			u.NextCodeExpiry = &expiry
+		}
+	}
+	return u, nil
+}
+
+// GetUserLimits возвращает квоты пользователя, заданные администратором.
+func (s *Store) GetUserLimits(ctx context.Context, userID int) (storage.UserLimits, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.limits[userID], nil
+}
+
+// SetUserLimits заменяет квоты пользователя и записывает аудит.
+func (s *Store) SetUserLimits(ctx context.Context, userID int, limits storage.UserLimits, actorID int) (storage.UserLimits, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[userID]; !ok {
+		return storage.UserLimits{}, storage.ErrNotFound
+	}
+	payload, err := json.Marshal(limits)
+	if err != nil {
+		return storage.UserLimits{}, err
+	}
+	s.limits[userID] = limits
+	s.appendAudit(actorID, storage.AuditUserLimitsSet, userID, payload)
+	return limits, nil
+}
+
+type storedStatement struct {
+	storage.RewardStatement
+	ClaimedUntil time.Time
+}
+
+// ledger возвращает операции пользователя за месяц period по времени.
+// Вызывается под s.mu.
+func (s *Store) ledger(userID int, period time.Time) []storage.LedgerEntry {
+	from, to := period, period.AddDate(0, 1, 0)
+	in := func(t time.Time) bool { return !t.Before(from) && t.Before(to) }
+	entries := []storage.LedgerEntry{}
+	for _, r := range s.rewards {
+		if u, ok := s.users[r.RefereeID]; ok && r.ReferrerID == userID && r.Vested && in(r.VestedAt) {
+			entries = append(entries, storage.LedgerEntry{At: r.VestedAt, Type: storage.EntryReward, Amount: r.Amount, Details: u.Username})
+		}
+	}
+	for _, r := range s.redemptions {
+		if r.UserID == userID && in(r.CreatedAt) {
+			entries = append(entries, storage.LedgerEntry{At: r.CreatedAt, Type: storage.EntryRedemption, Amount: r.Amount, Details: r.Note})
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if !entries[i].At.Equal(entries[j].At) {
+			return entries[i].At.Before(entries[j].At)
+		}
+		return entries[i].Type < entries[j].Type
+	})
+	return entries
+}
+
+// GenerateStatements создает выписки за месяц period пользователям с
+// операциями в этом месяце; уже созданные не меняются.
+func (s *Store) GenerateStatements(ctx context.Context, period time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	period = storage.StatementPeriod(period)
+	key := period.Format(storage.StatementPeriodLayout)
+	exists := map[int]bool{}
+	for _, st := range s.statements {
+		if st.Period == key {
+			exists[st.UserID] = true
+		}
+	}
+	ids := make([]int, 0, len(s.users))
+	for id := range s.users {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	created := 0
+	for _, id := range ids {
+		if exists[id] || s.users[id].AnonymizedAt != nil {
+			continue
+		}
+		entries := s.ledger(id, period)
+		if len(entries) == 0 {
+			continue
+		}
+		st := storage.RewardStatement{ID: s.id(), UserID: id, Period: key, Entries: len(entries), CreatedAt: s.now()}
+		for _, e := range entries {
+			if e.Type == storage.EntryReward {
+				st.Earned += e.Amount
+			} else {
+				st.Redeemed -= e.Amount
+			}
+		}
+		s.statements = append(s.statements, storedStatement{RewardStatement: st})
+		created++
+	}
+	return created, nil
+}
+
+// ClaimStatements выбирает неотправленные выписки и закрепляет их на lease.
+func (s *Store) ClaimStatements(ctx context.Context, limit int, lease time.Duration) ([]storage.ClaimedStatement, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	claimed := []storage.ClaimedStatement{}
+	for i := range s.statements {
+		st := &s.statements[i]
+		u := s.users[st.UserID]
+		if len(claimed) == limit {
+			break
+		}
+		if st.SentAt != nil || st.ClaimedUntil.After(now) || u == nil || u.AnonymizedAt != nil {
+			continue
+		}
+		st.ClaimedUntil = now.Add(lease)
+		claimed = append(claimed, storage.ClaimedStatement{
+			RewardStatement: st.RewardStatement, Username: u.Username, Email: u.Email, Timezone: u.Timezone,
+		})
+	}
+	return claimed, nil
+}
+
+// MarkStatementSent отмечает выписку отправленной.
+func (s *Store) MarkStatementSent(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.statements {
+		if s.statements[i].ID == id {
+			now := s.now()
+			s.statements[i].SentAt = &now
+			s.statements[i].ClaimedUntil = time.Time{}
+		}
+	}
+	return nil
+}
+
+// ReleaseStatement снимает закрепление неотправленной выписки.
+func (s *Store) ReleaseStatement(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.statements {
+		if s.statements[i].ID == id && s.statements[i].SentAt == nil {
+			s.statements[i].ClaimedUntil = time.Time{}
+		}
+	}
+	return nil
+}
+
+// ListRewardStatements возвращает выписки пользователя, последние первыми.
+func (s *Store) ListRewardStatements(ctx context.Context, userID int) ([]storage.RewardStatement, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statements := []storage.RewardStatement{}
+	for _, st := range s.statements {
+		if st.UserID == userID {
+			statements = append(statements, st.RewardStatement)
+		}
+	}
+	sort.Slice(statements, func(i, j int) bool { return statements[i].Period > statements[j].Period })
+	return statements, nil
+}
+
+// GetRewardStatement возвращает выписку пользователя за месяц period.
+func (s *Store) GetRewardStatement(ctx context.Context, userID int, period time.Time) (storage.RewardStatement, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := storage.StatementPeriod(period).Format(storage.StatementPeriodLayout)
+	for _, st := range s.statements {
+		if st.UserID == userID && st.Period == key {
+			return st.RewardStatement, nil
+		}
+	}
+	return storage.RewardStatement{}, storage.ErrNotFound
+}
+
+// ListLedgerEntries возвращает операции пользователя за месяц period.
+func (s *Store) ListLedgerEntries(ctx context.Context, userID int, period time.Time) ([]storage.LedgerEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ledger(userID, storage.StatementPeriod(period)), nil
+}
+
+// ScrubPersonalData очищает IP-адреса и User-Agent в не более чем limit
+// записях таблицы target раньше before.
+func (s *Store) ScrubPersonalData(ctx context.Context, target string, before time.Time, limit int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	scrubbed := 0
+	switch target {
+	case storage.ScrubLoginEvents:
+		for i := range s.logins {
+			e := &s.logins[i]
+			if scrubbed < limit && e.CreatedAt.Before(before) && (e.IP != "" || e.UserAgent != "") {
+				e.IP, e.UserAgent = "", ""
+				scrubbed++
+			}
+		}
+	case storage.ScrubSignups:
+		ids := make([]int, 0, len(s.users))
+		for id := range s.users {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+		for _, id := range ids {
+			u := s.users[id]
+			if scrubbed < limit && u.CreatedAt.Before(before) && (u.IP != "" || u.UserAgent != "") {
+				u.IP, u.UserAgent = "", ""
+				scrubbed++
+			}
+		}
+	case storage.ScrubTermsAcceptances:
+		keys := make([]termsKey, 0, len(s.terms))
+		for k := range s.terms {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool { return s.terms[keys[i]].AcceptedAt.Before(s.terms[keys[j]].AcceptedAt) })
+		for _, k := range keys {
+			a := s.terms[k]
+			if scrubbed < limit && a.AcceptedAt.Before(before) && a.IP != "" {
+				a.IP = ""
+				s.terms[k] = a
+				scrubbed++
+			}
+		}
+	default:
+		return 0, fmt.Errorf("unknown scrub target %q", target)
+	}
+	return scrubbed, nil
+}
+
+// SignupMetadata возвращает IP-адрес и User-Agent регистрации пользователя.
+func (s *Store) SignupMetadata(userID int) (ip, userAgent string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, ok := s.users[userID]; ok {
+		return u.IP, u.UserAgent
+	}
+	return "", ""
+}
+
+// storedRegistration - регистрация в очереди со временем следующей
+// попытки
+type storedRegistration struct {
+	storage.QueuedRegistration
+	NextAttemptAt time.Time
+}
+
+// EnqueueRegistration ставит регистрацию в очередь, если ожидающих
+// меньше maxPending.
+func (s *Store) EnqueueRegistration(ctx context.Context, id string, payload json.RawMessage, maxPending int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending := 0
+	for _, r := range s.registrations {
+		if r.Status == storage.RegistrationPending {
+			pending++
+		}
+	}
+	if pending >= maxPending {
+		return storage.ErrRegistrationQueueFull
+	}
+	now := s.now()
+	s.registrations = append(s.registrations, storedRegistration{
+		QueuedRegistration: storage.QueuedRegistration{
+			ID: id, Status: storage.RegistrationPending, Payload: payload, CreatedAt: now, UpdatedAt: now,
+		},
+		NextAttemptAt: now,
+	})
+	return nil
+}
+
+// ClaimRegistrations выбирает ожидающие регистрации в порядке
+// поступления и откладывает их на lease.
+func (s *Store) ClaimRegistrations(ctx context.Context, limit int, lease time.Duration) ([]storage.QueuedRegistration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	claimed := []storage.QueuedRegistration{}
+	for i := range s.registrations {
+		r := &s.registrations[i]
+		if len(claimed) == limit {
+			break
+		}
+		if r.Status != storage.RegistrationPending || r.NextAttemptAt.After(now) {
+			continue
+		}
+		r.Attempts++
+		r.NextAttemptAt = now.Add(lease)
+		claimed = append(claimed, r.QueuedRegistration)
+	}
+	return claimed, nil
+}
+
+// FinishRegistration записывает итог ожидающей регистрации и удаляет ее
+// данные.
+func (s *Store) FinishRegistration(ctx context.Context, id, status string, result json.RawMessage, errorCode string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.registrations {
+		r := &s.registrations[i]
+		if r.ID != id || r.Status != storage.RegistrationPending {
+			continue
+		}
+		r.Status, r.Result, r.ErrorCode, r.Payload = status, result, errorCode, nil
+		r.UpdatedAt = s.now()
+		return nil
+	}
+	return storage.ErrNotFound
+}
+
+// GetQueuedRegistration возвращает регистрацию по ID.
+func (s *Store) GetQueuedRegistration(ctx context.Context, id string) (storage.QueuedRegistration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range s.registrations {
+		if r.ID == id {
+			return r.QueuedRegistration, nil
+		}
+	}
+	return storage.QueuedRegistration{}, storage.ErrNotFound
+}
+
+// PurgeRegistrations удаляет не больше limit обработанных регистраций,
+// итог которых записан раньше before.
+func (s *Store) PurgeRegistrations(ctx context.Context, before time.Time, limit int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	purged := 0
+	kept := s.registrations[:0]
+	for _, r := range s.registrations {
+		if purged < limit && r.Status != storage.RegistrationPending && r.UpdatedAt.Before(before) {
+			purged++
+			continue
+		}
+		kept = append(kept, r)
+	}
+	s.registrations = kept
+	return purged, nil
+}
+
+// FileDispute подает спор об атрибуции. Код ищется и среди удаленных.
+func (s *Store) FileDispute(ctx context.Context, nd storage.NewDispute) (storage.ReferralDispute, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	referrerID := 0
+	if c := s.codeByValue(nd.Code); c != nil {
+		referrerID = c.UserID
+	}
+	for i := len(s.archive) - 1; i >= 0 && referrerID == 0; i-- {
+		if s.archive[i].Code == nd.Code {
+			referrerID = s.archive[i].UserID
+		}
+	}
+	if referrerID == 0 {
+		return storage.ReferralDispute{}, storage.ErrNotFound
+	}
+
+	refereeID := nd.FiledBy
+	if nd.RefereeEmail != "" {
+		if referrerID != nd.FiledBy {
+			return storage.ReferralDispute{}, storage.ErrDisputeNotParty
+		}
+		u := s.userByEmail(nd.RefereeEmail)
+		if u == nil || u.AnonymizedAt != nil {
+			return storage.ReferralDispute{}, storage.ErrRefereeNotFound
+		}
+		refereeID = u.ID
+	}
+	if refereeID == referrerID {
+		return storage.ReferralDispute{}, storage.ErrSelfReferral
+	}
+	for _, d := range s.disputes {
+		if d.RefereeID == refereeID && d.Status == storage.DisputeOpen {
+			return storage.ReferralDispute{}, storage.ErrDisputeExists
+		}
+	}
+
+	d := storage.ReferralDispute{
+		ID: s.id(), FiledBy: nd.FiledBy, ReferrerID: referrerID, RefereeID: refereeID,
+		Code: nd.Code, Message: nd.Message, Status: storage.DisputeOpen, CreatedAt: s.now(),
+	}
+	s.disputes = append(s.disputes, d)
+	return d, nil
+}
+
+// ListDisputes возвращает страницу споров, новые первыми.
+func (s *Store) ListDisputes(ctx context.Context, filter storage.DisputeFilter, limit, offset int) ([]storage.ReferralDispute, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	disputes := []storage.ReferralDispute{}
+	for i := len(s.disputes) - 1; i >= 0; i-- {
+		if d := s.disputes[i]; filter.Status == "" || d.Status == filter.Status {
+			disputes = append(disputes, d)
+		}
+	}
+	if offset >= len(disputes) {
+		return []storage.ReferralDispute{}, nil
+	}
+	disputes = disputes[offset:]
+	if len(disputes) > limit {
+		disputes = disputes[:limit]
+	}
+	return disputes, nil
+}
+
+// ResolveDispute разрешает открытый спор; действие attach создает
+// связь с проверками storage.DB.ResolveDispute.
+func (s *Store) ResolveDispute(ctx context.Context, id int, action, note string, actorID int) (storage.ReferralDispute, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.disputes {
+		d := &s.disputes[i]
+		if d.ID != id {
+			continue
+		}
+		if d.Status != storage.DisputeOpen {
+			return storage.ReferralDispute{}, storage.ErrDisputeResolved
+		}
+		if action == storage.DisputeAttach {
+			if err := s.attachReferral(*d); err != nil {
+				return storage.ReferralDispute{}, err
+			}
+		}
+		now := s.now()
+		d.Status, d.Resolution, d.ResolutionNote = storage.DisputeResolved, action, note
+		d.ResolvedBy, d.ResolvedAt = &actorID, &now
+		payload, _ := json.Marshal(map[string]interface{}{
+			"dispute_id": d.ID, "resolution": action, "referrer_id": d.ReferrerID, "code": d.Code,
+		})
+		s.appendAudit(actorID, storage.AuditDisputeResolved, d.RefereeID, payload)
+		return *d, nil
+	}
+	return storage.ReferralDispute{}, storage.ErrNotFound
+}
+
+// inReferrerChain сообщает, входит ли userID в цепочку рефереров
+// referrerID, начиная с него самого. Вызывается под s.mu.
+func (s *Store) inReferrerChain(referrerID, userID int) bool {
+	for id, n := referrerID, 0; n <= len(s.links); n++ {
+		if id == userID {
+			return true
+		}
+		next := 0
+		for _, l := range s.links {
+			if l.RefereeID == id {
+				next = l.ReferrerID
+			}
+		}
+		if next == 0 {
+			return false
+		}
+		id = next
+	}
+	return false
+}
+
+// attachReferral создает связь реферала спора d с реферером и сдвигает
+// глубину связей его рефералов. Вызывается под s.mu.
+func (s *Store) attachReferral(d storage.ReferralDispute) error {
+	if s.users[d.ReferrerID] == nil || s.users[d.RefereeID] == nil {
+		return storage.ErrNotFound
+	}
+	if s.inReferrerChain(d.ReferrerID, d.RefereeID) {
+		return storage.ErrSelfReferral
+	}
+	for _, l := range s.links {
+		if l.RefereeID == d.RefereeID {
+			return storage.ErrAlreadyReferred
+		}
+	}
+
+	depth, err := s.linkDepth(d.ReferrerID)
+	if err != nil {
+		return err
+	}
+	// связи цепочки рефералов реферала и их глубина относительно него
+	below := map[int]int{}
+	level := []int{d.RefereeID}
+	deepest := 0
+	for n := 1; len(level) > 0; n++ {
+		var next []int
+		for i, l := range s.links {
+			for _, id := range level {
+				if _, seen := below[i]; !seen && l.ReferrerID == id {
+					below[i], deepest = n, n
+					next = append(next, l.RefereeID)
+				}
+			}
+		}
+		level = next
+	}
+	if err := s.chainDepth.Check(d.ReferrerID, depth+deepest); err != nil {
+		return err
+	}
+	for i := range below {
+		s.links[i].Depth += depth
+	}
+
+	if c := s.codeByValue(d.Code); c != nil {
+		c.Uses++
+	}
+	s.links = append(s.links, Link{
+		ReferrerID: d.ReferrerID, RefereeID: d.RefereeID, Code: d.Code,
+		Channel: storage.ChannelDispute, Depth: depth, CreatedAt: s.now(),
+	})
+	if tier, amount, ok := s.rewardTiers.For(s.referralCount(d.ReferrerID)); ok {
+		s.insertReward(d.ReferrerID, d.RefereeID, tier, amount)
+	}
+	return nil
+}
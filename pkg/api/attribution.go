@@ -0,0 +1,195 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"gorefer.go/pkg/auth"
+	"gorefer.go/pkg/storage"
+)
+
+// Cookie атрибуции: реферальный код, сохраненный при переходе по ссылке
+// /r/{code} и учитываемый при последующей регистрации без кода.
+const (
+	attributionCookie  = "gorefer_ref"
+	attributionTTL     = 30 * 24 * time.Hour
+	attributionPurpose = "attribution" // назначение подписи, см. auth.SignValue
+)
+
+// Адрес перенаправления после перехода по ссылке по умолчанию
+const defaultClickRedirect = "/"
+
+// Содержимое cookie атрибуции
+type attribution struct {
+	Code      string `json:"code"`
+	ClickID   int    `json:"click_id"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// WithClickRedirect задает адрес, на который /r/{code} перенаправляет
+// пользователя после учета перехода.
+func WithClickRedirect(url string) Option {
+	return func(a *API) {
+		a.clickRedirect = url
+	}
+}
+
+// encodeAttribution сериализует и подписывает содержимое cookie.
+func encodeAttribution(a attribution) (string, error) {
+	b, err := json.Marshal(a)
+	if err != nil {
+		return "", err
+	}
+	return auth.SignValue(attributionPurpose, base64.RawURLEncoding.EncodeToString(b)), nil
+}
+
+// decodeAttribution проверяет подпись и срок действия cookie. Измененное,
+// поддельное или истекшее значение отбрасывается без ошибки.
+func decodeAttribution(value string, now time.Time) (attribution, bool) {
+	payload, ok := auth.VerifyValue(attributionPurpose, value)
+	if !ok {
+		return attribution{}, false
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return attribution{}, false
+	}
+	var a attribution
+	if err := json.Unmarshal(b, &a); err != nil || a.Code == "" || now.Unix() >= a.ExpiresAt {
+		return attribution{}, false
+	}
+	return a, true
+}
+
+// attributionFrom возвращает действительную атрибуцию из cookie запроса.
+func attributionFrom(r *http.Request) (attribution, bool) {
+	c, err := r.Cookie(attributionCookie)
+	if err != nil {
+		return attribution{}, false
+	}
+	return decodeAttribution(c.Value, time.Now())
+}
+
+// clearAttribution удаляет cookie атрибуции после регистрации.
+func clearAttribution(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: attributionCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+}
+
+// registerAttributed регистрирует пользователя по коду из cookie
+// атрибуции. Если код с момента перехода стал недействительным, не
+// допускает домен email или цепочка реферера достигла предельной
+// глубины, пользователь регистрируется без реферала. referrer - владелец кода,
+// nil, если реферальная связь не создана.
+func (api *API) registerAttributed(ctx context.Context, params storage.CreateUserParams, a attribution) (id int, referrer *storage.UserRef, err error) {
+	params.Channel, params.ClickID = storage.ChannelLinkClick, a.ClickID
+	reg, err := api.db.RegisterWithReferralCode(ctx, a.Code, params)
+	if _, invalid := invalidCodeError(err); invalid {
+		id, err = api.db.CreateUser(ctx, params)
+		return id, nil, err
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	return reg.UserID, &reg.Referrer, nil
+}
+
+// Обработчик перехода по реферальной ссылке: учитывает переход,
+// сохраняет код в cookie атрибуции и перенаправляет пользователя.
+// Для недействительного кода cookie не выставляется.
+//
+// С WithLinkPreview ботам мессенджеров и запросам с ?preview=1 вместо
+// перенаправления отдается страница превью ссылки, см. wantsPreview.
+func (api *API) FollowReferralLink(w http.ResponseWriter, r *http.Request) {
+	code := chi.URLParam(r, "code")
+	if api.linkPreview != nil {
+		w.Header().Add("Vary", "Accept, User-Agent")
+		if wantsPreview(r) {
+			api.writePreview(w, r, code)
+			return
+		}
+	}
+	api.followCode(w, r, code)
+}
+
+// Обработчик ссылки по имени пользователя /r/@username: переход
+// учитывается по последнему действующему коду пользователя, как по
+// /r/{code}, но сам код в ссылке не виден. Имя сравнивается без учета
+// регистра. Если кода нет или пользователь отключил ссылку - 404.
+func (api *API) FollowVanityLink(w http.ResponseWriter, r *http.Request) {
+	username := chi.URLParam(r, "username")
+	ctx := r.Context()
+
+	resultChan := make(chan string)
+	errorChan := make(chan error)
+
+	go func() {
+		code, err := api.db.GetActiveReferralCodeByUsername(ctx, username)
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		resultChan <- code.Code
+	}()
+
+	select {
+	case code := <-resultChan:
+		api.followCode(w, r, code)
+
+	case err := <-errorChan:
+		if errors.Is(err, storage.ErrNotFound) {
+			api.writeError(w, r, CodeReferralCodeNotFound, err)
+			return
+		}
+		api.writeError(w, r, CodeInternal, fmt.Errorf("failed to resolve referral link: %w", err))
+	}
+}
+
+// followCode учитывает переход по коду, сохраняет код в cookie атрибуции
+// и перенаправляет пользователя.
+func (api *API) followCode(w http.ResponseWriter, r *http.Request, code string) {
+	ctx := r.Context()
+
+	resultChan := make(chan int)
+	errorChan := make(chan error)
+
+	go func() {
+		clickID, err := api.db.RecordClick(ctx, code)
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		resultChan <- clickID
+	}()
+
+	select {
+	case clickID := <-resultChan:
+		value, err := encodeAttribution(attribution{Code: code, ClickID: clickID, ExpiresAt: time.Now().Add(attributionTTL).Unix()})
+		if err != nil {
+			log.Printf("Ошибка при создании cookie атрибуции: %v", err)
+			break
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     attributionCookie,
+			Value:    value,
+			Path:     "/",
+			MaxAge:   int(attributionTTL.Seconds()),
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+
+	case err := <-errorChan:
+		if !errors.Is(err, storage.ErrNotFound) {
+			log.Printf("Ошибка при учете перехода по коду %q: %v", code, err)
+		}
+	}
+
+	http.Redirect(w, r, api.clickRedirect, http.StatusFound)
+}
@@ -0,0 +1,49 @@
+package api
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"gorefer.go/pkg/auth"
+)
+
+func TestDecodeAttribution(t *testing.T) {
+	now := time.Now()
+	valid := attribution{Code: "REF123", ClickID: 7, ExpiresAt: now.Add(attributionTTL).Unix()}
+	value, err := encodeAttribution(valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := encodeAttribution(attribution{Code: "REF123", ClickID: 7, ExpiresAt: now.Add(-time.Second).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, _, _ := strings.Cut(value, ".")
+
+	tests := []struct {
+		name   string
+		value  string
+		now    time.Time
+		want   attribution
+		wantOK bool
+	}{
+		{"Valid", value, now, valid, true},
+		{"Valid until expiry", value, now.Add(attributionTTL - time.Minute), valid, true},
+		{"Expired by clock", value, now.Add(attributionTTL), attribution{}, false},
+		{"Expired payload", expired, now, attribution{}, false},
+		{"Tampered payload", "eyJjb2RlIjoiRVZJTCJ9" + value[len(payload):], now, attribution{}, false},
+		{"Signed for another purpose", auth.SignValue("session", payload), now, attribution{}, false},
+		{"Unsigned", payload, now, attribution{}, false},
+		{"Empty", "", now, attribution{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := decodeAttribution(tt.value, tt.now)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("decodeAttribution() = %+v, %v, want %+v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"gorefer.go/pkg/reqctx"
+	"gorefer.go/pkg/storage"
+)
+
+// Максимальная длина подписи кода, как у столбца referral_codes.label
+const maxCodeLabelLength = 50
+
+// WithMultipleCodes разрешает пользователю до max действующих кодов
+// с подписями (label) вместо одного, заменяемого при создании нового.
+// Добавляет маршрут GET /p/referral-codes и разбивку по кодам в
+// GET /p/stats. max не больше 1 оставляет один код.
+func WithMultipleCodes(max int) Option {
+	return func(a *API) {
+		if max > 1 {
+			a.maxCodes = max
+		}
+	}
+}
+
+// multipleCodes сообщает, включены ли несколько кодов на пользователя.
+func (api *API) multipleCodes() bool {
+	return api.maxCodes > 1
+}
+
+// domainRestriction проверяет поля allowed_domain и allow_subdomains
+// запроса и приводит домен к форме, в которой он сохраняется.
+func domainRestriction(domain string, subdomains bool) (storage.DomainRestriction, error) {
+	d, err := storage.NormalizeDomain(domain)
+	if err != nil {
+		return storage.DomainRestriction{}, err
+	}
+	if d == "" && subdomains {
+		return storage.DomainRestriction{}, errors.New("allow_subdomains requires allowed_domain")
+	}
+	return storage.DomainRestriction{Domain: d, Subdomains: subdomains}, nil
+}
+
+// Обработчик для получения всех кодов текущего пользователя, включая
+// истекшие, в порядке создания.
+func (api *API) ListMyReferralCodes(w http.ResponseWriter, r *http.Request) {
+	claims, ok := reqctx.UserFrom(r.Context())
+	if !ok {
+		api.writeError(w, r, CodeUnauthorized, nil)
+		return
+	}
+
+	ctx := r.Context()
+
+	resultChan := make(chan []storage.ReferralCode)
+	errorChan := make(chan error)
+
+	go func() {
+		codes, err := api.db.ListUserReferralCodes(ctx, claims.UserID)
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		resultChan <- codes
+	}()
+
+	select {
+	case codes := <-resultChan:
+		api.writeCacheable(w, r, codes)
+
+	case err := <-errorChan:
+		api.writeError(w, r, CodeInternal, fmt.Errorf("failed to list referral codes: %w", err))
+		return
+	}
+}
+
+// Обработчик для сравнения кодов текущего пользователя: переходы,
+// регистрации и конверсия по каждому текущему и прежнему коду, по
+// убыванию числа регистраций. С ?include_archived=true прежние коды
+// берутся из архива удаленных кодов с отметкой archived_at.
+func (api *API) CompareMyReferralCodes(w http.ResponseWriter, r *http.Request) {
+	claims, ok := reqctx.UserFrom(r.Context())
+	if !ok {
+		api.writeError(w, r, CodeUnauthorized, nil)
+		return
+	}
+	archived, err := includeArchived(r)
+	if err != nil {
+		api.writeError(w, r, CodeInvalidParameter, err)
+		return
+	}
+
+	ctx := r.Context()
+
+	resultChan := make(chan []storage.CodeComparison)
+	errorChan := make(chan error)
+
+	go func() {
+		codes, err := api.db.CompareReferralCodes(ctx, claims.UserID, archived)
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		resultChan <- codes
+	}()
+
+	select {
+	case codes := <-resultChan:
+		api.writeCacheable(w, r, codes)
+
+	case err := <-errorChan:
+		api.writeError(w, r, CodeInternal, fmt.Errorf("failed to compare referral codes: %w", err))
+		return
+	}
+}
+
+// includeArchived сообщает, запрошены ли в статистике кодов удаленные
+// коды из архива (?include_archived=true).
+func includeArchived(r *http.Request) (bool, error) {
+	v, err := strconv.ParseBool(r.URL.Query().Get("include_archived"))
+	if err != nil && r.URL.Query().Has("include_archived") {
+		return false, fmt.Errorf("include_archived: %w", err)
+	}
+	return v, nil
+}
@@ -0,0 +1,139 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"gorefer.go/pkg/storage"
+)
+
+// Формат месяца в параметрах когортного отчета
+const cohortMonthLayout = "2006-01"
+
+// Наибольшее число месяцев в когортном отчете
+const maxCohortMonths = 24
+
+// Время хранения рассчитанного когортного отчета
+const cohortCacheTTL = time.Hour
+
+// CohortReport - когорты рефералов по месяцам приглашения.
+type CohortReport struct {
+	From           string               `json:"from"` // YYYY-MM
+	To             string               `json:"to"`   // YYYY-MM, включительно
+	ConversionDays int                  `json:"conversion_days"`
+	Cohorts        []storage.CohortStat `json:"cohorts"`
+	GeneratedAt    time.Time            `json:"generated_at"` // время расчета, отчет кэшируется на час
+}
+
+// cohortCache - рассчитанные отчеты по периоду. Безопасен для
+// конкурентного использования.
+type cohortCache struct {
+	mu      sync.Mutex
+	reports map[string]CohortReport
+}
+
+func (c *cohortCache) get(key string, now time.Time) (CohortReport, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	report, ok := c.reports[key]
+	if !ok || now.Sub(report.GeneratedAt) >= cohortCacheTTL {
+		return CohortReport{}, false
+	}
+	return report, true
+}
+
+// put сохраняет отчет и удаляет устаревшие.
+func (c *cohortCache) put(key string, report CohortReport) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.reports == nil {
+		c.reports = map[string]CohortReport{}
+	}
+	for k, r := range c.reports {
+		if report.GeneratedAt.Sub(r.GeneratedAt) >= cohortCacheTTL {
+			delete(c.reports, k)
+		}
+	}
+	c.reports[key] = report
+}
+
+// parseCohortRange разбирает month или пару from и to (YYYY-MM,
+// включительно) и возвращает полуинтервал [первый день from, первый день
+// месяца после to).
+func parseCohortRange(r *http.Request) (time.Time, time.Time, error) {
+	q := r.URL.Query()
+	fromParam, toParam := q.Get("from"), q.Get("to")
+	if month := q.Get("month"); month != "" {
+		if fromParam != "" || toParam != "" {
+			return time.Time{}, time.Time{}, errors.New("month cannot be combined with from and to")
+		}
+		fromParam, toParam = month, month
+	}
+	from, err := time.Parse(cohortMonthLayout, fromParam)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("from: %w", err)
+	}
+	to, err := time.Parse(cohortMonthLayout, toParam)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("to: %w", err)
+	}
+	to = to.AddDate(0, 1, 0)
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, fmt.Errorf("from %s is after to", from.Format(cohortMonthLayout))
+	}
+	if from.AddDate(0, maxCohortMonths, 0).Before(to) {
+		return time.Time{}, time.Time{}, fmt.Errorf("range exceeds %d months", maxCohortMonths)
+	}
+	return from, to, nil
+}
+
+// Обработчик когортного отчета (admin): рефералы, приглашенные в каждом
+// месяце периода, и сколько из них создали свой код в течение
+// storage.CohortConversionDays дней.
+//
+// Параметры: month - один месяц (YYYY-MM) либо from и to - границы периода
+// включительно, не более 24 месяцев. Отчет по периоду кэшируется на час.
+func (api *API) GetCohorts(w http.ResponseWriter, r *http.Request) {
+	from, to, err := parseCohortRange(r)
+	if err != nil {
+		api.writeError(w, r, CodeInvalidDateRange, err)
+		return
+	}
+	key := from.Format(cohortMonthLayout) + "/" + to.Format(cohortMonthLayout)
+	if report, ok := api.cohorts.get(key, time.Now()); ok {
+		respond(w, http.StatusOK, report)
+		return
+	}
+
+	ctx := r.Context()
+
+	resultChan := make(chan []storage.CohortStat)
+	errorChan := make(chan error)
+
+	go func() {
+		cohorts, err := api.db.GetCohortStats(ctx, from, to)
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		resultChan <- cohorts
+	}()
+
+	select {
+	case cohorts := <-resultChan:
+		report := CohortReport{
+			From:           from.Format(cohortMonthLayout),
+			To:             to.AddDate(0, -1, 0).Format(cohortMonthLayout),
+			ConversionDays: storage.CohortConversionDays,
+			Cohorts:        cohorts,
+			GeneratedAt:    time.Now().UTC(),
+		}
+		api.cohorts.put(key, report)
+		respond(w, http.StatusOK, report)
+	case err := <-errorChan:
+		api.writeError(w, r, CodeInternal, fmt.Errorf("failed to build cohort report: %w", err))
+	}
+}
@@ -0,0 +1,49 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"gorefer.go/pkg/api/middlware"
+)
+
+// errOverloaded - запрос отклонен ограничителем одновременной обработки
+var errOverloaded = errors.New("too many concurrent requests")
+
+// WithAuthConcurrency ограничивает одновременную обработку регистрации и
+// входа, где основное время уходит на bcrypt: не больше maxInFlight
+// запросов, еще до maxQueue ждут своей очереди, остальные сразу получают
+// 503 с Retry-After. Загрузка видна в разделе auth_concurrency сводки
+// /admin/overview. По умолчанию выключено.
+func WithAuthConcurrency(maxInFlight, maxQueue int) Option {
+	return func(a *API) {
+		if maxInFlight > 0 {
+			a.authLimiter = middlware.NewLimiter(maxInFlight, maxQueue)
+		}
+	}
+}
+
+// limitAuth - middleware группы маршрутов регистрации и входа.
+func (api *API) limitAuth(next http.Handler) http.Handler {
+	if api.authLimiter == nil {
+		return next
+	}
+	return middlware.Concurrency(api.authLimiter, api.overloaded)(next)
+}
+
+// overloaded отвечает на запрос, отклоненный ограничителем. Если запрос
+// не дождался очереди до дедлайна, ответ - 504, как у других таймаутов.
+func (api *API) overloaded(w http.ResponseWriter, r *http.Request) {
+	cause := errOverloaded
+	if err := r.Context().Err(); err != nil {
+		cause = fmt.Errorf("%w: %w", errOverloaded, err)
+	}
+	api.writeError(w, r, CodeServiceUnavailable, cause)
+}
+
+// authConcurrency - раздел сводки с загрузкой ограничителя.
+func (api *API) authConcurrency(ctx context.Context) (interface{}, error) {
+	return api.authLimiter.Stats(), nil
+}
@@ -0,0 +1,79 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gorefer.go/pkg/api/middlware"
+	"gorefer.go/pkg/reqctx"
+	"gorefer.go/pkg/timing"
+)
+
+// WithDecodeFailureLimit включает ограничение на ошибки разбора тела
+// запроса: после max ошибок с одного IP за window запросы с телом от этого
+// IP отклоняются со статусом 429 до конца окна. По умолчанию выключено.
+func WithDecodeFailureLimit(max int, window time.Duration) Option {
+	return func(a *API) {
+		if max > 0 && window > 0 {
+			a.decodeLimiter = newWindowLimiter(max, window)
+		}
+	}
+}
+
+// Сжатие ответов и распаковка запросов по умолчанию: ответы короче
+// 1 КБ не сжимаются, распакованное тело запроса - не больше 1 МБ.
+const (
+	defaultCompressMinSize = 1 << 10
+	defaultMaxRequestBody  = 1 << 20
+)
+
+// WithCompression задает порог сжатия ответов gzip в байтах и предел
+// размера распакованного тела запроса. Нулевые значения заменяются
+// значениями по умолчанию. Сжатие включено всегда, см.
+// middlware.Compress.
+func WithCompression(minSize int, maxRequestBody int64) Option {
+	return func(a *API) {
+		if minSize > 0 {
+			a.compressMinSize = minSize
+		}
+		if maxRequestBody > 0 {
+			a.maxRequestBody = maxRequestBody
+		}
+	}
+}
+
+// decodeJSON разбирает JSON-тело запроса в v. При ошибке отправляет ответ
+// и возвращает false; ошибка учитывается в метриках и в ограничителе
+// ошибок по IP. Слишком большое после распаковки тело получает 413,
+// неподдерживаемое сжатие - 415.
+func (api *API) decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	ip, _ := reqctx.ClientIPFrom(r.Context())
+	if retryAfter, blocked := api.decodeLimiter.blocked(ip); blocked {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		api.writeError(w, r, CodeTooManyRequests, fmt.Errorf("too many malformed payloads from %s", ip))
+		return false
+	}
+
+	stop := timing.Start(r.Context(), phaseDecode)
+	err := json.NewDecoder(r.Body).Decode(v)
+	stop()
+	if err != nil {
+		api.decodeLimiter.add(ip)
+		setErrorReason(r.Context(), ReasonDecode)
+		code := CodeInvalidPayload
+		switch {
+		case errors.Is(err, middlware.ErrBodyTooLarge):
+			code = CodePayloadTooLarge
+		case errors.Is(err, middlware.ErrUnsupportedEncoding):
+			code = CodeUnsupportedEncoding
+		}
+		api.writeError(w, r, code, err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,55 @@
+package api
+
+import (
+	"net/http"
+	"time"
+)
+
+// Версия API, публикуемая клиентам. Увеличивается при несовместимых
+// изменениях маршрутов и форматов ответов.
+const APIVersion = "1"
+
+// Discovery - публичные правила работы сервиса для клиентов. Значения
+// берутся из тех же настроек, по которым сервис проверяет запросы.
+type Discovery struct {
+	APIVersion       string            `json:"api_version"`
+	Password         PasswordRules     `json:"password"`
+	ReferralCode     ReferralCodeRules `json:"referral_code"`
+	Registration     Registration      `json:"registration"`
+	MagicLinkEnabled bool              `json:"magic_link_enabled"`
+	// двухфакторной аутентификации в сервисе пока нет
+	TwoFactorEnabled bool `json:"two_factor_enabled"`
+	MaxPageSize      int  `json:"max_page_size"`
+}
+
+// Правила пароля, см. Policy
+type PasswordRules struct {
+	MinLength int `json:"min_length"`
+}
+
+// Правила реферального кода, см. Policy
+type ReferralCodeRules struct {
+	MaxLength       int `json:"max_length"`
+	MaxLifetimeDays int `json:"max_lifetime_days"` // наибольший срок действия кода
+}
+
+// Discovery возвращает публичные правила работы сервиса.
+func (api *API) Discovery() Discovery {
+	return Discovery{
+		APIVersion: APIVersion,
+		Password:   PasswordRules{MinLength: api.policy.PasswordMinLength},
+		ReferralCode: ReferralCodeRules{
+			MaxLength:       api.policy.CodeMaxLength,
+			MaxLifetimeDays: int(api.policy.CodeMaxLifetime / (24 * time.Hour)),
+		},
+		Registration:     api.registration,
+		MagicLinkEnabled: api.magicLinks != nil,
+		MaxPageSize:      api.pages.Effective().MaxLimit,
+	}
+}
+
+// Обработчик для получения публичных правил сервиса
+// (/.well-known/gorefer-configuration)
+func (api *API) GetDiscovery(w http.ResponseWriter, r *http.Request) {
+	respond(w, http.StatusOK, api.Discovery())
+}
@@ -0,0 +1,218 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+
+	"gorefer.go/pkg/api/pagination"
+	"gorefer.go/pkg/reqctx"
+	"gorefer.go/pkg/storage"
+)
+
+// Максимальная длина текста спора и комментария к решению
+const maxDisputeTextLength = 2000
+
+// Обработчик для подачи спора об атрибуции: регистрация по коду не
+// засчиталась. Реферал указывает код, по которому регистрировался;
+// владелец кода указывает и email реферала в referee_email. Спор
+// разбирает администратор, см. ResolveDispute.
+func (api *API) FileDispute(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Code         string `json:"code"`
+		RefereeEmail string `json:"referee_email"`
+		Message      string `json:"message"`
+	}
+	if !api.decodeJSON(w, r, &request) {
+		return
+	}
+	request.Code = strings.TrimSpace(request.Code)
+	request.RefereeEmail = strings.TrimSpace(request.RefereeEmail)
+	request.Message = strings.TrimSpace(request.Message)
+	switch {
+	case request.Code == "" || request.Message == "":
+		api.writeError(w, r, CodeInvalidPayload, errors.New("code and message are required"))
+		return
+	case utf8.RuneCountInString(request.Message) > maxDisputeTextLength:
+		api.writeError(w, r, CodeInvalidPayload, fmt.Errorf("message exceeds %d characters", maxDisputeTextLength))
+		return
+	case request.RefereeEmail != "" && !strings.Contains(request.RefereeEmail, "@"):
+		api.writeError(w, r, CodeInvalidPayload, errors.New("referee_email must be an email address"))
+		return
+	}
+
+	claims, ok := reqctx.UserFrom(r.Context())
+	if !ok {
+		api.writeError(w, r, CodeUnauthorized, nil)
+		return
+	}
+
+	ctx := r.Context()
+
+	resultChan := make(chan storage.ReferralDispute)
+	errorChan := make(chan error)
+
+	go func() {
+		d, err := api.db.FileDispute(ctx, storage.NewDispute{
+			FiledBy:      claims.UserID,
+			Code:         request.Code,
+			RefereeEmail: request.RefereeEmail,
+			Message:      request.Message,
+		})
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		resultChan <- d
+	}()
+
+	select {
+	case d := <-resultChan:
+		respond(w, http.StatusCreated, d)
+
+	case err := <-errorChan:
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			api.writeError(w, r, CodeReferralCodeNotFound, err)
+		case errors.Is(err, storage.ErrDisputeNotParty):
+			api.writeError(w, r, CodeDisputeNotParty, err)
+		case errors.Is(err, storage.ErrRefereeNotFound):
+			api.writeError(w, r, CodeUserNotFound, err)
+		case errors.Is(err, storage.ErrSelfReferral):
+			api.writeError(w, r, CodeSelfReferral, err)
+		case errors.Is(err, storage.ErrDisputeExists):
+			api.writeError(w, r, CodeDisputeExists, err)
+		default:
+			api.writeError(w, r, CodeInternal, fmt.Errorf("failed to file dispute: %w", err))
+		}
+	}
+}
+
+// Обработчик для получения списка споров об атрибуции (admin). Параметр
+// status (open, resolved) отбирает споры. Поддерживает limit/offset.
+func (api *API) ListDisputes(w http.ResponseWriter, r *http.Request) {
+	page, err := pagination.Parse(r, api.pages)
+	if err != nil {
+		api.writeError(w, r, CodeInvalidParameter, err)
+		return
+	}
+
+	filter := storage.DisputeFilter{Status: r.URL.Query().Get("status")}
+	switch filter.Status {
+	case "", storage.DisputeOpen, storage.DisputeResolved:
+	default:
+		api.writeError(w, r, CodeInvalidParameter, fmt.Errorf("unknown dispute status %q", filter.Status))
+		return
+	}
+
+	ctx := r.Context()
+
+	resultChan := make(chan []storage.ReferralDispute)
+	errorChan := make(chan error)
+
+	go func() {
+		// лишняя запись показывает, есть ли следующая страница
+		disputes, err := api.db.ListDisputes(ctx, filter, page.Limit+1, page.Offset)
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		resultChan <- disputes
+	}()
+
+	select {
+	case disputes := <-resultChan:
+		hasMore := len(disputes) > page.Limit
+		if hasMore {
+			disputes = disputes[:page.Limit]
+		}
+		pagination.SetLink(w, r, page, hasMore)
+		respond(w, http.StatusOK, disputes)
+
+	case err := <-errorChan:
+		api.writeError(w, r, CodeInternal, fmt.Errorf("failed to list disputes: %w", err))
+		return
+	}
+}
+
+// Обработчик для разрешения спора об атрибуции (admin). Действие attach
+// создает недостающую реферальную связь и начисляет вознаграждение с
+// обычными проверками регистрации по коду, reject отклоняет спор, note
+// закрывает его с комментарием note без изменения атрибуции. Спор
+// разрешается один раз.
+func (api *API) ResolveDispute(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		api.writeError(w, r, CodeInvalidID, err)
+		return
+	}
+
+	var request struct {
+		Action string `json:"action"`
+		Note   string `json:"note"`
+	}
+	if !api.decodeJSON(w, r, &request) {
+		return
+	}
+	request.Note = strings.TrimSpace(request.Note)
+	switch request.Action {
+	case storage.DisputeAttach, storage.DisputeReject, storage.DisputeNote:
+	default:
+		api.writeError(w, r, CodeInvalidPayload, fmt.Errorf("unknown action %q, expected attach, reject or note", request.Action))
+		return
+	}
+	if request.Action == storage.DisputeNote && request.Note == "" {
+		api.writeError(w, r, CodeInvalidPayload, errors.New("note is required for the note action"))
+		return
+	}
+	if utf8.RuneCountInString(request.Note) > maxDisputeTextLength {
+		api.writeError(w, r, CodeInvalidPayload, fmt.Errorf("note exceeds %d characters", maxDisputeTextLength))
+		return
+	}
+
+	claims, ok := reqctx.UserFrom(r.Context())
+	if !ok {
+		api.writeError(w, r, CodeUnauthorized, nil)
+		return
+	}
+
+	ctx := r.Context()
+
+	resultChan := make(chan storage.ReferralDispute)
+	errorChan := make(chan error)
+
+	go func() {
+		d, err := api.db.ResolveDispute(ctx, id, request.Action, request.Note, claims.ActorID())
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		resultChan <- d
+	}()
+
+	select {
+	case d := <-resultChan:
+		respond(w, http.StatusOK, d)
+
+	case err := <-errorChan:
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			api.writeError(w, r, CodeDisputeNotFound, err)
+		case errors.Is(err, storage.ErrDisputeResolved):
+			api.writeError(w, r, CodeDisputeResolved, err)
+		case errors.Is(err, storage.ErrSelfReferral):
+			api.writeError(w, r, CodeSelfReferral, err)
+		case errors.Is(err, storage.ErrAlreadyReferred):
+			api.writeError(w, r, CodeAlreadyReferred, err)
+		case errors.Is(err, storage.ErrChainTooDeep):
+			api.writeError(w, r, CodeReferralChainTooDeep, err)
+		default:
+			api.writeError(w, r, CodeInternal, fmt.Errorf("failed to resolve dispute: %w", err))
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"gorefer.go/pkg/mailer"
+)
+
+// WithEmailTemplates задает шаблоны писем. Без этого параметра
+// используются встроенные шаблоны, см. mailer.DefaultTemplates.
+func WithEmailTemplates(t *mailer.Templates) Option {
+	return func(a *API) {
+		a.emails = t
+	}
+}
+
+// EmailPreview - письмо, собранное по шаблону на примерах значений.
+type EmailPreview struct {
+	Template string `json:"template"`
+	Subject  string `json:"subject"`
+	Text     string `json:"text"`
+	HTML     string `json:"html"`
+}
+
+// Обработчик предпросмотра письма (admin): ?template=invite. По
+// умолчанию ответ - JSON со всеми частями письма, с ?format=html -
+// HTML-версия для просмотра в браузере.
+func (api *API) PreviewEmail(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("template")
+	if name == "" {
+		api.writeError(w, r, CodeInvalidParameter, errors.New("template is required"))
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "html" {
+		api.writeError(w, r, CodeInvalidParameter, fmt.Errorf("unknown format %q", format))
+		return
+	}
+
+	msg, err := api.emails.Preview(name)
+	if errors.Is(err, mailer.ErrUnknownTemplate) {
+		api.writeError(w, r, CodeEmailTemplateNotFound, err)
+		return
+	}
+	if err != nil {
+		api.writeError(w, r, CodeInternal, fmt.Errorf("failed to render email template %q: %w", name, err))
+		return
+	}
+
+	if format == "html" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(msg.HTML))
+		return
+	}
+	respond(w, http.StatusOK, EmailPreview{Template: name, Subject: msg.Subject, Text: msg.Text, HTML: msg.HTML})
+}
@@ -0,0 +1,120 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorefer.go/pkg/api/middlware"
+	"gorefer.go/pkg/reqctx"
+)
+
+// Значение Retry-After по умолчанию для ответов 503/504.
+const defaultRetryAfter = 5 * time.Second
+
+// StatusClientClosedRequest - статус запроса, клиент которого закрыл
+// соединение до ответа (как в nginx). До клиента он не доходит и нужен
+// журналу доступа и метрикам.
+const StatusClientClosedRequest = 499
+
+// errForbidden - у вызывающего нет прав на запрошенный ресурс
+var errForbidden = errors.New("forbidden")
+
+// RetryableError - ошибка временной недоступности зависимости
+// (открытый предохранитель, перегруженный пул и т.п.), знающая,
+// через сколько имеет смысл повторить запрос. Такие ошибки
+// отдаются клиенту со статусом 503.
+type RetryableError interface {
+	error
+	RetryAfter() time.Duration
+}
+
+// FieldError - нарушение в одном поле запроса.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ValidationError - данные запроса не прошли проверку по полям. Ответ
+// с такой причиной перечисляет нарушения в поле fields.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		msgs[i] = f.Field + ": " + f.Message
+	}
+	return "validation failed: " + strings.Join(msgs, "; ")
+}
+
+// Функция для обработки ошибок. Статус и текст берутся из каталога по коду
+// ошибки, язык текста - из Accept-Language. Нарушения из ValidationError
+// перечисляются в поле fields. Истечение дедлайна превращается
+// в 504, RetryableError - в 503; для обоих статусов выставляется Retry-After.
+// Причина ошибки логируется вместе с ID запроса. Если обработчик уже начал
+// отправку ответа, тело с ошибкой не пишется - только лог. Если клиент
+// закрыл соединение, ответ получает статус StatusClientClosedRequest без
+// тела и не считается ошибкой сервиса.
+func (api *API) writeError(w http.ResponseWriter, r *http.Request, code string, cause error) {
+	if errors.Is(r.Context().Err(), context.Canceled) {
+		reqID, _ := reqctx.RequestIDFrom(r.Context())
+		log.Printf("[%s] %s %s: клиент закрыл соединение: %v", reqID, r.Method, r.URL.Path, cause)
+		setErrorReason(r.Context(), ReasonClientClosed)
+		if !middlware.Written(w) {
+			w.WriteHeader(StatusClientClosedRequest)
+		}
+		return
+	}
+	if cause != nil {
+		reqID, _ := reqctx.RequestIDFrom(r.Context())
+		log.Printf("ERROR [%s] %s %s: %s: %v", reqID, r.Method, r.URL.Path, code, cause)
+	}
+	if middlware.Written(w) {
+		return
+	}
+
+	var retryable RetryableError
+	switch {
+	case errors.As(cause, &retryable):
+		code = CodeServiceUnavailable
+	case errors.Is(cause, context.DeadlineExceeded):
+		code = CodeTimeout
+	}
+
+	status := errorStatus(code)
+	response := ErrorResponse{
+		Error: message(code, language(r)),
+		Code:  code,
+	}
+	var invalid *ValidationError
+	if errors.As(cause, &invalid) {
+		response.Fields = invalid.Fields
+	}
+	var quota *QuotaError
+	if errors.As(cause, &quota) {
+		response.Quota = &QuotaExceeded{Name: quota.Quota, Limit: quota.Limit, ResetAt: quota.ResetAt}
+		if quota.ResetAt != nil {
+			retryAfter := max(quota.ResetAt.Sub(api.now()), time.Second)
+			response.RetryAfterSeconds = int(math.Ceil(retryAfter.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(response.RetryAfterSeconds))
+		}
+	}
+	if status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout {
+		retryAfter := api.retryAfter
+		if retryable != nil && retryable.RetryAfter() > 0 {
+			retryAfter = retryable.RetryAfter()
+		}
+		response.RetryAfterSeconds = int(math.Ceil(retryAfter.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(response.RetryAfterSeconds))
+	}
+
+	respond(w, status, response)
+}
@@ -0,0 +1,176 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"gorefer.go/pkg/api/middlware"
+)
+
+func TestWriteError_AfterPartialWrite(t *testing.T) {
+	var logs bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&logs)
+
+	a := &API{retryAfter: defaultRetryAfter}
+	cause := errors.New("encoder failed")
+
+	tests := []struct {
+		name         string
+		handler      http.HandlerFunc
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			name: "Nothing written yet",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				a.writeError(w, r, CodeInternal, cause)
+			},
+			expectedCode: http.StatusInternalServerError,
+			expectedBody: CodeInternal,
+		},
+		{
+			name: "Headers already sent",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+				a.writeError(w, r, CodeInternal, cause)
+			},
+			expectedCode: http.StatusOK,
+			expectedBody: "",
+		},
+		{
+			name: "Body partially written",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`{"partial":`))
+				a.writeError(w, r, CodeInternal, cause)
+			},
+			expectedCode: http.StatusOK,
+			expectedBody: `{"partial":`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs.Reset()
+			h := middleware.RequestID(middlware.TrackWrites(tt.handler))
+
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+
+			if rr.Code != tt.expectedCode {
+				t.Errorf("status = %d, want %d", rr.Code, tt.expectedCode)
+			}
+			if tt.expectedBody == "" && rr.Body.Len() != 0 || !strings.Contains(rr.Body.String(), tt.expectedBody) {
+				t.Errorf("body = %q, want %q", rr.Body.String(), tt.expectedBody)
+			}
+			if tt.expectedCode == http.StatusOK && strings.Contains(rr.Body.String(), CodeInternal) {
+				t.Errorf("error envelope appended to partial response: %q", rr.Body.String())
+			}
+			if !strings.Contains(logs.String(), "encoder failed") || !strings.Contains(logs.String(), "ERROR [") {
+				t.Errorf("log = %q, want cause with request ID", logs.String())
+			}
+		})
+	}
+}
+
+// TestErrorCatalog_CoversReferencedCodes проверяет по исходникам пакета,
+// что каждый упомянутый код ошибки есть в каталоге: константы Code* и
+// строковые коды, переданные в writeError напрямую.
+func TestErrorCatalog_CoversReferencedCodes(t *testing.T) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, ".", func(fi fs.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go")
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	consts := map[string]string{}
+	for _, f := range pkgs["api"].Files {
+		for _, decl := range f.Decls {
+			gen, ok := decl.(*ast.GenDecl)
+			if !ok || gen.Tok != token.CONST {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				vs := spec.(*ast.ValueSpec)
+				for i, name := range vs.Names {
+					if !strings.HasPrefix(name.Name, "Code") || i >= len(vs.Values) {
+						continue
+					}
+					if lit, ok := vs.Values[i].(*ast.BasicLit); ok && lit.Kind == token.STRING {
+						consts[name.Name], _ = strconv.Unquote(lit.Value)
+					}
+				}
+			}
+		}
+	}
+	if len(consts) == 0 {
+		t.Fatal("no Code* constants found")
+	}
+
+	referenced := map[string]token.Position{}
+	for _, f := range pkgs["api"].Files {
+		ast.Inspect(f, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.Ident:
+				if code, ok := consts[n.Name]; ok {
+					referenced[code] = fset.Position(n.Pos())
+				}
+			case *ast.CallExpr:
+				sel, ok := n.Fun.(*ast.SelectorExpr)
+				if !ok || sel.Sel.Name != "writeError" || len(n.Args) < 3 {
+					break
+				}
+				if lit, ok := n.Args[2].(*ast.BasicLit); ok && lit.Kind == token.STRING {
+					code, _ := strconv.Unquote(lit.Value)
+					referenced[code] = fset.Position(lit.Pos())
+				}
+			}
+			return true
+		})
+	}
+	for code, pos := range referenced {
+		if _, ok := errorCatalog[code]; !ok {
+			t.Errorf("%s: code %s is missing from errorCatalog", pos, code)
+		}
+	}
+}
+
+func TestErrorCodes_SortedAndComplete(t *testing.T) {
+	codes := ErrorCodes()
+	if len(codes) != len(errorCatalog) {
+		t.Fatalf("ErrorCodes() has %d codes, catalog has %d", len(codes), len(errorCatalog))
+	}
+	for i, c := range codes {
+		if i > 0 && codes[i-1].Code >= c.Code {
+			t.Errorf("codes out of order: %s before %s", codes[i-1].Code, c.Code)
+		}
+		if c.Status < 400 || c.Status > 599 || c.Description == "" {
+			t.Errorf("%s = %d %q, want an error status and a description", c.Code, c.Status, c.Description)
+		}
+		for _, lang := range []string{"en", "ru"} {
+			if c.Messages[lang] == "" {
+				t.Errorf("%s has no %s message", c.Code, lang)
+			}
+		}
+	}
+
+	// повторный вызов дает тот же список, а изменение копии не трогает каталог
+	codes[0].Messages["en"] = "changed"
+	if again := ErrorCodes(); !reflect.DeepEqual(again[1:], codes[1:]) || again[0].Messages["en"] == "changed" {
+		t.Error("ErrorCodes() is not stable or shares messages with the catalog")
+	}
+}
@@ -0,0 +1,69 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"gorefer.go/pkg/reqctx"
+	"gorefer.go/pkg/storage"
+)
+
+// Обработчик для выгрузки данных текущего пользователя
+func (api *API) ExportMyData(w http.ResponseWriter, r *http.Request) {
+	claims, ok := reqctx.UserFrom(r.Context())
+	if !ok {
+		api.writeError(w, r, CodeUnauthorized, nil)
+		return
+	}
+	api.exportUser(w, r, claims.UserID)
+}
+
+// Обработчик для выгрузки данных пользователя по ID (admin)
+func (api *API) ExportUserData(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		api.writeError(w, r, CodeInvalidID, err)
+		return
+	}
+	api.exportUser(w, r, id)
+}
+
+// exportUser отправляет выгрузку данных пользователя вложением в формате JSON.
+func (api *API) exportUser(w http.ResponseWriter, r *http.Request, userID int) {
+	ctx := r.Context()
+
+	resultChan := make(chan storage.UserExport)
+	errorChan := make(chan error)
+
+	go func() {
+		export, err := api.db.ExportUserData(ctx, userID)
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		resultChan <- export
+	}()
+
+	select {
+	case export := <-resultChan:
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"user-%d-export.json\"", userID))
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(export); err != nil {
+			log.Printf("Ошибка отправки выгрузки: %v", err)
+		}
+
+	case err := <-errorChan:
+		if errors.Is(err, storage.ErrNotFound) {
+			api.writeError(w, r, CodeUserNotFound, err)
+			return
+		}
+		api.writeError(w, r, CodeInternal, fmt.Errorf("failed to export user data: %w", err))
+		return
+	}
+}
@@ -0,0 +1,43 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"gorefer.go/pkg/storage"
+)
+
+// FaultInjector - хранилище со сбоями, правила которого меняются через
+// /admin/faults, см. storage.Faulty.
+type FaultInjector interface {
+	Rules() storage.FaultRules
+	SetRules(rules storage.FaultRules) error
+}
+
+// WithFaultInjection включает маршруты GET и PUT /admin/faults для
+// управления сбоями хранилища на тестовом стенде. Без этого параметра
+// маршруты не регистрируются.
+func WithFaultInjection(f FaultInjector) Option {
+	return func(a *API) {
+		a.faults = f
+	}
+}
+
+// Обработчик для получения правил сбоев хранилища (admin)
+func (api *API) GetFaultRules(w http.ResponseWriter, r *http.Request) {
+	respond(w, http.StatusOK, api.faults.Rules())
+}
+
+// Обработчик для замены правил сбоев хранилища (admin). Пустой список
+// выключает сбои.
+func (api *API) SetFaultRules(w http.ResponseWriter, r *http.Request) {
+	var rules storage.FaultRules
+	if !api.decodeJSON(w, r, &rules) {
+		return
+	}
+	if err := api.faults.SetRules(rules); err != nil {
+		api.writeError(w, r, CodeInvalidPayload, fmt.Errorf("invalid fault rules: %w", err))
+		return
+	}
+	respond(w, http.StatusOK, api.faults.Rules())
+}
@@ -0,0 +1,100 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+
+	"gorefer.go/pkg/reqctx"
+	"gorefer.go/pkg/storage"
+)
+
+// Обработчик для получения отметок о подозрительных реферерах (admin).
+// Отметки создает фоновый анализатор fraud.Analyzer. Пока отметка не
+// разобрана, вознаграждения реферера удерживаются, см. ReviewReferrerFlag.
+func (api *API) GetReferrerFlags(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	resultChan := make(chan []storage.ReferrerFlag)
+	errorChan := make(chan error)
+
+	go func() {
+		flags, err := api.db.ListReferrerFlags(ctx)
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		resultChan <- flags
+	}()
+
+	select {
+	case flags := <-resultChan:
+		respond(w, http.StatusOK, flags)
+
+	case err := <-errorChan:
+		api.writeError(w, r, CodeInternal, fmt.Errorf("failed to list referrer flags: %w", err))
+		return
+	}
+}
+
+// Обработчик для разбора отметки о реферере (admin). Действие release
+// снимает удержание с вознаграждений, начисленных, пока отметка была
+// открыта, forfeit аннулирует их. Отметка разбирается один раз.
+func (api *API) ReviewReferrerFlag(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		api.writeError(w, r, CodeInvalidID, err)
+		return
+	}
+
+	var request struct {
+		Action string `json:"action"`
+	}
+	if !api.decodeJSON(w, r, &request) {
+		return
+	}
+	switch request.Action {
+	case storage.FlagRelease, storage.FlagForfeit:
+	default:
+		api.writeError(w, r, CodeInvalidPayload, fmt.Errorf("unknown action %q, expected release or forfeit", request.Action))
+		return
+	}
+
+	claims, ok := reqctx.UserFrom(r.Context())
+	if !ok {
+		api.writeError(w, r, CodeUnauthorized, nil)
+		return
+	}
+
+	ctx := r.Context()
+
+	resultChan := make(chan storage.ReferrerFlag)
+	errorChan := make(chan error)
+
+	go func() {
+		flag, err := api.db.ReviewReferrerFlag(ctx, id, request.Action, claims.ActorID())
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		resultChan <- flag
+	}()
+
+	select {
+	case flag := <-resultChan:
+		respond(w, http.StatusOK, flag)
+
+	case err := <-errorChan:
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			api.writeError(w, r, CodeFlagNotFound, err)
+		case errors.Is(err, storage.ErrFlagReviewed):
+			api.writeError(w, r, CodeFlagReviewed, err)
+		default:
+			api.writeError(w, r, CodeInternal, fmt.Errorf("failed to review referrer flag: %w", err))
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package api
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"sync"
+
+	"gorefer.go/pkg/reqctx"
+	"gorefer.go/pkg/storage"
+)
+
+// Referral - регистрация нового пользователя по реферальному коду.
+type Referral struct {
+	Code    string       `json:"code"`
+	Referee storage.User `json:"referee"`
+}
+
+// Hooks - обработчики доменных событий для встраивающих приложений.
+// Любое поле может быть nil.
+//
+// Обработчики вызываются асинхронно, после успешного завершения операции,
+// не более одного раза на событие. Порядок вызова разных обработчиков
+// одной операции (например, OnUserRegistered и OnReferralCreated)
+// не гарантируется. Паника в обработчике перехватывается и логируется.
+// Контекст обработчика не отменяется по завершении HTTP-запроса.
+type Hooks struct {
+	OnUserRegistered  func(ctx context.Context, user storage.User)
+	OnReferralCreated func(ctx context.Context, referral Referral)
+	OnLoginFailed     func(ctx context.Context, email, ip string)
+}
+
+// WithHooks задает обработчики доменных событий.
+func WithHooks(h Hooks) Option {
+	return func(a *API) {
+		a.hooks = h
+	}
+}
+
+// fire асинхронно выполняет обработчик события с перехватом паники.
+func (api *API) fire(ctx context.Context, name string, fn func(ctx context.Context)) {
+	ctx = context.WithoutCancel(ctx)
+	api.hooksWG.Add(1)
+	go func() {
+		defer api.hooksWG.Done()
+		defer func() {
+			if rec := recover(); rec != nil {
+				log.Printf("Паника в обработчике %s: %v\n%s", name, rec, debug.Stack())
+			}
+		}()
+		fn(ctx)
+	}()
+}
+
+// userRegistered сообщает о регистрации пользователя.
+func (api *API) userRegistered(ctx context.Context, user storage.User) {
+	if api.hooks.OnUserRegistered == nil {
+		return
+	}
+	user.Password = ""
+	api.fire(ctx, "OnUserRegistered", func(ctx context.Context) {
+		api.hooks.OnUserRegistered(ctx, user)
+	})
+}
+
+// referralCreated сообщает о регистрации по реферальному коду.
+func (api *API) referralCreated(ctx context.Context, code string, user storage.User) {
+	if api.hooks.OnReferralCreated == nil {
+		return
+	}
+	user.Password = ""
+	api.fire(ctx, "OnReferralCreated", func(ctx context.Context) {
+		api.hooks.OnReferralCreated(ctx, Referral{Code: code, Referee: user})
+	})
+}
+
+// loginFailed сообщает о неудачной попытке входа.
+func (api *API) loginFailed(r *http.Request, email string) {
+	if api.hooks.OnLoginFailed == nil {
+		return
+	}
+	ip, _ := reqctx.ClientIPFrom(r.Context())
+	api.fire(r.Context(), "OnLoginFailed", func(ctx context.Context) {
+		api.hooks.OnLoginFailed(ctx, email, ip)
+	})
+}
+
+// HookRecorder - тестовый двойник, запоминающий все события.
+type HookRecorder struct {
+	mu           sync.Mutex
+	Registered   []storage.User
+	Referrals    []Referral
+	FailedLogins []string
+}
+
+// Hooks возвращает обработчики, записывающие события в рекордер.
+func (rec *HookRecorder) Hooks() Hooks {
+	return Hooks{
+		OnUserRegistered: func(ctx context.Context, user storage.User) {
+			rec.mu.Lock()
+			defer rec.mu.Unlock()
+			rec.Registered = append(rec.Registered, user)
+		},
+		OnReferralCreated: func(ctx context.Context, referral Referral) {
+			rec.mu.Lock()
+			defer rec.mu.Unlock()
+			rec.Referrals = append(rec.Referrals, referral)
+		},
+		OnLoginFailed: func(ctx context.Context, email, ip string) {
+			rec.mu.Lock()
+			defer rec.mu.Unlock()
+			rec.FailedLogins = append(rec.FailedLogins, email)
+		},
+	}
+}
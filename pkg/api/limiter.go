@@ -0,0 +1,74 @@
+package api
+
+import (
+	"sync"
+	"time"
+)
+
+// Число записей, после которого ограничитель удаляет истекшие окна
+const limiterSweepSize = 1024
+
+// newWindowLimiter создает ограничитель: не больше max событий на ключ
+// за window.
+func newWindowLimiter(max int, window time.Duration) *windowLimiter {
+	return &windowLimiter{max: max, window: window, now: time.Now, windows: map[string]*counterWindow{}}
+}
+
+// windowLimiter считает события по ключу (IP, email) в фиксированных
+// окнах. Нулевой указатель - ограничение выключено.
+type windowLimiter struct {
+	max    int
+	window time.Duration
+	now    func() time.Time
+
+	mu      sync.Mutex
+	windows map[string]*counterWindow
+}
+
+type counterWindow struct {
+	start time.Time
+	count int
+}
+
+// blocked сообщает, исчерпан ли лимит событий для key, и через сколько
+// он сбросится.
+func (l *windowLimiter) blocked(key string) (time.Duration, bool) {
+	if l == nil {
+		return 0, false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fw, ok := l.windows[key]
+	if !ok || fw.count < l.max {
+		return 0, false
+	}
+	left := fw.start.Add(l.window).Sub(l.now())
+	if left <= 0 {
+		delete(l.windows, key)
+		return 0, false
+	}
+	return left, true
+}
+
+// add учитывает событие для key.
+func (l *windowLimiter) add(key string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if len(l.windows) >= limiterSweepSize {
+		for k, fw := range l.windows {
+			if now.Sub(fw.start) >= l.window {
+				delete(l.windows, k)
+			}
+		}
+	}
+	fw, ok := l.windows[key]
+	if !ok || now.Sub(fw.start) >= l.window {
+		fw = &counterWindow{start: now}
+		l.windows[key] = fw
+	}
+	fw.count++
+}
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"gorefer.go/pkg/api/pagination"
+	"gorefer.go/pkg/reqctx"
+	"gorefer.go/pkg/storage"
+)
+
+// Время на запись попытки входа в фоне
+const loginEventTimeout = 5 * time.Second
+
+// Размер страницы истории входов
+var loginHistoryPages = pagination.Defaults{Limit: 20, MaxLimit: 100}
+
+// recordLogin записывает попытку входа пользователя userID после ответа
+// клиенту: запись не задерживает вход, а ее ошибка только логируется.
+// Попытки с неизвестным email не записываются - их не к кому отнести.
+func (api *API) recordLogin(r *http.Request, userID int, success bool) {
+	ip, _ := reqctx.ClientIPFrom(r.Context())
+	event := storage.LoginEvent{
+		UserID:    userID,
+		IP:        ip,
+		UserAgent: r.UserAgent(),
+		Success:   success,
+	}
+	api.fire(r.Context(), "RecordLogin", func(ctx context.Context) {
+		ctx, cancel := context.WithTimeout(ctx, loginEventTimeout)
+		defer cancel()
+		if err := api.db.RecordLogin(ctx, event); err != nil {
+			log.Printf("Ошибка записи входа пользователя %d: %v", userID, err)
+		}
+	})
+}
+
+// Обработчик для получения профиля текущего пользователя, включая время
+// последнего успешного входа.
+func (api *API) GetMyProfile(w http.ResponseWriter, r *http.Request) {
+	claims, ok := reqctx.UserFrom(r.Context())
+	if !ok {
+		api.writeError(w, r, CodeUnauthorized, nil)
+		return
+	}
+
+	ctx := r.Context()
+
+	resultChan := make(chan storage.Profile)
+	errorChan := make(chan error)
+
+	go func() {
+		profile, err := api.db.GetProfile(ctx, claims.UserID)
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		resultChan <- profile
+	}()
+
+	select {
+	case profile := <-resultChan:
+		respond(w, http.StatusOK, profile)
+	case err := <-errorChan:
+		if errors.Is(err, storage.ErrNotFound) {
+			api.writeError(w, r, CodeUserNotFound, err)
+			return
+		}
+		api.writeError(w, r, CodeInternal, fmt.Errorf("failed to retrieve profile: %w", err))
+	}
+}
+
+// Обработчик для получения истории входов текущего пользователя, новые
+// первыми, включая неудачные попытки. Поддерживает limit/offset.
+func (api *API) GetMyLogins(w http.ResponseWriter, r *http.Request) {
+	claims, ok := reqctx.UserFrom(r.Context())
+	if !ok {
+		api.writeError(w, r, CodeUnauthorized, nil)
+		return
+	}
+	page, err := pagination.Parse(r, loginHistoryPages)
+	if err != nil {
+		api.writeError(w, r, CodeInvalidParameter, err)
+		return
+	}
+
+	ctx := r.Context()
+
+	resultChan := make(chan []storage.LoginEvent)
+	errorChan := make(chan error)
+
+	go func() {
+		// лишняя запись показывает, есть ли следующая страница
+		events, err := api.db.ListLoginEvents(ctx, claims.UserID, page.Limit+1, page.Offset)
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		resultChan <- events
+	}()
+
+	select {
+	case events := <-resultChan:
+		hasMore := len(events) > page.Limit
+		if hasMore {
+			events = events[:page.Limit]
+		}
+		pagination.SetLink(w, r, page, hasMore)
+		respond(w, http.StatusOK, events)
+	case err := <-errorChan:
+		api.writeError(w, r, CodeInternal, fmt.Errorf("failed to retrieve login history: %w", err))
+	}
+}
@@ -0,0 +1,211 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorefer.go/pkg/auth"
+	"gorefer.go/pkg/mailer"
+	"gorefer.go/pkg/storage"
+)
+
+// Одноразовая ссылка входа
+const (
+	magicLinkTTL     = 15 * time.Minute
+	magicLinkPurpose = "magic_link" // назначение подписи, см. auth.SignValue
+)
+
+// Ограничение запросов ссылки на один email по умолчанию
+const (
+	defaultMagicLinkMaxRequests = 5
+	defaultMagicLinkWindow      = time.Hour
+)
+
+// Mailer отправляет письма. Реализация для SMTP - mailer.SMTP.
+type Mailer interface {
+	Send(ctx context.Context, to string, msg mailer.Message) error
+}
+
+// MagicLinks - параметры входа по одноразовой ссылке из письма.
+type MagicLinks struct {
+	Mailer      Mailer
+	BaseURL     string        // внешний адрес сервиса, к нему добавляется [префикс Handler]/login/magic?token=...
+	MaxRequests int           // запросов ссылки на один email за Window; 0 - 5
+	Window      time.Duration // 0 - час
+}
+
+// Содержимое токена ссылки входа
+type magicLinkClaims struct {
+	Email     string `json:"email"`
+	JTI       string `json:"jti"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// WithMagicLinks включает вход по одноразовой ссылке: маршруты
+// POST /login/magic-link и GET /login/magic. Без этого параметра
+// маршруты не регистрируются.
+func WithMagicLinks(m MagicLinks) Option {
+	return func(a *API) {
+		if m.MaxRequests <= 0 {
+			m.MaxRequests = defaultMagicLinkMaxRequests
+		}
+		if m.Window <= 0 {
+			m.Window = defaultMagicLinkWindow
+		}
+		a.magicLinks = &m
+		a.magicLinkLimiter = newWindowLimiter(m.MaxRequests, m.Window)
+	}
+}
+
+// encodeMagicLink выпускает подписанный токен ссылки для email.
+func encodeMagicLink(email string, now time.Time) (string, error) {
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(magicLinkClaims{
+		Email:     email,
+		JTI:       base64.RawURLEncoding.EncodeToString(jti),
+		ExpiresAt: now.Add(magicLinkTTL).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	return auth.SignValue(magicLinkPurpose, base64.RawURLEncoding.EncodeToString(b)), nil
+}
+
+// decodeMagicLink проверяет подпись и срок действия токена ссылки.
+func decodeMagicLink(token string, now time.Time) (magicLinkClaims, bool) {
+	payload, ok := auth.VerifyValue(magicLinkPurpose, token)
+	if !ok {
+		return magicLinkClaims{}, false
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return magicLinkClaims{}, false
+	}
+	var c magicLinkClaims
+	if err := json.Unmarshal(b, &c); err != nil || c.Email == "" || c.JTI == "" || now.Unix() >= c.ExpiresAt {
+		return magicLinkClaims{}, false
+	}
+	return c, true
+}
+
+// Обработчик запроса ссылки входа. Ответ не зависит от того,
+// зарегистрирован ли email: поиск пользователя и отправка письма
+// выполняются в фоне.
+func (api *API) RequestMagicLink(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Email string `json:"email"`
+	}
+	if !api.decodeJSON(w, r, &request) {
+		return
+	}
+	email := strings.TrimSpace(request.Email)
+	if !strings.Contains(email, "@") {
+		api.writeError(w, r, CodeInvalidPayload, errors.New("email is required"))
+		return
+	}
+
+	key := strings.ToLower(email)
+	if retryAfter, blocked := api.magicLinkLimiter.blocked(key); blocked {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		api.writeError(w, r, CodeMagicLinkRateLimited, fmt.Errorf("too many login links requested for %s", email))
+		return
+	}
+	api.magicLinkLimiter.add(key)
+
+	api.fire(r.Context(), "magic link", func(ctx context.Context) {
+		api.sendMagicLink(ctx, email)
+	})
+	respond(w, http.StatusAccepted, nil)
+}
+
+// sendMagicLink отправляет ссылку входа, если пользователь с email
+// существует. Ошибки только логируются. ctx несет префикс монтирования
+// из запроса, см. Handler.
+func (api *API) sendMagicLink(ctx context.Context, email string) {
+	user, err := api.db.GetUserByEmail(ctx, email)
+	if err != nil {
+		if !errors.Is(err, storage.ErrNotFound) {
+			log.Printf("Ошибка при поиске пользователя для ссылки входа: %v", err)
+		}
+		return
+	}
+	token, err := encodeMagicLink(user.Email, time.Now())
+	if err != nil {
+		log.Printf("Ошибка при создании ссылки входа: %v", err)
+		return
+	}
+	link := strings.TrimRight(api.magicLinks.BaseURL, "/") + basePath(ctx) + "/login/magic?token=" + url.QueryEscape(token)
+	msg, err := api.emails.Render("magic_link", mailer.Vars{
+		"Link":       link,
+		"TTLMinutes": strconv.Itoa(int(magicLinkTTL.Minutes())),
+	})
+	if err != nil {
+		log.Printf("Ошибка при подготовке письма со ссылкой входа: %v", err)
+		return
+	}
+	if err := api.magicLinks.Mailer.Send(ctx, user.Email, msg); err != nil {
+		log.Printf("Ошибка при отправке ссылки входа: %v", err)
+	}
+}
+
+// Обработчик входа по одноразовой ссылке. Возвращает тот же ответ,
+// что и вход по паролю.
+func (api *API) MagicLinkLogin(w http.ResponseWriter, r *http.Request) {
+	claims, ok := decodeMagicLink(r.URL.Query().Get("token"), time.Now())
+	if !ok {
+		api.writeError(w, r, CodeMagicLinkInvalid, nil)
+		return
+	}
+
+	ctx := r.Context()
+
+	resultChan := make(chan storage.User)
+	errorChan := make(chan error)
+
+	go func() {
+		err := api.db.ConsumeMagicLinkToken(ctx, claims.JTI, claims.Email, time.Unix(claims.ExpiresAt, 0))
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		user, err := api.db.GetUserByEmail(ctx, claims.Email)
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		resultChan <- user
+	}()
+
+	select {
+	case user := <-resultChan:
+		token, err := auth.GenerateToken(user.ID, user.Username, user.Role)
+		if err != nil {
+			api.writeError(w, r, CodeInternal, fmt.Errorf("failed to generate token: %w", err))
+			return
+		}
+		respond(w, http.StatusOK, TokenResponse{Token: token})
+		api.recordLogin(r, user.ID, true)
+
+	case err := <-errorChan:
+		if errors.Is(err, storage.ErrTokenUsed) || errors.Is(err, storage.ErrNotFound) {
+			api.writeError(w, r, CodeMagicLinkInvalid, err)
+			return
+		}
+		api.writeError(w, r, CodeInternal, fmt.Errorf("failed to log in with magic link: %w", err))
+		return
+	}
+}
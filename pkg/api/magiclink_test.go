@@ -0,0 +1,44 @@
+package api
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDecodeMagicLink(t *testing.T) {
+	now := time.Now()
+	token, err := encodeMagicLink("alice@example.com", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attributionToken, err := encodeAttribution(attribution{Code: "REF123", ExpiresAt: now.Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		now    time.Time
+		wantOK bool
+	}{
+		{"Valid", token, now, true},
+		{"Just before expiry", token, now.Add(magicLinkTTL - time.Second), true},
+		{"Expired", token, now.Add(magicLinkTTL), false},
+		{"Attribution cookie", attributionToken, now, false},
+		{"Truncated", token[:len(token)-2], now, false},
+		{"Empty", "", now, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, ok := decodeMagicLink(tt.token, tt.now)
+			if ok != tt.wantOK {
+				t.Fatalf("decodeMagicLink() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if ok && (claims.Email != "alice@example.com" || claims.JTI == "") {
+				t.Errorf("decodeMagicLink() = %+v, want email alice@example.com and jti", claims)
+			}
+		})
+	}
+}
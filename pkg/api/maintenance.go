@@ -0,0 +1,50 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"gorefer.go/pkg/storage"
+)
+
+// Обработчик проверки согласованности реферальных данных (admin).
+// Ответ - отчет storage.ConsistencyReport в виде JSON-файла. С ?fix=true
+// найденные расхождения исправляются в той же транзакции.
+func (api *API) RecountReferrals(w http.ResponseWriter, r *http.Request) {
+	fix, _ := strconv.ParseBool(r.URL.Query().Get("fix"))
+	ctx := r.Context()
+
+	resultChan := make(chan storage.ConsistencyReport)
+	errorChan := make(chan error)
+
+	go func() {
+		report, err := api.db.ConsistencyCheck(ctx, fix)
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		resultChan <- report
+	}()
+
+	select {
+	case report := <-resultChan:
+		if !report.Consistent() {
+			log.Printf("Проверка согласованности: связей без вознаграждения %d, вознаграждений без связи %d, расхождений счетчиков кодов %d, исправлено: %t",
+				len(report.LinksWithoutRewards), len(report.RewardsWithoutLinks), len(report.CodeUsageMismatches), report.Fixed)
+		}
+		filename := fmt.Sprintf("consistency-%s.json", report.CheckedAt.Format("20060102T150405Z"))
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			log.Printf("Ошибка отправки отчета: %v", err)
+		}
+
+	case err := <-errorChan:
+		api.writeError(w, r, CodeInternal, fmt.Errorf("failed to check referral consistency: %w", err))
+		return
+	}
+}
@@ -0,0 +1,426 @@
+package api
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Стабильные коды ошибок API. Коды не зависят от языка ответа,
+// клиенты могут полагаться на них при обработке ошибок.
+const (
+	CodeInvalidPayload          = "INVALID_PAYLOAD"
+	CodeInvalidID               = "INVALID_ID"
+	CodeInvalidParameter        = "INVALID_PARAMETER"
+	CodeInvalidRequestTimeout   = "INVALID_REQUEST_TIMEOUT"
+	CodeInvalidDateRange        = "INVALID_DATE_RANGE"
+	CodeInvalidTimezone         = "INVALID_TIMEZONE"
+	CodeValidationFailed        = "VALIDATION_FAILED"
+	CodeInvalidCredentials      = "INVALID_CREDENTIALS"
+	CodeUnauthorized            = "UNAUTHORIZED"
+	CodeForbidden               = "FORBIDDEN"
+	CodeAPIKeyInvalid           = "API_KEY_INVALID"
+	CodeAPIKeyScopeMissing      = "API_KEY_SCOPE_MISSING"
+	CodeAPIKeyNotFound          = "API_KEY_NOT_FOUND"
+	CodeUserNotFound            = "USER_NOT_FOUND"
+	CodeUserAlreadyAnonymized   = "USER_ALREADY_ANONYMIZED"
+	CodeReferralCodeNotFound    = "REFERRAL_CODE_NOT_FOUND"
+	CodeReferralCodeTaken       = "REFERRAL_CODE_TAKEN"
+	CodeReferralCodeInvalid     = "REFERRAL_CODE_INVALID"
+	CodeReferralCodeLimit       = "REFERRAL_CODE_LIMIT"
+	CodeReferralChainTooDeep    = "REFERRAL_CHAIN_TOO_DEEP"
+	CodeExpiryInPast            = "EXPIRY_IN_PAST"
+	CodeExpiryTooFar            = "EXPIRY_TOO_FAR"
+	CodeNewOwnerHasCode         = "NEW_OWNER_HAS_ACTIVE_CODE"
+	CodeTransferInvalid         = "REFERRAL_CODE_TRANSFER_INVALID"
+	CodeTransferBalance         = "REFERRAL_CODE_TRANSFER_BALANCE"
+	CodeDisputeNotFound         = "REFERRAL_DISPUTE_NOT_FOUND"
+	CodeDisputeExists           = "REFERRAL_DISPUTE_EXISTS"
+	CodeDisputeResolved         = "REFERRAL_DISPUTE_RESOLVED"
+	CodeDisputeNotParty         = "REFERRAL_DISPUTE_NOT_PARTY"
+	CodeFlagNotFound            = "REFERRER_FLAG_NOT_FOUND"
+	CodeFlagReviewed            = "REFERRER_FLAG_REVIEWED"
+	CodeSelfReferral            = "SELF_REFERRAL"
+	CodeAlreadyReferred         = "ALREADY_REFERRED"
+	CodeDomainMismatch          = "CODE_DOMAIN_MISMATCH"
+	CodeTermsNotAccepted        = "TERMS_NOT_ACCEPTED"
+	CodeEmailTaken              = "EMAIL_TAKEN"
+	CodeUsernameTaken           = "USERNAME_TAKEN"
+	CodeInsufficientBalance     = "INSUFFICIENT_BALANCE"
+	CodeRegistrationDisabled    = "REGISTRATION_DISABLED"
+	CodeRegistrationQueueFull   = "REGISTRATION_QUEUE_FULL"
+	CodeRegistrationNotFound    = "REGISTRATION_NOT_FOUND"
+	CodeMetadataInvalid         = "METADATA_INVALID"
+	CodePayloadTooLarge         = "PAYLOAD_TOO_LARGE"
+	CodeUnsupportedEncoding     = "UNSUPPORTED_ENCODING"
+	CodeTooManyRequests         = "TOO_MANY_REQUESTS"
+	CodeMagicLinkRateLimited    = "MAGIC_LINK_RATE_LIMITED"
+	CodeMagicLinkInvalid        = "MAGIC_LINK_INVALID"
+	CodeActionLinkInvalid       = "ACTION_LINK_INVALID"
+	CodeActionLinkUsed          = "ACTION_LINK_USED"
+	CodeWidgetRateLimited       = "WIDGET_RATE_LIMITED"
+	CodeQuotaExceeded           = "QUOTA_EXCEEDED"
+	CodeEmailTemplateNotFound   = "EMAIL_TEMPLATE_NOT_FOUND"
+	CodeWebhookDeliveryNotFound = "WEBHOOK_DELIVERY_NOT_FOUND"
+	CodeStatementNotFound       = "STATEMENT_NOT_FOUND"
+	CodeRouteNotFound           = "ROUTE_NOT_FOUND"
+	CodeMethodNotAllowed        = "METHOD_NOT_ALLOWED"
+	CodeInternal                = "INTERNAL_ERROR"
+	CodeInternalPanic           = "INTERNAL_PANIC"
+	CodeServiceUnavailable      = "SERVICE_UNAVAILABLE"
+	CodeTimeout                 = "TIMEOUT"
+)
+
+// Язык сообщений по умолчанию.
+const defaultLanguage = "en"
+
+// Описание кода ошибки: HTTP-статус и сообщения на поддерживаемых языках.
+type errorDef struct {
+	status   int
+	messages map[string]string
+}
+
+// Каталог сообщений об ошибках.
+var errorCatalog = map[string]errorDef{
+	CodeInvalidPayload: {http.StatusBadRequest, map[string]string{
+		"en": "invalid request payload",
+		"ru": "некорректное тело запроса",
+	}},
+	CodeInvalidID: {http.StatusBadRequest, map[string]string{
+		"en": "invalid identifier",
+		"ru": "некорректный идентификатор",
+	}},
+	CodeInvalidParameter: {http.StatusBadRequest, map[string]string{
+		"en": "invalid query parameter",
+		"ru": "некорректный параметр запроса",
+	}},
+	CodeInvalidRequestTimeout: {http.StatusBadRequest, map[string]string{
+		"en": "X-Request-Timeout must be a positive number of seconds",
+		"ru": "X-Request-Timeout должен быть положительным числом секунд",
+	}},
+	CodeInvalidDateRange: {http.StatusBadRequest, map[string]string{
+		"en": "invalid date range",
+		"ru": "некорректный период",
+	}},
+	CodeInvalidTimezone: {http.StatusBadRequest, map[string]string{
+		"en": "unknown time zone, expected an IANA name such as Asia/Kolkata",
+		"ru": "неизвестный часовой пояс, ожидается имя IANA, например Europe/Moscow",
+	}},
+	CodeValidationFailed: {http.StatusUnprocessableEntity, map[string]string{
+		"en": "request fields failed validation, see fields",
+		"ru": "поля запроса не прошли проверку, подробности в fields",
+	}},
+	CodeInvalidCredentials: {http.StatusUnauthorized, map[string]string{
+		"en": "invalid login credentials",
+		"ru": "неверный логин или пароль",
+	}},
+	CodeUnauthorized: {http.StatusUnauthorized, map[string]string{
+		"en": "unauthorized",
+		"ru": "требуется авторизация",
+	}},
+	CodeForbidden: {http.StatusForbidden, map[string]string{
+		"en": "access denied",
+		"ru": "доступ запрещен",
+	}},
+	CodeAPIKeyInvalid: {http.StatusUnauthorized, map[string]string{
+		"en": "API key is unknown or revoked",
+		"ru": "ключ API неизвестен или отозван",
+	}},
+	CodeAPIKeyScopeMissing: {http.StatusForbidden, map[string]string{
+		"en": "API key does not have the scope required by this route",
+		"ru": "у ключа API нет области, нужной для этого маршрута",
+	}},
+	CodeAPIKeyNotFound: {http.StatusNotFound, map[string]string{
+		"en": "API key not found or already revoked",
+		"ru": "ключ API не найден или уже отозван",
+	}},
+	CodeUserNotFound: {http.StatusNotFound, map[string]string{
+		"en": "user not found",
+		"ru": "пользователь не найден",
+	}},
+	CodeUserAlreadyAnonymized: {http.StatusConflict, map[string]string{
+		"en": "user is already anonymized",
+		"ru": "пользователь уже анонимизирован",
+	}},
+	CodeReferralCodeNotFound: {http.StatusNotFound, map[string]string{
+		"en": "referral code not found",
+		"ru": "реферальный код не найден",
+	}},
+	CodeReferralCodeTaken: {http.StatusConflict, map[string]string{
+		"en": "referral code is already taken",
+		"ru": "реферальный код уже занят",
+	}},
+	CodeReferralCodeLimit: {http.StatusConflict, map[string]string{
+		"en": "maximum number of active referral codes reached",
+		"ru": "достигнуто максимальное число активных реферальных кодов",
+	}},
+	CodeReferralCodeInvalid: {http.StatusUnprocessableEntity, map[string]string{
+		"en": "referral code is expired, revoked or used up",
+		"ru": "реферальный код истек, отозван или исчерпан",
+	}},
+	CodeReferralChainTooDeep: {http.StatusUnprocessableEntity, map[string]string{
+		"en": "the referrer's referral chain has reached the maximum depth",
+		"ru": "реферальная цепочка реферера достигла максимальной глубины",
+	}},
+	CodeExpiryInPast: {http.StatusUnprocessableEntity, map[string]string{
+		"en": "expires_at must be in the future",
+		"ru": "срок действия expires_at должен быть в будущем",
+	}},
+	CodeExpiryTooFar: {http.StatusUnprocessableEntity, map[string]string{
+		"en": "expires_at is beyond the maximum referral code lifetime, see GET /.well-known/gorefer-configuration",
+		"ru": "срок действия expires_at больше наибольшего срока действия реферального кода, см. GET /.well-known/gorefer-configuration",
+	}},
+	CodeNewOwnerHasCode: {http.StatusConflict, map[string]string{
+		"en": "the new owner already has an active referral code, delete it via DELETE /admin/referral-codes?code= or wait for it to expire before transferring",
+		"ru": "у нового владельца уже есть действующий реферальный код, удалите его через DELETE /admin/referral-codes?code= или дождитесь его истечения",
+	}},
+	CodeTransferInvalid: {http.StatusConflict, map[string]string{
+		"en": "the code cannot go to this user: it already belongs to them, is reserved for an email, or they signed up with it",
+		"ru": "код нельзя передать этому пользователю: он уже владеет кодом, код зарезервирован за email или пользователь зарегистрировался по нему",
+	}},
+	CodeTransferBalance: {http.StatusConflict, map[string]string{
+		"en": "the current owner has already redeemed the rewards for this code's referrals, transfer without include_history",
+		"ru": "текущий владелец уже списал вознаграждения за приглашенных по коду, передайте код без include_history",
+	}},
+	CodeDisputeNotFound: {http.StatusNotFound, map[string]string{
+		"en": "referral dispute not found",
+		"ru": "спор об атрибуции не найден",
+	}},
+	CodeDisputeExists: {http.StatusConflict, map[string]string{
+		"en": "there is already an open dispute about this referee",
+		"ru": "о реферале уже есть открытый спор",
+	}},
+	CodeDisputeResolved: {http.StatusConflict, map[string]string{
+		"en": "the dispute is already resolved",
+		"ru": "спор уже разрешен",
+	}},
+	CodeDisputeNotParty: {http.StatusForbidden, map[string]string{
+		"en": "only the referee, or the code owner naming the referee by referee_email, can file a dispute about this code",
+		"ru": "спор о коде может подать только реферал или владелец кода, указав email реферала в referee_email",
+	}},
+	CodeFlagNotFound: {http.StatusNotFound, map[string]string{
+		"en": "referrer flag not found",
+		"ru": "отметка о реферере не найдена",
+	}},
+	CodeFlagReviewed: {http.StatusConflict, map[string]string{
+		"en": "the referrer flag is already reviewed",
+		"ru": "отметка о реферере уже разобрана",
+	}},
+	CodeSelfReferral: {http.StatusConflict, map[string]string{
+		"en": "a user cannot be their own referrer, directly or through their referral chain",
+		"ru": "пользователь не может быть своим реферером, напрямую или через реферальную цепочку",
+	}},
+	CodeAlreadyReferred: {http.StatusConflict, map[string]string{
+		"en": "the referee is already attributed to a referrer",
+		"ru": "реферал уже засчитан рефереру",
+	}},
+	CodeDomainMismatch: {http.StatusUnprocessableEntity, map[string]string{
+		"en": "this referral code is limited to email addresses in another domain",
+		"ru": "реферальный код доступен только для email в другом домене",
+	}},
+	CodeTermsNotAccepted: {http.StatusPreconditionRequired, map[string]string{
+		"en": "accept the current referral program terms via POST /p/terms/accept first",
+		"ru": "сначала примите текущие условия реферальной программы через POST /p/terms/accept",
+	}},
+	CodeInsufficientBalance: {http.StatusConflict, map[string]string{
+		"en": "reward balance is too low for this redemption",
+		"ru": "баланса вознаграждений недостаточно для списания",
+	}},
+	CodeEmailTaken: {http.StatusConflict, map[string]string{
+		"en": "email is already registered or has a reserved code",
+		"ru": "email уже зарегистрирован или для него уже зарезервирован код",
+	}},
+	CodeUsernameTaken: {http.StatusConflict, map[string]string{
+		"en": "username is already taken",
+		"ru": "имя пользователя уже занято",
+	}},
+	CodeRegistrationDisabled: {http.StatusForbidden, map[string]string{
+		"en": "this registration method is disabled, see GET /config/public",
+		"ru": "этот способ регистрации выключен, см. GET /config/public",
+	}},
+	CodeRegistrationQueueFull: {http.StatusTooManyRequests, map[string]string{
+		"en": "registration queue is full, try again later",
+		"ru": "очередь регистраций заполнена, повторите позже",
+	}},
+	CodeRegistrationNotFound: {http.StatusNotFound, map[string]string{
+		"en": "queued registration not found",
+		"ru": "регистрация в очереди не найдена",
+	}},
+	CodeMetadataInvalid: {http.StatusUnprocessableEntity, map[string]string{
+		"en": "metadata must be a JSON object of at most 4 KB and 4 levels of nesting",
+		"ru": "метаданные должны быть JSON-объектом не больше 4 КБ и 4 уровней вложенности",
+	}},
+	CodePayloadTooLarge: {http.StatusRequestEntityTooLarge, map[string]string{
+		"en": "request body is too large",
+		"ru": "тело запроса слишком большое",
+	}},
+	CodeUnsupportedEncoding: {http.StatusUnsupportedMediaType, map[string]string{
+		"en": "unsupported Content-Encoding, only gzip is accepted",
+		"ru": "неподдерживаемый Content-Encoding, принимается только gzip",
+	}},
+	CodeTooManyRequests: {http.StatusTooManyRequests, map[string]string{
+		"en": "too many malformed requests, try again later",
+		"ru": "слишком много некорректных запросов, повторите позже",
+	}},
+	CodeMagicLinkRateLimited: {http.StatusTooManyRequests, map[string]string{
+		"en": "too many login links requested for this email, try again later",
+		"ru": "слишком много запросов ссылки входа для этого email, повторите позже",
+	}},
+	CodeMagicLinkInvalid: {http.StatusUnauthorized, map[string]string{
+		"en": "login link is invalid, expired or already used",
+		"ru": "ссылка входа недействительна, истекла или уже использована",
+	}},
+	CodeActionLinkInvalid: {http.StatusBadRequest, map[string]string{
+		"en": "the link is invalid, open it from the email again",
+		"ru": "ссылка недействительна, откройте ее из письма еще раз",
+	}},
+	CodeActionLinkUsed: {http.StatusGone, map[string]string{
+		"en": "the link has expired or has already been used",
+		"ru": "срок ссылки истек, или она уже использована",
+	}},
+	CodeWidgetRateLimited: {http.StatusTooManyRequests, map[string]string{
+		"en": "too many widget requests for this referral code, try again later",
+		"ru": "слишком много запросов виджета для этого реферального кода, повторите позже",
+	}},
+	CodeQuotaExceeded: {http.StatusTooManyRequests, map[string]string{
+		"en": "quota exceeded, try again after it resets",
+		"ru": "квота исчерпана, повторите после ее сброса",
+	}},
+	CodeEmailTemplateNotFound: {http.StatusNotFound, map[string]string{
+		"en": "email template not found",
+		"ru": "шаблон письма не найден",
+	}},
+	CodeWebhookDeliveryNotFound: {http.StatusNotFound, map[string]string{
+		"en": "webhook delivery not found",
+		"ru": "доставка события не найдена",
+	}},
+	CodeStatementNotFound: {http.StatusNotFound, map[string]string{
+		"en": "no reward statement for this month",
+		"ru": "выписки за этот месяц нет",
+	}},
+	CodeRouteNotFound: {http.StatusNotFound, map[string]string{
+		"en": "no such route",
+		"ru": "маршрут не найден",
+	}},
+	CodeMethodNotAllowed: {http.StatusMethodNotAllowed, map[string]string{
+		"en": "method not allowed for this route, see the Allow header",
+		"ru": "метод не поддерживается для этого маршрута, допустимые методы - в заголовке Allow",
+	}},
+	CodeInternal: {http.StatusInternalServerError, map[string]string{
+		"en": "internal server error",
+		"ru": "внутренняя ошибка сервера",
+	}},
+	CodeInternalPanic: {http.StatusInternalServerError, map[string]string{
+		"en": "internal server error",
+		"ru": "внутренняя ошибка сервера",
+	}},
+	CodeServiceUnavailable: {http.StatusServiceUnavailable, map[string]string{
+		"en": "service temporarily unavailable",
+		"ru": "сервис временно недоступен",
+	}},
+	CodeTimeout: {http.StatusGatewayTimeout, map[string]string{
+		"en": "request timed out",
+		"ru": "превышено время ожидания запроса",
+	}},
+}
+
+// errorStatus возвращает HTTP-статус для кода ошибки.
+func errorStatus(code string) int {
+	if def, ok := errorCatalog[code]; ok {
+		return def.status
+	}
+	return http.StatusInternalServerError
+}
+
+// message возвращает текст ошибки на запрошенном языке,
+// при отсутствии перевода - на языке по умолчанию.
+// Описание кода ошибки для клиентов, см. ErrorCodes
+type ErrorCodeInfo struct {
+	Code        string            `json:"code"`
+	Status      int               `json:"status"`
+	Description string            `json:"description"` // сообщение на языке по умолчанию
+	Messages    map[string]string `json:"messages"`    // сообщения по языкам
+}
+
+// ErrorCodes возвращает все коды ошибок каталога, упорядоченные по коду.
+// Клиенты сверяют по этому списку обработку ошибок вместо текстов.
+func ErrorCodes() []ErrorCodeInfo {
+	codes := make([]ErrorCodeInfo, 0, len(errorCatalog))
+	for code, def := range errorCatalog {
+		messages := make(map[string]string, len(def.messages))
+		for lang, msg := range def.messages {
+			messages[lang] = msg
+		}
+		codes = append(codes, ErrorCodeInfo{
+			Code:        code,
+			Status:      def.status,
+			Description: def.messages[defaultLanguage],
+			Messages:    messages,
+		})
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i].Code < codes[j].Code })
+	return codes
+}
+
+// Обработчик для получения каталога кодов ошибок
+// (/v1/meta/error-codes)
+func (api *API) GetErrorCodes(w http.ResponseWriter, r *http.Request) {
+	respond(w, http.StatusOK, ErrorCodes())
+}
+
+func message(code, lang string) string {
+	def, ok := errorCatalog[code]
+	if !ok {
+		def = errorCatalog[CodeInternal]
+	}
+	if msg, ok := def.messages[lang]; ok {
+		return msg
+	}
+	return def.messages[defaultLanguage]
+}
+
+// language выбирает язык ответа по заголовку Accept-Language
+// с учетом весов q. Неизвестные языки пропускаются.
+func language(r *http.Request) string {
+	type candidate struct {
+		lang string
+		q    float64
+	}
+
+	var candidates []candidate
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		if tag == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		// "ru-RU" -> "ru"
+		if i := strings.IndexByte(tag, '-'); i > 0 {
+			tag = tag[:i]
+		}
+		candidates = append(candidates, candidate{tag, q})
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].q > candidates[j].q
+	})
+	for _, c := range candidates {
+		if c.q <= 0 {
+			continue
+		}
+		if _, ok := errorCatalog[CodeInternal].messages[c.lang]; ok {
+			return c.lang
+		}
+	}
+	return defaultLanguage
+}
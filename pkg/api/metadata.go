@@ -0,0 +1,171 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"gorefer.go/pkg/api/pagination"
+	"gorefer.go/pkg/reqctx"
+	"gorefer.go/pkg/storage"
+)
+
+// Ограничения метаданных реферального кода
+const (
+	maxMetadataSize  = 4 << 10 // байт в исходном JSON
+	maxMetadataDepth = 4       // уровней вложенности, включая корневой объект
+)
+
+// validateMetadata проверяет метаданные кода: JSON-объект не больше
+// maxMetadataSize байт и maxMetadataDepth уровней. Пустое значение
+// (метаданные не переданы) допустимо.
+func validateMetadata(raw json.RawMessage) error {
+	if len(raw) == 0 {
+		return nil
+	}
+	if len(raw) > maxMetadataSize {
+		return fmt.Errorf("metadata is %d bytes, limit is %d", len(raw), maxMetadataSize)
+	}
+	if trimmed := bytes.TrimSpace(raw); len(trimmed) == 0 || trimmed[0] != '{' {
+		return errors.New("metadata must be a JSON object")
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			// raw уже разобран decodeJSON, поэтому ошибка здесь - конец данных
+			return nil
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			if depth++; depth > maxMetadataDepth {
+				return fmt.Errorf("metadata nesting exceeds %d levels", maxMetadataDepth)
+			}
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+	}
+}
+
+// Обработчик для изменения собственного реферального кода: метаданные,
+// ограничение домена email и срок действия expires_at. Каждое из них
+// заменяется целиком, если передано; allowed_domain "" снимает
+// ограничение. Срок проверяется так же, как при создании кода. Изменения
+// применяются вместе и только к текущему коду пользователя.
+func (api *API) UpdateMyReferralCode(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Metadata        json.RawMessage `json:"metadata"`
+		AllowedDomain   *string         `json:"allowed_domain"`
+		AllowSubdomains bool            `json:"allow_subdomains"`
+		ExpiresAt       *int64          `json:"expires_at"`
+	}
+	if !api.decodeJSON(w, r, &request) {
+		return
+	}
+	if len(request.Metadata) == 0 && request.AllowedDomain == nil && request.ExpiresAt == nil {
+		api.writeError(w, r, CodeInvalidPayload, errors.New("metadata, allowed_domain or expires_at is required"))
+		return
+	}
+	if request.ExpiresAt != nil {
+		if err := api.policy.validateExpiry(*request.ExpiresAt); err != nil {
+			code, _ := expiryErrorCode(err)
+			api.writeError(w, r, code, err)
+			return
+		}
+	}
+	if err := validateMetadata(request.Metadata); err != nil {
+		api.writeError(w, r, CodeMetadataInvalid, err)
+		return
+	}
+	update := storage.ReferralCodeUpdate{Metadata: request.Metadata, ExpiresAt: request.ExpiresAt}
+	if request.AllowedDomain != nil {
+		domain, err := domainRestriction(*request.AllowedDomain, request.AllowSubdomains)
+		if err != nil {
+			api.writeError(w, r, CodeInvalidPayload, err)
+			return
+		}
+		update.Domain = &domain
+	} else if request.AllowSubdomains {
+		api.writeError(w, r, CodeInvalidPayload, errors.New("allow_subdomains requires allowed_domain"))
+		return
+	}
+
+	claims, ok := reqctx.UserFrom(r.Context())
+	if !ok {
+		api.writeError(w, r, CodeUnauthorized, nil)
+		return
+	}
+
+	ctx := r.Context()
+
+	resultChan := make(chan error)
+	go func() {
+		resultChan <- api.db.UpdateReferralCode(ctx, claims.UserID, update)
+	}()
+
+	if err := <-resultChan; err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			api.writeError(w, r, CodeReferralCodeNotFound, err)
+			return
+		}
+		if code, ok := expiryErrorCode(err); ok {
+			api.writeError(w, r, code, err)
+			return
+		}
+		api.writeError(w, r, CodeInternal, fmt.Errorf("failed to update referral code: %w", err))
+		return
+	}
+
+	respond(w, http.StatusNoContent, nil)
+}
+
+// Обработчик для получения списка реферальных кодов (admin). Параметры
+// meta_key и meta_value отбирают коды, в метаданных которых есть ключ с
+// указанным строковым значением. Поддерживает limit/offset.
+func (api *API) ListReferralCodes(w http.ResponseWriter, r *http.Request) {
+	page, err := pagination.Parse(r, api.pages)
+	if err != nil {
+		api.writeError(w, r, CodeInvalidParameter, err)
+		return
+	}
+
+	q := r.URL.Query()
+	filter := storage.ReferralCodeFilter{MetaKey: q.Get("meta_key"), MetaValue: q.Get("meta_value")}
+	if filter.MetaKey == "" && q.Has("meta_value") {
+		api.writeError(w, r, CodeInvalidParameter, errors.New("meta_value requires meta_key"))
+		return
+	}
+
+	ctx := r.Context()
+
+	resultChan := make(chan []storage.ReferralCode)
+	errorChan := make(chan error)
+
+	go func() {
+		// лишняя запись показывает, есть ли следующая страница
+		codes, err := api.db.ListReferralCodes(ctx, filter, page.Limit+1, page.Offset)
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		resultChan <- codes
+	}()
+
+	select {
+	case codes := <-resultChan:
+		hasMore := len(codes) > page.Limit
+		if hasMore {
+			codes = codes[:page.Limit]
+		}
+		pagination.SetLink(w, r, page, hasMore)
+		respond(w, http.StatusOK, codes)
+
+	case err := <-errorChan:
+		api.writeError(w, r, CodeInternal, fmt.Errorf("failed to list referral codes: %w", err))
+		return
+	}
+}
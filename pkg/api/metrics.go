@@ -0,0 +1,174 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/go-chi/chi/v5"
+	"gorefer.go/pkg/api/middlware"
+)
+
+// Причины ответов 4xx в метриках
+const (
+	ReasonDecode     = "decode_error"     // тело запроса не разбирается как JSON
+	ReasonValidation = "validation_error" // некорректные данные запроса
+	ReasonAuth       = "auth_error"       // 401 и 403
+	ReasonOther      = "other_error"      // прочие 4xx: 404, 409, 429 и т.п.
+	// клиент закрыл соединение, не дождавшись ответа
+	ReasonClientClosed = "client_closed"
+)
+
+// Маршрут в метриках для запросов, не совпавших ни с одним шаблоном
+const unmatchedRoute = "unmatched"
+
+// ErrorCounts - число ответов 4xx по маршруту ("POST /register") и причине.
+type ErrorCounts map[string]map[string]int64
+
+// errorMetrics - счетчики ответов 4xx, а также общее число ответов и
+// ответов 5xx для сводки /admin/overview. Безопасны для конкурентного
+// использования.
+type errorMetrics struct {
+	mu           sync.Mutex
+	counts       ErrorCounts
+	requests     int64
+	clientErrors int64
+	serverErrors int64
+	panics       PanicCounts
+}
+
+// RequestTotals - общее число ответов и доля ошибок с запуска сервиса.
+type RequestTotals struct {
+	Requests     int64   `json:"requests"`
+	ClientErrors int64   `json:"client_errors"`
+	ServerErrors int64   `json:"server_errors"`
+	ErrorRate    float64 `json:"error_rate"` // доля ответов 5xx
+}
+
+// observe учитывает ответ со статусом status в общих счетчиках.
+func (m *errorMetrics) observe(status int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests++
+	switch {
+	case status >= 500:
+		m.serverErrors++
+	case status >= 400:
+		m.clientErrors++
+	}
+}
+
+func (m *errorMetrics) totals() RequestTotals {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t := RequestTotals{Requests: m.requests, ClientErrors: m.clientErrors, ServerErrors: m.serverErrors}
+	if m.requests > 0 {
+		t.ErrorRate = float64(m.serverErrors) / float64(m.requests)
+	}
+	return t
+}
+
+func (m *errorMetrics) inc(route, reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.counts == nil {
+		m.counts = ErrorCounts{}
+	}
+	if m.counts[route] == nil {
+		m.counts[route] = map[string]int64{}
+	}
+	m.counts[route][reason]++
+}
+
+func (m *errorMetrics) snapshot() ErrorCounts {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counts := make(ErrorCounts, len(m.counts))
+	for route, reasons := range m.counts {
+		counts[route] = make(map[string]int64, len(reasons))
+		for reason, n := range reasons {
+			counts[route][reason] = n
+		}
+	}
+	return counts
+}
+
+// ErrorCounts возвращает текущие значения счетчиков ответов 4xx.
+func (api *API) ErrorCounts() ErrorCounts {
+	return api.metrics.snapshot()
+}
+
+type reasonKey struct{}
+
+// errorReason - причина ошибки, которую обработчик сообщает счетчикам
+// через контекст запроса.
+type errorReason struct {
+	reason string
+}
+
+// setErrorReason задает причину ответа 4xx текущего запроса.
+func setErrorReason(ctx context.Context, reason string) {
+	if er, ok := ctx.Value(reasonKey{}).(*errorReason); ok {
+		er.reason = reason
+	}
+}
+
+// countErrors учитывает ответы 4xx по шаблону маршрута и причине.
+// Причину сообщает обработчик через setErrorReason, иначе она выводится
+// из статуса. Все ответы попадают в общие счетчики. Должен стоять после
+// middlware.TrackWrites.
+func (api *API) countErrors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		er := &errorReason{}
+		r = r.WithContext(context.WithValue(r.Context(), reasonKey{}, er))
+		next.ServeHTTP(w, r)
+
+		status := middlware.Status(w)
+		api.metrics.observe(status)
+		if status < 400 || status >= 500 {
+			return
+		}
+		api.metrics.inc(r.Method+" "+api.routePattern(r), errorReasonFor(status, er.reason))
+	})
+}
+
+// routePattern возвращает шаблон маршрута запроса. Если запрос отклонен
+// middleware группы до выбора маршрута (например, без токена), шаблон
+// ищется заново, чтобы ошибка попала в счетчик конкретного маршрута.
+func (api *API) routePattern(r *http.Request) string {
+	pattern := ""
+	if rctx := chi.RouteContext(r.Context()); rctx != nil {
+		pattern = rctx.RoutePattern()
+	}
+	if pattern == "" || strings.HasSuffix(pattern, "/*") {
+		// маршруты API не включают префикс монтирования, см. Handler
+		path := strings.TrimPrefix(r.URL.Path, basePath(r.Context()))
+		rctx := chi.NewRouteContext()
+		if api.r.Match(rctx, r.Method, path) {
+			pattern = rctx.RoutePattern()
+		}
+	}
+	if pattern == "" {
+		return unmatchedRoute
+	}
+	return pattern
+}
+
+// errorReasonFor выбирает причину для статуса 4xx.
+func errorReasonFor(status int, reason string) string {
+	switch {
+	case reason != "":
+		return reason
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return ReasonAuth
+	case status == http.StatusBadRequest || status == http.StatusUnprocessableEntity:
+		return ReasonValidation
+	}
+	return ReasonOther
+}
+
+// Обработчик для получения счетчиков ответов 4xx (admin).
+func (api *API) GetErrorMetrics(w http.ResponseWriter, r *http.Request) {
+	respond(w, http.StatusOK, api.ErrorCounts())
+}
@@ -6,14 +6,26 @@ import (
 	"net/http"
 
 	"gorefer.go/pkg/auth"
+	"gorefer.go/pkg/reqctx"
 )
 
 type contextKey string
 
+// Ключи контекста, которые TokenAuthMiddleware по-прежнему заполняет для
+// совместимости со сторонним кодом.
+//
+// Deprecated: используйте reqctx.UserFrom.
 const (
-	UserKey contextKey = "username"
+	UserKey   contextKey = "username"
+	ClaimsKey contextKey = "claims"
+	ActorKey  contextKey = "actor" // ID администратора при входе от имени пользователя
 )
 
+// TokenRotateHeader выставляется в ответах на запросы с токеном,
+// подписанным прежним ключом: клиенту нужно получить новый токен через
+// POST /refresh до конца периода ротации.
+const TokenRotateHeader = "X-Token-Rotate"
+
 // TokenAuthMiddleware проверяет токен и добавляет пользователя в контекст
 func TokenAuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -25,16 +37,54 @@ func TokenAuthMiddleware(next http.Handler) http.Handler {
 
 		tokenString = tokenString[len("Bearer "):]
 
-		username, err := auth.ValidateToken(tokenString)
+		claims, err := auth.ValidateToken(tokenString)
 		if err != nil {
 			http.Error(w, "Недействительный токен", http.StatusUnauthorized)
 			fmt.Println("Ошибка при проверке токена:", err)
 			return
 		}
 
-		ctx := context.WithValue(r.Context(), UserKey, username)
+		if claims.StaleKey {
+			w.Header().Set(TokenRotateHeader, "true")
+		}
+
+		ctx := reqctx.WithUser(r.Context(), claims)
+		ctx = context.WithValue(ctx, UserKey, claims.Username)
+		ctx = context.WithValue(ctx, ClaimsKey, claims)
+		if claims.Impersonated() {
+			ctx = context.WithValue(ctx, ActorKey, claims.Act.UserID)
+		}
 		r = r.WithContext(ctx)
 
 		next.ServeHTTP(w, r)
 	})
 }
+
+// DenyImpersonation запрещает доступ с токеном входа от имени пользователя.
+// Применяется к чувствительным маршрутам (смена пароля, удаление аккаунта,
+// 2FA) после TokenAuthMiddleware.
+func DenyImpersonation(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := reqctx.UserFrom(r.Context())
+		if !ok || claims.Impersonated() {
+			http.Error(w, "Действие недоступно при входе от имени пользователя", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireRole пропускает только пользователей с указанной ролью.
+// Должен применяться после TokenAuthMiddleware.
+func RequireRole(role string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := reqctx.UserFrom(r.Context())
+			if !ok || claims.Role != role {
+				http.Error(w, "Доступ запрещен", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
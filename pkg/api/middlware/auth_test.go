@@ -0,0 +1,85 @@
+package middlware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"gorefer.go/pkg/auth"
+	"gorefer.go/pkg/reqctx"
+)
+
+func TestDenyImpersonation(t *testing.T) {
+	regular, err := auth.GenerateToken(5, "user", "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	impersonated, err := auth.GenerateImpersonationToken(5, "user", "user", auth.Actor{UserID: 1, Username: "admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		token        string
+		expectedCode int
+		wantActor    int
+	}{
+		{"Regular token passes", regular, http.StatusOK, 0},
+		{"Impersonation token is rejected", impersonated, http.StatusForbidden, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var actor, userID int
+			h := TokenAuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// устаревший ключ заполняется для совместимости
+				actor, _ = r.Context().Value(ActorKey).(int)
+				if claims, ok := reqctx.UserFrom(r.Context()); ok {
+					userID = claims.UserID
+				}
+				DenyImpersonation(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusOK)
+				})).ServeHTTP(w, r)
+			}))
+
+			req := httptest.NewRequest("POST", "/p/password", nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedCode {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, tt.expectedCode)
+			}
+			if actor != tt.wantActor {
+				t.Errorf("actor in context = %d, want %d", actor, tt.wantActor)
+			}
+			if userID != 5 {
+				t.Errorf("reqctx user ID = %d, want 5", userID)
+			}
+		})
+	}
+}
+
+func TestRequestContext(t *testing.T) {
+	var (
+		ip, reqID   string
+		ipOK, reqOK bool
+	)
+	h := middleware.RequestID(RequestContext(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip, ipOK = reqctx.ClientIPFrom(r.Context())
+		reqID, reqOK = reqctx.RequestIDFrom(r.Context())
+	})))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "192.0.2.10:4321"
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	if !ipOK || ip != "192.0.2.10" {
+		t.Errorf("ClientIPFrom() = %q, %v, want 192.0.2.10", ip, ipOK)
+	}
+	if !reqOK || reqID == "" {
+		t.Errorf("RequestIDFrom() = %q, %v, want a request ID", reqID, reqOK)
+	}
+}
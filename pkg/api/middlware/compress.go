@@ -0,0 +1,264 @@
+package middlware
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ErrBodyTooLarge - распакованное тело запроса превышает допустимый размер.
+var ErrBodyTooLarge = errors.New("decompressed request body too large")
+
+// ErrUnsupportedEncoding - тело запроса сжато неподдерживаемым способом.
+var ErrUnsupportedEncoding = errors.New("unsupported request content encoding")
+
+// Compress сжимает ответы gzip, если клиент принимает gzip, и
+// распаковывает тела запросов с Content-Encoding: gzip.
+//
+// Ответ короче minSize байт отправляется без сжатия; до принятия решения
+// он накапливается в буфере. Flush сжимает уже записанное и отправляет
+// клиенту, поэтому потоковые ответы не задерживаются. Не сжимаются
+// ответы без тела, уже сжатые (с Content-Encoding), изображения и
+// архивы, а также text/event-stream.
+//
+// Распакованное тело запроса длиннее maxBody байт не читается: чтение
+// возвращает ErrBodyTooLarge. Тело с другим Content-Encoding при чтении
+// возвращает ErrUnsupportedEncoding. Ошибки чтения обрабатывает
+// обработчик, разбирающий тело.
+func Compress(minSize int, maxBody int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Body != nil && r.Body != http.NoBody {
+				switch encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); encoding {
+				case "", "identity":
+				case "gzip", "x-gzip":
+					r.Body = &gzipBody{src: r.Body, limit: maxBody}
+					r.Header.Del("Content-Encoding")
+					r.Header.Del("Content-Length")
+					r.ContentLength = -1
+				default:
+					r.Body = errorBody{src: r.Body, err: ErrUnsupportedEncoding}
+				}
+			}
+
+			w.Header().Add("Vary", "Accept-Encoding")
+			if r.Method == http.MethodHead || !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			gw := &gzipWriter{ResponseWriter: w, minSize: minSize}
+			defer gw.close()
+			next.ServeHTTP(gw, r)
+		})
+	}
+}
+
+// acceptsGzip сообщает, принимает ли клиент gzip: в Accept-Encoding
+// есть gzip или "*" с ненулевым весом.
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				var err error
+				if q, err = strconv.ParseFloat(v, 64); err != nil {
+					q = 0
+				}
+			}
+		}
+		if q > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// compressible сообщает, имеет ли смысл сжимать ответ с заголовками h.
+func compressible(h http.Header) bool {
+	if h.Get("Content-Encoding") != "" {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	switch {
+	case mediaType == "text/event-stream",
+		strings.HasPrefix(mediaType, "image/"),
+		strings.HasPrefix(mediaType, "video/"),
+		strings.HasPrefix(mediaType, "audio/"),
+		mediaType == "application/zip",
+		mediaType == "application/gzip":
+		return false
+	}
+	return true
+}
+
+// gzipWriter откладывает отправку заголовков, пока не станет ясно,
+// сжимать ли ответ.
+type gzipWriter struct {
+	http.ResponseWriter
+	minSize int
+	status  int
+	buf     []byte
+	decided bool
+	gz      *gzip.Writer // nil - ответ отправляется без сжатия
+}
+
+func (gw *gzipWriter) WriteHeader(code int) {
+	if gw.decided || gw.status != 0 {
+		return
+	}
+	if code < http.StatusOK {
+		gw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	gw.status = code
+	if !bodyAllowed(code) {
+		gw.decide(false)
+	}
+}
+
+func (gw *gzipWriter) Write(b []byte) (int, error) {
+	if !gw.decided {
+		gw.buf = append(gw.buf, b...)
+		if len(gw.buf) < gw.minSize {
+			return len(b), nil
+		}
+		if err := gw.decide(true); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if gw.gz != nil {
+		return gw.gz.Write(b)
+	}
+	return gw.ResponseWriter.Write(b)
+}
+
+// Flush отправляет накопленное клиенту, сжимая его, если ответ
+// подлежит сжатию.
+func (gw *gzipWriter) Flush() {
+	if !gw.decided {
+		gw.decide(true)
+	}
+	if gw.gz != nil {
+		gw.gz.Flush()
+	}
+	http.NewResponseController(gw.ResponseWriter).Flush()
+}
+
+// Unwrap нужен http.ResponseController для доступа к исходному writer.
+func (gw *gzipWriter) Unwrap() http.ResponseWriter {
+	return gw.ResponseWriter
+}
+
+// decide отправляет заголовки и накопленное тело. При compress ответ
+// сжимается, если его тип это допускает.
+func (gw *gzipWriter) decide(compress bool) error {
+	gw.decided = true
+	if gw.status == 0 {
+		gw.status = http.StatusOK
+	}
+	h := gw.Header()
+	if compress && bodyAllowed(gw.status) && compressible(h) {
+		if h.Get("Content-Type") == "" {
+			// без типа net/http определил бы его по сжатым байтам
+			h.Set("Content-Type", http.DetectContentType(gw.buf))
+		}
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", "gzip")
+		gw.gz = gzip.NewWriter(gw.ResponseWriter)
+	}
+	gw.ResponseWriter.WriteHeader(gw.status)
+
+	buf := gw.buf
+	gw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if gw.gz != nil {
+		_, err = gw.gz.Write(buf)
+	} else {
+		_, err = gw.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// close завершает ответ: короткий ответ отправляется без сжатия.
+func (gw *gzipWriter) close() {
+	if !gw.decided {
+		if gw.status == 0 && len(gw.buf) == 0 {
+			// обработчик ничего не записал, ответ формирует net/http
+			return
+		}
+		gw.decide(false)
+	}
+	if gw.gz != nil {
+		gw.gz.Close()
+	}
+}
+
+// bodyAllowed сообщает, может ли ответ со статусом code иметь тело.
+func bodyAllowed(code int) bool {
+	return code != http.StatusNoContent && code != http.StatusNotModified
+}
+
+// gzipBody распаковывает тело запроса при чтении, ограничивая размер
+// распакованных данных.
+type gzipBody struct {
+	src   io.ReadCloser
+	limit int64
+	zr    *gzip.Reader
+	read  int64
+	err   error
+}
+
+func (b *gzipBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	if b.zr == nil {
+		if b.zr, b.err = gzip.NewReader(b.src); b.err != nil {
+			return 0, b.err
+		}
+	}
+	// читается не больше чем на байт сверх предела, чтобы заметить превышение
+	if room := b.limit + 1 - b.read; int64(len(p)) > room {
+		p = p[:room]
+	}
+	n, err := b.zr.Read(p)
+	b.read += int64(n)
+	if b.read > b.limit {
+		b.err = ErrBodyTooLarge
+		return 0, b.err
+	}
+	if err != nil {
+		b.err = err
+	}
+	return n, err
+}
+
+func (b *gzipBody) Close() error {
+	if b.zr != nil {
+		b.zr.Close()
+	}
+	return b.src.Close()
+}
+
+// errorBody - тело запроса, чтение которого всегда возвращает err.
+type errorBody struct {
+	src io.ReadCloser
+	err error
+}
+
+func (b errorBody) Read([]byte) (int, error) { return 0, b.err }
+
+func (b errorBody) Close() error { return b.src.Close() }
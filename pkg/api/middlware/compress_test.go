@@ -0,0 +1,170 @@
+package middlware
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// gzipBytes сжимает b gzip
+func gzipBytes(t *testing.T, b []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestCompress_Response(t *testing.T) {
+	large := strings.Repeat(`{"code":"SPRING","clicks":10},`, 100)
+
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		contentType    string
+		body           string
+		wantGzip       bool
+	}{
+		{"Large JSON is compressed", "gzip, deflate", "application/json", large, true},
+		{"Small JSON is not compressed", "gzip", "application/json", `{"id":1}`, false},
+		{"Client without gzip", "br", "application/json", large, false},
+		{"Gzip refused with zero weight", "gzip;q=0, *;q=0", "application/json", large, false},
+		{"Wildcard accepted", "*", "application/json", large, true},
+		{"PNG is not compressed", "gzip", "image/png", large, false},
+		{"Event stream is not compressed", "gzip", "text/event-stream", large, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := Compress(512, 1<<20)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.WriteHeader(http.StatusCreated)
+				io.WriteString(w, tt.body)
+			}))
+			req := httptest.NewRequest("GET", "/p/referral-codes", nil)
+			req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusCreated {
+				t.Errorf("status = %d, want %d", rr.Code, http.StatusCreated)
+			}
+			if rr.Header().Get("Vary") != "Accept-Encoding" {
+				t.Errorf("Vary = %q, want Accept-Encoding", rr.Header().Get("Vary"))
+			}
+			gzipped := rr.Header().Get("Content-Encoding") == "gzip"
+			if gzipped != tt.wantGzip {
+				t.Fatalf("Content-Encoding = %q, want gzip: %v", rr.Header().Get("Content-Encoding"), tt.wantGzip)
+			}
+
+			body := rr.Body.Bytes()
+			if gzipped {
+				zr, err := gzip.NewReader(rr.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if body, err = io.ReadAll(zr); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if string(body) != tt.body {
+				t.Errorf("body after round trip differs: got %d bytes, want %d", len(body), len(tt.body))
+			}
+		})
+	}
+}
+
+func TestCompress_Streaming(t *testing.T) {
+	// второй кусок пишется только после того, как клиент прочитал первый
+	proceed := make(chan struct{})
+	h := Compress(1<<20, 1<<20)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		io.WriteString(w, "{\"n\":1}\n")
+		http.NewResponseController(w).Flush()
+		<-proceed
+		io.WriteString(w, "{\"n\":2}\n")
+	}))
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL) // клиент сам запрашивает и распаковывает gzip
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if !resp.Uncompressed {
+		t.Error("flushed response below the threshold was not compressed")
+	}
+
+	br := bufio.NewReader(resp.Body)
+	first, err := br.ReadString('\n')
+	close(proceed)
+	if err != nil || first != "{\"n\":1}\n" {
+		t.Fatalf("first chunk = %q, %v", first, err)
+	}
+	rest, err := io.ReadAll(br)
+	if err != nil || string(rest) != "{\"n\":2}\n" {
+		t.Errorf("rest = %q, %v", rest, err)
+	}
+}
+
+func TestCompress_RequestBody(t *testing.T) {
+	payload := []byte(`{"username":"alice","email":"alice@example.com"}`)
+	bomb := gzipBytes(t, bytes.Repeat([]byte("0"), 10<<20))
+
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		want     string
+		wantErr  error
+	}{
+		{"Plain body", "", payload, string(payload), nil},
+		{"Gzip body", "gzip", gzipBytes(t, payload), string(payload), nil},
+		{"Gzip body, mixed case", " GZip ", gzipBytes(t, payload), string(payload), nil},
+		{"Zip bomb", "gzip", bomb, "", ErrBodyTooLarge},
+		{"Unsupported encoding", "br", payload, "", ErrUnsupportedEncoding},
+		{"Corrupt gzip", "gzip", payload, "", gzip.ErrHeader},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				got     []byte
+				readErr error
+			)
+			h := Compress(512, 1<<10)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got, readErr = io.ReadAll(r.Body)
+				if enc := r.Header.Get("Content-Encoding"); enc != "" && readErr == nil {
+					t.Errorf("Content-Encoding %q left on decoded request", enc)
+				}
+			}))
+			req := httptest.NewRequest("POST", "/register", bytes.NewReader(tt.body))
+			if tt.encoding != "" {
+				req.Header.Set("Content-Encoding", tt.encoding)
+			}
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			if !errors.Is(readErr, tt.wantErr) {
+				t.Fatalf("read error = %v, want %v", readErr, tt.wantErr)
+			}
+			if tt.wantErr == nil && string(got) != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+			if errors.Is(tt.wantErr, ErrBodyTooLarge) && len(got) > 1<<10 {
+				t.Errorf("read %d bytes past the limit", len(got))
+			}
+		})
+	}
+}
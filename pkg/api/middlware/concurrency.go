@@ -0,0 +1,92 @@
+package middlware
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// Limiter ограничивает число одновременно обрабатываемых запросов группы
+// маршрутов. Запросы сверх MaxInFlight ждут в очереди; если очередь
+// заполнена, запрос сразу отклоняется, а не копится до истечения
+// таймаута. Безопасен для конкурентного использования.
+type Limiter struct {
+	slots    chan struct{}
+	maxQueue int64
+
+	inFlight atomic.Int64
+	queued   atomic.Int64
+	shed     atomic.Int64
+}
+
+// LimiterStats - текущая загрузка Limiter.
+type LimiterStats struct {
+	InFlight int64 `json:"in_flight"` // обрабатываются сейчас
+	Queued   int64 `json:"queued"`    // ждут освобождения места
+	Shed     int64 `json:"shed"`      // отклонено с запуска
+}
+
+// NewLimiter создает Limiter на maxInFlight одновременных запросов и
+// очередь до maxQueue ожидающих. maxInFlight меньше 1 заменяется на 1,
+// отрицательный maxQueue - на 0.
+func NewLimiter(maxInFlight, maxQueue int) *Limiter {
+	if maxInFlight < 1 {
+		maxInFlight = 1
+	}
+	if maxQueue < 0 {
+		maxQueue = 0
+	}
+	return &Limiter{slots: make(chan struct{}, maxInFlight), maxQueue: int64(maxQueue)}
+}
+
+// Stats возвращает текущую загрузку.
+func (l *Limiter) Stats() LimiterStats {
+	return LimiterStats{InFlight: l.inFlight.Load(), Queued: l.queued.Load(), Shed: l.shed.Load()}
+}
+
+// acquire занимает место для запроса. false - очередь заполнена или
+// запрос отменен, пока ждал.
+func (l *Limiter) acquire(r *http.Request) bool {
+	select {
+	case l.slots <- struct{}{}:
+		l.inFlight.Add(1)
+		return true
+	default:
+	}
+
+	if l.queued.Add(1) > l.maxQueue {
+		l.queued.Add(-1)
+		l.shed.Add(1)
+		return false
+	}
+	defer l.queued.Add(-1)
+	select {
+	case l.slots <- struct{}{}:
+		l.inFlight.Add(1)
+		return true
+	case <-r.Context().Done():
+		l.shed.Add(1)
+		return false
+	}
+}
+
+func (l *Limiter) release() {
+	l.inFlight.Add(-1)
+	<-l.slots
+}
+
+// Concurrency пропускает запросы через l. Отклоненные запросы получают
+// ответ reject, обычно 503 с Retry-After; обработчик для них не
+// вызывается. Для очереди важен дедлайн запроса, поэтому middleware
+// ставится после Timeout.
+func Concurrency(l *Limiter, reject func(http.ResponseWriter, *http.Request)) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !l.acquire(r) {
+				reject(w, r)
+				return
+			}
+			defer l.release()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package middlware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// waitStats ждет, пока загрузка l не станет want
+func waitStats(t *testing.T, l *Limiter, want func(LimiterStats) bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !want(l.Stats()) {
+		if time.Now().After(deadline) {
+			t.Fatalf("limiter stats = %+v", l.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestConcurrency_ShedsBeyondQueue(t *testing.T) {
+	const inFlight, queue, total = 2, 3, 12
+	l := NewLimiter(inFlight, queue)
+
+	// медленный хэшер: держит запрос, пока тест не отпустит все
+	release := make(chan struct{})
+	hasher := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusCreated)
+	})
+	reject := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	h := Concurrency(l, reject)(hasher)
+
+	statuses := make(chan int, total)
+	for i := 0; i < total; i++ {
+		go func() {
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest("POST", "/login", nil))
+			statuses <- rr.Code
+		}()
+	}
+
+	// пока допущенные запросы держат хэшер, лишние уже получили ответ
+	timeout := time.After(2 * time.Second)
+	for shed := 0; shed < total-inFlight-queue; shed++ {
+		select {
+		case code := <-statuses:
+			if code != http.StatusServiceUnavailable {
+				t.Fatalf("response before release = %d, want 503", code)
+			}
+		case <-timeout:
+			t.Fatalf("only %d of %d requests were shed while the hasher was busy", shed, total-inFlight-queue)
+		}
+	}
+	waitStats(t, l, func(s LimiterStats) bool { return s.InFlight == inFlight && s.Queued == queue })
+	if s := l.Stats(); s.Shed != total-inFlight-queue {
+		t.Errorf("shed = %d, want %d", s.Shed, total-inFlight-queue)
+	}
+
+	close(release)
+	for i := 0; i < inFlight+queue; i++ {
+		if code := <-statuses; code != http.StatusCreated {
+			t.Errorf("admitted request = %d, want 201", code)
+		}
+	}
+	if s := l.Stats(); s.InFlight != 0 || s.Queued != 0 {
+		t.Errorf("stats after completion = %+v, want nothing in flight or queued", s)
+	}
+}
+
+func TestConcurrency_QueuedRequestCanceled(t *testing.T) {
+	l := NewLimiter(1, 1)
+	release := make(chan struct{})
+	defer close(release)
+	h := Concurrency(l, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+
+	go h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/login", nil))
+	waitStats(t, l, func(s LimiterStats) bool { return s.InFlight == 1 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("POST", "/login", nil).WithContext(ctx))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503", rr.Code)
+	}
+	if s := l.Stats(); s.Queued != 0 || s.Shed != 1 {
+		t.Errorf("stats = %+v, want empty queue and one shed request", s)
+	}
+}
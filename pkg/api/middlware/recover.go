@@ -0,0 +1,30 @@
+package middlware
+
+import (
+	"errors"
+	"net/http"
+	"runtime/debug"
+)
+
+// Recoverer перехватывает панику обработчика и передает ее onPanic вместе
+// со стеком. Ответ формирует onPanic; если отправка ответа уже начата,
+// писать заголовки повторно нельзя, см. Written. http.ErrAbortHandler не
+// перехватывается: им обработчик намеренно обрывает соединение. Ставится
+// после TrackWrites.
+func Recoverer(onPanic func(w http.ResponseWriter, r *http.Request, rec interface{}, stack []byte)) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer func() {
+				rec := recover()
+				if rec == nil {
+					return
+				}
+				if err, ok := rec.(error); ok && errors.Is(err, http.ErrAbortHandler) {
+					panic(rec)
+				}
+				onPanic(w, r, rec, debug.Stack())
+			}()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,26 @@
+package middlware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRecoverer_AbortHandlerPassesThrough(t *testing.T) {
+	called := false
+	h := TrackWrites(Recoverer(func(w http.ResponseWriter, r *http.Request, rec interface{}, stack []byte) {
+		called = true
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	})))
+
+	defer func() {
+		if rec := recover(); rec != http.ErrAbortHandler {
+			t.Errorf("recovered %v, want http.ErrAbortHandler", rec)
+		}
+		if called {
+			t.Error("onPanic called for http.ErrAbortHandler")
+		}
+	}()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+}
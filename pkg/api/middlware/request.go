@@ -0,0 +1,31 @@
+package middlware
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"gorefer.go/pkg/reqctx"
+)
+
+// RequestContext сохраняет в контексте ID запроса и IP клиента для
+// reqctx.RequestIDFrom и reqctx.ClientIPFrom. Должен стоять после
+// middleware.RequestID.
+func RequestContext(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := reqctx.WithClientIP(r.Context(), clientIP(r))
+		if id := middleware.GetReqID(ctx); id != "" {
+			ctx = reqctx.WithRequestID(ctx, id)
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// clientIP возвращает адрес клиента без порта.
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
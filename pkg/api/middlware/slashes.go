@@ -0,0 +1,74 @@
+package middlware
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// CleanSlashes приводит путь запроса к каноническому виду до
+// маршрутизации: повторные слэши схлопываются, завершающий слэш
+// отбрасывается. GET и HEAD перенаправляются на канонический путь с
+// кодом 308, остальные методы обрабатываются по нему сразу, чтобы не
+// терять тело запроса. Путь обрабатывается в экранированном виде, так что
+// закодированные символы в параметрах пути, например в email, не
+// меняются. Канонический путь не начинается с "//", поэтому
+// перенаправление не уводит на другой хост. Путь маршрута chi
+// (RoutePath), заданный при монтировании под префиксом, очищается так же.
+func CleanSlashes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		escaped := r.URL.EscapedPath()
+		clean := cleanSlashes(escaped)
+		if clean == escaped {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			target := clean
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusPermanentRedirect)
+			return
+		}
+		path, err := url.PathUnescape(clean)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		u := *r.URL
+		u.Path, u.RawPath = path, ""
+		if u.EscapedPath() != clean {
+			u.RawPath = clean
+		}
+		r = r.WithContext(r.Context())
+		r.URL = &u
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePath != "" {
+			rctx.RoutePath = cleanSlashes(rctx.RoutePath)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// cleanSlashes схлопывает повторные слэши и отбрасывает завершающий
+// слэш, кроме корня.
+func cleanSlashes(p string) string {
+	if !strings.Contains(p, "//") && (len(p) <= 1 || !strings.HasSuffix(p, "/")) {
+		return p
+	}
+	var b strings.Builder
+	b.Grow(len(p))
+	for i := 0; i < len(p); i++ {
+		if p[i] == '/' && i > 0 && p[i-1] == '/' {
+			continue
+		}
+		b.WriteByte(p[i])
+	}
+	clean := b.String()
+	if len(clean) > 1 {
+		clean = strings.TrimSuffix(clean, "/")
+	}
+	return clean
+}
@@ -0,0 +1,56 @@
+package middlware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCleanSlashes(t *testing.T) {
+	tests := []struct {
+		name         string
+		method       string
+		target       string
+		wantStatus   int
+		wantLocation string
+		wantPath     string // путь, который видит обработчик
+	}{
+		{"Canonical", "GET", "/login", http.StatusOK, "", "/login"},
+		{"Root", "GET", "/", http.StatusOK, "", "/"},
+		{"GET trailing slash", "GET", "/p/stats/", http.StatusPermanentRedirect, "/p/stats", ""},
+		{"GET double slash", "GET", "//p//stats", http.StatusPermanentRedirect, "/p/stats", ""},
+		{"GET keeps query", "GET", "/p/referral-codes/compare/?include_archived=true", http.StatusPermanentRedirect, "/p/referral-codes/compare?include_archived=true", ""},
+		{"GET keeps escaped email", "GET", "/p/referral-code/a%2Bb%40example.com/", http.StatusPermanentRedirect, "/p/referral-code/a%2Bb%40example.com", ""},
+		{"HEAD trailing slash", "HEAD", "/p/referral-code/", http.StatusPermanentRedirect, "/p/referral-code", ""},
+		{"POST trailing slash", "POST", "/register/", http.StatusOK, "", "/register"},
+		{"POST double slash", "POST", "//login", http.StatusOK, "", "/login"},
+		{"PATCH both", "PATCH", "//p///me//", http.StatusOK, "", "/p/me"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotPath, gotBody string
+			h := CleanSlashes(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotPath = r.URL.EscapedPath()
+				body, _ := io.ReadAll(r.Body)
+				gotBody = string(body)
+			}))
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.target, strings.NewReader("payload")))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("Location"); got != tt.wantLocation {
+				t.Errorf("Location = %q, want %q", got, tt.wantLocation)
+			}
+			if gotPath != tt.wantPath {
+				t.Errorf("handler path = %q, want %q", gotPath, tt.wantPath)
+			}
+			if tt.wantPath != "" && gotBody != "payload" {
+				t.Errorf("handler body = %q, want payload", gotBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package middlware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gorefer.go/pkg/timing"
+)
+
+// RequestTimeoutHeader - заголовок, которым клиент сообщает, сколько
+// секунд готов ждать ответа, например "60" или "0.5".
+const RequestTimeoutHeader = "X-Request-Timeout"
+
+// MinRequestTimeout - наименьший бюджет, который может запросить клиент;
+// меньшие значения поднимаются до него.
+const MinRequestTimeout = 500 * time.Millisecond
+
+// Этап Server-Timing с действующим бюджетом времени запроса
+const phaseDeadline = "deadline"
+
+// ErrInvalidRequestTimeout - значение RequestTimeoutHeader не является
+// положительным числом секунд.
+var ErrInvalidRequestTimeout = errors.New("invalid " + RequestTimeoutHeader)
+
+// ParseRequestTimeout разбирает значение RequestTimeoutHeader и
+// приводит его к границам [MinRequestTimeout, ceiling]. Ошибка
+// оборачивает ErrInvalidRequestTimeout.
+func ParseRequestTimeout(value string, ceiling time.Duration) (time.Duration, error) {
+	secs, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(secs) || math.IsInf(secs, 0) || secs <= 0 {
+		return 0, fmt.Errorf("%w: %q is not a positive number of seconds", ErrInvalidRequestTimeout, value)
+	}
+	// сравнение в секундах: большое значение переполнило бы Duration
+	if secs >= ceiling.Seconds() {
+		return ceiling, nil
+	}
+	return min(max(MinRequestTimeout, time.Duration(secs*float64(time.Second))), ceiling), nil
+}
+
+// Timeout ограничивает время обработки запроса: контекст запроса получает
+// дедлайн d. Обработчики передают этот контекст в хранилище, а ошибка
+// истечения дедлайна превращается общим обработчиком ошибок в 504.
+//
+// Клиент может запросить другой бюджет заголовком RequestTimeoutHeader:
+// значение приводится к границам [MinRequestTimeout, ceiling], ceiling
+// меньше d заменяется на d. На некорректное значение отвечает invalid.
+// Действующий бюджет попадает в Server-Timing как этап deadline, если
+// замеры включены, см. ServerTiming.
+func Timeout(d, ceiling time.Duration, invalid func(http.ResponseWriter, *http.Request, error)) func(http.Handler) http.Handler {
+	ceiling = max(ceiling, d)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			budget := d
+			if value := r.Header.Get(RequestTimeoutHeader); value != "" {
+				var err error
+				if budget, err = ParseRequestTimeout(value, ceiling); err != nil {
+					invalid(w, r, err)
+					return
+				}
+			}
+			if rec := timing.FromContext(r.Context()); rec != nil {
+				rec.Add(phaseDeadline, budget)
+			}
+			ctx, cancel := context.WithTimeout(r.Context(), budget)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package middlware
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseRequestTimeout(t *testing.T) {
+	const ceiling = 60 * time.Second
+	tests := []struct {
+		name    string
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"Within bounds", "30", 30 * time.Second, false},
+		{"Fractional", "1.5", 1500 * time.Millisecond, false},
+		{"Above ceiling", "600", ceiling, false},
+		{"Huge", "1e300", ceiling, false},
+		{"Below floor", "0.01", MinRequestTimeout, false},
+		{"Zero", "0", 0, true},
+		{"Negative", "-5", 0, true},
+		{"Not a number", "soon", 0, true},
+		{"NaN", "NaN", 0, true},
+		{"Infinity", "+Inf", 0, true},
+		{"Duration syntax", "30s", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseRequestTimeout(tt.value, ceiling)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidRequestTimeout) {
+					t.Errorf("ParseRequestTimeout(%q) error = %v, want ErrInvalidRequestTimeout", tt.value, err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("ParseRequestTimeout(%q) = %v, %v; want %v", tt.value, got, err, tt.want)
+			}
+		})
+	}
+
+	// потолок ниже нижней границы не превышается
+	if got, err := ParseRequestTimeout("0.01", 100*time.Millisecond); err != nil || got != 100*time.Millisecond {
+		t.Errorf("ParseRequestTimeout with low ceiling = %v, %v; want 100ms", got, err)
+	}
+}
+
+func TestTimeout_ClientHint(t *testing.T) {
+	const budget, ceiling = 5 * time.Second, 60 * time.Second
+	tests := []struct {
+		name       string
+		header     string
+		want       time.Duration
+		wantStatus int
+	}{
+		{"Default budget", "", budget, http.StatusOK},
+		{"Longer", "30", 30 * time.Second, http.StatusOK},
+		{"Clamped to ceiling", "3600", ceiling, http.StatusOK},
+		{"Shorter", "1", time.Second, http.StatusOK},
+		{"Clamped to floor", "0.001", MinRequestTimeout, http.StatusOK},
+		{"Invalid", "forever", 0, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var remaining time.Duration
+			h := Timeout(budget, ceiling, func(w http.ResponseWriter, r *http.Request, err error) {
+				w.WriteHeader(http.StatusBadRequest)
+			})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				deadline, ok := r.Context().Deadline()
+				if !ok {
+					t.Fatal("request context has no deadline")
+				}
+				remaining = time.Until(deadline)
+			}))
+
+			req := httptest.NewRequest("GET", "/p/me/export", nil)
+			if tt.header != "" {
+				req.Header.Set(RequestTimeoutHeader, tt.header)
+			}
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rr.Code, tt.wantStatus)
+			}
+			if tt.want != 0 && (remaining > tt.want || remaining < tt.want-time.Second) {
+				t.Errorf("deadline in %v, want about %v", remaining, tt.want)
+			}
+		})
+	}
+}
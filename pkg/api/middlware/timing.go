@@ -0,0 +1,76 @@
+package middlware
+
+import (
+	"bytes"
+	"net/http"
+	"time"
+
+	"gorefer.go/pkg/timing"
+)
+
+// ServerTimingHeader - заголовок с длительностями этапов обработки запроса.
+const ServerTimingHeader = "Server-Timing"
+
+// Этап кодирования ответа, который замеряет сама ServerTiming
+const phaseEncode = "encode"
+
+// timingWriter придерживает ответ, пока обработчик не завершится:
+// заголовок Server-Timing должен уйти до тела, а этапы известны только
+// в конце.
+type timingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+	// от WriteHeader до конца первой записи тела - кодирование ответа
+	headerAt time.Time
+	encode   time.Duration
+}
+
+func (tw *timingWriter) WriteHeader(code int) {
+	if tw.status == 0 {
+		tw.status = code
+		tw.headerAt = time.Now()
+	}
+}
+
+func (tw *timingWriter) Write(b []byte) (int, error) {
+	if tw.status == 0 {
+		tw.WriteHeader(http.StatusOK)
+	}
+	n, err := tw.body.Write(b)
+	if tw.encode == 0 {
+		tw.encode = time.Since(tw.headerAt)
+	}
+	return n, err
+}
+
+// ServerTiming включает замеры этапов для запросов, для которых enabled
+// возвращает true: обработчики получают timing.Recorder в контексте, а
+// ответ - заголовок Server-Timing. Ответ отправляется целиком после
+// завершения обработчика, поэтому middleware не подходит для потоковых
+// маршрутов. Для остальных запросов накладных расходов нет.
+func ServerTiming(enabled func(*http.Request) bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !enabled(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ctx, rec := timing.NewContext(r.Context())
+			tw := &timingWriter{ResponseWriter: w}
+			next.ServeHTTP(tw, r.WithContext(ctx))
+
+			if tw.status == 0 {
+				tw.status = http.StatusOK
+			}
+			if tw.body.Len() > 0 {
+				rec.Add(phaseEncode, tw.encode)
+			}
+			if h := rec.Header(); h != "" {
+				w.Header().Set(ServerTimingHeader, h)
+			}
+			w.WriteHeader(tw.status)
+			w.Write(tw.body.Bytes())
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package middlware
+
+import "net/http"
+
+// writeTracker запоминает, начал ли обработчик отправку ответа,
+// и с каким статусом.
+type writeTracker struct {
+	http.ResponseWriter
+	written bool
+	status  int
+}
+
+func (tw *writeTracker) WriteHeader(code int) {
+	if !tw.written {
+		tw.status = code
+	}
+	tw.written = true
+	tw.ResponseWriter.WriteHeader(code)
+}
+
+func (tw *writeTracker) Write(b []byte) (int, error) {
+	if !tw.written {
+		tw.status = http.StatusOK
+	}
+	tw.written = true
+	return tw.ResponseWriter.Write(b)
+}
+
+// Unwrap нужен http.ResponseController для доступа к исходному writer.
+func (tw *writeTracker) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+// TrackWrites оборачивает ResponseWriter, чтобы обработчик ошибок мог
+// узнать через Written, отправлены ли уже заголовки.
+func TrackWrites(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&writeTracker{ResponseWriter: w}, r)
+	})
+}
+
+// Status возвращает отправленный статус ответа; 0, если отправка не
+// начата или writer не обернут TrackWrites или ServerTiming.
+func Status(w http.ResponseWriter) int {
+	switch tw := w.(type) {
+	case *writeTracker:
+		return tw.status
+	case *timingWriter:
+		return tw.status
+	}
+	return 0
+}
+
+// Written сообщает, начата ли отправка ответа. Для writer без обертки
+// TrackWrites или ServerTiming возвращает false.
+func Written(w http.ResponseWriter) bool {
+	switch tw := w.(type) {
+	case *writeTracker:
+		return tw.written
+	case *timingWriter:
+		return tw.status != 0
+	}
+	return false
+}
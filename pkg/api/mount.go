@@ -0,0 +1,62 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Ключ контекста для префикса, под которым смонтирован API
+type prefixKey struct{}
+
+// Handler возвращает обработчик API для встраивания в другое приложение
+// под префиксом prefix (например, "/referrals"):
+//
+//	parent.Mount("/referrals", a.Handler("/referrals"))
+//
+// Маршруты сопоставляются с путем запроса без префикса, параметры пути
+// родительского маршрутизатора не видны обработчикам API. Ссылки,
+// которые API формирует сам (ссылки входа из писем), включают префикс;
+// заголовки Link пагинации строятся из исходного пути запроса и уже
+// содержат его. Пустой префикс или "/" равносильны Router().
+func (api *API) Handler(prefix string) http.Handler {
+	prefix = strings.TrimRight(prefix, "/")
+	if prefix == "" {
+		return api.r
+	}
+	if !strings.HasPrefix(prefix, "/") {
+		prefix = "/" + prefix
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// как и chi, маршрутизируем по экранированному пути, если он есть
+		path := r.URL.RawPath
+		if path == "" {
+			path = r.URL.Path
+		}
+		rest, ok := strings.CutPrefix(path, prefix)
+		if !ok || (rest != "" && rest[0] != '/') {
+			http.NotFound(w, r)
+			return
+		}
+		if rest == "" {
+			rest = "/"
+		}
+
+		// собственный контекст маршрута: chi.Mux с контекстом в запросе
+		// маршрутизирует по RoutePath, а не по r.URL.Path
+		rctx := chi.NewRouteContext()
+		rctx.RoutePath = rest
+		ctx := context.WithValue(r.Context(), chi.RouteCtxKey, rctx)
+		ctx = context.WithValue(ctx, prefixKey{}, prefix)
+		api.r.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// basePath возвращает префикс, под которым смонтирован API, или пустую
+// строку для Router().
+func basePath(ctx context.Context) string {
+	prefix, _ := ctx.Value(prefixKey{}).(string)
+	return prefix
+}
@@ -0,0 +1,139 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Время ожидания одного раздела сводки
+const overviewSectionTimeout = 2 * time.Second
+
+// OverviewSource - источник раздела сводки /admin/overview. Результат
+// сериализуется в JSON как есть.
+type OverviewSource func(ctx context.Context) (interface{}, error)
+
+// WithOverviewSource добавляет в сводку /admin/overview раздел name,
+// например состояние пула соединений с БД. Раздел с тем же именем, что
+// и встроенный, заменяет встроенный.
+func WithOverviewSource(name string, src OverviewSource) Option {
+	return func(a *API) {
+		if a.overviewSources == nil {
+			a.overviewSources = map[string]OverviewSource{}
+		}
+		a.overviewSources[name] = src
+	}
+}
+
+// Overview - сводка состояния сервиса. Разделы собираются независимо:
+// раздел, источник которого недоступен, отсутствует в Sections и
+// описан в Errors.
+type Overview struct {
+	GeneratedAt time.Time              `json:"generated_at"`
+	Sections    map[string]interface{} `json:"sections"`
+	Errors      []OverviewError        `json:"errors"`
+}
+
+// OverviewError - раздел сводки, который не удалось собрать.
+type OverviewError struct {
+	Section string `json:"section"`
+	Error   string `json:"error"` // "timeout" или "unavailable", подробности - в журнале
+}
+
+// overviewSections возвращает встроенные разделы сводки вместе с
+// добавленными через WithOverviewSource.
+func (api *API) overviewSections() map[string]OverviewSource {
+	sections := map[string]OverviewSource{
+		"signups_today": func(ctx context.Context) (interface{}, error) {
+			y, m, d := time.Now().UTC().Date()
+			return api.db.CountSignups(ctx, time.Date(y, m, d, 0, 0, 0, 0, time.UTC))
+		},
+		"active_codes": func(ctx context.Context) (interface{}, error) {
+			return api.db.CountActiveCodes(ctx)
+		},
+		"requests": func(ctx context.Context) (interface{}, error) {
+			return api.metrics.totals(), nil
+		},
+		"panics_total": api.panicsTotal,
+	}
+	if api.authLimiter != nil {
+		sections["auth_concurrency"] = api.authConcurrency
+	}
+	if api.retention != nil {
+		sections["retention"] = func(ctx context.Context) (interface{}, error) {
+			return api.retention.RetentionStats(), nil
+		}
+	}
+	for name, src := range api.overviewSources {
+		sections[name] = src
+	}
+	return sections
+}
+
+// collectSection получает раздел сводки с ограничением по времени.
+// Источник, не учитывающий отмену контекста, не задерживает ответ.
+func collectSection(ctx context.Context, src OverviewSource) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, overviewSectionTimeout)
+	defer cancel()
+
+	type result struct {
+		v   interface{}
+		err error
+	}
+	resultChan := make(chan result, 1)
+	go func() {
+		v, err := src(ctx)
+		resultChan <- result{v, err}
+	}()
+
+	select {
+	case r := <-resultChan:
+		return r.v, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Обработчик сводки состояния сервиса (admin): регистрации за текущие
+// сутки (UTC), действующие коды, счетчики ответов и добавленные разделы.
+// Ошибка одного раздела не влияет на остальные, ответ всегда 200.
+func (api *API) GetOverview(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	overview := Overview{Sections: map[string]interface{}{}, Errors: []OverviewError{}}
+
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for name, src := range api.overviewSections() {
+		wg.Add(1)
+		go func(name string, src OverviewSource) {
+			defer wg.Done()
+			v, err := collectSection(ctx, src)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				overview.Sections[name] = v
+				return
+			}
+			log.Printf("Ошибка раздела сводки %q: %v", name, err)
+			reason := "unavailable"
+			if errors.Is(err, context.DeadlineExceeded) {
+				reason = "timeout"
+			}
+			overview.Errors = append(overview.Errors, OverviewError{Section: name, Error: reason})
+		}(name, src)
+	}
+	wg.Wait()
+
+	sort.Slice(overview.Errors, func(i, j int) bool {
+		return overview.Errors[i].Section < overview.Errors[j].Section
+	})
+	overview.GeneratedAt = time.Now().UTC()
+	respond(w, http.StatusOK, overview)
+}
@@ -0,0 +1,108 @@
+// Пакет pagination разбирает параметры постраничной выдачи limit/offset
+// и строит заголовок Link (RFC 5988) со ссылками next и prev.
+package pagination
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Defaults - размер страницы по умолчанию и максимальный размер.
+type Defaults struct {
+	Limit    int
+	MaxLimit int
+}
+
+// Значения по умолчанию, если конфигурация их не задает.
+var DefaultDefaults = Defaults{Limit: 50, MaxLimit: 200}
+
+// Page - запрошенная страница.
+type Page struct {
+	Limit  int
+	Offset int
+}
+
+// ErrInvalid оборачивает все ошибки разбора параметров.
+var ErrInvalid = errors.New("invalid pagination parameter")
+
+// Parse читает limit и offset из строки запроса. Отсутствующий limit
+// заменяется значением по умолчанию, превышающий максимум - максимумом.
+// Нечисловые, отрицательные и нулевой limit считаются ошибкой.
+func Parse(r *http.Request, d Defaults) (Page, error) {
+	d = d.withFallback()
+	page := Page{Limit: d.Limit}
+
+	q := r.URL.Query()
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return Page{}, fmt.Errorf("%w: limit must be a positive integer, got %q", ErrInvalid, v)
+		}
+		page.Limit = limit
+	}
+	if page.Limit > d.MaxLimit {
+		page.Limit = d.MaxLimit
+	}
+
+	if v := q.Get("offset"); v != "" {
+		offset, err := strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return Page{}, fmt.Errorf("%w: offset must be a non-negative integer, got %q", ErrInvalid, v)
+		}
+		page.Offset = offset
+	}
+	return page, nil
+}
+
+// Effective возвращает значения, с которыми работает Parse: незаданные
+// заменены значениями по умолчанию.
+func (d Defaults) Effective() Defaults {
+	return d.withFallback()
+}
+
+// withFallback подставляет значения по умолчанию вместо незаданных.
+func (d Defaults) withFallback() Defaults {
+	if d.MaxLimit <= 0 {
+		d.MaxLimit = DefaultDefaults.MaxLimit
+	}
+	if d.Limit <= 0 {
+		d.Limit = DefaultDefaults.Limit
+	}
+	if d.Limit > d.MaxLimit {
+		d.Limit = d.MaxLimit
+	}
+	return d
+}
+
+// Link строит значение заголовка Link для страницы page. hasMore
+// сообщает, есть ли записи после текущей страницы. Остальные параметры
+// запроса сохраняются. Пустая строка - ссылок нет.
+func Link(r *http.Request, page Page, hasMore bool) string {
+	var links []string
+	if hasMore {
+		links = append(links, link(r, page.Limit, page.Offset+page.Limit, "next"))
+	}
+	if page.Offset > 0 {
+		links = append(links, link(r, page.Limit, max(page.Offset-page.Limit, 0), "prev"))
+	}
+	return strings.Join(links, ", ")
+}
+
+// SetLink выставляет заголовок Link, если есть соседние страницы.
+func SetLink(w http.ResponseWriter, r *http.Request, page Page, hasMore bool) {
+	if l := Link(r, page, hasMore); l != "" {
+		w.Header().Set("Link", l)
+	}
+}
+
+func link(r *http.Request, limit, offset int, rel string) string {
+	q := r.URL.Query()
+	q.Set("limit", strconv.Itoa(limit))
+	q.Set("offset", strconv.Itoa(offset))
+	u := *r.URL
+	u.RawQuery = q.Encode()
+	return fmt.Sprintf("<%s>; rel=%q", u.RequestURI(), rel)
+}
@@ -0,0 +1,75 @@
+package pagination
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	defaults := Defaults{Limit: 20, MaxLimit: 100}
+
+	tests := []struct {
+		name    string
+		query   string
+		want    Page
+		wantErr bool
+	}{
+		{"Defaults", "", Page{Limit: 20}, false},
+		{"Explicit values", "limit=10&offset=30", Page{Limit: 10, Offset: 30}, false},
+		{"Limit clamped to maximum", "limit=1000", Page{Limit: 100}, false},
+		{"Zero limit", "limit=0", Page{}, true},
+		{"Negative limit", "limit=-5", Page{}, true},
+		{"Negative offset", "offset=-1", Page{}, true},
+		{"Non-numeric limit", "limit=ten", Page{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(httptest.NewRequest("GET", "/items?"+tt.query, nil), defaults)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalid) {
+				t.Errorf("Parse() error = %v, want ErrInvalid", err)
+			}
+			if got != tt.want {
+				t.Errorf("Parse() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParse_ZeroDefaults(t *testing.T) {
+	got, err := Parse(httptest.NewRequest("GET", "/items?limit=100000", nil), Defaults{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Limit != DefaultDefaults.MaxLimit {
+		t.Errorf("Parse() limit = %d, want %d", got.Limit, DefaultDefaults.MaxLimit)
+	}
+}
+
+func TestLink(t *testing.T) {
+	tests := []struct {
+		name    string
+		page    Page
+		hasMore bool
+		want    string
+	}{
+		{"Single page", Page{Limit: 10}, false, ""},
+		{"First page", Page{Limit: 10}, true, `</items?filter=x&limit=10&offset=10>; rel="next"`},
+		{"Middle page", Page{Limit: 10, Offset: 10}, true,
+			`</items?filter=x&limit=10&offset=20>; rel="next", </items?filter=x&limit=10&offset=0>; rel="prev"`},
+		{"Last page with short offset", Page{Limit: 10, Offset: 5}, false, `</items?filter=x&limit=10&offset=0>; rel="prev"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/items?filter=x&limit=10", nil)
+			if got := Link(r, tt.page, tt.hasMore); got != tt.want {
+				t.Errorf("Link() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
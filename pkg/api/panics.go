@@ -0,0 +1,56 @@
+package api
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	"gorefer.go/pkg/reqctx"
+)
+
+// PanicCounts - число перехваченных паник обработчиков по маршруту
+// ("GET /p/me").
+type PanicCounts map[string]int64
+
+// incPanic учитывает панику обработчика маршрута route.
+func (m *errorMetrics) incPanic(route string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.panics == nil {
+		m.panics = PanicCounts{}
+	}
+	m.panics[route]++
+}
+
+func (m *errorMetrics) panicSnapshot() PanicCounts {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counts := make(PanicCounts, len(m.panics))
+	for route, n := range m.panics {
+		counts[route] = n
+	}
+	return counts
+}
+
+// PanicCounts возвращает текущие значения счетчиков паник, они же
+// раздел panics_total сводки /admin/overview.
+func (api *API) PanicCounts() PanicCounts {
+	return api.metrics.panicSnapshot()
+}
+
+// recoverPanic отвечает на панику обработчика, см. middlware.Recoverer:
+// пишет стек в журнал с ID запроса, учитывает панику в счетчике маршрута
+// и отвечает 500 INTERNAL_PANIC в общем формате ошибок. Если обработчик
+// уже начал отправку ответа, ответ остается как есть.
+func (api *API) recoverPanic(w http.ResponseWriter, r *http.Request, rec interface{}, stack []byte) {
+	reqID, _ := reqctx.RequestIDFrom(r.Context())
+	route := r.Method + " " + api.routePattern(r)
+	log.Printf("PANIC [%s] %s: %v\n%s", reqID, route, rec, stack)
+	api.metrics.incPanic(route)
+	api.writeError(w, r, CodeInternalPanic, nil)
+}
+
+// panicsTotal - раздел сводки со счетчиками паник.
+func (api *API) panicsTotal(ctx context.Context) (interface{}, error) {
+	return api.PanicCounts(), nil
+}
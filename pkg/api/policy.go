@@ -0,0 +1,85 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"gorefer.go/pkg/storage"
+)
+
+// Policy - ограничения данных, которые вводят пользователи. Те же
+// значения публикуются в /.well-known/gorefer-configuration, чтобы
+// клиенты проверяли ввод по правилам сервиса.
+type Policy struct {
+	// PasswordMinLength - минимальная длина пароля в символах
+	PasswordMinLength int
+	// CodeMaxLength - максимальная длина реферального кода в символах;
+	// не больше maxCodeLength
+	CodeMaxLength int
+	// CodeMaxLifetime - наибольший срок действия реферального кода от
+	// момента создания или изменения срока
+	CodeMaxLifetime time.Duration
+}
+
+// Длина столбца referral_codes.code
+const maxCodeLength = 50
+
+// По умолчанию пароль только не должен быть пустым
+var defaultPolicy = Policy{PasswordMinLength: 1, CodeMaxLength: maxCodeLength, CodeMaxLifetime: storage.DefaultCodeLifetime}
+
+// WithPolicy задает ограничения данных пользователей. Нулевые значения
+// заменяются значениями по умолчанию.
+func WithPolicy(p Policy) Option {
+	return func(a *API) {
+		if p.PasswordMinLength > 0 {
+			a.policy.PasswordMinLength = p.PasswordMinLength
+		}
+		if p.CodeMaxLength > 0 {
+			a.policy.CodeMaxLength = min(p.CodeMaxLength, maxCodeLength)
+		}
+		if p.CodeMaxLifetime > 0 {
+			a.policy.CodeMaxLifetime = p.CodeMaxLifetime
+		}
+	}
+}
+
+// validatePassword проверяет длину непустого пароля. Нарушение
+// возвращается как *ValidationError с полем password.
+func (p Policy) validatePassword(password string) error {
+	if utf8.RuneCountInString(password) >= p.PasswordMinLength {
+		return nil
+	}
+	return &ValidationError{Fields: []FieldError{{
+		Field:   "password",
+		Code:    "too_short",
+		Message: fmt.Sprintf("password must be at least %d characters", p.PasswordMinLength),
+	}}}
+}
+
+// validateCode проверяет длину реферального кода.
+func (p Policy) validateCode(code string) error {
+	if utf8.RuneCountInString(code) > p.CodeMaxLength {
+		return fmt.Errorf("code exceeds %d characters", p.CodeMaxLength)
+	}
+	return nil
+}
+
+// validateExpiry проверяет срок действия кода expiresAt (Unix-время) так
+// же, как хранилище, см. storage.CheckCodeExpiry.
+func (p Policy) validateExpiry(expiresAt int64) error {
+	return storage.CheckCodeExpiry(expiresAt, time.Now(), p.CodeMaxLifetime)
+}
+
+// expiryErrorCode возвращает код ошибки для недопустимого срока действия
+// кода; false - err не ошибка срока.
+func expiryErrorCode(err error) (string, bool) {
+	switch {
+	case errors.Is(err, storage.ErrExpiryInPast):
+		return CodeExpiryInPast, true
+	case errors.Is(err, storage.ErrExpiryTooFar):
+		return CodeExpiryTooFar, true
+	}
+	return "", false
+}
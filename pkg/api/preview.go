@@ -0,0 +1,160 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorefer.go/pkg/storage"
+)
+
+// LinkPreview - страница с метатегами OpenGraph, которую получают
+// мессенджеры при показе превью ссылки /r/{code}.
+type LinkPreview struct {
+	Title       string // название программы, например "Acme"
+	Description string // описание программы под заголовком превью
+	ImageURL    string // картинка превью; пусто - без картинки
+	BaseURL     string // внешний адрес сервиса для og:url
+	// InviteTitle - заголовок превью действующего кода, {name} заменяется
+	// именем реферера; пусто - "{name} приглашает в " + Title
+	InviteTitle string
+}
+
+// Признаки User-Agent ботов, которые запрашивают страницу ради превью
+// ссылки, в нижнем регистре
+var unfurlBots = []string{
+	"slackbot", "slack-imgproxy", "whatsapp", "telegrambot", "discordbot",
+	"facebookexternalhit", "facebookcatalog", "twitterbot", "linkedinbot",
+	"skypeuripreview", "vkshare", "viber", "embedly", "redditbot",
+}
+
+// WithLinkPreview включает превью ссылок /r/{code} для мессенджеров. Без
+// этого параметра /r/{code} всегда перенаправляет.
+func WithLinkPreview(p LinkPreview) Option {
+	return func(a *API) {
+		if p.InviteTitle == "" {
+			p.InviteTitle = "{name} приглашает в " + p.Title
+		}
+		a.linkPreview = &p
+	}
+}
+
+// wantsPreview сообщает, нужна ли вместо перенаправления страница превью:
+// ее запрашивает бот мессенджера (Accept: text/html и известный
+// User-Agent) или параметр ?preview=1.
+func wantsPreview(r *http.Request) bool {
+	if v, _ := strconv.ParseBool(r.URL.Query().Get("preview")); v {
+		return true
+	}
+	if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		return false
+	}
+	agent := strings.ToLower(r.UserAgent())
+	for _, bot := range unfurlBots {
+		if strings.Contains(agent, bot) {
+			return true
+		}
+	}
+	return false
+}
+
+// previewPage - данные страницы превью
+type previewPage struct {
+	Title       string
+	Description string
+	ImageURL    string
+	URL         string
+	SiteName    string
+}
+
+var previewTemplate = template.Must(template.New("preview").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<meta property="og:type" content="website">
+<meta property="og:title" content="{{.Title}}">
+<meta property="og:description" content="{{.Description}}">
+<meta property="og:site_name" content="{{.SiteName}}">
+<meta property="og:url" content="{{.URL}}">
+{{- if .ImageURL}}
+<meta property="og:image" content="{{.ImageURL}}">
+<meta name="twitter:card" content="summary_large_image">
+{{- else}}
+<meta name="twitter:card" content="summary">
+{{- end}}
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Description}}</p>
+<p><a href="{{.URL}}">{{.SiteName}}</a></p>
+</body>
+</html>
+`))
+
+// previewPageFor составляет страницу превью кода. Показывается только имя
+// реферера, без email; для недействительного кода страница не называет
+// реферера.
+func (api *API) previewPageFor(r *http.Request, d storage.ReferralCodeDetails, now time.Time) previewPage {
+	p := api.linkPreview
+	page := previewPage{
+		Title:       p.Title,
+		Description: p.Description,
+		ImageURL:    p.ImageURL,
+		URL:         strings.TrimRight(p.BaseURL, "/") + basePath(r.Context()) + "/r/" + d.Code,
+		SiteName:    p.Title,
+	}
+	active := d.Status == storage.CodeStatusActive && !d.Revoked() && !d.Expired(now) && !d.Exhausted()
+	if active && d.OwnerUsername != "" {
+		page.Title = strings.ReplaceAll(p.InviteTitle, "{name}", d.OwnerUsername)
+	}
+	return page
+}
+
+// writePreview отвечает страницей превью кода. Переход по ссылке не
+// учитывается: превью запрашивает бот, а не приглашенный.
+func (api *API) writePreview(w http.ResponseWriter, r *http.Request, code string) {
+	ctx := r.Context()
+
+	resultChan := make(chan storage.ReferralCodeDetails)
+	errorChan := make(chan error)
+
+	go func() {
+		details, err := api.db.GetReferralCodeDetails(ctx, code)
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		resultChan <- details
+	}()
+
+	status := http.StatusOK
+	var details storage.ReferralCodeDetails
+	select {
+	case details = <-resultChan:
+
+	case err := <-errorChan:
+		if !errors.Is(err, storage.ErrNotFound) {
+			api.writeError(w, r, CodeInternal, fmt.Errorf("failed to get referral code preview: %w", err))
+			return
+		}
+		// неизвестный код - та же нейтральная страница
+		status = http.StatusNotFound
+		details.Code = code
+	}
+
+	var buf bytes.Buffer
+	if err := previewTemplate.Execute(&buf, api.previewPageFor(r, details, time.Now())); err != nil {
+		api.writeError(w, r, CodeInternal, fmt.Errorf("failed to render referral code preview: %w", err))
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,392 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"gorefer.go/pkg/api/middlware"
+	"gorefer.go/pkg/auth"
+	"gorefer.go/pkg/storage"
+)
+
+// RegistrationQueue - очередь регистраций /register-with-referral при
+// пиковой нагрузке. Когда ограничитель WithAuthConcurrency заполнен,
+// регистрация не отклоняется с 503, а сохраняется в очереди: клиент
+// получает 202 с адресом статуса и опрашивает GET /registrations/{id}.
+// Регистрации обрабатываются фоновым компонентом API тем же кодом, что
+// и обычная регистрация. Пароль хешируется до постановки в очередь:
+// открытый пароль не сохраняется.
+type RegistrationQueue struct {
+	MaxPending   int           // предел ожидающих регистраций; сверх него - 429
+	Workers      int           // одновременно обрабатываемые регистрации
+	PollInterval time.Duration // период выбора новых регистраций
+	// Lease - через сколько регистрация, обработка которой прервалась,
+	// выбирается снова
+	Lease time.Duration
+	// ResultTTL - сколько хранится итог регистрации для опроса статуса
+	ResultTTL time.Duration
+}
+
+// Параметры очереди регистраций по умолчанию
+var defaultRegistrationQueue = RegistrationQueue{
+	MaxPending:   1000,
+	Workers:      4,
+	PollInterval: time.Second,
+	Lease:        time.Minute,
+	ResultTTL:    24 * time.Hour,
+}
+
+// Предел попыток регистрации, прерванной внутренней ошибкой; после него
+// регистрация завершается ошибкой INTERNAL_ERROR.
+const maxRegistrationAttempts = 5
+
+// Число обработанных регистраций, удаляемых за один проход
+const registrationPurgeBatch = 500
+
+// WithRegistrationQueue включает очередь регистраций. Действует только
+// вместе с WithAuthConcurrency: без ограничителя регистрации не
+// ставятся в очередь. Нулевые значения заменяются значениями по
+// умолчанию.
+func WithRegistrationQueue(q RegistrationQueue) Option {
+	return func(a *API) {
+		if q.MaxPending <= 0 {
+			q.MaxPending = defaultRegistrationQueue.MaxPending
+		}
+		if q.Workers <= 0 {
+			q.Workers = defaultRegistrationQueue.Workers
+		}
+		if q.PollInterval <= 0 {
+			q.PollInterval = defaultRegistrationQueue.PollInterval
+		}
+		if q.Lease <= 0 {
+			q.Lease = defaultRegistrationQueue.Lease
+		}
+		if q.ResultTTL <= 0 {
+			q.ResultTTL = defaultRegistrationQueue.ResultTTL
+		}
+		a.regQueue = &q
+	}
+}
+
+// RegistrationStatus - статус регистрации в очереди. User есть только у
+// завершенной регистрации, Error - только у отклоненной.
+type RegistrationStatus struct {
+	ID        string                  `json:"id"`
+	Status    string                  `json:"status"` // см. storage.RegistrationPending и др.
+	StatusURL string                  `json:"status_url"`
+	User      *ReferralSignupResponse `json:"user,omitempty"`
+	Error     *ErrorResponse          `json:"error,omitempty"`
+}
+
+// queuedSignup - данные регистрации в очереди. Пароль в Params уже
+// хеширован.
+type queuedSignup struct {
+	Params      storage.CreateUserParams `json:"params"`
+	Code        string                   `json:"code,omitempty"`
+	CodeSource  string                   `json:"code_source,omitempty"`
+	Attribution *attribution             `json:"attribution,omitempty"` // cookie атрибуции запроса
+	Language    string                   `json:"language"`
+}
+
+// signupCode восстанавливает код регистрации.
+func (q queuedSignup) signupCode() signupCode {
+	c := signupCode{code: q.Code, source: q.CodeSource}
+	if q.Attribution != nil {
+		c.att, c.attributed = *q.Attribution, true
+	}
+	return c
+}
+
+// newRegistrationID выпускает случайный ID регистрации: по нему без
+// авторизации доступен статус с email пользователя.
+func newRegistrationID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// limitReferralSignup - middleware /register-with-referral: как limitAuth,
+// но с очередью регистраций запрос сверх ограничителя ставится в очередь.
+func (api *API) limitReferralSignup(next http.Handler) http.Handler {
+	if api.authLimiter == nil {
+		return next
+	}
+	reject := api.overloaded
+	if api.regQueue != nil {
+		reject = api.enqueueRegistration
+	}
+	return middlware.Concurrency(api.authLimiter, reject)(next)
+}
+
+// enqueueRegistration проверяет запрос /register-with-referral так же,
+// как обработчик, и ставит регистрацию в очередь: 202 с адресом статуса
+// или 429, если очередь заполнена.
+func (api *API) enqueueRegistration(w http.ResponseWriter, r *http.Request) {
+	// запрос не дождался места до дедлайна - ставить в очередь поздно
+	if r.Context().Err() != nil {
+		api.overloaded(w, r)
+		return
+	}
+	request, ok := api.referralSignupRequest(w, r)
+	if !ok {
+		return
+	}
+	hashedPassword, err := auth.HashPassword(request.user.Password)
+	if err != nil {
+		api.writeError(w, r, CodeInternal, fmt.Errorf("failed to hash password: %w", err))
+		return
+	}
+	request.user.Password = hashedPassword
+	job := queuedSignup{
+		Params:     signupParams(r, request.user, request.source),
+		Code:       request.ref.code,
+		CodeSource: request.ref.source,
+		Language:   language(r),
+	}
+	if request.ref.attributed {
+		att := request.ref.att
+		job.Attribution = &att
+	}
+	payload, err := json.Marshal(job)
+	if err != nil {
+		api.writeError(w, r, CodeInternal, fmt.Errorf("failed to encode registration: %w", err))
+		return
+	}
+
+	ctx := r.Context()
+
+	resultChan := make(chan string)
+	errorChan := make(chan error)
+	go func() {
+		id, err := newRegistrationID()
+		if err == nil {
+			err = api.db.EnqueueRegistration(ctx, id, payload, api.regQueue.MaxPending)
+		}
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		resultChan <- id
+	}()
+
+	select {
+	case id := <-resultChan:
+		status := api.registrationStatus(r, storage.QueuedRegistration{ID: id, Status: storage.RegistrationPending})
+		w.Header().Set("Location", status.StatusURL)
+		api.setPollInterval(w)
+		respond(w, http.StatusAccepted, status)
+	case err := <-errorChan:
+		if errors.Is(err, storage.ErrRegistrationQueueFull) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(api.retryAfter.Seconds()))))
+			api.writeError(w, r, CodeRegistrationQueueFull, err)
+			return
+		}
+		api.writeError(w, r, CodeInternal, fmt.Errorf("failed to enqueue registration: %w", err))
+	}
+}
+
+// Обработчик для опроса статуса регистрации в очереди. Пока регистрация
+// ожидает обработки, Retry-After подсказывает интервал опроса.
+func (api *API) GetRegistrationStatus(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	ctx := r.Context()
+
+	resultChan := make(chan storage.QueuedRegistration)
+	errorChan := make(chan error)
+	go func() {
+		reg, err := api.db.GetQueuedRegistration(ctx, id)
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		resultChan <- reg
+	}()
+
+	select {
+	case reg := <-resultChan:
+		status := api.registrationStatus(r, reg)
+		switch reg.Status {
+		case storage.RegistrationPending:
+			api.setPollInterval(w)
+		case storage.RegistrationCompleted:
+			// регистрация учла cookie атрибуции, как и обычная
+			if _, ok := attributionFrom(r); ok {
+				clearAttribution(w)
+			}
+		}
+		respond(w, http.StatusOK, status)
+	case err := <-errorChan:
+		if errors.Is(err, storage.ErrNotFound) {
+			api.writeError(w, r, CodeRegistrationNotFound, err)
+			return
+		}
+		api.writeError(w, r, CodeInternal, fmt.Errorf("failed to retrieve registration: %w", err))
+	}
+}
+
+// registrationStatus собирает ответ со статусом регистрации.
+func (api *API) registrationStatus(r *http.Request, reg storage.QueuedRegistration) RegistrationStatus {
+	status := RegistrationStatus{
+		ID:        reg.ID,
+		Status:    reg.Status,
+		StatusURL: basePath(r.Context()) + "/registrations/" + reg.ID,
+	}
+	switch reg.Status {
+	case storage.RegistrationCompleted:
+		var user ReferralSignupResponse
+		if err := json.Unmarshal(reg.Result, &user); err == nil {
+			status.User = &user
+		}
+	case storage.RegistrationFailed:
+		status.Error = &ErrorResponse{Code: reg.ErrorCode, Error: message(reg.ErrorCode, language(r))}
+	}
+	return status
+}
+
+// setPollInterval подсказывает клиенту интервал опроса статуса.
+func (api *API) setPollInterval(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(api.regQueue.PollInterval.Seconds()))))
+}
+
+// processRegistrations - фоновый компонент очереди регистраций: каждые
+// PollInterval обрабатывает ожидающие регистрации и удаляет итоги
+// старше ResultTTL.
+func (api *API) processRegistrations(ctx context.Context) {
+	ticker := time.NewTicker(api.regQueue.PollInterval)
+	defer ticker.Stop()
+	for {
+		if err := api.drainRegistrations(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Ошибка обработки очереди регистраций: %v", err)
+		}
+		if _, err := api.db.PurgeRegistrations(ctx, api.now().Add(-api.regQueue.ResultTTL), registrationPurgeBatch); err != nil && ctx.Err() == nil {
+			log.Printf("Ошибка удаления обработанных регистраций: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// drainRegistrations обрабатывает ожидающие регистрации партиями по
+// Workers, пока очередь не опустеет.
+func (api *API) drainRegistrations(ctx context.Context) error {
+	for ctx.Err() == nil {
+		regs, err := api.db.ClaimRegistrations(ctx, api.regQueue.Workers, api.regQueue.Lease)
+		if err != nil {
+			return err
+		}
+		var wg sync.WaitGroup
+		for _, reg := range regs {
+			wg.Add(1)
+			go func(reg storage.QueuedRegistration) {
+				defer wg.Done()
+				api.processRegistration(ctx, reg)
+			}(reg)
+		}
+		wg.Wait()
+		if len(regs) < api.regQueue.Workers {
+			return nil
+		}
+	}
+	return ctx.Err()
+}
+
+// processRegistration выполняет регистрацию из очереди и записывает
+// итог. Регистрация, прерванная внутренней ошибкой, остается в очереди и
+// выбирается снова по истечении Lease.
+func (api *API) processRegistration(ctx context.Context, reg storage.QueuedRegistration) {
+	var job queuedSignup
+	if err := json.Unmarshal(reg.Payload, &job); err != nil {
+		log.Printf("Некорректная регистрация %s в очереди: %v", reg.ID, err)
+		api.finishRegistration(ctx, reg.ID, storage.RegistrationFailed, nil, CodeInternal)
+		return
+	}
+	c := job.signupCode()
+
+	res, err := api.runQueuedSignup(ctx, job, c)
+	if err != nil && reg.Attempts > 1 {
+		res, err = api.resumeSignup(ctx, job, err)
+	}
+	if err != nil {
+		code := signupErrorCode(err)
+		if code == CodeInternal {
+			log.Printf("Ошибка регистрации %s из очереди, попытка %d: %v", reg.ID, reg.Attempts, err)
+			if reg.Attempts < maxRegistrationAttempts {
+				return
+			}
+		}
+		api.finishRegistration(ctx, reg.ID, storage.RegistrationFailed, nil, code)
+		return
+	}
+
+	user := job.Params.User
+	user.ID, user.Password = res.id, ""
+	response := newReferralSignupResponse(user, res.referrer)
+	response.Warning = res.warning
+	result, err := json.Marshal(response)
+	if err != nil {
+		log.Printf("Ошибка кодирования итога регистрации %s: %v", reg.ID, err)
+		return
+	}
+	if !api.finishRegistration(ctx, reg.ID, storage.RegistrationCompleted, result, "") {
+		return
+	}
+	api.userRegistered(ctx, user)
+	if res.referrer != nil {
+		api.referralCreated(ctx, c.code, user)
+	}
+}
+
+// runQueuedSignup регистрирует пользователя из очереди: квота
+// приглашений и транзакция - те же, что у обычной регистрации, см.
+// signup.
+func (api *API) runQueuedSignup(ctx context.Context, job queuedSignup, c signupCode) (signupResult, error) {
+	if c.explicit() {
+		if err := api.checkInviteQuota(ctx, c.code); err != nil {
+			return signupResult{}, err
+		}
+	}
+	return api.createAccount(ctx, job.Params, c, job.Language)
+}
+
+// resumeSignup проверяет, не создала ли пользователя прерванная попытка
+// той же регистрации: email или имя заняты пользователем с тем же хешем
+// пароля, а хеш со случайной солью совпасть у разных регистраций не
+// может. Реферер такой регистрации в итоге не указывается. Иначе
+// возвращает исходную ошибку err.
+func (api *API) resumeSignup(ctx context.Context, job queuedSignup, err error) (signupResult, error) {
+	if code := signupErrorCode(err); code != CodeEmailTaken && code != CodeUsernameTaken {
+		return signupResult{}, err
+	}
+	user, getErr := api.db.GetUserByEmail(ctx, job.Params.Email)
+	if getErr != nil || user.Password != job.Params.Password {
+		return signupResult{}, err
+	}
+	return signupResult{id: user.ID}, nil
+}
+
+// finishRegistration записывает итог регистрации. false - итог не
+// записан, регистрация будет выбрана снова.
+func (api *API) finishRegistration(ctx context.Context, id, status string, result json.RawMessage, code string) bool {
+	if err := api.db.FinishRegistration(ctx, id, status, result, code); err != nil {
+		log.Printf("Ошибка записи итога регистрации %s: %v", id, err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,283 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"gorefer.go/pkg/reqctx"
+	"gorefer.go/pkg/storage"
+)
+
+// Названия квот пользователей
+const (
+	QuotaCodesPerDay   = "codes_per_day"   // созданий кодов за сутки
+	QuotaInvitesPerDay = "invites_per_day" // регистраций по кодам пользователя за сутки
+	QuotaActiveCodes   = "active_codes"    // действующих кодов одновременно
+)
+
+// Quotas - общие квоты пользователей. Суточные квоты сбрасываются в
+// полночь UTC. 0 - без ограничения. Администратор может задать
+// пользователю свои квоты, см. SetUserLimits.
+//
+// Квоты мягкие: использование проверяется до записи, поэтому
+// одновременные запросы могут превысить квоту на несколько единиц.
+type Quotas struct {
+	CodesPerDay   int
+	InvitesPerDay int
+	// ActiveCodes проверяется только при нескольких кодах, см.
+	// WithMultipleCodes: единственный код заменяется при создании нового
+	ActiveCodes int
+}
+
+// WithQuotas включает квоты пользователей и маршруты GET /p/limits и
+// PATCH /admin/users/{id}/limits. Без этого параметра квоты не
+// проверяются.
+func WithQuotas(q Quotas) Option {
+	return func(a *API) {
+		a.quotas = &q
+	}
+}
+
+// WithClock подменяет часы, по которым считаются окна квот. Нужен тестам.
+func WithClock(now func() time.Time) Option {
+	return func(a *API) {
+		a.now = now
+	}
+}
+
+// QuotaError - квота пользователя исчерпана
+type QuotaError struct {
+	Quota   string
+	Limit   int
+	ResetAt *time.Time // nil - квота не освобождается со временем
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("quota %s of %d exceeded", e.Quota, e.Limit)
+}
+
+// QuotaExceeded - исчерпанная квота в ответе QUOTA_EXCEEDED
+type QuotaExceeded struct {
+	Name    string     `json:"name"`
+	Limit   int        `json:"limit"`
+	ResetAt *time.Time `json:"reset_at,omitempty"`
+}
+
+// QuotaState - состояние квоты пользователя
+type QuotaState struct {
+	Name      string     `json:"name"`
+	Limit     *int       `json:"limit"` // nil - без ограничения
+	Used      int        `json:"used"`
+	Remaining *int       `json:"remaining"`
+	ResetAt   *time.Time `json:"reset_at"`
+	// квота задана пользователю администратором
+	Overridden bool `json:"overridden"`
+}
+
+// quotaState составляет состояние квоты: limit - общая квота, override -
+// квота пользователя.
+func quotaState(name string, limit int, override *int, used int, resetAt *time.Time) QuotaState {
+	s := QuotaState{Name: name, Used: used, ResetAt: resetAt, Overridden: override != nil}
+	if override != nil {
+		limit = *override
+	}
+	if limit > 0 {
+		remaining := max(limit-used, 0)
+		s.Limit, s.Remaining = &limit, &remaining
+	}
+	return s
+}
+
+// quotaStates возвращает состояние всех квот пользователя на момент now.
+func (api *API) quotaStates(ctx context.Context, userID int, now time.Time) ([]QuotaState, error) {
+	limits, err := api.db.GetUserLimits(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	day := now.UTC()
+	dayStart := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.UTC)
+	usage, err := api.db.GetQuotaUsage(ctx, userID, dayStart)
+	if err != nil {
+		return nil, err
+	}
+	reset := dayStart.AddDate(0, 0, 1)
+	return []QuotaState{
+		quotaState(QuotaCodesPerDay, api.quotas.CodesPerDay, limits.CodesPerDay, usage.CodesCreated, &reset),
+		quotaState(QuotaInvitesPerDay, api.quotas.InvitesPerDay, limits.InvitesPerDay, usage.Invites, &reset),
+		// действующий код освобождает квоту, когда истекает
+		quotaState(QuotaActiveCodes, api.quotas.ActiveCodes, limits.ActiveCodes, usage.ActiveCodes, usage.NextCodeExpiry),
+	}, nil
+}
+
+// checkQuotas возвращает *QuotaError, если у пользователя исчерпана одна
+// из квот names. Без WithQuotas квоты не проверяются.
+func (api *API) checkQuotas(ctx context.Context, userID int, names ...string) error {
+	if api.quotas == nil {
+		return nil
+	}
+	states, err := api.quotaStates(ctx, userID, api.now())
+	if err != nil {
+		return fmt.Errorf("failed to check quotas: %w", err)
+	}
+	for _, s := range states {
+		for _, name := range names {
+			if s.Name == name && s.Remaining != nil && *s.Remaining == 0 {
+				return &QuotaError{Quota: s.Name, Limit: *s.Limit, ResetAt: s.ResetAt}
+			}
+		}
+	}
+	return nil
+}
+
+// checkInviteQuota проверяет суточную квоту приглашений владельца кода.
+// Неизвестный или незанятый код не проверяется: об этом сообщит сама
+// регистрация.
+func (api *API) checkInviteQuota(ctx context.Context, code string) error {
+	if api.quotas == nil {
+		return nil
+	}
+	details, err := api.db.GetReferralCodeDetails(ctx, code)
+	if errors.Is(err, storage.ErrNotFound) || (err == nil && details.UserID == 0) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return api.checkQuotas(ctx, details.UserID, QuotaInvitesPerDay)
+}
+
+// Обработчик состояния квот текущего пользователя
+func (api *API) GetMyLimits(w http.ResponseWriter, r *http.Request) {
+	claims, ok := reqctx.UserFrom(r.Context())
+	if !ok {
+		api.writeError(w, r, CodeUnauthorized, nil)
+		return
+	}
+
+	ctx := r.Context()
+
+	resultChan := make(chan []QuotaState)
+	errorChan := make(chan error)
+
+	go func() {
+		states, err := api.quotaStates(ctx, claims.UserID, api.now())
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		resultChan <- states
+	}()
+
+	select {
+	case states := <-resultChan:
+		respond(w, http.StatusOK, states)
+
+	case err := <-errorChan:
+		api.writeError(w, r, CodeInternal, fmt.Errorf("failed to get quotas: %w", err))
+	}
+}
+
+// limitPatch - поле квоты в PATCH /admin/users/{id}/limits: отсутствие
+// поля оставляет квоту как есть, null возвращает общую квоту.
+type limitPatch struct {
+	set   bool
+	value *int
+}
+
+func (p *limitPatch) UnmarshalJSON(b []byte) error {
+	p.set = true
+	return json.Unmarshal(b, &p.value)
+}
+
+// apply применяет поле к квоте пользователя.
+func (p limitPatch) apply(limit **int) {
+	if p.set {
+		*limit = p.value
+	}
+}
+
+// Обработчик для изменения квот пользователя (admin). Поля, которых нет в
+// запросе, не меняются; null возвращает общую квоту, 0 снимает
+// ограничение. Изменение фиксируется в журнале аудита.
+func (api *API) SetUserLimits(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		api.writeError(w, r, CodeInvalidID, err)
+		return
+	}
+
+	var request struct {
+		CodesPerDay   limitPatch `json:"codes_per_day"`
+		InvitesPerDay limitPatch `json:"invites_per_day"`
+		ActiveCodes   limitPatch `json:"active_codes"`
+	}
+	if !api.decodeJSON(w, r, &request) {
+		return
+	}
+
+	var invalid []FieldError
+	for _, f := range []struct {
+		name  string
+		patch limitPatch
+	}{
+		{QuotaCodesPerDay, request.CodesPerDay},
+		{QuotaInvitesPerDay, request.InvitesPerDay},
+		{QuotaActiveCodes, request.ActiveCodes},
+	} {
+		if f.patch.value != nil && *f.patch.value < 0 {
+			invalid = append(invalid, FieldError{Field: f.name, Code: "negative", Message: "quota must not be negative"})
+		}
+	}
+	if len(invalid) > 0 {
+		api.writeError(w, r, CodeValidationFailed, &ValidationError{Fields: invalid})
+		return
+	}
+
+	claims, ok := reqctx.UserFrom(r.Context())
+	if !ok {
+		api.writeError(w, r, CodeUnauthorized, nil)
+		return
+	}
+
+	ctx := r.Context()
+
+	resultChan := make(chan storage.UserLimits)
+	errorChan := make(chan error)
+
+	go func() {
+		limits, err := api.db.GetUserLimits(ctx, userID)
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		request.CodesPerDay.apply(&limits.CodesPerDay)
+		request.InvitesPerDay.apply(&limits.InvitesPerDay)
+		request.ActiveCodes.apply(&limits.ActiveCodes)
+		limits, err = api.db.SetUserLimits(ctx, userID, limits, claims.ActorID())
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		resultChan <- limits
+	}()
+
+	select {
+	case limits := <-resultChan:
+		respond(w, http.StatusOK, limits)
+
+	case err := <-errorChan:
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			api.writeError(w, r, CodeUserNotFound, err)
+		default:
+			api.writeError(w, r, CodeInternal, fmt.Errorf("failed to set user limits: %w", err))
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Registration - доступность способов регистрации. Способы включаются
+// независимо: например, для запуска только по приглашениям открытая
+// регистрация выключается, а регистрация по коду остается.
+type Registration struct {
+	// Open - регистрация без реферального кода: /register и
+	// /register-with-referral без referral_code
+	Open bool `json:"open_enabled"`
+	// Referral - регистрация по коду: /register-with-referral с
+	// referral_code, а также /register с кодом в заголовке
+	// X-Referral-Code или параметре ?ref=
+	Referral bool `json:"referral_enabled"`
+	// InvalidCode - что делать с недействительным кодом из заголовка или
+	// параметра запроса: InvalidCodeReject (по умолчанию) или
+	// InvalidCodeIgnore
+	InvalidCode string `json:"invalid_code"`
+}
+
+// Обработка недействительного кода из заголовка X-Referral-Code или
+// параметра ?ref=. Код из тела запроса всегда отклоняется, код из cookie
+// атрибуции всегда пропускается.
+const (
+	// ошибка регистрации, как для кода из тела: 422 REFERRAL_CODE_INVALID
+	// и т.п.
+	InvalidCodeReject = "reject"
+	// регистрация без реферала с предупреждением в поле warning ответа;
+	// только при включенной открытой регистрации
+	InvalidCodeIgnore = "ignore"
+)
+
+// По умолчанию доступны оба способа регистрации
+var defaultRegistration = Registration{Open: true, Referral: true, InvalidCode: InvalidCodeReject}
+
+// allows сообщает, доступна ли регистрация с кодом c: с явно переданным
+// кодом - регистрация по коду, иначе открытая, даже при cookie
+// атрибуции: код из cookie при ошибке не прерывает регистрацию.
+func (reg Registration) allows(c signupCode) bool {
+	if c.explicit() {
+		return reg.Referral
+	}
+	return reg.Open
+}
+
+// ignores сообщает, пропускается ли недействительный код c вместо
+// ошибки регистрации.
+func (reg Registration) ignores(c signupCode) bool {
+	return (c.source == codeFromHeader || c.source == codeFromQuery) &&
+		reg.InvalidCode == InvalidCodeIgnore && reg.Open
+}
+
+// errRegistrationDisabled - способ регистрации выключен конфигурацией
+var errRegistrationDisabled = errors.New("registration method is disabled")
+
+// WithRegistration задает доступные способы регистрации.
+func WithRegistration(reg Registration) Option {
+	return func(a *API) {
+		a.registration = reg
+	}
+}
+
+// PublicConfig - настройки, которые интерфейс регистрации получает без
+// авторизации, чтобы показывать только доступные формы.
+type PublicConfig struct {
+	Registration Registration `json:"registration"`
+}
+
+// Обработчик для получения публичных настроек сервиса
+func (api *API) GetPublicConfig(w http.ResponseWriter, r *http.Request) {
+	respond(w, http.StatusOK, PublicConfig{Registration: api.registration})
+}
@@ -0,0 +1,114 @@
+package api
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gorefer.go/pkg/storage"
+)
+
+// Формат дат в параметрах и выгрузках отчетов.
+const reportDateLayout = "2006-01-02"
+
+// Максимальная длина периода отчета в днях.
+const maxReportDays = 366
+
+// parseReportRange разбирает параметры from и to (включительно, YYYY-MM-DD)
+// и возвращает полуинтервал [from, to+1 день).
+func parseReportRange(r *http.Request) (time.Time, time.Time, error) {
+	from, err := time.Parse(reportDateLayout, r.URL.Query().Get("from"))
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("from: %w", err)
+	}
+	to, err := time.Parse(reportDateLayout, r.URL.Query().Get("to"))
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("to: %w", err)
+	}
+	to = to.AddDate(0, 0, 1)
+
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, fmt.Errorf("from %s is after to", from.Format(reportDateLayout))
+	}
+	if to.Sub(from) > maxReportDays*24*time.Hour {
+		return time.Time{}, time.Time{}, fmt.Errorf("range exceeds %d days", maxReportDays)
+	}
+	return from, to, nil
+}
+
+// Обработчик для получения отчета по реферальной программе (admin).
+//
+// Параметры: from и to - границы периода включительно (YYYY-MM-DD, не более
+// 366 дней), format - json (по умолчанию) или csv. CSV содержит разбивку по
+// дням с колонками date, signups (все регистрации), referral_signups
+// (регистрации по реферальным кодам).
+func (api *API) GetProgramReport(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "csv" {
+		api.writeError(w, r, CodeInvalidParameter, fmt.Errorf("unsupported format %q", format))
+		return
+	}
+
+	from, to, err := parseReportRange(r)
+	if err != nil {
+		api.writeError(w, r, CodeInvalidDateRange, err)
+		return
+	}
+
+	ctx := r.Context()
+
+	resultChan := make(chan storage.ProgramReport)
+	errorChan := make(chan error)
+
+	go func() {
+		report, err := api.db.GetProgramReport(ctx, from, to)
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		resultChan <- report
+	}()
+
+	select {
+	case report := <-resultChan:
+		if format == "csv" {
+			writeReportCSV(w, report)
+			return
+		}
+		respond(w, http.StatusOK, report)
+
+	case err := <-errorChan:
+		api.writeError(w, r, CodeInternal, fmt.Errorf("failed to build report: %w", err))
+		return
+	}
+}
+
+// writeReportCSV построчно отправляет разбивку отчета по дням в формате CSV.
+func writeReportCSV(w http.ResponseWriter, report storage.ProgramReport) {
+	filename := fmt.Sprintf("referrals_%s_%s.csv",
+		report.From.Format(reportDateLayout),
+		report.To.AddDate(0, 0, -1).Format(reportDateLayout))
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.WriteHeader(http.StatusOK)
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"date", "signups", "referral_signups"})
+	for _, day := range report.Days {
+		cw.Write([]string{
+			day.Date.Format(reportDateLayout),
+			strconv.Itoa(day.Signups),
+			strconv.Itoa(day.ReferralSignups),
+		})
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		log.Printf("Ошибка записи CSV: %v", err)
+	}
+}
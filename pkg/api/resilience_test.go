@@ -0,0 +1,178 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"gorefer.go/pkg/api"
+	"gorefer.go/pkg/api/apitest"
+	"gorefer.go/pkg/storage"
+)
+
+// Проверки устойчивости API к сбоям хранилища, внедренным через
+// storage.Faulty: таймауты, отмены и ошибки PostgreSQL.
+
+// getError выполняет запрос и возвращает статус и тело ошибки.
+func getError(t *testing.T, srv *apitest.Server, req *http.Request) (int, http.Header, api.ErrorResponse) {
+	t.Helper()
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body api.ErrorResponse
+	if resp.StatusCode >= 400 {
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode, resp.Header, body
+}
+
+func TestResilience_StorageFaults(t *testing.T) {
+	srv := apitest.NewServer(t,
+		apitest.WithFaults(nil),
+		apitest.WithAPIOptions(api.WithTimeouts(api.Timeouts{User: time.Second, Admin: time.Second})),
+	)
+
+	tests := []struct {
+		name           string
+		rules          storage.FaultRules
+		header         string // X-Request-Timeout
+		wantStatus     int
+		wantCode       string
+		wantRetryAfter bool
+		maxElapsed     time.Duration
+	}{
+		{"No faults", nil, "", http.StatusOK, "", false, time.Second},
+		{"Zero probability", storage.FaultRules{{Method: "GetReferralStats", Probability: 0, Error: storage.FaultTimeout}}, "", http.StatusOK, "", false, time.Second},
+		{"Storage deadline maps to 504", storage.FaultRules{{Method: "GetReferralStats", Probability: 1, Error: storage.FaultTimeout}}, "", http.StatusGatewayTimeout, api.CodeTimeout, true, time.Second},
+		{"Slow storage trips the request budget", storage.FaultRules{{Method: "*", Probability: 1, LatencyMs: 5000}}, "0.5", http.StatusGatewayTimeout, api.CodeTimeout, true, 2 * time.Second},
+		{"Latency within budget", storage.FaultRules{{Method: "GetReferralStats", Probability: 1, LatencyMs: 50}}, "", http.StatusOK, "", false, time.Second},
+		{"Database shutdown is an internal error", storage.FaultRules{{Method: "GetReferralStats", Probability: 1, Error: storage.FaultUnavailable}}, "", http.StatusInternalServerError, api.CodeInternal, false, time.Second},
+		{"Other methods are unaffected", storage.FaultRules{{Method: "GetCodeStats", Probability: 1, Error: storage.FaultUnavailable}}, "", http.StatusOK, "", false, time.Second},
+		{"First matching rule wins", storage.FaultRules{
+			{Method: "GetReferralStats", Probability: 0},
+			{Method: "*", Probability: 1, Error: storage.FaultTimeout},
+		}, "", http.StatusOK, "", false, time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := srv.Faults.SetRules(tt.rules); err != nil {
+				t.Fatal(err)
+			}
+			req := srv.NewRequest(t, "GET", "/p/stats", nil)
+			if tt.header != "" {
+				req.Header.Set("X-Request-Timeout", tt.header)
+			}
+			start := time.Now()
+			status, header, body := getError(t, srv, req)
+			if elapsed := time.Since(start); elapsed > tt.maxElapsed {
+				t.Errorf("request took %v, want under %v", elapsed, tt.maxElapsed)
+			}
+			if status != tt.wantStatus || body.Code != tt.wantCode {
+				t.Fatalf("got %d %q, want %d %q", status, body.Code, tt.wantStatus, tt.wantCode)
+			}
+			if got := header.Get("Retry-After") != ""; got != tt.wantRetryAfter {
+				t.Errorf("Retry-After = %q, want present %t", header.Get("Retry-After"), tt.wantRetryAfter)
+			}
+		})
+	}
+}
+
+func TestResilience_FaultRulesEndpoint(t *testing.T) {
+	srv := apitest.NewServer(t, apitest.WithAdmin(), apitest.WithFaults(storage.FaultRules{
+		{Method: "GetReferralStats", Probability: 1, Error: storage.FaultSerialization},
+	}))
+
+	put := func(t *testing.T, body string) int {
+		t.Helper()
+		resp := srv.Do(t, "PUT", "/admin/faults", strings.NewReader(body))
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	stats := func(t *testing.T) int {
+		t.Helper()
+		resp := srv.Do(t, "GET", "/p/stats", nil)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if got := stats(t); got != http.StatusInternalServerError {
+		t.Fatalf("stats with initial fault = %d, want 500", got)
+	}
+
+	resp := srv.Do(t, "GET", "/admin/faults", nil)
+	var rules storage.FaultRules
+	if err := json.NewDecoder(resp.Body).Decode(&rules); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(rules) != 1 || rules[0].Error != storage.FaultSerialization {
+		t.Errorf("rules = %+v, want the initial rule", rules)
+	}
+
+	for _, invalid := range []string{
+		`[{"method":"GetReferralStats","probability":2}]`,
+		`[{"method":"GetReferralStats","probability":1,"error":"meteor"}]`,
+		`[{"probability":1}]`,
+	} {
+		if got := put(t, invalid); got != http.StatusBadRequest {
+			t.Errorf("PUT %s = %d, want 400", invalid, got)
+		}
+	}
+	if got := stats(t); got != http.StatusInternalServerError {
+		t.Errorf("rejected rules replaced the active ones: stats = %d, want 500", got)
+	}
+
+	if got := put(t, `[]`); got != http.StatusOK {
+		t.Fatalf("PUT [] = %d, want 200", got)
+	}
+	if got := stats(t); got != http.StatusOK {
+		t.Errorf("stats after clearing faults = %d, want 200", got)
+	}
+}
+
+func TestResilience_FaultRoutesDisabled(t *testing.T) {
+	srv := apitest.NewServer(t, apitest.WithAdmin())
+	resp := srv.Do(t, "GET", "/admin/faults", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /admin/faults without fault injection = %d, want 404", resp.StatusCode)
+	}
+}
+
+// Клиент закрыл соединение, пока хранилище отвечает: контекст запроса
+// отменяется, обработчик завершается сразу, не дожидаясь хранилища, а
+// ответ не считается ошибкой сервиса.
+func TestResilience_ClientDisconnect(t *testing.T) {
+	srv := apitest.NewServer(t, apitest.WithFaults(storage.FaultRules{
+		{Method: "*", Probability: 1, LatencyMs: 10000},
+	}))
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.NewRequest(t, "GET", "/p/stats", nil).Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	// запрос должен дойти до хранилища
+	time.Sleep(100 * time.Millisecond)
+	conn.Close()
+
+	start := time.Now()
+	for srv.API.ErrorCounts()["GET /p/stats"][api.ReasonClientClosed] == 0 {
+		if time.Since(start) > 2*time.Second {
+			t.Fatalf("handler still waits for storage after disconnect, counts = %v", srv.API.ErrorCounts())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := srv.API.ErrorCounts()["GET /p/stats"]; len(got) != 1 {
+		t.Errorf("counts for /p/stats = %v, want only %s", got, api.ReasonClientClosed)
+	}
+}
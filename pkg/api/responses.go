@@ -0,0 +1,138 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"gorefer.go/pkg/onboarding"
+	"gorefer.go/pkg/storage"
+)
+
+// ErrorResponse - тело ответа с ошибкой.
+type ErrorResponse struct {
+	Error             string       `json:"error"`
+	Code              string       `json:"code"`
+	RetryAfterSeconds int          `json:"retry_after_seconds,omitempty"`
+	Fields            []FieldError `json:"fields,omitempty"` // нарушения по полям для VALIDATION_FAILED
+	// исчерпанная квота для QUOTA_EXCEEDED
+	Quota *QuotaExceeded `json:"quota,omitempty"`
+}
+
+// TokenResponse - ответ на успешный вход.
+type TokenResponse struct {
+	Token string `json:"token"`
+}
+
+// SignupUser - зарегистрированный пользователь в ответе на регистрацию.
+type SignupUser struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+	Email    string `json:"email"`
+}
+
+// ReferralSignupResponse - ответ на регистрацию через
+// /register-with-referral: пользователь и пригласивший его реферер.
+type ReferralSignupResponse struct {
+	User       SignupUser       `json:"user"`
+	ReferredBy *storage.UserRef `json:"referred_by"` // null - регистрация без реферера
+	Warning    *SignupWarning   `json:"warning,omitempty"`
+}
+
+// SignupResponse - ответ на регистрацию через /register.
+type SignupResponse struct {
+	ID      int            `json:"id"`
+	Warning *SignupWarning `json:"warning,omitempty"`
+}
+
+// SignupWarning - почему реферальный код из заголовка X-Referral-Code или
+// параметра ?ref= не учтен, см. InvalidCodeIgnore.
+type SignupWarning struct {
+	Code    string `json:"code"` // код ошибки, которой завершилась бы регистрация
+	Message string `json:"message"`
+}
+
+// newReferralSignupResponse собирает ответ на регистрацию; пароль в
+// ответ не попадает.
+func newReferralSignupResponse(user storage.User, referrer *storage.UserRef) ReferralSignupResponse {
+	return ReferralSignupResponse{
+		User:       SignupUser{ID: user.ID, Username: user.Username, Email: user.Email},
+		ReferredBy: referrer,
+	}
+}
+
+// ValidationResponse - ответ на проверку данных в режиме dry_run.
+// Ограничение домена есть, только если код его задает.
+type ValidationResponse struct {
+	Valid bool `json:"valid"`
+	storage.DomainRestriction
+}
+
+// CreatedResponse - ответ на создание ресурса.
+type CreatedResponse struct {
+	ID int `json:"id"`
+}
+
+// ReferralResponse - приглашенный пользователь в списке рефералов
+// без персональных данных. Onboarding содержит только названия шагов.
+type ReferralResponse struct {
+	Username   string               `json:"username"`
+	JoinedAt   time.Time            `json:"joined_at"`
+	Onboarding *onboarding.Progress `json:"onboarding,omitempty"`
+	Reward     string               `json:"reward,omitempty"` // storage.RewardPending или storage.RewardVested
+}
+
+// ReferralCodeDetailsResponse - подробности реферального кода с признаками
+// его недействительности.
+type ReferralCodeDetailsResponse struct {
+	storage.ReferralCodeDetails
+	Active    bool `json:"active"`
+	Expired   bool `json:"expired"`
+	Revoked   bool `json:"revoked"`
+	Exhausted bool `json:"exhausted"`
+	Reserved  bool `json:"reserved"`
+}
+
+// Значение Content-Type для JSON-ответов. Срез общий для всех ответов:
+// Header.Set и Header.Add его не изменяют, а заменяют, поэтому
+// присваивание не выделяет память на каждый ответ.
+var jsonContentType = []string{"application/json"}
+
+// respond отправляет ответ с указанным статусом. Если v не nil, тело
+// кодируется в JSON; заголовки выставляются до WriteHeader. Ошибки
+// кодирования только логируются - статус к этому моменту уже отправлен.
+// Ответы 201 отправляются через created.
+func respond(w http.ResponseWriter, status int, v interface{}) {
+	if v == nil {
+		w.WriteHeader(status)
+		return
+	}
+	w.Header()["Content-Type"] = jsonContentType
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Ошибка кодирования ответа: %v", err)
+	}
+}
+
+// Адрес Location текущего пользователя после регистрации
+const profileLocation = "/p/me"
+
+// resourceLink - ссылка на связанный ресурс для заголовка Link.
+type resourceLink struct {
+	path string // путь относительно API
+	rel  string
+}
+
+// created отправляет ответ 201 с заголовком Location - путем созданного
+// ресурса относительно API - и заголовками Link на связанные ресурсы.
+// Пути дополняются префиксом монтирования, см. Handler.
+func created(w http.ResponseWriter, r *http.Request, location string, v interface{}, links ...resourceLink) {
+	base := basePath(r.Context())
+	w.Header().Set("Location", base+location)
+	for _, l := range links {
+		w.Header().Add("Link", fmt.Sprintf("<%s>; rel=%q", base+l.path, l.rel))
+	}
+	respond(w, http.StatusCreated, v)
+}
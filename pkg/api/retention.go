@@ -0,0 +1,42 @@
+package api
+
+import (
+	"net/http"
+	"time"
+)
+
+// RetentionReporter - источник итогов очистки устаревших персональных
+// данных, см. пакет retention.
+type RetentionReporter interface {
+	RetentionStats() RetentionStats
+}
+
+// RetentionStats - итоги очистки устаревших IP-адресов и User-Agent,
+// завершенных доставок событий и архива удаленных кодов
+type RetentionStats struct {
+	MaxAgeDays        int        `json:"max_age_days"`         // срок хранения
+	ArchiveMaxAgeDays int        `json:"archive_max_age_days"` // срок хранения архива удаленных кодов
+	LastRunAt         *time.Time `json:"last_run_at"`          // nil - очистка еще не выполнялась
+	// LastRun - очищено строк за последний проход по таблицам
+	LastRun map[string]int64 `json:"last_run"`
+	// Capped - последний проход остановлен на пределе строк, устаревшие
+	// строки остались до следующего прохода
+	Capped bool `json:"capped"`
+	// Total - очищено строк по таблицам с запуска сервиса
+	Total map[string]int64 `json:"total"`
+}
+
+// WithRetention включает маршрут /admin/metrics/retention и раздел
+// retention сводки /admin/overview. Без этого параметра маршрут не
+// регистрируется.
+func WithRetention(r RetentionReporter) Option {
+	return func(a *API) {
+		a.retention = r
+	}
+}
+
+// Обработчик для получения итогов очистки устаревших персональных
+// данных (admin).
+func (api *API) GetRetentionMetrics(w http.ResponseWriter, r *http.Request) {
+	respond(w, http.StatusOK, api.retention.RetentionStats())
+}
@@ -0,0 +1,121 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"unicode/utf8"
+
+	"gorefer.go/pkg/api/pagination"
+	"gorefer.go/pkg/reqctx"
+	"gorefer.go/pkg/storage"
+)
+
+// Максимальная длина комментария к списанию
+const maxRedemptionNoteLength = 500
+
+// Обработчик для списания вознаграждений текущего пользователя. Сумма
+// должна быть положительной и не больше баланса; в ответе - списание с
+// балансом после него.
+func (api *API) RedeemReward(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Amount int64  `json:"amount"`
+		Note   string `json:"note"`
+	}
+	if !api.decodeJSON(w, r, &request) {
+		return
+	}
+	if request.Amount <= 0 {
+		api.writeError(w, r, CodeInvalidPayload, errors.New("amount must be positive"))
+		return
+	}
+	if utf8.RuneCountInString(request.Note) > maxRedemptionNoteLength {
+		api.writeError(w, r, CodeInvalidPayload, fmt.Errorf("note exceeds %d characters", maxRedemptionNoteLength))
+		return
+	}
+
+	claims, ok := reqctx.UserFrom(r.Context())
+	if !ok {
+		api.writeError(w, r, CodeUnauthorized, nil)
+		return
+	}
+
+	ctx := r.Context()
+
+	resultChan := make(chan storage.Redemption)
+	errorChan := make(chan error)
+
+	go func() {
+		redemption, err := api.db.RedeemReward(ctx, claims.UserID, request.Amount, request.Note)
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		resultChan <- redemption
+	}()
+
+	select {
+	case redemption := <-resultChan:
+		respond(w, http.StatusCreated, redemption)
+
+	case err := <-errorChan:
+		switch {
+		case errors.Is(err, storage.ErrInsufficientBalance):
+			api.writeError(w, r, CodeInsufficientBalance, err)
+		case errors.Is(err, storage.ErrNotFound):
+			api.writeError(w, r, CodeUserNotFound, err)
+		default:
+			api.writeError(w, r, CodeInternal, fmt.Errorf("failed to redeem reward: %w", err))
+		}
+		return
+	}
+}
+
+// Обработчик для получения списаний вознаграждений для сверки (admin).
+// Параметр user_id отбирает списания пользователя. Поддерживает
+// limit/offset.
+func (api *API) ListRedemptions(w http.ResponseWriter, r *http.Request) {
+	page, err := pagination.Parse(r, api.pages)
+	if err != nil {
+		api.writeError(w, r, CodeInvalidParameter, err)
+		return
+	}
+
+	var userID int
+	if v := r.URL.Query().Get("user_id"); v != "" {
+		if userID, err = strconv.Atoi(v); err != nil || userID <= 0 {
+			api.writeError(w, r, CodeInvalidID, fmt.Errorf("invalid user_id %q", v))
+			return
+		}
+	}
+
+	ctx := r.Context()
+
+	resultChan := make(chan []storage.Redemption)
+	errorChan := make(chan error)
+
+	go func() {
+		// лишняя запись показывает, есть ли следующая страница
+		redemptions, err := api.db.ListRedemptions(ctx, userID, page.Limit+1, page.Offset)
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		resultChan <- redemptions
+	}()
+
+	select {
+	case redemptions := <-resultChan:
+		hasMore := len(redemptions) > page.Limit
+		if hasMore {
+			redemptions = redemptions[:page.Limit]
+		}
+		pagination.SetLink(w, r, page, hasMore)
+		respond(w, http.StatusOK, redemptions)
+
+	case err := <-errorChan:
+		api.writeError(w, r, CodeInternal, fmt.Errorf("failed to list redemptions: %w", err))
+		return
+	}
+}
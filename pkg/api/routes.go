@@ -0,0 +1,103 @@
+package api
+
+import (
+	"net/http"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// RouteInfo - зарегистрированный маршрут и цепочка его middleware
+// в порядке применения.
+type RouteInfo struct {
+	Method     string   `json:"method"`
+	Pattern    string   `json:"pattern"`
+	Middleware []string `json:"middleware"`
+}
+
+// Routes возвращает все маршруты маршрутизатора, упорядоченные по
+// шаблону и методу.
+func (api *API) Routes() []RouteInfo {
+	var routes []RouteInfo
+	chi.Walk(api.r, func(method, route string, _ http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		names := make([]string, len(middlewares))
+		for i, mw := range middlewares {
+			names[i] = middlewareName(mw)
+		}
+		routes = append(routes, RouteInfo{Method: method, Pattern: route, Middleware: names})
+		return nil
+	})
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Pattern != routes[j].Pattern {
+			return routes[i].Pattern < routes[j].Pattern
+		}
+		return routes[i].Method < routes[j].Method
+	})
+	return routes
+}
+
+// Суффиксы имен замыканий (".func1" или ".1" в зависимости от версии
+// Go) и методов-значений ("-fm") в runtime
+var closureSuffix = regexp.MustCompile(`(\.(func)?\d+)+$|-fm$`)
+
+// middlewareName возвращает короткое имя функции middleware:
+// "middlware.Timeout" для замыкания из middlware.Timeout(d),
+// "api.countErrors" для метода API.
+func middlewareName(mw func(http.Handler) http.Handler) string {
+	fn := runtime.FuncForPC(reflect.ValueOf(mw).Pointer())
+	if fn == nil {
+		return "unknown"
+	}
+	name := fn.Name()
+	name = name[strings.LastIndex(name, "/")+1:]
+	name = closureSuffix.ReplaceAllString(name, "")
+	return strings.Replace(name, "(*API).", "", 1)
+}
+
+// Методы, которые проверяются при формировании заголовка Allow
+var routeMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+	http.MethodPatch, http.MethodDelete, http.MethodOptions,
+}
+
+// allowedMethods возвращает методы, для которых есть маршрут с путем
+// запроса r.
+func (api *API) allowedMethods(r *http.Request) []string {
+	path := r.URL.RawPath
+	if path == "" {
+		path = r.URL.Path
+	}
+	// при встраивании через Handler маршруты заданы без префикса
+	path = strings.TrimPrefix(path, basePath(r.Context()))
+	if path == "" {
+		path = "/"
+	}
+	var allowed []string
+	for _, method := range routeMethods {
+		if api.r.Match(chi.NewRouteContext(), method, path) {
+			allowed = append(allowed, method)
+		}
+	}
+	return allowed
+}
+
+// routeNotFound отвечает на запрос к неизвестному пути.
+func (api *API) routeNotFound(w http.ResponseWriter, r *http.Request) {
+	api.writeError(w, r, CodeRouteNotFound, nil)
+}
+
+// methodNotAllowed отвечает на запрос к известному пути с методом, для
+// которого нет маршрута. Допустимые методы перечисляются в Allow.
+func (api *API) methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Allow", strings.Join(api.allowedMethods(r), ", "))
+	api.writeError(w, r, CodeMethodNotAllowed, nil)
+}
+
+// Обработчик для получения списка маршрутов с middleware (admin).
+func (api *API) GetRoutes(w http.ResponseWriter, r *http.Request) {
+	respond(w, http.StatusOK, api.Routes())
+}
@@ -0,0 +1,341 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorefer.go/pkg/auth"
+	"gorefer.go/pkg/storage"
+	"gorefer.go/pkg/timing"
+)
+
+// errInvalidSignup - в данных регистрации не хватает обязательных полей
+var errInvalidSignup = errors.New("username, email and password are required")
+
+// dryRun сообщает, запрошена ли только проверка данных регистрации
+// (?dry_run=true) без создания записей.
+func dryRun(r *http.Request) bool {
+	v, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+	return v
+}
+
+// Реферальный код для /register, который партнер может передать, не
+// меняя тело запроса своей формы регистрации
+const (
+	referralCodeHeader = "X-Referral-Code"
+	referralCodeParam  = "ref"
+)
+
+// Источники реферального кода регистрации от высшего приоритета к низшему
+const (
+	codeFromBody   = "body"   // referral_code в теле /register-with-referral
+	codeFromHeader = "header" // заголовок X-Referral-Code
+	codeFromQuery  = "query"  // параметр ?ref=
+	codeFromCookie = "cookie" // cookie атрибуции после перехода по ссылке
+)
+
+// signupCode - реферальный код регистрации и его источник
+type signupCode struct {
+	code   string
+	source string // пустой - регистрация без кода
+	// att - содержимое cookie атрибуции; attributed - cookie есть, даже
+	// если код взят из другого источника
+	att        attribution
+	attributed bool
+}
+
+// explicit сообщает, передан ли код клиентом явно, а не взят из cookie
+// атрибуции.
+func (c signupCode) explicit() bool {
+	return c.source != "" && c.source != codeFromCookie
+}
+
+// resolveReferralCode выбирает реферальный код регистрации: из тела
+// запроса, затем из заголовка X-Referral-Code, параметра ?ref= и cookie
+// атрибуции. Общий для /register и /register-with-referral.
+func resolveReferralCode(r *http.Request, bodyCode string) signupCode {
+	var c signupCode
+	c.att, c.attributed = attributionFrom(r)
+	switch {
+	case bodyCode != "":
+		c.code, c.source = bodyCode, codeFromBody
+	case strings.TrimSpace(r.Header.Get(referralCodeHeader)) != "":
+		c.code, c.source = strings.TrimSpace(r.Header.Get(referralCodeHeader)), codeFromHeader
+	case strings.TrimSpace(r.URL.Query().Get(referralCodeParam)) != "":
+		c.code, c.source = strings.TrimSpace(r.URL.Query().Get(referralCodeParam)), codeFromQuery
+	case c.attributed:
+		c.code, c.source = c.att.Code, codeFromCookie
+	}
+	return c
+}
+
+// signupResult - итог регистрации
+type signupResult struct {
+	id       int
+	referrer *storage.UserRef // nil - реферальная связь не создана
+	warning  *SignupWarning   // код не учтен, см. Registration.ignores
+}
+
+// signup регистрирует пользователя по коду c, без кода - открытой
+// регистрацией. Пароль user хешируется здесь. Недействительный код из
+// cookie атрибуции пропускается, из заголовка или параметра - по
+// настройке Registration.InvalidCode.
+func (api *API) signup(ctx context.Context, r *http.Request, user storage.User, source string, c signupCode) (signupResult, error) {
+	if c.explicit() {
+		if err := api.checkInviteQuota(ctx, c.code); err != nil {
+			return signupResult{}, err
+		}
+	}
+	stopHash := timing.Start(ctx, phaseHash)
+	hashedPassword, err := auth.HashPassword(user.Password)
+	stopHash()
+	if err != nil {
+		return signupResult{}, err
+	}
+	plain := user.Password
+	user.Password = hashedPassword
+	params := signupParams(r, user, source)
+	params.PlainPassword = plain
+	return api.createAccount(ctx, params, c, language(r))
+}
+
+// createAccount создает пользователя с уже хешированным паролем по коду c
+// в одной транзакции с реферальной связью. lang - язык предупреждения о
+// пропущенном коде. Общий для обработчиков регистрации и очереди
+// регистраций.
+func (api *API) createAccount(ctx context.Context, params storage.CreateUserParams, c signupCode, lang string) (signupResult, error) {
+	defer timing.Start(ctx, phaseDB)()
+	var res signupResult
+	var err error
+	switch c.source {
+	case "":
+		res.id, err = api.db.CreateUser(ctx, params)
+	case codeFromCookie:
+		res.id, res.referrer, err = api.registerAttributed(ctx, params, c.att)
+	default:
+		var reg storage.ReferralRegistration
+		reg, err = api.db.RegisterWithReferralCode(ctx, c.code, params)
+		if code, invalid := invalidCodeError(err); invalid && api.registration.ignores(c) {
+			res.warning = &SignupWarning{Code: code, Message: message(code, lang)}
+			res.id, err = api.db.CreateUser(ctx, params)
+			break
+		}
+		if err == nil {
+			res.id, res.referrer = reg.UserID, &reg.Referrer
+		}
+	}
+	return res, err
+}
+
+// invalidCodeError сообщает, что регистрация не прошла из-за самого
+// реферального кода, и возвращает код ошибки API.
+func invalidCodeError(err error) (string, bool) {
+	switch {
+	case errors.Is(err, storage.ErrCodeInvalid):
+		return CodeReferralCodeInvalid, true
+	case errors.Is(err, storage.ErrChainTooDeep):
+		return CodeReferralChainTooDeep, true
+	case errors.Is(err, storage.ErrCodeDomainMismatch):
+		return CodeDomainMismatch, true
+	}
+	return "", false
+}
+
+// registered уведомляет о регистрации пользователя и удаляет cookie
+// атрибуции.
+func (api *API) registered(w http.ResponseWriter, r *http.Request, user storage.User, c signupCode, res signupResult) {
+	api.userRegistered(r.Context(), user)
+	if res.referrer != nil {
+		api.referralCreated(r.Context(), c.code, user)
+	}
+	if c.attributed {
+		clearAttribution(w)
+	}
+}
+
+// referralSignup - проверенный запрос /register-with-referral
+type referralSignup struct {
+	user   storage.User
+	source string
+	ref    signupCode
+}
+
+// referralSignupRequest разбирает и проверяет запрос
+// /register-with-referral. false - ответ уже отправлен: ошибка или итог
+// проверки в режиме dry_run. Общий для регистрации и постановки в
+// очередь регистраций.
+func (api *API) referralSignupRequest(w http.ResponseWriter, r *http.Request) (referralSignup, bool) {
+	var request struct {
+		ReferralCode string       `json:"referral_code,omitempty"` // Позволяет отсутствовать
+		User         storage.User `json:"user"`
+		Source       string       `json:"source"`
+	}
+
+	if !api.registration.Referral {
+		api.writeError(w, r, CodeRegistrationDisabled, errRegistrationDisabled)
+		return referralSignup{}, false
+	}
+	if !api.decodeJSON(w, r, &request) {
+		return referralSignup{}, false
+	}
+	ref := resolveReferralCode(r, request.ReferralCode)
+	if !api.registration.allows(ref) {
+		api.writeError(w, r, CodeRegistrationDisabled, errRegistrationDisabled)
+		return referralSignup{}, false
+	}
+
+	if dryRun(r) {
+		api.validateOnly(w, r, request.User, api.dryRunCode(ref))
+		return referralSignup{}, false
+	}
+	stopValidate := timing.Start(r.Context(), phaseValidate)
+	code, err := api.validateUser(&request.User)
+	stopValidate()
+	if err != nil {
+		api.writeError(w, r, code, err)
+		return referralSignup{}, false
+	}
+	return referralSignup{user: request.User, source: request.Source, ref: ref}, true
+}
+
+// validateUser проверяет поля регистрации и приводит имя пользователя
+// к форме, в которой оно сохраняется. Возвращает код ошибки API и
+// причину, если данные не прошли проверку.
+func (api *API) validateUser(user *storage.User) (string, error) {
+	if strings.TrimSpace(user.Username) == "" || user.Password == "" || !strings.Contains(user.Email, "@") {
+		return CodeInvalidPayload, errInvalidSignup
+	}
+	name, err := normalizeUsername(user.Username)
+	if err != nil {
+		return CodeValidationFailed, err
+	}
+	user.Username = name
+	if err := api.policy.validatePassword(user.Password); err != nil {
+		return CodeValidationFailed, err
+	}
+	return "", nil
+}
+
+// validateSignup выполняет все проверки регистрации, обращаясь к хранилищу
+// только на чтение. Возвращает ограничение домена кода, чтобы форма
+// регистрации могла предупредить о нем заранее, и код ошибки API с
+// причиной, если данные не прошли проверку. Пустой referralCode не
+// проверяется.
+func (api *API) validateSignup(ctx context.Context, user storage.User, referralCode string) (storage.DomainRestriction, string, error) {
+	var none storage.DomainRestriction
+	if code, err := api.validateUser(&user); err != nil {
+		return none, code, err
+	}
+
+	exists, err := api.db.EmailExists(ctx, user.Email)
+	if err != nil {
+		return none, CodeInternal, fmt.Errorf("failed to check email: %w", err)
+	}
+	if exists {
+		return none, CodeEmailTaken, storage.ErrEmailTaken
+	}
+
+	if referralCode == "" {
+		return none, "", nil
+	}
+	details, err := api.db.GetReferralCodeDetails(ctx, referralCode)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return none, CodeReferralCodeNotFound, err
+		}
+		return none, CodeInternal, fmt.Errorf("failed to retrieve referral code: %w", err)
+	}
+	if details.Expired(time.Now()) || details.Revoked() || details.Exhausted() || details.Reserved() {
+		return none, CodeReferralCodeInvalid, fmt.Errorf("referral code %q cannot be redeemed", referralCode)
+	}
+	// код реферера, не принявшего текущие условия, не действует
+	if err := api.checkTerms(ctx, details.UserID); err != nil {
+		if errors.Is(err, errTermsNotAccepted) {
+			return none, CodeReferralCodeInvalid, fmt.Errorf("referral code %q cannot be redeemed: %w", referralCode, err)
+		}
+		return none, CodeInternal, fmt.Errorf("failed to check referrer terms: %w", err)
+	}
+	if !details.Allows(user.Email) {
+		return details.DomainRestriction, CodeDomainMismatch, &ValidationError{Fields: []FieldError{{
+			Field:   "email",
+			Code:    "domain_mismatch",
+			Message: fmt.Sprintf("referral code %q is limited to %s addresses", referralCode, details.Domain),
+		}}}
+	}
+	return details.DomainRestriction, "", nil
+}
+
+// writeSignupError отвечает на ошибку регистрации. Занятый email
+// определяется ограничением уникальности в БД, а не предварительной
+// проверкой: одновременные регистрации через /register и
+// /register-with-referral проходят ее обе, и вторая получает тот же
+// ответ 409, что и при последовательных запросах.
+func (api *API) writeSignupError(w http.ResponseWriter, r *http.Request, err error, action string) {
+	code := signupErrorCode(err)
+	if code == CodeInternal {
+		err = fmt.Errorf("failed to %s: %w", action, err)
+	}
+	api.writeError(w, r, code, err)
+}
+
+// signupErrorCode возвращает код ошибки API для ошибки регистрации;
+// CodeInternal - ошибка не связана с данными регистрации.
+func signupErrorCode(err error) string {
+	switch {
+	case errors.Is(err, storage.ErrEmailTaken):
+		return CodeEmailTaken
+	case errors.Is(err, storage.ErrUsernameTaken):
+		return CodeUsernameTaken
+	case errors.Is(err, storage.ErrChainTooDeep):
+		return CodeReferralChainTooDeep
+	case errors.Is(err, storage.ErrCodeInvalid):
+		// в том числе код реферера, не принявшего текущие условия программы
+		return CodeReferralCodeInvalid
+	case errors.Is(err, storage.ErrCodeDomainMismatch):
+		return CodeDomainMismatch
+	case errors.Is(err, storage.ErrSelfReferral):
+		// повтор регистрации владельца кода по собственному коду
+		return CodeSelfReferral
+	case errors.As(err, new(*QuotaError)):
+		// реферер исчерпал суточную квоту приглашений
+		return CodeQuotaExceeded
+	}
+	return CodeInternal
+}
+
+// dryRunCode возвращает код, который проверяется в режиме dry_run:
+// пропускаемый при ошибке код не проверяется.
+func (api *API) dryRunCode(c signupCode) string {
+	if !c.explicit() || api.registration.ignores(c) {
+		return ""
+	}
+	return c.code
+}
+
+// validateOnly отвечает на запрос регистрации в режиме dry_run:
+// 200 {"valid": true} с ограничением домена кода, если оно есть, либо
+// обычная ошибка. Ничего не записывается.
+func (api *API) validateOnly(w http.ResponseWriter, r *http.Request, user storage.User, referralCode string) {
+	type result struct {
+		domain storage.DomainRestriction
+		code   string
+		err    error
+	}
+	resultChan := make(chan result)
+	go func() {
+		domain, code, err := api.validateSignup(r.Context(), user, referralCode)
+		resultChan <- result{domain, code, err}
+	}()
+
+	res := <-resultChan
+	if res.err != nil {
+		api.writeError(w, r, res.code, res.err)
+		return
+	}
+	respond(w, http.StatusOK, ValidationResponse{Valid: true, DomainRestriction: res.domain})
+}
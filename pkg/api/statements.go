@@ -0,0 +1,143 @@
+package api
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"gorefer.go/pkg/reqctx"
+	"gorefer.go/pkg/storage"
+)
+
+// Обработчик для получения выписок по вознаграждениям текущего
+// пользователя, последние первыми.
+func (api *API) ListMyStatements(w http.ResponseWriter, r *http.Request) {
+	claims, ok := reqctx.UserFrom(r.Context())
+	if !ok {
+		api.writeError(w, r, CodeUnauthorized, nil)
+		return
+	}
+
+	ctx := r.Context()
+
+	resultChan := make(chan []storage.RewardStatement)
+	errorChan := make(chan error)
+
+	go func() {
+		statements, err := api.db.ListRewardStatements(ctx, claims.UserID)
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		resultChan <- statements
+	}()
+
+	select {
+	case statements := <-resultChan:
+		respond(w, http.StatusOK, statements)
+
+	case err := <-errorChan:
+		api.writeError(w, r, CodeInternal, fmt.Errorf("failed to list statements: %w", err))
+		return
+	}
+}
+
+// Обработчик для повторной загрузки выписки текущего пользователя за
+// месяц {period} (YYYY-MM) в формате CSV - тот же файл, что приложен к
+// письму.
+func (api *API) DownloadMyStatement(w http.ResponseWriter, r *http.Request) {
+	period, err := time.Parse(storage.StatementPeriodLayout, chi.URLParam(r, "period"))
+	if err != nil {
+		api.writeError(w, r, CodeInvalidParameter, fmt.Errorf("period must be YYYY-MM: %w", err))
+		return
+	}
+
+	claims, ok := reqctx.UserFrom(r.Context())
+	if !ok {
+		api.writeError(w, r, CodeUnauthorized, nil)
+		return
+	}
+
+	ctx := r.Context()
+
+	resultChan := make(chan []storage.LedgerEntry)
+	errorChan := make(chan error)
+	var loc *time.Location
+
+	go func() {
+		// выгружаются только месяцы, за которые выписка сформирована
+		if _, err := api.db.GetRewardStatement(ctx, claims.UserID, period); err != nil {
+			errorChan <- err
+			return
+		}
+		entries, err := api.db.ListLedgerEntries(ctx, claims.UserID, period)
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		profile, err := api.db.GetProfile(ctx, claims.UserID)
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		loc = UserLocation(profile.Timezone)
+		resultChan <- entries
+	}()
+
+	select {
+	case entries := <-resultChan:
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", StatementFilename(period)))
+		w.WriteHeader(http.StatusOK)
+		if err := WriteStatementCSV(w, entries, loc); err != nil {
+			log.Printf("Ошибка записи CSV: %v", err)
+		}
+
+	case err := <-errorChan:
+		if errors.Is(err, storage.ErrNotFound) {
+			api.writeError(w, r, CodeStatementNotFound, err)
+			return
+		}
+		api.writeError(w, r, CodeInternal, fmt.Errorf("failed to get statement: %w", err))
+		return
+	}
+}
+
+// StatementFilename возвращает имя CSV-файла выписки за месяц period.
+func StatementFilename(period time.Time) string {
+	return "rewards_" + period.Format(storage.StatementPeriodLayout) + ".csv"
+}
+
+// UserLocation возвращает часовой пояс пользователя по имени из профиля.
+// Пустое или неизвестное имя дает UTC.
+func UserLocation(name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// WriteStatementCSV построчно записывает операции выписки в формате CSV,
+// даты - в часовом поясе loc.
+func WriteStatementCSV(w io.Writer, entries []storage.LedgerEntry, loc *time.Location) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"date", "type", "amount", "details"})
+	for _, e := range entries {
+		cw.Write([]string{
+			e.At.In(loc).Format(time.RFC3339),
+			e.Type,
+			strconv.FormatInt(e.Amount, 10),
+			e.Details,
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
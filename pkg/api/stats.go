@@ -0,0 +1,55 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"gorefer.go/pkg/reqctx"
+	"gorefer.go/pkg/storage"
+)
+
+// Обработчик для получения реферальной статистики текущего пользователя:
+// число приглашенных, начисленные вознаграждения и текущая ступень, а при
+// нескольких кодах на пользователя - переходы и рефералы по каждому коду,
+// с ?include_archived=true - и по удаленным кодам из архива
+func (api *API) GetMyStats(w http.ResponseWriter, r *http.Request) {
+	claims, ok := reqctx.UserFrom(r.Context())
+	if !ok {
+		api.writeError(w, r, CodeUnauthorized, nil)
+		return
+	}
+	archived, err := includeArchived(r)
+	if err != nil {
+		api.writeError(w, r, CodeInvalidParameter, err)
+		return
+	}
+
+	ctx := r.Context()
+
+	resultChan := make(chan storage.ReferralStats)
+	errorChan := make(chan error)
+
+	go func() {
+		stats, err := api.db.GetReferralStats(ctx, claims.UserID)
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		if api.multipleCodes() {
+			if stats.Codes, err = api.db.GetCodeStats(ctx, claims.UserID, archived); err != nil {
+				errorChan <- err
+				return
+			}
+		}
+		resultChan <- stats
+	}()
+
+	select {
+	case stats := <-resultChan:
+		respond(w, http.StatusOK, stats)
+
+	case err := <-errorChan:
+		api.writeError(w, r, CodeInternal, fmt.Errorf("failed to retrieve referral stats: %w", err))
+		return
+	}
+}
@@ -0,0 +1,73 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"gorefer.go/pkg/reqctx"
+	"gorefer.go/pkg/storage"
+)
+
+// errTermsNotAccepted - реферер не принял текущую версию условий программы
+var errTermsNotAccepted = errors.New("current referral program terms are not accepted")
+
+// WithTermsVersion требует от реферера принять условия программы версии
+// version через POST /p/terms/accept, прежде чем создавать коды. Смена
+// версии снова закрывает создание кодов всем, пока они не примут новую;
+// коды непринявших рефереров при этом не действуют при регистрации, если
+// хранилищу передан тот же storage.WithTermsVersion. Пустая версия -
+// проверка выключена.
+func WithTermsVersion(version string) Option {
+	return func(a *API) {
+		a.termsVersion = version
+	}
+}
+
+// checkTerms проверяет, что пользователь принял текущую версию условий.
+// Ошибка errTermsNotAccepted - не принял.
+func (api *API) checkTerms(ctx context.Context, userID int) error {
+	if api.termsVersion == "" {
+		return nil
+	}
+	accepted, err := api.db.TermsAccepted(ctx, userID, api.termsVersion)
+	if err != nil {
+		return err
+	}
+	if !accepted {
+		return fmt.Errorf("%w: version %s", errTermsNotAccepted, api.termsVersion)
+	}
+	return nil
+}
+
+// Обработчик принятия текущей версии условий реферальной программы
+func (api *API) AcceptTerms(w http.ResponseWriter, r *http.Request) {
+	claims, ok := reqctx.UserFrom(r.Context())
+	if !ok {
+		api.writeError(w, r, CodeUnauthorized, nil)
+		return
+	}
+	ip, _ := reqctx.ClientIPFrom(r.Context())
+
+	ctx := r.Context()
+
+	resultChan := make(chan storage.TermsAcceptance)
+	errorChan := make(chan error)
+
+	go func() {
+		acceptance, err := api.db.AcceptTerms(ctx, claims.UserID, api.termsVersion, ip)
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		resultChan <- acceptance
+	}()
+
+	select {
+	case acceptance := <-resultChan:
+		respond(w, http.StatusOK, acceptance)
+	case err := <-errorChan:
+		api.writeError(w, r, CodeInternal, fmt.Errorf("failed to accept terms: %w", err))
+	}
+}
@@ -0,0 +1,52 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"gorefer.go/pkg/auth"
+	"gorefer.go/pkg/storage"
+)
+
+// Заголовок запроса, которым администратор включает Server-Timing для
+// одного запроса; значение - DebugTiming
+const (
+	DebugHeader = "X-Gorefer-Debug"
+	DebugTiming = "timing"
+)
+
+// Этапы обработки в заголовке Server-Timing; этап encode замеряет
+// middlware.ServerTiming
+const (
+	phaseDecode   = "decode"
+	phaseValidate = "validate"
+	phaseHash     = "hash"
+	phaseDB       = "db"
+)
+
+// WithServerTiming включает заголовок Server-Timing с длительностями
+// этапов регистрации и входа для всех запросов. Без этого параметра
+// заголовок отдается только на запросы администратора с DebugHeader.
+func WithServerTiming(enabled bool) Option {
+	return func(a *API) {
+		a.serverTiming = enabled
+	}
+}
+
+// serverTimingEnabled сообщает, нужны ли запросу замеры этапов. Маршруты
+// регистрации и входа не требуют токена, поэтому токен администратора
+// проверяется здесь, и только при наличии DebugHeader.
+func (api *API) serverTimingEnabled(r *http.Request) bool {
+	if api.serverTiming {
+		return true
+	}
+	if r.Header.Get(DebugHeader) != DebugTiming {
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	claims, err := auth.ValidateToken(token)
+	return err == nil && claims.Role == storage.RoleAdmin && !claims.Impersonated()
+}
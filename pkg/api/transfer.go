@@ -0,0 +1,89 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+
+	"gorefer.go/pkg/reqctx"
+	"gorefer.go/pkg/storage"
+)
+
+// errNewOwnerNotFound - пользователя, которому передается код, нет
+var errNewOwnerNotFound = errors.New("new owner not found")
+
+// Обработчик для передачи реферального кода другому пользователю (admin),
+// например когда владелец кода партнера уходит из компании. Новые
+// регистрации по коду засчитываются новому владельцу; с
+// ?include_history=true ему переходят и прежние приглашенные по коду
+// вместе с начислениями за них. Передача фиксируется в журнале аудита.
+func (api *API) TransferReferralCode(w http.ResponseWriter, r *http.Request) {
+	code := chi.URLParam(r, "code")
+	includeHistory, err := strconv.ParseBool(r.URL.Query().Get("include_history"))
+	if err != nil && r.URL.Query().Has("include_history") {
+		api.writeError(w, r, CodeInvalidParameter, fmt.Errorf("include_history: %w", err))
+		return
+	}
+
+	var request struct {
+		NewOwnerID int `json:"new_owner_id"`
+	}
+	if !api.decodeJSON(w, r, &request) {
+		return
+	}
+	if request.NewOwnerID <= 0 {
+		api.writeError(w, r, CodeInvalidPayload, errors.New("new_owner_id is required"))
+		return
+	}
+
+	claims, ok := reqctx.UserFrom(r.Context())
+	if !ok {
+		api.writeError(w, r, CodeUnauthorized, nil)
+		return
+	}
+
+	ctx := r.Context()
+
+	resultChan := make(chan storage.CodeTransfer)
+	errorChan := make(chan error)
+
+	go func() {
+		if _, err := api.db.GetUserByID(ctx, request.NewOwnerID); err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				err = errNewOwnerNotFound
+			}
+			errorChan <- err
+			return
+		}
+		t, err := api.db.TransferReferralCode(ctx, code, request.NewOwnerID, includeHistory, claims.ActorID())
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		resultChan <- t
+	}()
+
+	select {
+	case t := <-resultChan:
+		respond(w, http.StatusOK, t)
+
+	case err := <-errorChan:
+		switch {
+		case errors.Is(err, errNewOwnerNotFound):
+			api.writeError(w, r, CodeUserNotFound, err)
+		case errors.Is(err, storage.ErrNotFound):
+			api.writeError(w, r, CodeReferralCodeNotFound, err)
+		case errors.Is(err, storage.ErrOwnerHasActiveCode):
+			api.writeError(w, r, CodeNewOwnerHasCode, err)
+		case errors.Is(err, storage.ErrTransferInvalid):
+			api.writeError(w, r, CodeTransferInvalid, err)
+		case errors.Is(err, storage.ErrInsufficientBalance):
+			api.writeError(w, r, CodeTransferBalance, err)
+		default:
+			api.writeError(w, r, CodeInternal, fmt.Errorf("failed to transfer referral code: %w", err))
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package api
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Ограничения длины имени пользователя в символах после нормализации
+const (
+	usernameMinLength = 3
+	usernameMaxLength = 32
+)
+
+// Знаки препинания, допустимые в имени пользователя помимо букв и цифр
+const usernamePunctuation = "._-"
+
+// Имена, которые нельзя занять при регистрации и смене имени. Сравнение
+// выполняется по skeleton, поэтому "Admin", "r00t" или "аdmin" с
+// кириллической "а" тоже отклоняются.
+var reservedUsernames = []string{"admin", "support", "root"}
+
+// Коды нарушений в поле username
+const (
+	usernameTooShort     = "too_short"
+	usernameTooLong      = "too_long"
+	usernameInvalidChars = "invalid_characters"
+	usernameReserved     = "reserved"
+)
+
+// Похожие на латиницу символы других алфавитов и цифры, которыми
+// подменяют буквы в зарезервированных именах
+var confusables = map[rune]rune{
+	'а': 'a', 'е': 'e', 'о': 'o', 'р': 'p', 'с': 'c', 'у': 'y', 'х': 'x',
+	'і': 'i', 'ј': 'j', 'ѕ': 's', 'һ': 'h', 'ԁ': 'd', 'ո': 'n', 'т': 't',
+	'α': 'a', 'ο': 'o', 'ρ': 'p', 'τ': 't', 'ι': 'i', 'ν': 'v', 'κ': 'k',
+	'0': 'o', '1': 'i', 'l': 'i', '5': 's',
+}
+
+// normalizeUsername проверяет имя пользователя и возвращает его в форме
+// NFC, в которой оно сохраняется. Нарушение возвращается как
+// *ValidationError с полем username.
+func normalizeUsername(username string) (string, error) {
+	fail := func(code, msg string) (string, error) {
+		return "", &ValidationError{Fields: []FieldError{{Field: "username", Code: code, Message: msg}}}
+	}
+	if !utf8.ValidString(username) {
+		return fail(usernameInvalidChars, "username must be valid UTF-8")
+	}
+
+	name := norm.NFC.String(username)
+	switch n := utf8.RuneCountInString(name); {
+	case n < usernameMinLength:
+		return fail(usernameTooShort, "username must be at least 3 characters")
+	case n > usernameMaxLength:
+		return fail(usernameTooLong, "username must be at most 32 characters")
+	}
+	for i, r := range name {
+		switch {
+		case unicode.IsLetter(r), unicode.IsDigit(r):
+		case unicode.Is(unicode.Mn, r) && i > 0:
+			// комбинируемые знаки без готовой составной формы, например в деванагари
+		case strings.ContainsRune(usernamePunctuation, r) && i > 0:
+		default:
+			return fail(usernameInvalidChars, "username may contain only letters, digits and . _ - and must start with a letter or digit")
+		}
+	}
+	if reservedUsername(name) {
+		return fail(usernameReserved, "username is reserved")
+	}
+	return name, nil
+}
+
+// reservedUsername сообщает, совпадает ли имя с зарезервированным с
+// точностью до регистра, знаков препинания, совместимых форм Unicode и
+// похожих символов.
+func reservedUsername(name string) bool {
+	s := skeleton(name)
+	for _, reserved := range reservedUsernames {
+		if s == skeleton(reserved) {
+			return true
+		}
+	}
+	return false
+}
+
+// skeleton приводит имя к форме для сравнения с зарезервированными:
+// NFKD, нижний регистр, похожие символы заменены латиницей, знаки
+// препинания и комбинируемые знаки удалены.
+func skeleton(name string) string {
+	var b strings.Builder
+	for _, r := range norm.NFKD.String(strings.ToLower(name)) {
+		if unicode.Is(unicode.Mn, r) || strings.ContainsRune(usernamePunctuation, r) {
+			continue
+		}
+		if c, ok := confusables[r]; ok {
+			r = c
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,52 @@
+package api
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeUsername(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		want     string
+		wantCode string
+	}{
+		{"Latin", "alice_99", "alice_99", ""},
+		{"Cyrillic", "Иван.Петров", "Иван.Петров", ""},
+		{"Decomposed form is composed", "jose\u0301", "jos\u00e9", ""},
+		{"Too short", "ab", "", usernameTooShort},
+		{"Too short after composition", "éé", "", usernameTooShort},
+		{"Too long", strings.Repeat("a", 33), "", usernameTooLong},
+		{"Control character", "bob\x00by", "", usernameInvalidChars},
+		{"Space", "bob by", "", usernameInvalidChars},
+		{"Leading punctuation", ".bobby", "", usernameInvalidChars},
+		{"Invalid UTF-8", "bob\xffby", "", usernameInvalidChars},
+		{"Reserved", "admin", "", usernameReserved},
+		{"Reserved with case and punctuation", "Sup.Port", "", usernameReserved},
+		{"Reserved with Cyrillic homoglyph", "аdmin", "", usernameReserved},
+		{"Reserved with digits", "r00t", "", usernameReserved},
+		{"Reserved with fullwidth letters", "ａｄｍｉｎ", "", usernameReserved},
+		{"Reserved name as prefix", "admin_fan", "admin_fan", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := normalizeUsername(tt.username)
+			if tt.wantCode == "" {
+				if err != nil || got != tt.want {
+					t.Fatalf("normalizeUsername(%q) = %q, %v; want %q", tt.username, got, err, tt.want)
+				}
+				return
+			}
+			var invalid *ValidationError
+			if !errors.As(err, &invalid) || len(invalid.Fields) != 1 {
+				t.Fatalf("normalizeUsername(%q) error = %v, want field error", tt.username, err)
+			}
+			if f := invalid.Fields[0]; f.Field != "username" || f.Code != tt.wantCode {
+				t.Errorf("field error = %+v, want username/%s", f, tt.wantCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"gorefer.go/pkg/api/pagination"
+	"gorefer.go/pkg/storage"
+)
+
+// WebhookRedeliverer немедленно повторяет доставку события, см.
+// webhooks.Dispatcher.
+type WebhookRedeliverer interface {
+	Redeliver(ctx context.Context, id int) (storage.WebhookDelivery, error)
+}
+
+// WithWebhooks включает маршруты просмотра и повтора доставок событий
+// внешним получателям. Без этого параметра маршруты не регистрируются.
+func WithWebhooks(r WebhookRedeliverer) Option {
+	return func(a *API) {
+		a.webhooks = r
+	}
+}
+
+// Обработчик для получения списка доставок событий (admin). Параметры
+// status (pending, delivered, failed) и target отбирают доставки.
+// Поддерживает limit/offset.
+func (api *API) ListWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	page, err := pagination.Parse(r, api.pages)
+	if err != nil {
+		api.writeError(w, r, CodeInvalidParameter, err)
+		return
+	}
+
+	q := r.URL.Query()
+	filter := storage.WebhookDeliveryFilter{Status: q.Get("status"), Target: q.Get("target")}
+	switch filter.Status {
+	case "", storage.WebhookPending, storage.WebhookDelivered, storage.WebhookFailed:
+	default:
+		api.writeError(w, r, CodeInvalidParameter, fmt.Errorf("unknown delivery status %q", filter.Status))
+		return
+	}
+
+	ctx := r.Context()
+
+	resultChan := make(chan []storage.WebhookDelivery)
+	errorChan := make(chan error)
+
+	go func() {
+		// лишняя запись показывает, есть ли следующая страница
+		deliveries, err := api.db.ListWebhookDeliveries(ctx, filter, page.Limit+1, page.Offset)
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		resultChan <- deliveries
+	}()
+
+	select {
+	case deliveries := <-resultChan:
+		hasMore := len(deliveries) > page.Limit
+		if hasMore {
+			deliveries = deliveries[:page.Limit]
+		}
+		pagination.SetLink(w, r, page, hasMore)
+		respond(w, http.StatusOK, deliveries)
+
+	case err := <-errorChan:
+		api.writeError(w, r, CodeInternal, fmt.Errorf("failed to list webhook deliveries: %w", err))
+		return
+	}
+}
+
+// Обработчик для немедленного повтора доставки события (admin). В ответе
+// возвращается доставка с результатом попытки.
+func (api *API) RetryWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		api.writeError(w, r, CodeInvalidID, err)
+		return
+	}
+
+	ctx := r.Context()
+
+	resultChan := make(chan storage.WebhookDelivery)
+	errorChan := make(chan error)
+
+	go func() {
+		delivery, err := api.webhooks.Redeliver(ctx, id)
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		resultChan <- delivery
+	}()
+
+	select {
+	case delivery := <-resultChan:
+		respond(w, http.StatusOK, delivery)
+
+	case err := <-errorChan:
+		if errors.Is(err, storage.ErrNotFound) {
+			api.writeError(w, r, CodeWebhookDeliveryNotFound, err)
+			return
+		}
+		api.writeError(w, r, CodeInternal, fmt.Errorf("failed to retry webhook delivery: %w", err))
+		return
+	}
+}
+
+// Обработчик для получения числа ожидающих и неудавшихся доставок по
+// получателям (admin).
+func (api *API) GetWebhookMetrics(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	resultChan := make(chan []storage.WebhookTargetStats)
+	errorChan := make(chan error)
+
+	go func() {
+		stats, err := api.db.WebhookStats(ctx)
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		resultChan <- stats
+	}()
+
+	select {
+	case stats := <-resultChan:
+		respond(w, http.StatusOK, stats)
+
+	case err := <-errorChan:
+		api.writeError(w, r, CodeInternal, fmt.Errorf("failed to get webhook metrics: %w", err))
+		return
+	}
+}
@@ -0,0 +1,217 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"gorefer.go/pkg/storage"
+)
+
+// Ограничение запросов данных виджета на один код по умолчанию
+const (
+	defaultWidgetMaxRequests = 600
+	defaultWidgetWindow      = time.Minute
+)
+
+// Данные кода хранятся в памяти и в кэше браузеров и CDN партнеров не
+// дольше этого времени
+const (
+	widgetCacheTTL = time.Minute
+	widgetMaxAge   = 5 * time.Minute
+)
+
+// Состояния виджета
+const (
+	WidgetActive  = "active"
+	WidgetExpired = "expired"
+	WidgetUsedUp  = "used_up"
+)
+
+// Widget - параметры виджета "присоединяйтесь по моей ссылке" на сайтах
+// партнеров.
+type Widget struct {
+	// Origins - сайты партнеров, которым браузер разрешит читать ответ;
+	// "*" - любые
+	Origins     []string
+	BaseURL     string        // внешний адрес сервиса для ссылки регистрации
+	MaxRequests int           // запросов на один код за Window; 0 - 600
+	Window      time.Duration // 0 - минута
+}
+
+// WidgetData - данные виджета. Поля подобраны так, чтобы ответ можно было
+// показывать на чужом сайте: ни email, ни идентификаторов.
+type WidgetData struct {
+	State         string    `json:"state"`
+	DisplayName   string    `json:"display_name"`
+	RemainingUses *int      `json:"remaining_uses"` // nil - без ограничения
+	ExpiresAt     time.Time `json:"expires_at"`
+	// пусто, если по коду уже нельзя зарегистрироваться
+	SignupURL string `json:"signup_url,omitempty"`
+}
+
+// WithWidget включает маршрут GET /widget/{code}. Без этого параметра
+// маршрут не регистрируется.
+func WithWidget(wd Widget) Option {
+	return func(a *API) {
+		if wd.MaxRequests <= 0 {
+			wd.MaxRequests = defaultWidgetMaxRequests
+		}
+		if wd.Window <= 0 {
+			wd.Window = defaultWidgetWindow
+		}
+		a.widget = &wd
+		a.widgetLimiter = newWindowLimiter(wd.MaxRequests, wd.Window)
+	}
+}
+
+// widgetCache - данные виджетов по коду. Безопасен для конкурентного
+// использования.
+type widgetCache struct {
+	mu      sync.Mutex
+	entries map[string]widgetEntry
+}
+
+type widgetEntry struct {
+	details   storage.ReferralCodeDetails
+	fetchedAt time.Time
+}
+
+func (c *widgetCache) get(code string, now time.Time) (storage.ReferralCodeDetails, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[code]
+	if !ok || now.Sub(e.fetchedAt) >= widgetCacheTTL {
+		return storage.ReferralCodeDetails{}, false
+	}
+	return e.details, true
+}
+
+// put сохраняет данные кода и удаляет устаревшие.
+func (c *widgetCache) put(code string, details storage.ReferralCodeDetails, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = map[string]widgetEntry{}
+	}
+	if len(c.entries) >= limiterSweepSize {
+		for k, e := range c.entries {
+			if now.Sub(e.fetchedAt) >= widgetCacheTTL {
+				delete(c.entries, k)
+			}
+		}
+	}
+	c.entries[code] = widgetEntry{details: details, fetchedAt: now}
+}
+
+// widgetData составляет данные виджета по коду. Отозванный или
+// незанятый код - ErrNotFound, как будто его нет.
+func (api *API) widgetData(r *http.Request, d storage.ReferralCodeDetails, now time.Time) (WidgetData, error) {
+	if d.Status != storage.CodeStatusActive || d.Revoked() || d.OwnerUsername == "" {
+		return WidgetData{}, storage.ErrNotFound
+	}
+	data := WidgetData{State: WidgetActive, DisplayName: d.OwnerUsername, ExpiresAt: d.ExpiresAt}
+	if d.MaxUses != nil {
+		remaining := max(*d.MaxUses-d.Uses, 0)
+		data.RemainingUses = &remaining
+		if remaining == 0 {
+			data.State = WidgetUsedUp
+		}
+	}
+	if d.Expired(now) {
+		data.State = WidgetExpired
+	}
+	if data.State == WidgetActive {
+		data.SignupURL = strings.TrimRight(api.widget.BaseURL, "/") + basePath(r.Context()) + "/r/" + d.Code
+	}
+	return data, nil
+}
+
+// widgetCORS разрешает сайтам партнеров из Widget.Origins читать ответы
+// виджета.
+func (api *API) widgetCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+		if origin := r.Header.Get("Origin"); origin != "" {
+			for _, allowed := range api.widget.Origins {
+				if allowed == "*" || strings.EqualFold(allowed, origin) {
+					w.Header().Set("Access-Control-Allow-Origin", origin)
+					break
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Обработчик предварительного запроса CORS к /widget/{code}
+func (api *API) WidgetPreflight(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Max-Age", "86400")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Обработчик данных виджета реферального кода для сайтов партнеров
+// (/widget/{code}). Токен не нужен; ответ кэшируется браузером и CDN.
+// Для истекшего или исчерпанного кода возвращается 410 с соответствующим
+// состоянием, чтобы виджет показал его вместо ссылки.
+func (api *API) GetWidget(w http.ResponseWriter, r *http.Request) {
+	code := chi.URLParam(r, "code")
+
+	if retryAfter, blocked := api.widgetLimiter.blocked(code); blocked {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		api.writeError(w, r, CodeWidgetRateLimited, fmt.Errorf("too many widget requests for %s", code))
+		return
+	}
+	api.widgetLimiter.add(code)
+
+	ctx := r.Context()
+	now := time.Now()
+
+	resultChan := make(chan WidgetData)
+	errorChan := make(chan error)
+
+	go func() {
+		details, ok := api.widgets.get(code, now)
+		if !ok {
+			var err error
+			details, err = api.db.GetReferralCodeDetails(ctx, code)
+			if err != nil {
+				errorChan <- err
+				return
+			}
+			api.widgets.put(code, details, now)
+		}
+		data, err := api.widgetData(r, details, now)
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		resultChan <- data
+	}()
+
+	select {
+	case data := <-resultChan:
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(widgetMaxAge.Seconds())))
+		status := http.StatusOK
+		if data.State != WidgetActive {
+			status = http.StatusGone
+		}
+		respond(w, status, data)
+
+	case err := <-errorChan:
+		if errors.Is(err, storage.ErrNotFound) {
+			api.writeError(w, r, CodeReferralCodeNotFound, err)
+			return
+		}
+		api.writeError(w, r, CodeInternal, fmt.Errorf("failed to get widget data: %w", err))
+	}
+}
@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// ErrActionTokenInvalid - токен действия поврежден, подписан другим
+// ключом или выпущен для другого действия
+var ErrActionTokenInvalid = errors.New("недействительная ссылка действия")
+
+// ErrActionTokenExpired - срок действия токена истек
+var ErrActionTokenExpired = errors.New("срок действия ссылки истек")
+
+// ActionToken - подписанное действие из письма, которое выполняется по
+// ссылке без входа. Подпись покрывает пользователя, действие, объект,
+// срок и случайный Nonce; однократность обеспечивает вызывающий, сохраняя
+// использованные Nonce до ExpiresAt.
+type ActionToken struct {
+	UserID    int    `json:"uid"`
+	Action    string `json:"act"`
+	Subject   int    `json:"sub,omitempty"` // объект действия, например ID кода; 0 - нет
+	ExpiresAt int64  `json:"exp"`
+	Nonce     string `json:"nonce"`
+}
+
+// Expiry возвращает срок действия токена.
+func (t ActionToken) Expiry() time.Time {
+	return time.Unix(t.ExpiresAt, 0)
+}
+
+// NewActionToken выпускает токен действия action над subject для
+// пользователя userID, действующий до expiresAt, и подписывает его
+// текущим ключом из Keys.
+func NewActionToken(userID int, action string, subject int, expiresAt time.Time) (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(ActionToken{
+		UserID:    userID,
+		Action:    action,
+		Subject:   subject,
+		ExpiresAt: expiresAt.Unix(),
+		Nonce:     base64.RawURLEncoding.EncodeToString(nonce),
+	})
+	if err != nil {
+		return "", err
+	}
+	return SignValue(actionPurpose(action), base64.RawURLEncoding.EncodeToString(b)), nil
+}
+
+// ParseActionToken проверяет подпись токена действия action и его срок
+// на момент now. Токен другого действия не проходит проверку.
+func ParseActionToken(token, action string, now time.Time) (ActionToken, error) {
+	payload, ok := VerifyValue(actionPurpose(action), token)
+	if !ok {
+		return ActionToken{}, ErrActionTokenInvalid
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return ActionToken{}, ErrActionTokenInvalid
+	}
+	var t ActionToken
+	if err := json.Unmarshal(b, &t); err != nil || t.Action != action || t.UserID == 0 || t.Nonce == "" {
+		return ActionToken{}, ErrActionTokenInvalid
+	}
+	if !now.Before(t.Expiry()) {
+		return ActionToken{}, ErrActionTokenExpired
+	}
+	return t, nil
+}
+
+// actionPurpose - назначение подписи токена действия, см. SignValue
+func actionPurpose(action string) string {
+	return "action:" + action
+}
@@ -0,0 +1,64 @@
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestActionToken(t *testing.T) {
+	useKeys(t, func() ([]byte, error) { return []byte("secret"), nil })
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	token, err := NewActionToken(7, "extend_code", 42, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ParseActionToken(token, "extend_code", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.UserID != 7 || got.Subject != 42 || got.Action != "extend_code" || got.Nonce == "" || !got.Expiry().Equal(now.Add(time.Hour)) {
+		t.Errorf("token = %+v", got)
+	}
+
+	// подмена пользователя в теле при сохранении подписи
+	payload, rest, _ := strings.Cut(token, ".")
+	b, _ := base64.RawURLEncoding.DecodeString(payload)
+	var forged ActionToken
+	if err := json.Unmarshal(b, &forged); err != nil {
+		t.Fatal(err)
+	}
+	forged.UserID = 8
+	b, _ = json.Marshal(forged)
+	tampered := base64.RawURLEncoding.EncodeToString(b) + "." + rest
+
+	tests := []struct {
+		name    string
+		token   string
+		action  string
+		now     time.Time
+		wantErr error
+	}{
+		{"Tampered payload", tampered, "extend_code", now, ErrActionTokenInvalid},
+		{"Other action", token, "delete_code", now, ErrActionTokenInvalid},
+		{"Malformed", "garbage", "extend_code", now, ErrActionTokenInvalid},
+		{"Expired", token, "extend_code", now.Add(time.Hour), ErrActionTokenExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseActionToken(tt.token, tt.action, tt.now); !errors.Is(err, tt.wantErr) {
+				t.Errorf("ParseActionToken() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// другой секрет подпись не принимает
+	useKeys(t, func() ([]byte, error) { return []byte("other"), nil })
+	if _, err := ParseActionToken(token, "extend_code", now); !errors.Is(err, ErrActionTokenInvalid) {
+		t.Errorf("ParseActionToken() with another secret error = %v, want ErrActionTokenInvalid", err)
+	}
+}
@@ -22,7 +22,7 @@ func CheckPasswordHash(password, hash string) error {
 }
 
 // Обработчик для регистрации пользователя
-func RegisterHandler(db storage.DBInterface) http.HandlerFunc {
+func RegisterHandler(db storage.UserStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var user storage.User
 		if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
@@ -41,7 +41,8 @@ func RegisterHandler(db storage.DBInterface) http.HandlerFunc {
 		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 		defer cancel()
 
-		if _, err := db.CreateUser(ctx, user); err != nil {
+		params := storage.CreateUserParams{User: user, UserAgent: r.UserAgent(), Source: r.URL.Query().Get("source")}
+		if _, err := db.CreateUser(ctx, params); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
@@ -51,7 +52,7 @@ func RegisterHandler(db storage.DBInterface) http.HandlerFunc {
 }
 
 // Обработчик для аутентификации пользователя
-func LoginHandler(db storage.DBInterface) http.HandlerFunc {
+func LoginHandler(db storage.UserStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var user storage.User
 		if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
@@ -74,7 +75,7 @@ func LoginHandler(db storage.DBInterface) http.HandlerFunc {
 			return
 		}
 
-		token, err := GenerateToken(existingUser.ID, existingUser.Username)
+		token, err := GenerateToken(existingUser.ID, existingUser.Username, existingUser.Role)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -0,0 +1,64 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"gorefer.go/pkg/storage"
+)
+
+func TestLoginHandler(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// обработчику достаточно хранилища пользователей
+	users := storage.NewMockUserStore(ctrl)
+	useKeys(t, func() ([]byte, error) { return []byte("secret"), nil })
+
+	hash, err := HashPassword("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		payload      string
+		expectedCode int
+		mockSetup    func()
+	}{
+		{
+			name:         "Successful login",
+			payload:      `{"email":"test@example.com","password":"password"}`,
+			expectedCode: http.StatusOK,
+			mockSetup: func() {
+				users.EXPECT().GetUserByEmail(gomock.Any(), "test@example.com").
+					Return(storage.User{ID: 1, Username: "test", Password: hash}, nil)
+			},
+		},
+		{
+			name:         "Wrong password",
+			payload:      `{"email":"test@example.com","password":"wrong"}`,
+			expectedCode: http.StatusUnauthorized,
+			mockSetup: func() {
+				users.EXPECT().GetUserByEmail(gomock.Any(), "test@example.com").
+					Return(storage.User{ID: 1, Username: "test", Password: hash}, nil)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.mockSetup()
+
+			rr := httptest.NewRecorder()
+			LoginHandler(users).ServeHTTP(rr, httptest.NewRequest("POST", "/login", strings.NewReader(tt.payload)))
+
+			if rr.Code != tt.expectedCode {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, tt.expectedCode)
+			}
+		})
+	}
+}
@@ -1,66 +1,179 @@
 package auth
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
-	"os"
+	"sync/atomic"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
 )
 
-// JWTSecret - секретный ключ для подписи токенов (загружаем из переменной окружения)
-var JWTSecret = []byte(os.Getenv("JWT_SECRET"))
+// Время жизни токена входа от имени пользователя
+const impersonationTTL = 15 * time.Minute
 
 // CustomClaims включает стандартные и дополнительные поля
 type CustomClaims struct {
 	UserID   int    `json:"user_id"`
 	Username string `json:"username"`
+	Role     string `json:"role"`
+	Act      *Actor `json:"act,omitempty"` // администратор, действующий от имени пользователя
 	jwt.StandardClaims
+
+	// StaleKey - токен подписан ключом, выведенным из обращения, и
+	// принимается только до конца периода ротации. Заполняется ValidateToken.
+	StaleKey bool `json:"-"`
+}
+
+// Actor - администратор, выполнивший вход от имени пользователя
+type Actor struct {
+	UserID   int    `json:"user_id"`
+	Username string `json:"sub"`
+}
+
+// Impersonated сообщает, выпущен ли токен для входа от имени пользователя.
+func (c *CustomClaims) Impersonated() bool {
+	return c.Act != nil
+}
+
+// ActorID возвращает ID того, кто фактически выполняет действие:
+// администратора при входе от имени пользователя, иначе самого пользователя.
+func (c *CustomClaims) ActorID() int {
+	if c.Act != nil {
+		return c.Act.UserID
+	}
+	return c.UserID
 }
 
 // Создание JWT токена с кастомными утверждениями
-func GenerateToken(userID int, username string) (string, error) {
-	expirationTime := time.Now().Add(24 * time.Hour)
-
-	claims := &CustomClaims{
-		UserID:   userID,
-		Username: username,
-		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: expirationTime.Unix(),
-			IssuedAt:  time.Now().Unix(),
-			Subject:   username,
-		},
+func GenerateToken(userID int, username, role string) (string, error) {
+	return signToken(&CustomClaims{UserID: userID, Username: username, Role: role}, tokenTTL)
+}
+
+// Создание короткоживущего токена администратора act для входа от имени
+// пользователя
+func GenerateImpersonationToken(userID int, username, role string, act Actor) (string, error) {
+	return signToken(&CustomClaims{UserID: userID, Username: username, Role: role, Act: &act}, impersonationTTL)
+}
+
+// Кодировка частей JWT: base64url без дополнения
+var segmentEncoding = base64.RawURLEncoding
+
+// Заголовок JWT. Поля идут по алфавиту, как при кодировании заголовка
+// jwt-go (map), поэтому токены побайтно совпадают с jwt.SignedString.
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Typ string `json:"typ"`
+}
+
+// Закодированный заголовок для ключа kid
+type headerSegment struct {
+	kid     string
+	encoded string
+}
+
+// Заголовок последнего ключа подписи: меняется только при ротации
+var lastHeader atomic.Pointer[headerSegment]
+
+// encodedHeader возвращает закодированный заголовок токена с ключом kid.
+func encodedHeader(kid string) (string, error) {
+	if h := lastHeader.Load(); h != nil && h.kid == kid {
+		return h.encoded, nil
+	}
+	b, err := json.Marshal(tokenHeader{Alg: jwt.SigningMethodHS256.Alg(), Kid: kid, Typ: "JWT"})
+	if err != nil {
+		return "", err
 	}
+	h := &headerSegment{kid: kid, encoded: segmentEncoding.EncodeToString(b)}
+	lastHeader.Store(h)
+	return h.encoded, nil
+}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(JWTSecret)
+// signToken подписывает утверждения текущим ключом (HS256). Токен
+// собирается в одном буфере без промежуточных строк jwt-go: вход
+// выполняется часто, и выпуск токена заметен в профиле аллокаций.
+func signToken(claims *CustomClaims, ttl time.Duration) (string, error) {
+	now := time.Now()
+	claims.StandardClaims = jwt.StandardClaims{
+		ExpiresAt: now.Add(ttl).Unix(),
+		IssuedAt:  now.Unix(),
+		Subject:   claims.Username,
+	}
+
+	kid, secret := Keys.Current()
+	header, err := encodedHeader(kid)
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, 0, len(header)+segmentEncoding.EncodedLen(len(payload))+segmentEncoding.EncodedLen(sha256.Size)+2)
+	buf = append(buf, header...)
+	buf = append(buf, '.')
+	buf = segmentEncoding.AppendEncode(buf, payload)
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(buf)
+	var sum [sha256.Size]byte
+	buf = append(buf, '.')
+	buf = segmentEncoding.AppendEncode(buf, mac.Sum(sum[:0]))
+	return string(buf), nil
 }
 
 // Проверка JWT токена с кастомными утверждениями
-func ValidateToken(tokenString string) (string, error) {
+func ValidateToken(tokenString string) (*CustomClaims, error) {
+	keys := Keys
+	var (
+		kid   string
+		stale bool
+	)
 	token, err := jwt.ParseWithClaims(tokenString, &CustomClaims{}, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, errors.New("недопустимый метод подписи")
 		}
-		return JWTSecret, nil
+		kid, _ = token.Header["kid"].(string)
+		secret, retired, err := keys.key(kid)
+		stale = retired
+		return secret, err
 	})
 
 	if err != nil {
 		if err == jwt.ErrSignatureInvalid {
-			return "", errors.New("недействительная подпись токена")
+			return nil, errors.New("недействительная подпись токена")
 		}
-		return "", errors.New("ошибка разбора токена: " + err.Error())
+		return nil, errors.New("ошибка разбора токена: " + err.Error())
 	}
 
 	claims, ok := token.Claims.(*CustomClaims)
 	if !ok || !token.Valid {
-		return "", errors.New("недействительный токен")
+		return nil, errors.New("недействительный токен")
 	}
 
 	// Проверяем истечение токена
 	if claims.ExpiresAt < time.Now().Unix() {
-		return "", errors.New("токен истек")
+		return nil, errors.New("токен истек")
+	}
+
+	if stale {
+		claims.StaleKey = true
+		keys.countStale(kid)
 	}
+	return claims, nil
+}
 
-	return claims.Username, nil
+// Проверка работоспособности подписи: выпуск и проверка тестового токена
+func SelfCheck() error {
+	token, err := GenerateToken(0, "selfcheck", "")
+	if err != nil {
+		return err
+	}
+	_, err = ValidateToken(token)
+	return err
 }
@@ -0,0 +1,300 @@
+package auth
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// useKeys подменяет хранилище ключей на время теста
+func useKeys(t *testing.T, load KeyLoader) *KeyStore {
+	t.Helper()
+	ks, err := NewKeyStore(load)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := Keys
+	Keys = ks
+	t.Cleanup(func() { Keys = prev })
+	return ks
+}
+
+func TestKeyStore_ReloadKeepsOldTokensValid(t *testing.T) {
+	secret := "first"
+	ks := useKeys(t, func() ([]byte, error) { return []byte(secret), nil })
+
+	oldToken, err := GenerateToken(1, "alice", "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret = "second"
+	if err := ks.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if kid, _ := ks.Current(); kid != keyID([]byte("second")) {
+		t.Fatalf("current key version = %s, want %s", kid, keyID([]byte("second")))
+	}
+
+	newToken, err := GenerateToken(2, "bob", "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, token := range map[string]string{"old": oldToken, "new": newToken} {
+		if _, err := ValidateToken(token); err != nil {
+			t.Errorf("ValidateToken(%s) error = %v", name, err)
+		}
+	}
+
+	// повторная загрузка того же секрета не создает новую версию
+	if err := ks.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := ks.KeyStats(); len(stats) != 2 {
+		t.Errorf("KeyStats() after no-op reload = %+v, want 2 versions", stats)
+	}
+}
+
+// Версия ключа определяется секретом, а не процессом: экземпляры сервиса
+// с одним секретом принимают токены друг друга по kid.
+func TestKeyStore_VersionFromSecret(t *testing.T) {
+	first, err := NewKeyStore(func() ([]byte, error) { return []byte("shared"), nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewKeyStore(func() ([]byte, error) { return []byte("shared"), nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	kid1, _ := first.Current()
+	kid2, _ := second.Current()
+	if kid1 != kid2 || len(kid1) != 16 {
+		t.Errorf("kids = %q, %q, want equal 16-character versions", kid1, kid2)
+	}
+}
+
+func TestKeyStore_FileSecret(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jwt_secret")
+	if err := os.WriteFile(path, []byte("first\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ks := useKeys(t, FileSecret(path))
+	if _, key := ks.Current(); string(key) != "first" {
+		t.Fatalf("secret = %q, want first", key)
+	}
+	oldToken, err := GenerateToken(1, "alice", "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// смена файла подхватывается перезагрузкой без перезапуска
+	if err := os.WriteFile(path, []byte("second"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if kid, _ := ks.Current(); kid != keyID([]byte("second")) {
+		t.Errorf("current key version = %s, want %s", kid, keyID([]byte("second")))
+	}
+	if claims, err := ValidateToken(oldToken); err != nil || !claims.StaleKey {
+		t.Errorf("old token: claims = %+v, error = %v, want valid stale token", claims, err)
+	}
+
+	// пустой файл не заменяет текущий ключ
+	if err := os.WriteFile(path, []byte(" \n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.Reload(); err == nil {
+		t.Error("Reload() with empty secret file error = nil")
+	}
+	if kid, _ := ks.Current(); kid != keyID([]byte("second")) {
+		t.Errorf("current key version after failed reload = %s, want %s", kid, keyID([]byte("second")))
+	}
+}
+
+func TestKeyStore_UnknownVersionRejected(t *testing.T) {
+	useKeys(t, func() ([]byte, error) { return []byte("secret"), nil })
+
+	token, err := GenerateToken(1, "alice", "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// хранилище с другим секретом токен не принимает
+	useKeys(t, func() ([]byte, error) { return []byte("other"), nil })
+	if _, err := ValidateToken(token); err == nil {
+		t.Error("ValidateToken() error = nil, want signature error")
+	}
+}
+
+// Запускать с -race: проверка токенов идет параллельно с перезагрузкой.
+func TestKeyStore_ConcurrentReload(t *testing.T) {
+	var n atomic.Int64
+	ks := useKeys(t, func() ([]byte, error) {
+		return []byte(fmt.Sprintf("secret-%d", n.Add(1))), nil
+	})
+
+	token, err := GenerateToken(1, "alice", "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if _, err := ValidateToken(token); err != nil {
+					t.Errorf("ValidateToken() error = %v", err)
+					return
+				}
+				if _, err := GenerateToken(2, "bob", "user"); err != nil {
+					t.Errorf("GenerateToken() error = %v", err)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 50; i++ {
+		if err := ks.Reload(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+}
+
+func TestKeyStore_RotationGrace(t *testing.T) {
+	secret := "first"
+	ks := useKeys(t, func() ([]byte, error) { return []byte(secret), nil })
+	now := time.Now()
+	ks.now = func() time.Time { return now }
+	ks.SetRotationGrace(time.Hour)
+
+	oldToken, err := GenerateToken(1, "alice", "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims, err := ValidateToken(oldToken); err != nil || claims.StaleKey {
+		t.Fatalf("before rotation: claims = %+v, error = %v, want current key", claims, err)
+	}
+
+	secret = "second"
+	if err := ks.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	newToken, err := GenerateToken(2, "bob", "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name      string
+		elapsed   time.Duration // с момента ротации
+		wantValid bool
+	}{
+		{"Right after rotation", 0, true},
+		{"Within grace", 59 * time.Minute, true},
+		{"After grace", 61 * time.Minute, false},
+	}
+	rotatedAt := now
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			now = rotatedAt.Add(step.elapsed)
+			claims, err := ValidateToken(oldToken)
+			if step.wantValid {
+				if err != nil || !claims.StaleKey {
+					t.Errorf("old token: claims = %+v, error = %v, want valid stale token", claims, err)
+				}
+			} else if err == nil {
+				t.Error("old token accepted after grace window")
+			}
+			// токены нового ключа не затронуты
+			if claims, err := ValidateToken(newToken); err != nil || claims.StaleKey {
+				t.Errorf("new token: claims = %+v, error = %v, want valid current token", claims, err)
+			}
+		})
+	}
+
+	stats := ks.KeyStats()
+	if len(stats) != 2 || stats[0].Current || !stats[1].Current {
+		t.Fatalf("KeyStats() = %+v, want retired version 1 and current version 2", stats)
+	}
+	if stats[0].StaleValidations != 2 || stats[1].StaleValidations != 0 {
+		t.Errorf("stale validations = %d/%d, want 2/0", stats[0].StaleValidations, stats[1].StaleValidations)
+	}
+	if want := rotatedAt.Add(time.Hour).UTC(); stats[0].GraceUntil == nil || !stats[0].GraceUntil.Equal(want) {
+		t.Errorf("grace until = %v, want %v", stats[0].GraceUntil, want)
+	}
+
+	// следующая ротация удаляет ключ с истекшим периодом
+	secret = "third"
+	if err := ks.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := ks.KeyStats(); len(stats) != 2 || stats[0].Version != keyID([]byte("second")) {
+		t.Errorf("KeyStats() after second rotation = %+v, want versions 2 and 3", stats)
+	}
+}
+
+func TestSignToken_MatchesJWTGo(t *testing.T) {
+	secret := "first"
+	ks := useKeys(t, func() ([]byte, error) { return []byte(secret), nil })
+
+	check := func(t *testing.T, claims *CustomClaims) {
+		t.Helper()
+		got, err := signToken(claims, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// тот же токен, выпущенный средствами jwt-go
+		kid, key := ks.Current()
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		token.Header["kid"] = kid
+		want, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("signToken() = %s\nwant %s", got, want)
+		}
+	}
+
+	check(t, &CustomClaims{UserID: 1, Username: "alice", Role: "user"})
+	check(t, &CustomClaims{UserID: 2, Username: "юля \"<&>\"", Role: "admin", Act: &Actor{UserID: 3, Username: "root"}})
+
+	// после ротации заголовок содержит новую версию ключа
+	secret = "second"
+	if err := ks.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	check(t, &CustomClaims{UserID: 1, Username: "alice", Role: "user"})
+}
+
+// BenchmarkGenerateToken измеряет выпуск токена при параллельных входах.
+// Сборка токена в одном буфере вместо jwt.SignedString: 32 -> 10
+// аллокаций и 2.4 КБ -> 1.2 КБ на токен.
+func BenchmarkGenerateToken(b *testing.B) {
+	ks, err := NewKeyStore(func() ([]byte, error) { return []byte("bench-secret"), nil })
+	if err != nil {
+		b.Fatal(err)
+	}
+	prev := Keys
+	Keys = ks
+	b.Cleanup(func() { Keys = prev })
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := GenerateToken(42, "alice", "user"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
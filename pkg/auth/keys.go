@@ -0,0 +1,238 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Время жизни выпускаемых токенов. Ключ, выведенный из обращения раньше
+// этого срока, еще может понадобиться для проверки выпущенных им токенов.
+const tokenTTL = 24 * time.Hour
+
+// KeyLoader возвращает актуальный секрет для подписи токенов.
+type KeyLoader func() ([]byte, error)
+
+// EnvSecret читает секрет из переменной окружения JWT_SECRET. Переменная
+// окружения процесса не меняется, поэтому Reload с этим загрузчиком
+// ключ не сменит; для ротации без перезапуска используется FileSecret.
+func EnvSecret() ([]byte, error) {
+	return []byte(os.Getenv("JWT_SECRET")), nil
+}
+
+// FileSecret возвращает загрузчик, читающий секрет из файла path при
+// каждом вызове. Пробельные символы по краям отбрасываются, пустой файл
+// считается ошибкой.
+func FileSecret(path string) KeyLoader {
+	return func() ([]byte, error) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("чтение секрета подписи: %w", err)
+		}
+		secret := bytes.TrimSpace(data)
+		if len(secret) == 0 {
+			return nil, fmt.Errorf("файл секрета подписи %s пуст", path)
+		}
+		return secret, nil
+	}
+}
+
+// keyID возвращает версию ключа: первые 8 байт SHA-256 секрета в hex.
+// Версия не зависит от процесса, поэтому все экземпляры сервиса с одним
+// секретом выпускают токены с одинаковым kid.
+func keyID(secret []byte) string {
+	sum := sha256.Sum256(secret)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Версия ключа подписи
+type signingKey struct {
+	secret    []byte
+	loadedAt  int       // порядковый номер загрузки, задает порядок в KeyStats
+	retiredAt time.Time // нулевое значение - ключ текущий
+	stale     *atomic.Int64
+}
+
+// KeyStore хранит версионированные ключи подписи токенов. Новые токены
+// подписываются текущим ключом, его версия (см. keyID) записывается в
+// заголовок kid.
+// После Reload токены, подписанные прежними ключами, продолжают проходить
+// проверку в течение периода ротации (по умолчанию - срок жизни токена),
+// такие проверки учитываются в KeyStats. Методы безопасны для
+// конкурентного использования.
+type KeyStore struct {
+	mu      sync.RWMutex
+	load    KeyLoader
+	current string
+	loads   int
+	keys    map[string]signingKey
+	grace   time.Duration
+	now     func() time.Time // подменяется в тестах
+}
+
+// NewKeyStore создает хранилище и загружает первый ключ.
+func NewKeyStore(load KeyLoader) (*KeyStore, error) {
+	ks := &KeyStore{load: load, keys: map[string]signingKey{}, grace: tokenTTL, now: time.Now}
+	if err := ks.Reload(); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// Keys - хранилище ключей, используемое GenerateToken и ValidateToken.
+// По умолчанию секрет берется из JWT_SECRET; при заданном в конфигурации
+// файле секрета хранилище заменяется при запуске.
+var Keys = func() *KeyStore {
+	secret := []byte(os.Getenv("JWT_SECRET"))
+	kid := keyID(secret)
+	return &KeyStore{
+		load:    EnvSecret,
+		current: kid,
+		loads:   1,
+		keys:    map[string]signingKey{kid: {secret: secret, loadedAt: 1, stale: new(atomic.Int64)}},
+		grace:   tokenTTL,
+		now:     time.Now,
+	}
+}()
+
+// SetRotationGrace задает период после Reload, в течение которого токены,
+// подписанные прежним ключом, еще принимаются. Значения вне (0, срок
+// жизни токена] заменяются сроком жизни токена.
+func (ks *KeyStore) SetRotationGrace(d time.Duration) {
+	if d <= 0 || d > tokenTTL {
+		d = tokenTTL
+	}
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.grace = d
+}
+
+// Reload загружает секрет заново. Если секрет изменился, он становится
+// новой версией ключа, а прежний выводится из обращения. Возврат к
+// секрету, еще не вышедшему из периода ротации, снова делает его текущим.
+func (ks *KeyStore) Reload() error {
+	secret, err := ks.load()
+	if err != nil {
+		return err
+	}
+	kid := keyID(secret)
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if kid == ks.current {
+		return nil
+	}
+	now := ks.now()
+	if cur, ok := ks.keys[ks.current]; ok {
+		cur.retiredAt = now
+		ks.keys[ks.current] = cur
+	}
+	ks.loads++
+	key, ok := ks.keys[kid]
+	if !ok {
+		key = signingKey{secret: secret, stale: new(atomic.Int64)}
+	}
+	key.loadedAt, key.retiredAt = ks.loads, time.Time{}
+	ks.current = kid
+	ks.keys[kid] = key
+
+	// ключи, токены которых уже не принимаются
+	for version, key := range ks.keys {
+		if !key.retiredAt.IsZero() && now.Sub(key.retiredAt) > ks.grace {
+			delete(ks.keys, version)
+		}
+	}
+	return nil
+}
+
+// Current возвращает версию и секрет текущего ключа.
+func (ks *KeyStore) Current() (string, []byte) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return ks.current, ks.keys[ks.current].secret
+}
+
+// Key возвращает секрет по версии из заголовка kid. Токены без kid
+// (выпущенные до появления версий) и с числовым kid (выпущенные, когда
+// версия была номером загрузки в процессе) проверяются текущим ключом.
+func (ks *KeyStore) Key(kid string) ([]byte, error) {
+	secret, _, err := ks.key(kid)
+	return secret, err
+}
+
+// key возвращает секрет по версии и сообщает, выведен ли ключ из
+// обращения. Ключ, период ротации которого истек, не возвращается.
+func (ks *KeyStore) key(kid string) (secret []byte, retired bool, err error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	if _, err := strconv.Atoi(kid); kid == "" || err == nil {
+		return ks.keys[ks.current].secret, false, nil
+	}
+	key, ok := ks.keys[kid]
+	if !ok {
+		return nil, false, errors.New("неизвестная версия ключа")
+	}
+	if key.retiredAt.IsZero() {
+		return key.secret, false, nil
+	}
+	if ks.now().Sub(key.retiredAt) > ks.grace {
+		return nil, false, errors.New("ключ выведен из обращения")
+	}
+	return key.secret, true, nil
+}
+
+// countStale учитывает проверку токена, подписанного прежним ключом kid.
+func (ks *KeyStore) countStale(kid string) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	if key, ok := ks.keys[kid]; ok && key.stale != nil {
+		key.stale.Add(1)
+	}
+}
+
+// KeyStat - состояние версии ключа подписи.
+type KeyStat struct {
+	Version          string     `json:"version"`
+	Current          bool       `json:"current"`
+	RetiredAt        *time.Time `json:"retired_at,omitempty"`
+	GraceUntil       *time.Time `json:"grace_until,omitempty"` // после этого момента токены ключа не принимаются
+	StaleValidations int64      `json:"stale_validations"`     // принятых токенов после вывода из обращения
+}
+
+// KeyStats возвращает состояние ключей в порядке их загрузки. Когда
+// счетчик прежнего ключа перестает расти, клиенты перешли на новый.
+func (ks *KeyStore) KeyStats() []KeyStat {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	versions := make([]string, 0, len(ks.keys))
+	for version := range ks.keys {
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return ks.keys[versions[i]].loadedAt < ks.keys[versions[j]].loadedAt
+	})
+
+	stats := make([]KeyStat, 0, len(versions))
+	for _, version := range versions {
+		key := ks.keys[version]
+		st := KeyStat{Version: version, Current: version == ks.current}
+		if !key.retiredAt.IsZero() {
+			retiredAt, graceUntil := key.retiredAt.UTC(), key.retiredAt.Add(ks.grace).UTC()
+			st.RetiredAt, st.GraceUntil = &retiredAt, &graceUntil
+		}
+		if key.stale != nil {
+			st.StaleValidations = key.stale.Load()
+		}
+		stats = append(stats, st)
+	}
+	return stats
+}
@@ -0,0 +1,44 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+)
+
+// SignValue подписывает value текущим ключом из Keys. Результат имеет вид
+// "<value>.<версия ключа>.<HMAC-SHA256>"; value не должно содержать точек.
+// purpose разделяет назначения подписи: значение, подписанное для одной
+// цели, не проходит проверку для другой.
+func SignValue(purpose, value string) string {
+	kid, secret := Keys.Current()
+	return value + "." + kid + "." + valueMAC(secret, purpose, value)
+}
+
+// VerifyValue проверяет подпись SignValue и возвращает исходное значение.
+// Подпись ключом, уже удаленным из Keys, не проходит проверку.
+func VerifyValue(purpose, signed string) (string, bool) {
+	value, kid, ok := strings.Cut(signed, ".")
+	if !ok {
+		return "", false
+	}
+	kid, mac, ok := strings.Cut(kid, ".")
+	if !ok {
+		return "", false
+	}
+	secret, err := Keys.Key(kid)
+	if err != nil || kid == "" {
+		return "", false
+	}
+	if !hmac.Equal([]byte(mac), []byte(valueMAC(secret, purpose, value))) {
+		return "", false
+	}
+	return value, true
+}
+
+func valueMAC(secret []byte, purpose, value string) string {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(purpose + "\x00" + value))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,43 @@
+package auth
+
+import "testing"
+
+func TestSignValue(t *testing.T) {
+	useKeys(t, func() ([]byte, error) { return []byte("secret"), nil })
+	signed := SignValue("attribution", "payload")
+	last := "A"
+	if signed[len(signed)-1] == 'A' {
+		last = "B"
+	}
+
+	tests := []struct {
+		name    string
+		purpose string
+		signed  string
+		want    string
+		wantOK  bool
+	}{
+		{"Valid", "attribution", signed, "payload", true},
+		{"Other purpose", "session", signed, "", false},
+		{"Tampered value", "attribution", "payloaD" + signed[len("payload"):], "", false},
+		{"Tampered signature", "attribution", signed[:len(signed)-1] + last, "", false},
+		{"Missing key version", "attribution", "payload..mac", "", false},
+		{"Unknown key version", "attribution", "payload.9.mac", "", false},
+		{"Malformed", "attribution", "payload", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := VerifyValue(tt.purpose, tt.signed)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("VerifyValue() = %q, %v, want %q, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+
+	// другой секрет подпись не принимает
+	useKeys(t, func() ([]byte, error) { return []byte("other"), nil })
+	if _, ok := VerifyValue("attribution", signed); ok {
+		t.Error("VerifyValue() with another secret ok = true, want false")
+	}
+}
@@ -0,0 +1,122 @@
+// Пакет fraud периодически анализирует реферальную активность и отмечает
+// рефереров с подозрительными шаблонами регистраций для ручной проверки.
+package fraud
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"gorefer.go/pkg/storage"
+)
+
+// Причины отметки реферера
+const (
+	ReasonVelocity = "velocity" // слишком много регистраций за окно
+	ReasonSubnet   = "subnet"   // регистрации сосредоточены в одной подсети
+)
+
+// Thresholds - пороги срабатывания эвристик.
+type Thresholds struct {
+	MaxSignups       int           // допустимое число регистраций реферера за Window
+	MaxSubnetSignups int           // допустимое число регистраций из одной подсети за Window
+	Window           time.Duration // окно анализа
+	Interval         time.Duration // период запуска анализа
+}
+
+// Пороги по умолчанию, если конфигурация их не задает.
+var DefaultThresholds = Thresholds{
+	MaxSignups:       50,
+	MaxSubnetSignups: 5,
+	Window:           24 * time.Hour,
+	Interval:         time.Hour,
+}
+
+// withFallback подставляет значения по умолчанию вместо незаданных.
+func (t Thresholds) withFallback() Thresholds {
+	if t.MaxSignups <= 0 {
+		t.MaxSignups = DefaultThresholds.MaxSignups
+	}
+	if t.MaxSubnetSignups <= 0 {
+		t.MaxSubnetSignups = DefaultThresholds.MaxSubnetSignups
+	}
+	if t.Window <= 0 {
+		t.Window = DefaultThresholds.Window
+	}
+	if t.Interval <= 0 {
+		t.Interval = DefaultThresholds.Interval
+	}
+	return t
+}
+
+// Evaluate применяет эвристики к активности реферера. Оценка - сумма
+// превышений порогов в разах; ok сообщает, сработала ли хотя бы одна.
+func Evaluate(a storage.ReferrerActivity, t Thresholds) (flag storage.ReferrerFlag, ok bool) {
+	t = t.withFallback()
+	flag.ReferrerID = a.ReferrerID
+	if a.Signups > t.MaxSignups {
+		flag.Score += float64(a.Signups) / float64(t.MaxSignups)
+		flag.Reasons = append(flag.Reasons, fmt.Sprintf("%s: %d signups in %s", ReasonVelocity, a.Signups, t.Window))
+	}
+	if a.SubnetSignups > t.MaxSubnetSignups {
+		flag.Score += float64(a.SubnetSignups) / float64(t.MaxSubnetSignups)
+		flag.Reasons = append(flag.Reasons, fmt.Sprintf("%s: %d signups from %s", ReasonSubnet, a.SubnetSignups, a.TopSubnet))
+	}
+	return flag, len(flag.Reasons) > 0
+}
+
+// Analyzer - фоновый компонент, отмечающий подозрительных рефереров.
+// Подходит для api.API.Register.
+type Analyzer struct {
+	store      storage.FraudStore
+	thresholds Thresholds
+	now        func() time.Time
+}
+
+// NewAnalyzer создает анализатор с порогами t.
+func NewAnalyzer(store storage.FraudStore, t Thresholds) *Analyzer {
+	return &Analyzer{store: store, thresholds: t.withFallback(), now: time.Now}
+}
+
+// Run запускает анализ сразу и затем каждые Interval до отмены ctx.
+func (a *Analyzer) Run(ctx context.Context) {
+	ticker := time.NewTicker(a.thresholds.Interval)
+	defer ticker.Stop()
+	for {
+		if n, err := a.Analyze(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Ошибка анализа реферальной активности: %v", err)
+		} else if n > 0 {
+			log.Printf("Отмечено подозрительных рефереров: %d", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Analyze выполняет один проход анализа и возвращает число отмеченных
+// рефереров.
+func (a *Analyzer) Analyze(ctx context.Context) (int, error) {
+	activity, err := a.store.GetReferrerActivity(ctx, a.now().Add(-a.thresholds.Window))
+	if err != nil {
+		return 0, err
+	}
+	flagged := 0
+	for _, act := range activity {
+		flag, ok := Evaluate(act, a.thresholds)
+		if !ok {
+			continue
+		}
+		if err := a.store.FlagReferrer(ctx, flag); err != nil {
+			return flagged, fmt.Errorf("реферер %d: %w", act.ReferrerID, err)
+		}
+		flagged++
+	}
+	return flagged, nil
+}
@@ -0,0 +1,116 @@
+package fraud
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+
+	"gorefer.go/pkg/storage"
+)
+
+func TestEvaluate(t *testing.T) {
+	th := Thresholds{MaxSignups: 10, MaxSubnetSignups: 3, Window: time.Hour}
+
+	tests := []struct {
+		name        string
+		activity    storage.ReferrerActivity
+		wantFlag    bool
+		wantReasons int
+		wantScore   float64
+	}{
+		{
+			name:     "normal activity",
+			activity: storage.ReferrerActivity{ReferrerID: 1, Signups: 5, TopSubnet: "10.0.0.0/24", SubnetSignups: 2},
+		},
+		{
+			name:        "signup burst from different networks",
+			activity:    storage.ReferrerActivity{ReferrerID: 2, Signups: 20, TopSubnet: "10.0.0.0/24", SubnetSignups: 1},
+			wantFlag:    true,
+			wantReasons: 1,
+			wantScore:   2,
+		},
+		{
+			name:        "few signups from one subnet",
+			activity:    storage.ReferrerActivity{ReferrerID: 3, Signups: 6, TopSubnet: "192.0.2.0/24", SubnetSignups: 6},
+			wantFlag:    true,
+			wantReasons: 1,
+			wantScore:   2,
+		},
+		{
+			name:        "burst from one subnet",
+			activity:    storage.ReferrerActivity{ReferrerID: 4, Signups: 30, TopSubnet: "192.0.2.0/24", SubnetSignups: 30},
+			wantFlag:    true,
+			wantReasons: 2,
+			wantScore:   13,
+		},
+		{
+			name:     "at thresholds",
+			activity: storage.ReferrerActivity{ReferrerID: 5, Signups: 10, TopSubnet: "192.0.2.0/24", SubnetSignups: 3},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flag, ok := Evaluate(tt.activity, th)
+			if ok != tt.wantFlag {
+				t.Fatalf("Evaluate() ok = %v, want %v", ok, tt.wantFlag)
+			}
+			if !ok {
+				return
+			}
+			if flag.ReferrerID != tt.activity.ReferrerID {
+				t.Errorf("ReferrerID = %d, want %d", flag.ReferrerID, tt.activity.ReferrerID)
+			}
+			if len(flag.Reasons) != tt.wantReasons {
+				t.Errorf("Reasons = %v, want %d reasons", flag.Reasons, tt.wantReasons)
+			}
+			if flag.Score != tt.wantScore {
+				t.Errorf("Score = %v, want %v", flag.Score, tt.wantScore)
+			}
+		})
+	}
+}
+
+func TestAnalyzer_Analyze(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	store := storage.NewMockDBInterface(ctrl)
+	store.EXPECT().GetReferrerActivity(gomock.Any(), now.Add(-24*time.Hour)).Return([]storage.ReferrerActivity{
+		{ReferrerID: 1, Signups: 3, TopSubnet: "10.0.0.0/24", SubnetSignups: 1},
+		{ReferrerID: 2, Signups: 8, TopSubnet: "192.0.2.0/24", SubnetSignups: 8},
+	}, nil)
+	store.EXPECT().FlagReferrer(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, flag storage.ReferrerFlag) error {
+		if flag.ReferrerID != 2 {
+			t.Errorf("flagged referrer %d, want 2", flag.ReferrerID)
+		}
+		return nil
+	})
+
+	a := NewAnalyzer(store, Thresholds{})
+	a.now = func() time.Time { return now }
+	n, err := a.Analyze(context.Background())
+	if err != nil {
+		t.Fatalf("Analyze() error = %v", err)
+	}
+	if n != 1 {
+		t.Errorf("Analyze() flagged = %d, want 1", n)
+	}
+}
+
+func TestAnalyzer_AnalyzeError(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	dbErr := errors.New("db down")
+	store := storage.NewMockDBInterface(ctrl)
+	store.EXPECT().GetReferrerActivity(gomock.Any(), gomock.Any()).Return(nil, dbErr)
+
+	if _, err := NewAnalyzer(store, Thresholds{}).Analyze(context.Background()); !errors.Is(err, dbErr) {
+		t.Errorf("Analyze() error = %v, want %v", err, dbErr)
+	}
+}
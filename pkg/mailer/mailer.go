@@ -0,0 +1,173 @@
+// Пакет mailer отправляет письма через SMTP-сервер и собирает их по
+// шаблонам, см. Templates.
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+)
+
+// ErrHeaderInjection - адрес или тема письма содержат перевод строки.
+var ErrHeaderInjection = errors.New("недопустимый перевод строки в заголовке письма")
+
+// Message - письмо: тема, текст, необязательная HTML-версия и вложения.
+type Message struct {
+	Subject     string
+	Text        string
+	HTML        string // пустая строка - только текст
+	Attachments []Attachment
+}
+
+// Attachment - файл, вложенный в письмо
+type Attachment struct {
+	Filename    string
+	ContentType string // например "text/csv; charset=utf-8"
+	Data        []byte
+}
+
+// Длина строки base64 во вложениях по RFC 2045
+const base64LineLength = 76
+
+// SMTP отправляет письма через SMTP-сервер Addr (host:port). Если
+// Username пуст, аутентификация не выполняется.
+type SMTP struct {
+	Addr     string
+	From     string
+	Username string
+	Password string
+}
+
+// Send отправляет письмо msg. net/smtp не поддерживает отмену, поэтому
+// ctx проверяется только перед отправкой.
+func (m SMTP) Send(ctx context.Context, to string, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	raw, err := message(m.From, to, msg)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if m.Username != "" {
+		host, _, err := net.SplitHostPort(m.Addr)
+		if err != nil {
+			return fmt.Errorf("адрес SMTP-сервера %q: %w", m.Addr, err)
+		}
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+	return smtp.SendMail(m.Addr, auth, m.From, []string{to}, raw)
+}
+
+// message собирает письмо в формате RFC 5322. Тема кодируется по RFC 2047.
+// Письмо с HTML-версией отправляется как multipart/alternative, письмо с
+// вложениями - как multipart/mixed, первая часть которого - текст письма.
+func message(from, to string, msg Message) ([]byte, error) {
+	for _, h := range []string{from, to, msg.Subject} {
+		if strings.ContainsAny(h, "\r\n") {
+			return nil, ErrHeaderInjection
+		}
+	}
+	var b strings.Builder
+	b.WriteString("From: " + from + "\r\n")
+	b.WriteString("To: " + to + "\r\n")
+	b.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", msg.Subject) + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+
+	contentType, body, err := messageBody(msg)
+	if err != nil {
+		return nil, err
+	}
+	if len(msg.Attachments) == 0 {
+		b.WriteString("Content-Type: " + contentType + "\r\n")
+		b.WriteString("\r\n")
+		b.Write(body)
+		return []byte(b.String()), nil
+	}
+
+	var mixed bytes.Buffer
+	mw := multipart.NewWriter(&mixed)
+	w, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {contentType}})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	for _, a := range msg.Attachments {
+		if strings.ContainsAny(a.Filename+a.ContentType, "\r\n") {
+			return nil, ErrHeaderInjection
+		}
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {a.ContentType},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": a.Filename})},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		encoded := base64.StdEncoding.EncodeToString(a.Data)
+		for len(encoded) > 0 {
+			n := min(len(encoded), base64LineLength)
+			if _, err := io.WriteString(w, encoded[:n]+"\r\n"); err != nil {
+				return nil, err
+			}
+			encoded = encoded[n:]
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	b.WriteString("Content-Type: multipart/mixed; boundary=" + mw.Boundary() + "\r\n")
+	b.WriteString("\r\n")
+	b.Write(mixed.Bytes())
+	return []byte(b.String()), nil
+}
+
+// messageBody возвращает Content-Type и тело письма без вложений.
+func messageBody(msg Message) (string, []byte, error) {
+	if msg.HTML == "" {
+		return "text/plain; charset=UTF-8", []byte(crlf(msg.Text)), nil
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, part := range []struct{ contentType, content string }{
+		{"text/plain; charset=UTF-8", msg.Text},
+		{"text/html; charset=UTF-8", msg.HTML},
+	} {
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return "", nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(crlf(part.content))); err != nil {
+			return "", nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return "", nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return "", nil, err
+	}
+	return "multipart/alternative; boundary=" + mw.Boundary(), body.Bytes(), nil
+}
+
+// crlf заменяет переводы строк на CRLF.
+func crlf(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "\r\n", "\n"), "\n", "\r\n")
+}
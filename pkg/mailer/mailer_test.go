@@ -0,0 +1,141 @@
+package mailer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func TestMessage(t *testing.T) {
+	msg, err := message("noreply@example.com", "alice@example.com", Message{Subject: "Вход в gorefer", Text: "line1\nline2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"To: alice@example.com\r\n",
+		"Subject: =?utf-8?q?",
+		"\r\n\r\nline1\r\nline2",
+	} {
+		if !strings.Contains(string(msg), want) {
+			t.Errorf("message() = %q, want it to contain %q", msg, want)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		to      string
+		subject string
+	}{
+		{"Recipient", "alice@example.com\r\nBcc: mallory@example.com", "subject"},
+		{"Subject", "alice@example.com", "subject\nBcc: mallory@example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := message("noreply@example.com", tt.to, Message{Subject: tt.subject, Text: "body"}); !errors.Is(err, ErrHeaderInjection) {
+				t.Errorf("message() error = %v, want ErrHeaderInjection", err)
+			}
+		})
+	}
+}
+
+func TestMessage_Alternative(t *testing.T) {
+	raw, err := message("noreply@example.com", "alice@example.com", Message{Subject: "subject", Text: "текст", HTML: "<p>текст</p>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("Content-Type = %q, want multipart/alternative", m.Header.Get("Content-Type"))
+	}
+
+	mr := multipart.NewReader(m.Body, params["boundary"])
+	var parts []string
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		// NextPart снимает quoted-printable
+		b, err := io.ReadAll(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, strings.SplitN(p.Header.Get("Content-Type"), ";", 2)[0]+" "+string(b))
+	}
+	want := []string{"text/plain текст", "text/html <p>текст</p>"}
+	if strings.Join(parts, "|") != strings.Join(want, "|") {
+		t.Errorf("parts = %q, want %q", parts, want)
+	}
+}
+
+func TestMessage_Attachments(t *testing.T) {
+	csv := []byte(strings.Repeat("date,type,amount\n", 10))
+	raw, err := message("noreply@example.com", "alice@example.com", Message{
+		Subject: "subject", Text: "текст", HTML: "<p>текст</p>",
+		Attachments: []Attachment{{Filename: "выписка 2026-09.csv", ContentType: "text/csv; charset=utf-8", Data: csv}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("Content-Type = %q, want multipart/mixed", m.Header.Get("Content-Type"))
+	}
+
+	mr := multipart.NewReader(m.Body, params["boundary"])
+	body, err := mr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := body.Header.Get("Content-Type"); !strings.HasPrefix(ct, "multipart/alternative; boundary=") {
+		t.Errorf("first part Content-Type = %q, want multipart/alternative", ct)
+	}
+	attachment, err := mr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := attachment.FileName(); got != "выписка 2026-09.csv" {
+		t.Errorf("filename = %q", got)
+	}
+	// NextPart не снимает base64
+	encoded, err := io.ReadAll(attachment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(encoded), "\r\n") {
+		if len(line) > base64LineLength {
+			t.Fatalf("line of %d bytes, want at most %d", len(line), base64LineLength)
+		}
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(string(encoded), "\r\n", ""))
+	if err != nil || !bytes.Equal(data, csv) {
+		t.Errorf("attachment = %q, %v, want %q", data, err, csv)
+	}
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Errorf("extra part: %v", err)
+	}
+
+	_, err = message("noreply@example.com", "alice@example.com", Message{
+		Subject: "subject", Text: "текст", Attachments: []Attachment{{Filename: "a.csv\r\nBcc: mallory@example.com"}},
+	})
+	if !errors.Is(err, ErrHeaderInjection) {
+		t.Errorf("message() error = %v, want ErrHeaderInjection", err)
+	}
+}
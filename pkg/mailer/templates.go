@@ -0,0 +1,280 @@
+package mailer
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	texttemplate "text/template"
+)
+
+// Встроенные шаблоны писем. Шаблон name состоит из двух файлов:
+//   - name.txt - text/template с блоками "subject" и "text";
+//   - name.html - html/template с блоком "content", который выводится
+//     внутри блока "layout" из layout.html.
+//
+//go:embed templates
+var embedded embed.FS
+
+// Общий шаблон HTML-писем
+const layoutFile = "layout.html"
+
+// Название сервиса в письмах по умолчанию
+const defaultBrand = "gorefer"
+
+// ErrUnknownTemplate - шаблона с таким именем нет в реестре.
+var ErrUnknownTemplate = errors.New("неизвестный шаблон письма")
+
+// Vars - значения переменных шаблона. Переменная Brand добавляется
+// реестром.
+type Vars map[string]string
+
+// Переменные шаблонов с примерами значений для проверки при загрузке
+// и предпросмотра. Шаблон, использующий переменную не из этого списка,
+// не загружается.
+var templateVars = map[string]Vars{
+	"magic_link": {
+		"Link":       "https://gorefer.example/login/magic?token=sample",
+		"TTLMinutes": "15",
+	},
+	"verification": {
+		"Username": "alice",
+		"Link":     "https://gorefer.example/verify?token=sample",
+	},
+	"invite": {
+		"InviterName": "alice",
+		"Code":        "SAMPLE42",
+		"Link":        "https://gorefer.example/r/SAMPLE42",
+	},
+	"reset": {
+		"Username":   "alice",
+		"Link":       "https://gorefer.example/reset?token=sample",
+		"TTLMinutes": "30",
+	},
+	"referral_notification": {
+		"Username":    "alice",
+		"RefereeName": "bob",
+	},
+	"code_expiring": {
+		"Username":   "alice",
+		"Code":       "SAMPLE42",
+		"ExpiresAt":  "02.01.2027 15:04 UTC",
+		"ExtendLink": "https://gorefer.example/actions/extend-code?token=sample",
+	},
+	"reward_statement": {
+		"Username": "alice",
+		"Period":   "2026-09",
+		"Earned":   "700",
+		"Redeemed": "200",
+		"Entries":  "3",
+	},
+}
+
+// Templates - реестр шаблонов писем: встроенные шаблоны, часть которых
+// может быть заменена файлами из каталога. Безопасен для конкурентного
+// использования.
+type Templates struct {
+	brand    string
+	dir      string
+	active   map[string]*templateSet
+	defaults map[string]*templateSet
+}
+
+// Разобранный шаблон письма
+type templateSet struct {
+	text       *texttemplate.Template
+	html       *htmltemplate.Template
+	overridden bool // хотя бы один файл взят из каталога
+}
+
+// LoadTemplates загружает встроенные шаблоны и заменяет их файлами
+// с теми же именами из каталога dir (пустой dir - только встроенные).
+// Каждый шаблон проверяется на примерах значений: обращение к
+// неизвестной переменной, ошибка разбора или неизвестный файл в
+// каталоге возвращают ошибку. brand - название сервиса в письмах,
+// пустое - "gorefer".
+func LoadTemplates(dir, brand string) (*Templates, error) {
+	if brand == "" {
+		brand = defaultBrand
+	}
+	base, err := fs.Sub(embedded, "templates")
+	if err != nil {
+		return nil, err
+	}
+	t := &Templates{brand: brand, dir: dir, active: map[string]*templateSet{}, defaults: map[string]*templateSet{}}
+
+	var override fs.FS
+	if dir != "" {
+		override = os.DirFS(dir)
+		if err := checkOverrides(override); err != nil {
+			return nil, fmt.Errorf("шаблоны писем %s: %w", dir, err)
+		}
+	}
+	for name := range templateVars {
+		def, err := parseSet(base, nil, name)
+		if err != nil {
+			return nil, fmt.Errorf("встроенный шаблон письма %q: %w", name, err)
+		}
+		t.defaults[name], t.active[name] = def, def
+		if override == nil {
+			continue
+		}
+		set, err := parseSet(base, override, name)
+		if err != nil {
+			return nil, fmt.Errorf("шаблон письма %q из %s: %w", name, dir, err)
+		}
+		if set.overridden {
+			t.active[name] = set
+		}
+	}
+	return t, nil
+}
+
+// DefaultTemplates возвращает реестр только из встроенных шаблонов.
+// Встроенные шаблоны проверяются тестами пакета, поэтому ошибка
+// загрузки означает ошибку сборки.
+func DefaultTemplates() *Templates {
+	t, err := LoadTemplates("", "")
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// checkOverrides проверяет, что каталог содержит только файлы известных
+// шаблонов: опечатка в имени иначе молча оставила бы встроенный шаблон.
+func checkOverrides(dir fs.FS) error {
+	entries, err := fs.ReadDir(dir, ".")
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || strings.HasPrefix(name, ".") || name == layoutFile {
+			continue
+		}
+		ext := path.Ext(name)
+		if _, ok := templateVars[strings.TrimSuffix(name, ext)]; !ok || (ext != ".txt" && ext != ".html") {
+			return fmt.Errorf("неизвестный файл шаблона %s", name)
+		}
+	}
+	return nil
+}
+
+// readTemplate читает файл из override, если он там есть, иначе из base.
+func readTemplate(base, override fs.FS, name string) (src string, overridden bool, err error) {
+	if override != nil {
+		b, err := fs.ReadFile(override, name)
+		if err == nil {
+			return string(b), true, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", false, err
+		}
+	}
+	b, err := fs.ReadFile(base, name)
+	return string(b), false, err
+}
+
+// parseSet разбирает шаблон name. Обращение к отсутствующей переменной
+// при выполнении - ошибка.
+func parseSet(base, override fs.FS, name string) (*templateSet, error) {
+	set := &templateSet{}
+
+	src, overridden, err := readTemplate(base, override, name+".txt")
+	if err != nil {
+		return nil, err
+	}
+	set.overridden = overridden
+	if set.text, err = texttemplate.New(name).Option("missingkey=error").Parse(src); err != nil {
+		return nil, err
+	}
+
+	set.html = htmltemplate.New(name).Option("missingkey=error")
+	for _, file := range []string{layoutFile, name + ".html"} {
+		src, overridden, err := readTemplate(base, override, file)
+		if err != nil {
+			return nil, err
+		}
+		set.overridden = set.overridden || overridden
+		if _, err := set.html.Parse(src); err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+	}
+
+	// выполнение на примерах проверяет обращения к переменным
+	sample := Vars{"Brand": defaultBrand}
+	for k, v := range templateVars[name] {
+		sample[k] = v
+	}
+	if _, err := set.render(sample); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// render выполняет все части шаблона.
+func (s *templateSet) render(vars Vars) (Message, error) {
+	var subject, text, html bytes.Buffer
+	if err := s.text.ExecuteTemplate(&subject, "subject", vars); err != nil {
+		return Message{}, err
+	}
+	if err := s.text.ExecuteTemplate(&text, "text", vars); err != nil {
+		return Message{}, err
+	}
+	if err := s.html.ExecuteTemplate(&html, "layout", vars); err != nil {
+		return Message{}, err
+	}
+	return Message{
+		Subject: strings.TrimSpace(subject.String()),
+		Text:    text.String(),
+		HTML:    html.String(),
+	}, nil
+}
+
+// vars дополняет значения переменной Brand.
+func (t *Templates) vars(vars Vars) Vars {
+	all := Vars{"Brand": t.brand}
+	for k, v := range vars {
+		all[k] = v
+	}
+	return all
+}
+
+// Names возвращает имена шаблонов по алфавиту.
+func (t *Templates) Names() []string {
+	names := make([]string, 0, len(t.active))
+	for name := range t.active {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Render заполняет шаблон name. Если шаблон из каталога не удалось
+// выполнить с этими значениями, ошибка записывается в журнал, а письмо
+// собирается по встроенному шаблону.
+func (t *Templates) Render(name string, vars Vars) (Message, error) {
+	set, ok := t.active[name]
+	if !ok {
+		return Message{}, fmt.Errorf("%w: %q", ErrUnknownTemplate, name)
+	}
+	m, err := set.render(t.vars(vars))
+	if err == nil || !set.overridden {
+		return m, err
+	}
+	log.Printf("Ошибка шаблона письма %q из %s, используется встроенный: %v", name, t.dir, err)
+	return t.defaults[name].render(t.vars(vars))
+}
+
+// Preview заполняет шаблон name примерами значений.
+func (t *Templates) Preview(name string) (Message, error) {
+	return t.Render(name, templateVars[name])
+}
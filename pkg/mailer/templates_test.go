@@ -0,0 +1,123 @@
+package mailer
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDefaultTemplates(t *testing.T) {
+	tmpl := DefaultTemplates()
+	for _, name := range tmpl.Names() {
+		t.Run(name, func(t *testing.T) {
+			m, err := tmpl.Preview(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.Subject == "" || m.Text == "" || m.HTML == "" {
+				t.Errorf("Preview(%q) = %+v, want subject, text and html", name, m)
+			}
+			// все переменные шаблона попадают хотя бы в одну из частей
+			for k, v := range templateVars[name] {
+				if !strings.Contains(m.Text, v) && !strings.Contains(m.HTML, v) {
+					t.Errorf("variable %s = %q is not used", k, v)
+				}
+			}
+		})
+	}
+	if _, err := tmpl.Render("unknown", nil); !errors.Is(err, ErrUnknownTemplate) {
+		t.Errorf("Render(unknown) error = %v, want ErrUnknownTemplate", err)
+	}
+}
+
+// writeTemplates создает каталог с файлами шаблонов.
+func writeTemplates(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, src := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoadTemplates(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   map[string]string
+		wantErr string
+	}{
+		{"Override", map[string]string{
+			"invite.txt": `{{define "subject"}}Join {{.Brand}}{{end}}{{define "text"}}{{.Link}}{{end}}`,
+		}, ""},
+		{"Unknown variable", map[string]string{
+			"invite.txt": `{{define "subject"}}Join{{end}}{{define "text"}}{{.Referrer}}{{end}}`,
+		}, "Referrer"},
+		{"Unknown variable in layout", map[string]string{
+			"layout.html": `{{define "layout"}}{{.Logo}}{{template "content" .}}{{end}}`,
+		}, "Logo"},
+		{"Syntax error", map[string]string{
+			"reset.html": `{{define "content"}}{{.Link}`,
+		}, "reset"},
+		{"Unknown file", map[string]string{
+			"invitation.txt": `{{define "subject"}}{{end}}{{define "text"}}{{end}}`,
+		}, "invitation.txt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := LoadTemplates(writeTemplates(t, tt.files), "Acme")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("LoadTemplates() error = %v, want it to mention %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			m, err := tmpl.Preview("invite")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.Subject != "Join Acme" || m.Text != templateVars["invite"]["Link"] {
+				t.Errorf("Preview(invite) = %q / %q, want override", m.Subject, m.Text)
+			}
+			// HTML-версия осталась встроенной, с названием из конфигурации
+			if !strings.Contains(m.HTML, "Acme") {
+				t.Errorf("html = %q, want brand Acme", m.HTML)
+			}
+		})
+	}
+}
+
+func TestTemplates_RenderFallback(t *testing.T) {
+	// ошибка проявляется только на значениях, отличных от примеров
+	dir := writeTemplates(t, map[string]string{
+		"invite.txt": `{{define "subject"}}Join{{end}}{{define "text"}}{{if eq .Code "BROKEN"}}{{.Missing}}{{end}}{{.Link}}{{end}}`,
+	})
+	tmpl, err := LoadTemplates(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	vars := Vars{"InviterName": "alice", "Code": "BROKEN", "Link": "https://example.com/r/BROKEN"}
+	m, err := tmpl.Render("invite", vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Subject != "alice приглашает вас в gorefer" {
+		t.Errorf("subject = %q, want embedded default", m.Subject)
+	}
+	if !strings.Contains(logs.String(), `"invite"`) {
+		t.Errorf("log = %q, want template error", logs.String())
+	}
+}
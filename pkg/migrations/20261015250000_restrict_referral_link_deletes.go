@@ -0,0 +1,77 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/pressly/goose"
+)
+
+// Миграция на Go, чтобы перед заменой внешних ключей записать в журнал,
+// сколько записей без владельца было удалено.
+func init() {
+	goose.AddMigration(upRestrictReferralLinkDeletes, downRestrictReferralLinkDeletes)
+}
+
+// Записи, ссылающиеся на несуществующих пользователей. Появляются в базах,
+// где ограничения отключались при ручном восстановлении данных; с ними
+// ограничения не удастся создать заново.
+var orphanCleanup = []struct {
+	name  string
+	query string
+}{
+	{"referral_codes", `
+        DELETE FROM referral_codes rc
+        WHERE rc.user_id IS NOT NULL
+          AND NOT EXISTS (SELECT 1 FROM users u WHERE u.id = rc.user_id)`},
+	{"referral_links", `
+        DELETE FROM referral_links rl
+        WHERE NOT EXISTS (SELECT 1 FROM users u WHERE u.id = rl.referrer_id)
+           OR NOT EXISTS (SELECT 1 FROM users u WHERE u.id = rl.referee_id)`},
+}
+
+// Коды удаляются вместе с владельцем. Реферальные связи - история
+// начислений, поэтому пользователя со связями удалить нельзя: его
+// данные обезличиваются анонимизацией, а строка остается.
+func upRestrictReferralLinkDeletes(tx *sql.Tx) error {
+	report := make([]string, 0, len(orphanCleanup))
+	for _, c := range orphanCleanup {
+		res, err := tx.Exec(c.query)
+		if err != nil {
+			return fmt.Errorf("очистка %s: %w", c.name, err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		report = append(report, fmt.Sprintf("%s=%d", c.name, n))
+	}
+	log.Printf("Удалены записи без владельца: %s", strings.Join(report, ", "))
+
+	return replaceForeignKeys(tx, "CASCADE", "RESTRICT")
+}
+
+func downRestrictReferralLinkDeletes(tx *sql.Tx) error {
+	return replaceForeignKeys(tx, "CASCADE", "CASCADE")
+}
+
+// replaceForeignKeys пересоздает внешние ключи кодов и реферальных связей
+// на users с прежними именами и указанными действиями при удалении.
+func replaceForeignKeys(tx *sql.Tx, codes, links string) error {
+	_, err := tx.Exec(fmt.Sprintf(`
+        ALTER TABLE referral_codes
+            DROP CONSTRAINT IF EXISTS referral_codes_user_id_fkey,
+            ADD CONSTRAINT referral_codes_user_id_fkey
+                FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE %[1]s;
+        ALTER TABLE referral_links
+            DROP CONSTRAINT IF EXISTS referral_links_referrer_id_fkey,
+            DROP CONSTRAINT IF EXISTS referral_links_referee_id_fkey,
+            ADD CONSTRAINT referral_links_referrer_id_fkey
+                FOREIGN KEY (referrer_id) REFERENCES users(id) ON DELETE %[2]s,
+            ADD CONSTRAINT referral_links_referee_id_fkey
+                FOREIGN KEY (referee_id) REFERENCES users(id) ON DELETE %[2]s;`,
+		codes, links))
+	return err
+}
@@ -1,25 +1,177 @@
 package migrations
 
 import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
 	"log"
+	"path/filepath"
+	"time"
 
 	_ "github.com/lib/pq"
 
 	"github.com/pressly/goose"
 )
 
-// RunMigrations выполняет миграции базы данных
-func RunMigrations(dbInfo string) {
+// Ключ advisory-блокировки, под которой выполняются миграции.
+// Одновременно мигрировать базу может только один экземпляр сервиса.
+const lockKey = 7_001_000_001
+
+// Интервал повторной попытки взять блокировку.
+const lockPollInterval = time.Second
+
+var (
+	// ErrLocked - миграции выполняет другой экземпляр, и он не успел
+	// завершить их до истечения дедлайна.
+	ErrLocked = errors.New("миграции выполняет другой экземпляр")
+	// ErrFailed - ошибка при выполнении самих миграций.
+	ErrFailed = errors.New("ошибка выполнения миграций")
+)
+
+// Каталог файлов миграций относительно рабочего каталога сервиса
+const migrationsDir = "../../migrations"
+
+// Migration - примененная миграция
+type Migration struct {
+	Version int64  `json:"version"`
+	Name    string `json:"name"` // имя файла миграции
+}
+
+// Result - итог выполнения миграций
+type Result struct {
+	From    int64       `json:"from"` // версия схемы до миграций
+	To      int64       `json:"to"`   // версия схемы после миграций
+	Applied []Migration `json:"applied"`
+}
+
+// RunMigrations выполняет миграции базы данных, см. ApplyMigrations.
+func RunMigrations(ctx context.Context, dbInfo string) error {
+	_, err := ApplyMigrations(ctx, dbInfo)
+	return err
+}
+
+// ApplyMigrations выполняет миграции базы данных под
+// advisory-блокировкой и возвращает примененные миграции. Если
+// блокировку держит другой экземпляр, функция ждет ее освобождения и
+// затем проверяет, что применять больше нечего. Ожидание и сами миграции
+// ограничены дедлайном ctx.
+func ApplyMigrations(ctx context.Context, dbInfo string) (Result, error) {
 	db, err := goose.OpenDBWithDriver("postgres", dbInfo)
 	if err != nil {
-		log.Fatalf("Не удалось подключиться к базе данных: %v", err)
+		return Result{}, fmt.Errorf("не удалось подключиться к базе данных: %w", err)
+	}
+
+	// блокировка сессионная, поэтому держится на отдельном соединении
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		db.Close()
+		return Result{}, fmt.Errorf("не удалось подключиться к базе данных: %w", err)
+	}
+
+	waited, err := acquireLock(ctx, func(ctx context.Context) (bool, error) {
+		var ok bool
+		err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", lockKey).Scan(&ok)
+		return ok, err
+	})
+	if err != nil {
+		conn.Close()
+		db.Close()
+		return Result{}, err
+	}
+	if waited {
+		log.Println("Миграции выполнены другим экземпляром, проверка...")
 	}
-	defer db.Close() // Закрываем соединение после выполнения миграций
 
 	log.Println("Запуск миграций...")
-	if err := goose.Up(db, "../../migrations"); err != nil {
-		log.Fatalf("Ошибка выполнения миграций: %v", err)
+	type outcome struct {
+		res Result
+		err error
 	}
+	done := make(chan outcome, 1)
+	go func() {
+		res, err := up(db)
+		done <- outcome{res, err}
+	}()
 
-	log.Println("Миграции выполнены успешно.")
+	release := func() {
+		conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", lockKey)
+		conn.Close()
+		db.Close()
+	}
+
+	var res Result
+	select {
+	case o := <-done:
+		release()
+		if o.err != nil {
+			return Result{}, fmt.Errorf("%w: %w", ErrFailed, o.err)
+		}
+		res = o.res
+	case <-ctx.Done():
+		// goose не поддерживает отмену: соединения закрываются после
+		// завершения текущей миграции, чтобы не блокировать запуск
+		go func() {
+			<-done
+			release()
+		}()
+		return Result{}, fmt.Errorf("%w: %w", ErrFailed, ctx.Err())
+	}
+
+	log.Printf("Миграции выполнены успешно, применено %d.", len(res.Applied))
+	return res, nil
+}
+
+// up применяет миграции и определяет примененные по версиям схемы до и
+// после.
+func up(db *sql.DB) (Result, error) {
+	from, err := goose.GetDBVersion(db)
+	if err != nil {
+		return Result{}, err
+	}
+	if err := goose.Up(db, migrationsDir); err != nil {
+		return Result{}, err
+	}
+	to, err := goose.GetDBVersion(db)
+	if err != nil {
+		return Result{}, err
+	}
+	res := Result{From: from, To: to, Applied: []Migration{}}
+	if to == from {
+		return res, nil
+	}
+	applied, err := goose.CollectMigrations(migrationsDir, from, to)
+	if err != nil {
+		return Result{}, err
+	}
+	for _, m := range applied {
+		res.Applied = append(res.Applied, Migration{Version: m.Version, Name: filepath.Base(m.Source)})
+	}
+	return res, nil
+}
+
+// acquireLock пытается взять блокировку до истечения дедлайна ctx.
+// waited сообщает, пришлось ли ждать другой экземпляр.
+func acquireLock(ctx context.Context, tryLock func(ctx context.Context) (bool, error)) (waited bool, err error) {
+	for {
+		ok, err := tryLock(ctx)
+		switch {
+		case err != nil && ctx.Err() != nil:
+			return waited, fmt.Errorf("%w: %w", ErrLocked, ctx.Err())
+		case err != nil:
+			return waited, fmt.Errorf("не удалось взять блокировку миграций: %w", err)
+		case ok:
+			return waited, nil
+		}
+
+		if !waited {
+			log.Println("Миграции выполняет другой экземпляр, ожидание...")
+			waited = true
+		}
+		select {
+		case <-ctx.Done():
+			return waited, fmt.Errorf("%w: %w", ErrLocked, ctx.Err())
+		case <-time.After(lockPollInterval):
+		}
+	}
 }
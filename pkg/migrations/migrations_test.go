@@ -0,0 +1,42 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAcquireLock(t *testing.T) {
+	tests := []struct {
+		name       string
+		results    []bool
+		timeout    time.Duration
+		wantWaited bool
+		wantErr    error
+	}{
+		{"Lock is free", []bool{true}, time.Second, false, nil},
+		{"Lock released by another instance", []bool{false, true}, 5 * time.Second, true, nil},
+		{"Another instance keeps migrating", []bool{false, false, false}, 100 * time.Millisecond, true, ErrLocked},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+
+			calls := 0
+			waited, err := acquireLock(ctx, func(ctx context.Context) (bool, error) {
+				ok := tt.results[min(calls, len(tt.results)-1)]
+				calls++
+				return ok, nil
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("acquireLock() error = %v, want %v", err, tt.wantErr)
+			}
+			if waited != tt.wantWaited {
+				t.Errorf("acquireLock() waited = %v, want %v", waited, tt.wantWaited)
+			}
+		})
+	}
+}
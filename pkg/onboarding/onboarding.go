@@ -0,0 +1,80 @@
+// Пакет onboarding описывает шаги знакомства приглашенного с сервисом.
+// Вознаграждение реферера за приглашенного зачисляется, когда тот
+// выполнит все обязательные шаги.
+package onboarding
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Шаги знакомства с сервисом
+const (
+	StepEmailVerified    = "email_verified"    // вход по одноразовой ссылке подтвердил email
+	StepFirstLogin       = "first_login"       // первый успешный вход
+	StepProfileCompleted = "profile_completed" // в профиле указан часовой пояс
+)
+
+// Steps - все известные шаги в порядке, в котором их обычно выполняют.
+var Steps = []string{StepEmailVerified, StepFirstLogin, StepProfileCompleted}
+
+// ErrInvalidRules оборачивает все ошибки проверки правил.
+var ErrInvalidRules = errors.New("некорректные правила знакомства с сервисом")
+
+// Rules - шаги, обязательные для зачисления вознаграждения. Пустой
+// список - вознаграждение зачисляется сразу при регистрации.
+type Rules []string
+
+// Progress - выполненные и оставшиеся обязательные шаги.
+type Progress struct {
+	Completed []string `json:"completed"`
+	Remaining []string `json:"remaining"`
+}
+
+// Validate проверяет, что шаги известны и не повторяются.
+func (r Rules) Validate() error {
+	seen := map[string]bool{}
+	for _, step := range r {
+		if !known(step) {
+			return fmt.Errorf("%w: неизвестный шаг %q", ErrInvalidRules, step)
+		}
+		if seen[step] {
+			return fmt.Errorf("%w: шаг %q повторяется", ErrInvalidRules, step)
+		}
+		seen[step] = true
+	}
+	return nil
+}
+
+// Done сообщает, выполнены ли все обязательные шаги.
+func (r Rules) Done(completed []string) bool {
+	return len(r.Progress(completed).Remaining) == 0
+}
+
+// Progress возвращает обязательные шаги, разделенные на выполненные и
+// оставшиеся, в порядке правил. Выполненные необязательные шаги не
+// учитываются.
+func (r Rules) Progress(completed []string) Progress {
+	done := map[string]bool{}
+	for _, step := range completed {
+		done[step] = true
+	}
+	p := Progress{Completed: []string{}, Remaining: []string{}}
+	for _, step := range r {
+		if done[step] {
+			p.Completed = append(p.Completed, step)
+		} else {
+			p.Remaining = append(p.Remaining, step)
+		}
+	}
+	return p
+}
+
+func known(step string) bool {
+	for _, s := range Steps {
+		if s == step {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package onboarding
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestRules_Progress(t *testing.T) {
+	rules := Rules{StepEmailVerified, StepFirstLogin, StepProfileCompleted}
+	tests := []struct {
+		name      string
+		rules     Rules
+		completed []string
+		want      Progress
+		wantDone  bool
+	}{
+		{"Nothing done", rules, nil, Progress{Completed: []string{}, Remaining: rules}, false},
+		{"Order of rules", rules, []string{StepProfileCompleted, StepEmailVerified},
+			Progress{Completed: []string{StepEmailVerified, StepProfileCompleted}, Remaining: []string{StepFirstLogin}}, false},
+		{"All done", rules, []string{StepFirstLogin, StepProfileCompleted, StepEmailVerified},
+			Progress{Completed: rules, Remaining: []string{}}, true},
+		{"Optional steps ignored", Rules{StepFirstLogin}, []string{StepFirstLogin, StepProfileCompleted},
+			Progress{Completed: []string{StepFirstLogin}, Remaining: []string{}}, true},
+		{"No rules", nil, nil, Progress{Completed: []string{}, Remaining: []string{}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.rules.Progress(tt.completed)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Progress() = %+v, want %+v", got, tt.want)
+			}
+			if done := tt.rules.Done(tt.completed); done != tt.wantDone {
+				t.Errorf("Done() = %t, want %t", done, tt.wantDone)
+			}
+		})
+	}
+}
+
+func TestRules_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   Rules
+		wantErr bool
+	}{
+		{"Empty", nil, false},
+		{"All steps", Rules(Steps), false},
+		{"Unknown step", Rules{"phone_verified"}, true},
+		{"Repeated step", Rules{StepFirstLogin, StepFirstLogin}, true},
+	}
+
+	for _, tt := range tests {
+		err := tt.rules.Validate()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: Validate() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+		if err != nil && !errors.Is(err, ErrInvalidRules) {
+			t.Errorf("%s: error %v does not wrap ErrInvalidRules", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+// Пакет reminders напоминает рефереру по email, что срок его
+// реферального кода скоро истечет. Напоминание отправляется один раз на
+// код; выбор кодов в хранилище исключает повторную отправку другим
+// экземпляром сервиса.
+package reminders
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"gorefer.go/pkg/api"
+	"gorefer.go/pkg/mailer"
+	"gorefer.go/pkg/storage"
+)
+
+// Шаблон письма-напоминания
+const template = "code_expiring"
+
+// Формат срока действия кода в письме
+const expiryLayout = "02.01.2006 15:04 MST"
+
+// Число кодов, выбираемых за один проход
+const batchSize = 50
+
+// Config - окно напоминания и период проверки.
+type Config struct {
+	Window   time.Duration // напоминать о кодах, истекающих в пределах окна
+	Interval time.Duration // период проверки
+	// BaseURL - внешний адрес API для ссылки продления кода в письме, см.
+	// api.ExtendCodeLink; пусто - письмо без ссылки
+	BaseURL string
+}
+
+// Параметры по умолчанию, если конфигурация их не задает.
+var DefaultConfig = Config{
+	Window:   72 * time.Hour,
+	Interval: time.Hour,
+}
+
+// withFallback подставляет значения по умолчанию вместо незаданных.
+func (c Config) withFallback() Config {
+	if c.Window <= 0 {
+		c.Window = DefaultConfig.Window
+	}
+	if c.Interval <= 0 {
+		c.Interval = DefaultConfig.Interval
+	}
+	return c
+}
+
+// Reminder - фоновый компонент напоминаний. Подходит для
+// api.API.Register.
+type Reminder struct {
+	store     storage.ReminderStore
+	mailer    api.Mailer
+	templates *mailer.Templates
+	config    Config
+	now       func() time.Time
+}
+
+// New создает компонент напоминаний. templates nil - встроенные шаблоны.
+func New(store storage.ReminderStore, m api.Mailer, templates *mailer.Templates, config Config) *Reminder {
+	if templates == nil {
+		templates = mailer.DefaultTemplates()
+	}
+	return &Reminder{store: store, mailer: m, templates: templates, config: config.withFallback(), now: time.Now}
+}
+
+// Run отправляет напоминания каждые Interval до отмены ctx.
+func (r *Reminder) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.config.Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := r.SendDue(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Ошибка отправки напоминаний об истечении кодов: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// SendDue отправляет напоминания о кодах, истекающих в пределах Window,
+// и возвращает число отправленных писем. Код, письмо о котором не
+// отправлено, будет выбран снова при следующей проверке.
+func (r *Reminder) SendDue(ctx context.Context) (int, error) {
+	sent := 0
+	for {
+		codes, err := r.store.ClaimExpiringCodes(ctx, r.now().Add(r.config.Window), batchSize)
+		if err != nil {
+			return sent, err
+		}
+		failed := false
+		for _, c := range codes {
+			if err := r.send(ctx, c); err != nil {
+				log.Printf("Ошибка отправки напоминания о коде %d: %v", c.ID, err)
+				// отметка снимается и после отмены ctx, иначе код останется без напоминания
+				if err := r.store.ReleaseExpiringCode(context.WithoutCancel(ctx), c.ID); err != nil {
+					log.Printf("Ошибка снятия отметки напоминания о коде %d: %v", c.ID, err)
+				}
+				failed = true
+				continue
+			}
+			sent++
+		}
+		// после ошибки отправки следующая партия выбрала бы те же коды
+		if len(codes) < batchSize || failed || ctx.Err() != nil {
+			return sent, ctx.Err()
+		}
+	}
+}
+
+// send отправляет напоминание владельцу кода. С BaseURL письмо содержит
+// одноразовую ссылку продления кода на api.ExtendCodeBy.
+func (r *Reminder) send(ctx context.Context, c storage.ExpiringCode) error {
+	vars := mailer.Vars{
+		"Username":   c.Username,
+		"Code":       c.Code,
+		"ExpiresAt":  c.ExpiresAt.In(api.UserLocation(c.Timezone)).Format(expiryLayout),
+		"ExtendLink": "",
+	}
+	if r.config.BaseURL != "" {
+		link, err := api.ExtendCodeLink(r.config.BaseURL, c)
+		if err != nil {
+			return err
+		}
+		vars["ExtendLink"] = link
+	}
+	msg, err := r.templates.Render(template, vars)
+	if err != nil {
+		return err
+	}
+	return r.mailer.Send(ctx, c.Email, msg)
+}
@@ -0,0 +1,215 @@
+package reminders
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gorefer.go/pkg/api/apitest"
+	"gorefer.go/pkg/mailer"
+	"gorefer.go/pkg/storage"
+)
+
+// fakeMailer запоминает отправленные письма; пока fail задан, отправка
+// не удается.
+type fakeMailer struct {
+	mu   sync.Mutex
+	fail error
+	sent map[string][]mailer.Message
+}
+
+func (m *fakeMailer) Send(ctx context.Context, to string, msg mailer.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.fail != nil {
+		return m.fail
+	}
+	if m.sent == nil {
+		m.sent = map[string][]mailer.Message{}
+	}
+	m.sent[to] = append(m.sent[to], msg)
+	return nil
+}
+
+func (m *fakeMailer) count(to string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.sent[to])
+}
+
+// newStore создает хранилище на часах clock с пользователями, коды
+// которых истекают через заданное время.
+func newStore(t *testing.T, clock func() time.Time, expiries map[string]time.Duration) *apitest.Store {
+	t.Helper()
+	ctx := context.Background()
+	store := apitest.NewStore()
+	store.SetNow(clock)
+	for name, in := range expiries {
+		id, err := store.CreateUser(ctx, storage.CreateUserParams{User: storage.User{Username: name, Email: name + "@example.com"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		code := strings.ToUpper(name) + "42"
+		if err := store.CreateReferralCode(ctx, id, code, clock().Add(in).Unix(), "", nil, storage.DomainRestriction{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store
+}
+
+func TestReminder_SendsOncePerCode(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	store := newStore(t, clock, map[string]time.Duration{
+		"soon":    24 * time.Hour,
+		"edge":    72 * time.Hour,
+		"later":   100 * time.Hour,
+		"expired": -time.Hour,
+	})
+	m := &fakeMailer{}
+	r := New(store, m, nil, Config{Window: 72 * time.Hour})
+	r.now = clock
+
+	sent, err := r.SendDue(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != 2 {
+		t.Errorf("first pass sent %d reminders, want 2", sent)
+	}
+	for name, want := range map[string]int{"soon": 1, "edge": 1, "later": 0, "expired": 0} {
+		if got := m.count(name + "@example.com"); got != want {
+			t.Errorf("reminders to %s = %d, want %d", name, got, want)
+		}
+	}
+	msg := m.sent["soon@example.com"][0]
+	if !strings.Contains(msg.Text, "SOON42") || !strings.Contains(msg.Text, "16.10.2026 12:00 UTC") {
+		t.Errorf("reminder text = %q, want code and expiry date", msg.Text)
+	}
+
+	// повторная проверка не отправляет писем
+	if sent, err := r.SendDue(ctx); err != nil || sent != 0 {
+		t.Errorf("second pass = %d, %v; want 0", sent, err)
+	}
+
+	// код попадает в окно со временем
+	now = now.Add(48 * time.Hour)
+	if sent, err := r.SendDue(ctx); err != nil || sent != 1 {
+		t.Errorf("pass after 48h = %d, %v; want 1", sent, err)
+	}
+	if got := m.count("later@example.com"); got != 1 {
+		t.Errorf("reminders to later = %d, want 1", got)
+	}
+}
+
+// Срок в письме выводится в часовом поясе владельца кода
+func TestReminder_OwnerTimezone(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	store := newStore(t, clock, map[string]time.Duration{"berlin": 24 * time.Hour, "unknown": 24 * time.Hour})
+	for name, timezone := range map[string]string{"berlin": "Europe/Berlin", "unknown": "Not/A_Zone"} {
+		u, err := store.GetUserByEmail(ctx, name+"@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := store.SetTimezone(ctx, u.ID, timezone); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := &fakeMailer{}
+	r := New(store, m, nil, Config{})
+	r.now = clock
+
+	if _, err := r.SendDue(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"berlin": "16.10.2026 14:00 CEST", "unknown": "16.10.2026 12:00 UTC"} {
+		if sent := m.sent[name+"@example.com"]; len(sent) != 1 || !strings.Contains(sent[0].Text, want) {
+			t.Errorf("reminder to %s = %+v, want expiry %q", name, sent, want)
+		}
+	}
+}
+
+func TestReminder_ConcurrentReplicas(t *testing.T) {
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	expiries := map[string]time.Duration{}
+	for i := 0; i < 3*batchSize; i++ {
+		expiries[fmt.Sprintf("user%03d", i)] = time.Duration(i+1) * time.Minute
+	}
+	store := newStore(t, clock, expiries)
+	m := &fakeMailer{}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := New(store, m, nil, Config{})
+			r.now = clock
+			if _, err := r.SendDue(context.Background()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for name := range expiries {
+		if got := m.count(name + "@example.com"); got != 1 {
+			t.Errorf("reminders to %s = %d, want 1", name, got)
+		}
+	}
+}
+
+func TestReminder_RetriesFailedSend(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	store := newStore(t, clock, map[string]time.Duration{"soon": time.Hour})
+	m := &fakeMailer{fail: errors.New("smtp unavailable")}
+	r := New(store, m, nil, Config{})
+	r.now = clock
+
+	if sent, err := r.SendDue(ctx); err != nil || sent != 0 {
+		t.Fatalf("pass with failing mailer = %d, %v; want 0", sent, err)
+	}
+	m.fail = nil
+	if sent, err := r.SendDue(ctx); err != nil || sent != 1 {
+		t.Errorf("pass after recovery = %d, %v; want 1", sent, err)
+	}
+}
+
+func TestReminder_ExtendLink(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	tests := []struct {
+		name     string
+		baseURL  string
+		wantLink bool
+	}{
+		{"With BaseURL", "https://gorefer.test/", true},
+		{"Without BaseURL", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &fakeMailer{}
+			r := New(newStore(t, clock, map[string]time.Duration{"soon": time.Hour}), m, nil, Config{BaseURL: tt.baseURL})
+			r.now = clock
+			if sent, err := r.SendDue(ctx); err != nil || sent != 1 {
+				t.Fatalf("SendDue() = %d, %v; want 1", sent, err)
+			}
+			msg := m.sent["soon@example.com"][0]
+			const link = "https://gorefer.test/actions/extend-code?token="
+			if got := strings.Contains(msg.Text, link) && strings.Contains(msg.HTML, link); got != tt.wantLink {
+				t.Errorf("extend link in reminder = %v, want %v:\n%s", got, tt.wantLink, msg.Text)
+			}
+		})
+	}
+}
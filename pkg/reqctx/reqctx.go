@@ -0,0 +1,127 @@
+// Пакет reqctx хранит данные запроса в контексте: утверждения токена
+// пользователя, ключ API сервиса, ID запроса, IP клиента и загруженного
+// пользователя запроса. Ключи неэкспортируемые, поэтому
+// значения доступны только через функции пакета и не пересекаются с
+// ключами других пакетов.
+package reqctx
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"gorefer.go/pkg/auth"
+	"gorefer.go/pkg/storage"
+)
+
+// UserClaims - утверждения токена аутентифицированного пользователя:
+// ID, имя и роль. Имени и роли из токена достаточно для ответов и
+// писем, загружать пользователя ради них не нужно.
+type UserClaims = auth.CustomClaims
+
+// ErrNoUser - запрос не аутентифицирован пользователем
+var ErrNoUser = errors.New("запрос не аутентифицирован пользователем")
+
+type key int
+
+const (
+	userKey key = iota
+	requestIDKey
+	clientIPKey
+	apiKeyKey
+	userCacheKey
+)
+
+// APIKey - ключ API, которым аутентифицирован запрос другого сервиса.
+type APIKey struct {
+	ID     int
+	Name   string
+	Scopes []string
+}
+
+// WithUser возвращает контекст с утверждениями пользователя и пустым
+// кэшем пользователей запроса, см. CurrentUser.
+func WithUser(ctx context.Context, claims *UserClaims) context.Context {
+	ctx = context.WithValue(ctx, userCacheKey, &userCache{users: map[int]storage.User{}})
+	return context.WithValue(ctx, userKey, claims)
+}
+
+// UserFrom возвращает утверждения пользователя; false, если запрос
+// не аутентифицирован.
+func UserFrom(ctx context.Context) (*UserClaims, bool) {
+	claims, ok := ctx.Value(userKey).(*UserClaims)
+	return claims, ok && claims != nil
+}
+
+// WithAPIKey возвращает контекст с ключом API запроса.
+func WithAPIKey(ctx context.Context, key APIKey) context.Context {
+	return context.WithValue(ctx, apiKeyKey, key)
+}
+
+// APIKeyFrom возвращает ключ API запроса; false, если запрос
+// аутентифицирован не ключом.
+func APIKeyFrom(ctx context.Context) (APIKey, bool) {
+	key, ok := ctx.Value(apiKeyKey).(APIKey)
+	return key, ok
+}
+
+// WithRequestID возвращает контекст с ID запроса.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// RequestIDFrom возвращает ID запроса; false, если он не задан.
+func RequestIDFrom(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(requestIDKey).(string)
+	return id, ok && id != ""
+}
+
+// WithClientIP возвращает контекст с IP клиента.
+func WithClientIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, clientIPKey, ip)
+}
+
+// ClientIPFrom возвращает IP клиента; false, если он не задан.
+func ClientIPFrom(ctx context.Context) (string, bool) {
+	ip, ok := ctx.Value(clientIPKey).(string)
+	return ip, ok && ip != ""
+}
+
+// UserLoader загружает пользователя по ID, например storage.UserStore.
+type UserLoader interface {
+	GetUserByID(ctx context.Context, id int) (storage.User, error)
+}
+
+// Пользователи, загруженные за время запроса
+type userCache struct {
+	mu    sync.Mutex
+	users map[int]storage.User
+}
+
+// CurrentUser возвращает пользователя запроса со всеми полями. Первый
+// вызов загружает его через db, следующие в том же запросе берут его из
+// кэша, поэтому обработчик может вызывать CurrentUser сколько угодно раз.
+// Ошибка загрузки не кэшируется. ErrNoUser, если запрос не
+// аутентифицирован.
+func CurrentUser(ctx context.Context, db UserLoader) (storage.User, error) {
+	claims, ok := UserFrom(ctx)
+	if !ok {
+		return storage.User{}, ErrNoUser
+	}
+	cache, ok := ctx.Value(userCacheKey).(*userCache)
+	if !ok {
+		return db.GetUserByID(ctx, claims.UserID)
+	}
+	// блокировка на время загрузки: одновременные вызовы ждут первый
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if user, ok := cache.users[claims.UserID]; ok {
+		return user, nil
+	}
+	user, err := db.GetUserByID(ctx, claims.UserID)
+	if err != nil {
+		return storage.User{}, err
+	}
+	cache.users[claims.UserID] = user
+	return user, nil
+}
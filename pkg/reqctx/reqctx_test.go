@@ -0,0 +1,111 @@
+package reqctx
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	gomock "github.com/golang/mock/gomock"
+	"gorefer.go/pkg/storage"
+)
+
+func TestMissingValues(t *testing.T) {
+	ctx := context.Background()
+
+	if claims, ok := UserFrom(ctx); ok || claims != nil {
+		t.Errorf("UserFrom(empty) = %v, %v, want nil, false", claims, ok)
+	}
+	if id, ok := RequestIDFrom(ctx); ok || id != "" {
+		t.Errorf("RequestIDFrom(empty) = %q, %v, want \"\", false", id, ok)
+	}
+	if ip, ok := ClientIPFrom(ctx); ok || ip != "" {
+		t.Errorf("ClientIPFrom(empty) = %q, %v, want \"\", false", ip, ok)
+	}
+	if key, ok := APIKeyFrom(ctx); ok || key.ID != 0 {
+		t.Errorf("APIKeyFrom(empty) = %+v, %v, want zero, false", key, ok)
+	}
+
+	// nil и пустые значения считаются отсутствующими
+	ctx = WithUser(ctx, nil)
+	ctx = WithRequestID(ctx, "")
+	ctx = WithClientIP(ctx, "")
+	if _, ok := UserFrom(ctx); ok {
+		t.Error("UserFrom(nil claims) ok = true, want false")
+	}
+	if _, ok := RequestIDFrom(ctx); ok {
+		t.Error("RequestIDFrom(\"\") ok = true, want false")
+	}
+	if _, ok := ClientIPFrom(ctx); ok {
+		t.Error("ClientIPFrom(\"\") ok = true, want false")
+	}
+
+	// значение с чужим ключом того же вида не находится
+	ctx = context.WithValue(context.Background(), "claims", &UserClaims{UserID: 1})
+	if _, ok := UserFrom(ctx); ok {
+		t.Error("UserFrom() found a value stored under a foreign key")
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	ctx := WithUser(context.Background(), &UserClaims{UserID: 7, Role: "admin"})
+	ctx = WithRequestID(ctx, "host/abc-000001")
+	ctx = WithClientIP(ctx, "192.0.2.1")
+	ctx = WithAPIKey(ctx, APIKey{ID: 3, Name: "billing", Scopes: []string{"reports:read"}})
+
+	if claims, ok := UserFrom(ctx); !ok || claims.UserID != 7 || claims.Role != "admin" {
+		t.Errorf("UserFrom() = %+v, %v", claims, ok)
+	}
+	if id, ok := RequestIDFrom(ctx); !ok || id != "host/abc-000001" {
+		t.Errorf("RequestIDFrom() = %q, %v", id, ok)
+	}
+	if ip, ok := ClientIPFrom(ctx); !ok || ip != "192.0.2.1" {
+		t.Errorf("ClientIPFrom() = %q, %v", ip, ok)
+	}
+	if key, ok := APIKeyFrom(ctx); !ok || key.ID != 3 || key.Name != "billing" {
+		t.Errorf("APIKeyFrom() = %+v, %v", key, ok)
+	}
+}
+
+func TestCurrentUser_LoadsOncePerRequest(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	db := storage.NewMockUserStore(ctrl)
+	alice := storage.User{ID: 7, Username: "alice", Email: "alice@example.com", Role: "user"}
+
+	// первый запрос: ошибка не кэшируется, затем пользователь загружается один раз
+	gomock.InOrder(
+		db.EXPECT().GetUserByID(gomock.Any(), 7).Return(storage.User{}, errors.New("connection refused")),
+		db.EXPECT().GetUserByID(gomock.Any(), 7).Return(alice, nil).Times(1),
+	)
+	ctx := WithUser(context.Background(), &UserClaims{UserID: 7, Username: "alice", Role: "user"})
+	if _, err := CurrentUser(ctx, db); err == nil {
+		t.Fatal("CurrentUser() error = nil, want storage error")
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if user, err := CurrentUser(ctx, db); err != nil || user != alice {
+				t.Errorf("CurrentUser() = %+v, %v, want %+v", user, err, alice)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// следующий запрос загружает пользователя заново
+	db.EXPECT().GetUserByID(gomock.Any(), 7).Return(alice, nil).Times(1)
+	ctx = WithUser(context.Background(), &UserClaims{UserID: 7})
+	for i := 0; i < 3; i++ {
+		if _, err := CurrentUser(ctx, db); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCurrentUser_Unauthenticated(t *testing.T) {
+	db := storage.NewMockUserStore(gomock.NewController(t))
+	if _, err := CurrentUser(context.Background(), db); !errors.Is(err, ErrNoUser) {
+		t.Errorf("CurrentUser(empty) error = %v, want ErrNoUser", err)
+	}
+}
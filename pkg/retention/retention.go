@@ -0,0 +1,212 @@
+// Пакет retention периодически очищает IP-адреса и User-Agent в
+// записях старше срока хранения, установленного политикой
+// конфиденциальности, удаляет завершенные доставки событий, тело которых
+// содержит данные пользователей, и устаревшие записи архива удаленных
+// реферальных кодов. Очистка идет партиями с пределом строк за проход,
+// чтобы не держать долгие блокировки; оставшиеся строки очищаются
+// следующими проходами.
+package retention
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"gorefer.go/pkg/api"
+	"gorefer.go/pkg/storage"
+)
+
+// MinMaxAge - наименьший допустимый срок хранения. Более короткий срок
+// уничтожил бы данные, нужные для разбора инцидентов и проверки
+// мошенничества, поэтому очистка с ним не запускается.
+const MinMaxAge = 30 * 24 * time.Hour
+
+// ErrTooShort - срок хранения короче MinMaxAge
+var ErrTooShort = errors.New("срок хранения персональных данных меньше допустимого")
+
+// Config - сроки хранения, период проверки и размеры партий.
+type Config struct {
+	MaxAge        time.Duration // очищать записи и удалять завершенные доставки событий старше срока
+	ArchiveMaxAge time.Duration // удалять коды из архива через этот срок после удаления
+	Interval      time.Duration // период проверки
+	BatchSize     int           // строк в одном запросе
+	MaxRows       int           // предел строк за проход по всем таблицам
+}
+
+// Параметры по умолчанию, если конфигурация их не задает.
+var DefaultConfig = Config{
+	MaxAge:        90 * 24 * time.Hour,
+	ArchiveMaxAge: 365 * 24 * time.Hour,
+	Interval:      time.Hour,
+	BatchSize:     500,
+	MaxRows:       10000,
+}
+
+// withFallback подставляет значения по умолчанию вместо незаданных.
+func (c Config) withFallback() Config {
+	if c.MaxAge <= 0 {
+		c.MaxAge = DefaultConfig.MaxAge
+	}
+	if c.ArchiveMaxAge <= 0 {
+		c.ArchiveMaxAge = DefaultConfig.ArchiveMaxAge
+	}
+	if c.Interval <= 0 {
+		c.Interval = DefaultConfig.Interval
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = DefaultConfig.BatchSize
+	}
+	if c.MaxRows <= 0 {
+		c.MaxRows = DefaultConfig.MaxRows
+	}
+	return c
+}
+
+// Validate проверяет, что срок хранения не меньше MinMaxAge.
+func (c Config) Validate() error {
+	if c = c.withFallback(); c.MaxAge < MinMaxAge {
+		return fmt.Errorf("%w: %s < %s", ErrTooShort, c.MaxAge, MinMaxAge)
+	}
+	return nil
+}
+
+// Result - итог прохода очистки
+type Result struct {
+	// очищено строк по таблицам storage.ScrubTargets и удалено записей
+	// storage.WebhookDeliveries и архива storage.CodeArchive
+	Scrubbed map[string]int64
+	Capped   bool // проход остановлен на пределе MaxRows
+}
+
+// Scrubber - фоновый компонент очистки. Подходит для api.API.Register,
+// итоги - для api.WithRetention.
+type Scrubber struct {
+	store  storage.RetentionStore
+	config Config
+	now    func() time.Time
+
+	mu    sync.Mutex
+	stats api.RetentionStats
+}
+
+// New создает компонент очистки. Срок хранения меньше MinMaxAge -
+// ошибка ErrTooShort.
+func New(store storage.RetentionStore, config Config) (*Scrubber, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	config = config.withFallback()
+	return &Scrubber{
+		store:  store,
+		config: config,
+		now:    time.Now,
+		stats: api.RetentionStats{
+			MaxAgeDays:        int(config.MaxAge / (24 * time.Hour)),
+			ArchiveMaxAgeDays: int(config.ArchiveMaxAge / (24 * time.Hour)),
+			LastRun:           map[string]int64{},
+			Total:             map[string]int64{},
+		},
+	}, nil
+}
+
+// Run выполняет очистку каждые Interval до отмены ctx.
+func (s *Scrubber) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.config.Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := s.ScrubDue(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Ошибка очистки устаревших персональных данных: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ScrubDue очищает записи и удаляет завершенные доставки событий старше
+// MaxAge, удаляет записи архива кодов старше ArchiveMaxAge партиями по BatchSize, но не больше MaxRows строк
+// за вызов. Итог учитывается в RetentionStats и при ошибке.
+func (s *Scrubber) ScrubDue(ctx context.Context) (res Result, err error) {
+	res.Scrubbed = map[string]int64{}
+	defer func() { s.record(res) }()
+
+	now := s.now()
+	before := now.Add(-s.config.MaxAge)
+	remaining := s.config.MaxRows
+	for _, target := range storage.ScrubTargets {
+		err := s.batches(&res, target, &remaining, func(limit int) (int, error) {
+			return s.store.ScrubPersonalData(ctx, target, before, limit)
+		})
+		if err != nil || res.Capped {
+			return res, err
+		}
+	}
+	err = s.batches(&res, storage.WebhookDeliveries, &remaining, func(limit int) (int, error) {
+		return s.store.PurgeWebhookDeliveries(ctx, before, limit)
+	})
+	if err != nil || res.Capped {
+		return res, err
+	}
+	err = s.batches(&res, storage.CodeArchive, &remaining, func(limit int) (int, error) {
+		return s.store.PurgeCodeArchive(ctx, now.Add(-s.config.ArchiveMaxAge), limit)
+	})
+	return res, err
+}
+
+// batches вызывает run партиями, пока таблица target не исчерпана или
+// не достигнут предел remaining. Достижение предела отмечается в
+// res.Capped.
+func (s *Scrubber) batches(res *Result, target string, remaining *int, run func(limit int) (int, error)) error {
+	for {
+		if *remaining == 0 {
+			res.Capped = true
+			return nil
+		}
+		limit := min(s.config.BatchSize, *remaining)
+		n, err := run(limit)
+		res.Scrubbed[target] += int64(n)
+		*remaining -= n
+		if err != nil || n < limit {
+			return err
+		}
+	}
+}
+
+// record учитывает итог прохода.
+func (s *Scrubber) record(res Result) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now().UTC()
+	s.stats.LastRunAt = &now
+	s.stats.LastRun = res.Scrubbed
+	s.stats.Capped = res.Capped
+	var total int64
+	for target, n := range res.Scrubbed {
+		s.stats.Total[target] += n
+		total += n
+	}
+	if total > 0 {
+		log.Printf("Очищены устаревшие персональные данные: %v", res.Scrubbed)
+	}
+}
+
+// RetentionStats возвращает итоги очистки для api.WithRetention.
+func (s *Scrubber) RetentionStats() api.RetentionStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := s.stats
+	stats.LastRun = map[string]int64{}
+	for target, n := range s.stats.LastRun {
+		stats.LastRun[target] = n
+	}
+	stats.Total = map[string]int64{}
+	for target, n := range s.stats.Total {
+		stats.Total[target] = n
+	}
+	return stats
+}
@@ -0,0 +1,228 @@
+package retention
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"gorefer.go/pkg/api/apitest"
+	"gorefer.go/pkg/storage"
+)
+
+const day = 24 * time.Hour
+
+// newStore создает хранилище на часах clock с пользователями, которые
+// зарегистрировались и вошли ages назад.
+func newStore(t *testing.T, now *time.Time, ages map[string]time.Duration) (*apitest.Store, map[string]int) {
+	t.Helper()
+	ctx := context.Background()
+	store := apitest.NewStore()
+	start := *now
+	ids := map[string]int{}
+	for name, age := range ages {
+		*now = start.Add(-age)
+		store.SetNow(func() time.Time { return *now })
+		id, err := store.CreateUser(ctx, storage.CreateUserParams{
+			User: storage.User{Username: name, Email: name + "@example.com"},
+			IP:   "203.0.113.7", UserAgent: "Mozilla/5.0",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := store.RecordLogin(ctx, storage.LoginEvent{UserID: id, IP: "203.0.113.7", UserAgent: "Mozilla/5.0", Success: true}); err != nil {
+			t.Fatal(err)
+		}
+		ids[name] = id
+	}
+	*now = start
+	return store, ids
+}
+
+// scrubbed сообщает, очищены ли данные регистрации и входа пользователя.
+func scrubbed(t *testing.T, store *apitest.Store, id int) bool {
+	t.Helper()
+	ip, ua := store.SignupMetadata(id)
+	events, err := store.ListLoginEvents(context.Background(), id, 10, 0)
+	if err != nil || len(events) != 1 {
+		t.Fatalf("ListLoginEvents() = %v, %v", events, err)
+	}
+	return ip == "" && ua == "" && events[0].IP == "" && events[0].UserAgent == ""
+}
+
+func TestScrubber_ScrubsOnlyOldRows(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	store, ids := newStore(t, &now, map[string]time.Duration{
+		"fresh":   day,
+		"edge":    90*day - time.Minute,
+		"old":     90*day + time.Minute,
+		"ancient": 400 * day,
+	})
+	s, err := New(store, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.now = func() time.Time { return now }
+
+	res, err := s.ScrubDue(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Scrubbed[storage.ScrubLoginEvents] != 2 || res.Scrubbed[storage.ScrubSignups] != 2 || res.Capped {
+		t.Errorf("ScrubDue() = %+v, want 2 login events and 2 signups", res)
+	}
+	for name, want := range map[string]bool{"fresh": false, "edge": false, "old": true, "ancient": true} {
+		if got := scrubbed(t, store, ids[name]); got != want {
+			t.Errorf("%s scrubbed = %v, want %v", name, got, want)
+		}
+	}
+
+	// строки стареют со временем
+	now = now.Add(time.Hour)
+	if res, err := s.ScrubDue(ctx); err != nil || res.Scrubbed[storage.ScrubSignups] != 1 {
+		t.Errorf("pass after an hour = %+v, %v; want edge scrubbed", res, err)
+	}
+	if !scrubbed(t, store, ids["edge"]) || scrubbed(t, store, ids["fresh"]) {
+		t.Error("want edge scrubbed and fresh kept")
+	}
+}
+
+func TestScrubber_StopsAtCap(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	ages := map[string]time.Duration{}
+	for i := 0; i < 7; i++ {
+		ages[fmt.Sprintf("user%d", i)] = 100*day + time.Duration(i)*time.Minute
+	}
+	store, _ := newStore(t, &now, ages)
+	s, err := New(store, Config{BatchSize: 2, MaxRows: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.now = func() time.Time { return now }
+
+	// 7 входов и 7 регистраций при пределе 5 строк за проход
+	tests := []struct {
+		logins, signups int64
+		capped          bool
+	}{
+		{5, 0, true},
+		{2, 3, true},
+		{0, 4, false},
+		{0, 0, false},
+	}
+	for i, tt := range tests {
+		res, err := s.ScrubDue(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Scrubbed[storage.ScrubLoginEvents] != tt.logins || res.Scrubbed[storage.ScrubSignups] != tt.signups || res.Capped != tt.capped {
+			t.Errorf("pass %d = %+v, want %d logins, %d signups, capped %v", i, res, tt.logins, tt.signups, tt.capped)
+		}
+	}
+
+	stats := s.RetentionStats()
+	if stats.MaxAgeDays != 90 || stats.LastRunAt == nil || stats.Total[storage.ScrubLoginEvents] != 7 || stats.Total[storage.ScrubSignups] != 7 {
+		t.Errorf("RetentionStats() = %+v, want 7 rows of each table in total", stats)
+	}
+}
+
+func TestNew_RefusesShortRetention(t *testing.T) {
+	tests := []struct {
+		name    string
+		maxAge  time.Duration
+		wantErr bool
+	}{
+		{"Default", 0, false},
+		{"Floor", MinMaxAge, false},
+		{"Below floor", MinMaxAge - time.Hour, true},
+		{"One day", day, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := New(apitest.NewStore(), Config{MaxAge: tt.maxAge})
+			if got := errors.Is(err, ErrTooShort); got != tt.wantErr || (s == nil) != tt.wantErr {
+				t.Errorf("New() = %v, %v; want ErrTooShort %v", s, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestScrubber_PurgesCodeArchive(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	store, ids := newStore(t, &now, map[string]time.Duration{"alice": 500 * day})
+	expires := now.Add(30 * day).Unix()
+	for code, age := range map[string]time.Duration{"OLD": 400 * day, "RECENT": 10 * day} {
+		now = now.Add(-age)
+		if err := store.CreateReferralCode(ctx, ids["alice"], code, expires, "", nil, storage.DomainRestriction{}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.DeleteReferralCodeByCode(ctx, code, ids["alice"]); err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(age)
+	}
+	s, err := New(store, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.now = func() time.Time { return now }
+
+	res, err := s.ScrubDue(ctx)
+	if err != nil || res.Scrubbed[storage.CodeArchive] != 1 {
+		t.Fatalf("ScrubDue() = %+v, %v; want 1 archived code purged", res, err)
+	}
+	codes, err := store.CompareReferralCodes(ctx, ids["alice"], true)
+	if err != nil || len(codes) != 1 || codes[0].Code != "RECENT" {
+		t.Errorf("archived codes after purge = %+v, %v; want RECENT", codes, err)
+	}
+	if stats := s.RetentionStats(); stats.ArchiveMaxAgeDays != 365 {
+		t.Errorf("ArchiveMaxAgeDays = %d, want 365", stats.ArchiveMaxAgeDays)
+	}
+}
+
+func TestScrubber_PurgesWebhookDeliveries(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	store, _ := newStore(t, &now, nil)
+	store.SetNow(func() time.Time { return now })
+	finish := func(age time.Duration, status string) {
+		now = now.Add(-age)
+		if err := store.EnqueueWebhook(ctx, "user.registered", json.RawMessage(`{"data": {}}`), []string{"https://hooks.example.com"}); err != nil {
+			t.Fatal(err)
+		}
+		deliveries, err := store.ListWebhookDeliveries(ctx, storage.WebhookDeliveryFilter{}, 1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != storage.WebhookPending {
+			if _, err := store.RecordWebhookAttempt(ctx, deliveries[0].ID, storage.WebhookAttempt{Status: status}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		now = now.Add(age)
+	}
+	finish(200*day, storage.WebhookDelivered)
+	finish(200*day, storage.WebhookFailed)
+	finish(200*day, storage.WebhookPending)
+	finish(10*day, storage.WebhookDelivered)
+
+	s, err := New(store, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.now = func() time.Time { return now }
+
+	res, err := s.ScrubDue(ctx)
+	if err != nil || res.Scrubbed[storage.WebhookDeliveries] != 2 {
+		t.Fatalf("ScrubDue() = %+v, %v; want 2 finished deliveries purged", res, err)
+	}
+	left, err := store.ListWebhookDeliveries(ctx, storage.WebhookDeliveryFilter{}, 10, 0)
+	if err != nil || len(left) != 2 {
+		t.Errorf("deliveries after purge = %+v, %v; want the pending and the recent one", left, err)
+	}
+}
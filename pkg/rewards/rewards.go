@@ -0,0 +1,71 @@
+// Пакет rewards описывает ступени вознаграждения рефереров: сумма за
+// приглашенного пользователя зависит от его порядкового номера.
+package rewards
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidTiers оборачивает все ошибки проверки ступеней.
+var ErrInvalidTiers = errors.New("некорректные ступени вознаграждения")
+
+// Tier - ступень вознаграждения. UpTo - накопительная граница: ступень
+// действует для рефералов с номерами от предыдущей границы + 1 до UpTo.
+type Tier struct {
+	UpTo   int   `json:"up_to"`
+	Amount int64 `json:"amount"`
+}
+
+// Tiers - упорядоченный список ступеней. Рефералы после последней
+// границы не вознаграждаются. Пустой список - вознаграждений нет.
+type Tiers []Tier
+
+// Active - ступень, по которой будет вознагражден следующий реферал.
+type Active struct {
+	Tier      int   `json:"tier"` // номер ступени, с 1
+	UpTo      int   `json:"up_to"`
+	Amount    int64 `json:"amount"`
+	Remaining int   `json:"remaining"` // рефералов до перехода на следующую ступень
+}
+
+// Validate проверяет, что границы положительны и строго возрастают,
+// а суммы неотрицательны.
+func (ts Tiers) Validate() error {
+	prev := 0
+	for i, t := range ts {
+		if t.UpTo <= prev {
+			return fmt.Errorf("%w: ступень %d: up_to %d должно быть больше %d", ErrInvalidTiers, i+1, t.UpTo, prev)
+		}
+		if t.Amount < 0 {
+			return fmt.Errorf("%w: ступень %d: отрицательная сумма %d", ErrInvalidTiers, i+1, t.Amount)
+		}
+		prev = t.UpTo
+	}
+	return nil
+}
+
+// For возвращает номер ступени (с 1) и сумму для n-го по счету
+// реферала. ok равно false, если n за пределами всех ступеней.
+func (ts Tiers) For(n int) (tier int, amount int64, ok bool) {
+	if n <= 0 {
+		return 0, 0, false
+	}
+	for i, t := range ts {
+		if n <= t.UpTo {
+			return i + 1, t.Amount, true
+		}
+	}
+	return 0, 0, false
+}
+
+// Active возвращает ступень для следующего реферала при count уже
+// приглашенных. nil - вознаграждений больше нет.
+func (ts Tiers) Active(count int) *Active {
+	tier, amount, ok := ts.For(count + 1)
+	if !ok {
+		return nil
+	}
+	upTo := ts[tier-1].UpTo
+	return &Active{Tier: tier, UpTo: upTo, Amount: amount, Remaining: upTo - count}
+}
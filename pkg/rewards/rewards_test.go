@@ -0,0 +1,83 @@
+package rewards
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// первые 5 рефералов - 100, следующие 20 - 30, дальше ничего
+var productTiers = Tiers{{UpTo: 5, Amount: 100}, {UpTo: 25, Amount: 30}}
+
+func TestTiers_For(t *testing.T) {
+	tests := []struct {
+		n          int
+		wantTier   int
+		wantAmount int64
+		wantOK     bool
+	}{
+		{0, 0, 0, false},
+		{1, 1, 100, true},
+		{5, 1, 100, true},
+		{6, 2, 30, true},
+		{25, 2, 30, true},
+		{26, 0, 0, false},
+		{1000, 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		tier, amount, ok := productTiers.For(tt.n)
+		if tier != tt.wantTier || amount != tt.wantAmount || ok != tt.wantOK {
+			t.Errorf("For(%d) = %d, %d, %v, want %d, %d, %v", tt.n, tier, amount, ok, tt.wantTier, tt.wantAmount, tt.wantOK)
+		}
+	}
+
+	if _, _, ok := Tiers(nil).For(1); ok {
+		t.Error("empty tiers: For(1) ok = true, want false")
+	}
+}
+
+func TestTiers_Active(t *testing.T) {
+	tests := []struct {
+		count int
+		want  *Active
+	}{
+		{0, &Active{Tier: 1, UpTo: 5, Amount: 100, Remaining: 5}},
+		{4, &Active{Tier: 1, UpTo: 5, Amount: 100, Remaining: 1}},
+		{5, &Active{Tier: 2, UpTo: 25, Amount: 30, Remaining: 20}},
+		{24, &Active{Tier: 2, UpTo: 25, Amount: 30, Remaining: 1}},
+		{25, nil},
+	}
+
+	for _, tt := range tests {
+		if got := productTiers.Active(tt.count); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Active(%d) = %+v, want %+v", tt.count, got, tt.want)
+		}
+	}
+}
+
+func TestTiers_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		tiers   Tiers
+		wantErr bool
+	}{
+		{"Empty", nil, false},
+		{"Valid", productTiers, false},
+		{"Zero bound", Tiers{{UpTo: 0, Amount: 1}}, true},
+		{"Not increasing", Tiers{{UpTo: 5, Amount: 1}, {UpTo: 5, Amount: 1}}, true},
+		{"Negative amount", Tiers{{UpTo: 5, Amount: -1}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.tiers.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidTiers) {
+				t.Errorf("Validate() error = %v, want ErrInvalidTiers", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+// Пакет statements раз в месяц отправляет рефереру по email выписку по
+// вознаграждениям за прошедший месяц с CSV-файлом операций. Выписки
+// создаются в хранилище один раз на пользователя и месяц; письма
+// отправляются партиями, выбор которых исключает повторную отправку
+// другим экземпляром сервиса и продолжается после перезапуска.
+package statements
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"strconv"
+	"time"
+
+	"gorefer.go/pkg/api"
+	"gorefer.go/pkg/mailer"
+	"gorefer.go/pkg/storage"
+)
+
+// Шаблон письма с выпиской
+const template = "reward_statement"
+
+// Число выписок, выбираемых за один проход
+const batchSize = 50
+
+// Время, на которое выписка закрепляется за экземпляром на время
+// отправки. Если экземпляр остановится, не отправив письмо, выписку
+// выберет следующий проход после истечения срока.
+const claimLease = 10 * time.Minute
+
+// Config - период проверки.
+type Config struct {
+	Interval time.Duration // период проверки
+}
+
+// Параметры по умолчанию, если конфигурация их не задает.
+var DefaultConfig = Config{
+	Interval: time.Hour,
+}
+
+// withFallback подставляет значения по умолчанию вместо незаданных.
+func (c Config) withFallback() Config {
+	if c.Interval <= 0 {
+		c.Interval = DefaultConfig.Interval
+	}
+	return c
+}
+
+// Sender - фоновый компонент выписок. Подходит для api.API.Register.
+type Sender struct {
+	store     storage.StatementStore
+	mailer    api.Mailer
+	templates *mailer.Templates
+	config    Config
+	now       func() time.Time
+}
+
+// New создает компонент выписок. templates nil - встроенные шаблоны.
+func New(store storage.StatementStore, m api.Mailer, templates *mailer.Templates, config Config) *Sender {
+	if templates == nil {
+		templates = mailer.DefaultTemplates()
+	}
+	return &Sender{store: store, mailer: m, templates: templates, config: config.withFallback(), now: time.Now}
+}
+
+// Run создает и отправляет выписки каждые Interval до отмены ctx.
+func (s *Sender) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.config.Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := s.SendDue(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Ошибка отправки выписок по вознаграждениям: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// SendDue создает выписки за прошедший месяц, если их еще нет, и
+// отправляет неотправленные. Возвращает число отправленных писем.
+// Выписка, письмо с которой не отправлено, будет выбрана снова при
+// следующей проверке.
+func (s *Sender) SendDue(ctx context.Context) (int, error) {
+	period := storage.StatementPeriod(s.now()).AddDate(0, -1, 0)
+	if _, err := s.store.GenerateStatements(ctx, period); err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for {
+		statements, err := s.store.ClaimStatements(ctx, batchSize, claimLease)
+		if err != nil {
+			return sent, err
+		}
+		failed := false
+		for _, st := range statements {
+			if err := s.send(ctx, st); err != nil {
+				log.Printf("Ошибка отправки выписки %d: %v", st.ID, err)
+				// закрепление снимается и после отмены ctx, чтобы не ждать истечения срока
+				if err := s.store.ReleaseStatement(context.WithoutCancel(ctx), st.ID); err != nil {
+					log.Printf("Ошибка снятия закрепления выписки %d: %v", st.ID, err)
+				}
+				failed = true
+				continue
+			}
+			if err := s.store.MarkStatementSent(context.WithoutCancel(ctx), st.ID); err != nil {
+				return sent, err
+			}
+			sent++
+		}
+		// после ошибки отправки следующая партия выбрала бы те же выписки
+		if len(statements) < batchSize || failed || ctx.Err() != nil {
+			return sent, ctx.Err()
+		}
+	}
+}
+
+// send отправляет выписку с CSV-файлом операций за месяц.
+func (s *Sender) send(ctx context.Context, st storage.ClaimedStatement) error {
+	period, err := time.Parse(storage.StatementPeriodLayout, st.Period)
+	if err != nil {
+		return err
+	}
+	entries, err := s.store.ListLedgerEntries(ctx, st.UserID, period)
+	if err != nil {
+		return err
+	}
+	var csv bytes.Buffer
+	if err := api.WriteStatementCSV(&csv, entries, api.UserLocation(st.Timezone)); err != nil {
+		return err
+	}
+
+	msg, err := s.templates.Render(template, mailer.Vars{
+		"Username": st.Username,
+		"Period":   st.Period,
+		"Earned":   strconv.FormatInt(st.Earned, 10),
+		"Redeemed": strconv.FormatInt(st.Redeemed, 10),
+		"Entries":  strconv.Itoa(st.Entries),
+	})
+	if err != nil {
+		return err
+	}
+	msg.Attachments = []mailer.Attachment{{
+		Filename:    api.StatementFilename(period),
+		ContentType: "text/csv; charset=utf-8",
+		Data:        csv.Bytes(),
+	}}
+	return s.mailer.Send(ctx, st.Email, msg)
+}
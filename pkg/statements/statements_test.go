@@ -0,0 +1,209 @@
+package statements
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gorefer.go/pkg/api/apitest"
+	"gorefer.go/pkg/mailer"
+	"gorefer.go/pkg/storage"
+)
+
+// fakeMailer запоминает отправленные письма; пока fail задан, отправка
+// не удается.
+type fakeMailer struct {
+	mu   sync.Mutex
+	fail error
+	sent map[string][]mailer.Message
+}
+
+func (m *fakeMailer) Send(ctx context.Context, to string, msg mailer.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.fail != nil {
+		return m.fail
+	}
+	if m.sent == nil {
+		m.sent = map[string][]mailer.Message{}
+	}
+	m.sent[to] = append(m.sent[to], msg)
+	return nil
+}
+
+func (m *fakeMailer) count(to string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.sent[to])
+}
+
+// newUser создает пользователя name с адресом name@example.com.
+func newUser(t *testing.T, store *apitest.Store, name string) int {
+	t.Helper()
+	id, err := store.CreateUser(context.Background(), storage.CreateUserParams{User: storage.User{Username: name, Email: name + "@example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestSender_SendsOncePerMonth(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2026, 9, 10, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	store := apitest.NewStore()
+	store.SetNow(clock)
+
+	alice, bob := newUser(t, store, "alice"), newUser(t, store, "bob")
+	newUser(t, store, "carol")
+	referee := newUser(t, store, "dave")
+	store.AddReward(alice, referee, 500)
+	now = now.Add(24 * time.Hour)
+	if _, err := store.RedeemReward(ctx, alice, 200, "gift card"); err != nil {
+		t.Fatal(err)
+	}
+	// операция октября попадет только в следующую выписку
+	now = time.Date(2026, 10, 2, 9, 0, 0, 0, time.UTC)
+	store.AddReward(bob, referee, 300)
+
+	m := &fakeMailer{}
+	s := New(store, m, nil, Config{})
+	s.now = clock
+
+	sent, err := s.SendDue(ctx)
+	if err != nil || sent != 1 {
+		t.Fatalf("first pass = %d, %v; want 1", sent, err)
+	}
+	for name, want := range map[string]int{"alice": 1, "bob": 0, "carol": 0} {
+		if got := m.count(name + "@example.com"); got != want {
+			t.Errorf("statements to %s = %d, want %d", name, got, want)
+		}
+	}
+	msg := m.sent["alice@example.com"][0]
+	if !strings.Contains(msg.Text, "начислено 500, списано 200, операций 2") {
+		t.Errorf("statement text = %q, want totals", msg.Text)
+	}
+	if len(msg.Attachments) != 1 || msg.Attachments[0].Filename != "rewards_2026-09.csv" {
+		t.Fatalf("attachments = %+v, want rewards_2026-09.csv", msg.Attachments)
+	}
+	wantCSV := "date,type,amount,details\n" +
+		"2026-09-10T12:00:00Z,reward,500,dave\n" +
+		"2026-09-11T12:00:00Z,redemption,-200,gift card\n"
+	if got := string(msg.Attachments[0].Data); got != wantCSV {
+		t.Errorf("attachment = %q, want %q", got, wantCSV)
+	}
+
+	// повторные проходы в том же месяце не создают и не отправляют выписок
+	for i := 0; i < 2; i++ {
+		if sent, err := s.SendDue(ctx); err != nil || sent != 0 {
+			t.Errorf("rerun %d = %d, %v; want 0", i, sent, err)
+		}
+	}
+	if list, _ := store.ListRewardStatements(ctx, alice); len(list) != 1 || list[0].SentAt == nil {
+		t.Errorf("alice statements = %+v, want one sent", list)
+	}
+
+	// в следующем месяце - выписка за октябрь
+	now = time.Date(2026, 11, 1, 0, 30, 0, 0, time.UTC)
+	if sent, err := s.SendDue(ctx); err != nil || sent != 1 {
+		t.Errorf("pass in November = %d, %v; want 1", sent, err)
+	}
+	if got := m.count("bob@example.com"); got != 1 {
+		t.Errorf("statements to bob = %d, want 1", got)
+	}
+}
+
+func TestSender_ResumesInterruptedRun(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2026, 9, 10, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	store := apitest.NewStore()
+	store.SetNow(clock)
+	referee := newUser(t, store, "referee")
+	for i := 0; i < batchSize+10; i++ {
+		store.AddReward(newUser(t, store, fmt.Sprintf("user%03d", i)), referee, 100)
+	}
+	now = time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+
+	// экземпляр выбрал первую партию и остановился, не отправив писем
+	if _, err := store.GenerateStatements(ctx, now.AddDate(0, -1, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if claimed, err := store.ClaimStatements(ctx, batchSize, claimLease); err != nil || len(claimed) != batchSize {
+		t.Fatalf("ClaimStatements() = %d, %v", len(claimed), err)
+	}
+
+	m := &fakeMailer{}
+	s := New(store, m, nil, Config{})
+	s.now = clock
+	if sent, err := s.SendDue(ctx); err != nil || sent != 10 {
+		t.Fatalf("pass during lease = %d, %v; want 10", sent, err)
+	}
+	now = now.Add(claimLease)
+	if sent, err := s.SendDue(ctx); err != nil || sent != batchSize {
+		t.Fatalf("pass after lease = %d, %v; want %d", sent, err, batchSize)
+	}
+	for i := 0; i < batchSize+10; i++ {
+		if got := m.count(fmt.Sprintf("user%03d@example.com", i)); got != 1 {
+			t.Errorf("statements to user%03d = %d, want 1", i, got)
+		}
+	}
+}
+
+func TestSender_ConcurrentReplicas(t *testing.T) {
+	now := time.Date(2026, 9, 10, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	store := apitest.NewStore()
+	store.SetNow(clock)
+	referee := newUser(t, store, "referee")
+	for i := 0; i < 3*batchSize; i++ {
+		store.AddReward(newUser(t, store, fmt.Sprintf("user%03d", i)), referee, 100)
+	}
+	now = time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	m := &fakeMailer{}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s := New(store, m, nil, Config{})
+			s.now = clock
+			if _, err := s.SendDue(context.Background()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i := 0; i < 3*batchSize; i++ {
+		if got := m.count(fmt.Sprintf("user%03d@example.com", i)); got != 1 {
+			t.Errorf("statements to user%03d = %d, want 1", i, got)
+		}
+	}
+}
+
+func TestSender_RetriesFailedSend(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2026, 9, 10, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	store := apitest.NewStore()
+	store.SetNow(clock)
+	store.AddReward(newUser(t, store, "alice"), newUser(t, store, "bob"), 100)
+	now = now.AddDate(0, 1, 0)
+
+	m := &fakeMailer{fail: errors.New("smtp unavailable")}
+	s := New(store, m, nil, Config{})
+	s.now = clock
+	if sent, err := s.SendDue(ctx); err != nil || sent != 0 {
+		t.Fatalf("pass with failing mailer = %d, %v; want 0", sent, err)
+	}
+	m.fail = nil
+	if sent, err := s.SendDue(ctx); err != nil || sent != 1 {
+		t.Errorf("pass after recovery = %d, %v; want 1", sent, err)
+	}
+}
@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	pgxv4 "github.com/jackc/pgx/v4"
+)
+
+// Ключ API для вызовов между сервисами. Сам ключ не хранится, только
+// его хэш; Prefix - начало ключа, по которому его узнает администратор.
+type APIKey struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedBy  *int       `json:"created_by"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+// Параметры нового ключа API
+type NewAPIKey struct {
+	Name      string
+	Prefix    string
+	KeyHash   string // хэш ключа, по которому он ищется в UseAPIKey
+	Scopes    []string
+	CreatedBy int // администратор, создавший ключ
+}
+
+// HasScope сообщает, разрешена ли ключу область scope.
+func (k APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Создание ключа API. Создание фиксируется в журнале аудита от имени
+// k.CreatedBy.
+func (db *DB) CreateAPIKey(ctx context.Context, k NewAPIKey) (_ APIKey, err error) {
+	defer wrapError(&err, "create api key name=%s", k.Name)
+	var key APIKey
+	err = db.pool.BeginFunc(ctx, func(tx pgxv4.Tx) error {
+		err := tx.QueryRow(ctx, `
+        INSERT INTO api_keys (name, prefix, key_hash, scopes, created_by)
+        VALUES ($1, $2, $3, $4, $5)
+        RETURNING id, name, prefix, scopes, created_by, created_at`,
+			k.Name, k.Prefix, k.KeyHash, k.Scopes, k.CreatedBy).
+			Scan(&key.ID, &key.Name, &key.Prefix, &key.Scopes, &key.CreatedBy, &key.CreatedAt)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `
+        INSERT INTO audit_log (actor_id, action, payload)
+        VALUES ($1, $2, $3)`,
+			k.CreatedBy,
+			AuditAPIKeyCreated,
+			map[string]interface{}{"key_id": key.ID, "name": key.Name, "scopes": key.Scopes},
+		)
+		return err
+	})
+	if err != nil {
+		return APIKey{}, err
+	}
+	return key, nil
+}
+
+// Поиск действующего ключа по хэшу с отметкой времени использования.
+// Отозванный или неизвестный ключ - ErrNotFound; отзыв действует с
+// первого же запроса после него.
+func (db *DB) UseAPIKey(ctx context.Context, keyHash string) (_ APIKey, err error) {
+	defer wrapError(&err, "use api key")
+	var key APIKey
+	err = db.pool.QueryRow(ctx, `
+        UPDATE api_keys SET last_used_at = NOW()
+        WHERE key_hash = $1 AND revoked_at IS NULL
+        RETURNING id, name, prefix, scopes, created_by, created_at, last_used_at`, keyHash).
+		Scan(&key.ID, &key.Name, &key.Prefix, &key.Scopes, &key.CreatedBy, &key.CreatedAt, &key.LastUsedAt)
+	if errors.Is(err, pgxv4.ErrNoRows) {
+		return APIKey{}, ErrNotFound
+	}
+	if err != nil {
+		return APIKey{}, err
+	}
+	return key, nil
+}
+
+// Все ключи API, включая отозванные, в порядке создания
+func (db *DB) ListAPIKeys(ctx context.Context) (_ []APIKey, err error) {
+	defer wrapError(&err, "list api keys")
+	rows, err := db.pool.Query(ctx, `
+        SELECT id, name, prefix, scopes, created_by, created_at, last_used_at, revoked_at
+        FROM api_keys
+        ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		var k APIKey
+		if err := rows.Scan(&k.ID, &k.Name, &k.Prefix, &k.Scopes, &k.CreatedBy, &k.CreatedAt, &k.LastUsedAt, &k.RevokedAt); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// Отзыв ключа API. Действие фиксируется в журнале аудита от имени
+// администратора actorID. Если ключа нет или он уже отозван - ErrNotFound.
+func (db *DB) RevokeAPIKey(ctx context.Context, id, actorID int) (err error) {
+	defer wrapError(&err, "revoke api key id=%d", id)
+	return db.pool.BeginFunc(ctx, func(tx pgxv4.Tx) error {
+		var name string
+		err := tx.QueryRow(ctx, `
+        UPDATE api_keys SET revoked_at = NOW()
+        WHERE id = $1 AND revoked_at IS NULL
+        RETURNING name`, id).Scan(&name)
+		if errors.Is(err, pgxv4.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `
+        INSERT INTO audit_log (actor_id, action, payload)
+        VALUES ($1, $2, $3)`,
+			actorID,
+			AuditAPIKeyRevoked,
+			map[string]interface{}{"key_id": id, "name": name},
+		)
+		return err
+	})
+}
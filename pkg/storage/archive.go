@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	pgxv4 "github.com/jackc/pgx/v4"
+)
+
+// CodeArchive - таблица удаленных реферальных кодов. Коды попадают в нее
+// при замене и удалении, чтобы статистика и сравнение кодов с
+// include_archived сохраняли историю. Регистрация по архивному коду
+// невозможна: код ищется только в referral_codes.
+const CodeArchive = "referral_codes_archive"
+
+// Столбцы referral_codes, копируемые в архив
+const archiveColumns = `id, user_id, code, expires_at, created_at, uses, max_uses,
+    revoked_at, status, reserved_email, client_token, metadata, label,
+    allowed_domain, allow_subdomains, reminded_at`
+
+// archiveCodes копирует в архив коды, выбранные условием where по
+// referral_codes, вместе с числом их переходов. Вызывается в транзакции
+// перед удалением кодов: переходы удаляются вместе с кодом.
+func archiveCodes(ctx context.Context, tx pgxv4.Tx, where string, args ...interface{}) error {
+	_, err := tx.Exec(ctx, `
+        INSERT INTO referral_codes_archive (`+archiveColumns+`, clicks)
+        SELECT `+archiveColumns+`,
+            (SELECT COUNT(*) FROM referral_clicks c WHERE c.referral_code_id = referral_codes.id)
+        FROM referral_codes
+        WHERE `+where+`
+        ON CONFLICT (id) DO NOTHING`, args...)
+	return err
+}
+
+// Удаление не более limit записей архива кодов, удаленных раньше before.
+// Возвращает число удаленных записей; меньше limit - устаревших записей
+// не осталось.
+func (db *DB) PurgeCodeArchive(ctx context.Context, before time.Time, limit int) (_ int, err error) {
+	defer wrapError(&err, "purge code archive before=%s", before.Format(time.RFC3339))
+	tag, err := db.pool.Exec(ctx, `
+        DELETE FROM referral_codes_archive
+        WHERE id IN (
+            SELECT id FROM referral_codes_archive
+            WHERE archived_at < $1
+            ORDER BY archived_at
+            LIMIT $2
+            FOR UPDATE SKIP LOCKED
+        )`, before, limit)
+	if err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), nil
+}
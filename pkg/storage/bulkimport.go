@@ -0,0 +1,523 @@
+package storage
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	pgxv4 "github.com/jackc/pgx/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Источник регистрации и канал атрибуции пользователей и связей,
+// перенесенных из прежней системы командой "gorefer import"
+const (
+	SourceImport  = "import"
+	ChannelImport = "import"
+)
+
+// Число строк, загружаемых одной транзакцией
+const importChunkSize = 1000
+
+// Ключ рекомендательной блокировки, сериализующей одновременные импорты
+const importLockID = 7_204_520
+
+// Пользователь из файла импорта
+type ImportUser struct {
+	Line         int // строка файла, для отчета об отклоненных строках
+	Username     string
+	Email        string
+	PasswordHash string    // хеш bcrypt, сохраняется как есть
+	Role         string    // пустая - RoleUser
+	CreatedAt    time.Time // нулевое - время импорта
+}
+
+// Реферальная связь из файла импорта. Пользователи указываются email: они
+// могут быть загружены тем же импортом или уже быть в БД.
+type ImportLink struct {
+	Line          int
+	ReferrerEmail string
+	RefereeEmail  string
+	Code          string    // код, по которому пришел реферал; пустой - неизвестен
+	CreatedAt     time.Time // нулевое - время импорта
+}
+
+// Данные импорта
+type ImportData struct {
+	Users []ImportUser
+	Links []ImportLink
+}
+
+// Отклоненная строка файла импорта
+type ImportReject struct {
+	File   string // "users" или "links"
+	Line   int
+	Key    string // email пользователя или реферала
+	Reason string
+}
+
+// Итог импорта
+type ImportResult struct {
+	UsersImported int
+	UsersSkipped  int // email уже есть в БД
+	LinksImported int
+	LinksSkipped  int // у реферала уже есть реферер
+	Rejects       []ImportReject
+}
+
+// Названия файлов импорта в ImportReject
+const (
+	importUsersFile = "users"
+	importLinksFile = "links"
+)
+
+// Колонки файлов импорта. Колонки без пометки обязательны.
+var (
+	importUserColumns = []string{"username", "email", "password_hash", "created_at?", "role?"}
+	importLinkColumns = []string{"referrer_email", "referee_email", "created_at?", "code?"}
+)
+
+// ReadImportUsers читает CSV-файл пользователей с заголовком username,
+// email, password_hash и необязательными created_at (RFC 3339) и role.
+// Строки, которые не удалось разобрать, возвращаются как отклоненные;
+// ошибка - только если файл не читается или в заголовке нет колонок.
+func ReadImportUsers(r io.Reader) ([]ImportUser, []ImportReject, error) {
+	var users []ImportUser
+	rejects, err := readImportCSV(r, importUsersFile, importUserColumns, "email", func(line int, row map[string]string) error {
+		u := ImportUser{
+			Line:         line,
+			Username:     row["username"],
+			Email:        row["email"],
+			PasswordHash: row["password_hash"],
+			Role:         row["role"],
+		}
+		var err error
+		if u.CreatedAt, err = parseImportTime(row["created_at"]); err != nil {
+			return err
+		}
+		users = append(users, u)
+		return nil
+	})
+	return users, rejects, err
+}
+
+// ReadImportLinks читает CSV-файл связей с заголовком referrer_email,
+// referee_email и необязательными created_at (RFC 3339) и code.
+func ReadImportLinks(r io.Reader) ([]ImportLink, []ImportReject, error) {
+	var links []ImportLink
+	rejects, err := readImportCSV(r, importLinksFile, importLinkColumns, "referee_email", func(line int, row map[string]string) error {
+		l := ImportLink{
+			Line:          line,
+			ReferrerEmail: row["referrer_email"],
+			RefereeEmail:  row["referee_email"],
+			Code:          row["code"],
+		}
+		var err error
+		if l.CreatedAt, err = parseImportTime(row["created_at"]); err != nil {
+			return err
+		}
+		links = append(links, l)
+		return nil
+	})
+	return links, rejects, err
+}
+
+// readImportCSV читает CSV с заголовком и передает строки parse по
+// названиям колонок. Колонка с "?" в конце необязательна; значение
+// колонки key указывается в отчете об отклоненной строке.
+func readImportCSV(r io.Reader, file string, columns []string, key string, parse func(line int, row map[string]string) error) ([]ImportReject, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1 // число полей проверяется ниже, чтобы не прерывать чтение
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%s: заголовок: %w", file, err)
+	}
+	index := make(map[string]int, len(header))
+	for i, name := range header {
+		index[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, c := range columns {
+		if _, ok := index[c]; !ok && !strings.HasSuffix(c, "?") {
+			return nil, fmt.Errorf("%s: нет колонки %s", file, c)
+		}
+	}
+
+	var rejects []ImportReject
+	for {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return rejects, nil
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			rejects = append(rejects, ImportReject{File: file, Line: parseErr.Line, Reason: parseErr.Err.Error()})
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		line, _ := cr.FieldPos(0)
+		if len(record) != len(header) {
+			rejects = append(rejects, ImportReject{File: file, Line: line,
+				Reason: fmt.Sprintf("%d полей вместо %d", len(record), len(header))})
+			continue
+		}
+		row := make(map[string]string, len(columns))
+		for _, c := range columns {
+			c = strings.TrimSuffix(c, "?")
+			if i, ok := index[c]; ok {
+				row[c] = strings.TrimSpace(record[i])
+			}
+		}
+		if err := parse(line, row); err != nil {
+			rejects = append(rejects, ImportReject{File: file, Line: line, Key: row[key], Reason: err.Error()})
+		}
+	}
+}
+
+// parseImportTime разбирает время RFC 3339; пустая строка - нулевое время.
+func parseImportTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("created_at: ожидается время RFC 3339: %q", s)
+	}
+	return t, nil
+}
+
+// validateImport проверяет строки импорта без обращения к БД и
+// возвращает прошедшие проверку. Повтор email или имени пользователя и
+// второй реферер реферала в пределах файла отклоняются, первое вхождение
+// остается.
+func validateImport(data ImportData) (ImportData, []ImportReject) {
+	var (
+		valid     ImportData
+		rejects   []ImportReject
+		emails    = map[string]int{}
+		usernames = map[string]int{}
+	)
+	for _, u := range data.Users {
+		reject := func(reason string, args ...interface{}) {
+			rejects = append(rejects, ImportReject{File: importUsersFile, Line: u.Line, Key: u.Email, Reason: fmt.Sprintf(reason, args...)})
+		}
+		// email сравниваются без учета регистра, как в users_email_lower_key
+		email := strings.ToLower(u.Email)
+		emailLine, dupEmail := emails[email]
+		nameLine, dupName := usernames[strings.ToLower(u.Username)]
+		switch n := utf8.RuneCountInString(u.Username); {
+		case n == 0:
+			reject("пустое имя пользователя")
+		case n > 50:
+			reject("имя пользователя длиннее 50 символов")
+		case !strings.Contains(u.Email, "@") || utf8.RuneCountInString(u.Email) > 100:
+			reject("неверный email %q", u.Email)
+		case u.Role != "" && u.Role != RoleUser && u.Role != RoleAdmin:
+			reject("неизвестная роль %q", u.Role)
+		case !validBcryptHash(u.PasswordHash):
+			reject("password_hash не является хешем bcrypt")
+		case dupEmail:
+			reject("email повторяется, см. строку %d", emailLine)
+		case dupName:
+			reject("имя пользователя повторяется, см. строку %d", nameLine)
+		default:
+			emails[email] = u.Line
+			usernames[strings.ToLower(u.Username)] = u.Line
+			valid.Users = append(valid.Users, u)
+		}
+	}
+
+	// ключи - email в нижнем регистре
+	referrerOf := map[string]string{} // реферер реферала по связям файла
+	refereeLine := map[string]int{}
+	for _, l := range data.Links {
+		reject := func(reason string, args ...interface{}) {
+			rejects = append(rejects, ImportReject{File: importLinksFile, Line: l.Line, Key: l.RefereeEmail, Reason: fmt.Sprintf(reason, args...)})
+		}
+		referrer, referee := strings.ToLower(l.ReferrerEmail), strings.ToLower(l.RefereeEmail)
+		prevLine, dup := refereeLine[referee]
+		switch {
+		case referrer == "" || referee == "":
+			reject("не указан email реферера или реферала")
+		case referrer == referee:
+			reject("пользователь не может быть своим реферером")
+		case utf8.RuneCountInString(l.Code) > 50:
+			reject("код длиннее 50 символов")
+		case dup:
+			reject("у реферала уже есть реферер, см. строку %d", prevLine)
+		case importCycle(referrerOf, referrer, referee):
+			reject("связь замыкает реферальную цепочку в цикл")
+		default:
+			referrerOf[referee] = referrer
+			refereeLine[referee] = l.Line
+			valid.Links = append(valid.Links, l)
+		}
+	}
+	return valid, rejects
+}
+
+// validBcryptHash сообщает, является ли строка хешем bcrypt.
+func validBcryptHash(hash string) bool {
+	_, err := bcrypt.Cost([]byte(hash))
+	return err == nil
+}
+
+// importCycle сообщает, приведет ли связь referrer -> referee к циклу:
+// referee уже встречается в цепочке рефереров referrer.
+func importCycle(referrerOf map[string]string, referrer, referee string) bool {
+	for i := 0; i <= len(referrerOf); i++ {
+		if referrer == referee {
+			return true
+		}
+		next, ok := referrerOf[referrer]
+		if !ok {
+			return false
+		}
+		referrer = next
+	}
+	return true
+}
+
+// BulkImport переносит пользователей и реферальные связи из прежней
+// системы. Хеши паролей сохраняются как есть, время регистрации и связей
+// - из файла. Строки загружаются через COPY частями по importChunkSize в
+// отдельных транзакциях; ошибочные строки попадают в ImportResult.Rejects
+// и не прерывают импорт.
+//
+// Повторный импорт безопасен: пользователь, email которого уже есть в БД,
+// пропускается, как и связь реферала, у которого уже есть реферер.
+// Вознаграждения за импортированные связи не начисляются - они выплачены
+// в прежней системе. Ошибка возвращается только при сбое БД, вместе с
+// итогом уже загруженных частей.
+func (db *DB) BulkImport(ctx context.Context, data ImportData) (_ ImportResult, err error) {
+	defer wrapError(&err, "bulk import users=%d links=%d", len(data.Users), len(data.Links))
+	var res ImportResult
+	data, res.Rejects = validateImport(data)
+	now := time.Now()
+
+	for start := 0; start < len(data.Users); start += importChunkSize {
+		chunk := data.Users[start:min(start+importChunkSize, len(data.Users))]
+		if err := db.importUsers(ctx, chunk, now, &res); err != nil {
+			return res, err
+		}
+	}
+	for start := 0; start < len(data.Links); start += importChunkSize {
+		chunk := data.Links[start:min(start+importChunkSize, len(data.Links))]
+		if err := db.importLinks(ctx, chunk, now, &res); err != nil {
+			return res, err
+		}
+	}
+	if res.LinksImported > 0 {
+		if err := db.recomputeDepth(ctx); err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+// importUsers загружает часть пользователей одной транзакцией.
+func (db *DB) importUsers(ctx context.Context, users []ImportUser, now time.Time, res *ImportResult) error {
+	var imported, skipped int
+	var rejects []ImportReject
+	err := db.pool.BeginFunc(ctx, func(tx pgxv4.Tx) error {
+		imported, skipped, rejects = 0, 0, nil
+		if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, importLockID); err != nil {
+			return err
+		}
+		emails := make([]string, len(users))
+		names := make([]string, len(users))
+		for i, u := range users {
+			emails[i], names[i] = strings.ToLower(u.Email), strings.ToLower(u.Username)
+		}
+		existingEmails, err := queryStrings(ctx, tx, `SELECT lower(email) FROM users WHERE lower(email) = ANY($1)`, emails)
+		if err != nil {
+			return err
+		}
+		takenNames, err := queryStrings(ctx, tx, `SELECT lower(username) FROM users WHERE lower(username) = ANY($1)`, names)
+		if err != nil {
+			return err
+		}
+
+		var rows [][]interface{}
+		for _, u := range users {
+			switch {
+			case existingEmails[strings.ToLower(u.Email)]:
+				skipped++
+			case takenNames[strings.ToLower(u.Username)]:
+				rejects = append(rejects, ImportReject{File: importUsersFile, Line: u.Line, Key: u.Email, Reason: ErrUsernameTaken.Error()})
+			default:
+				role, createdAt := u.Role, u.CreatedAt
+				if role == "" {
+					role = RoleUser
+				}
+				if createdAt.IsZero() {
+					createdAt = now
+				}
+				rows = append(rows, []interface{}{u.Username, u.Email, u.PasswordHash, role, SourceImport, createdAt})
+			}
+		}
+		n, err := tx.CopyFrom(ctx, pgxv4.Identifier{"users"},
+			[]string{"username", "email", "password", "role", "signup_source", "created_at"},
+			pgxv4.CopyFromRows(rows))
+		imported = int(n)
+		return err
+	})
+	if isUniqueViolation(err, emailUniqueConstraint) || isUniqueViolation(err, usernameUniqueConstraint) {
+		// пользователь зарегистрировался во время импорта; повторный
+		// запуск загрузит остальных пользователей части
+		for _, u := range users {
+			res.Rejects = append(res.Rejects, ImportReject{File: importUsersFile, Line: u.Line, Key: u.Email,
+				Reason: "часть не загружена из-за одновременной регистрации, повторите импорт"})
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	res.UsersImported += imported
+	res.UsersSkipped += skipped
+	res.Rejects = append(res.Rejects, rejects...)
+	return nil
+}
+
+// importLinks загружает часть реферальных связей одной транзакцией.
+func (db *DB) importLinks(ctx context.Context, links []ImportLink, now time.Time, res *ImportResult) error {
+	var imported, skipped int
+	var rejects []ImportReject
+	err := db.pool.BeginFunc(ctx, func(tx pgxv4.Tx) error {
+		imported, skipped, rejects = 0, 0, nil
+		if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, importLockID); err != nil {
+			return err
+		}
+		var emails []string
+		for _, l := range links {
+			emails = append(emails, strings.ToLower(l.ReferrerEmail), strings.ToLower(l.RefereeEmail))
+		}
+		// ключ - email в нижнем регистре, как в индексе users_email_lower_key
+		ids := map[string]int{}
+		rows, err := tx.Query(ctx, `SELECT id, lower(email) FROM users WHERE lower(email) = ANY($1)`, emails)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var id int
+			var email string
+			if err := rows.Scan(&id, &email); err != nil {
+				rows.Close()
+				return err
+			}
+			ids[email] = id
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		var refereeIDs []int
+		for _, l := range links {
+			if id, ok := ids[strings.ToLower(l.RefereeEmail)]; ok {
+				refereeIDs = append(refereeIDs, id)
+			}
+		}
+		linked := map[int]bool{}
+		rows, err = tx.Query(ctx, `SELECT referee_id FROM referral_links WHERE referee_id = ANY($1)`, refereeIDs)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			linked[id] = true
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		var copyRows [][]interface{}
+		for _, l := range links {
+			referrerID, okReferrer := ids[strings.ToLower(l.ReferrerEmail)]
+			refereeID, okReferee := ids[strings.ToLower(l.RefereeEmail)]
+			switch {
+			case !okReferrer:
+				rejects = append(rejects, ImportReject{File: importLinksFile, Line: l.Line, Key: l.RefereeEmail, Reason: "реферер не найден: " + l.ReferrerEmail})
+			case !okReferee:
+				rejects = append(rejects, ImportReject{File: importLinksFile, Line: l.Line, Key: l.RefereeEmail, Reason: "реферал не найден"})
+			case linked[refereeID]:
+				skipped++
+			default:
+				createdAt := l.CreatedAt
+				if createdAt.IsZero() {
+					createdAt = now
+				}
+				var code interface{}
+				if l.Code != "" {
+					code = l.Code
+				}
+				copyRows = append(copyRows, []interface{}{referrerID, refereeID, code, ChannelImport, createdAt})
+			}
+		}
+		n, err := tx.CopyFrom(ctx, pgxv4.Identifier{"referral_links"},
+			[]string{"referrer_id", "referee_id", "code", "channel", "created_at"},
+			pgxv4.CopyFromRows(copyRows))
+		imported = int(n)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	res.LinksImported += imported
+	res.LinksSkipped += skipped
+	res.Rejects = append(res.Rejects, rejects...)
+	return nil
+}
+
+// queryStrings возвращает множество значений единственной колонки запроса.
+func queryStrings(ctx context.Context, tx pgxv4.Tx, sql string, args ...interface{}) (map[string]bool, error) {
+	rows, err := tx.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	set := map[string]bool{}
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		set[s] = true
+	}
+	return set, rows.Err()
+}
+
+// recomputeDepth пересчитывает глубину связей после импорта тем же
+// запросом, что и миграция, добавившая глубину: импортированные связи
+// могут продлить существующие цепочки.
+func (db *DB) recomputeDepth(ctx context.Context) error {
+	_, err := db.pool.Exec(ctx, `
+        WITH RECURSIVE chain AS (
+            SELECT rl.id, rl.referee_id, 1 AS depth
+            FROM referral_links rl
+            WHERE NOT EXISTS (SELECT 1 FROM referral_links p WHERE p.referee_id = rl.referrer_id)
+            UNION ALL
+            SELECT rl.id, rl.referee_id, c.depth + 1
+            FROM referral_links rl
+            JOIN chain c ON rl.referrer_id = c.referee_id
+            WHERE c.depth < (SELECT COUNT(*) FROM referral_links)
+        )
+        UPDATE referral_links rl SET depth = c.depth
+        FROM (SELECT id, MAX(depth) AS depth FROM chain GROUP BY id) c
+        WHERE c.id = rl.id AND rl.depth <> c.depth`)
+	return err
+}
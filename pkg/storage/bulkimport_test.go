@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testHash возвращает хеш bcrypt для файлов импорта в тестах
+func testHash(t *testing.T) string {
+	t.Helper()
+	h, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(h)
+}
+
+func TestReadImportUsers(t *testing.T) {
+	hash := testHash(t)
+	file := "username,email,password_hash,created_at\n" +
+		"alice,alice@example.com," + hash + ",2021-03-04T05:06:07Z\n" +
+		"bob,bob@example.com," + hash + "\n" + // не хватает поля
+		"carol,carol@example.com," + hash + ",yesterday\n" +
+		"dave,\"dave@example.com," + hash + ",\n" + // незакрытая кавычка до конца файла
+		""
+
+	users, rejects, err := ReadImportUsers(strings.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].Email != "alice@example.com" || users[0].Line != 2 ||
+		!users[0].CreatedAt.Equal(time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)) {
+		t.Errorf("users = %+v, want alice from line 2", users)
+	}
+	wantLines := []int{3, 4, 5}
+	if len(rejects) != len(wantLines) {
+		t.Fatalf("rejects = %+v, want lines %v", rejects, wantLines)
+	}
+	for i, r := range rejects {
+		if r.Line != wantLines[i] || r.File != importUsersFile || r.Reason == "" {
+			t.Errorf("reject %d = %+v, want line %d", i, r, wantLines[i])
+		}
+	}
+	if rejects[1].Key != "carol@example.com" {
+		t.Errorf("reject key = %q, want carol@example.com", rejects[1].Key)
+	}
+}
+
+func TestReadImport_Header(t *testing.T) {
+	tests := []struct {
+		name    string
+		read    func(string) error
+		file    string
+		wantErr bool
+	}{
+		{"Empty users file", readUsers, "", true},
+		{"Missing password_hash", readUsers, "username,email\n", true},
+		{"Columns in any order", readUsers, "Email, password_hash ,username,role\n", false},
+		{"Missing referee_email", readLinks, "referrer_email,created_at\n", true},
+		{"Links without optional columns", readLinks, "referrer_email,referee_email\n", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.read(tt.file); (err != nil) != tt.wantErr {
+				t.Errorf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func readUsers(file string) error {
+	_, _, err := ReadImportUsers(strings.NewReader(file))
+	return err
+}
+
+func readLinks(file string) error {
+	_, _, err := ReadImportLinks(strings.NewReader(file))
+	return err
+}
+
+func TestValidateImport(t *testing.T) {
+	hash := testHash(t)
+	user := func(line int, name, email string) ImportUser {
+		return ImportUser{Line: line, Username: name, Email: email, PasswordHash: hash}
+	}
+	link := func(line int, referrer, referee string) ImportLink {
+		return ImportLink{Line: line, ReferrerEmail: referrer, RefereeEmail: referee}
+	}
+
+	badHash := user(5, "eve", "eve@example.com")
+	badHash.PasswordHash = "plaintext"
+	badRole := user(6, "frank", "frank@example.com")
+	badRole.Role = "owner"
+
+	data := ImportData{
+		Users: []ImportUser{
+			user(2, "alice", "a@example.com"),
+			user(3, "bob", "b@example.com"),
+			user(4, "Alice", "other@example.com"), // имя повторяется без учета регистра
+			badHash,
+			badRole,
+			user(7, "bob2", "b@example.com"), // email повторяется
+			user(8, "nomail", "example.com"),
+			user(9, "", "empty@example.com"),
+			user(10, strings.Repeat("x", 51), "long@example.com"),
+		},
+		Links: []ImportLink{
+			link(2, "a@example.com", "b@example.com"),
+			link(3, "c@example.com", "b@example.com"), // второй реферер
+			link(4, "b@example.com", "c@example.com"),
+			link(5, "c@example.com", "a@example.com"), // цикл a -> b -> c -> a
+			link(6, "d@example.com", "d@example.com"),
+			link(7, "", "e@example.com"),
+		},
+	}
+	valid, rejects := validateImport(data)
+
+	if len(valid.Users) != 2 || valid.Users[0].Line != 2 || valid.Users[1].Line != 3 {
+		t.Errorf("valid users = %+v, want lines 2 and 3", valid.Users)
+	}
+	if len(valid.Links) != 2 || valid.Links[0].Line != 2 || valid.Links[1].Line != 4 {
+		t.Errorf("valid links = %+v, want lines 2 and 4", valid.Links)
+	}
+	rejected := map[string][]int{}
+	for _, r := range rejects {
+		rejected[r.File] = append(rejected[r.File], r.Line)
+	}
+	if got := rejected[importUsersFile]; len(got) != 7 {
+		t.Errorf("rejected user lines = %v, want 4-10", got)
+	}
+	if got := rejected[importLinksFile]; len(got) != 4 {
+		t.Errorf("rejected link lines = %v, want 3, 5, 6, 7", got)
+	}
+}
+
+func TestValidateImport_ZeroLines(t *testing.T) {
+	// строки, собранные не из файла, не имеют номеров
+	hash := testHash(t)
+	valid, rejects := validateImport(ImportData{Users: []ImportUser{
+		{Username: "alice", Email: "a@example.com", PasswordHash: hash},
+		{Username: "alice2", Email: "a@example.com", PasswordHash: hash},
+	}})
+	if len(valid.Users) != 1 || len(rejects) != 1 {
+		t.Errorf("valid = %d, rejects = %d, want 1 and 1", len(valid.Users), len(rejects))
+	}
+}
+
+func TestValidateImport_EmailCase(t *testing.T) {
+	// email сравниваются без учета регистра, как в уникальном индексе
+	hash := testHash(t)
+	valid, rejects := validateImport(ImportData{
+		Users: []ImportUser{
+			{Line: 2, Username: "ann", Email: "Ann@example.com", PasswordHash: hash},
+			{Line: 3, Username: "ann2", Email: "ann@example.com", PasswordHash: hash},
+		},
+		Links: []ImportLink{
+			{Line: 2, ReferrerEmail: "Bob@example.com", RefereeEmail: "bob@example.com"},
+			{Line: 3, ReferrerEmail: "a@example.com", RefereeEmail: "b@example.com"},
+			{Line: 4, ReferrerEmail: "c@example.com", RefereeEmail: "B@example.com"},
+			{Line: 5, ReferrerEmail: "B@EXAMPLE.COM", RefereeEmail: "A@example.com"},
+		},
+	})
+
+	if len(valid.Users) != 1 || valid.Users[0].Line != 2 {
+		t.Errorf("valid users = %+v, want line 2", valid.Users)
+	}
+	if len(valid.Links) != 1 || valid.Links[0].Line != 3 {
+		t.Errorf("valid links = %+v, want line 3", valid.Links)
+	}
+	want := []ImportReject{
+		{File: importUsersFile, Line: 3, Key: "ann@example.com", Reason: "email повторяется, см. строку 2"},
+		{File: importLinksFile, Line: 2, Key: "bob@example.com", Reason: "пользователь не может быть своим реферером"},
+		{File: importLinksFile, Line: 4, Key: "B@example.com", Reason: "у реферала уже есть реферер, см. строку 3"},
+		{File: importLinksFile, Line: 5, Key: "A@example.com", Reason: "связь замыкает реферальную цепочку в цикл"},
+	}
+	if !reflect.DeepEqual(rejects, want) {
+		t.Errorf("rejects = %+v, want %+v", rejects, want)
+	}
+}
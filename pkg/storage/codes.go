@@ -0,0 +1,248 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	pgxv4 "github.com/jackc/pgx/v4"
+)
+
+// Новый реферальный код пользователя, у которого может быть несколько
+// активных кодов
+type NewReferralCode struct {
+	UserID      int
+	Code        string
+	Label       string // подпись кода, например канал продвижения
+	ExpiresAt   int64
+	ClientToken string          // повтор с тем же токеном возвращает ErrClientTokenUsed
+	Metadata    json.RawMessage // nil - пустой объект
+	Domain      DomainRestriction
+}
+
+// Статистика одного кода пользователя
+type ReferralCodeStats struct {
+	Code      string `json:"code"`
+	Label     string `json:"label,omitempty"`
+	Clicks    int    `json:"clicks"`
+	Referrals int    `json:"referrals"`
+	// ArchivedAt - время удаления архивного кода; nil - код действует
+	ArchivedAt *time.Time `json:"archived_at,omitempty"`
+}
+
+// checkClientToken возвращает ErrClientTokenUsed, если у пользователя
+// уже есть код, созданный с токеном клиента clientToken.
+func checkClientToken(ctx context.Context, tx pgxv4.Tx, userID int, clientToken string) error {
+	if clientToken == "" {
+		return nil
+	}
+	var replayed bool
+	err := tx.QueryRow(ctx, `
+        SELECT EXISTS (SELECT 1 FROM referral_codes WHERE user_id = $1 AND client_token = $2)`,
+		userID, clientToken).
+		Scan(&replayed)
+	if err != nil {
+		return err
+	}
+	if replayed {
+		return ErrClientTokenUsed
+	}
+	return nil
+}
+
+// Добавление реферального кода без замены существующих. Если у
+// пользователя уже limit действующих кодов (активных, не истекших и не
+// отозванных) - ErrCodeLimit. Ошибки токена клиента и занятого кода -
+// как у CreateReferralCode.
+func (db *DB) AddReferralCode(ctx context.Context, c NewReferralCode, limit int) (err error) {
+	defer wrapError(&err, "add referral code user=%d code=%s", c.UserID, c.Code)
+	if err := db.checkExpiry(c.ExpiresAt); err != nil {
+		return err
+	}
+	return db.pool.BeginFunc(ctx, func(tx pgxv4.Tx) error {
+		// Блокировка пользователя сериализует одновременные запросы
+		if _, err := tx.Exec(ctx, `SELECT id FROM users WHERE id = $1 FOR UPDATE`, c.UserID); err != nil {
+			return err
+		}
+		if err := checkClientToken(ctx, tx, c.UserID, c.ClientToken); err != nil {
+			return err
+		}
+
+		var active int
+		err := tx.QueryRow(ctx, `
+        SELECT COUNT(*) FROM referral_codes
+        WHERE user_id = $1 AND status = $2 AND expires_at > NOW() AND revoked_at IS NULL`,
+			c.UserID, CodeStatusActive).
+			Scan(&active)
+		if err != nil {
+			return err
+		}
+		if active >= limit {
+			return ErrCodeLimit
+		}
+
+		_, err = tx.Exec(ctx, `
+    INSERT INTO referral_codes (user_id, code, label, expires_at, client_token, metadata, allowed_domain, allow_subdomains)
+    VALUES ($1, $2, NULLIF($3, ''), to_timestamp($4), NULLIF($5, ''), COALESCE($6::jsonb, '{}'), NULLIF($7, ''), $8)`,
+			c.UserID,
+			c.Code,
+			c.Label,
+			c.ExpiresAt,
+			c.ClientToken,
+			jsonbParam(c.Metadata),
+			c.Domain.Domain,
+			c.Domain.Subdomains,
+		)
+		if isUniqueViolation(err, codeUniqueConstraint) {
+			return ErrCodeTaken
+		}
+		if err != nil {
+			return err
+		}
+		return recordCodeCreation(ctx, tx, c.UserID)
+	})
+}
+
+// Все коды пользователя в порядке создания, включая истекшие
+func (db *DB) ListUserReferralCodes(ctx context.Context, userID int) (_ []ReferralCode, err error) {
+	defer wrapError(&err, "list referral codes user=%d", userID)
+	rows, err := db.pool.Query(ctx, `
+        SELECT id, user_id, code, expires_at, uses, metadata, COALESCE(label, ''),
+            COALESCE(allowed_domain, ''), allow_subdomains
+        FROM referral_codes
+        WHERE user_id = $1
+        ORDER BY created_at, id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	codes := []ReferralCode{}
+	for rows.Next() {
+		var c ReferralCode
+		if err := rows.Scan(&c.ID, &c.UserID, &c.Code, &c.ExpiresAt, &c.Uses, &c.Metadata, &c.Label, &c.Domain, &c.Subdomains); err != nil {
+			return nil, err
+		}
+		codes = append(codes, c)
+	}
+	return codes, rows.Err()
+}
+
+// Переходы и рефералы по каждому коду пользователя. Рефералы считаются
+// по связям, созданным после создания кода: значение кода могло
+// принадлежать удаленному ранее коду. С includeArchived - и по удаленным
+// кодам из архива: их переходы сохранены при удалении, рефералы
+// учитываются до момента удаления.
+func (db *DB) GetCodeStats(ctx context.Context, userID int, includeArchived bool) (_ []ReferralCodeStats, err error) {
+	defer wrapError(&err, "code stats user=%d", userID)
+	rows, err := db.read.Query(ctx, `
+        SELECT k.code, k.label, k.clicks, k.referrals, k.archived_at
+        FROM (
+            SELECT rc.id, rc.code, COALESCE(rc.label, '') AS label, rc.created_at,
+                (SELECT COUNT(*) FROM referral_clicks c WHERE c.referral_code_id = rc.id) AS clicks,
+                (SELECT COUNT(*) FROM referral_links rl WHERE rl.code = rc.code AND rl.created_at >= rc.created_at) AS referrals,
+                NULL::timestamptz AS archived_at
+            FROM referral_codes rc
+            WHERE rc.user_id = $1
+            UNION ALL
+            SELECT a.id, a.code, COALESCE(a.label, ''), a.created_at, a.clicks,
+                (SELECT COUNT(*) FROM referral_links rl
+                 WHERE rl.referrer_id = a.user_id AND rl.code = a.code
+                    AND rl.created_at >= a.created_at AND rl.created_at < a.archived_at),
+                a.archived_at
+            FROM referral_codes_archive a
+            WHERE $2 AND a.user_id = $1
+        ) k
+        ORDER BY k.created_at, k.id`, userID, includeArchived)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := []ReferralCodeStats{}
+	for rows.Next() {
+		var s ReferralCodeStats
+		if err := rows.Scan(&s.Code, &s.Label, &s.Clicks, &s.Referrals, &s.ArchivedAt); err != nil {
+			return nil, err
+		}
+		stats = append(stats, s)
+	}
+	return stats, rows.Err()
+}
+
+// Показатели кода для сравнения кодов реферера
+type CodeComparison struct {
+	Code           string   `json:"code"`
+	Label          string   `json:"label,omitempty"`
+	Current        bool     `json:"current"` // false - код заменен или удален, известен по связям или архиву
+	Clicks         int      `json:"clicks"`
+	Signups        int      `json:"signups"`
+	LinkSignups    int      `json:"link_signups"`    // регистрации после перехода по ссылке
+	ConversionRate *float64 `json:"conversion_rate"` // LinkSignups / Clicks; null без переходов
+	// ArchivedAt - время удаления кода из архива, только с include_archived
+	ArchivedAt *time.Time `json:"archived_at,omitempty"`
+}
+
+// Сравнение кодов пользователя: текущие коды, в том числе без
+// переходов и регистраций, и прежние коды, по которым есть реферальные
+// связи. Переходы по прежним кодам удалены вместе с кодами. С
+// includeArchived прежние коды берутся из архива с метками, переходами и
+// регистрациями до удаления; коды, которых нет в архиве, по-прежнему
+// известны по связям. Порядок - по числу регистраций, затем переходов,
+// по убыванию.
+func (db *DB) CompareReferralCodes(ctx context.Context, userID int, includeArchived bool) (_ []CodeComparison, err error) {
+	defer wrapError(&err, "compare referral codes user=%d", userID)
+	rows, err := db.read.Query(ctx, `
+        SELECT k.code, k.label, k.current, k.archived_at,
+            k.archived_clicks + COUNT(DISTINCT c.id),
+            COUNT(DISTINCT rl.id),
+            COUNT(DISTINCT rl.id) FILTER (WHERE rl.channel = $2)
+        FROM (
+            SELECT rc.id, rc.code, COALESCE(rc.label, '') AS label, rc.created_at,
+                NULL::timestamptz AS archived_at, 0 AS archived_clicks, TRUE AS current
+            FROM referral_codes rc
+            WHERE rc.user_id = $1
+            UNION ALL
+            SELECT NULL, a.code, COALESCE(a.label, ''), a.created_at, a.archived_at, a.clicks, FALSE
+            FROM referral_codes_archive a
+            WHERE $3 AND a.user_id = $1
+            UNION ALL
+            SELECT NULL, l.code, '', NULL, NULL, 0, FALSE
+            FROM referral_links l
+            WHERE l.referrer_id = $1 AND l.code IS NOT NULL
+                AND NOT EXISTS (SELECT 1 FROM referral_codes rc WHERE rc.user_id = $1 AND rc.code = l.code)
+                AND NOT ($3 AND EXISTS (SELECT 1 FROM referral_codes_archive a WHERE a.user_id = $1 AND a.code = l.code))
+            GROUP BY l.code
+        ) k
+        LEFT JOIN referral_clicks c ON c.referral_code_id = k.id
+        LEFT JOIN referral_links rl ON rl.referrer_id = $1 AND rl.code = k.code
+            AND (k.created_at IS NULL OR rl.created_at >= k.created_at)
+            AND (k.archived_at IS NULL OR rl.created_at < k.archived_at)
+        GROUP BY k.code, k.label, k.current, k.archived_at, k.archived_clicks
+        ORDER BY 6 DESC, 5 DESC, k.code`, userID, ChannelLinkClick, includeArchived)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	codes := []CodeComparison{}
+	for rows.Next() {
+		var c CodeComparison
+		if err := rows.Scan(&c.Code, &c.Label, &c.Current, &c.ArchivedAt, &c.Clicks, &c.Signups, &c.LinkSignups); err != nil {
+			return nil, err
+		}
+		c.ConversionRate = ConversionRate(c.LinkSignups, c.Clicks)
+		codes = append(codes, c)
+	}
+	return codes, rows.Err()
+}
+
+// ConversionRate возвращает долю регистраций от переходов или nil, если
+// переходов не было.
+func ConversionRate(signups, clicks int) *float64 {
+	if clicks == 0 {
+		return nil
+	}
+	rate := float64(signups) / float64(clicks)
+	return &rate
+}
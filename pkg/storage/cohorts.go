@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// Срок в днях после приглашения, в течение которого создание своего кода
+// считается конверсией реферала в реферера
+const CohortConversionDays = 30
+
+// Когорта рефералов, приглашенных за календарный месяц (UTC)
+type CohortStat struct {
+	Month    string `json:"month"`    // YYYY-MM
+	Referred int    `json:"referred"` // приглашено за месяц
+	// создали свой код в пределах CohortConversionDays после приглашения
+	Converted      int     `json:"converted"`
+	ConversionRate float64 `json:"conversion_rate"`
+}
+
+// rate заполняет долю конверсии.
+func (c *CohortStat) rate() {
+	if c.Referred > 0 {
+		c.ConversionRate = float64(c.Converted) / float64(c.Referred)
+	}
+}
+
+// Когорты рефералов, приглашенных в [from, to), по месяцам приглашения.
+// Месяцы без приглашений отсутствуют. Коды, удаленные после создания,
+// не учитываются.
+func (db *DB) GetCohortStats(ctx context.Context, from, to time.Time) (_ []CohortStat, err error) {
+	defer wrapError(&err, "cohort stats from=%s to=%s", from.Format(time.DateOnly), to.Format(time.DateOnly))
+	rows, err := db.read.Query(ctx, `
+        SELECT to_char(date_trunc('month', rl.created_at AT TIME ZONE 'UTC'), 'YYYY-MM') AS month,
+            COUNT(*),
+            COUNT(*) FILTER (WHERE EXISTS (
+                SELECT 1 FROM referral_codes rc
+                WHERE rc.user_id = rl.referee_id
+                    AND rc.created_at >= rl.created_at
+                    AND rc.created_at < rl.created_at + make_interval(days => $3)))
+        FROM referral_links rl
+        WHERE rl.created_at >= $1 AND rl.created_at < $2
+        GROUP BY month
+        ORDER BY month`, from, to, CohortConversionDays)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cohorts := []CohortStat{}
+	for rows.Next() {
+		var c CohortStat
+		if err := rows.Scan(&c.Month, &c.Referred, &c.Converted); err != nil {
+			return nil, err
+		}
+		c.rate()
+		cohorts = append(cohorts, c)
+	}
+	return cohorts, rows.Err()
+}
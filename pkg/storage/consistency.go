@@ -0,0 +1,206 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	pgxv4 "github.com/jackc/pgx/v4"
+)
+
+// Результат проверки согласованности реферальных данных
+type ConsistencyReport struct {
+	CheckedAt           time.Time           `json:"checked_at"`
+	Fixed               bool                `json:"fixed"` // расхождения исправлены в той же транзакции
+	LinksWithoutRewards []MissingReward     `json:"links_without_rewards"`
+	RewardsWithoutLinks []OrphanReward      `json:"rewards_without_links"`
+	CodeUsageMismatches []CodeUsageMismatch `json:"code_usage_mismatches"`
+}
+
+// Consistent сообщает, что расхождений не найдено.
+func (r ConsistencyReport) Consistent() bool {
+	return len(r.LinksWithoutRewards) == 0 && len(r.RewardsWithoutLinks) == 0 && len(r.CodeUsageMismatches) == 0
+}
+
+// Реферальная связь, за которую по ступеням положено, но не начислено
+// вознаграждение
+type MissingReward struct {
+	ReferrerID int   `json:"referrer_id"`
+	RefereeID  int   `json:"referee_id"`
+	Tier       int   `json:"tier"`
+	Amount     int64 `json:"amount"`
+}
+
+// Вознаграждение без соответствующей реферальной связи
+type OrphanReward struct {
+	ID         int   `json:"id"`
+	ReferrerID int   `json:"referrer_id"`
+	RefereeID  int   `json:"referee_id"`
+	Amount     int64 `json:"amount"`
+}
+
+// Код, счетчик использований которого не совпадает с числом связей по нему
+type CodeUsageMismatch struct {
+	ID    int    `json:"id"`
+	Code  string `json:"code"`
+	Uses  int    `json:"uses"`
+	Links int    `json:"links"`
+}
+
+// ConsistencyCheck ищет расхождения между реферальными связями,
+// вознаграждениями и счетчиками использований кодов:
+//   - связи без вознаграждения, положенного по ступеням (номер реферала
+//     считается по порядку создания связей, как в creditReferral);
+//   - вознаграждения без связи между тем же реферером и приглашенным;
+//   - коды, у которых uses не равно числу связей, созданных по коду
+//     после его создания (код с тем же значением мог быть пересоздан).
+//
+// Проверка выполняется на одном снимке данных. При fix расхождения
+// исправляются в той же транзакции: недостающие вознаграждения
+// начисляются, лишние удаляются, uses приводится к числу связей. Таблицы
+// на это время блокируются от записи, регистрации по кодам ждут
+// завершения.
+func (db *DB) ConsistencyCheck(ctx context.Context, fix bool) (_ ConsistencyReport, err error) {
+	defer wrapError(&err, "consistency check fix=%t", fix)
+	report := ConsistencyReport{
+		LinksWithoutRewards: []MissingReward{},
+		RewardsWithoutLinks: []OrphanReward{},
+		CodeUsageMismatches: []CodeUsageMismatch{},
+	}
+	opts := pgxv4.TxOptions{IsoLevel: pgxv4.RepeatableRead}
+	if !fix {
+		opts.AccessMode = pgxv4.ReadOnly
+	}
+
+	err = db.pool.BeginTxFunc(ctx, opts, func(tx pgxv4.Tx) error {
+		if fix {
+			// блокировка до первого запроса, чтобы снимок ее учитывал
+			_, err := tx.Exec(ctx, `LOCK TABLE referral_links, referral_rewards, referral_codes IN SHARE ROW EXCLUSIVE MODE`)
+			if err != nil {
+				return err
+			}
+		}
+
+		var err error
+		if report.LinksWithoutRewards, err = db.linksWithoutRewards(ctx, tx); err != nil {
+			return err
+		}
+		if report.RewardsWithoutLinks, err = rewardsWithoutLinks(ctx, tx); err != nil {
+			return err
+		}
+		if report.CodeUsageMismatches, err = codeUsageMismatches(ctx, tx); err != nil {
+			return err
+		}
+		if !fix {
+			return nil
+		}
+
+		for _, m := range report.LinksWithoutRewards {
+			if err := db.insertReward(ctx, tx, m.ReferrerID, m.RefereeID, m.Tier, m.Amount); err != nil {
+				return err
+			}
+		}
+		if len(report.RewardsWithoutLinks) > 0 {
+			ids := make([]int, len(report.RewardsWithoutLinks))
+			for i, o := range report.RewardsWithoutLinks {
+				ids[i] = o.ID
+			}
+			if _, err := tx.Exec(ctx, `DELETE FROM referral_rewards WHERE id = ANY($1)`, ids); err != nil {
+				return err
+			}
+		}
+		for _, m := range report.CodeUsageMismatches {
+			if _, err := tx.Exec(ctx, `UPDATE referral_codes SET uses = $2 WHERE id = $1`, m.ID, m.Links); err != nil {
+				return err
+			}
+		}
+		report.Fixed = true
+		return nil
+	})
+	if err != nil {
+		return ConsistencyReport{}, err
+	}
+	report.CheckedAt = time.Now().UTC()
+	return report, nil
+}
+
+// Связи без вознаграждения, положенного по ступеням
+func (db *DB) linksWithoutRewards(ctx context.Context, tx pgxv4.Tx) ([]MissingReward, error) {
+	missing := []MissingReward{}
+	if len(db.rewardTiers) == 0 {
+		return missing, nil
+	}
+	rows, err := tx.Query(ctx, `
+        SELECT l.referrer_id, l.referee_id, l.n FROM (
+            SELECT rl.referrer_id, rl.referee_id,
+                ROW_NUMBER() OVER (PARTITION BY rl.referrer_id ORDER BY rl.created_at, rl.id) AS n
+            FROM referral_links rl
+        ) l
+        WHERE NOT EXISTS (SELECT 1 FROM referral_rewards rr WHERE rr.referee_id = l.referee_id)
+        ORDER BY l.referrer_id, l.n`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var m MissingReward
+		var n int
+		if err := rows.Scan(&m.ReferrerID, &m.RefereeID, &n); err != nil {
+			return nil, err
+		}
+		var ok bool
+		if m.Tier, m.Amount, ok = db.rewardTiers.For(n); ok {
+			missing = append(missing, m)
+		}
+	}
+	return missing, rows.Err()
+}
+
+// Вознаграждения без реферальной связи
+func rewardsWithoutLinks(ctx context.Context, tx pgxv4.Tx) ([]OrphanReward, error) {
+	rows, err := tx.Query(ctx, `
+        SELECT rr.id, rr.referrer_id, rr.referee_id, rr.amount FROM referral_rewards rr
+        WHERE NOT EXISTS (
+            SELECT 1 FROM referral_links rl
+            WHERE rl.referrer_id = rr.referrer_id AND rl.referee_id = rr.referee_id)
+        ORDER BY rr.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orphans := []OrphanReward{}
+	for rows.Next() {
+		var o OrphanReward
+		if err := rows.Scan(&o.ID, &o.ReferrerID, &o.RefereeID, &o.Amount); err != nil {
+			return nil, err
+		}
+		orphans = append(orphans, o)
+	}
+	return orphans, rows.Err()
+}
+
+// Коды, счетчик использований которых расходится с числом связей
+func codeUsageMismatches(ctx context.Context, tx pgxv4.Tx) ([]CodeUsageMismatch, error) {
+	rows, err := tx.Query(ctx, `
+        SELECT rc.id, rc.code, rc.uses, COUNT(rl.id)
+        FROM referral_codes rc
+        LEFT JOIN referral_links rl ON rl.code = rc.code AND rl.created_at >= rc.created_at
+        GROUP BY rc.id, rc.code, rc.uses
+        HAVING rc.uses <> COUNT(rl.id)
+        ORDER BY rc.code`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	mismatches := []CodeUsageMismatch{}
+	for rows.Next() {
+		var m CodeUsageMismatch
+		if err := rows.Scan(&m.ID, &m.Code, &m.Uses, &m.Links); err != nil {
+			return nil, err
+		}
+		mismatches = append(mismatches, m)
+	}
+	return mismatches, rows.Err()
+}
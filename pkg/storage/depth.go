@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	pgxv4 "github.com/jackc/pgx/v4"
+)
+
+// ChainDepth - ограничения глубины реферальных цепочек. Глубина связи
+// реферера без собственного реферера равна 1, каждое следующее звено
+// цепочки на единицу глубже. Ограничение защищает запросы по дереву
+// рефералов от цепочек из тысяч звеньев, которые строятся при накрутке.
+type ChainDepth struct {
+	// Max - наибольшая допустимая глубина; регистрация глубже отклоняется
+	Max int
+	// Alert - глубина, начиная с которой регистрация сопровождается
+	// предупреждением в журнале
+	Alert int
+}
+
+// Ограничения глубины по умолчанию
+var DefaultChainDepth = ChainDepth{Max: 100, Alert: 50}
+
+// ErrChainTooDeep возвращается при регистрации по коду реферера, цепочка
+// которого уже достигла ChainDepth.Max
+var ErrChainTooDeep = errors.New("превышена глубина реферальной цепочки")
+
+// WithChainDepth задает ограничения глубины реферальных цепочек. Нулевые
+// значения заменяются значениями DefaultChainDepth.
+func WithChainDepth(d ChainDepth) Option {
+	return func(db *DB) {
+		db.chainDepth = d.withFallback()
+	}
+}
+
+func (d ChainDepth) withFallback() ChainDepth {
+	if d.Max <= 0 {
+		d.Max = DefaultChainDepth.Max
+	}
+	if d.Alert <= 0 {
+		d.Alert = DefaultChainDepth.Alert
+	}
+	return d
+}
+
+// Check проверяет глубину depth новой связи реферера referrerID:
+// возвращает ErrChainTooDeep сверх Max и пишет предупреждение в журнал,
+// начиная с Alert.
+func (d ChainDepth) Check(referrerID, depth int) error {
+	d = d.withFallback()
+	if depth > d.Max {
+		log.Printf("Предупреждение: регистрация по коду реферера %d отклонена, глубина цепочки %d больше %d", referrerID, depth, d.Max)
+		return fmt.Errorf("%w: %d > %d", ErrChainTooDeep, depth, d.Max)
+	}
+	if depth >= d.Alert {
+		log.Printf("Предупреждение: глубина реферальной цепочки реферера %d достигла %d (порог %d)", referrerID, depth, d.Alert)
+	}
+	return nil
+}
+
+// inReferrerChain сообщает, входит ли userID в цепочку рефереров
+// referrerID, начиная с него самого: связь userID с кодом referrerID
+// сделала бы пользователя своим реферером.
+func (db *DB) inReferrerChain(ctx context.Context, tx pgxv4.Tx, referrerID, userID int) (bool, error) {
+	var found bool
+	err := tx.QueryRow(ctx, `
+        WITH RECURSIVE chain AS (
+            SELECT $1::int AS id, 0 AS n
+            UNION ALL
+            SELECT rl.referrer_id, c.n + 1
+            FROM referral_links rl
+            JOIN chain c ON rl.referee_id = c.id
+            WHERE c.n < $3
+        )
+        SELECT EXISTS(SELECT 1 FROM chain WHERE id = $2)`, referrerID, userID, db.chainDepth.withFallback().Max).
+		Scan(&found)
+	return found, err
+}
+
+// linkDepth возвращает глубину новой связи реферера referrerID и
+// проверяет ее ограничениями хранилища.
+func (db *DB) linkDepth(ctx context.Context, tx pgxv4.Tx, referrerID int) (int, error) {
+	var depth int
+	err := tx.QueryRow(ctx, `
+        SELECT COALESCE(MAX(depth), 0) + 1 FROM referral_links WHERE referee_id = $1`, referrerID).
+		Scan(&depth)
+	if err != nil {
+		return 0, err
+	}
+	return depth, db.chainDepth.Check(referrerID, depth)
+}
@@ -0,0 +1,323 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	pgxv4 "github.com/jackc/pgx/v4"
+)
+
+// Состояния спора об атрибуции
+const (
+	DisputeOpen     = "open"     // ожидает решения администратора
+	DisputeResolved = "resolved" // решение принято, см. Resolution
+)
+
+// Решения по спору об атрибуции
+const (
+	DisputeAttach = "attach" // создана недостающая связь и начислено вознаграждение
+	DisputeReject = "reject" // спор отклонен
+	DisputeNote   = "note"   // спор закрыт с комментарием без изменения атрибуции
+)
+
+// Канал атрибуции связи, созданной администратором при разборе спора
+const ChannelDispute = "dispute"
+
+// Ограничение уникальности открытого спора о реферале
+const openDisputeConstraint = "referral_disputes_open_referee_key"
+
+// ErrDisputeResolved возвращается при повторном разрешении спора
+var ErrDisputeResolved = errors.New("спор уже разрешен")
+
+// ErrDisputeExists возвращается, если о реферале уже есть открытый спор
+var ErrDisputeExists = errors.New("о реферале уже есть открытый спор")
+
+// ErrDisputeNotParty возвращается, если спор подает не реферал и не
+// владелец кода
+var ErrDisputeNotParty = errors.New("спор может подать только реферал или владелец кода")
+
+// ErrRefereeNotFound возвращается, если реферала, указанного владельцем
+// кода, нет
+var ErrRefereeNotFound = errors.New("реферал не найден")
+
+// ErrSelfReferral возвращается, если связь сделала бы пользователя
+// реферером самого себя, напрямую или через реферальную цепочку
+var ErrSelfReferral = errors.New("пользователь не может быть своим реферером")
+
+// ErrAlreadyReferred возвращается, если у реферала уже есть реферер
+var ErrAlreadyReferred = errors.New("у реферала уже есть реферер")
+
+// Спор об атрибуции регистрации реферальному коду
+type ReferralDispute struct {
+	ID             int        `json:"id"`
+	FiledBy        int        `json:"filed_by"`
+	ReferrerID     int        `json:"referrer_id"`
+	RefereeID      int        `json:"referee_id"`
+	Code           string     `json:"code"`
+	Message        string     `json:"message"`
+	Status         string     `json:"status"`
+	Resolution     string     `json:"resolution,omitempty"`
+	ResolutionNote string     `json:"resolution_note,omitempty"`
+	ResolvedBy     *int       `json:"resolved_by,omitempty"`
+	ResolvedAt     *time.Time `json:"resolved_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+// Новый спор. Реферал указывает только код; владелец кода указывает и
+// email реферала.
+type NewDispute struct {
+	FiledBy      int
+	Code         string
+	RefereeEmail string // пустой - спор подает сам реферал
+	Message      string
+}
+
+// Фильтр списка споров; пустые поля не ограничивают выборку
+type DisputeFilter struct {
+	Status string
+}
+
+// Подача спора об атрибуции. Реферер - владелец кода; код ищется и среди
+// удаленных, если действующего с таким значением нет. ErrNotFound, если
+// кода нет; ErrDisputeNotParty, если email реферала указывает не
+// владелец кода; ErrRefereeNotFound, если пользователя с этим email нет;
+// ErrSelfReferral, если реферал подает спор о своем коде;
+// ErrDisputeExists, если о реферале уже есть открытый спор.
+func (db *DB) FileDispute(ctx context.Context, nd NewDispute) (_ ReferralDispute, err error) {
+	defer wrapError(&err, "file dispute user=%d code=%s", nd.FiledBy, nd.Code)
+	var referrerID int
+	err = db.pool.QueryRow(ctx, `
+        SELECT user_id FROM (
+            SELECT user_id, created_at AS ts, 1 AS o FROM referral_codes WHERE code = $1
+            UNION ALL
+            SELECT user_id, archived_at, 2 FROM referral_codes_archive WHERE code = $1
+        ) c
+        WHERE user_id IS NOT NULL
+        ORDER BY o, ts DESC
+        LIMIT 1`, nd.Code).Scan(&referrerID)
+	if errors.Is(err, pgxv4.ErrNoRows) {
+		return ReferralDispute{}, ErrNotFound
+	}
+	if err != nil {
+		return ReferralDispute{}, err
+	}
+
+	refereeID := nd.FiledBy
+	if nd.RefereeEmail != "" {
+		if referrerID != nd.FiledBy {
+			return ReferralDispute{}, ErrDisputeNotParty
+		}
+		err = db.pool.QueryRow(ctx, `
+        SELECT id FROM users WHERE lower(email) = lower($1) AND anonymized_at IS NULL`, nd.RefereeEmail).
+			Scan(&refereeID)
+		if errors.Is(err, pgxv4.ErrNoRows) {
+			return ReferralDispute{}, ErrRefereeNotFound
+		}
+		if err != nil {
+			return ReferralDispute{}, err
+		}
+	}
+	if refereeID == referrerID {
+		return ReferralDispute{}, ErrSelfReferral
+	}
+
+	d, err := scanDispute(db.pool.QueryRow(ctx, `
+        INSERT INTO referral_disputes (filed_by, referrer_id, referee_id, code, message)
+        VALUES ($1, $2, $3, $4, $5)
+        RETURNING `+disputeColumns, nd.FiledBy, referrerID, refereeID, nd.Code, nd.Message))
+	if isUniqueViolation(err, openDisputeConstraint) {
+		return ReferralDispute{}, ErrDisputeExists
+	}
+	return d, err
+}
+
+// Страница споров, новые первыми
+func (db *DB) ListDisputes(ctx context.Context, filter DisputeFilter, limit, offset int) (_ []ReferralDispute, err error) {
+	defer wrapError(&err, "list disputes status=%s", filter.Status)
+	rows, err := db.read.Query(ctx, `
+        SELECT `+disputeColumns+` FROM referral_disputes
+        WHERE $1 = '' OR status = $1
+        ORDER BY id DESC
+        LIMIT $2 OFFSET $3`, filter.Status, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	disputes := []ReferralDispute{}
+	for rows.Next() {
+		d, err := scanDispute(rows)
+		if err != nil {
+			return nil, err
+		}
+		disputes = append(disputes, d)
+	}
+	return disputes, rows.Err()
+}
+
+// Разрешение открытого спора администратором actorID действием
+// DisputeAttach, DisputeReject или DisputeNote; спор переходит в
+// DisputeResolved. DisputeAttach в той же транзакции создает связь
+// реферала с реферером по коду спора и начисляет вознаграждение, как
+// при регистрации: ErrSelfReferral, если реферал - сам реферер или
+// входит в его цепочку рефереров, ErrAlreadyReferred, если у реферала
+// уже есть реферер, ErrChainTooDeep, если цепочка станет глубже
+// допустимого. ErrNotFound, если спора нет; ErrDisputeResolved, если он
+// уже разрешен. Решение фиксируется в журнале аудита.
+func (db *DB) ResolveDispute(ctx context.Context, id int, action, note string, actorID int) (_ ReferralDispute, err error) {
+	defer wrapError(&err, "resolve dispute id=%d action=%s", id, action)
+	var d ReferralDispute
+	err = db.pool.BeginFunc(ctx, func(tx pgxv4.Tx) error {
+		var err error
+		d, err = scanDispute(tx.QueryRow(ctx, `
+        SELECT `+disputeColumns+` FROM referral_disputes WHERE id = $1 FOR UPDATE`, id))
+		if errors.Is(err, pgxv4.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if d.Status != DisputeOpen {
+			return ErrDisputeResolved
+		}
+
+		if action == DisputeAttach {
+			if err := db.attachReferral(ctx, tx, d); err != nil {
+				return err
+			}
+		}
+
+		d, err = scanDispute(tx.QueryRow(ctx, `
+        UPDATE referral_disputes SET
+            status = $2,
+            resolution = $3,
+            resolution_note = NULLIF($4, ''),
+            resolved_by = $5,
+            resolved_at = NOW()
+        WHERE id = $1
+        RETURNING `+disputeColumns, id, DisputeResolved, action, note, actorID))
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(ctx, `
+        INSERT INTO audit_log (actor_id, action, target_user_id, payload)
+        VALUES ($1, $2, $3, $4)`,
+			actorID,
+			AuditDisputeResolved,
+			d.RefereeID,
+			map[string]interface{}{"dispute_id": d.ID, "resolution": action, "referrer_id": d.ReferrerID, "code": d.Code},
+		)
+		return err
+	})
+	if err != nil {
+		return ReferralDispute{}, err
+	}
+	return d, nil
+}
+
+// attachReferral создает недостающую связь реферала спора d с
+// реферером. До спора реферал был началом своей цепочки, поэтому
+// глубина связей его рефералов увеличивается на глубину новой связи.
+func (db *DB) attachReferral(ctx context.Context, tx pgxv4.Tx, d ReferralDispute) error {
+	// строки пользователей блокируются в порядке id, как при начислениях:
+	// одновременные споры о том же реферале проверяются по очереди
+	var locked int
+	err := tx.QueryRow(ctx, `
+        WITH l AS (
+            SELECT id FROM users WHERE id IN ($1, $2) ORDER BY id FOR UPDATE
+        )
+        SELECT COUNT(*) FROM l`, d.ReferrerID, d.RefereeID).Scan(&locked)
+	if err != nil {
+		return err
+	}
+	if locked < 2 {
+		return ErrNotFound
+	}
+
+	maxDepth := db.chainDepth.withFallback().Max
+	var referred, cycle bool
+	err = tx.QueryRow(ctx, `
+        WITH RECURSIVE chain AS (
+            SELECT $1::int AS id, 0 AS n
+            UNION ALL
+            SELECT rl.referrer_id, c.n + 1
+            FROM referral_links rl
+            JOIN chain c ON rl.referee_id = c.id
+            WHERE c.n < $3
+        )
+        SELECT
+            EXISTS(SELECT 1 FROM referral_links WHERE referee_id = $2),
+            EXISTS(SELECT 1 FROM chain WHERE id = $2)`, d.ReferrerID, d.RefereeID, maxDepth).
+		Scan(&referred, &cycle)
+	if err != nil {
+		return err
+	}
+	if cycle {
+		return ErrSelfReferral
+	}
+	if referred {
+		return ErrAlreadyReferred
+	}
+
+	depth, err := db.linkDepth(ctx, tx, d.ReferrerID)
+	if err != nil {
+		return err
+	}
+	var below int
+	err = tx.QueryRow(ctx, `SELECT COALESCE(MAX(depth), 0) FROM (`+downlineLinks+`) s`, d.RefereeID, maxDepth).
+		Scan(&below)
+	if err != nil {
+		return err
+	}
+	if below > 0 {
+		if err := db.chainDepth.Check(d.ReferrerID, depth+below); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(ctx, `
+        UPDATE referral_links rl SET depth = rl.depth + $3
+        FROM (`+downlineLinks+`) s
+        WHERE rl.id = s.id`, d.RefereeID, maxDepth, depth)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `
+        INSERT INTO referral_links (referrer_id, referee_id, code, channel, depth)
+        VALUES ($1, $2, $3, $4, $5)`,
+		d.ReferrerID, d.RefereeID, d.Code, ChannelDispute, depth)
+	if err != nil {
+		return err
+	}
+	// uses остается равным числу связей по коду, см. ConsistencyCheck
+	_, err = tx.Exec(ctx, `UPDATE referral_codes SET uses = uses + 1 WHERE code = $1`, d.Code)
+	if err != nil {
+		return err
+	}
+	return db.creditReferral(ctx, tx, d.ReferrerID, d.RefereeID)
+}
+
+// downlineLinks выбирает связи цепочки рефералов пользователя $1 с
+// глубиной относительно него, не глубже $2
+const downlineLinks = `
+        WITH RECURSIVE sub AS (
+            SELECT id, referee_id, 1 AS depth FROM referral_links WHERE referrer_id = $1
+            UNION ALL
+            SELECT rl.id, rl.referee_id, s.depth + 1
+            FROM referral_links rl
+            JOIN sub s ON rl.referrer_id = s.referee_id
+            WHERE s.depth < $2
+        )
+        SELECT DISTINCT id, depth FROM sub`
+
+const disputeColumns = `id, filed_by, referrer_id, referee_id, code, message, status,
+    COALESCE(resolution, ''), COALESCE(resolution_note, ''), resolved_by, resolved_at, created_at`
+
+func scanDispute(row pgxv4.Row) (ReferralDispute, error) {
+	var d ReferralDispute
+	err := row.Scan(&d.ID, &d.FiledBy, &d.ReferrerID, &d.RefereeID, &d.Code, &d.Message, &d.Status,
+		&d.Resolution, &d.ResolutionNote, &d.ResolvedBy, &d.ResolvedAt, &d.CreatedAt)
+	return d, err
+}
@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrCodeDomainMismatch возвращается при регистрации по коду с
+// ограничением домена, если email в другом домене
+var ErrCodeDomainMismatch = errors.New("email не соответствует домену реферального кода")
+
+// Наибольшая длина доменного имени
+const maxDomainLength = 253
+
+// Ограничение кода доменом email, например для партнерских программ.
+// Пустой Domain - код доступен с любым email.
+type DomainRestriction struct {
+	Domain string `json:"allowed_domain,omitempty"`
+	// Subdomains - подходят и поддомены Domain: eu.acme.com для acme.com
+	Subdomains bool `json:"allow_subdomains,omitempty"`
+}
+
+// NormalizeDomain приводит домен к форме, в которой он сохраняется:
+// нижний регистр, без "@" в начале и точки в конце. Пустая строка -
+// ограничения нет. Домен должен состоять хотя бы из двух меток из
+// латинских букв, цифр и дефисов.
+func NormalizeDomain(domain string) (string, error) {
+	d := strings.ToLower(strings.TrimSpace(domain))
+	d = strings.TrimSuffix(strings.TrimPrefix(d, "@"), ".")
+	if d == "" {
+		return "", nil
+	}
+	if len(d) > maxDomainLength {
+		return "", fmt.Errorf("domain exceeds %d characters", maxDomainLength)
+	}
+	labels := strings.Split(d, ".")
+	if len(labels) < 2 {
+		return "", fmt.Errorf("domain %q has no top-level part", domain)
+	}
+	for _, l := range labels {
+		if l == "" || l[0] == '-' || l[len(l)-1] == '-' {
+			return "", fmt.Errorf("domain %q is malformed", domain)
+		}
+		for _, c := range l {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+				return "", fmt.Errorf("domain %q is malformed", domain)
+			}
+		}
+	}
+	return d, nil
+}
+
+// Allows сообщает, можно ли зарегистрироваться по коду с email.
+// Домены сравниваются без учета регистра.
+func (d DomainRestriction) Allows(email string) bool {
+	if d.Domain == "" {
+		return true
+	}
+	at := strings.LastIndexByte(email, '@')
+	if at < 0 {
+		return false
+	}
+	host := strings.TrimSuffix(strings.ToLower(email[at+1:]), ".")
+	domain := strings.ToLower(d.Domain)
+	return host == domain || d.Subdomains && strings.HasSuffix(host, "."+domain)
+}
@@ -0,0 +1,41 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// wrapError дополняет ошибку метода хранилища описанием операции:
+// "storage: create user email=j***@example.com: <ошибка>". Вызывается
+// через defer с именованным результатом err; nil не изменяется.
+// Сигнальные ошибки (ErrNotFound и т.п.) и ошибки pgx остаются
+// доступны через errors.Is/As. В описание не должны попадать
+// персональные данные - email передается через redactEmail.
+func wrapError(err *error, format string, args ...interface{}) {
+	if *err != nil {
+		*err = fmt.Errorf("storage: "+format+": %w", append(args, *err)...)
+	}
+}
+
+// Наибольшая длина домена в redactEmail, в байтах
+const maxRedactedDomain = 64
+
+// redactEmail скрывает локальную часть email, оставляя первый символ
+// и домен: "j***@example.com". Длинный домен обрезается до
+// maxRedactedDomain байт, чтобы email из запроса не раздувал журнал.
+func redactEmail(email string) string {
+	local, domain, ok := strings.Cut(email, "@")
+	if !ok || local == "" {
+		return "***"
+	}
+	if len(domain) > maxRedactedDomain {
+		cut := maxRedactedDomain
+		for cut > 0 && !utf8.RuneStart(domain[cut]) {
+			cut--
+		}
+		domain = domain[:cut] + "..."
+	}
+	_, size := utf8.DecodeRuneInString(local)
+	return local[:size] + "***@" + domain
+}
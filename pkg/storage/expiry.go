@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// DefaultCodeLifetime - наибольший срок действия реферального кода по
+// умолчанию
+const DefaultCodeLifetime = 365 * 24 * time.Hour
+
+// ErrExpiryInPast возвращается, если срок действия нового или измененного
+// кода не в будущем: такой код истек бы сразу после создания
+var ErrExpiryInPast = errors.New("срок действия реферального кода уже истек")
+
+// ErrExpiryTooFar возвращается, если срок действия кода дальше наибольшего
+var ErrExpiryTooFar = errors.New("срок действия реферального кода больше допустимого")
+
+// WithMaxCodeLifetime задает наибольший срок действия реферального кода
+// от момента создания или изменения. 0 - DefaultCodeLifetime.
+func WithMaxCodeLifetime(d time.Duration) Option {
+	return func(db *DB) {
+		db.codeLifetime = d
+	}
+}
+
+// CheckCodeExpiry проверяет срок действия expiresAt (Unix-время) кода:
+// он должен быть позже now и не дальше now+maxLifetime. maxLifetime 0 -
+// DefaultCodeLifetime.
+func CheckCodeExpiry(expiresAt int64, now time.Time, maxLifetime time.Duration) error {
+	if maxLifetime <= 0 {
+		maxLifetime = DefaultCodeLifetime
+	}
+	at := time.Unix(expiresAt, 0)
+	if !at.After(now) {
+		return fmt.Errorf("%w: %s", ErrExpiryInPast, at.UTC().Format(time.RFC3339))
+	}
+	if at.After(now.Add(maxLifetime)) {
+		return fmt.Errorf("%w: %s позже %s", ErrExpiryTooFar, at.UTC().Format(time.RFC3339), now.Add(maxLifetime).UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// checkExpiry проверяет срок действия кода по текущему времени.
+func (db *DB) checkExpiry(expiresAt int64) error {
+	return CheckCodeExpiry(expiresAt, time.Now(), db.codeLifetime)
+}
@@ -0,0 +1,215 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	pgxv4 "github.com/jackc/pgx/v4"
+)
+
+// Максимальное число записей в каждом списке выгрузки
+const maxExportRows = 1000
+
+// Выгрузка всех данных пользователя (переносимость данных)
+type UserExport struct {
+	Profile       ExportProfile    `json:"profile"`
+	ReferralCodes []ReferralCode   `json:"referral_codes"`
+	Referrals     []ExportReferral `json:"referrals"`
+	Referrer      *ExportReferral  `json:"referrer"`
+	Rewards       []ExportReward   `json:"rewards"`     // вознаграждения за приглашенных
+	Redemptions   []Redemption     `json:"redemptions"` // списания вознаграждений
+	AuditLog      []AuditEntry     `json:"audit_log"`
+	Truncated     bool             `json:"truncated"` // часть записей не вошла из-за ограничения размера
+}
+
+// Профиль пользователя в выгрузке
+type ExportProfile struct {
+	ID           int        `json:"id"`
+	Username     string     `json:"username"`
+	Email        string     `json:"email"`
+	Role         string     `json:"role"`
+	SignupSource string     `json:"signup_source"`
+	Timezone     string     `json:"timezone"`
+	CreatedAt    time.Time  `json:"created_at"`
+	LastLoginAt  *time.Time `json:"last_login_at"`
+	AnonymizedAt *time.Time `json:"anonymized_at"`
+}
+
+// Реферальная связь в выгрузке: приглашенный или пригласивший
+// пользователь без его контактных данных
+type ExportReferral struct {
+	Username string    `json:"username"`
+	Code     *string   `json:"code"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+// Вознаграждение за приглашенного в выгрузке
+type ExportReward struct {
+	Referee   string     `json:"referee"` // имя приглашенного
+	Tier      int        `json:"tier"`
+	Amount    int64      `json:"amount"`
+	Status    string     `json:"status"` // RewardPending, RewardVested, RewardPendingReview или RewardForfeited
+	CreatedAt time.Time  `json:"created_at"`
+	VestedAt  *time.Time `json:"vested_at"`
+}
+
+// Запись журнала аудита
+type AuditEntry struct {
+	ID        int             `json:"id"`
+	ActorID   *int            `json:"actor_id"`
+	Action    string          `json:"action"`
+	Payload   json.RawMessage `json:"payload"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// Выгрузка данных пользователя. Запросы отправляются одним пакетом;
+// каждый список ограничен maxExportRows записями.
+func (db *DB) ExportUserData(ctx context.Context, userID int) (_ UserExport, err error) {
+	defer wrapError(&err, "export user=%d", userID)
+	batch := &pgxv4.Batch{}
+	batch.Queue(`
+        SELECT id, username, email, role, signup_source, timezone, created_at, last_login_at, anonymized_at
+        FROM users WHERE id = $1`, userID)
+	batch.Queue(`
+        SELECT id, user_id, code, expires_at, uses, metadata
+        FROM referral_codes WHERE user_id = $1
+        ORDER BY created_at, id LIMIT $2`, userID, maxExportRows+1)
+	batch.Queue(`
+        SELECT u.username, rl.code, rl.created_at
+        FROM referral_links rl JOIN users u ON rl.referee_id = u.id
+        WHERE rl.referrer_id = $1
+        ORDER BY rl.created_at, rl.id LIMIT $2`, userID, maxExportRows+1)
+	batch.Queue(`
+        SELECT u.username, rl.code, rl.created_at
+        FROM referral_links rl JOIN users u ON rl.referrer_id = u.id
+        WHERE rl.referee_id = $1
+        ORDER BY rl.created_at LIMIT 1`, userID)
+	batch.Queue(`
+        SELECT u.username, rr.tier, rr.amount,
+            COALESCE(rr.review_status, CASE WHEN rr.vested_at IS NULL THEN $3 ELSE $4 END),
+            rr.created_at, rr.vested_at
+        FROM referral_rewards rr JOIN users u ON u.id = rr.referee_id
+        WHERE rr.referrer_id = $1
+        ORDER BY rr.created_at, rr.id LIMIT $2`, userID, maxExportRows+1, RewardPending, RewardVested)
+	batch.Queue(`
+        SELECT id, user_id, amount, balance_after, note, created_at
+        FROM reward_redemptions WHERE user_id = $1
+        ORDER BY created_at, id LIMIT $2`, userID, maxExportRows+1)
+	batch.Queue(`
+        SELECT id, actor_id, action, payload, created_at
+        FROM audit_log WHERE target_user_id = $1
+        ORDER BY created_at, id LIMIT $2`, userID, maxExportRows+1)
+
+	br := db.pool.SendBatch(ctx, batch)
+	defer br.Close()
+
+	var export UserExport
+	p := &export.Profile
+	err = br.QueryRow().Scan(&p.ID, &p.Username, &p.Email, &p.Role, &p.SignupSource, &p.Timezone, &p.CreatedAt, &p.LastLoginAt, &p.AnonymizedAt)
+	if err != nil {
+		if errors.Is(err, pgxv4.ErrNoRows) {
+			return UserExport{}, ErrNotFound
+		}
+		return UserExport{}, err
+	}
+
+	export.ReferralCodes = []ReferralCode{}
+	err = scanExportRows(br, &export, func(rows pgxv4.Rows) error {
+		var c ReferralCode
+		if err := rows.Scan(&c.ID, &c.UserID, &c.Code, &c.ExpiresAt, &c.Uses, &c.Metadata); err != nil {
+			return err
+		}
+		export.ReferralCodes = append(export.ReferralCodes, c)
+		return nil
+	})
+	if err != nil {
+		return UserExport{}, err
+	}
+
+	export.Referrals = []ExportReferral{}
+	err = scanExportRows(br, &export, func(rows pgxv4.Rows) error {
+		var ref ExportReferral
+		if err := rows.Scan(&ref.Username, &ref.Code, &ref.JoinedAt); err != nil {
+			return err
+		}
+		export.Referrals = append(export.Referrals, ref)
+		return nil
+	})
+	if err != nil {
+		return UserExport{}, err
+	}
+
+	var referrer ExportReferral
+	err = br.QueryRow().Scan(&referrer.Username, &referrer.Code, &referrer.JoinedAt)
+	switch {
+	case err == nil:
+		export.Referrer = &referrer
+	case !errors.Is(err, pgxv4.ErrNoRows):
+		return UserExport{}, err
+	}
+
+	export.Rewards = []ExportReward{}
+	err = scanExportRows(br, &export, func(rows pgxv4.Rows) error {
+		var r ExportReward
+		if err := rows.Scan(&r.Referee, &r.Tier, &r.Amount, &r.Status, &r.CreatedAt, &r.VestedAt); err != nil {
+			return err
+		}
+		export.Rewards = append(export.Rewards, r)
+		return nil
+	})
+	if err != nil {
+		return UserExport{}, err
+	}
+
+	export.Redemptions = []Redemption{}
+	err = scanExportRows(br, &export, func(rows pgxv4.Rows) error {
+		var r Redemption
+		if err := rows.Scan(&r.ID, &r.UserID, &r.Amount, &r.BalanceAfter, &r.Note, &r.CreatedAt); err != nil {
+			return err
+		}
+		export.Redemptions = append(export.Redemptions, r)
+		return nil
+	})
+	if err != nil {
+		return UserExport{}, err
+	}
+
+	export.AuditLog = []AuditEntry{}
+	err = scanExportRows(br, &export, func(rows pgxv4.Rows) error {
+		var e AuditEntry
+		if err := rows.Scan(&e.ID, &e.ActorID, &e.Action, &e.Payload, &e.CreatedAt); err != nil {
+			return err
+		}
+		export.AuditLog = append(export.AuditLog, e)
+		return nil
+	})
+	if err != nil {
+		return UserExport{}, err
+	}
+
+	return export, nil
+}
+
+// scanExportRows читает результат очередного запроса пакета. Если записей
+// больше maxExportRows, лишние отбрасываются и выгрузка помечается неполной.
+func scanExportRows(br pgxv4.BatchResults, export *UserExport, scan func(rows pgxv4.Rows) error) error {
+	rows, err := br.Query()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	n := 0
+	for rows.Next() {
+		if n++; n > maxExportRows {
+			export.Truncated = true
+			break
+		}
+		if err := scan(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,748 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgconn"
+)
+
+// Сбои, которые умеет внедрять Faulty. Ошибки БД повторяют то, что
+// возвращает pgx при соответствующих сбоях PostgreSQL.
+const (
+	FaultTimeout       = "timeout"        // context.DeadlineExceeded
+	FaultCanceled      = "canceled"       // context.Canceled
+	FaultUnavailable   = "unavailable"    // 57P01: сервер завершает работу
+	FaultTooManyConns  = "too_many_conns" // 53300: исчерпаны соединения
+	FaultSerialization = "serialization"  // 40001: конфликт сериализации
+	FaultReadOnly      = "read_only"      // 25006: запись в реплику
+)
+
+// faultErrors - ошибки по названию сбоя
+var faultErrors = map[string]error{
+	FaultTimeout:       context.DeadlineExceeded,
+	FaultCanceled:      context.Canceled,
+	FaultUnavailable:   &pgconn.PgError{Code: "57P01", Message: "terminating connection due to administrator command"},
+	FaultTooManyConns:  &pgconn.PgError{Code: "53300", Message: "sorry, too many clients already"},
+	FaultSerialization: &pgconn.PgError{Code: "40001", Message: "could not serialize access due to concurrent update"},
+	FaultReadOnly:      &pgconn.PgError{Code: "25006", Message: "cannot execute statement in a read-only transaction"},
+}
+
+// FaultRule - сбой метода хранилища. С вероятностью Probability вызов
+// метода Method ("*" - любого) задерживается на LatencyMs и, если задан
+// Error, завершается этой ошибкой без обращения к хранилищу. Задержка
+// прерывается отменой контекста запроса.
+type FaultRule struct {
+	Method      string  `json:"method"`
+	Probability float64 `json:"probability"` // от 0 до 1
+	LatencyMs   int     `json:"latency_ms"`
+	Error       string  `json:"error"` // один из Fault*; пусто - только задержка
+}
+
+// FaultRules - правила сбоев. Для вызова применяется первое подходящее
+// правило.
+type FaultRules []FaultRule
+
+// Validate проверяет вероятности и названия сбоев.
+func (rules FaultRules) Validate() error {
+	for i, r := range rules {
+		if r.Method == "" {
+			return fmt.Errorf("правило %d: не указан метод", i)
+		}
+		if r.Probability < 0 || r.Probability > 1 {
+			return fmt.Errorf("правило %d: вероятность %v вне [0, 1]", i, r.Probability)
+		}
+		if r.LatencyMs < 0 {
+			return fmt.Errorf("правило %d: отрицательная задержка", i)
+		}
+		if _, ok := faultErrors[r.Error]; r.Error != "" && !ok {
+			return fmt.Errorf("правило %d: неизвестный сбой %q", i, r.Error)
+		}
+	}
+	return nil
+}
+
+// Faulty - хранилище, внедряющее сбои в вызовы inner для проверки
+// устойчивости API: таймаутов, ответов 503/504 и т.п. Правила можно
+// менять на ходу. Только для тестовых стендов: в рабочей конфигурации
+// Faulty не создается.
+type Faulty struct {
+	inner DBInterface
+
+	mu    sync.Mutex
+	rules FaultRules
+	rand  func() float64 // подменяется в тестах
+}
+
+var _ DBInterface = (*Faulty)(nil)
+
+// NewFaulty оборачивает inner хранилищем со сбоями по правилам rules.
+// Правила должны пройти FaultRules.Validate.
+func NewFaulty(inner DBInterface, rules FaultRules) *Faulty {
+	return &Faulty{inner: inner, rules: rules, rand: rand.Float64}
+}
+
+// Rules возвращает действующие правила.
+func (f *Faulty) Rules() FaultRules {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append(FaultRules{}, f.rules...)
+}
+
+// SetRules заменяет правила. Вызовы, уже ожидающие задержки, ее дождутся.
+func (f *Faulty) SetRules(rules FaultRules) error {
+	if err := rules.Validate(); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rules = append(FaultRules{}, rules...)
+	return nil
+}
+
+// rule выбирает правило для метода и решает, срабатывает ли оно.
+func (f *Faulty) rule(method string) (FaultRule, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, r := range f.rules {
+		if r.Method == method || r.Method == "*" {
+			return r, f.rand() < r.Probability
+		}
+	}
+	return FaultRule{}, false
+}
+
+// inject применяет к вызову метода сработавшее правило.
+func (f *Faulty) inject(ctx context.Context, method string) error {
+	r, ok := f.rule(method)
+	if !ok {
+		return nil
+	}
+	if r.LatencyMs > 0 {
+		timer := time.NewTimer(time.Duration(r.LatencyMs) * time.Millisecond)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if r.Error == "" {
+		return nil
+	}
+	return fmt.Errorf("внедренный сбой %s в %s: %w", r.Error, method, faultErrors[r.Error])
+}
+
+// UserStore
+
+func (f *Faulty) CreateUser(ctx context.Context, params CreateUserParams) (int, error) {
+	if err := f.inject(ctx, "CreateUser"); err != nil {
+		return 0, err
+	}
+	return f.inner.CreateUser(ctx, params)
+}
+
+func (f *Faulty) GetUserByEmail(ctx context.Context, email string) (User, error) {
+	if err := f.inject(ctx, "GetUserByEmail"); err != nil {
+		return User{}, err
+	}
+	return f.inner.GetUserByEmail(ctx, email)
+}
+
+func (f *Faulty) GetUserByID(ctx context.Context, id int) (User, error) {
+	if err := f.inject(ctx, "GetUserByID"); err != nil {
+		return User{}, err
+	}
+	return f.inner.GetUserByID(ctx, id)
+}
+
+func (f *Faulty) EmailExists(ctx context.Context, email string) (bool, error) {
+	if err := f.inject(ctx, "EmailExists"); err != nil {
+		return false, err
+	}
+	return f.inner.EmailExists(ctx, email)
+}
+
+func (f *Faulty) SetTimezone(ctx context.Context, userID int, timezone string) error {
+	if err := f.inject(ctx, "SetTimezone"); err != nil {
+		return err
+	}
+	return f.inner.SetTimezone(ctx, userID, timezone)
+}
+
+func (f *Faulty) SetUsername(ctx context.Context, userID int, username string) error {
+	if err := f.inject(ctx, "SetUsername"); err != nil {
+		return err
+	}
+	return f.inner.SetUsername(ctx, userID, username)
+}
+
+func (f *Faulty) SetVanityLinkOptOut(ctx context.Context, userID int, optOut bool) error {
+	if err := f.inject(ctx, "SetVanityLinkOptOut"); err != nil {
+		return err
+	}
+	return f.inner.SetVanityLinkOptOut(ctx, userID, optOut)
+}
+
+func (f *Faulty) UpdateProfile(ctx context.Context, userID int, u ProfileUpdate) error {
+	if err := f.inject(ctx, "UpdateProfile"); err != nil {
+		return err
+	}
+	return f.inner.UpdateProfile(ctx, userID, u)
+}
+
+func (f *Faulty) GetProfile(ctx context.Context, userID int) (Profile, error) {
+	if err := f.inject(ctx, "GetProfile"); err != nil {
+		return Profile{}, err
+	}
+	return f.inner.GetProfile(ctx, userID)
+}
+
+func (f *Faulty) RecordLogin(ctx context.Context, e LoginEvent) error {
+	if err := f.inject(ctx, "RecordLogin"); err != nil {
+		return err
+	}
+	return f.inner.RecordLogin(ctx, e)
+}
+
+func (f *Faulty) ListLoginEvents(ctx context.Context, userID int, limit int, offset int) ([]LoginEvent, error) {
+	if err := f.inject(ctx, "ListLoginEvents"); err != nil {
+		return nil, err
+	}
+	return f.inner.ListLoginEvents(ctx, userID, limit, offset)
+}
+
+func (f *Faulty) AnonymizeUser(ctx context.Context, userID int, actorID int) error {
+	if err := f.inject(ctx, "AnonymizeUser"); err != nil {
+		return err
+	}
+	return f.inner.AnonymizeUser(ctx, userID, actorID)
+}
+
+func (f *Faulty) ExportUserData(ctx context.Context, userID int) (UserExport, error) {
+	if err := f.inject(ctx, "ExportUserData"); err != nil {
+		return UserExport{}, err
+	}
+	return f.inner.ExportUserData(ctx, userID)
+}
+
+// ReferralCodeStore
+
+func (f *Faulty) CreateReferralCode(ctx context.Context, userID int, code string, expiresAt int64, clientToken string, metadata json.RawMessage, domain DomainRestriction) error {
+	if err := f.inject(ctx, "CreateReferralCode"); err != nil {
+		return err
+	}
+	return f.inner.CreateReferralCode(ctx, userID, code, expiresAt, clientToken, metadata, domain)
+}
+
+func (f *Faulty) UpdateReferralCode(ctx context.Context, userID int, u ReferralCodeUpdate) error {
+	if err := f.inject(ctx, "UpdateReferralCode"); err != nil {
+		return err
+	}
+	return f.inner.UpdateReferralCode(ctx, userID, u)
+}
+
+func (f *Faulty) ListReferralCodes(ctx context.Context, filter ReferralCodeFilter, limit int, offset int) ([]ReferralCode, error) {
+	if err := f.inject(ctx, "ListReferralCodes"); err != nil {
+		return nil, err
+	}
+	return f.inner.ListReferralCodes(ctx, filter, limit, offset)
+}
+
+func (f *Faulty) DeleteReferralCode(ctx context.Context, userID int) error {
+	if err := f.inject(ctx, "DeleteReferralCode"); err != nil {
+		return err
+	}
+	return f.inner.DeleteReferralCode(ctx, userID)
+}
+
+func (f *Faulty) DeleteReferralCodeByCode(ctx context.Context, code string, actorID int) (DeletedReferralCode, error) {
+	if err := f.inject(ctx, "DeleteReferralCodeByCode"); err != nil {
+		return DeletedReferralCode{}, err
+	}
+	return f.inner.DeleteReferralCodeByCode(ctx, code, actorID)
+}
+
+func (f *Faulty) TransferReferralCode(ctx context.Context, code string, newOwnerID int, includeHistory bool, actorID int) (CodeTransfer, error) {
+	if err := f.inject(ctx, "TransferReferralCode"); err != nil {
+		return CodeTransfer{}, err
+	}
+	return f.inner.TransferReferralCode(ctx, code, newOwnerID, includeHistory, actorID)
+}
+
+func (f *Faulty) GetReferralCodeByEmail(ctx context.Context, email string) (ReferralCode, error) {
+	if err := f.inject(ctx, "GetReferralCodeByEmail"); err != nil {
+		return ReferralCode{}, err
+	}
+	return f.inner.GetReferralCodeByEmail(ctx, email)
+}
+
+func (f *Faulty) GetActiveReferralCodeByUsername(ctx context.Context, username string) (ReferralCode, error) {
+	if err := f.inject(ctx, "GetActiveReferralCodeByUsername"); err != nil {
+		return ReferralCode{}, err
+	}
+	return f.inner.GetActiveReferralCodeByUsername(ctx, username)
+}
+
+func (f *Faulty) GetReferralCodeByUserID(ctx context.Context, userID int) (ReferralCode, error) {
+	if err := f.inject(ctx, "GetReferralCodeByUserID"); err != nil {
+		return ReferralCode{}, err
+	}
+	return f.inner.GetReferralCodeByUserID(ctx, userID)
+}
+
+func (f *Faulty) GetReferralCodeByClientToken(ctx context.Context, userID int, clientToken string) (ReferralCode, error) {
+	if err := f.inject(ctx, "GetReferralCodeByClientToken"); err != nil {
+		return ReferralCode{}, err
+	}
+	return f.inner.GetReferralCodeByClientToken(ctx, userID, clientToken)
+}
+
+func (f *Faulty) GetReferralCodeDetails(ctx context.Context, code string) (ReferralCodeDetails, error) {
+	if err := f.inject(ctx, "GetReferralCodeDetails"); err != nil {
+		return ReferralCodeDetails{}, err
+	}
+	return f.inner.GetReferralCodeDetails(ctx, code)
+}
+
+func (f *Faulty) ReserveReferralCode(ctx context.Context, email string, code string, expiresAt int64, domain DomainRestriction) error {
+	if err := f.inject(ctx, "ReserveReferralCode"); err != nil {
+		return err
+	}
+	return f.inner.ReserveReferralCode(ctx, email, code, expiresAt, domain)
+}
+
+func (f *Faulty) AddReferralCode(ctx context.Context, c NewReferralCode, limit int) error {
+	if err := f.inject(ctx, "AddReferralCode"); err != nil {
+		return err
+	}
+	return f.inner.AddReferralCode(ctx, c, limit)
+}
+
+func (f *Faulty) ListUserReferralCodes(ctx context.Context, userID int) ([]ReferralCode, error) {
+	if err := f.inject(ctx, "ListUserReferralCodes"); err != nil {
+		return nil, err
+	}
+	return f.inner.ListUserReferralCodes(ctx, userID)
+}
+
+func (f *Faulty) GetCodeStats(ctx context.Context, userID int, includeArchived bool) ([]ReferralCodeStats, error) {
+	if err := f.inject(ctx, "GetCodeStats"); err != nil {
+		return nil, err
+	}
+	return f.inner.GetCodeStats(ctx, userID, includeArchived)
+}
+
+func (f *Faulty) CompareReferralCodes(ctx context.Context, userID int, includeArchived bool) ([]CodeComparison, error) {
+	if err := f.inject(ctx, "CompareReferralCodes"); err != nil {
+		return nil, err
+	}
+	return f.inner.CompareReferralCodes(ctx, userID, includeArchived)
+}
+
+// ReferralStore
+
+func (f *Faulty) RegisterWithReferralCode(ctx context.Context, referralCode string, params CreateUserParams) (ReferralRegistration, error) {
+	if err := f.inject(ctx, "RegisterWithReferralCode"); err != nil {
+		return ReferralRegistration{}, err
+	}
+	return f.inner.RegisterWithReferralCode(ctx, referralCode, params)
+}
+
+func (f *Faulty) RecordClick(ctx context.Context, code string) (int, error) {
+	if err := f.inject(ctx, "RecordClick"); err != nil {
+		return 0, err
+	}
+	return f.inner.RecordClick(ctx, code)
+}
+
+func (f *Faulty) GetReferralsByReferrerID(ctx context.Context, referrerID int, limit int, offset int) ([]ReferralSummary, error) {
+	if err := f.inject(ctx, "GetReferralsByReferrerID"); err != nil {
+		return nil, err
+	}
+	return f.inner.GetReferralsByReferrerID(ctx, referrerID, limit, offset)
+}
+
+func (f *Faulty) GetProgramReport(ctx context.Context, from time.Time, to time.Time) (ProgramReport, error) {
+	if err := f.inject(ctx, "GetProgramReport"); err != nil {
+		return ProgramReport{}, err
+	}
+	return f.inner.GetProgramReport(ctx, from, to)
+}
+
+func (f *Faulty) GetCohortStats(ctx context.Context, from time.Time, to time.Time) ([]CohortStat, error) {
+	if err := f.inject(ctx, "GetCohortStats"); err != nil {
+		return nil, err
+	}
+	return f.inner.GetCohortStats(ctx, from, to)
+}
+
+// AuditStore
+
+func (f *Faulty) RecordAudit(ctx context.Context, actorID int, action string, targetUserID int, payload interface{}) error {
+	if err := f.inject(ctx, "RecordAudit"); err != nil {
+		return err
+	}
+	return f.inner.RecordAudit(ctx, actorID, action, targetUserID, payload)
+}
+
+// FraudStore
+
+func (f *Faulty) GetReferrerActivity(ctx context.Context, since time.Time) ([]ReferrerActivity, error) {
+	if err := f.inject(ctx, "GetReferrerActivity"); err != nil {
+		return nil, err
+	}
+	return f.inner.GetReferrerActivity(ctx, since)
+}
+
+func (f *Faulty) FlagReferrer(ctx context.Context, flag ReferrerFlag) error {
+	if err := f.inject(ctx, "FlagReferrer"); err != nil {
+		return err
+	}
+	return f.inner.FlagReferrer(ctx, flag)
+}
+
+func (f *Faulty) ListReferrerFlags(ctx context.Context) ([]ReferrerFlag, error) {
+	if err := f.inject(ctx, "ListReferrerFlags"); err != nil {
+		return nil, err
+	}
+	return f.inner.ListReferrerFlags(ctx)
+}
+
+func (f *Faulty) ReviewReferrerFlag(ctx context.Context, id int, resolution string, actorID int) (ReferrerFlag, error) {
+	if err := f.inject(ctx, "ReviewReferrerFlag"); err != nil {
+		return ReferrerFlag{}, err
+	}
+	return f.inner.ReviewReferrerFlag(ctx, id, resolution, actorID)
+}
+
+// RewardStore
+
+func (f *Faulty) GetReferralStats(ctx context.Context, userID int) (ReferralStats, error) {
+	if err := f.inject(ctx, "GetReferralStats"); err != nil {
+		return ReferralStats{}, err
+	}
+	return f.inner.GetReferralStats(ctx, userID)
+}
+
+func (f *Faulty) RedeemReward(ctx context.Context, userID int, amount int64, note string) (Redemption, error) {
+	if err := f.inject(ctx, "RedeemReward"); err != nil {
+		return Redemption{}, err
+	}
+	return f.inner.RedeemReward(ctx, userID, amount, note)
+}
+
+func (f *Faulty) ListRedemptions(ctx context.Context, userID int, limit int, offset int) ([]Redemption, error) {
+	if err := f.inject(ctx, "ListRedemptions"); err != nil {
+		return nil, err
+	}
+	return f.inner.ListRedemptions(ctx, userID, limit, offset)
+}
+
+// TokenStore
+
+func (f *Faulty) ConsumeMagicLinkToken(ctx context.Context, jti string, email string, expiresAt time.Time) error {
+	if err := f.inject(ctx, "ConsumeMagicLinkToken"); err != nil {
+		return err
+	}
+	return f.inner.ConsumeMagicLinkToken(ctx, jti, email, expiresAt)
+}
+
+func (f *Faulty) ConsumeActionToken(ctx context.Context, nonce string, userID int, action string, expiresAt time.Time) error {
+	if err := f.inject(ctx, "ConsumeActionToken"); err != nil {
+		return err
+	}
+	return f.inner.ConsumeActionToken(ctx, nonce, userID, action, expiresAt)
+}
+
+// MaintenanceStore
+
+func (f *Faulty) ConsistencyCheck(ctx context.Context, fix bool) (ConsistencyReport, error) {
+	if err := f.inject(ctx, "ConsistencyCheck"); err != nil {
+		return ConsistencyReport{}, err
+	}
+	return f.inner.ConsistencyCheck(ctx, fix)
+}
+
+// OverviewStore
+
+func (f *Faulty) CountSignups(ctx context.Context, since time.Time) (int, error) {
+	if err := f.inject(ctx, "CountSignups"); err != nil {
+		return 0, err
+	}
+	return f.inner.CountSignups(ctx, since)
+}
+
+func (f *Faulty) CountActiveCodes(ctx context.Context) (int, error) {
+	if err := f.inject(ctx, "CountActiveCodes"); err != nil {
+		return 0, err
+	}
+	return f.inner.CountActiveCodes(ctx)
+}
+
+// WebhookStore
+
+func (f *Faulty) EnqueueWebhook(ctx context.Context, event string, payload json.RawMessage, targets []string) error {
+	if err := f.inject(ctx, "EnqueueWebhook"); err != nil {
+		return err
+	}
+	return f.inner.EnqueueWebhook(ctx, event, payload, targets)
+}
+
+func (f *Faulty) ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]WebhookDelivery, error) {
+	if err := f.inject(ctx, "ClaimWebhookDeliveries"); err != nil {
+		return nil, err
+	}
+	return f.inner.ClaimWebhookDeliveries(ctx, limit, lease)
+}
+
+func (f *Faulty) GetWebhookDelivery(ctx context.Context, id int) (WebhookDelivery, error) {
+	if err := f.inject(ctx, "GetWebhookDelivery"); err != nil {
+		return WebhookDelivery{}, err
+	}
+	return f.inner.GetWebhookDelivery(ctx, id)
+}
+
+func (f *Faulty) RecordWebhookAttempt(ctx context.Context, id int, attempt WebhookAttempt) (WebhookDelivery, error) {
+	if err := f.inject(ctx, "RecordWebhookAttempt"); err != nil {
+		return WebhookDelivery{}, err
+	}
+	return f.inner.RecordWebhookAttempt(ctx, id, attempt)
+}
+
+func (f *Faulty) ListWebhookDeliveries(ctx context.Context, filter WebhookDeliveryFilter, limit int, offset int) ([]WebhookDelivery, error) {
+	if err := f.inject(ctx, "ListWebhookDeliveries"); err != nil {
+		return nil, err
+	}
+	return f.inner.ListWebhookDeliveries(ctx, filter, limit, offset)
+}
+
+func (f *Faulty) WebhookStats(ctx context.Context) ([]WebhookTargetStats, error) {
+	if err := f.inject(ctx, "WebhookStats"); err != nil {
+		return nil, err
+	}
+	return f.inner.WebhookStats(ctx)
+}
+
+// TermsStore
+
+func (f *Faulty) AcceptTerms(ctx context.Context, userID int, version string, ip string) (TermsAcceptance, error) {
+	if err := f.inject(ctx, "AcceptTerms"); err != nil {
+		return TermsAcceptance{}, err
+	}
+	return f.inner.AcceptTerms(ctx, userID, version, ip)
+}
+
+func (f *Faulty) TermsAccepted(ctx context.Context, userID int, version string) (bool, error) {
+	if err := f.inject(ctx, "TermsAccepted"); err != nil {
+		return false, err
+	}
+	return f.inner.TermsAccepted(ctx, userID, version)
+}
+
+// ReminderStore
+
+func (f *Faulty) ClaimExpiringCodes(ctx context.Context, until time.Time, limit int) ([]ExpiringCode, error) {
+	if err := f.inject(ctx, "ClaimExpiringCodes"); err != nil {
+		return nil, err
+	}
+	return f.inner.ClaimExpiringCodes(ctx, until, limit)
+}
+
+func (f *Faulty) ReleaseExpiringCode(ctx context.Context, codeID int) error {
+	if err := f.inject(ctx, "ReleaseExpiringCode"); err != nil {
+		return err
+	}
+	return f.inner.ReleaseExpiringCode(ctx, codeID)
+}
+
+// APIKeyStore
+
+func (f *Faulty) CreateAPIKey(ctx context.Context, k NewAPIKey) (APIKey, error) {
+	if err := f.inject(ctx, "CreateAPIKey"); err != nil {
+		return APIKey{}, err
+	}
+	return f.inner.CreateAPIKey(ctx, k)
+}
+
+func (f *Faulty) UseAPIKey(ctx context.Context, keyHash string) (APIKey, error) {
+	if err := f.inject(ctx, "UseAPIKey"); err != nil {
+		return APIKey{}, err
+	}
+	return f.inner.UseAPIKey(ctx, keyHash)
+}
+
+func (f *Faulty) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	if err := f.inject(ctx, "ListAPIKeys"); err != nil {
+		return nil, err
+	}
+	return f.inner.ListAPIKeys(ctx)
+}
+
+func (f *Faulty) RevokeAPIKey(ctx context.Context, id int, actorID int) error {
+	if err := f.inject(ctx, "RevokeAPIKey"); err != nil {
+		return err
+	}
+	return f.inner.RevokeAPIKey(ctx, id, actorID)
+}
+
+// QuotaStore
+
+func (f *Faulty) GetQuotaUsage(ctx context.Context, userID int, since time.Time) (QuotaUsage, error) {
+	if err := f.inject(ctx, "GetQuotaUsage"); err != nil {
+		return QuotaUsage{}, err
+	}
+	return f.inner.GetQuotaUsage(ctx, userID, since)
+}
+
+func (f *Faulty) GetUserLimits(ctx context.Context, userID int) (UserLimits, error) {
+	if err := f.inject(ctx, "GetUserLimits"); err != nil {
+		return UserLimits{}, err
+	}
+	return f.inner.GetUserLimits(ctx, userID)
+}
+
+func (f *Faulty) SetUserLimits(ctx context.Context, userID int, limits UserLimits, actorID int) (UserLimits, error) {
+	if err := f.inject(ctx, "SetUserLimits"); err != nil {
+		return UserLimits{}, err
+	}
+	return f.inner.SetUserLimits(ctx, userID, limits, actorID)
+}
+
+// StatementStore
+
+func (f *Faulty) GenerateStatements(ctx context.Context, period time.Time) (int, error) {
+	if err := f.inject(ctx, "GenerateStatements"); err != nil {
+		return 0, err
+	}
+	return f.inner.GenerateStatements(ctx, period)
+}
+
+func (f *Faulty) ClaimStatements(ctx context.Context, limit int, lease time.Duration) ([]ClaimedStatement, error) {
+	if err := f.inject(ctx, "ClaimStatements"); err != nil {
+		return nil, err
+	}
+	return f.inner.ClaimStatements(ctx, limit, lease)
+}
+
+func (f *Faulty) MarkStatementSent(ctx context.Context, id int) error {
+	if err := f.inject(ctx, "MarkStatementSent"); err != nil {
+		return err
+	}
+	return f.inner.MarkStatementSent(ctx, id)
+}
+
+func (f *Faulty) ReleaseStatement(ctx context.Context, id int) error {
+	if err := f.inject(ctx, "ReleaseStatement"); err != nil {
+		return err
+	}
+	return f.inner.ReleaseStatement(ctx, id)
+}
+
+func (f *Faulty) ListRewardStatements(ctx context.Context, userID int) ([]RewardStatement, error) {
+	if err := f.inject(ctx, "ListRewardStatements"); err != nil {
+		return nil, err
+	}
+	return f.inner.ListRewardStatements(ctx, userID)
+}
+
+func (f *Faulty) GetRewardStatement(ctx context.Context, userID int, period time.Time) (RewardStatement, error) {
+	if err := f.inject(ctx, "GetRewardStatement"); err != nil {
+		return RewardStatement{}, err
+	}
+	return f.inner.GetRewardStatement(ctx, userID, period)
+}
+
+func (f *Faulty) ListLedgerEntries(ctx context.Context, userID int, period time.Time) ([]LedgerEntry, error) {
+	if err := f.inject(ctx, "ListLedgerEntries"); err != nil {
+		return nil, err
+	}
+	return f.inner.ListLedgerEntries(ctx, userID, period)
+}
+
+// RetentionStore
+
+func (f *Faulty) ScrubPersonalData(ctx context.Context, target string, before time.Time, limit int) (int, error) {
+	if err := f.inject(ctx, "ScrubPersonalData"); err != nil {
+		return 0, err
+	}
+	return f.inner.ScrubPersonalData(ctx, target, before, limit)
+}
+
+func (f *Faulty) PurgeCodeArchive(ctx context.Context, before time.Time, limit int) (int, error) {
+	if err := f.inject(ctx, "PurgeCodeArchive"); err != nil {
+		return 0, err
+	}
+	return f.inner.PurgeCodeArchive(ctx, before, limit)
+}
+
+func (f *Faulty) PurgeWebhookDeliveries(ctx context.Context, before time.Time, limit int) (int, error) {
+	if err := f.inject(ctx, "PurgeWebhookDeliveries"); err != nil {
+		return 0, err
+	}
+	return f.inner.PurgeWebhookDeliveries(ctx, before, limit)
+}
+
+// RegistrationQueueStore
+
+func (f *Faulty) EnqueueRegistration(ctx context.Context, id string, payload json.RawMessage, maxPending int) error {
+	if err := f.inject(ctx, "EnqueueRegistration"); err != nil {
+		return err
+	}
+	return f.inner.EnqueueRegistration(ctx, id, payload, maxPending)
+}
+
+func (f *Faulty) ClaimRegistrations(ctx context.Context, limit int, lease time.Duration) ([]QueuedRegistration, error) {
+	if err := f.inject(ctx, "ClaimRegistrations"); err != nil {
+		return nil, err
+	}
+	return f.inner.ClaimRegistrations(ctx, limit, lease)
+}
+
+func (f *Faulty) FinishRegistration(ctx context.Context, id string, status string, result json.RawMessage, errorCode string) error {
+	if err := f.inject(ctx, "FinishRegistration"); err != nil {
+		return err
+	}
+	return f.inner.FinishRegistration(ctx, id, status, result, errorCode)
+}
+
+func (f *Faulty) GetQueuedRegistration(ctx context.Context, id string) (QueuedRegistration, error) {
+	if err := f.inject(ctx, "GetQueuedRegistration"); err != nil {
+		return QueuedRegistration{}, err
+	}
+	return f.inner.GetQueuedRegistration(ctx, id)
+}
+
+func (f *Faulty) PurgeRegistrations(ctx context.Context, before time.Time, limit int) (int, error) {
+	if err := f.inject(ctx, "PurgeRegistrations"); err != nil {
+		return 0, err
+	}
+	return f.inner.PurgeRegistrations(ctx, before, limit)
+}
+
+// DisputeStore
+
+func (f *Faulty) FileDispute(ctx context.Context, nd NewDispute) (ReferralDispute, error) {
+	if err := f.inject(ctx, "FileDispute"); err != nil {
+		return ReferralDispute{}, err
+	}
+	return f.inner.FileDispute(ctx, nd)
+}
+
+func (f *Faulty) ListDisputes(ctx context.Context, filter DisputeFilter, limit int, offset int) ([]ReferralDispute, error) {
+	if err := f.inject(ctx, "ListDisputes"); err != nil {
+		return nil, err
+	}
+	return f.inner.ListDisputes(ctx, filter, limit, offset)
+}
+
+func (f *Faulty) ResolveDispute(ctx context.Context, id int, action string, note string, actorID int) (ReferralDispute, error) {
+	if err := f.inject(ctx, "ResolveDispute"); err != nil {
+		return ReferralDispute{}, err
+	}
+	return f.inner.ResolveDispute(ctx, id, action, note, actorID)
+}
@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	gomock "github.com/golang/mock/gomock"
+	"github.com/jackc/pgconn"
+)
+
+func TestFaultRules_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   FaultRules
+		wantErr bool
+	}{
+		{"Пустые правила", nil, false},
+		{"Верные правила", FaultRules{{Method: "*", Probability: 0.5, LatencyMs: 100, Error: FaultUnavailable}}, false},
+		{"Только задержка", FaultRules{{Method: "GetUserByID", Probability: 1, LatencyMs: 10}}, false},
+		{"Без метода", FaultRules{{Probability: 1}}, true},
+		{"Вероятность больше 1", FaultRules{{Method: "*", Probability: 1.5}}, true},
+		{"Отрицательная вероятность", FaultRules{{Method: "*", Probability: -0.1}}, true},
+		{"Отрицательная задержка", FaultRules{{Method: "*", Probability: 1, LatencyMs: -1}}, true},
+		{"Неизвестный сбой", FaultRules{{Method: "*", Probability: 1, Error: "meteor"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.rules.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFaulty_Inject(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	tests := []struct {
+		name      string
+		rules     FaultRules
+		roll      float64 // значение rand
+		wantInner bool
+		wantErr   error
+		wantCode  string // код ошибки PostgreSQL
+	}{
+		{"Без правил", nil, 0, true, nil, ""},
+		{"Правило другого метода", FaultRules{{Method: "GetUserByID", Probability: 1, Error: FaultTimeout}}, 0, true, nil, ""},
+		{"Правило не сработало", FaultRules{{Method: "GetReferralStats", Probability: 0.5, Error: FaultTimeout}}, 0.7, true, nil, ""},
+		{"Таймаут", FaultRules{{Method: "GetReferralStats", Probability: 1, Error: FaultTimeout}}, 0, false, context.DeadlineExceeded, ""},
+		{"Отмена", FaultRules{{Method: "*", Probability: 1, Error: FaultCanceled}}, 0, false, context.Canceled, ""},
+		{"Сервер недоступен", FaultRules{{Method: "*", Probability: 1, Error: FaultUnavailable}}, 0, false, nil, "57P01"},
+		{"Конфликт сериализации", FaultRules{{Method: "*", Probability: 1, Error: FaultSerialization}}, 0, false, nil, "40001"},
+		{"Первое подходящее правило", FaultRules{
+			{Method: "GetReferralStats", Probability: 0},
+			{Method: "*", Probability: 1, Error: FaultTimeout},
+		}, 0, true, nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner := NewMockDBInterface(ctrl)
+			if tt.wantInner {
+				inner.EXPECT().GetReferralStats(gomock.Any(), 1).Return(ReferralStats{Referrals: 3}, nil)
+			}
+			f := NewFaulty(inner, tt.rules)
+			f.rand = func() float64 { return tt.roll }
+
+			stats, err := f.GetReferralStats(context.Background(), 1)
+			if tt.wantInner {
+				if err != nil || stats.Referrals != 3 {
+					t.Fatalf("GetReferralStats() = %+v, %v, want the inner result", stats, err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("GetReferralStats() error = nil, want injected fault")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("error = %v, want %v", err, tt.wantErr)
+			}
+			var pgErr *pgconn.PgError
+			if tt.wantCode != "" && (!errors.As(err, &pgErr) || pgErr.Code != tt.wantCode) {
+				t.Errorf("error = %v, want PostgreSQL code %s", err, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestFaulty_LatencyHonorsContext(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	f := NewFaulty(NewMockDBInterface(ctrl), FaultRules{{Method: "*", Probability: 1, LatencyMs: 10000}})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := f.GetReferralStats(ctx, 1)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error = %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("latency was not interrupted: %v", elapsed)
+	}
+}
+
+func TestFaulty_SetRules(t *testing.T) {
+	f := NewFaulty(nil, nil)
+	if err := f.SetRules(FaultRules{{Method: "*", Probability: 2}}); err == nil {
+		t.Fatal("SetRules() accepted invalid rules")
+	}
+	if len(f.Rules()) != 0 {
+		t.Errorf("invalid rules replaced the active ones: %+v", f.Rules())
+	}
+	rules := FaultRules{{Method: "*", Probability: 1, Error: FaultReadOnly}}
+	if err := f.SetRules(rules); err != nil {
+		t.Fatal(err)
+	}
+	rules[0].Probability = 0
+	if got := f.Rules(); len(got) != 1 || got[0].Probability != 1 {
+		t.Errorf("Rules() = %+v, want a copy of the rules set", got)
+	}
+}
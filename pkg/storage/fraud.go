@@ -0,0 +1,205 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	pgxv4 "github.com/jackc/pgx/v4"
+)
+
+// Решения по отметке о реферере
+const (
+	FlagRelease = "release" // удержанные вознаграждения зачисляются как обычно
+	FlagForfeit = "forfeit" // удержанные вознаграждения аннулируются
+)
+
+// ErrFlagReviewed возвращается при повторном разборе отметки
+var ErrFlagReviewed = errors.New("отметка о реферере уже разобрана")
+
+// Активность реферера за период
+type ReferrerActivity struct {
+	ReferrerID    int
+	Signups       int    // регистрации по кодам реферера
+	TopSubnet     string // подсеть (/24 для IPv4, /64 для IPv6) с наибольшим числом регистраций
+	SubnetSignups int    // регистрации из TopSubnet
+}
+
+// Отметка о подозрительной активности реферера
+type ReferrerFlag struct {
+	ID         int       `json:"id"`
+	ReferrerID int       `json:"referrer_id"`
+	Score      float64   `json:"score"`
+	Reasons    []string  `json:"reasons"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+	// заполняются при разборе, см. ReviewReferrerFlag
+	ReviewedAt *time.Time `json:"reviewed_at,omitempty"`
+	Resolution string     `json:"resolution,omitempty"`
+}
+
+// Колонки referrer_flags в порядке полей scanFlag
+const flagColumns = `id, referrer_id, score::float8, reasons, created_at, updated_at, reviewed_at, COALESCE(resolution, '')`
+
+// scanFlag читает отметку из строки с колонками flagColumns
+func scanFlag(row pgxv4.Row) (ReferrerFlag, error) {
+	var f ReferrerFlag
+	err := row.Scan(&f.ID, &f.ReferrerID, &f.Score, &f.Reasons, &f.CreatedAt, &f.UpdatedAt, &f.ReviewedAt, &f.Resolution)
+	return f, err
+}
+
+// Получение активности рефереров, получивших рефералов после since
+func (db *DB) GetReferrerActivity(ctx context.Context, since time.Time) (_ []ReferrerActivity, err error) {
+	defer wrapError(&err, "referrer activity since=%s", since.Format(time.RFC3339))
+	rows, err := db.read.Query(ctx, `
+        WITH recent AS (
+            SELECT rl.referrer_id,
+                network(set_masklen(u.signup_ip, CASE WHEN family(u.signup_ip) = 4 THEN 24 ELSE 64 END)) AS subnet
+            FROM referral_links rl
+            JOIN users u ON u.id = rl.referee_id
+            WHERE rl.created_at >= $1
+        )
+        SELECT r.referrer_id, r.signups, COALESCE(s.subnet::text, ''), COALESCE(s.cnt, 0)
+        FROM (SELECT referrer_id, COUNT(*) AS signups FROM recent GROUP BY referrer_id) r
+        LEFT JOIN LATERAL (
+            SELECT subnet, COUNT(*) AS cnt FROM recent x
+            WHERE x.referrer_id = r.referrer_id AND x.subnet IS NOT NULL
+            GROUP BY subnet ORDER BY cnt DESC LIMIT 1
+        ) s ON true`, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var activity []ReferrerActivity
+	for rows.Next() {
+		var a ReferrerActivity
+		if err := rows.Scan(&a.ReferrerID, &a.Signups, &a.TopSubnet, &a.SubnetSignups); err != nil {
+			return nil, err
+		}
+		activity = append(activity, a)
+	}
+	return activity, rows.Err()
+}
+
+// Создание или обновление непросмотренной отметки о реферере
+func (db *DB) FlagReferrer(ctx context.Context, flag ReferrerFlag) (err error) {
+	defer wrapError(&err, "flag referrer=%d", flag.ReferrerID)
+	_, err = db.pool.Exec(ctx, `
+        INSERT INTO referrer_flags (referrer_id, score, reasons)
+        VALUES ($1, $2, $3)
+        ON CONFLICT (referrer_id) WHERE reviewed_at IS NULL
+        DO UPDATE SET score = EXCLUDED.score, reasons = EXCLUDED.reasons, updated_at = NOW()`,
+		flag.ReferrerID,
+		flag.Score,
+		flag.Reasons,
+	)
+	return err
+}
+
+// Получение непросмотренных отметок, начиная с самых подозрительных
+func (db *DB) ListReferrerFlags(ctx context.Context) (_ []ReferrerFlag, err error) {
+	defer wrapError(&err, "list referrer flags")
+	rows, err := db.read.Query(ctx, `
+        SELECT `+flagColumns+`
+        FROM referrer_flags
+        WHERE reviewed_at IS NULL
+        ORDER BY score DESC, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	flags := []ReferrerFlag{}
+	for rows.Next() {
+		f, err := scanFlag(rows)
+		if err != nil {
+			return nil, err
+		}
+		flags = append(flags, f)
+	}
+	return flags, rows.Err()
+}
+
+// Разбор отметки о реферере администратором. Решение FlagRelease
+// снимает удержание с вознаграждений, начисленных, пока отметка была
+// открыта: они зачисляются, если приглашенные выполнили обязательные
+// шаги. FlagForfeit аннулирует их. Отметка разбирается один раз.
+func (db *DB) ReviewReferrerFlag(ctx context.Context, id int, resolution string, actorID int) (_ ReferrerFlag, err error) {
+	defer wrapError(&err, "review referrer flag id=%d resolution=%s", id, resolution)
+	var f ReferrerFlag
+	err = db.pool.BeginFunc(ctx, func(tx pgxv4.Tx) error {
+		var err error
+		f, err = scanFlag(tx.QueryRow(ctx, `
+        SELECT `+flagColumns+` FROM referrer_flags WHERE id = $1 FOR UPDATE`, id))
+		if errors.Is(err, pgxv4.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if f.ReviewedAt != nil {
+			return ErrFlagReviewed
+		}
+
+		// строка реферера блокируется, как при начислении: новое
+		// вознаграждение не появится между снятием удержания и
+		// закрытием отметки
+		if _, err := tx.Exec(ctx, `SELECT id FROM users WHERE id = $1 FOR UPDATE`, f.ReferrerID); err != nil {
+			return err
+		}
+		status := RewardForfeited
+		if resolution == FlagRelease {
+			status = ""
+		}
+		rows, err := tx.Query(ctx, `
+        UPDATE referral_rewards SET review_status = NULLIF($3, '')
+        WHERE referrer_id = $1 AND review_status = $2
+        RETURNING referee_id`, f.ReferrerID, RewardPendingReview, status)
+		if err != nil {
+			return err
+		}
+		var referees []int
+		for rows.Next() {
+			var refereeID int
+			if err := rows.Scan(&refereeID); err != nil {
+				rows.Close()
+				return err
+			}
+			referees = append(referees, refereeID)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if resolution == FlagRelease {
+			for _, refereeID := range referees {
+				if err := db.vestRewards(ctx, tx, refereeID); err != nil {
+					return err
+				}
+			}
+		}
+
+		f, err = scanFlag(tx.QueryRow(ctx, `
+        UPDATE referrer_flags SET reviewed_at = NOW(), resolution = $2
+        WHERE id = $1
+        RETURNING `+flagColumns, id, resolution))
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(ctx, `
+        INSERT INTO audit_log (actor_id, action, target_user_id, payload)
+        VALUES ($1, $2, $3, $4)`,
+			actorID,
+			AuditFlagReviewed,
+			f.ReferrerID,
+			map[string]interface{}{"flag_id": f.ID, "resolution": resolution, "rewards": len(referees)},
+		)
+		return err
+	})
+	if err != nil {
+		return ReferrerFlag{}, err
+	}
+	return f, nil
+}
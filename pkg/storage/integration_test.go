@@ -0,0 +1,1960 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"golang.org/x/crypto/bcrypt"
+
+	"gorefer.go/pkg/migrations"
+	"gorefer.go/pkg/onboarding"
+	"gorefer.go/pkg/rewards"
+)
+
+// testDB подключается к базе из GOREFER_TEST_DB и применяет миграции.
+// Без переменной окружения интеграционные тесты пропускаются.
+func testDB(t *testing.T) *DB {
+	t.Helper()
+	dsn := os.Getenv("GOREFER_TEST_DB")
+	if dsn == "" {
+		t.Skip("GOREFER_TEST_DB не задана")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := migrations.RunMigrations(ctx, dsn); err != nil {
+		t.Fatal(err)
+	}
+	db, err := New(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	return db
+}
+
+// seedReferrer создает реферера с действующим кодом
+func seedReferrer(t *testing.T, db *DB, suffix string) string {
+	t.Helper()
+	ctx := context.Background()
+	code := "IT" + suffix
+	id, err := db.CreateUser(ctx, CreateUserParams{User: User{
+		Username: "referrer" + suffix, Email: "referrer" + suffix + "@example.com", Password: "x",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateReferralCode(ctx, id, code, time.Now().Add(time.Hour).Unix(), "", nil, DomainRestriction{}); err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+// referralState возвращает число пользователей с email, число их
+// реферальных связей и число использований кода
+func referralState(t *testing.T, db *DB, email, code string) (users, links, uses int) {
+	t.Helper()
+	err := db.pool.QueryRow(context.Background(), `
+        SELECT
+            (SELECT COUNT(*) FROM users WHERE email = $1),
+            (SELECT COUNT(*) FROM referral_links rl JOIN users u ON u.id = rl.referee_id WHERE u.email = $1),
+            (SELECT uses FROM referral_codes WHERE code = $2)`, email, code).
+		Scan(&users, &links, &uses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return users, links, uses
+}
+
+func TestIntegration_RegisterWithReferralCodeRetry(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+
+	t.Run("Сбой при создании связи и повтор", func(t *testing.T) {
+		suffix := fmt.Sprint(time.Now().UnixNano())
+		code := seedReferrer(t, db, suffix)
+		params := retryParams(t, suffix)
+
+		errDeadlock := errors.New("deadlock detected")
+		db.beforeReferralLink = func() error { return errDeadlock }
+		_, err := db.RegisterWithReferralCode(ctx, code, params)
+		db.beforeReferralLink = nil
+		if !errors.Is(err, errDeadlock) {
+			t.Fatalf("first attempt error = %v, want injected fault", err)
+		}
+
+		reg, err := db.RegisterWithReferralCode(ctx, code, params)
+		if err != nil {
+			t.Fatalf("retry error = %v", err)
+		}
+		if users, links, uses := referralState(t, db, params.Email, code); users != 1 || links != 1 || uses != 1 {
+			t.Errorf("users = %d, links = %d, uses = %d, want 1, 1, 1", users, links, uses)
+		}
+		if reg.Referrer.Username != "referrer"+suffix || reg.Referrer.ID == 0 || reg.UserID == 0 {
+			t.Errorf("registration = %+v, want referrer referrer%s", reg, suffix)
+		}
+	})
+
+	t.Run("Повтор после создания пользователя без связи", func(t *testing.T) {
+		suffix := fmt.Sprint(time.Now().UnixNano())
+		code := seedReferrer(t, db, suffix)
+		params := retryParams(t, suffix)
+
+		// прерванная попытка успела создать только пользователя
+		userID, err := db.CreateUser(ctx, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// без пароля пользователя чужой запрос не достраивает связь
+		for _, plain := range []string{"", "guess"} {
+			other := params
+			other.PlainPassword = plain
+			if _, err := db.RegisterWithReferralCode(ctx, code, other); !errors.Is(err, ErrEmailTaken) {
+				t.Errorf("retry with password %q error = %v, want ErrEmailTaken", plain, err)
+			}
+		}
+
+		reg, err := db.RegisterWithReferralCode(ctx, code, params)
+		if err != nil {
+			t.Fatalf("retry error = %v", err)
+		}
+		if reg.UserID != userID {
+			t.Errorf("retry UserID = %d, want existing user %d", reg.UserID, userID)
+		}
+		if users, links, uses := referralState(t, db, params.Email, code); users != 1 || links != 1 || uses != 1 {
+			t.Errorf("users = %d, links = %d, uses = %d, want 1, 1, 1", users, links, uses)
+		}
+
+		// пользователь уже со связью повторно не привязывается
+		if _, err := db.RegisterWithReferralCode(ctx, code, params); err == nil {
+			t.Error("second registration of a linked user succeeded, want error")
+		}
+	})
+
+	t.Run("Повтор по собственному коду", func(t *testing.T) {
+		suffix := fmt.Sprint(time.Now().UnixNano())
+		params := retryParams(t, suffix)
+		code := "OWN" + suffix
+		if err := db.ReserveReferralCode(ctx, params.Email, code, time.Now().Add(24*time.Hour).Unix(), DomainRestriction{}); err != nil {
+			t.Fatal(err)
+		}
+
+		// прерванная попытка создала пользователя, и код стал его собственным
+		if _, err := db.CreateUser(ctx, params); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.RegisterWithReferralCode(ctx, code, params); !errors.Is(err, ErrSelfReferral) {
+			t.Errorf("retry with own code error = %v, want ErrSelfReferral", err)
+		}
+		if users, links, uses := referralState(t, db, params.Email, code); users != 1 || links != 0 || uses != 0 {
+			t.Errorf("users = %d, links = %d, uses = %d, want 1, 0, 0", users, links, uses)
+		}
+	})
+}
+
+// retryParams возвращает параметры регистрации с хешем пароля и самим паролем
+func retryParams(t *testing.T, suffix string) CreateUserParams {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return CreateUserParams{
+		User:          User{Username: "referee" + suffix, Email: "referee" + suffix + "@example.com", Password: string(hash)},
+		PlainPassword: "secret",
+	}
+}
+
+// Одновременные регистрации по коду одного реферера не должны получить
+// одинаковый номер реферала: каждая ступень выдается ровно up_to раз.
+func TestIntegration_CreditReferralConcurrent(t *testing.T) {
+	db := testDB(t)
+	db.rewardTiers = rewards.Tiers{{UpTo: 2, Amount: 100}, {UpTo: 5, Amount: 30}}
+	ctx := context.Background()
+
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	code := seedReferrer(t, db, suffix)
+
+	const signups = 8
+	var wg sync.WaitGroup
+	for i := 0; i < signups; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			params := CreateUserParams{User: User{
+				Username: fmt.Sprintf("referee%s-%d", suffix, i), Email: fmt.Sprintf("referee%s-%d@example.com", suffix, i), Password: "x",
+			}}
+			if _, err := db.RegisterWithReferralCode(ctx, code, params); err != nil {
+				t.Errorf("registration %d error = %v", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	rows, err := db.pool.Query(ctx, `
+        SELECT rr.amount FROM referral_rewards rr
+        JOIN referral_codes rc ON rc.user_id = rr.referrer_id
+        WHERE rc.code = $1`, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var amounts []int64
+	for rows.Next() {
+		var amount int64
+		if err := rows.Scan(&amount); err != nil {
+			t.Fatal(err)
+		}
+		amounts = append(amounts, amount)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(amounts, func(i, j int) bool { return amounts[i] > amounts[j] })
+	if want := []int64{100, 100, 30, 30, 30}; !reflect.DeepEqual(amounts, want) {
+		t.Errorf("credited amounts = %v, want %v", amounts, want)
+	}
+}
+
+func TestIntegration_DuplicateRegistrationRace(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		// имя пользователя во втором запросе; совпадающее имя позволяет
+		// регистрации по коду достроить связь пользователя, созданного
+		// первым запросом, см. registrationRetryWindow
+		sameUsername bool
+	}{
+		{"Разные имена", false},
+		{"Одинаковые имена", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for round := 0; round < 10; round++ {
+				suffix := fmt.Sprintf("%d-%d", time.Now().UnixNano(), round)
+				code := seedReferrer(t, db, suffix)
+				email := "race" + suffix + "@example.com"
+				plain := CreateUserParams{User: User{Username: "plain" + suffix, Email: email, Password: "x"}}
+				referred := plain
+				if !tt.sameUsername {
+					referred.Username = "referred" + suffix
+				}
+
+				var (
+					wg               sync.WaitGroup
+					start            = make(chan struct{})
+					errPlain, errRef error
+				)
+				wg.Add(2)
+				go func() {
+					defer wg.Done()
+					<-start
+					_, errPlain = db.CreateUser(ctx, plain)
+				}()
+				go func() {
+					defer wg.Done()
+					<-start
+					_, errRef = db.RegisterWithReferralCode(ctx, code, referred)
+				}()
+				close(start)
+				wg.Wait()
+
+				for _, err := range []error{errPlain, errRef} {
+					if err != nil && !errors.Is(err, ErrEmailTaken) {
+						t.Fatalf("round %d: error = %v, want nil or ErrEmailTaken", round, err)
+					}
+				}
+				if errPlain != nil && errRef != nil {
+					t.Fatalf("round %d: both registrations failed", round)
+				}
+
+				users, links, uses := referralState(t, db, email, code)
+				if users != 1 {
+					t.Errorf("round %d: users = %d, want 1", round, users)
+				}
+				if links > 1 || uses != links {
+					t.Errorf("round %d: links = %d, uses = %d, want at most one link and uses equal to links", round, links, uses)
+				}
+				if errRef != nil && links != 0 {
+					t.Errorf("round %d: referral registration failed but link exists", round)
+				}
+			}
+		})
+	}
+}
+
+func TestIntegration_ConsistencyCheck(t *testing.T) {
+	db := testDB(t)
+	db.rewardTiers = rewards.Tiers{{UpTo: 5, Amount: 100}}
+	ctx := context.Background()
+
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	code := seedReferrer(t, db, suffix)
+	for i := 0; i < 2; i++ {
+		params := CreateUserParams{User: User{
+			Username: fmt.Sprintf("referee%s-%d", suffix, i), Email: fmt.Sprintf("referee%s-%d@example.com", suffix, i), Password: "x",
+		}}
+		if _, err := db.RegisterWithReferralCode(ctx, code, params); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// последствия неудачного выката: пропавшее вознаграждение и сбитый счетчик
+	var referrerID int
+	err := db.pool.QueryRow(ctx, `SELECT user_id FROM referral_codes WHERE code = $1`, code).Scan(&referrerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.pool.Exec(ctx, `
+        DELETE FROM referral_rewards WHERE id = (
+            SELECT MAX(id) FROM referral_rewards WHERE referrer_id = $1)`, referrerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.pool.Exec(ctx, `UPDATE referral_codes SET uses = 7 WHERE code = $1`, code); err != nil {
+		t.Fatal(err)
+	}
+
+	// расхождения по коду реферера; в общей базе могут быть и чужие
+	found := func(report ConsistencyReport) (missing, mismatched int) {
+		for _, m := range report.LinksWithoutRewards {
+			if m.ReferrerID == referrerID {
+				missing++
+			}
+		}
+		for _, m := range report.CodeUsageMismatches {
+			if m.Code == code {
+				mismatched++
+			}
+		}
+		return missing, mismatched
+	}
+
+	for _, fix := range []bool{false, true} {
+		report, err := db.ConsistencyCheck(ctx, fix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if missing, mismatched := found(report); missing != 1 || mismatched != 1 {
+			t.Errorf("ConsistencyCheck(fix=%t) found %d missing rewards, %d usage mismatches, want 1, 1", fix, missing, mismatched)
+		}
+	}
+
+	report, err := db.ConsistencyCheck(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if missing, mismatched := found(report); missing != 0 || mismatched != 0 {
+		t.Errorf("after fix found %d missing rewards, %d usage mismatches, want none", missing, mismatched)
+	}
+	if _, _, uses := referralState(t, db, "", code); uses != 2 {
+		t.Errorf("uses after fix = %d, want 2", uses)
+	}
+}
+
+func TestIntegration_CompareReferralCodes(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	old := seedReferrer(t, db, suffix)
+	register := func(code, name string, channel string, clickID int) {
+		t.Helper()
+		params := CreateUserParams{User: User{Username: name + suffix, Email: name + suffix + "@example.com", Password: "x"}, Channel: channel, ClickID: clickID}
+		if _, err := db.RegisterWithReferralCode(ctx, code, params); err != nil {
+			t.Fatal(err)
+		}
+	}
+	register(old, "old", "", 0)
+
+	// замена кода удаляет прежний, связь по нему остается
+	referrer, err := db.GetUserByEmail(ctx, "referrer"+suffix+"@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := old + "NEW"
+	if err := db.CreateReferralCode(ctx, referrer.ID, code, time.Now().Add(time.Hour).Unix(), "", nil, DomainRestriction{}); err != nil {
+		t.Fatal(err)
+	}
+	quiet := old + "QUIET"
+	if err := db.AddReferralCode(ctx, NewReferralCode{UserID: referrer.ID, Code: quiet, ExpiresAt: time.Now().Add(time.Hour).Unix()}, 3); err != nil {
+		t.Fatal(err)
+	}
+	var clickID int
+	for i := 0; i < 2; i++ {
+		if clickID, err = db.RecordClick(ctx, code); err != nil {
+			t.Fatal(err)
+		}
+	}
+	register(code, "clicked", ChannelLinkClick, clickID)
+	register(code, "typed", "", 0)
+
+	got, err := db.CompareReferralCodes(ctx, referrer.ID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	half := 0.5
+	want := []CodeComparison{
+		{Code: code, Current: true, Clicks: 2, Signups: 2, LinkSignups: 1, ConversionRate: &half},
+		{Code: old, Signups: 1},
+		{Code: quiet, Current: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("CompareReferralCodes() = %+v, want %+v", got, want)
+	}
+}
+
+// Переход из cookie сохраняется в связи, только если он существует и
+// относится к коду регистрации; иначе регистрация проходит без него.
+func TestIntegration_RegisterWithStaleClickID(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	code := seedReferrer(t, db, suffix)
+	other := seedReferrer(t, db, suffix+"o")
+	ownClick, err := db.RecordClick(ctx, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherClick, err := db.RecordClick(ctx, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		clickID int
+		want    int
+	}{
+		{"Own click", ownClick, ownClick},
+		{"Click of another code", otherClick, 0},
+		{"Deleted click", 2147483000, 0},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := fmt.Sprintf("click%d%s", i, suffix)
+			reg, err := db.RegisterWithReferralCode(ctx, code, CreateUserParams{
+				User:    User{Username: name, Email: name + "@example.com", Password: "x"},
+				Channel: ChannelLinkClick,
+				ClickID: tt.clickID,
+			})
+			if err != nil {
+				t.Fatalf("register error = %v", err)
+			}
+			var got *int
+			if err := db.pool.QueryRow(ctx, `
+        SELECT click_id FROM referral_links WHERE referee_id = $1`, reg.UserID).Scan(&got); err != nil {
+				t.Fatal(err)
+			}
+			if (got == nil) != (tt.want == 0) || got != nil && *got != tt.want {
+				t.Errorf("click_id = %v, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIntegration_RecordLogin(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	id, err := db.CreateUser(ctx, CreateUserParams{User: User{
+		Username: "login" + suffix, Email: "login" + suffix + "@example.com", Password: "x",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.RecordLogin(ctx, LoginEvent{UserID: id, IP: "not-an-ip", Success: false}); err != nil {
+		t.Fatal(err)
+	}
+	profile, err := db.GetProfile(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.LastLoginAt != nil {
+		t.Errorf("failed attempt set last_login_at = %v", profile.LastLoginAt)
+	}
+
+	if err := db.RecordLogin(ctx, LoginEvent{UserID: id, IP: "192.0.2.7", UserAgent: "it", Success: true}); err != nil {
+		t.Fatal(err)
+	}
+	if profile, err = db.GetProfile(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if profile.LastLoginAt == nil {
+		t.Error("successful login did not set last_login_at")
+	}
+
+	events, err := db.ListLoginEvents(ctx, id, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || !events[0].Success || events[0].IP != "192.0.2.7" || events[1].IP != "" {
+		t.Fatalf("ListLoginEvents() = %+v", events)
+	}
+
+	// анонимизация удаляет историю входов
+	if err := db.AnonymizeUser(ctx, id, id); err != nil {
+		t.Fatal(err)
+	}
+	if events, err = db.ListLoginEvents(ctx, id, 10, 0); err != nil || len(events) != 0 {
+		t.Errorf("after anonymize ListLoginEvents() = %+v, %v", events, err)
+	}
+}
+
+// Анонимизация удаляет данные клиента, сохраненные при регистрации
+func TestIntegration_AnonymizeUserSignupData(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	id, err := db.CreateUser(ctx, CreateUserParams{
+		User:      User{Username: "anon" + suffix, Email: "anon" + suffix + "@example.com", Password: "x"},
+		UserAgent: "it-agent",
+		IP:        "192.0.2.9",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.AcceptTerms(ctx, id, "v1", "192.0.2.10"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AnonymizeUser(ctx, id, id); err != nil {
+		t.Fatal(err)
+	}
+
+	var userAgent, signupIP *string
+	err = db.pool.QueryRow(ctx, `SELECT user_agent, signup_ip::text FROM users WHERE id = $1`, id).Scan(&userAgent, &signupIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userAgent != nil || signupIP != nil {
+		t.Errorf("user_agent = %v, signup_ip = %v after anonymize, want NULL", userAgent, signupIP)
+	}
+	var termsIPs int
+	if err := db.pool.QueryRow(ctx, `
+        SELECT COUNT(*) FROM terms_acceptances WHERE user_id = $1 AND ip IS NOT NULL`, id).Scan(&termsIPs); err != nil {
+		t.Fatal(err)
+	}
+	if termsIPs != 0 {
+		t.Errorf("terms acceptances with IP after anonymize = %d, want 0", termsIPs)
+	}
+}
+
+func TestIntegration_AnonymizeUserWebhooksAndTokens(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	email := "hooked" + suffix + "@example.com"
+	id, err := db.CreateUser(ctx, CreateUserParams{User: User{Username: "hooked" + suffix, Email: email, Password: "x"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := "https://hooks.example.com/" + suffix
+	registered, _ := json.Marshal(map[string]interface{}{"event": "user.registered", "data": User{ID: id, Email: email}})
+	referral, _ := json.Marshal(map[string]interface{}{"event": "referral.created", "data": map[string]interface{}{
+		"code": "X", "referee": User{ID: id, Email: email},
+	}})
+	other, _ := json.Marshal(map[string]interface{}{"event": "user.registered", "data": User{ID: -id, Email: "other@example.com"}})
+	for _, payload := range [][]byte{registered, referral, other} {
+		if err := db.EnqueueWebhook(ctx, "test", payload, []string{target}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	jti := "anon-" + suffix
+	if err := db.ConsumeMagicLinkToken(ctx, jti, strings.ToUpper(email), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.AnonymizeUser(ctx, id, id); err != nil {
+		t.Fatal(err)
+	}
+	deliveries, err := db.ListWebhookDeliveries(ctx, WebhookDeliveryFilter{Target: target}, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 || !strings.Contains(string(deliveries[0].Payload), "other@example.com") {
+		t.Errorf("deliveries after anonymize = %+v, want only the other user's event", deliveries)
+	}
+	var tokens int
+	if err := db.pool.QueryRow(ctx, `SELECT COUNT(*) FROM magic_link_tokens WHERE jti = $1`, jti).Scan(&tokens); err != nil {
+		t.Fatal(err)
+	}
+	if tokens != 0 {
+		t.Errorf("magic link tokens after anonymize = %d, want 0", tokens)
+	}
+}
+
+func TestIntegration_PurgeWebhookDeliveries(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+
+	target := "https://hooks.example.com/purge-" + fmt.Sprint(time.Now().UnixNano())
+	for i := 0; i < 3; i++ {
+		if err := db.EnqueueWebhook(ctx, "test", json.RawMessage(`{"data": {}}`), []string{target}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deliveries, err := db.ListWebhookDeliveries(ctx, WebhookDeliveryFilter{Target: target}, 10, 0)
+	if err != nil || len(deliveries) != 3 {
+		t.Fatalf("deliveries = %+v, %v", deliveries, err)
+	}
+	for i, status := range []string{WebhookDelivered, WebhookFailed} {
+		if _, err := db.RecordWebhookAttempt(ctx, deliveries[i].ID, WebhookAttempt{StatusCode: 200, Status: status}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// ожидающая доставка остается, сколько бы она ни ждала
+	if _, err := db.PurgeWebhookDeliveries(ctx, time.Now().Add(time.Hour), 1000); err != nil {
+		t.Fatal(err)
+	}
+	left, err := db.ListWebhookDeliveries(ctx, WebhookDeliveryFilter{Target: target}, 10, 0)
+	if err != nil || len(left) != 1 || left[0].Status != WebhookPending {
+		t.Errorf("deliveries after purge = %+v, %v; want only the pending one", left, err)
+	}
+}
+
+func TestIntegration_Seed(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+
+	count := func() (users, clicks, links int) {
+		t.Helper()
+		err := db.pool.QueryRow(ctx, `
+        SELECT
+            (SELECT COUNT(*) FROM users WHERE email LIKE '%@demo.gorefer.test'),
+            (SELECT COUNT(*) FROM referral_clicks c JOIN referral_codes rc ON rc.id = c.referral_code_id WHERE rc.code = 'ALICE2026'),
+            (SELECT COUNT(*) FROM referral_links WHERE code = 'ALICE2026')`).
+			Scan(&users, &clicks, &links)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return users, clicks, links
+	}
+
+	// загрузка безопасна при повторе и поверх меньшего профиля
+	for _, profile := range []string{SeedMinimal, SeedDemo, SeedDemo} {
+		if err := db.Seed(ctx, profile); err != nil {
+			t.Fatalf("Seed(%s): %v", profile, err)
+		}
+	}
+	users, clicks, links := count()
+	data, _ := SeedProfile(SeedDemo)
+	if users != len(data.Users) || links != 3 {
+		t.Errorf("after seeding users = %d, links = %d, want %d, 3", users, links, len(data.Users))
+	}
+	// alice загружена профилем minimal и не дополняется
+	if clicks != 3 {
+		t.Errorf("ALICE2026 clicks = %d, want 3", clicks)
+	}
+
+	admin, err := db.GetUserByEmail(ctx, "admin@demo.gorefer.test")
+	if err != nil || admin.Role != RoleAdmin {
+		t.Errorf("seeded admin = %+v, %v", admin, err)
+	}
+}
+
+func TestIntegration_ForeignKeys(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	code := seedReferrer(t, db, suffix)
+	referee, err := db.CreateUser(ctx, CreateUserParams{User: User{
+		Username: "fkreferee" + suffix, Email: "fkreferee" + suffix + "@example.com", Password: "x",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.pool.Exec(ctx, `
+        INSERT INTO referral_links (referrer_id, referee_id, code)
+        SELECT user_id, $1, code FROM referral_codes WHERE code = $2`, referee, code); err != nil {
+		t.Fatal(err)
+	}
+
+	// пользователя с реферальными связями удалить нельзя ни с одной стороны
+	for _, email := range []string{"referrer" + suffix + "@example.com", "fkreferee" + suffix + "@example.com"} {
+		_, err := db.pool.Exec(ctx, `DELETE FROM users WHERE email = $1`, email)
+		var pgErr *pgconn.PgError
+		if !errors.As(err, &pgErr) || pgErr.Code != "23503" {
+			t.Errorf("delete %s: err = %v, want foreign key violation", email, err)
+		}
+	}
+	if users, links, _ := referralState(t, db, "fkreferee"+suffix+"@example.com", code); users != 1 || links != 1 {
+		t.Errorf("after rejected deletes users = %d, links = %d, want 1, 1", users, links)
+	}
+
+	// код удаляется вместе с владельцем без связей
+	owner, err := db.CreateUser(ctx, CreateUserParams{User: User{
+		Username: "fkowner" + suffix, Email: "fkowner" + suffix + "@example.com", Password: "x",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateReferralCode(ctx, owner, "FK"+suffix, time.Now().Add(time.Hour).Unix(), "", nil, DomainRestriction{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.pool.Exec(ctx, `DELETE FROM users WHERE id = $1`, owner); err != nil {
+		t.Fatal(err)
+	}
+	var codes int
+	if err := db.pool.QueryRow(ctx, `SELECT COUNT(*) FROM referral_codes WHERE code = $1`, "FK"+suffix).Scan(&codes); err != nil {
+		t.Fatal(err)
+	}
+	if codes != 0 {
+		t.Errorf("code of deleted user remains: %d rows", codes)
+	}
+}
+
+func TestIntegration_ChainDepth(t *testing.T) {
+	db := testDB(t)
+	db.chainDepth = ChainDepth{Max: 2, Alert: 2}
+	ctx := context.Background()
+
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	code := seedReferrer(t, db, suffix)
+	register := func(code, name string) (ReferralRegistration, error) {
+		return db.RegisterWithReferralCode(ctx, code, CreateUserParams{User: User{
+			Username: name + suffix, Email: name + suffix + "@example.com", Password: "x",
+		}})
+	}
+
+	// реферер -> first -> second: глубина 2 допустима
+	first, err := register(code, "depth1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateReferralCode(ctx, first.UserID, "D1"+suffix, time.Now().Add(time.Hour).Unix(), "", nil, DomainRestriction{}); err != nil {
+		t.Fatal(err)
+	}
+	second, err := register("D1"+suffix, "depth2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var depth int
+	if err := db.pool.QueryRow(ctx, `SELECT depth FROM referral_links WHERE referee_id = $1`, second.UserID).Scan(&depth); err != nil {
+		t.Fatal(err)
+	}
+	if depth != 2 {
+		t.Errorf("depth = %d, want 2", depth)
+	}
+
+	// третье звено отклоняется вместе с учетом использования кода
+	if err := db.CreateReferralCode(ctx, second.UserID, "D2"+suffix, time.Now().Add(time.Hour).Unix(), "", nil, DomainRestriction{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := register("D2"+suffix, "depth3"); !errors.Is(err, ErrChainTooDeep) {
+		t.Fatalf("register at depth 3: err = %v, want ErrChainTooDeep", err)
+	}
+	if users, links, uses := referralState(t, db, "depth3"+suffix+"@example.com", "D2"+suffix); users != 0 || links != 0 || uses != 0 {
+		t.Errorf("after rejected signup users = %d, links = %d, uses = %d, want 0", users, links, uses)
+	}
+}
+
+func TestIntegration_GetReferralCodeByEmailNotFound(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	email := "nocode" + suffix + "@example.com"
+	if _, err := db.CreateUser(ctx, CreateUserParams{User: User{Username: "nocode" + suffix, Email: email, Password: "x"}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, email := range []string{email, "missing" + suffix + "@example.com"} {
+		if _, err := db.GetReferralCodeByEmail(ctx, email); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetReferralCodeByEmail(%s) error = %v, want ErrNotFound", email, err)
+		}
+	}
+}
+
+func TestIntegration_EmailCaseInsensitive(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	email := "Case" + suffix + "@Example.com"
+	id, err := db.CreateUser(ctx, CreateUserParams{User: User{Username: "case" + suffix, Email: email, Password: "x"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lower := strings.ToLower(email)
+	if exists, err := db.EmailExists(ctx, lower); err != nil || !exists {
+		t.Errorf("EmailExists(%s) = %v, %v; want true", lower, exists, err)
+	}
+	if u, err := db.GetUserByEmail(ctx, lower); err != nil || u.ID != id {
+		t.Errorf("GetUserByEmail(%s) = %+v, %v; want user %d", lower, u, err, id)
+	}
+	_, err = db.CreateUser(ctx, CreateUserParams{User: User{Username: "case2" + suffix, Email: strings.ToUpper(email), Password: "x"}})
+	if !errors.Is(err, ErrEmailTaken) {
+		t.Errorf("CreateUser with upper-case email error = %v, want ErrEmailTaken", err)
+	}
+}
+
+func TestIntegration_ExportUserDataRewards(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	code := seedReferrer(t, db, suffix)
+	var userID int
+	if err := db.pool.QueryRow(ctx, `SELECT user_id FROM referral_codes WHERE code = $1`, code).Scan(&userID); err != nil {
+		t.Fatal(err)
+	}
+	referee, err := db.CreateUser(ctx, CreateUserParams{User: User{
+		Username: "export" + suffix, Email: "export" + suffix + "@example.com", Password: "x",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.pool.Exec(ctx, `
+        INSERT INTO referral_rewards (referrer_id, referee_id, tier, amount, vested_at)
+        VALUES ($1, $2, 1, 300, now())`, userID, referee)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.RedeemReward(ctx, userID, 120, "payout"); err != nil {
+		t.Fatal(err)
+	}
+
+	export, err := db.ExportUserData(ctx, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(export.Rewards) != 1 {
+		t.Fatalf("rewards = %+v, want one", export.Rewards)
+	}
+	if r := export.Rewards[0]; r.Referee != "export"+suffix || r.Amount != 300 || r.Status != RewardVested || r.VestedAt == nil {
+		t.Errorf("reward = %+v", r)
+	}
+	if len(export.Redemptions) != 1 {
+		t.Fatalf("redemptions = %+v, want one", export.Redemptions)
+	}
+	if r := export.Redemptions[0]; r.Amount != -120 || r.BalanceAfter != 180 || r.Note != "payout" {
+		t.Errorf("redemption = %+v", r)
+	}
+}
+
+func TestIntegration_RedeemRewardConcurrent(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	code := seedReferrer(t, db, suffix)
+	var userID int
+	if err := db.pool.QueryRow(ctx, `SELECT user_id FROM referral_codes WHERE code = $1`, code).Scan(&userID); err != nil {
+		t.Fatal(err)
+	}
+	referee, err := db.CreateUser(ctx, CreateUserParams{User: User{
+		Username: "redeem" + suffix, Email: "redeem" + suffix + "@example.com", Password: "x",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.pool.Exec(ctx, `
+        INSERT INTO referral_rewards (referrer_id, referee_id, tier, amount)
+        VALUES ($1, $2, 1, 1000)`, userID, referee)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 20 списаний по 70 при балансе 1000: проходят ровно 14
+	const workers = 20
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		redeems int
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := db.RedeemReward(ctx, userID, 70, fmt.Sprint("worker ", i))
+			if errors.Is(err, ErrInsufficientBalance) {
+				return
+			}
+			if err != nil {
+				t.Errorf("redeem %d error = %v", i, err)
+				return
+			}
+			mu.Lock()
+			redeems++
+			mu.Unlock()
+		}(i)
+	}
+	wg.Wait()
+
+	stats, err := db.GetReferralStats(ctx, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if redeems != 14 || stats.Balance != 20 {
+		t.Errorf("redeemed %d times, balance %d; want 14 times, 20", redeems, stats.Balance)
+	}
+	redemptions, err := db.ListRedemptions(ctx, userID, workers, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(redemptions) != 14 || redemptions[0].BalanceAfter != 20 {
+		t.Errorf("redemptions = %d, last balance %d; want 14, 20", len(redemptions), redemptions[0].BalanceAfter)
+	}
+}
+
+// Токен действия принимается один раз
+func TestIntegration_ConsumeActionToken(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	id, err := db.CreateUser(ctx, CreateUserParams{User: User{Username: "action" + suffix, Email: "action" + suffix + "@example.com", Password: "x"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := "nonce-" + suffix
+	if err := db.ConsumeActionToken(ctx, nonce, id, "extend_code", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ConsumeActionToken(ctx, nonce, id, "extend_code", time.Now().Add(time.Hour)); !errors.Is(err, ErrTokenUsed) {
+		t.Errorf("second ConsumeActionToken() error = %v, want ErrTokenUsed", err)
+	}
+}
+
+// Изменение кода применяется вместе и только к текущему коду
+func TestIntegration_UpdateReferralCode(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	older := seedReferrer(t, db, suffix)
+	referrer, err := db.GetUserByEmail(ctx, "referrer"+suffix+"@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := older + "CUR"
+	originalExpiry := time.Now().Add(time.Hour).Unix()
+	if err := db.AddReferralCode(ctx, NewReferralCode{UserID: referrer.ID, Code: current, ExpiresAt: originalExpiry}, 5); err != nil {
+		t.Fatal(err)
+	}
+
+	expiresAt := time.Now().Add(48 * time.Hour).Unix()
+	err = db.UpdateReferralCode(ctx, referrer.ID, ReferralCodeUpdate{
+		Metadata:  json.RawMessage(`{"campaign":"spring"}`),
+		Domain:    &DomainRestriction{Domain: "acme.com"},
+		ExpiresAt: &expiresAt,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := db.GetReferralCodeDetails(ctx, current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Domain != "acme.com" || got.ExpiresAt.Unix() != expiresAt || !strings.Contains(string(got.Metadata), "spring") {
+		t.Errorf("current code = %+v, want all changes applied", got)
+	}
+	prev, err := db.GetReferralCodeDetails(ctx, older)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prev.Domain != "" || prev.ExpiresAt.Unix() == expiresAt || strings.Contains(string(prev.Metadata), "spring") {
+		t.Errorf("older code = %+v, want it unchanged", prev)
+	}
+
+	// срок вне допустимого не меняет ничего
+	past := time.Now().Add(-time.Hour).Unix()
+	err = db.UpdateReferralCode(ctx, referrer.ID, ReferralCodeUpdate{Domain: &DomainRestriction{}, ExpiresAt: &past})
+	if !errors.Is(err, ErrExpiryInPast) {
+		t.Fatalf("update with past expiry error = %v, want ErrExpiryInPast", err)
+	}
+	if got, err := db.GetReferralCodeDetails(ctx, current); err != nil || got.Domain != "acme.com" {
+		t.Errorf("after failed update: code = %+v, %v; want domain kept", got, err)
+	}
+
+	// CodeID выбирает другой код пользователя; чужой код не найден
+	err = db.UpdateReferralCode(ctx, referrer.ID, ReferralCodeUpdate{CodeID: prev.ID, ExpiresAt: &expiresAt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := db.GetReferralCodeDetails(ctx, older); err != nil || got.ExpiresAt.Unix() != expiresAt {
+		t.Errorf("older code after update by ID = %+v, %v; want new expiry", got, err)
+	}
+	err = db.UpdateReferralCode(ctx, referrer.ID+1, ReferralCodeUpdate{CodeID: prev.ID, ExpiresAt: &expiresAt})
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("update of another user's code error = %v, want ErrNotFound", err)
+	}
+}
+
+// Отклоненная по домену регистрация не учитывает использование кода и
+// не создает пользователя
+func TestIntegration_RegisterWithReferralCodeDomain(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	code := seedReferrer(t, db, suffix)
+	referrer, err := db.GetUserByEmail(ctx, "referrer"+suffix+"@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.UpdateReferralCode(ctx, referrer.ID, ReferralCodeUpdate{Domain: &DomainRestriction{Domain: "acme.com", Subdomains: true}}); err != nil {
+		t.Fatal(err)
+	}
+
+	mismatch := "out" + suffix + "@example.com"
+	_, err = db.RegisterWithReferralCode(ctx, code, CreateUserParams{User: User{Username: "out" + suffix, Email: mismatch, Password: "x"}})
+	if !errors.Is(err, ErrCodeDomainMismatch) {
+		t.Fatalf("RegisterWithReferralCode() error = %v, want ErrCodeDomainMismatch", err)
+	}
+	if users, _, uses := referralState(t, db, mismatch, code); users != 0 || uses != 0 {
+		t.Errorf("after mismatch: users = %d, uses = %d, want 0, 0", users, uses)
+	}
+
+	match := "in" + suffix + "@EU.Acme.com"
+	if _, err := db.RegisterWithReferralCode(ctx, code, CreateUserParams{User: User{Username: "in" + suffix, Email: match, Password: "x"}}); err != nil {
+		t.Fatal(err)
+	}
+	details, err := db.GetReferralCodeDetails(ctx, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if details.Uses != 1 || details.DomainRestriction != (DomainRestriction{Domain: "acme.com", Subdomains: true}) {
+		t.Errorf("details = uses %d, %+v; want 1 use restricted to acme.com", details.Uses, details.DomainRestriction)
+	}
+}
+
+func TestIntegration_GetActiveReferralCodeByUsername(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	code := seedReferrer(t, db, suffix)
+	referrer, err := db.GetUserByEmail(ctx, "referrer"+suffix+"@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := db.GetActiveReferralCodeByUsername(ctx, strings.ToUpper(referrer.Username))
+	if err != nil || got.Code != code {
+		t.Fatalf("GetActiveReferralCodeByUsername() = %q, %v; want %q", got.Code, err, code)
+	}
+
+	// имя, совпадающее с точностью до регистра, занято
+	_, err = db.CreateUser(ctx, CreateUserParams{User: User{
+		Username: strings.ToUpper(referrer.Username), Email: "twin" + suffix + "@example.com", Password: "x",
+	}})
+	if !errors.Is(err, ErrUsernameTaken) {
+		t.Errorf("CreateUser() with taken username error = %v, want ErrUsernameTaken", err)
+	}
+
+	if err := db.SetVanityLinkOptOut(ctx, referrer.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetActiveReferralCodeByUsername(ctx, referrer.Username); !errors.Is(err, ErrNotFound) {
+		t.Errorf("after opt-out error = %v, want ErrNotFound", err)
+	}
+}
+
+// Изменение профиля применяется целиком или не применяется
+func TestIntegration_UpdateProfile(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	id, err := db.CreateUser(ctx, CreateUserParams{User: User{Username: "profile" + suffix, Email: "profile" + suffix + "@example.com", Password: "x"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CreateUser(ctx, CreateUserParams{User: User{Username: "taken" + suffix, Email: "taken" + suffix + "@example.com", Password: "x"}}); err != nil {
+		t.Fatal(err)
+	}
+	before, err := db.GetProfile(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	optOut := true
+	err = db.UpdateProfile(ctx, id, ProfileUpdate{Username: "taken" + suffix, Timezone: "Asia/Tokyo", VanityLinkOptOut: &optOut})
+	if !errors.Is(err, ErrUsernameTaken) {
+		t.Fatalf("UpdateProfile() with taken username error = %v, want ErrUsernameTaken", err)
+	}
+	if got, err := db.GetProfile(ctx, id); err != nil || !reflect.DeepEqual(got, before) {
+		t.Errorf("profile after failed update = %+v, %v; want unchanged %+v", got, err, before)
+	}
+
+	if err := db.UpdateProfile(ctx, id, ProfileUpdate{Username: "renamed" + suffix, Timezone: "Asia/Tokyo", VanityLinkOptOut: &optOut}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := db.GetProfile(ctx, id)
+	if err != nil || got.Username != "renamed"+suffix || got.Timezone != "Asia/Tokyo" || !got.VanityLinkOptOut {
+		t.Errorf("profile after update = %+v, %v; want all fields changed", got, err)
+	}
+}
+
+func TestIntegration_TermsVersionGatesRedemption(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	code := seedReferrer(t, db, suffix)
+	referrer, err := db.GetUserByEmail(ctx, "referrer"+suffix+"@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	register := func(name string) error {
+		_, err := db.RegisterWithReferralCode(ctx, code, CreateUserParams{User: User{
+			Username: name + suffix, Email: name + suffix + "@example.com", Password: "x",
+		}})
+		return err
+	}
+
+	WithTermsVersion("v1")(db)
+	if err := register("before"); !errors.Is(err, ErrCodeInvalid) {
+		t.Fatalf("register before acceptance error = %v, want ErrCodeInvalid", err)
+	}
+	first, err := db.AcceptTerms(ctx, referrer.ID, "v1", "203.0.113.7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := db.AcceptTerms(ctx, referrer.ID, "v1", "198.51.100.1")
+	if err != nil || !again.AcceptedAt.Equal(first.AcceptedAt) || again.IP != "203.0.113.7" {
+		t.Errorf("repeated AcceptTerms() = %+v, %v; want first acceptance %+v", again, err, first)
+	}
+	if err := register("accepted"); err != nil {
+		t.Fatalf("register after acceptance: %v", err)
+	}
+
+	// новая версия снова требует принятия
+	WithTermsVersion("v2")(db)
+	if err := register("bumped"); !errors.Is(err, ErrCodeInvalid) {
+		t.Errorf("register after version bump error = %v, want ErrCodeInvalid", err)
+	}
+	if accepted, err := db.TermsAccepted(ctx, referrer.ID, "v2"); err != nil || accepted {
+		t.Errorf("TermsAccepted(v2) = %t, %v; want false", accepted, err)
+	}
+}
+
+func TestIntegration_ClaimExpiringCodes(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	code := seedReferrer(t, db, fmt.Sprint(time.Now().UnixNano()))
+
+	claim := func() *ExpiringCode {
+		t.Helper()
+		codes, err := db.ClaimExpiringCodes(ctx, time.Now().Add(2*time.Hour), 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range codes {
+			if c.Code == code {
+				return &c
+			}
+		}
+		return nil
+	}
+	c := claim()
+	if c == nil || c.Email == "" {
+		t.Fatalf("ClaimExpiringCodes() = %+v, want code %s with owner email", c, code)
+	}
+	if again := claim(); again != nil {
+		t.Errorf("code %s was claimed twice", code)
+	}
+	// снятая отметка возвращает код в выборку
+	if err := db.ReleaseExpiringCode(ctx, c.ID); err != nil {
+		t.Fatal(err)
+	}
+	if claim() == nil {
+		t.Errorf("released code %s was not claimed again", code)
+	}
+}
+
+func TestIntegration_GetCohortStats(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	code := seedReferrer(t, db, suffix)
+
+	var referees []int
+	for _, name := range []string{"cohort1", "cohort2"} {
+		reg, err := db.RegisterWithReferralCode(ctx, code, CreateUserParams{User: User{
+			Username: name + suffix, Email: name + suffix + "@example.com", Password: "x",
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		referees = append(referees, reg.UserID)
+	}
+	if err := db.CreateReferralCode(ctx, referees[0], "CO"+suffix, time.Now().Add(time.Hour).Unix(), "", nil, DomainRestriction{}); err != nil {
+		t.Fatal(err)
+	}
+	// когорта в прошлом, в случайном году, чтобы не пересекаться с
+	// данными других тестов
+	month := time.Date(1000+rand.Intn(900), 5, 1, 0, 0, 0, 0, time.UTC)
+	if _, err := db.pool.Exec(ctx, `
+        UPDATE referral_links SET created_at = $2 WHERE referee_id = ANY($1)`, referees, month.AddDate(0, 0, 9)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.pool.Exec(ctx, `
+        UPDATE referral_codes SET created_at = $2 WHERE user_id = $1`, referees[0], month.AddDate(0, 0, 19)); err != nil {
+		t.Fatal(err)
+	}
+
+	cohorts, err := db.GetCohortStats(ctx, month, month.AddDate(0, 1, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []CohortStat{{Month: month.Format("2006-01"), Referred: 2, Converted: 1, ConversionRate: 0.5}}
+	if !reflect.DeepEqual(cohorts, want) {
+		t.Errorf("GetCohortStats() = %+v, want %+v", cohorts, want)
+	}
+}
+
+func TestIntegration_TransferReferralCode(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	code := seedReferrer(t, db, suffix)
+	var oldOwner int
+	if err := db.pool.QueryRow(ctx, `SELECT user_id FROM referral_codes WHERE code = $1`, code).Scan(&oldOwner); err != nil {
+		t.Fatal(err)
+	}
+	newUser := func(name string) int {
+		t.Helper()
+		id, err := db.CreateUser(ctx, CreateUserParams{User: User{
+			Username: name + suffix, Email: name + suffix + "@example.com", Password: "x",
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	heir := newUser("heir")
+	for _, name := range []string{"first", "second"} {
+		referee := newUser(name)
+		_, err := db.pool.Exec(ctx, `
+        WITH l AS (
+            INSERT INTO referral_links (referrer_id, referee_id, code) VALUES ($1, $2, $3)
+        )
+        INSERT INTO referral_rewards (referrer_id, referee_id, tier, amount) VALUES ($1, $2, 1, 100)`,
+			oldOwner, referee, code)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := db.TransferReferralCode(ctx, code, oldOwner, false, heir); !errors.Is(err, ErrTransferInvalid) {
+		t.Errorf("transfer to the owner error = %v, want ErrTransferInvalid", err)
+	}
+	got, err := db.TransferReferralCode(ctx, code, heir, true, heir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.FromUserID != oldOwner || got.LinksMoved != 2 || got.RewardsMoved != 2 || got.AmountMoved != 200 {
+		t.Errorf("transfer = %+v, want 2 links and 200 moved from %d", got, oldOwner)
+	}
+	for user, want := range map[int]int64{oldOwner: 0, heir: 200} {
+		stats, err := db.GetReferralStats(ctx, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Balance != want {
+			t.Errorf("user %d balance = %d, want %d", user, stats.Balance, want)
+		}
+	}
+
+	// у прежнего владельца действующего кода больше нет, у нового - есть
+	if _, err := db.TransferReferralCode(ctx, code, oldOwner, false, heir); err != nil {
+		t.Errorf("transfer back error = %v", err)
+	}
+	other := seedReferrer(t, db, suffix+"b")
+	if _, err := db.TransferReferralCode(ctx, other, oldOwner, false, heir); !errors.Is(err, ErrOwnerHasActiveCode) {
+		t.Errorf("transfer to an owner with a code error = %v, want ErrOwnerHasActiveCode", err)
+	}
+}
+
+func TestIntegration_APIKeys(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	admin, err := db.CreateUser(ctx, CreateUserParams{User: User{
+		Username: "keyadmin" + suffix, Email: "keyadmin" + suffix + "@example.com", Password: "x",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := "hash" + suffix
+	created, err := db.CreateAPIKey(ctx, NewAPIKey{
+		Name: "billing", Prefix: "grk_test", KeyHash: hash, Scopes: []string{"reports:read"}, CreatedBy: admin,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	used, err := db.UseAPIKey(ctx, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used.ID != created.ID || used.LastUsedAt == nil || !used.HasScope("reports:read") {
+		t.Errorf("used key = %+v, want key %d with last_used_at and reports:read", used, created.ID)
+	}
+
+	if err := db.RevokeAPIKey(ctx, created.ID, admin); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.UseAPIKey(ctx, hash); !errors.Is(err, ErrNotFound) {
+		t.Errorf("use after revocation error = %v, want ErrNotFound", err)
+	}
+	if err := db.RevokeAPIKey(ctx, created.ID, admin); !errors.Is(err, ErrNotFound) {
+		t.Errorf("second revocation error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestIntegration_Quotas(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	user, err := db.CreateUser(ctx, CreateUserParams{User: User{
+		Username: "quota" + suffix, Email: "quota" + suffix + "@example.com", Password: "x",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	since := time.Now().Add(-time.Minute)
+	expires := time.Now().Add(time.Hour).Unix()
+	// замена кода тоже считается созданием
+	for i := 0; i < 2; i++ {
+		if err := db.CreateReferralCode(ctx, user, fmt.Sprintf("Q%d%s", i, suffix), expires, "", nil, DomainRestriction{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	usage, err := db.GetQuotaUsage(ctx, user, since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.CodesCreated != 2 || usage.ActiveCodes != 1 || usage.Invites != 0 || usage.NextCodeExpiry == nil {
+		t.Errorf("usage = %+v, want 2 created, 1 active with expiry", usage)
+	}
+	if usage, err := db.GetQuotaUsage(ctx, user, time.Now().Add(time.Minute)); err != nil || usage.CodesCreated != 0 {
+		t.Errorf("usage after window = %+v, %v, want nothing created", usage, err)
+	}
+
+	if limits, err := db.GetUserLimits(ctx, user); err != nil || limits != (UserLimits{}) {
+		t.Fatalf("limits = %+v, %v, want none", limits, err)
+	}
+	five := 5
+	if _, err := db.SetUserLimits(ctx, user, UserLimits{CodesPerDay: &five}, user); err != nil {
+		t.Fatal(err)
+	}
+	limits, err := db.GetUserLimits(ctx, user)
+	if err != nil || limits.CodesPerDay == nil || *limits.CodesPerDay != 5 || limits.ActiveCodes != nil {
+		t.Errorf("limits = %+v, %v, want codes_per_day 5", limits, err)
+	}
+	if _, err := db.SetUserLimits(ctx, -1, UserLimits{}, user); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unknown user: err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestIntegration_BulkImport(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	email := func(name string) string { return name + suffix + "@import.example.com" }
+	hash := testHash(t)
+	registered := time.Date(2019, time.May, 1, 12, 0, 0, 0, time.UTC)
+
+	// уже зарегистрированный пользователь становится реферером импорта
+	existingID, err := db.CreateUser(ctx, CreateUserParams{User: User{
+		Username: "imp_existing" + suffix, Email: email("existing"), Password: "x",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := ImportData{
+		Users: []ImportUser{
+			{Line: 2, Username: "imp_a" + suffix, Email: email("a"), PasswordHash: hash, CreatedAt: registered},
+			{Line: 3, Username: "imp_b" + suffix, Email: email("b"), PasswordHash: hash},
+			{Line: 4, Username: "imp_x" + suffix, Email: email("existing"), PasswordHash: hash},
+			{Line: 5, Username: "imp_existing" + suffix, Email: email("c"), PasswordHash: hash},
+		},
+		Links: []ImportLink{
+			{Line: 2, ReferrerEmail: email("existing"), RefereeEmail: email("a"), Code: "LEGACY", CreatedAt: registered},
+			{Line: 3, ReferrerEmail: email("a"), RefereeEmail: email("b")},
+			{Line: 4, ReferrerEmail: email("missing"), RefereeEmail: email("c")},
+		},
+	}
+
+	res, err := db.BulkImport(ctx, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.UsersImported != 2 || res.UsersSkipped != 1 || res.LinksImported != 2 || len(res.Rejects) != 2 {
+		t.Errorf("first import = %+v, want 2 users, 1 skipped, 2 links, 2 rejects", res)
+	}
+
+	a, err := db.GetUserByEmail(ctx, email("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(a.Password), []byte("secret")) != nil {
+		t.Error("imported password hash was not stored as is")
+	}
+	var linkedAt time.Time
+	var depth int
+	var channel string
+	err = db.pool.QueryRow(ctx, `SELECT created_at, channel FROM referral_links WHERE referee_id = $1`, a.ID).Scan(&linkedAt, &channel)
+	if err != nil || !linkedAt.Equal(registered) || channel != ChannelImport {
+		t.Errorf("link of a: created_at = %v, channel = %q, %v; want %v, %q", linkedAt, channel, err, registered, ChannelImport)
+	}
+	err = db.pool.QueryRow(ctx, `
+        SELECT rl.depth FROM referral_links rl JOIN users u ON u.id = rl.referee_id
+        WHERE u.email = $1`, email("b")).Scan(&depth)
+	if err != nil || depth != 2 {
+		t.Errorf("depth of b = %d, %v; want 2", depth, err)
+	}
+	if stats, err := db.GetReferralStats(ctx, existingID); err != nil || stats.RewardTotal != 0 {
+		t.Errorf("imported links credited rewards: %+v, %v", stats, err)
+	}
+
+	// повторный импорт ничего не меняет
+	res, err = db.BulkImport(ctx, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.UsersImported != 0 || res.UsersSkipped != 3 || res.LinksImported != 0 || res.LinksSkipped != 2 {
+		t.Errorf("second import = %+v, want everything skipped", res)
+	}
+}
+
+func TestIntegration_OnboardingVesting(t *testing.T) {
+	db := testDB(t)
+	db.rewardTiers = rewards.Tiers{{UpTo: 10, Amount: 100}}
+	db.onboarding = onboarding.Rules(onboarding.Steps)
+	ctx := context.Background()
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	code := seedReferrer(t, db, suffix)
+	email := "onboarding" + suffix + "@example.com"
+
+	reg, err := db.RegisterWithReferralCode(ctx, code, CreateUserParams{User: User{
+		Username: "onboarding" + suffix, Email: email, Password: "x",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vested := func() (vested bool) {
+		t.Helper()
+		err := db.pool.QueryRow(ctx, `
+        SELECT vested_at IS NOT NULL FROM referral_rewards WHERE referee_id = $1`, reg.UserID).Scan(&vested)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return vested
+	}
+
+	steps := []struct {
+		name string
+		do   func() error
+	}{
+		{onboarding.StepFirstLogin, func() error { return db.RecordLogin(ctx, LoginEvent{UserID: reg.UserID, Success: true}) }},
+		{onboarding.StepProfileCompleted, func() error { return db.SetTimezone(ctx, reg.UserID, "Europe/Berlin") }},
+		{onboarding.StepEmailVerified, func() error {
+			return db.ConsumeMagicLinkToken(ctx, "jti"+suffix, email, time.Now().Add(time.Hour))
+		}},
+	}
+	for i, step := range steps {
+		if vested() {
+			t.Fatalf("reward vested before %s", step.name)
+		}
+		if stats, err := db.GetReferralStats(ctx, reg.Referrer.ID); err != nil || stats.Balance != 0 || stats.RewardPending != 100 {
+			t.Errorf("before %s: stats = %+v, %v; want balance 0, pending 100", step.name, stats, err)
+		}
+		if err := step.do(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		refs, err := db.GetReferralsByReferrerID(ctx, reg.Referrer.ID, 10, 0)
+		if err != nil || len(refs) != 1 || refs[0].Onboarding == nil || len(refs[0].Onboarding.Completed) != i+1 {
+			t.Errorf("after %s: referrals = %+v, %v", step.name, refs, err)
+		}
+	}
+	if !vested() {
+		t.Fatal("reward not vested after all steps")
+	}
+	if stats, err := db.GetReferralStats(ctx, reg.Referrer.ID); err != nil || stats.Balance != 100 || stats.RewardPending != 0 {
+		t.Errorf("after vesting: stats = %+v, %v; want balance 100", stats, err)
+	}
+}
+
+// Вознаграждение реферера с открытой отметкой удерживается: не входит в
+// баланс и не зачисляется после шагов знакомства до разбора отметки.
+func TestIntegration_FlaggedReferrerRewardsHeld(t *testing.T) {
+	db := testDB(t)
+	db.rewardTiers = rewards.Tiers{{UpTo: 10, Amount: 100}}
+	db.onboarding = onboarding.Rules{onboarding.StepFirstLogin}
+	ctx := context.Background()
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	code := seedReferrer(t, db, suffix)
+
+	register := func(t *testing.T, name string) ReferralRegistration {
+		t.Helper()
+		reg, err := db.RegisterWithReferralCode(ctx, code, CreateUserParams{User: User{
+			Username: name + suffix, Email: name + suffix + "@example.com", Password: "x",
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// обязательный шаг выполнен: без отметки вознаграждение зачислилось бы
+		if err := db.RecordLogin(ctx, LoginEvent{UserID: reg.UserID, Success: true}); err != nil {
+			t.Fatal(err)
+		}
+		return reg
+	}
+	flag := func(t *testing.T, referrerID int) int {
+		t.Helper()
+		if err := db.FlagReferrer(ctx, ReferrerFlag{ReferrerID: referrerID, Score: 2, Reasons: []string{"burst"}}); err != nil {
+			t.Fatal(err)
+		}
+		var id int
+		err := db.pool.QueryRow(ctx, `
+        SELECT id FROM referrer_flags WHERE referrer_id = $1 AND reviewed_at IS NULL`, referrerID).Scan(&id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	wantStats := func(t *testing.T, referrerID int, held, balance int64) {
+		t.Helper()
+		stats, err := db.GetReferralStats(ctx, referrerID)
+		if err != nil || stats.RewardHeld != held || stats.Balance != balance || stats.RewardPending != 0 {
+			t.Errorf("stats = %+v, %v; want held %d, balance %d", stats, err, held, balance)
+		}
+	}
+
+	// регистрация первого приглашенного создает строку реферера для отметки
+	first := register(t, "first")
+	referrerID := first.Referrer.ID
+	wantStats(t, referrerID, 0, 100)
+
+	id := flag(t, referrerID)
+	register(t, "held")
+	wantStats(t, referrerID, 100, 100)
+	if _, err := db.RedeemReward(ctx, referrerID, 200, "payout"); !errors.Is(err, ErrInsufficientBalance) {
+		t.Errorf("redeem including held reward error = %v, want ErrInsufficientBalance", err)
+	}
+
+	f, err := db.ReviewReferrerFlag(ctx, id, FlagRelease, referrerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Resolution != FlagRelease || f.ReviewedAt == nil {
+		t.Errorf("flag = %+v, want reviewed with release", f)
+	}
+	wantStats(t, referrerID, 0, 200)
+	if _, err := db.ReviewReferrerFlag(ctx, id, FlagForfeit, referrerID); !errors.Is(err, ErrFlagReviewed) {
+		t.Errorf("second review error = %v, want ErrFlagReviewed", err)
+	}
+
+	id = flag(t, referrerID)
+	forfeited := register(t, "forfeited")
+	if _, err := db.ReviewReferrerFlag(ctx, id, FlagForfeit, referrerID); err != nil {
+		t.Fatal(err)
+	}
+	wantStats(t, referrerID, 0, 200)
+	refs, err := db.GetReferralsByReferrerID(ctx, referrerID, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range refs {
+		if r.ID == forfeited.UserID && r.Reward != RewardForfeited {
+			t.Errorf("forfeited referral reward = %q, want %q", r.Reward, RewardForfeited)
+		}
+	}
+}
+
+// Отмена контекста прерывает запрос, ждущий блокировку строки, и
+// возвращает соединение в пул, не дожидаясь снятия блокировки.
+func TestIntegration_CancelReleasesConnection(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	seedReferrer(t, db, suffix)
+	user, err := db.GetUserByEmail(ctx, "referrer"+suffix+"@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		lock string // блокировка, которую ждет call
+		call func(ctx context.Context) error
+	}{
+		{"CreateReferralCode", `SELECT id FROM users WHERE id = $1 FOR UPDATE`, func(ctx context.Context) error {
+			return db.CreateReferralCode(ctx, user.ID, "ITC"+suffix, time.Now().Add(time.Hour).Unix(), "", nil, DomainRestriction{})
+		}},
+		{"DeleteReferralCode", `SELECT id FROM referral_codes WHERE user_id = $1 FOR UPDATE`, func(ctx context.Context) error {
+			return db.DeleteReferralCode(ctx, user.ID)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx, err := db.pool.Begin(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tx.Rollback(ctx)
+			if _, err := tx.Exec(ctx, tt.lock, user.ID); err != nil {
+				t.Fatal(err)
+			}
+			held := db.PoolStats().Acquired
+
+			callCtx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			done := make(chan error, 1)
+			go func() { done <- tt.call(callCtx) }()
+
+			waitAcquired := func(want int32) {
+				t.Helper()
+				deadline := time.Now().Add(2 * time.Second)
+				for db.PoolStats().Acquired != want {
+					if time.Now().After(deadline) {
+						t.Fatalf("acquired = %d, want %d", db.PoolStats().Acquired, want)
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+			}
+			waitAcquired(held + 1)
+
+			cancel()
+			select {
+			case err := <-done:
+				if !errors.Is(err, context.Canceled) {
+					t.Errorf("err = %v, want context.Canceled", err)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("call still waits for the lock after cancel")
+			}
+			waitAcquired(held)
+		})
+	}
+}
+
+func TestIntegration_RewardStatements(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	code := seedReferrer(t, db, suffix)
+	var userID int
+	if err := db.pool.QueryRow(ctx, `SELECT user_id FROM referral_codes WHERE code = $1`, code).Scan(&userID); err != nil {
+		t.Fatal(err)
+	}
+	referee, err := db.CreateUser(ctx, CreateUserParams{User: User{
+		Username: "stmt" + suffix, Email: "stmt" + suffix + "@example.com", Password: "x",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	period := time.Date(2001, 3, 1, 0, 0, 0, 0, time.UTC)
+	_, err = db.pool.Exec(ctx, `
+        INSERT INTO referral_rewards (referrer_id, referee_id, tier, amount, vested_at)
+        VALUES ($1, $2, 1, 700, $3)`, userID, referee, period.Add(36*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// повторное создание не дублирует выписку
+	for i := 0; i < 2; i++ {
+		if _, err := db.GenerateStatements(ctx, period); err != nil {
+			t.Fatal(err)
+		}
+	}
+	st, err := db.GetRewardStatement(ctx, userID, period)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Period != "2001-03" || st.Earned != 700 || st.Entries != 1 || st.SentAt != nil {
+		t.Errorf("statement = %+v, want 2001-03 earned 700 of 1 entry, not sent", st)
+	}
+	entries, err := db.ListLedgerEntries(ctx, userID, period)
+	if err != nil || len(entries) != 1 || entries[0].Type != EntryReward || entries[0].Details != "stmt"+suffix {
+		t.Errorf("ListLedgerEntries() = %+v, %v", entries, err)
+	}
+
+	claim := func() *ClaimedStatement {
+		t.Helper()
+		statements, err := db.ClaimStatements(ctx, 1000, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range statements {
+			if s.ID == st.ID {
+				return &s
+			}
+		}
+		return nil
+	}
+	if c := claim(); c == nil || c.Email == "" {
+		t.Fatalf("ClaimStatements() = %+v, want statement %d with owner email", c, st.ID)
+	}
+	if claim() != nil {
+		t.Errorf("statement %d was claimed twice", st.ID)
+	}
+	if err := db.ReleaseStatement(ctx, st.ID); err != nil {
+		t.Fatal(err)
+	}
+	if claim() == nil {
+		t.Errorf("released statement %d was not claimed again", st.ID)
+	}
+	if err := db.MarkStatementSent(ctx, st.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ReleaseStatement(ctx, st.ID); err != nil {
+		t.Fatal(err)
+	}
+	if claim() != nil {
+		t.Errorf("sent statement %d was claimed again", st.ID)
+	}
+}
+
+func TestIntegration_ScrubPersonalData(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	userID, err := db.CreateUser(ctx, CreateUserParams{
+		User: User{Username: "scrub" + suffix, Email: "scrub" + suffix + "@example.com", Password: "x"},
+		IP:   "203.0.113.7", UserAgent: "Mozilla/5.0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// три входа 2001 года и один текущий
+	for _, at := range []string{"2001-01-01", "2001-01-02", "2001-01-03"} {
+		_, err := db.pool.Exec(ctx, `
+            INSERT INTO login_events (user_id, ip, user_agent, success, created_at)
+            VALUES ($1, '203.0.113.7', 'Mozilla/5.0', true, $2)`, userID, at)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.RecordLogin(ctx, LoginEvent{UserID: userID, IP: "203.0.113.7", UserAgent: "Mozilla/5.0", Success: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	before := time.Date(2002, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, want := range []int{2, 1, 0} {
+		n, err := db.ScrubPersonalData(ctx, ScrubLoginEvents, before, 2)
+		if err != nil || n != want {
+			t.Errorf("pass %d: ScrubPersonalData() = %d, %v; want %d", i, n, err, want)
+		}
+	}
+	events, err := db.ListLoginEvents(ctx, userID, 10, 0)
+	if err != nil || len(events) != 4 {
+		t.Fatalf("ListLoginEvents() = %+v, %v", events, err)
+	}
+	for _, e := range events {
+		old := e.CreatedAt.Before(before)
+		if scrubbed := e.IP == "" && e.UserAgent == ""; scrubbed != old {
+			t.Errorf("event at %s: scrubbed = %v, want %v", e.CreatedAt, scrubbed, old)
+		}
+	}
+
+	if _, err := db.ScrubPersonalData(ctx, "referral_clicks", before, 1); err == nil {
+		t.Error("ScrubPersonalData(referral_clicks) succeeded, want unknown target error")
+	}
+}
+
+func TestIntegration_CodeArchive(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	code := seedReferrer(t, db, suffix)
+	if _, err := db.RecordClick(ctx, code); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.RegisterWithReferralCode(ctx, code, CreateUserParams{User: User{
+		Username: "archived" + suffix, Email: "archived" + suffix + "@example.com", Password: "x",
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	deleted, err := db.DeleteReferralCodeByCode(ctx, code, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// без архива код известен только по связи, без переходов
+	linked, err := db.CompareReferralCodes(ctx, deleted.UserID, false)
+	if err != nil || len(linked) != 1 || linked[0].ArchivedAt != nil || linked[0].Clicks != 0 {
+		t.Errorf("CompareReferralCodes(false) = %+v, %v; want the code known by its link", linked, err)
+	}
+	all, err := db.CompareReferralCodes(ctx, deleted.UserID, true)
+	if err != nil || len(all) != 1 {
+		t.Fatalf("CompareReferralCodes(true) = %+v, %v; want the archived code", all, err)
+	}
+	if c := all[0]; c.Code != code || c.Current || c.ArchivedAt == nil || c.Clicks != 1 || c.Signups != 1 {
+		t.Errorf("archived code = %+v, want 1 click and 1 signup", c)
+	}
+
+	if _, err := db.RegisterWithReferralCode(ctx, code, CreateUserParams{User: User{
+		Username: "late" + suffix, Email: "late" + suffix + "@example.com", Password: "x",
+	}}); err == nil {
+		t.Error("registration with an archived code succeeded, want error")
+	}
+
+	if n, err := db.PurgeCodeArchive(ctx, time.Now().Add(time.Hour), 1000); err != nil || n < 1 {
+		t.Errorf("PurgeCodeArchive() = %d, %v; want the archived code purged", n, err)
+	}
+	if all, err := db.CompareReferralCodes(ctx, deleted.UserID, true); err != nil || len(all) != 1 || all[0].ArchivedAt != nil {
+		t.Errorf("CompareReferralCodes(true) after purge = %+v, %v; want the code known by its link", all, err)
+	}
+}
+
+func TestIntegration_RegistrationQueue(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	if _, err := db.pool.Exec(ctx, `DELETE FROM registration_queue`); err != nil {
+		t.Fatal(err)
+	}
+
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	ids := []string{"a" + suffix, "b" + suffix}
+	for _, id := range ids {
+		if err := db.EnqueueRegistration(ctx, id, json.RawMessage(`{"email":"queued@example.com"}`), 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.EnqueueRegistration(ctx, "c"+suffix, json.RawMessage(`{}`), 2); !errors.Is(err, ErrRegistrationQueueFull) {
+		t.Errorf("EnqueueRegistration() over the limit = %v, want ErrRegistrationQueueFull", err)
+	}
+
+	claimed, err := db.ClaimRegistrations(ctx, 1, time.Minute)
+	if err != nil || len(claimed) != 1 || claimed[0].ID != ids[0] || claimed[0].Attempts != 1 {
+		t.Fatalf("ClaimRegistrations() = %+v, %v; want the oldest registration", claimed, err)
+	}
+	// выбранная регистрация отложена на lease, вторая еще доступна
+	if claimed, err := db.ClaimRegistrations(ctx, 10, time.Minute); err != nil || len(claimed) != 1 || claimed[0].ID != ids[1] {
+		t.Errorf("second claim = %+v, %v; want only %s", claimed, err, ids[1])
+	}
+
+	if err := db.FinishRegistration(ctx, ids[0], RegistrationCompleted, json.RawMessage(`{"user":{"id":1}}`), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.FinishRegistration(ctx, ids[0], RegistrationFailed, nil, "EMAIL_TAKEN"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("second FinishRegistration() = %v, want ErrNotFound", err)
+	}
+	reg, err := db.GetQueuedRegistration(ctx, ids[0])
+	if err != nil || reg.Status != RegistrationCompleted || reg.Payload != nil || len(reg.Result) == 0 {
+		t.Errorf("finished registration = %+v, %v; want result without payload", reg, err)
+	}
+
+	if n, err := db.PurgeRegistrations(ctx, time.Now().Add(time.Hour), 10); err != nil || n != 1 {
+		t.Errorf("PurgeRegistrations() = %d, %v; want the finished registration", n, err)
+	}
+	if _, err := db.GetQueuedRegistration(ctx, ids[1]); err != nil {
+		t.Errorf("pending registration after purge: %v", err)
+	}
+}
+
+func TestIntegration_ReferralDisputes(t *testing.T) {
+	db := testDB(t)
+	db.rewardTiers = rewards.Tiers{{UpTo: 5, Amount: 100}}
+	ctx := context.Background()
+
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	code := seedReferrer(t, db, suffix)
+	var referrer int
+	if err := db.pool.QueryRow(ctx, `SELECT user_id FROM referral_codes WHERE code = $1`, code).Scan(&referrer); err != nil {
+		t.Fatal(err)
+	}
+	newUser := func(name string) int {
+		t.Helper()
+		id, err := db.CreateUser(ctx, CreateUserParams{User: User{
+			Username: name + suffix, Email: name + suffix + "@example.com", Password: "x",
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	// у реферала спора уже есть свой приглашенный
+	referee, invited := newUser("disputer"), newUser("invited")
+	if _, err := db.pool.Exec(ctx, `
+        INSERT INTO referral_links (referrer_id, referee_id, depth) VALUES ($1, $2, 1)`, referee, invited); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := db.FileDispute(ctx, NewDispute{FiledBy: referee, Code: code, Message: "used the code"})
+	if err != nil || d.ReferrerID != referrer || d.Status != DisputeOpen {
+		t.Fatalf("FileDispute() = %+v, %v; want open dispute against %d", d, err, referrer)
+	}
+	if _, err := db.FileDispute(ctx, NewDispute{FiledBy: referrer, Code: code, RefereeEmail: "DISPUTER" + suffix + "@example.com", Message: "mine"}); !errors.Is(err, ErrDisputeExists) {
+		t.Errorf("second open dispute error = %v, want ErrDisputeExists", err)
+	}
+
+	got, err := db.ResolveDispute(ctx, d.ID, DisputeAttach, "", referrer)
+	if err != nil || got.Status != DisputeResolved || got.Resolution != DisputeAttach || got.ResolvedAt == nil {
+		t.Fatalf("ResolveDispute() = %+v, %v; want resolved by attach", got, err)
+	}
+	if _, err := db.ResolveDispute(ctx, d.ID, DisputeReject, "", referrer); !errors.Is(err, ErrDisputeResolved) {
+		t.Errorf("second ResolveDispute() = %v, want ErrDisputeResolved", err)
+	}
+	depths := map[int]int{}
+	rows, err := db.pool.Query(ctx, `SELECT referee_id, depth FROM referral_links WHERE referee_id IN ($1, $2)`, referee, invited)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var id, depth int
+		if err := rows.Scan(&id, &depth); err != nil {
+			t.Fatal(err)
+		}
+		depths[id] = depth
+	}
+	if depths[referee] != 1 || depths[invited] != 2 {
+		t.Errorf("depths = %v, want referee 1 and invited 2", depths)
+	}
+	stats, err := db.GetReferralStats(ctx, referrer)
+	if err != nil || stats.Referrals != 1 || stats.RewardTotal != 100 {
+		t.Errorf("referrer stats = %+v, %v; want 1 referral and reward 100", stats, err)
+	}
+	if _, links, uses := referralState(t, db, "disputer"+suffix+"@example.com", code); links != 1 || uses != 1 {
+		t.Errorf("code links = %d, uses = %d, want 1 and 1", links, uses)
+	}
+
+	// обратная связь замкнула бы цепочку в цикл, повторная - дубль
+	back := seedReferrer(t, db, suffix+"b")
+	if _, err := db.pool.Exec(ctx, `UPDATE referral_codes SET user_id = $2 WHERE code = $1`, back, invited); err != nil {
+		t.Fatal(err)
+	}
+	cycle, err := db.FileDispute(ctx, NewDispute{FiledBy: referrer, Code: back, Message: "used the code"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ResolveDispute(ctx, cycle.ID, DisputeAttach, "", referrer); !errors.Is(err, ErrSelfReferral) {
+		t.Errorf("attach closing a cycle error = %v, want ErrSelfReferral", err)
+	}
+	if _, err := db.ResolveDispute(ctx, cycle.ID, DisputeReject, "no", referrer); err != nil {
+		t.Fatal(err)
+	}
+	dup, err := db.FileDispute(ctx, NewDispute{FiledBy: referee, Code: seedReferrer(t, db, suffix+"c"), Message: "or this one"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ResolveDispute(ctx, dup.ID, DisputeAttach, "", referrer); !errors.Is(err, ErrAlreadyReferred) {
+		t.Errorf("attach of a referred user error = %v, want ErrAlreadyReferred", err)
+	}
+}
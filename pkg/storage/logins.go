@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	pgxv4 "github.com/jackc/pgx/v4"
+
+	"gorefer.go/pkg/onboarding"
+)
+
+// Попытка входа пользователя
+type LoginEvent struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"-"`
+	IP        string    `json:"ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Success   bool      `json:"success"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Профиль текущего пользователя
+type Profile struct {
+	ID          int        `json:"id"`
+	Username    string     `json:"username"`
+	Email       string     `json:"email"`
+	Role        string     `json:"role"`
+	Timezone    string     `json:"timezone"`
+	CreatedAt   time.Time  `json:"created_at"`
+	LastLoginAt *time.Time `json:"last_login_at"` // nil - пользователь еще не входил
+	// ссылка /r/@username отключена пользователем
+	VanityLinkOptOut bool `json:"vanity_link_opt_out"`
+}
+
+// Запись попытки входа. Успешный вход обновляет last_login_at
+// пользователя и отмечает шаг onboarding.StepFirstLogin. Некорректный IP
+// не сохраняется, User-Agent обрезается как при регистрации.
+func (db *DB) RecordLogin(ctx context.Context, e LoginEvent) (err error) {
+	defer wrapError(&err, "record login user=%d success=%t", e.UserID, e.Success)
+	userAgent, ip := clientColumns(e.UserAgent, e.IP)
+	return db.pool.BeginFunc(ctx, func(tx pgxv4.Tx) error {
+		_, err := tx.Exec(ctx, `
+        INSERT INTO login_events (user_id, ip, user_agent, success)
+        VALUES ($1, NULLIF($2, '')::inet, NULLIF($3, ''), $4)`,
+			e.UserID, ip, userAgent, e.Success)
+		if err != nil || !e.Success {
+			return err
+		}
+		_, err = tx.Exec(ctx, `UPDATE users SET last_login_at = NOW() WHERE id = $1`, e.UserID)
+		if err != nil {
+			return err
+		}
+		return db.completeStep(ctx, tx, e.UserID, onboarding.StepFirstLogin)
+	})
+}
+
+// Попытки входа пользователя, новые первыми, с пропуском offset записей
+func (db *DB) ListLoginEvents(ctx context.Context, userID, limit, offset int) (_ []LoginEvent, err error) {
+	defer wrapError(&err, "list login events user=%d", userID)
+	rows, err := db.read.Query(ctx, `
+        SELECT id, user_id, COALESCE(host(ip), ''), COALESCE(user_agent, ''), success, created_at
+        FROM login_events
+        WHERE user_id = $1
+        ORDER BY created_at DESC, id DESC
+        LIMIT $2 OFFSET $3`, userID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []LoginEvent{}
+	for rows.Next() {
+		var e LoginEvent
+		if err := rows.Scan(&e.ID, &e.UserID, &e.IP, &e.UserAgent, &e.Success, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// Профиль пользователя с временем последнего входа
+func (db *DB) GetProfile(ctx context.Context, userID int) (_ Profile, err error) {
+	defer wrapError(&err, "get profile user=%d", userID)
+	var p Profile
+	err = db.pool.QueryRow(ctx, `
+        SELECT id, username, email, role, timezone, created_at, last_login_at, vanity_link_opt_out
+        FROM users WHERE id = $1`, userID).
+		Scan(&p.ID, &p.Username, &p.Email, &p.Role, &p.Timezone, &p.CreatedAt, &p.LastLoginAt, &p.VanityLinkOptOut)
+	if errors.Is(err, pgxv4.ErrNoRows) {
+		return Profile{}, ErrNotFound
+	}
+	return p, err
+}
@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// Фильтр списка реферальных кодов. Пустой MetaKey - без фильтра.
+type ReferralCodeFilter struct {
+	MetaKey   string // ключ метаданных
+	MetaValue string // строковое значение ключа
+}
+
+// containment возвращает JSON для оператора @> или nil без фильтра.
+func (f ReferralCodeFilter) containment() (interface{}, error) {
+	if f.MetaKey == "" {
+		return nil, nil
+	}
+	b, err := json.Marshal(map[string]string{f.MetaKey: f.MetaValue})
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// jsonbParam передает JSON как текст параметра jsonb; пустой JSON - NULL.
+func jsonbParam(raw json.RawMessage) interface{} {
+	if len(raw) == 0 {
+		return nil
+	}
+	return string(raw)
+}
+
+// Изменение реферального кода, см. UpdateReferralCode. Незаданные поля
+// не меняются.
+type ReferralCodeUpdate struct {
+	CodeID    int                // код пользователя; 0 - текущий код
+	Metadata  json.RawMessage    // новые метаданные целиком
+	Domain    *DomainRestriction // пустой Domain снимает ограничение
+	ExpiresAt *int64             // новый срок; напоминание отправляется заново
+}
+
+// Изменение реферального кода пользователя: u.CodeID или, если он не
+// задан, текущего - того же, что возвращает GetReferralCodeByUserID.
+// Метаданные, домен и срок меняются одним запросом: либо все, либо
+// ничего. Прочие коды пользователя не затрагиваются. Если кода нет или
+// он принадлежит другому пользователю - ErrNotFound.
+func (db *DB) UpdateReferralCode(ctx context.Context, userID int, u ReferralCodeUpdate) (err error) {
+	defer wrapError(&err, "update referral code user=%d", userID)
+	if u.ExpiresAt != nil {
+		if err := db.checkExpiry(*u.ExpiresAt); err != nil {
+			return err
+		}
+	}
+	var domain DomainRestriction
+	if u.Domain != nil {
+		domain = *u.Domain
+	}
+	tag, err := db.pool.Exec(ctx, `
+        UPDATE referral_codes SET
+            metadata = COALESCE($2::jsonb, metadata),
+            allowed_domain = CASE WHEN $3 THEN NULLIF($4, '') ELSE allowed_domain END,
+            allow_subdomains = CASE WHEN $3 THEN $5 ELSE allow_subdomains END,
+            expires_at = COALESCE(to_timestamp($6::float8), expires_at),
+            reminded_at = CASE WHEN $6::float8 IS NULL THEN reminded_at END
+        WHERE id = (
+            SELECT id FROM referral_codes
+            WHERE user_id = $1 AND ($7 = 0 OR id = $7)
+            ORDER BY created_at DESC, id DESC
+            LIMIT 1
+        )`,
+		userID,
+		jsonbParam(u.Metadata),
+		u.Domain != nil,
+		domain.Domain,
+		domain.Subdomains,
+		u.ExpiresAt,
+		u.CodeID,
+	)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Получение страницы реферальных кодов, отфильтрованных по метаданным
+func (db *DB) ListReferralCodes(ctx context.Context, filter ReferralCodeFilter, limit, offset int) (_ []ReferralCode, err error) {
+	defer wrapError(&err, "list referral codes")
+	contains, err := filter.containment()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.read.Query(ctx, `
+        SELECT id, COALESCE(user_id, 0), code, expires_at, uses, metadata,
+            COALESCE(allowed_domain, ''), allow_subdomains
+        FROM referral_codes
+        WHERE $1::jsonb IS NULL OR metadata @> $1::jsonb
+        ORDER BY id
+        LIMIT $2 OFFSET $3`, contains, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	codes := []ReferralCode{}
+	for rows.Next() {
+		var c ReferralCode
+		if err := rows.Scan(&c.ID, &c.UserID, &c.Code, &c.ExpiresAt, &c.Uses, &c.Metadata, &c.Domain, &c.Subdomains); err != nil {
+			return nil, err
+		}
+		codes = append(codes, c)
+	}
+	return codes, rows.Err()
+}
@@ -1,70 +1,298 @@
 // Code generated by MockGen. DO NOT EDIT.
-// Source: C:\dev\projects\GOREFER\pkg\storage\storage.go
+// Source: storage.go
 
 // Package storage is a generated GoMock package.
 package storage
 
 import (
 	context "context"
+	json "encoding/json"
 	reflect "reflect"
+	time "time"
 
 	gomock "github.com/golang/mock/gomock"
 )
 
-// MockDBInterface is a mock of DBInterface interface.
-type MockDBInterface struct {
+// MockUserStore is a mock of UserStore interface.
+type MockUserStore struct {
 	ctrl     *gomock.Controller
-	recorder *MockDBInterfaceMockRecorder
+	recorder *MockUserStoreMockRecorder
 }
 
-// MockDBInterfaceMockRecorder is the mock recorder for MockDBInterface.
-type MockDBInterfaceMockRecorder struct {
-	mock *MockDBInterface
+// MockUserStoreMockRecorder is the mock recorder for MockUserStore.
+type MockUserStoreMockRecorder struct {
+	mock *MockUserStore
 }
 
-// NewMockDBInterface creates a new mock instance.
-func NewMockDBInterface(ctrl *gomock.Controller) *MockDBInterface {
-	mock := &MockDBInterface{ctrl: ctrl}
-	mock.recorder = &MockDBInterfaceMockRecorder{mock}
+// NewMockUserStore creates a new mock instance.
+func NewMockUserStore(ctrl *gomock.Controller) *MockUserStore {
+	mock := &MockUserStore{ctrl: ctrl}
+	mock.recorder = &MockUserStoreMockRecorder{mock}
 	return mock
 }
 
 // EXPECT returns an object that allows the caller to indicate expected use.
-func (m *MockDBInterface) EXPECT() *MockDBInterfaceMockRecorder {
+func (m *MockUserStore) EXPECT() *MockUserStoreMockRecorder {
 	return m.recorder
 }
 
-// CreateReferralCode mocks base method.
-func (m *MockDBInterface) CreateReferralCode(ctx context.Context, userID int, code string, expiresAt int64) error {
+// AnonymizeUser mocks base method.
+func (m *MockUserStore) AnonymizeUser(ctx context.Context, userID, actorID int) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "CreateReferralCode", ctx, userID, code, expiresAt)
+	ret := m.ctrl.Call(m, "AnonymizeUser", ctx, userID, actorID)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
-// CreateReferralCode indicates an expected call of CreateReferralCode.
-func (mr *MockDBInterfaceMockRecorder) CreateReferralCode(ctx, userID, code, expiresAt interface{}) *gomock.Call {
+// AnonymizeUser indicates an expected call of AnonymizeUser.
+func (mr *MockUserStoreMockRecorder) AnonymizeUser(ctx, userID, actorID interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateReferralCode", reflect.TypeOf((*MockDBInterface)(nil).CreateReferralCode), ctx, userID, code, expiresAt)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AnonymizeUser", reflect.TypeOf((*MockUserStore)(nil).AnonymizeUser), ctx, userID, actorID)
 }
 
 // CreateUser mocks base method.
-func (m *MockDBInterface) CreateUser(ctx context.Context, user User) (int, error) {
+func (m *MockUserStore) CreateUser(ctx context.Context, params CreateUserParams) (int, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "CreateUser", ctx, user)
+	ret := m.ctrl.Call(m, "CreateUser", ctx, params)
 	ret0, _ := ret[0].(int)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // CreateUser indicates an expected call of CreateUser.
-func (mr *MockDBInterfaceMockRecorder) CreateUser(ctx, user interface{}) *gomock.Call {
+func (mr *MockUserStoreMockRecorder) CreateUser(ctx, params interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateUser", reflect.TypeOf((*MockUserStore)(nil).CreateUser), ctx, params)
+}
+
+// EmailExists mocks base method.
+func (m *MockUserStore) EmailExists(ctx context.Context, email string) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "EmailExists", ctx, email)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// EmailExists indicates an expected call of EmailExists.
+func (mr *MockUserStoreMockRecorder) EmailExists(ctx, email interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "EmailExists", reflect.TypeOf((*MockUserStore)(nil).EmailExists), ctx, email)
+}
+
+// ExportUserData mocks base method.
+func (m *MockUserStore) ExportUserData(ctx context.Context, userID int) (UserExport, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ExportUserData", ctx, userID)
+	ret0, _ := ret[0].(UserExport)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ExportUserData indicates an expected call of ExportUserData.
+func (mr *MockUserStoreMockRecorder) ExportUserData(ctx, userID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ExportUserData", reflect.TypeOf((*MockUserStore)(nil).ExportUserData), ctx, userID)
+}
+
+// GetProfile mocks base method.
+func (m *MockUserStore) GetProfile(ctx context.Context, userID int) (Profile, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetProfile", ctx, userID)
+	ret0, _ := ret[0].(Profile)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetProfile indicates an expected call of GetProfile.
+func (mr *MockUserStoreMockRecorder) GetProfile(ctx, userID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetProfile", reflect.TypeOf((*MockUserStore)(nil).GetProfile), ctx, userID)
+}
+
+// GetUserByEmail mocks base method.
+func (m *MockUserStore) GetUserByEmail(ctx context.Context, email string) (User, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUserByEmail", ctx, email)
+	ret0, _ := ret[0].(User)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetUserByEmail indicates an expected call of GetUserByEmail.
+func (mr *MockUserStoreMockRecorder) GetUserByEmail(ctx, email interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserByEmail", reflect.TypeOf((*MockUserStore)(nil).GetUserByEmail), ctx, email)
+}
+
+// GetUserByID mocks base method.
+func (m *MockUserStore) GetUserByID(ctx context.Context, id int) (User, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUserByID", ctx, id)
+	ret0, _ := ret[0].(User)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetUserByID indicates an expected call of GetUserByID.
+func (mr *MockUserStoreMockRecorder) GetUserByID(ctx, id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserByID", reflect.TypeOf((*MockUserStore)(nil).GetUserByID), ctx, id)
+}
+
+// ListLoginEvents mocks base method.
+func (m *MockUserStore) ListLoginEvents(ctx context.Context, userID, limit, offset int) ([]LoginEvent, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListLoginEvents", ctx, userID, limit, offset)
+	ret0, _ := ret[0].([]LoginEvent)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListLoginEvents indicates an expected call of ListLoginEvents.
+func (mr *MockUserStoreMockRecorder) ListLoginEvents(ctx, userID, limit, offset interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListLoginEvents", reflect.TypeOf((*MockUserStore)(nil).ListLoginEvents), ctx, userID, limit, offset)
+}
+
+// RecordLogin mocks base method.
+func (m *MockUserStore) RecordLogin(ctx context.Context, e LoginEvent) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RecordLogin", ctx, e)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RecordLogin indicates an expected call of RecordLogin.
+func (mr *MockUserStoreMockRecorder) RecordLogin(ctx, e interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RecordLogin", reflect.TypeOf((*MockUserStore)(nil).RecordLogin), ctx, e)
+}
+
+// SetTimezone mocks base method.
+func (m *MockUserStore) SetTimezone(ctx context.Context, userID int, timezone string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetTimezone", ctx, userID, timezone)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetTimezone indicates an expected call of SetTimezone.
+func (mr *MockUserStoreMockRecorder) SetTimezone(ctx, userID, timezone interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetTimezone", reflect.TypeOf((*MockUserStore)(nil).SetTimezone), ctx, userID, timezone)
+}
+
+// SetUsername mocks base method.
+func (m *MockUserStore) SetUsername(ctx context.Context, userID int, username string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetUsername", ctx, userID, username)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetUsername indicates an expected call of SetUsername.
+func (mr *MockUserStoreMockRecorder) SetUsername(ctx, userID, username interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetUsername", reflect.TypeOf((*MockUserStore)(nil).SetUsername), ctx, userID, username)
+}
+
+// SetVanityLinkOptOut mocks base method.
+func (m *MockUserStore) SetVanityLinkOptOut(ctx context.Context, userID int, optOut bool) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetVanityLinkOptOut", ctx, userID, optOut)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetVanityLinkOptOut indicates an expected call of SetVanityLinkOptOut.
+func (mr *MockUserStoreMockRecorder) SetVanityLinkOptOut(ctx, userID, optOut interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetVanityLinkOptOut", reflect.TypeOf((*MockUserStore)(nil).SetVanityLinkOptOut), ctx, userID, optOut)
+}
+
+// UpdateProfile mocks base method.
+func (m *MockUserStore) UpdateProfile(ctx context.Context, userID int, u ProfileUpdate) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateProfile", ctx, userID, u)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UpdateProfile indicates an expected call of UpdateProfile.
+func (mr *MockUserStoreMockRecorder) UpdateProfile(ctx, userID, u interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateProfile", reflect.TypeOf((*MockUserStore)(nil).UpdateProfile), ctx, userID, u)
+}
+
+// MockReferralCodeStore is a mock of ReferralCodeStore interface.
+type MockReferralCodeStore struct {
+	ctrl     *gomock.Controller
+	recorder *MockReferralCodeStoreMockRecorder
+}
+
+// MockReferralCodeStoreMockRecorder is the mock recorder for MockReferralCodeStore.
+type MockReferralCodeStoreMockRecorder struct {
+	mock *MockReferralCodeStore
+}
+
+// NewMockReferralCodeStore creates a new mock instance.
+func NewMockReferralCodeStore(ctrl *gomock.Controller) *MockReferralCodeStore {
+	mock := &MockReferralCodeStore{ctrl: ctrl}
+	mock.recorder = &MockReferralCodeStoreMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockReferralCodeStore) EXPECT() *MockReferralCodeStoreMockRecorder {
+	return m.recorder
+}
+
+// AddReferralCode mocks base method.
+func (m *MockReferralCodeStore) AddReferralCode(ctx context.Context, c NewReferralCode, limit int) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AddReferralCode", ctx, c, limit)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AddReferralCode indicates an expected call of AddReferralCode.
+func (mr *MockReferralCodeStoreMockRecorder) AddReferralCode(ctx, c, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddReferralCode", reflect.TypeOf((*MockReferralCodeStore)(nil).AddReferralCode), ctx, c, limit)
+}
+
+// CompareReferralCodes mocks base method.
+func (m *MockReferralCodeStore) CompareReferralCodes(ctx context.Context, userID int, includeArchived bool) ([]CodeComparison, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CompareReferralCodes", ctx, userID, includeArchived)
+	ret0, _ := ret[0].([]CodeComparison)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CompareReferralCodes indicates an expected call of CompareReferralCodes.
+func (mr *MockReferralCodeStoreMockRecorder) CompareReferralCodes(ctx, userID, includeArchived interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CompareReferralCodes", reflect.TypeOf((*MockReferralCodeStore)(nil).CompareReferralCodes), ctx, userID, includeArchived)
+}
+
+// CreateReferralCode mocks base method.
+func (m *MockReferralCodeStore) CreateReferralCode(ctx context.Context, userID int, code string, expiresAt int64, clientToken string, metadata json.RawMessage, domain DomainRestriction) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateReferralCode", ctx, userID, code, expiresAt, clientToken, metadata, domain)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CreateReferralCode indicates an expected call of CreateReferralCode.
+func (mr *MockReferralCodeStoreMockRecorder) CreateReferralCode(ctx, userID, code, expiresAt, clientToken, metadata, domain interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateUser", reflect.TypeOf((*MockDBInterface)(nil).CreateUser), ctx, user)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateReferralCode", reflect.TypeOf((*MockReferralCodeStore)(nil).CreateReferralCode), ctx, userID, code, expiresAt, clientToken, metadata, domain)
 }
 
 // DeleteReferralCode mocks base method.
-func (m *MockDBInterface) DeleteReferralCode(ctx context.Context, userID int) error {
+func (m *MockReferralCodeStore) DeleteReferralCode(ctx context.Context, userID int) error {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "DeleteReferralCode", ctx, userID)
 	ret0, _ := ret[0].(error)
@@ -72,13 +300,73 @@ func (m *MockDBInterface) DeleteReferralCode(ctx context.Context, userID int) er
 }
 
 // DeleteReferralCode indicates an expected call of DeleteReferralCode.
-func (mr *MockDBInterfaceMockRecorder) DeleteReferralCode(ctx, userID interface{}) *gomock.Call {
+func (mr *MockReferralCodeStoreMockRecorder) DeleteReferralCode(ctx, userID interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteReferralCode", reflect.TypeOf((*MockDBInterface)(nil).DeleteReferralCode), ctx, userID)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteReferralCode", reflect.TypeOf((*MockReferralCodeStore)(nil).DeleteReferralCode), ctx, userID)
+}
+
+// DeleteReferralCodeByCode mocks base method.
+func (m *MockReferralCodeStore) DeleteReferralCodeByCode(ctx context.Context, code string, actorID int) (DeletedReferralCode, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteReferralCodeByCode", ctx, code, actorID)
+	ret0, _ := ret[0].(DeletedReferralCode)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DeleteReferralCodeByCode indicates an expected call of DeleteReferralCodeByCode.
+func (mr *MockReferralCodeStoreMockRecorder) DeleteReferralCodeByCode(ctx, code, actorID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteReferralCodeByCode", reflect.TypeOf((*MockReferralCodeStore)(nil).DeleteReferralCodeByCode), ctx, code, actorID)
+}
+
+// GetActiveReferralCodeByUsername mocks base method.
+func (m *MockReferralCodeStore) GetActiveReferralCodeByUsername(ctx context.Context, username string) (ReferralCode, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetActiveReferralCodeByUsername", ctx, username)
+	ret0, _ := ret[0].(ReferralCode)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetActiveReferralCodeByUsername indicates an expected call of GetActiveReferralCodeByUsername.
+func (mr *MockReferralCodeStoreMockRecorder) GetActiveReferralCodeByUsername(ctx, username interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetActiveReferralCodeByUsername", reflect.TypeOf((*MockReferralCodeStore)(nil).GetActiveReferralCodeByUsername), ctx, username)
+}
+
+// GetCodeStats mocks base method.
+func (m *MockReferralCodeStore) GetCodeStats(ctx context.Context, userID int, includeArchived bool) ([]ReferralCodeStats, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetCodeStats", ctx, userID, includeArchived)
+	ret0, _ := ret[0].([]ReferralCodeStats)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetCodeStats indicates an expected call of GetCodeStats.
+func (mr *MockReferralCodeStoreMockRecorder) GetCodeStats(ctx, userID, includeArchived interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetCodeStats", reflect.TypeOf((*MockReferralCodeStore)(nil).GetCodeStats), ctx, userID, includeArchived)
+}
+
+// GetReferralCodeByClientToken mocks base method.
+func (m *MockReferralCodeStore) GetReferralCodeByClientToken(ctx context.Context, userID int, clientToken string) (ReferralCode, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetReferralCodeByClientToken", ctx, userID, clientToken)
+	ret0, _ := ret[0].(ReferralCode)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetReferralCodeByClientToken indicates an expected call of GetReferralCodeByClientToken.
+func (mr *MockReferralCodeStoreMockRecorder) GetReferralCodeByClientToken(ctx, userID, clientToken interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetReferralCodeByClientToken", reflect.TypeOf((*MockReferralCodeStore)(nil).GetReferralCodeByClientToken), ctx, userID, clientToken)
 }
 
 // GetReferralCodeByEmail mocks base method.
-func (m *MockDBInterface) GetReferralCodeByEmail(ctx context.Context, email string) (ReferralCode, error) {
+func (m *MockReferralCodeStore) GetReferralCodeByEmail(ctx context.Context, email string) (ReferralCode, error) {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "GetReferralCodeByEmail", ctx, email)
 	ret0, _ := ret[0].(ReferralCode)
@@ -87,51 +375,2493 @@ func (m *MockDBInterface) GetReferralCodeByEmail(ctx context.Context, email stri
 }
 
 // GetReferralCodeByEmail indicates an expected call of GetReferralCodeByEmail.
-func (mr *MockDBInterfaceMockRecorder) GetReferralCodeByEmail(ctx, email interface{}) *gomock.Call {
+func (mr *MockReferralCodeStoreMockRecorder) GetReferralCodeByEmail(ctx, email interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetReferralCodeByEmail", reflect.TypeOf((*MockDBInterface)(nil).GetReferralCodeByEmail), ctx, email)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetReferralCodeByEmail", reflect.TypeOf((*MockReferralCodeStore)(nil).GetReferralCodeByEmail), ctx, email)
 }
 
-// GetReferralsByReferrerID mocks base method.
-func (m *MockDBInterface) GetReferralsByReferrerID(ctx context.Context, referrerID int) ([]User, error) {
+// GetReferralCodeByUserID mocks base method.
+func (m *MockReferralCodeStore) GetReferralCodeByUserID(ctx context.Context, userID int) (ReferralCode, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetReferralsByReferrerID", ctx, referrerID)
-	ret0, _ := ret[0].([]User)
+	ret := m.ctrl.Call(m, "GetReferralCodeByUserID", ctx, userID)
+	ret0, _ := ret[0].(ReferralCode)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-// GetReferralsByReferrerID indicates an expected call of GetReferralsByReferrerID.
-func (mr *MockDBInterfaceMockRecorder) GetReferralsByReferrerID(ctx, referrerID interface{}) *gomock.Call {
+// GetReferralCodeByUserID indicates an expected call of GetReferralCodeByUserID.
+func (mr *MockReferralCodeStoreMockRecorder) GetReferralCodeByUserID(ctx, userID interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetReferralsByReferrerID", reflect.TypeOf((*MockDBInterface)(nil).GetReferralsByReferrerID), ctx, referrerID)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetReferralCodeByUserID", reflect.TypeOf((*MockReferralCodeStore)(nil).GetReferralCodeByUserID), ctx, userID)
 }
 
-// GetUserByEmail mocks base method.
-func (m *MockDBInterface) GetUserByEmail(ctx context.Context, email string) (User, error) {
+// GetReferralCodeDetails mocks base method.
+func (m *MockReferralCodeStore) GetReferralCodeDetails(ctx context.Context, code string) (ReferralCodeDetails, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetUserByEmail", ctx, email)
-	ret0, _ := ret[0].(User)
+	ret := m.ctrl.Call(m, "GetReferralCodeDetails", ctx, code)
+	ret0, _ := ret[0].(ReferralCodeDetails)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-// GetUserByEmail indicates an expected call of GetUserByEmail.
-func (mr *MockDBInterfaceMockRecorder) GetUserByEmail(ctx, email interface{}) *gomock.Call {
+// GetReferralCodeDetails indicates an expected call of GetReferralCodeDetails.
+func (mr *MockReferralCodeStoreMockRecorder) GetReferralCodeDetails(ctx, code interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserByEmail", reflect.TypeOf((*MockDBInterface)(nil).GetUserByEmail), ctx, email)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetReferralCodeDetails", reflect.TypeOf((*MockReferralCodeStore)(nil).GetReferralCodeDetails), ctx, code)
 }
 
-// RegisterWithReferralCode mocks base method.
-func (m *MockDBInterface) RegisterWithReferralCode(ctx context.Context, referralCode string, user User) error {
+// ListReferralCodes mocks base method.
+func (m *MockReferralCodeStore) ListReferralCodes(ctx context.Context, filter ReferralCodeFilter, limit, offset int) ([]ReferralCode, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListReferralCodes", ctx, filter, limit, offset)
+	ret0, _ := ret[0].([]ReferralCode)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListReferralCodes indicates an expected call of ListReferralCodes.
+func (mr *MockReferralCodeStoreMockRecorder) ListReferralCodes(ctx, filter, limit, offset interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListReferralCodes", reflect.TypeOf((*MockReferralCodeStore)(nil).ListReferralCodes), ctx, filter, limit, offset)
+}
+
+// ListUserReferralCodes mocks base method.
+func (m *MockReferralCodeStore) ListUserReferralCodes(ctx context.Context, userID int) ([]ReferralCode, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListUserReferralCodes", ctx, userID)
+	ret0, _ := ret[0].([]ReferralCode)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListUserReferralCodes indicates an expected call of ListUserReferralCodes.
+func (mr *MockReferralCodeStoreMockRecorder) ListUserReferralCodes(ctx, userID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListUserReferralCodes", reflect.TypeOf((*MockReferralCodeStore)(nil).ListUserReferralCodes), ctx, userID)
+}
+
+// ReserveReferralCode mocks base method.
+func (m *MockReferralCodeStore) ReserveReferralCode(ctx context.Context, email, code string, expiresAt int64, domain DomainRestriction) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "RegisterWithReferralCode", ctx, referralCode, user)
+	ret := m.ctrl.Call(m, "ReserveReferralCode", ctx, email, code, expiresAt, domain)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
-// RegisterWithReferralCode indicates an expected call of RegisterWithReferralCode.
-func (mr *MockDBInterfaceMockRecorder) RegisterWithReferralCode(ctx, referralCode, user interface{}) *gomock.Call {
+// ReserveReferralCode indicates an expected call of ReserveReferralCode.
+func (mr *MockReferralCodeStoreMockRecorder) ReserveReferralCode(ctx, email, code, expiresAt, domain interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReserveReferralCode", reflect.TypeOf((*MockReferralCodeStore)(nil).ReserveReferralCode), ctx, email, code, expiresAt, domain)
+}
+
+// TransferReferralCode mocks base method.
+func (m *MockReferralCodeStore) TransferReferralCode(ctx context.Context, code string, newOwnerID int, includeHistory bool, actorID int) (CodeTransfer, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "TransferReferralCode", ctx, code, newOwnerID, includeHistory, actorID)
+	ret0, _ := ret[0].(CodeTransfer)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// TransferReferralCode indicates an expected call of TransferReferralCode.
+func (mr *MockReferralCodeStoreMockRecorder) TransferReferralCode(ctx, code, newOwnerID, includeHistory, actorID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TransferReferralCode", reflect.TypeOf((*MockReferralCodeStore)(nil).TransferReferralCode), ctx, code, newOwnerID, includeHistory, actorID)
+}
+
+// UpdateReferralCode mocks base method.
+func (m *MockReferralCodeStore) UpdateReferralCode(ctx context.Context, userID int, u ReferralCodeUpdate) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateReferralCode", ctx, userID, u)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UpdateReferralCode indicates an expected call of UpdateReferralCode.
+func (mr *MockReferralCodeStoreMockRecorder) UpdateReferralCode(ctx, userID, u interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateReferralCode", reflect.TypeOf((*MockReferralCodeStore)(nil).UpdateReferralCode), ctx, userID, u)
+}
+
+// MockReferralStore is a mock of ReferralStore interface.
+type MockReferralStore struct {
+	ctrl     *gomock.Controller
+	recorder *MockReferralStoreMockRecorder
+}
+
+// MockReferralStoreMockRecorder is the mock recorder for MockReferralStore.
+type MockReferralStoreMockRecorder struct {
+	mock *MockReferralStore
+}
+
+// NewMockReferralStore creates a new mock instance.
+func NewMockReferralStore(ctrl *gomock.Controller) *MockReferralStore {
+	mock := &MockReferralStore{ctrl: ctrl}
+	mock.recorder = &MockReferralStoreMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockReferralStore) EXPECT() *MockReferralStoreMockRecorder {
+	return m.recorder
+}
+
+// GetCohortStats mocks base method.
+func (m *MockReferralStore) GetCohortStats(ctx context.Context, from, to time.Time) ([]CohortStat, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetCohortStats", ctx, from, to)
+	ret0, _ := ret[0].([]CohortStat)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetCohortStats indicates an expected call of GetCohortStats.
+func (mr *MockReferralStoreMockRecorder) GetCohortStats(ctx, from, to interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetCohortStats", reflect.TypeOf((*MockReferralStore)(nil).GetCohortStats), ctx, from, to)
+}
+
+// GetProgramReport mocks base method.
+func (m *MockReferralStore) GetProgramReport(ctx context.Context, from, to time.Time) (ProgramReport, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetProgramReport", ctx, from, to)
+	ret0, _ := ret[0].(ProgramReport)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetProgramReport indicates an expected call of GetProgramReport.
+func (mr *MockReferralStoreMockRecorder) GetProgramReport(ctx, from, to interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetProgramReport", reflect.TypeOf((*MockReferralStore)(nil).GetProgramReport), ctx, from, to)
+}
+
+// GetReferralsByReferrerID mocks base method.
+func (m *MockReferralStore) GetReferralsByReferrerID(ctx context.Context, referrerID, limit, offset int) ([]ReferralSummary, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetReferralsByReferrerID", ctx, referrerID, limit, offset)
+	ret0, _ := ret[0].([]ReferralSummary)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetReferralsByReferrerID indicates an expected call of GetReferralsByReferrerID.
+func (mr *MockReferralStoreMockRecorder) GetReferralsByReferrerID(ctx, referrerID, limit, offset interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetReferralsByReferrerID", reflect.TypeOf((*MockReferralStore)(nil).GetReferralsByReferrerID), ctx, referrerID, limit, offset)
+}
+
+// RecordClick mocks base method.
+func (m *MockReferralStore) RecordClick(ctx context.Context, code string) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RecordClick", ctx, code)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RecordClick indicates an expected call of RecordClick.
+func (mr *MockReferralStoreMockRecorder) RecordClick(ctx, code interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RecordClick", reflect.TypeOf((*MockReferralStore)(nil).RecordClick), ctx, code)
+}
+
+// RegisterWithReferralCode mocks base method.
+func (m *MockReferralStore) RegisterWithReferralCode(ctx context.Context, referralCode string, params CreateUserParams) (ReferralRegistration, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RegisterWithReferralCode", ctx, referralCode, params)
+	ret0, _ := ret[0].(ReferralRegistration)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RegisterWithReferralCode indicates an expected call of RegisterWithReferralCode.
+func (mr *MockReferralStoreMockRecorder) RegisterWithReferralCode(ctx, referralCode, params interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RegisterWithReferralCode", reflect.TypeOf((*MockReferralStore)(nil).RegisterWithReferralCode), ctx, referralCode, params)
+}
+
+// MockAuditStore is a mock of AuditStore interface.
+type MockAuditStore struct {
+	ctrl     *gomock.Controller
+	recorder *MockAuditStoreMockRecorder
+}
+
+// MockAuditStoreMockRecorder is the mock recorder for MockAuditStore.
+type MockAuditStoreMockRecorder struct {
+	mock *MockAuditStore
+}
+
+// NewMockAuditStore creates a new mock instance.
+func NewMockAuditStore(ctrl *gomock.Controller) *MockAuditStore {
+	mock := &MockAuditStore{ctrl: ctrl}
+	mock.recorder = &MockAuditStoreMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockAuditStore) EXPECT() *MockAuditStoreMockRecorder {
+	return m.recorder
+}
+
+// RecordAudit mocks base method.
+func (m *MockAuditStore) RecordAudit(ctx context.Context, actorID int, action string, targetUserID int, payload interface{}) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RecordAudit", ctx, actorID, action, targetUserID, payload)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RecordAudit indicates an expected call of RecordAudit.
+func (mr *MockAuditStoreMockRecorder) RecordAudit(ctx, actorID, action, targetUserID, payload interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RecordAudit", reflect.TypeOf((*MockAuditStore)(nil).RecordAudit), ctx, actorID, action, targetUserID, payload)
+}
+
+// MockFraudStore is a mock of FraudStore interface.
+type MockFraudStore struct {
+	ctrl     *gomock.Controller
+	recorder *MockFraudStoreMockRecorder
+}
+
+// MockFraudStoreMockRecorder is the mock recorder for MockFraudStore.
+type MockFraudStoreMockRecorder struct {
+	mock *MockFraudStore
+}
+
+// NewMockFraudStore creates a new mock instance.
+func NewMockFraudStore(ctrl *gomock.Controller) *MockFraudStore {
+	mock := &MockFraudStore{ctrl: ctrl}
+	mock.recorder = &MockFraudStoreMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockFraudStore) EXPECT() *MockFraudStoreMockRecorder {
+	return m.recorder
+}
+
+// FlagReferrer mocks base method.
+func (m *MockFraudStore) FlagReferrer(ctx context.Context, flag ReferrerFlag) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FlagReferrer", ctx, flag)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// FlagReferrer indicates an expected call of FlagReferrer.
+func (mr *MockFraudStoreMockRecorder) FlagReferrer(ctx, flag interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FlagReferrer", reflect.TypeOf((*MockFraudStore)(nil).FlagReferrer), ctx, flag)
+}
+
+// GetReferrerActivity mocks base method.
+func (m *MockFraudStore) GetReferrerActivity(ctx context.Context, since time.Time) ([]ReferrerActivity, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetReferrerActivity", ctx, since)
+	ret0, _ := ret[0].([]ReferrerActivity)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetReferrerActivity indicates an expected call of GetReferrerActivity.
+func (mr *MockFraudStoreMockRecorder) GetReferrerActivity(ctx, since interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetReferrerActivity", reflect.TypeOf((*MockFraudStore)(nil).GetReferrerActivity), ctx, since)
+}
+
+// ListReferrerFlags mocks base method.
+func (m *MockFraudStore) ListReferrerFlags(ctx context.Context) ([]ReferrerFlag, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListReferrerFlags", ctx)
+	ret0, _ := ret[0].([]ReferrerFlag)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListReferrerFlags indicates an expected call of ListReferrerFlags.
+func (mr *MockFraudStoreMockRecorder) ListReferrerFlags(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListReferrerFlags", reflect.TypeOf((*MockFraudStore)(nil).ListReferrerFlags), ctx)
+}
+
+// ReviewReferrerFlag mocks base method.
+func (m *MockFraudStore) ReviewReferrerFlag(ctx context.Context, id int, resolution string, actorID int) (ReferrerFlag, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReviewReferrerFlag", ctx, id, resolution, actorID)
+	ret0, _ := ret[0].(ReferrerFlag)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ReviewReferrerFlag indicates an expected call of ReviewReferrerFlag.
+func (mr *MockFraudStoreMockRecorder) ReviewReferrerFlag(ctx, id, resolution, actorID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReviewReferrerFlag", reflect.TypeOf((*MockFraudStore)(nil).ReviewReferrerFlag), ctx, id, resolution, actorID)
+}
+
+// MockTokenStore is a mock of TokenStore interface.
+type MockTokenStore struct {
+	ctrl     *gomock.Controller
+	recorder *MockTokenStoreMockRecorder
+}
+
+// MockTokenStoreMockRecorder is the mock recorder for MockTokenStore.
+type MockTokenStoreMockRecorder struct {
+	mock *MockTokenStore
+}
+
+// NewMockTokenStore creates a new mock instance.
+func NewMockTokenStore(ctrl *gomock.Controller) *MockTokenStore {
+	mock := &MockTokenStore{ctrl: ctrl}
+	mock.recorder = &MockTokenStoreMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockTokenStore) EXPECT() *MockTokenStoreMockRecorder {
+	return m.recorder
+}
+
+// ConsumeActionToken mocks base method.
+func (m *MockTokenStore) ConsumeActionToken(ctx context.Context, nonce string, userID int, action string, expiresAt time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ConsumeActionToken", ctx, nonce, userID, action, expiresAt)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ConsumeActionToken indicates an expected call of ConsumeActionToken.
+func (mr *MockTokenStoreMockRecorder) ConsumeActionToken(ctx, nonce, userID, action, expiresAt interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ConsumeActionToken", reflect.TypeOf((*MockTokenStore)(nil).ConsumeActionToken), ctx, nonce, userID, action, expiresAt)
+}
+
+// ConsumeMagicLinkToken mocks base method.
+func (m *MockTokenStore) ConsumeMagicLinkToken(ctx context.Context, jti, email string, expiresAt time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ConsumeMagicLinkToken", ctx, jti, email, expiresAt)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ConsumeMagicLinkToken indicates an expected call of ConsumeMagicLinkToken.
+func (mr *MockTokenStoreMockRecorder) ConsumeMagicLinkToken(ctx, jti, email, expiresAt interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ConsumeMagicLinkToken", reflect.TypeOf((*MockTokenStore)(nil).ConsumeMagicLinkToken), ctx, jti, email, expiresAt)
+}
+
+// MockRewardStore is a mock of RewardStore interface.
+type MockRewardStore struct {
+	ctrl     *gomock.Controller
+	recorder *MockRewardStoreMockRecorder
+}
+
+// MockRewardStoreMockRecorder is the mock recorder for MockRewardStore.
+type MockRewardStoreMockRecorder struct {
+	mock *MockRewardStore
+}
+
+// NewMockRewardStore creates a new mock instance.
+func NewMockRewardStore(ctrl *gomock.Controller) *MockRewardStore {
+	mock := &MockRewardStore{ctrl: ctrl}
+	mock.recorder = &MockRewardStoreMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockRewardStore) EXPECT() *MockRewardStoreMockRecorder {
+	return m.recorder
+}
+
+// GetReferralStats mocks base method.
+func (m *MockRewardStore) GetReferralStats(ctx context.Context, userID int) (ReferralStats, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetReferralStats", ctx, userID)
+	ret0, _ := ret[0].(ReferralStats)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetReferralStats indicates an expected call of GetReferralStats.
+func (mr *MockRewardStoreMockRecorder) GetReferralStats(ctx, userID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetReferralStats", reflect.TypeOf((*MockRewardStore)(nil).GetReferralStats), ctx, userID)
+}
+
+// ListRedemptions mocks base method.
+func (m *MockRewardStore) ListRedemptions(ctx context.Context, userID, limit, offset int) ([]Redemption, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListRedemptions", ctx, userID, limit, offset)
+	ret0, _ := ret[0].([]Redemption)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListRedemptions indicates an expected call of ListRedemptions.
+func (mr *MockRewardStoreMockRecorder) ListRedemptions(ctx, userID, limit, offset interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListRedemptions", reflect.TypeOf((*MockRewardStore)(nil).ListRedemptions), ctx, userID, limit, offset)
+}
+
+// RedeemReward mocks base method.
+func (m *MockRewardStore) RedeemReward(ctx context.Context, userID int, amount int64, note string) (Redemption, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RedeemReward", ctx, userID, amount, note)
+	ret0, _ := ret[0].(Redemption)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RedeemReward indicates an expected call of RedeemReward.
+func (mr *MockRewardStoreMockRecorder) RedeemReward(ctx, userID, amount, note interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RedeemReward", reflect.TypeOf((*MockRewardStore)(nil).RedeemReward), ctx, userID, amount, note)
+}
+
+// MockMaintenanceStore is a mock of MaintenanceStore interface.
+type MockMaintenanceStore struct {
+	ctrl     *gomock.Controller
+	recorder *MockMaintenanceStoreMockRecorder
+}
+
+// MockMaintenanceStoreMockRecorder is the mock recorder for MockMaintenanceStore.
+type MockMaintenanceStoreMockRecorder struct {
+	mock *MockMaintenanceStore
+}
+
+// NewMockMaintenanceStore creates a new mock instance.
+func NewMockMaintenanceStore(ctrl *gomock.Controller) *MockMaintenanceStore {
+	mock := &MockMaintenanceStore{ctrl: ctrl}
+	mock.recorder = &MockMaintenanceStoreMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockMaintenanceStore) EXPECT() *MockMaintenanceStoreMockRecorder {
+	return m.recorder
+}
+
+// ConsistencyCheck mocks base method.
+func (m *MockMaintenanceStore) ConsistencyCheck(ctx context.Context, fix bool) (ConsistencyReport, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ConsistencyCheck", ctx, fix)
+	ret0, _ := ret[0].(ConsistencyReport)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ConsistencyCheck indicates an expected call of ConsistencyCheck.
+func (mr *MockMaintenanceStoreMockRecorder) ConsistencyCheck(ctx, fix interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ConsistencyCheck", reflect.TypeOf((*MockMaintenanceStore)(nil).ConsistencyCheck), ctx, fix)
+}
+
+// MockOverviewStore is a mock of OverviewStore interface.
+type MockOverviewStore struct {
+	ctrl     *gomock.Controller
+	recorder *MockOverviewStoreMockRecorder
+}
+
+// MockOverviewStoreMockRecorder is the mock recorder for MockOverviewStore.
+type MockOverviewStoreMockRecorder struct {
+	mock *MockOverviewStore
+}
+
+// NewMockOverviewStore creates a new mock instance.
+func NewMockOverviewStore(ctrl *gomock.Controller) *MockOverviewStore {
+	mock := &MockOverviewStore{ctrl: ctrl}
+	mock.recorder = &MockOverviewStoreMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockOverviewStore) EXPECT() *MockOverviewStoreMockRecorder {
+	return m.recorder
+}
+
+// CountActiveCodes mocks base method.
+func (m *MockOverviewStore) CountActiveCodes(ctx context.Context) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CountActiveCodes", ctx)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CountActiveCodes indicates an expected call of CountActiveCodes.
+func (mr *MockOverviewStoreMockRecorder) CountActiveCodes(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CountActiveCodes", reflect.TypeOf((*MockOverviewStore)(nil).CountActiveCodes), ctx)
+}
+
+// CountSignups mocks base method.
+func (m *MockOverviewStore) CountSignups(ctx context.Context, since time.Time) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CountSignups", ctx, since)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CountSignups indicates an expected call of CountSignups.
+func (mr *MockOverviewStoreMockRecorder) CountSignups(ctx, since interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CountSignups", reflect.TypeOf((*MockOverviewStore)(nil).CountSignups), ctx, since)
+}
+
+// MockWebhookStore is a mock of WebhookStore interface.
+type MockWebhookStore struct {
+	ctrl     *gomock.Controller
+	recorder *MockWebhookStoreMockRecorder
+}
+
+// MockWebhookStoreMockRecorder is the mock recorder for MockWebhookStore.
+type MockWebhookStoreMockRecorder struct {
+	mock *MockWebhookStore
+}
+
+// NewMockWebhookStore creates a new mock instance.
+func NewMockWebhookStore(ctrl *gomock.Controller) *MockWebhookStore {
+	mock := &MockWebhookStore{ctrl: ctrl}
+	mock.recorder = &MockWebhookStoreMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockWebhookStore) EXPECT() *MockWebhookStoreMockRecorder {
+	return m.recorder
+}
+
+// ClaimWebhookDeliveries mocks base method.
+func (m *MockWebhookStore) ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]WebhookDelivery, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ClaimWebhookDeliveries", ctx, limit, lease)
+	ret0, _ := ret[0].([]WebhookDelivery)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ClaimWebhookDeliveries indicates an expected call of ClaimWebhookDeliveries.
+func (mr *MockWebhookStoreMockRecorder) ClaimWebhookDeliveries(ctx, limit, lease interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ClaimWebhookDeliveries", reflect.TypeOf((*MockWebhookStore)(nil).ClaimWebhookDeliveries), ctx, limit, lease)
+}
+
+// EnqueueWebhook mocks base method.
+func (m *MockWebhookStore) EnqueueWebhook(ctx context.Context, event string, payload json.RawMessage, targets []string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "EnqueueWebhook", ctx, event, payload, targets)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// EnqueueWebhook indicates an expected call of EnqueueWebhook.
+func (mr *MockWebhookStoreMockRecorder) EnqueueWebhook(ctx, event, payload, targets interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "EnqueueWebhook", reflect.TypeOf((*MockWebhookStore)(nil).EnqueueWebhook), ctx, event, payload, targets)
+}
+
+// GetWebhookDelivery mocks base method.
+func (m *MockWebhookStore) GetWebhookDelivery(ctx context.Context, id int) (WebhookDelivery, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetWebhookDelivery", ctx, id)
+	ret0, _ := ret[0].(WebhookDelivery)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetWebhookDelivery indicates an expected call of GetWebhookDelivery.
+func (mr *MockWebhookStoreMockRecorder) GetWebhookDelivery(ctx, id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetWebhookDelivery", reflect.TypeOf((*MockWebhookStore)(nil).GetWebhookDelivery), ctx, id)
+}
+
+// ListWebhookDeliveries mocks base method.
+func (m *MockWebhookStore) ListWebhookDeliveries(ctx context.Context, filter WebhookDeliveryFilter, limit, offset int) ([]WebhookDelivery, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListWebhookDeliveries", ctx, filter, limit, offset)
+	ret0, _ := ret[0].([]WebhookDelivery)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListWebhookDeliveries indicates an expected call of ListWebhookDeliveries.
+func (mr *MockWebhookStoreMockRecorder) ListWebhookDeliveries(ctx, filter, limit, offset interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListWebhookDeliveries", reflect.TypeOf((*MockWebhookStore)(nil).ListWebhookDeliveries), ctx, filter, limit, offset)
+}
+
+// RecordWebhookAttempt mocks base method.
+func (m *MockWebhookStore) RecordWebhookAttempt(ctx context.Context, id int, attempt WebhookAttempt) (WebhookDelivery, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RecordWebhookAttempt", ctx, id, attempt)
+	ret0, _ := ret[0].(WebhookDelivery)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RecordWebhookAttempt indicates an expected call of RecordWebhookAttempt.
+func (mr *MockWebhookStoreMockRecorder) RecordWebhookAttempt(ctx, id, attempt interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RecordWebhookAttempt", reflect.TypeOf((*MockWebhookStore)(nil).RecordWebhookAttempt), ctx, id, attempt)
+}
+
+// WebhookStats mocks base method.
+func (m *MockWebhookStore) WebhookStats(ctx context.Context) ([]WebhookTargetStats, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "WebhookStats", ctx)
+	ret0, _ := ret[0].([]WebhookTargetStats)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// WebhookStats indicates an expected call of WebhookStats.
+func (mr *MockWebhookStoreMockRecorder) WebhookStats(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "WebhookStats", reflect.TypeOf((*MockWebhookStore)(nil).WebhookStats), ctx)
+}
+
+// MockRegistrationQueueStore is a mock of RegistrationQueueStore interface.
+type MockRegistrationQueueStore struct {
+	ctrl     *gomock.Controller
+	recorder *MockRegistrationQueueStoreMockRecorder
+}
+
+// MockRegistrationQueueStoreMockRecorder is the mock recorder for MockRegistrationQueueStore.
+type MockRegistrationQueueStoreMockRecorder struct {
+	mock *MockRegistrationQueueStore
+}
+
+// NewMockRegistrationQueueStore creates a new mock instance.
+func NewMockRegistrationQueueStore(ctrl *gomock.Controller) *MockRegistrationQueueStore {
+	mock := &MockRegistrationQueueStore{ctrl: ctrl}
+	mock.recorder = &MockRegistrationQueueStoreMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockRegistrationQueueStore) EXPECT() *MockRegistrationQueueStoreMockRecorder {
+	return m.recorder
+}
+
+// ClaimRegistrations mocks base method.
+func (m *MockRegistrationQueueStore) ClaimRegistrations(ctx context.Context, limit int, lease time.Duration) ([]QueuedRegistration, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ClaimRegistrations", ctx, limit, lease)
+	ret0, _ := ret[0].([]QueuedRegistration)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ClaimRegistrations indicates an expected call of ClaimRegistrations.
+func (mr *MockRegistrationQueueStoreMockRecorder) ClaimRegistrations(ctx, limit, lease interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ClaimRegistrations", reflect.TypeOf((*MockRegistrationQueueStore)(nil).ClaimRegistrations), ctx, limit, lease)
+}
+
+// EnqueueRegistration mocks base method.
+func (m *MockRegistrationQueueStore) EnqueueRegistration(ctx context.Context, id string, payload json.RawMessage, maxPending int) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "EnqueueRegistration", ctx, id, payload, maxPending)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// EnqueueRegistration indicates an expected call of EnqueueRegistration.
+func (mr *MockRegistrationQueueStoreMockRecorder) EnqueueRegistration(ctx, id, payload, maxPending interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "EnqueueRegistration", reflect.TypeOf((*MockRegistrationQueueStore)(nil).EnqueueRegistration), ctx, id, payload, maxPending)
+}
+
+// FinishRegistration mocks base method.
+func (m *MockRegistrationQueueStore) FinishRegistration(ctx context.Context, id, status string, result json.RawMessage, errorCode string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FinishRegistration", ctx, id, status, result, errorCode)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// FinishRegistration indicates an expected call of FinishRegistration.
+func (mr *MockRegistrationQueueStoreMockRecorder) FinishRegistration(ctx, id, status, result, errorCode interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FinishRegistration", reflect.TypeOf((*MockRegistrationQueueStore)(nil).FinishRegistration), ctx, id, status, result, errorCode)
+}
+
+// GetQueuedRegistration mocks base method.
+func (m *MockRegistrationQueueStore) GetQueuedRegistration(ctx context.Context, id string) (QueuedRegistration, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetQueuedRegistration", ctx, id)
+	ret0, _ := ret[0].(QueuedRegistration)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetQueuedRegistration indicates an expected call of GetQueuedRegistration.
+func (mr *MockRegistrationQueueStoreMockRecorder) GetQueuedRegistration(ctx, id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetQueuedRegistration", reflect.TypeOf((*MockRegistrationQueueStore)(nil).GetQueuedRegistration), ctx, id)
+}
+
+// PurgeRegistrations mocks base method.
+func (m *MockRegistrationQueueStore) PurgeRegistrations(ctx context.Context, before time.Time, limit int) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PurgeRegistrations", ctx, before, limit)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// PurgeRegistrations indicates an expected call of PurgeRegistrations.
+func (mr *MockRegistrationQueueStoreMockRecorder) PurgeRegistrations(ctx, before, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PurgeRegistrations", reflect.TypeOf((*MockRegistrationQueueStore)(nil).PurgeRegistrations), ctx, before, limit)
+}
+
+// MockDisputeStore is a mock of DisputeStore interface.
+type MockDisputeStore struct {
+	ctrl     *gomock.Controller
+	recorder *MockDisputeStoreMockRecorder
+}
+
+// MockDisputeStoreMockRecorder is the mock recorder for MockDisputeStore.
+type MockDisputeStoreMockRecorder struct {
+	mock *MockDisputeStore
+}
+
+// NewMockDisputeStore creates a new mock instance.
+func NewMockDisputeStore(ctrl *gomock.Controller) *MockDisputeStore {
+	mock := &MockDisputeStore{ctrl: ctrl}
+	mock.recorder = &MockDisputeStoreMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockDisputeStore) EXPECT() *MockDisputeStoreMockRecorder {
+	return m.recorder
+}
+
+// FileDispute mocks base method.
+func (m *MockDisputeStore) FileDispute(ctx context.Context, nd NewDispute) (ReferralDispute, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FileDispute", ctx, nd)
+	ret0, _ := ret[0].(ReferralDispute)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// FileDispute indicates an expected call of FileDispute.
+func (mr *MockDisputeStoreMockRecorder) FileDispute(ctx, nd interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FileDispute", reflect.TypeOf((*MockDisputeStore)(nil).FileDispute), ctx, nd)
+}
+
+// ListDisputes mocks base method.
+func (m *MockDisputeStore) ListDisputes(ctx context.Context, filter DisputeFilter, limit, offset int) ([]ReferralDispute, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListDisputes", ctx, filter, limit, offset)
+	ret0, _ := ret[0].([]ReferralDispute)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListDisputes indicates an expected call of ListDisputes.
+func (mr *MockDisputeStoreMockRecorder) ListDisputes(ctx, filter, limit, offset interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListDisputes", reflect.TypeOf((*MockDisputeStore)(nil).ListDisputes), ctx, filter, limit, offset)
+}
+
+// ResolveDispute mocks base method.
+func (m *MockDisputeStore) ResolveDispute(ctx context.Context, id int, action, note string, actorID int) (ReferralDispute, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ResolveDispute", ctx, id, action, note, actorID)
+	ret0, _ := ret[0].(ReferralDispute)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ResolveDispute indicates an expected call of ResolveDispute.
+func (mr *MockDisputeStoreMockRecorder) ResolveDispute(ctx, id, action, note, actorID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ResolveDispute", reflect.TypeOf((*MockDisputeStore)(nil).ResolveDispute), ctx, id, action, note, actorID)
+}
+
+// MockDBInterface is a mock of DBInterface interface.
+type MockDBInterface struct {
+	ctrl     *gomock.Controller
+	recorder *MockDBInterfaceMockRecorder
+}
+
+// MockDBInterfaceMockRecorder is the mock recorder for MockDBInterface.
+type MockDBInterfaceMockRecorder struct {
+	mock *MockDBInterface
+}
+
+// NewMockDBInterface creates a new mock instance.
+func NewMockDBInterface(ctrl *gomock.Controller) *MockDBInterface {
+	mock := &MockDBInterface{ctrl: ctrl}
+	mock.recorder = &MockDBInterfaceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockDBInterface) EXPECT() *MockDBInterfaceMockRecorder {
+	return m.recorder
+}
+
+// AcceptTerms mocks base method.
+func (m *MockDBInterface) AcceptTerms(ctx context.Context, userID int, version, ip string) (TermsAcceptance, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AcceptTerms", ctx, userID, version, ip)
+	ret0, _ := ret[0].(TermsAcceptance)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// AcceptTerms indicates an expected call of AcceptTerms.
+func (mr *MockDBInterfaceMockRecorder) AcceptTerms(ctx, userID, version, ip interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AcceptTerms", reflect.TypeOf((*MockDBInterface)(nil).AcceptTerms), ctx, userID, version, ip)
+}
+
+// AddReferralCode mocks base method.
+func (m *MockDBInterface) AddReferralCode(ctx context.Context, c NewReferralCode, limit int) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AddReferralCode", ctx, c, limit)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AddReferralCode indicates an expected call of AddReferralCode.
+func (mr *MockDBInterfaceMockRecorder) AddReferralCode(ctx, c, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddReferralCode", reflect.TypeOf((*MockDBInterface)(nil).AddReferralCode), ctx, c, limit)
+}
+
+// AnonymizeUser mocks base method.
+func (m *MockDBInterface) AnonymizeUser(ctx context.Context, userID, actorID int) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AnonymizeUser", ctx, userID, actorID)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AnonymizeUser indicates an expected call of AnonymizeUser.
+func (mr *MockDBInterfaceMockRecorder) AnonymizeUser(ctx, userID, actorID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AnonymizeUser", reflect.TypeOf((*MockDBInterface)(nil).AnonymizeUser), ctx, userID, actorID)
+}
+
+// ClaimExpiringCodes mocks base method.
+func (m *MockDBInterface) ClaimExpiringCodes(ctx context.Context, until time.Time, limit int) ([]ExpiringCode, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ClaimExpiringCodes", ctx, until, limit)
+	ret0, _ := ret[0].([]ExpiringCode)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ClaimExpiringCodes indicates an expected call of ClaimExpiringCodes.
+func (mr *MockDBInterfaceMockRecorder) ClaimExpiringCodes(ctx, until, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ClaimExpiringCodes", reflect.TypeOf((*MockDBInterface)(nil).ClaimExpiringCodes), ctx, until, limit)
+}
+
+// ClaimRegistrations mocks base method.
+func (m *MockDBInterface) ClaimRegistrations(ctx context.Context, limit int, lease time.Duration) ([]QueuedRegistration, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ClaimRegistrations", ctx, limit, lease)
+	ret0, _ := ret[0].([]QueuedRegistration)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ClaimRegistrations indicates an expected call of ClaimRegistrations.
+func (mr *MockDBInterfaceMockRecorder) ClaimRegistrations(ctx, limit, lease interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ClaimRegistrations", reflect.TypeOf((*MockDBInterface)(nil).ClaimRegistrations), ctx, limit, lease)
+}
+
+// ClaimStatements mocks base method.
+func (m *MockDBInterface) ClaimStatements(ctx context.Context, limit int, lease time.Duration) ([]ClaimedStatement, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ClaimStatements", ctx, limit, lease)
+	ret0, _ := ret[0].([]ClaimedStatement)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ClaimStatements indicates an expected call of ClaimStatements.
+func (mr *MockDBInterfaceMockRecorder) ClaimStatements(ctx, limit, lease interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ClaimStatements", reflect.TypeOf((*MockDBInterface)(nil).ClaimStatements), ctx, limit, lease)
+}
+
+// ClaimWebhookDeliveries mocks base method.
+func (m *MockDBInterface) ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]WebhookDelivery, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ClaimWebhookDeliveries", ctx, limit, lease)
+	ret0, _ := ret[0].([]WebhookDelivery)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ClaimWebhookDeliveries indicates an expected call of ClaimWebhookDeliveries.
+func (mr *MockDBInterfaceMockRecorder) ClaimWebhookDeliveries(ctx, limit, lease interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ClaimWebhookDeliveries", reflect.TypeOf((*MockDBInterface)(nil).ClaimWebhookDeliveries), ctx, limit, lease)
+}
+
+// CompareReferralCodes mocks base method.
+func (m *MockDBInterface) CompareReferralCodes(ctx context.Context, userID int, includeArchived bool) ([]CodeComparison, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CompareReferralCodes", ctx, userID, includeArchived)
+	ret0, _ := ret[0].([]CodeComparison)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CompareReferralCodes indicates an expected call of CompareReferralCodes.
+func (mr *MockDBInterfaceMockRecorder) CompareReferralCodes(ctx, userID, includeArchived interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CompareReferralCodes", reflect.TypeOf((*MockDBInterface)(nil).CompareReferralCodes), ctx, userID, includeArchived)
+}
+
+// ConsistencyCheck mocks base method.
+func (m *MockDBInterface) ConsistencyCheck(ctx context.Context, fix bool) (ConsistencyReport, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ConsistencyCheck", ctx, fix)
+	ret0, _ := ret[0].(ConsistencyReport)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ConsistencyCheck indicates an expected call of ConsistencyCheck.
+func (mr *MockDBInterfaceMockRecorder) ConsistencyCheck(ctx, fix interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ConsistencyCheck", reflect.TypeOf((*MockDBInterface)(nil).ConsistencyCheck), ctx, fix)
+}
+
+// ConsumeActionToken mocks base method.
+func (m *MockDBInterface) ConsumeActionToken(ctx context.Context, nonce string, userID int, action string, expiresAt time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ConsumeActionToken", ctx, nonce, userID, action, expiresAt)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ConsumeActionToken indicates an expected call of ConsumeActionToken.
+func (mr *MockDBInterfaceMockRecorder) ConsumeActionToken(ctx, nonce, userID, action, expiresAt interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ConsumeActionToken", reflect.TypeOf((*MockDBInterface)(nil).ConsumeActionToken), ctx, nonce, userID, action, expiresAt)
+}
+
+// ConsumeMagicLinkToken mocks base method.
+func (m *MockDBInterface) ConsumeMagicLinkToken(ctx context.Context, jti, email string, expiresAt time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ConsumeMagicLinkToken", ctx, jti, email, expiresAt)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ConsumeMagicLinkToken indicates an expected call of ConsumeMagicLinkToken.
+func (mr *MockDBInterfaceMockRecorder) ConsumeMagicLinkToken(ctx, jti, email, expiresAt interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ConsumeMagicLinkToken", reflect.TypeOf((*MockDBInterface)(nil).ConsumeMagicLinkToken), ctx, jti, email, expiresAt)
+}
+
+// CountActiveCodes mocks base method.
+func (m *MockDBInterface) CountActiveCodes(ctx context.Context) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CountActiveCodes", ctx)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CountActiveCodes indicates an expected call of CountActiveCodes.
+func (mr *MockDBInterfaceMockRecorder) CountActiveCodes(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CountActiveCodes", reflect.TypeOf((*MockDBInterface)(nil).CountActiveCodes), ctx)
+}
+
+// CountSignups mocks base method.
+func (m *MockDBInterface) CountSignups(ctx context.Context, since time.Time) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CountSignups", ctx, since)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CountSignups indicates an expected call of CountSignups.
+func (mr *MockDBInterfaceMockRecorder) CountSignups(ctx, since interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CountSignups", reflect.TypeOf((*MockDBInterface)(nil).CountSignups), ctx, since)
+}
+
+// CreateAPIKey mocks base method.
+func (m *MockDBInterface) CreateAPIKey(ctx context.Context, k NewAPIKey) (APIKey, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateAPIKey", ctx, k)
+	ret0, _ := ret[0].(APIKey)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CreateAPIKey indicates an expected call of CreateAPIKey.
+func (mr *MockDBInterfaceMockRecorder) CreateAPIKey(ctx, k interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateAPIKey", reflect.TypeOf((*MockDBInterface)(nil).CreateAPIKey), ctx, k)
+}
+
+// CreateReferralCode mocks base method.
+func (m *MockDBInterface) CreateReferralCode(ctx context.Context, userID int, code string, expiresAt int64, clientToken string, metadata json.RawMessage, domain DomainRestriction) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateReferralCode", ctx, userID, code, expiresAt, clientToken, metadata, domain)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CreateReferralCode indicates an expected call of CreateReferralCode.
+func (mr *MockDBInterfaceMockRecorder) CreateReferralCode(ctx, userID, code, expiresAt, clientToken, metadata, domain interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateReferralCode", reflect.TypeOf((*MockDBInterface)(nil).CreateReferralCode), ctx, userID, code, expiresAt, clientToken, metadata, domain)
+}
+
+// CreateUser mocks base method.
+func (m *MockDBInterface) CreateUser(ctx context.Context, params CreateUserParams) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateUser", ctx, params)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CreateUser indicates an expected call of CreateUser.
+func (mr *MockDBInterfaceMockRecorder) CreateUser(ctx, params interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateUser", reflect.TypeOf((*MockDBInterface)(nil).CreateUser), ctx, params)
+}
+
+// DeleteReferralCode mocks base method.
+func (m *MockDBInterface) DeleteReferralCode(ctx context.Context, userID int) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteReferralCode", ctx, userID)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteReferralCode indicates an expected call of DeleteReferralCode.
+func (mr *MockDBInterfaceMockRecorder) DeleteReferralCode(ctx, userID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteReferralCode", reflect.TypeOf((*MockDBInterface)(nil).DeleteReferralCode), ctx, userID)
+}
+
+// DeleteReferralCodeByCode mocks base method.
+func (m *MockDBInterface) DeleteReferralCodeByCode(ctx context.Context, code string, actorID int) (DeletedReferralCode, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteReferralCodeByCode", ctx, code, actorID)
+	ret0, _ := ret[0].(DeletedReferralCode)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DeleteReferralCodeByCode indicates an expected call of DeleteReferralCodeByCode.
+func (mr *MockDBInterfaceMockRecorder) DeleteReferralCodeByCode(ctx, code, actorID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteReferralCodeByCode", reflect.TypeOf((*MockDBInterface)(nil).DeleteReferralCodeByCode), ctx, code, actorID)
+}
+
+// EmailExists mocks base method.
+func (m *MockDBInterface) EmailExists(ctx context.Context, email string) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "EmailExists", ctx, email)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// EmailExists indicates an expected call of EmailExists.
+func (mr *MockDBInterfaceMockRecorder) EmailExists(ctx, email interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "EmailExists", reflect.TypeOf((*MockDBInterface)(nil).EmailExists), ctx, email)
+}
+
+// EnqueueRegistration mocks base method.
+func (m *MockDBInterface) EnqueueRegistration(ctx context.Context, id string, payload json.RawMessage, maxPending int) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "EnqueueRegistration", ctx, id, payload, maxPending)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// EnqueueRegistration indicates an expected call of EnqueueRegistration.
+func (mr *MockDBInterfaceMockRecorder) EnqueueRegistration(ctx, id, payload, maxPending interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "EnqueueRegistration", reflect.TypeOf((*MockDBInterface)(nil).EnqueueRegistration), ctx, id, payload, maxPending)
+}
+
+// EnqueueWebhook mocks base method.
+func (m *MockDBInterface) EnqueueWebhook(ctx context.Context, event string, payload json.RawMessage, targets []string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "EnqueueWebhook", ctx, event, payload, targets)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// EnqueueWebhook indicates an expected call of EnqueueWebhook.
+func (mr *MockDBInterfaceMockRecorder) EnqueueWebhook(ctx, event, payload, targets interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "EnqueueWebhook", reflect.TypeOf((*MockDBInterface)(nil).EnqueueWebhook), ctx, event, payload, targets)
+}
+
+// ExportUserData mocks base method.
+func (m *MockDBInterface) ExportUserData(ctx context.Context, userID int) (UserExport, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ExportUserData", ctx, userID)
+	ret0, _ := ret[0].(UserExport)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ExportUserData indicates an expected call of ExportUserData.
+func (mr *MockDBInterfaceMockRecorder) ExportUserData(ctx, userID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ExportUserData", reflect.TypeOf((*MockDBInterface)(nil).ExportUserData), ctx, userID)
+}
+
+// FileDispute mocks base method.
+func (m *MockDBInterface) FileDispute(ctx context.Context, nd NewDispute) (ReferralDispute, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FileDispute", ctx, nd)
+	ret0, _ := ret[0].(ReferralDispute)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// FileDispute indicates an expected call of FileDispute.
+func (mr *MockDBInterfaceMockRecorder) FileDispute(ctx, nd interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FileDispute", reflect.TypeOf((*MockDBInterface)(nil).FileDispute), ctx, nd)
+}
+
+// FinishRegistration mocks base method.
+func (m *MockDBInterface) FinishRegistration(ctx context.Context, id, status string, result json.RawMessage, errorCode string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FinishRegistration", ctx, id, status, result, errorCode)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// FinishRegistration indicates an expected call of FinishRegistration.
+func (mr *MockDBInterfaceMockRecorder) FinishRegistration(ctx, id, status, result, errorCode interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FinishRegistration", reflect.TypeOf((*MockDBInterface)(nil).FinishRegistration), ctx, id, status, result, errorCode)
+}
+
+// FlagReferrer mocks base method.
+func (m *MockDBInterface) FlagReferrer(ctx context.Context, flag ReferrerFlag) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FlagReferrer", ctx, flag)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// FlagReferrer indicates an expected call of FlagReferrer.
+func (mr *MockDBInterfaceMockRecorder) FlagReferrer(ctx, flag interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FlagReferrer", reflect.TypeOf((*MockDBInterface)(nil).FlagReferrer), ctx, flag)
+}
+
+// GenerateStatements mocks base method.
+func (m *MockDBInterface) GenerateStatements(ctx context.Context, period time.Time) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GenerateStatements", ctx, period)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GenerateStatements indicates an expected call of GenerateStatements.
+func (mr *MockDBInterfaceMockRecorder) GenerateStatements(ctx, period interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GenerateStatements", reflect.TypeOf((*MockDBInterface)(nil).GenerateStatements), ctx, period)
+}
+
+// GetActiveReferralCodeByUsername mocks base method.
+func (m *MockDBInterface) GetActiveReferralCodeByUsername(ctx context.Context, username string) (ReferralCode, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetActiveReferralCodeByUsername", ctx, username)
+	ret0, _ := ret[0].(ReferralCode)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetActiveReferralCodeByUsername indicates an expected call of GetActiveReferralCodeByUsername.
+func (mr *MockDBInterfaceMockRecorder) GetActiveReferralCodeByUsername(ctx, username interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetActiveReferralCodeByUsername", reflect.TypeOf((*MockDBInterface)(nil).GetActiveReferralCodeByUsername), ctx, username)
+}
+
+// GetCodeStats mocks base method.
+func (m *MockDBInterface) GetCodeStats(ctx context.Context, userID int, includeArchived bool) ([]ReferralCodeStats, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetCodeStats", ctx, userID, includeArchived)
+	ret0, _ := ret[0].([]ReferralCodeStats)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetCodeStats indicates an expected call of GetCodeStats.
+func (mr *MockDBInterfaceMockRecorder) GetCodeStats(ctx, userID, includeArchived interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetCodeStats", reflect.TypeOf((*MockDBInterface)(nil).GetCodeStats), ctx, userID, includeArchived)
+}
+
+// GetCohortStats mocks base method.
+func (m *MockDBInterface) GetCohortStats(ctx context.Context, from, to time.Time) ([]CohortStat, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetCohortStats", ctx, from, to)
+	ret0, _ := ret[0].([]CohortStat)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetCohortStats indicates an expected call of GetCohortStats.
+func (mr *MockDBInterfaceMockRecorder) GetCohortStats(ctx, from, to interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetCohortStats", reflect.TypeOf((*MockDBInterface)(nil).GetCohortStats), ctx, from, to)
+}
+
+// GetProfile mocks base method.
+func (m *MockDBInterface) GetProfile(ctx context.Context, userID int) (Profile, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetProfile", ctx, userID)
+	ret0, _ := ret[0].(Profile)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetProfile indicates an expected call of GetProfile.
+func (mr *MockDBInterfaceMockRecorder) GetProfile(ctx, userID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetProfile", reflect.TypeOf((*MockDBInterface)(nil).GetProfile), ctx, userID)
+}
+
+// GetProgramReport mocks base method.
+func (m *MockDBInterface) GetProgramReport(ctx context.Context, from, to time.Time) (ProgramReport, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetProgramReport", ctx, from, to)
+	ret0, _ := ret[0].(ProgramReport)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetProgramReport indicates an expected call of GetProgramReport.
+func (mr *MockDBInterfaceMockRecorder) GetProgramReport(ctx, from, to interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetProgramReport", reflect.TypeOf((*MockDBInterface)(nil).GetProgramReport), ctx, from, to)
+}
+
+// GetQueuedRegistration mocks base method.
+func (m *MockDBInterface) GetQueuedRegistration(ctx context.Context, id string) (QueuedRegistration, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetQueuedRegistration", ctx, id)
+	ret0, _ := ret[0].(QueuedRegistration)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetQueuedRegistration indicates an expected call of GetQueuedRegistration.
+func (mr *MockDBInterfaceMockRecorder) GetQueuedRegistration(ctx, id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetQueuedRegistration", reflect.TypeOf((*MockDBInterface)(nil).GetQueuedRegistration), ctx, id)
+}
+
+// GetQuotaUsage mocks base method.
+func (m *MockDBInterface) GetQuotaUsage(ctx context.Context, userID int, since time.Time) (QuotaUsage, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetQuotaUsage", ctx, userID, since)
+	ret0, _ := ret[0].(QuotaUsage)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetQuotaUsage indicates an expected call of GetQuotaUsage.
+func (mr *MockDBInterfaceMockRecorder) GetQuotaUsage(ctx, userID, since interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetQuotaUsage", reflect.TypeOf((*MockDBInterface)(nil).GetQuotaUsage), ctx, userID, since)
+}
+
+// GetReferralCodeByClientToken mocks base method.
+func (m *MockDBInterface) GetReferralCodeByClientToken(ctx context.Context, userID int, clientToken string) (ReferralCode, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetReferralCodeByClientToken", ctx, userID, clientToken)
+	ret0, _ := ret[0].(ReferralCode)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetReferralCodeByClientToken indicates an expected call of GetReferralCodeByClientToken.
+func (mr *MockDBInterfaceMockRecorder) GetReferralCodeByClientToken(ctx, userID, clientToken interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetReferralCodeByClientToken", reflect.TypeOf((*MockDBInterface)(nil).GetReferralCodeByClientToken), ctx, userID, clientToken)
+}
+
+// GetReferralCodeByEmail mocks base method.
+func (m *MockDBInterface) GetReferralCodeByEmail(ctx context.Context, email string) (ReferralCode, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetReferralCodeByEmail", ctx, email)
+	ret0, _ := ret[0].(ReferralCode)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetReferralCodeByEmail indicates an expected call of GetReferralCodeByEmail.
+func (mr *MockDBInterfaceMockRecorder) GetReferralCodeByEmail(ctx, email interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetReferralCodeByEmail", reflect.TypeOf((*MockDBInterface)(nil).GetReferralCodeByEmail), ctx, email)
+}
+
+// GetReferralCodeByUserID mocks base method.
+func (m *MockDBInterface) GetReferralCodeByUserID(ctx context.Context, userID int) (ReferralCode, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetReferralCodeByUserID", ctx, userID)
+	ret0, _ := ret[0].(ReferralCode)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetReferralCodeByUserID indicates an expected call of GetReferralCodeByUserID.
+func (mr *MockDBInterfaceMockRecorder) GetReferralCodeByUserID(ctx, userID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetReferralCodeByUserID", reflect.TypeOf((*MockDBInterface)(nil).GetReferralCodeByUserID), ctx, userID)
+}
+
+// GetReferralCodeDetails mocks base method.
+func (m *MockDBInterface) GetReferralCodeDetails(ctx context.Context, code string) (ReferralCodeDetails, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetReferralCodeDetails", ctx, code)
+	ret0, _ := ret[0].(ReferralCodeDetails)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetReferralCodeDetails indicates an expected call of GetReferralCodeDetails.
+func (mr *MockDBInterfaceMockRecorder) GetReferralCodeDetails(ctx, code interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetReferralCodeDetails", reflect.TypeOf((*MockDBInterface)(nil).GetReferralCodeDetails), ctx, code)
+}
+
+// GetReferralStats mocks base method.
+func (m *MockDBInterface) GetReferralStats(ctx context.Context, userID int) (ReferralStats, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetReferralStats", ctx, userID)
+	ret0, _ := ret[0].(ReferralStats)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetReferralStats indicates an expected call of GetReferralStats.
+func (mr *MockDBInterfaceMockRecorder) GetReferralStats(ctx, userID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetReferralStats", reflect.TypeOf((*MockDBInterface)(nil).GetReferralStats), ctx, userID)
+}
+
+// GetReferralsByReferrerID mocks base method.
+func (m *MockDBInterface) GetReferralsByReferrerID(ctx context.Context, referrerID, limit, offset int) ([]ReferralSummary, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetReferralsByReferrerID", ctx, referrerID, limit, offset)
+	ret0, _ := ret[0].([]ReferralSummary)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetReferralsByReferrerID indicates an expected call of GetReferralsByReferrerID.
+func (mr *MockDBInterfaceMockRecorder) GetReferralsByReferrerID(ctx, referrerID, limit, offset interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetReferralsByReferrerID", reflect.TypeOf((*MockDBInterface)(nil).GetReferralsByReferrerID), ctx, referrerID, limit, offset)
+}
+
+// GetReferrerActivity mocks base method.
+func (m *MockDBInterface) GetReferrerActivity(ctx context.Context, since time.Time) ([]ReferrerActivity, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetReferrerActivity", ctx, since)
+	ret0, _ := ret[0].([]ReferrerActivity)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetReferrerActivity indicates an expected call of GetReferrerActivity.
+func (mr *MockDBInterfaceMockRecorder) GetReferrerActivity(ctx, since interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetReferrerActivity", reflect.TypeOf((*MockDBInterface)(nil).GetReferrerActivity), ctx, since)
+}
+
+// GetRewardStatement mocks base method.
+func (m *MockDBInterface) GetRewardStatement(ctx context.Context, userID int, period time.Time) (RewardStatement, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetRewardStatement", ctx, userID, period)
+	ret0, _ := ret[0].(RewardStatement)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetRewardStatement indicates an expected call of GetRewardStatement.
+func (mr *MockDBInterfaceMockRecorder) GetRewardStatement(ctx, userID, period interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetRewardStatement", reflect.TypeOf((*MockDBInterface)(nil).GetRewardStatement), ctx, userID, period)
+}
+
+// GetUserByEmail mocks base method.
+func (m *MockDBInterface) GetUserByEmail(ctx context.Context, email string) (User, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUserByEmail", ctx, email)
+	ret0, _ := ret[0].(User)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetUserByEmail indicates an expected call of GetUserByEmail.
+func (mr *MockDBInterfaceMockRecorder) GetUserByEmail(ctx, email interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserByEmail", reflect.TypeOf((*MockDBInterface)(nil).GetUserByEmail), ctx, email)
+}
+
+// GetUserByID mocks base method.
+func (m *MockDBInterface) GetUserByID(ctx context.Context, id int) (User, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUserByID", ctx, id)
+	ret0, _ := ret[0].(User)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetUserByID indicates an expected call of GetUserByID.
+func (mr *MockDBInterfaceMockRecorder) GetUserByID(ctx, id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserByID", reflect.TypeOf((*MockDBInterface)(nil).GetUserByID), ctx, id)
+}
+
+// GetUserLimits mocks base method.
+func (m *MockDBInterface) GetUserLimits(ctx context.Context, userID int) (UserLimits, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUserLimits", ctx, userID)
+	ret0, _ := ret[0].(UserLimits)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetUserLimits indicates an expected call of GetUserLimits.
+func (mr *MockDBInterfaceMockRecorder) GetUserLimits(ctx, userID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserLimits", reflect.TypeOf((*MockDBInterface)(nil).GetUserLimits), ctx, userID)
+}
+
+// GetWebhookDelivery mocks base method.
+func (m *MockDBInterface) GetWebhookDelivery(ctx context.Context, id int) (WebhookDelivery, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetWebhookDelivery", ctx, id)
+	ret0, _ := ret[0].(WebhookDelivery)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetWebhookDelivery indicates an expected call of GetWebhookDelivery.
+func (mr *MockDBInterfaceMockRecorder) GetWebhookDelivery(ctx, id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetWebhookDelivery", reflect.TypeOf((*MockDBInterface)(nil).GetWebhookDelivery), ctx, id)
+}
+
+// ListAPIKeys mocks base method.
+func (m *MockDBInterface) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListAPIKeys", ctx)
+	ret0, _ := ret[0].([]APIKey)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListAPIKeys indicates an expected call of ListAPIKeys.
+func (mr *MockDBInterfaceMockRecorder) ListAPIKeys(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListAPIKeys", reflect.TypeOf((*MockDBInterface)(nil).ListAPIKeys), ctx)
+}
+
+// ListDisputes mocks base method.
+func (m *MockDBInterface) ListDisputes(ctx context.Context, filter DisputeFilter, limit, offset int) ([]ReferralDispute, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListDisputes", ctx, filter, limit, offset)
+	ret0, _ := ret[0].([]ReferralDispute)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListDisputes indicates an expected call of ListDisputes.
+func (mr *MockDBInterfaceMockRecorder) ListDisputes(ctx, filter, limit, offset interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListDisputes", reflect.TypeOf((*MockDBInterface)(nil).ListDisputes), ctx, filter, limit, offset)
+}
+
+// ListLedgerEntries mocks base method.
+func (m *MockDBInterface) ListLedgerEntries(ctx context.Context, userID int, period time.Time) ([]LedgerEntry, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListLedgerEntries", ctx, userID, period)
+	ret0, _ := ret[0].([]LedgerEntry)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListLedgerEntries indicates an expected call of ListLedgerEntries.
+func (mr *MockDBInterfaceMockRecorder) ListLedgerEntries(ctx, userID, period interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListLedgerEntries", reflect.TypeOf((*MockDBInterface)(nil).ListLedgerEntries), ctx, userID, period)
+}
+
+// ListLoginEvents mocks base method.
+func (m *MockDBInterface) ListLoginEvents(ctx context.Context, userID, limit, offset int) ([]LoginEvent, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListLoginEvents", ctx, userID, limit, offset)
+	ret0, _ := ret[0].([]LoginEvent)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListLoginEvents indicates an expected call of ListLoginEvents.
+func (mr *MockDBInterfaceMockRecorder) ListLoginEvents(ctx, userID, limit, offset interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListLoginEvents", reflect.TypeOf((*MockDBInterface)(nil).ListLoginEvents), ctx, userID, limit, offset)
+}
+
+// ListRedemptions mocks base method.
+func (m *MockDBInterface) ListRedemptions(ctx context.Context, userID, limit, offset int) ([]Redemption, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListRedemptions", ctx, userID, limit, offset)
+	ret0, _ := ret[0].([]Redemption)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListRedemptions indicates an expected call of ListRedemptions.
+func (mr *MockDBInterfaceMockRecorder) ListRedemptions(ctx, userID, limit, offset interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListRedemptions", reflect.TypeOf((*MockDBInterface)(nil).ListRedemptions), ctx, userID, limit, offset)
+}
+
+// ListReferralCodes mocks base method.
+func (m *MockDBInterface) ListReferralCodes(ctx context.Context, filter ReferralCodeFilter, limit, offset int) ([]ReferralCode, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListReferralCodes", ctx, filter, limit, offset)
+	ret0, _ := ret[0].([]ReferralCode)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListReferralCodes indicates an expected call of ListReferralCodes.
+func (mr *MockDBInterfaceMockRecorder) ListReferralCodes(ctx, filter, limit, offset interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListReferralCodes", reflect.TypeOf((*MockDBInterface)(nil).ListReferralCodes), ctx, filter, limit, offset)
+}
+
+// ListReferrerFlags mocks base method.
+func (m *MockDBInterface) ListReferrerFlags(ctx context.Context) ([]ReferrerFlag, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListReferrerFlags", ctx)
+	ret0, _ := ret[0].([]ReferrerFlag)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListReferrerFlags indicates an expected call of ListReferrerFlags.
+func (mr *MockDBInterfaceMockRecorder) ListReferrerFlags(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListReferrerFlags", reflect.TypeOf((*MockDBInterface)(nil).ListReferrerFlags), ctx)
+}
+
+// ListRewardStatements mocks base method.
+func (m *MockDBInterface) ListRewardStatements(ctx context.Context, userID int) ([]RewardStatement, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListRewardStatements", ctx, userID)
+	ret0, _ := ret[0].([]RewardStatement)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListRewardStatements indicates an expected call of ListRewardStatements.
+func (mr *MockDBInterfaceMockRecorder) ListRewardStatements(ctx, userID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListRewardStatements", reflect.TypeOf((*MockDBInterface)(nil).ListRewardStatements), ctx, userID)
+}
+
+// ListUserReferralCodes mocks base method.
+func (m *MockDBInterface) ListUserReferralCodes(ctx context.Context, userID int) ([]ReferralCode, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListUserReferralCodes", ctx, userID)
+	ret0, _ := ret[0].([]ReferralCode)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListUserReferralCodes indicates an expected call of ListUserReferralCodes.
+func (mr *MockDBInterfaceMockRecorder) ListUserReferralCodes(ctx, userID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListUserReferralCodes", reflect.TypeOf((*MockDBInterface)(nil).ListUserReferralCodes), ctx, userID)
+}
+
+// ListWebhookDeliveries mocks base method.
+func (m *MockDBInterface) ListWebhookDeliveries(ctx context.Context, filter WebhookDeliveryFilter, limit, offset int) ([]WebhookDelivery, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListWebhookDeliveries", ctx, filter, limit, offset)
+	ret0, _ := ret[0].([]WebhookDelivery)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListWebhookDeliveries indicates an expected call of ListWebhookDeliveries.
+func (mr *MockDBInterfaceMockRecorder) ListWebhookDeliveries(ctx, filter, limit, offset interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListWebhookDeliveries", reflect.TypeOf((*MockDBInterface)(nil).ListWebhookDeliveries), ctx, filter, limit, offset)
+}
+
+// MarkStatementSent mocks base method.
+func (m *MockDBInterface) MarkStatementSent(ctx context.Context, id int) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "MarkStatementSent", ctx, id)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// MarkStatementSent indicates an expected call of MarkStatementSent.
+func (mr *MockDBInterfaceMockRecorder) MarkStatementSent(ctx, id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MarkStatementSent", reflect.TypeOf((*MockDBInterface)(nil).MarkStatementSent), ctx, id)
+}
+
+// PurgeCodeArchive mocks base method.
+func (m *MockDBInterface) PurgeCodeArchive(ctx context.Context, before time.Time, limit int) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PurgeCodeArchive", ctx, before, limit)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// PurgeCodeArchive indicates an expected call of PurgeCodeArchive.
+func (mr *MockDBInterfaceMockRecorder) PurgeCodeArchive(ctx, before, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PurgeCodeArchive", reflect.TypeOf((*MockDBInterface)(nil).PurgeCodeArchive), ctx, before, limit)
+}
+
+// PurgeRegistrations mocks base method.
+func (m *MockDBInterface) PurgeRegistrations(ctx context.Context, before time.Time, limit int) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PurgeRegistrations", ctx, before, limit)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// PurgeRegistrations indicates an expected call of PurgeRegistrations.
+func (mr *MockDBInterfaceMockRecorder) PurgeRegistrations(ctx, before, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PurgeRegistrations", reflect.TypeOf((*MockDBInterface)(nil).PurgeRegistrations), ctx, before, limit)
+}
+
+// PurgeWebhookDeliveries mocks base method.
+func (m *MockDBInterface) PurgeWebhookDeliveries(ctx context.Context, before time.Time, limit int) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PurgeWebhookDeliveries", ctx, before, limit)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// PurgeWebhookDeliveries indicates an expected call of PurgeWebhookDeliveries.
+func (mr *MockDBInterfaceMockRecorder) PurgeWebhookDeliveries(ctx, before, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PurgeWebhookDeliveries", reflect.TypeOf((*MockDBInterface)(nil).PurgeWebhookDeliveries), ctx, before, limit)
+}
+
+// RecordAudit mocks base method.
+func (m *MockDBInterface) RecordAudit(ctx context.Context, actorID int, action string, targetUserID int, payload interface{}) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RecordAudit", ctx, actorID, action, targetUserID, payload)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RecordAudit indicates an expected call of RecordAudit.
+func (mr *MockDBInterfaceMockRecorder) RecordAudit(ctx, actorID, action, targetUserID, payload interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RecordAudit", reflect.TypeOf((*MockDBInterface)(nil).RecordAudit), ctx, actorID, action, targetUserID, payload)
+}
+
+// RecordClick mocks base method.
+func (m *MockDBInterface) RecordClick(ctx context.Context, code string) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RecordClick", ctx, code)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RecordClick indicates an expected call of RecordClick.
+func (mr *MockDBInterfaceMockRecorder) RecordClick(ctx, code interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RecordClick", reflect.TypeOf((*MockDBInterface)(nil).RecordClick), ctx, code)
+}
+
+// RecordLogin mocks base method.
+func (m *MockDBInterface) RecordLogin(ctx context.Context, e LoginEvent) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RecordLogin", ctx, e)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RecordLogin indicates an expected call of RecordLogin.
+func (mr *MockDBInterfaceMockRecorder) RecordLogin(ctx, e interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RecordLogin", reflect.TypeOf((*MockDBInterface)(nil).RecordLogin), ctx, e)
+}
+
+// RecordWebhookAttempt mocks base method.
+func (m *MockDBInterface) RecordWebhookAttempt(ctx context.Context, id int, attempt WebhookAttempt) (WebhookDelivery, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RecordWebhookAttempt", ctx, id, attempt)
+	ret0, _ := ret[0].(WebhookDelivery)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RecordWebhookAttempt indicates an expected call of RecordWebhookAttempt.
+func (mr *MockDBInterfaceMockRecorder) RecordWebhookAttempt(ctx, id, attempt interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RecordWebhookAttempt", reflect.TypeOf((*MockDBInterface)(nil).RecordWebhookAttempt), ctx, id, attempt)
+}
+
+// RedeemReward mocks base method.
+func (m *MockDBInterface) RedeemReward(ctx context.Context, userID int, amount int64, note string) (Redemption, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RedeemReward", ctx, userID, amount, note)
+	ret0, _ := ret[0].(Redemption)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RedeemReward indicates an expected call of RedeemReward.
+func (mr *MockDBInterfaceMockRecorder) RedeemReward(ctx, userID, amount, note interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RedeemReward", reflect.TypeOf((*MockDBInterface)(nil).RedeemReward), ctx, userID, amount, note)
+}
+
+// RegisterWithReferralCode mocks base method.
+func (m *MockDBInterface) RegisterWithReferralCode(ctx context.Context, referralCode string, params CreateUserParams) (ReferralRegistration, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RegisterWithReferralCode", ctx, referralCode, params)
+	ret0, _ := ret[0].(ReferralRegistration)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RegisterWithReferralCode indicates an expected call of RegisterWithReferralCode.
+func (mr *MockDBInterfaceMockRecorder) RegisterWithReferralCode(ctx, referralCode, params interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RegisterWithReferralCode", reflect.TypeOf((*MockDBInterface)(nil).RegisterWithReferralCode), ctx, referralCode, params)
+}
+
+// ReleaseExpiringCode mocks base method.
+func (m *MockDBInterface) ReleaseExpiringCode(ctx context.Context, codeID int) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReleaseExpiringCode", ctx, codeID)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ReleaseExpiringCode indicates an expected call of ReleaseExpiringCode.
+func (mr *MockDBInterfaceMockRecorder) ReleaseExpiringCode(ctx, codeID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReleaseExpiringCode", reflect.TypeOf((*MockDBInterface)(nil).ReleaseExpiringCode), ctx, codeID)
+}
+
+// ReleaseStatement mocks base method.
+func (m *MockDBInterface) ReleaseStatement(ctx context.Context, id int) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReleaseStatement", ctx, id)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ReleaseStatement indicates an expected call of ReleaseStatement.
+func (mr *MockDBInterfaceMockRecorder) ReleaseStatement(ctx, id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReleaseStatement", reflect.TypeOf((*MockDBInterface)(nil).ReleaseStatement), ctx, id)
+}
+
+// ReserveReferralCode mocks base method.
+func (m *MockDBInterface) ReserveReferralCode(ctx context.Context, email, code string, expiresAt int64, domain DomainRestriction) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReserveReferralCode", ctx, email, code, expiresAt, domain)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ReserveReferralCode indicates an expected call of ReserveReferralCode.
+func (mr *MockDBInterfaceMockRecorder) ReserveReferralCode(ctx, email, code, expiresAt, domain interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReserveReferralCode", reflect.TypeOf((*MockDBInterface)(nil).ReserveReferralCode), ctx, email, code, expiresAt, domain)
+}
+
+// ResolveDispute mocks base method.
+func (m *MockDBInterface) ResolveDispute(ctx context.Context, id int, action, note string, actorID int) (ReferralDispute, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ResolveDispute", ctx, id, action, note, actorID)
+	ret0, _ := ret[0].(ReferralDispute)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ResolveDispute indicates an expected call of ResolveDispute.
+func (mr *MockDBInterfaceMockRecorder) ResolveDispute(ctx, id, action, note, actorID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ResolveDispute", reflect.TypeOf((*MockDBInterface)(nil).ResolveDispute), ctx, id, action, note, actorID)
+}
+
+// ReviewReferrerFlag mocks base method.
+func (m *MockDBInterface) ReviewReferrerFlag(ctx context.Context, id int, resolution string, actorID int) (ReferrerFlag, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReviewReferrerFlag", ctx, id, resolution, actorID)
+	ret0, _ := ret[0].(ReferrerFlag)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ReviewReferrerFlag indicates an expected call of ReviewReferrerFlag.
+func (mr *MockDBInterfaceMockRecorder) ReviewReferrerFlag(ctx, id, resolution, actorID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReviewReferrerFlag", reflect.TypeOf((*MockDBInterface)(nil).ReviewReferrerFlag), ctx, id, resolution, actorID)
+}
+
+// RevokeAPIKey mocks base method.
+func (m *MockDBInterface) RevokeAPIKey(ctx context.Context, id, actorID int) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RevokeAPIKey", ctx, id, actorID)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RevokeAPIKey indicates an expected call of RevokeAPIKey.
+func (mr *MockDBInterfaceMockRecorder) RevokeAPIKey(ctx, id, actorID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RevokeAPIKey", reflect.TypeOf((*MockDBInterface)(nil).RevokeAPIKey), ctx, id, actorID)
+}
+
+// ScrubPersonalData mocks base method.
+func (m *MockDBInterface) ScrubPersonalData(ctx context.Context, target string, before time.Time, limit int) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ScrubPersonalData", ctx, target, before, limit)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ScrubPersonalData indicates an expected call of ScrubPersonalData.
+func (mr *MockDBInterfaceMockRecorder) ScrubPersonalData(ctx, target, before, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ScrubPersonalData", reflect.TypeOf((*MockDBInterface)(nil).ScrubPersonalData), ctx, target, before, limit)
+}
+
+// SetTimezone mocks base method.
+func (m *MockDBInterface) SetTimezone(ctx context.Context, userID int, timezone string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetTimezone", ctx, userID, timezone)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetTimezone indicates an expected call of SetTimezone.
+func (mr *MockDBInterfaceMockRecorder) SetTimezone(ctx, userID, timezone interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetTimezone", reflect.TypeOf((*MockDBInterface)(nil).SetTimezone), ctx, userID, timezone)
+}
+
+// SetUserLimits mocks base method.
+func (m *MockDBInterface) SetUserLimits(ctx context.Context, userID int, limits UserLimits, actorID int) (UserLimits, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetUserLimits", ctx, userID, limits, actorID)
+	ret0, _ := ret[0].(UserLimits)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// SetUserLimits indicates an expected call of SetUserLimits.
+func (mr *MockDBInterfaceMockRecorder) SetUserLimits(ctx, userID, limits, actorID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetUserLimits", reflect.TypeOf((*MockDBInterface)(nil).SetUserLimits), ctx, userID, limits, actorID)
+}
+
+// SetUsername mocks base method.
+func (m *MockDBInterface) SetUsername(ctx context.Context, userID int, username string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetUsername", ctx, userID, username)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetUsername indicates an expected call of SetUsername.
+func (mr *MockDBInterfaceMockRecorder) SetUsername(ctx, userID, username interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetUsername", reflect.TypeOf((*MockDBInterface)(nil).SetUsername), ctx, userID, username)
+}
+
+// SetVanityLinkOptOut mocks base method.
+func (m *MockDBInterface) SetVanityLinkOptOut(ctx context.Context, userID int, optOut bool) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetVanityLinkOptOut", ctx, userID, optOut)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetVanityLinkOptOut indicates an expected call of SetVanityLinkOptOut.
+func (mr *MockDBInterfaceMockRecorder) SetVanityLinkOptOut(ctx, userID, optOut interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetVanityLinkOptOut", reflect.TypeOf((*MockDBInterface)(nil).SetVanityLinkOptOut), ctx, userID, optOut)
+}
+
+// TermsAccepted mocks base method.
+func (m *MockDBInterface) TermsAccepted(ctx context.Context, userID int, version string) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "TermsAccepted", ctx, userID, version)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// TermsAccepted indicates an expected call of TermsAccepted.
+func (mr *MockDBInterfaceMockRecorder) TermsAccepted(ctx, userID, version interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TermsAccepted", reflect.TypeOf((*MockDBInterface)(nil).TermsAccepted), ctx, userID, version)
+}
+
+// TransferReferralCode mocks base method.
+func (m *MockDBInterface) TransferReferralCode(ctx context.Context, code string, newOwnerID int, includeHistory bool, actorID int) (CodeTransfer, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "TransferReferralCode", ctx, code, newOwnerID, includeHistory, actorID)
+	ret0, _ := ret[0].(CodeTransfer)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// TransferReferralCode indicates an expected call of TransferReferralCode.
+func (mr *MockDBInterfaceMockRecorder) TransferReferralCode(ctx, code, newOwnerID, includeHistory, actorID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TransferReferralCode", reflect.TypeOf((*MockDBInterface)(nil).TransferReferralCode), ctx, code, newOwnerID, includeHistory, actorID)
+}
+
+// UpdateProfile mocks base method.
+func (m *MockDBInterface) UpdateProfile(ctx context.Context, userID int, u ProfileUpdate) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateProfile", ctx, userID, u)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UpdateProfile indicates an expected call of UpdateProfile.
+func (mr *MockDBInterfaceMockRecorder) UpdateProfile(ctx, userID, u interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateProfile", reflect.TypeOf((*MockDBInterface)(nil).UpdateProfile), ctx, userID, u)
+}
+
+// UpdateReferralCode mocks base method.
+func (m *MockDBInterface) UpdateReferralCode(ctx context.Context, userID int, u ReferralCodeUpdate) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateReferralCode", ctx, userID, u)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UpdateReferralCode indicates an expected call of UpdateReferralCode.
+func (mr *MockDBInterfaceMockRecorder) UpdateReferralCode(ctx, userID, u interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateReferralCode", reflect.TypeOf((*MockDBInterface)(nil).UpdateReferralCode), ctx, userID, u)
+}
+
+// UseAPIKey mocks base method.
+func (m *MockDBInterface) UseAPIKey(ctx context.Context, keyHash string) (APIKey, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UseAPIKey", ctx, keyHash)
+	ret0, _ := ret[0].(APIKey)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// UseAPIKey indicates an expected call of UseAPIKey.
+func (mr *MockDBInterfaceMockRecorder) UseAPIKey(ctx, keyHash interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UseAPIKey", reflect.TypeOf((*MockDBInterface)(nil).UseAPIKey), ctx, keyHash)
+}
+
+// WebhookStats mocks base method.
+func (m *MockDBInterface) WebhookStats(ctx context.Context) ([]WebhookTargetStats, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "WebhookStats", ctx)
+	ret0, _ := ret[0].([]WebhookTargetStats)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// WebhookStats indicates an expected call of WebhookStats.
+func (mr *MockDBInterfaceMockRecorder) WebhookStats(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "WebhookStats", reflect.TypeOf((*MockDBInterface)(nil).WebhookStats), ctx)
+}
+
+// MockQuotaStore is a mock of QuotaStore interface.
+type MockQuotaStore struct {
+	ctrl     *gomock.Controller
+	recorder *MockQuotaStoreMockRecorder
+}
+
+// MockQuotaStoreMockRecorder is the mock recorder for MockQuotaStore.
+type MockQuotaStoreMockRecorder struct {
+	mock *MockQuotaStore
+}
+
+// NewMockQuotaStore creates a new mock instance.
+func NewMockQuotaStore(ctrl *gomock.Controller) *MockQuotaStore {
+	mock := &MockQuotaStore{ctrl: ctrl}
+	mock.recorder = &MockQuotaStoreMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockQuotaStore) EXPECT() *MockQuotaStoreMockRecorder {
+	return m.recorder
+}
+
+// GetQuotaUsage mocks base method.
+func (m *MockQuotaStore) GetQuotaUsage(ctx context.Context, userID int, since time.Time) (QuotaUsage, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetQuotaUsage", ctx, userID, since)
+	ret0, _ := ret[0].(QuotaUsage)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetQuotaUsage indicates an expected call of GetQuotaUsage.
+func (mr *MockQuotaStoreMockRecorder) GetQuotaUsage(ctx, userID, since interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetQuotaUsage", reflect.TypeOf((*MockQuotaStore)(nil).GetQuotaUsage), ctx, userID, since)
+}
+
+// GetUserLimits mocks base method.
+func (m *MockQuotaStore) GetUserLimits(ctx context.Context, userID int) (UserLimits, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUserLimits", ctx, userID)
+	ret0, _ := ret[0].(UserLimits)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetUserLimits indicates an expected call of GetUserLimits.
+func (mr *MockQuotaStoreMockRecorder) GetUserLimits(ctx, userID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserLimits", reflect.TypeOf((*MockQuotaStore)(nil).GetUserLimits), ctx, userID)
+}
+
+// SetUserLimits mocks base method.
+func (m *MockQuotaStore) SetUserLimits(ctx context.Context, userID int, limits UserLimits, actorID int) (UserLimits, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetUserLimits", ctx, userID, limits, actorID)
+	ret0, _ := ret[0].(UserLimits)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// SetUserLimits indicates an expected call of SetUserLimits.
+func (mr *MockQuotaStoreMockRecorder) SetUserLimits(ctx, userID, limits, actorID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetUserLimits", reflect.TypeOf((*MockQuotaStore)(nil).SetUserLimits), ctx, userID, limits, actorID)
+}
+
+// MockAPIKeyStore is a mock of APIKeyStore interface.
+type MockAPIKeyStore struct {
+	ctrl     *gomock.Controller
+	recorder *MockAPIKeyStoreMockRecorder
+}
+
+// MockAPIKeyStoreMockRecorder is the mock recorder for MockAPIKeyStore.
+type MockAPIKeyStoreMockRecorder struct {
+	mock *MockAPIKeyStore
+}
+
+// NewMockAPIKeyStore creates a new mock instance.
+func NewMockAPIKeyStore(ctrl *gomock.Controller) *MockAPIKeyStore {
+	mock := &MockAPIKeyStore{ctrl: ctrl}
+	mock.recorder = &MockAPIKeyStoreMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockAPIKeyStore) EXPECT() *MockAPIKeyStoreMockRecorder {
+	return m.recorder
+}
+
+// CreateAPIKey mocks base method.
+func (m *MockAPIKeyStore) CreateAPIKey(ctx context.Context, k NewAPIKey) (APIKey, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateAPIKey", ctx, k)
+	ret0, _ := ret[0].(APIKey)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CreateAPIKey indicates an expected call of CreateAPIKey.
+func (mr *MockAPIKeyStoreMockRecorder) CreateAPIKey(ctx, k interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateAPIKey", reflect.TypeOf((*MockAPIKeyStore)(nil).CreateAPIKey), ctx, k)
+}
+
+// ListAPIKeys mocks base method.
+func (m *MockAPIKeyStore) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListAPIKeys", ctx)
+	ret0, _ := ret[0].([]APIKey)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListAPIKeys indicates an expected call of ListAPIKeys.
+func (mr *MockAPIKeyStoreMockRecorder) ListAPIKeys(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListAPIKeys", reflect.TypeOf((*MockAPIKeyStore)(nil).ListAPIKeys), ctx)
+}
+
+// RevokeAPIKey mocks base method.
+func (m *MockAPIKeyStore) RevokeAPIKey(ctx context.Context, id, actorID int) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RevokeAPIKey", ctx, id, actorID)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RevokeAPIKey indicates an expected call of RevokeAPIKey.
+func (mr *MockAPIKeyStoreMockRecorder) RevokeAPIKey(ctx, id, actorID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RevokeAPIKey", reflect.TypeOf((*MockAPIKeyStore)(nil).RevokeAPIKey), ctx, id, actorID)
+}
+
+// UseAPIKey mocks base method.
+func (m *MockAPIKeyStore) UseAPIKey(ctx context.Context, keyHash string) (APIKey, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UseAPIKey", ctx, keyHash)
+	ret0, _ := ret[0].(APIKey)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// UseAPIKey indicates an expected call of UseAPIKey.
+func (mr *MockAPIKeyStoreMockRecorder) UseAPIKey(ctx, keyHash interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UseAPIKey", reflect.TypeOf((*MockAPIKeyStore)(nil).UseAPIKey), ctx, keyHash)
+}
+
+// MockReminderStore is a mock of ReminderStore interface.
+type MockReminderStore struct {
+	ctrl     *gomock.Controller
+	recorder *MockReminderStoreMockRecorder
+}
+
+// MockReminderStoreMockRecorder is the mock recorder for MockReminderStore.
+type MockReminderStoreMockRecorder struct {
+	mock *MockReminderStore
+}
+
+// NewMockReminderStore creates a new mock instance.
+func NewMockReminderStore(ctrl *gomock.Controller) *MockReminderStore {
+	mock := &MockReminderStore{ctrl: ctrl}
+	mock.recorder = &MockReminderStoreMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockReminderStore) EXPECT() *MockReminderStoreMockRecorder {
+	return m.recorder
+}
+
+// ClaimExpiringCodes mocks base method.
+func (m *MockReminderStore) ClaimExpiringCodes(ctx context.Context, until time.Time, limit int) ([]ExpiringCode, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ClaimExpiringCodes", ctx, until, limit)
+	ret0, _ := ret[0].([]ExpiringCode)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ClaimExpiringCodes indicates an expected call of ClaimExpiringCodes.
+func (mr *MockReminderStoreMockRecorder) ClaimExpiringCodes(ctx, until, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ClaimExpiringCodes", reflect.TypeOf((*MockReminderStore)(nil).ClaimExpiringCodes), ctx, until, limit)
+}
+
+// ReleaseExpiringCode mocks base method.
+func (m *MockReminderStore) ReleaseExpiringCode(ctx context.Context, codeID int) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReleaseExpiringCode", ctx, codeID)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ReleaseExpiringCode indicates an expected call of ReleaseExpiringCode.
+func (mr *MockReminderStoreMockRecorder) ReleaseExpiringCode(ctx, codeID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReleaseExpiringCode", reflect.TypeOf((*MockReminderStore)(nil).ReleaseExpiringCode), ctx, codeID)
+}
+
+// MockRetentionStore is a mock of RetentionStore interface.
+type MockRetentionStore struct {
+	ctrl     *gomock.Controller
+	recorder *MockRetentionStoreMockRecorder
+}
+
+// MockRetentionStoreMockRecorder is the mock recorder for MockRetentionStore.
+type MockRetentionStoreMockRecorder struct {
+	mock *MockRetentionStore
+}
+
+// NewMockRetentionStore creates a new mock instance.
+func NewMockRetentionStore(ctrl *gomock.Controller) *MockRetentionStore {
+	mock := &MockRetentionStore{ctrl: ctrl}
+	mock.recorder = &MockRetentionStoreMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockRetentionStore) EXPECT() *MockRetentionStoreMockRecorder {
+	return m.recorder
+}
+
+// PurgeCodeArchive mocks base method.
+func (m *MockRetentionStore) PurgeCodeArchive(ctx context.Context, before time.Time, limit int) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PurgeCodeArchive", ctx, before, limit)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// PurgeCodeArchive indicates an expected call of PurgeCodeArchive.
+func (mr *MockRetentionStoreMockRecorder) PurgeCodeArchive(ctx, before, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PurgeCodeArchive", reflect.TypeOf((*MockRetentionStore)(nil).PurgeCodeArchive), ctx, before, limit)
+}
+
+// PurgeWebhookDeliveries mocks base method.
+func (m *MockRetentionStore) PurgeWebhookDeliveries(ctx context.Context, before time.Time, limit int) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PurgeWebhookDeliveries", ctx, before, limit)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// PurgeWebhookDeliveries indicates an expected call of PurgeWebhookDeliveries.
+func (mr *MockRetentionStoreMockRecorder) PurgeWebhookDeliveries(ctx, before, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PurgeWebhookDeliveries", reflect.TypeOf((*MockRetentionStore)(nil).PurgeWebhookDeliveries), ctx, before, limit)
+}
+
+// ScrubPersonalData mocks base method.
+func (m *MockRetentionStore) ScrubPersonalData(ctx context.Context, target string, before time.Time, limit int) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ScrubPersonalData", ctx, target, before, limit)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ScrubPersonalData indicates an expected call of ScrubPersonalData.
+func (mr *MockRetentionStoreMockRecorder) ScrubPersonalData(ctx, target, before, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ScrubPersonalData", reflect.TypeOf((*MockRetentionStore)(nil).ScrubPersonalData), ctx, target, before, limit)
+}
+
+// MockStatementStore is a mock of StatementStore interface.
+type MockStatementStore struct {
+	ctrl     *gomock.Controller
+	recorder *MockStatementStoreMockRecorder
+}
+
+// MockStatementStoreMockRecorder is the mock recorder for MockStatementStore.
+type MockStatementStoreMockRecorder struct {
+	mock *MockStatementStore
+}
+
+// NewMockStatementStore creates a new mock instance.
+func NewMockStatementStore(ctrl *gomock.Controller) *MockStatementStore {
+	mock := &MockStatementStore{ctrl: ctrl}
+	mock.recorder = &MockStatementStoreMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockStatementStore) EXPECT() *MockStatementStoreMockRecorder {
+	return m.recorder
+}
+
+// ClaimStatements mocks base method.
+func (m *MockStatementStore) ClaimStatements(ctx context.Context, limit int, lease time.Duration) ([]ClaimedStatement, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ClaimStatements", ctx, limit, lease)
+	ret0, _ := ret[0].([]ClaimedStatement)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ClaimStatements indicates an expected call of ClaimStatements.
+func (mr *MockStatementStoreMockRecorder) ClaimStatements(ctx, limit, lease interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ClaimStatements", reflect.TypeOf((*MockStatementStore)(nil).ClaimStatements), ctx, limit, lease)
+}
+
+// GenerateStatements mocks base method.
+func (m *MockStatementStore) GenerateStatements(ctx context.Context, period time.Time) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GenerateStatements", ctx, period)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GenerateStatements indicates an expected call of GenerateStatements.
+func (mr *MockStatementStoreMockRecorder) GenerateStatements(ctx, period interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GenerateStatements", reflect.TypeOf((*MockStatementStore)(nil).GenerateStatements), ctx, period)
+}
+
+// GetRewardStatement mocks base method.
+func (m *MockStatementStore) GetRewardStatement(ctx context.Context, userID int, period time.Time) (RewardStatement, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetRewardStatement", ctx, userID, period)
+	ret0, _ := ret[0].(RewardStatement)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetRewardStatement indicates an expected call of GetRewardStatement.
+func (mr *MockStatementStoreMockRecorder) GetRewardStatement(ctx, userID, period interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetRewardStatement", reflect.TypeOf((*MockStatementStore)(nil).GetRewardStatement), ctx, userID, period)
+}
+
+// ListLedgerEntries mocks base method.
+func (m *MockStatementStore) ListLedgerEntries(ctx context.Context, userID int, period time.Time) ([]LedgerEntry, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListLedgerEntries", ctx, userID, period)
+	ret0, _ := ret[0].([]LedgerEntry)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListLedgerEntries indicates an expected call of ListLedgerEntries.
+func (mr *MockStatementStoreMockRecorder) ListLedgerEntries(ctx, userID, period interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListLedgerEntries", reflect.TypeOf((*MockStatementStore)(nil).ListLedgerEntries), ctx, userID, period)
+}
+
+// ListRewardStatements mocks base method.
+func (m *MockStatementStore) ListRewardStatements(ctx context.Context, userID int) ([]RewardStatement, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListRewardStatements", ctx, userID)
+	ret0, _ := ret[0].([]RewardStatement)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListRewardStatements indicates an expected call of ListRewardStatements.
+func (mr *MockStatementStoreMockRecorder) ListRewardStatements(ctx, userID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListRewardStatements", reflect.TypeOf((*MockStatementStore)(nil).ListRewardStatements), ctx, userID)
+}
+
+// MarkStatementSent mocks base method.
+func (m *MockStatementStore) MarkStatementSent(ctx context.Context, id int) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "MarkStatementSent", ctx, id)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// MarkStatementSent indicates an expected call of MarkStatementSent.
+func (mr *MockStatementStoreMockRecorder) MarkStatementSent(ctx, id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MarkStatementSent", reflect.TypeOf((*MockStatementStore)(nil).MarkStatementSent), ctx, id)
+}
+
+// ReleaseStatement mocks base method.
+func (m *MockStatementStore) ReleaseStatement(ctx context.Context, id int) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReleaseStatement", ctx, id)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ReleaseStatement indicates an expected call of ReleaseStatement.
+func (mr *MockStatementStoreMockRecorder) ReleaseStatement(ctx, id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReleaseStatement", reflect.TypeOf((*MockStatementStore)(nil).ReleaseStatement), ctx, id)
+}
+
+// MockTermsStore is a mock of TermsStore interface.
+type MockTermsStore struct {
+	ctrl     *gomock.Controller
+	recorder *MockTermsStoreMockRecorder
+}
+
+// MockTermsStoreMockRecorder is the mock recorder for MockTermsStore.
+type MockTermsStoreMockRecorder struct {
+	mock *MockTermsStore
+}
+
+// NewMockTermsStore creates a new mock instance.
+func NewMockTermsStore(ctrl *gomock.Controller) *MockTermsStore {
+	mock := &MockTermsStore{ctrl: ctrl}
+	mock.recorder = &MockTermsStoreMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockTermsStore) EXPECT() *MockTermsStoreMockRecorder {
+	return m.recorder
+}
+
+// AcceptTerms mocks base method.
+func (m *MockTermsStore) AcceptTerms(ctx context.Context, userID int, version, ip string) (TermsAcceptance, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AcceptTerms", ctx, userID, version, ip)
+	ret0, _ := ret[0].(TermsAcceptance)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// AcceptTerms indicates an expected call of AcceptTerms.
+func (mr *MockTermsStoreMockRecorder) AcceptTerms(ctx, userID, version, ip interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AcceptTerms", reflect.TypeOf((*MockTermsStore)(nil).AcceptTerms), ctx, userID, version, ip)
+}
+
+// TermsAccepted mocks base method.
+func (m *MockTermsStore) TermsAccepted(ctx context.Context, userID int, version string) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "TermsAccepted", ctx, userID, version)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// TermsAccepted indicates an expected call of TermsAccepted.
+func (mr *MockTermsStoreMockRecorder) TermsAccepted(ctx, userID, version interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RegisterWithReferralCode", reflect.TypeOf((*MockDBInterface)(nil).RegisterWithReferralCode), ctx, referralCode, user)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TermsAccepted", reflect.TypeOf((*MockTermsStore)(nil).TermsAccepted), ctx, userID, version)
 }
@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"context"
+
+	pgxv4 "github.com/jackc/pgx/v4"
+
+	"gorefer.go/pkg/onboarding"
+)
+
+// Состояния вознаграждения за приглашенного
+const (
+	RewardPending       = "pending"        // приглашенный еще не выполнил обязательные шаги
+	RewardVested        = "vested"         // вознаграждение зачислено на баланс реферера
+	RewardPendingReview = "pending_review" // удержано до разбора отметки о реферере
+	RewardForfeited     = "forfeited"      // аннулировано по итогам разбора отметки
+)
+
+// WithOnboarding задает шаги знакомства с сервисом, которые должен
+// выполнить приглашенный, чтобы вознаграждение за него зачислилось на
+// баланс реферера. До этого вознаграждение ожидает и в баланс не входит.
+// Без шагов вознаграждение зачисляется сразу при начислении.
+func WithOnboarding(rules onboarding.Rules) Option {
+	return func(db *DB) {
+		db.onboarding = rules
+	}
+}
+
+// insertReward начисляет вознаграждение за приглашенного. Если у
+// реферера есть непросмотренная отметка о подозрительной активности,
+// вознаграждение удерживается до ее разбора (RewardPendingReview), см.
+// ReviewReferrerFlag. Иначе, если приглашенный уже выполнил обязательные
+// шаги, вознаграждение сразу зачисляется.
+func (db *DB) insertReward(ctx context.Context, tx pgxv4.Tx, referrerID, refereeID, tier int, amount int64) error {
+	var held bool
+	err := tx.QueryRow(ctx, `
+        SELECT EXISTS (SELECT 1 FROM referrer_flags WHERE referrer_id = $1 AND reviewed_at IS NULL)`,
+		referrerID).Scan(&held)
+	if err != nil {
+		return err
+	}
+	vestNow := len(db.onboarding) == 0 && !held
+	_, err = tx.Exec(ctx, `
+        INSERT INTO referral_rewards (referrer_id, referee_id, tier, amount, vested_at, review_status)
+        VALUES ($1, $2, $3, $4, CASE WHEN $5 THEN NOW() END, CASE WHEN $6 THEN $7 END)
+        ON CONFLICT (referee_id) DO NOTHING`,
+		referrerID, refereeID, tier, amount, vestNow, held, RewardPendingReview)
+	if err != nil || held || len(db.onboarding) == 0 {
+		return err
+	}
+	return db.vestRewards(ctx, tx, refereeID)
+}
+
+// completeStep отмечает шаг знакомства пользователя выполненным в
+// транзакции действия, которым он выполнен, и зачисляет вознаграждение
+// за пользователя, если выполнены все обязательные шаги.
+func (db *DB) completeStep(ctx context.Context, tx pgxv4.Tx, userID int, step string) error {
+	tag, err := tx.Exec(ctx, `
+        INSERT INTO onboarding_steps (user_id, step) VALUES ($1, $2)
+        ON CONFLICT (user_id, step) DO NOTHING`, userID, step)
+	if err != nil || tag.RowsAffected() == 0 || len(db.onboarding) == 0 {
+		return err
+	}
+	return db.vestRewards(ctx, tx, userID)
+}
+
+// vestRewards зачисляет ожидающее вознаграждение за приглашенного
+// refereeID, если он выполнил все обязательные шаги. Удержанные и
+// аннулированные вознаграждения не зачисляются.
+func (db *DB) vestRewards(ctx context.Context, tx pgxv4.Tx, refereeID int) error {
+	var steps []string
+	err := tx.QueryRow(ctx, `
+        SELECT COALESCE(array_agg(step), '{}') FROM onboarding_steps WHERE user_id = $1`, refereeID).
+		Scan(&steps)
+	if err != nil || !db.onboarding.Done(steps) {
+		return err
+	}
+	_, err = tx.Exec(ctx, `
+        UPDATE referral_rewards SET vested_at = NOW()
+        WHERE referee_id = $1 AND vested_at IS NULL AND review_status IS NULL`, refereeID)
+	return err
+}
@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// Состояние пула соединений с БД
+type PoolStats struct {
+	Total             int32 `json:"total"`
+	Idle              int32 `json:"idle"`
+	Acquired          int32 `json:"acquired"`
+	Max               int32 `json:"max"`
+	AcquireCount      int64 `json:"acquire_count"`
+	EmptyAcquireCount int64 `json:"empty_acquire_count"` // ожидания свободного соединения
+	AcquireDurationMs int64 `json:"acquire_duration_ms"` // суммарное время ожидания
+}
+
+// PoolStats возвращает текущее состояние пула соединений.
+func (db *DB) PoolStats() PoolStats {
+	s := db.pool.Stat()
+	return PoolStats{
+		Total:             s.TotalConns(),
+		Idle:              s.IdleConns(),
+		Acquired:          s.AcquiredConns(),
+		Max:               s.MaxConns(),
+		AcquireCount:      s.AcquireCount(),
+		EmptyAcquireCount: s.EmptyAcquireCount(),
+		AcquireDurationMs: s.AcquireDuration().Milliseconds(),
+	}
+}
+
+// Число пользователей, зарегистрированных начиная с since
+func (db *DB) CountSignups(ctx context.Context, since time.Time) (_ int, err error) {
+	defer wrapError(&err, "count signups since=%s", since.Format(time.RFC3339))
+	var n int
+	err = db.read.QueryRow(ctx, `SELECT COUNT(*) FROM users WHERE created_at >= $1`, since).Scan(&n)
+	return n, err
+}
+
+// Число действующих кодов: активных, не истекших и не отозванных
+func (db *DB) CountActiveCodes(ctx context.Context) (_ int, err error) {
+	defer wrapError(&err, "count active codes")
+	var n int
+	err = db.read.QueryRow(ctx, `
+        SELECT COUNT(*) FROM referral_codes
+        WHERE status = $1 AND expires_at > NOW() AND revoked_at IS NULL`, CodeStatusActive).
+		Scan(&n)
+	return n, err
+}
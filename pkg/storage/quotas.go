@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	pgxv4 "github.com/jackc/pgx/v4"
+)
+
+// Использование квот пользователя
+type QuotaUsage struct {
+	CodesCreated int // кодов создано начиная с since
+	Invites      int // приглашенных зарегистрировалось начиная с since
+	ActiveCodes  int // действующих кодов сейчас
+	// срок ближайшего к истечению действующего кода; nil - кодов нет
+	NextCodeExpiry *time.Time
+}
+
+// Квоты пользователя, заданные администратором. nil - действует общая
+// квота, 0 - без ограничения.
+type UserLimits struct {
+	CodesPerDay   *int `json:"codes_per_day"`
+	InvitesPerDay *int `json:"invites_per_day"`
+	ActiveCodes   *int `json:"active_codes"`
+}
+
+// recordCodeCreation учитывает создание кода для квоты codes_per_day.
+func recordCodeCreation(ctx context.Context, tx pgxv4.Tx, userID int) error {
+	_, err := tx.Exec(ctx, `INSERT INTO code_creations (user_id) VALUES ($1)`, userID)
+	return err
+}
+
+// Использование квот пользователя: созданные коды и приглашенные начиная
+// с since, а также действующие коды. Квоты проверяются сразу после
+// записей, поэтому чтение идет с основной БД.
+func (db *DB) GetQuotaUsage(ctx context.Context, userID int, since time.Time) (_ QuotaUsage, err error) {
+	defer wrapError(&err, "get quota usage user=%d", userID)
+	var u QuotaUsage
+	err = db.pool.QueryRow(ctx, `
+        SELECT
+            (SELECT COUNT(*) FROM code_creations WHERE user_id = $1 AND created_at >= $2),
+            (SELECT COUNT(*) FROM referral_links WHERE referrer_id = $1 AND created_at >= $2),
+            COUNT(*), MIN(expires_at)
+        FROM referral_codes
+        WHERE user_id = $1 AND status = $3 AND expires_at > NOW() AND revoked_at IS NULL`,
+		userID, since, CodeStatusActive).
+		Scan(&u.CodesCreated, &u.Invites, &u.ActiveCodes, &u.NextCodeExpiry)
+	if err != nil {
+		return QuotaUsage{}, err
+	}
+	return u, nil
+}
+
+// Квоты пользователя, заданные администратором. Если квоты не задавались
+// - пустые UserLimits.
+func (db *DB) GetUserLimits(ctx context.Context, userID int) (_ UserLimits, err error) {
+	defer wrapError(&err, "get user limits user=%d", userID)
+	var l UserLimits
+	err = db.pool.QueryRow(ctx, `
+        SELECT codes_per_day, invites_per_day, active_codes
+        FROM user_limits WHERE user_id = $1`, userID).
+		Scan(&l.CodesPerDay, &l.InvitesPerDay, &l.ActiveCodes)
+	if errors.Is(err, pgxv4.ErrNoRows) {
+		return UserLimits{}, nil
+	}
+	if err != nil {
+		return UserLimits{}, err
+	}
+	return l, nil
+}
+
+// Замена квот пользователя. Действие фиксируется в журнале аудита от
+// имени администратора actorID. Если пользователя нет - ErrNotFound.
+func (db *DB) SetUserLimits(ctx context.Context, userID int, limits UserLimits, actorID int) (_ UserLimits, err error) {
+	defer wrapError(&err, "set user limits user=%d", userID)
+	var l UserLimits
+	err = db.pool.BeginFunc(ctx, func(tx pgxv4.Tx) error {
+		var id int
+		err := tx.QueryRow(ctx, `SELECT id FROM users WHERE id = $1 FOR UPDATE`, userID).Scan(&id)
+		if errors.Is(err, pgxv4.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		err = tx.QueryRow(ctx, `
+        INSERT INTO user_limits (user_id, codes_per_day, invites_per_day, active_codes)
+        VALUES ($1, $2, $3, $4)
+        ON CONFLICT (user_id) DO UPDATE SET
+            codes_per_day = EXCLUDED.codes_per_day,
+            invites_per_day = EXCLUDED.invites_per_day,
+            active_codes = EXCLUDED.active_codes,
+            updated_at = NOW()
+        RETURNING codes_per_day, invites_per_day, active_codes`,
+			userID, limits.CodesPerDay, limits.InvitesPerDay, limits.ActiveCodes).
+			Scan(&l.CodesPerDay, &l.InvitesPerDay, &l.ActiveCodes)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `
+        INSERT INTO audit_log (actor_id, action, target_user_id, payload)
+        VALUES ($1, $2, $3, $4)`,
+			actorID,
+			AuditUserLimitsSet,
+			userID,
+			l,
+		)
+		return err
+	})
+	if err != nil {
+		return UserLimits{}, err
+	}
+	return l, nil
+}
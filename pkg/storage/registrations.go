@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	pgxv4 "github.com/jackc/pgx/v4"
+)
+
+// Статусы регистрации в очереди
+const (
+	RegistrationPending   = "pending"   // ожидает обработки или повторной попытки
+	RegistrationCompleted = "completed" // пользователь создан
+	RegistrationFailed    = "failed"    // регистрация отклонена, см. ErrorCode
+)
+
+// ErrRegistrationQueueFull - в очереди регистраций нет места
+var ErrRegistrationQueueFull = errors.New("очередь регистраций заполнена")
+
+// Регистрация в очереди. Payload и Result хранилище не разбирает:
+// их формат определяет API. Payload есть только у ожидающих регистраций.
+type QueuedRegistration struct {
+	ID        string          `json:"id"`
+	Status    string          `json:"status"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+	Result    json.RawMessage `json:"result,omitempty"`
+	ErrorCode string          `json:"error_code,omitempty"`
+	Attempts  int             `json:"attempts"`
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+// Постановка регистрации в очередь. Если ожидающих регистраций уже
+// maxPending, возвращается ErrRegistrationQueueFull; при одновременных
+// вызовах предел может быть превышен на число вызовов.
+func (db *DB) EnqueueRegistration(ctx context.Context, id string, payload json.RawMessage, maxPending int) (err error) {
+	defer wrapError(&err, "enqueue registration id=%s", id)
+	tag, err := db.pool.Exec(ctx, `
+        INSERT INTO registration_queue (id, payload)
+        SELECT $1, $2::jsonb
+        WHERE (SELECT COUNT(*) FROM registration_queue WHERE status = 'pending') < $3`,
+		id, string(payload), maxPending)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrRegistrationQueueFull
+	}
+	return nil
+}
+
+// Выбор ожидающих регистраций в порядке поступления. Выбранные
+// регистрации откладываются на lease: если обработчик упадет, не записав
+// итог, регистрация будет выбрана снова по истечении lease.
+func (db *DB) ClaimRegistrations(ctx context.Context, limit int, lease time.Duration) (_ []QueuedRegistration, err error) {
+	defer wrapError(&err, "claim registrations")
+	rows, err := db.pool.Query(ctx, `
+        UPDATE registration_queue SET
+            attempts = attempts + 1,
+            next_attempt_at = NOW() + make_interval(secs => $2)
+        WHERE id IN (
+            SELECT id FROM registration_queue
+            WHERE status = 'pending' AND next_attempt_at <= NOW()
+            ORDER BY created_at, id
+            LIMIT $1
+            FOR UPDATE SKIP LOCKED
+        )
+        RETURNING `+registrationColumns, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	regs := []QueuedRegistration{}
+	for rows.Next() {
+		r, err := scanRegistration(rows)
+		if err != nil {
+			return nil, err
+		}
+		regs = append(regs, r)
+	}
+	return regs, rows.Err()
+}
+
+// Запись итога регистрации: status - RegistrationCompleted с result или
+// RegistrationFailed с errorCode. Данные регистрации удаляются.
+// ErrNotFound, если ожидающей регистрации с таким ID нет.
+func (db *DB) FinishRegistration(ctx context.Context, id, status string, result json.RawMessage, errorCode string) (err error) {
+	defer wrapError(&err, "finish registration id=%s", id)
+	var res interface{}
+	if result != nil {
+		res = string(result)
+	}
+	tag, err := db.pool.Exec(ctx, `
+        UPDATE registration_queue SET
+            status = $2,
+            result = $3::jsonb,
+            error_code = NULLIF($4, ''),
+            payload = NULL,
+            updated_at = NOW()
+        WHERE id = $1 AND status = 'pending'`, id, status, res, errorCode)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Регистрация по ID; ErrNotFound, если ее нет. Читается с основного
+// сервера: клиент опрашивает статус сразу после постановки в очередь.
+func (db *DB) GetQueuedRegistration(ctx context.Context, id string) (_ QueuedRegistration, err error) {
+	defer wrapError(&err, "get queued registration id=%s", id)
+	r, err := scanRegistration(db.pool.QueryRow(ctx, `
+        SELECT `+registrationColumns+` FROM registration_queue WHERE id = $1`, id))
+	if errors.Is(err, pgxv4.ErrNoRows) {
+		return QueuedRegistration{}, ErrNotFound
+	}
+	return r, err
+}
+
+// Удаление обработанных регистраций, итог которых записан раньше before,
+// не больше limit за вызов. Возвращает число удаленных записей.
+func (db *DB) PurgeRegistrations(ctx context.Context, before time.Time, limit int) (_ int, err error) {
+	defer wrapError(&err, "purge registrations")
+	tag, err := db.pool.Exec(ctx, `
+        DELETE FROM registration_queue
+        WHERE id IN (
+            SELECT id FROM registration_queue
+            WHERE status <> 'pending' AND updated_at < $1
+            LIMIT $2
+            FOR UPDATE SKIP LOCKED
+        )`, before, limit)
+	if err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+const registrationColumns = `id, status, payload, result, COALESCE(error_code, ''), attempts, created_at, updated_at`
+
+func scanRegistration(row pgxv4.Row) (QueuedRegistration, error) {
+	var r QueuedRegistration
+	err := row.Scan(&r.ID, &r.Status, &r.Payload, &r.Result, &r.ErrorCode, &r.Attempts, &r.CreatedAt, &r.UpdatedAt)
+	return r, err
+}
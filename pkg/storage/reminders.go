@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// Код, владельцу которого отправляется напоминание об истечении срока
+type ExpiringCode struct {
+	ID        int
+	UserID    int
+	Code      string
+	Label     string
+	ExpiresAt time.Time
+	Username  string
+	Email     string
+	Timezone  string // часовой пояс владельца для сроков в письме
+}
+
+// Выбор действующих кодов, срок которых истекает не позже until и о
+// которых еще не напоминали. Выбранные коды сразу помечаются
+// напомненными, поэтому другой экземпляр сервиса их не получит; если
+// письмо не отправлено, отметку снимает ReleaseExpiringCode. Коды
+// анонимизированных пользователей не выбираются.
+func (db *DB) ClaimExpiringCodes(ctx context.Context, until time.Time, limit int) (_ []ExpiringCode, err error) {
+	defer wrapError(&err, "claim expiring codes")
+	rows, err := db.pool.Query(ctx, `
+        UPDATE referral_codes rc SET reminded_at = NOW()
+        FROM users u
+        WHERE u.id = rc.user_id AND rc.id IN (
+            SELECT c.id FROM referral_codes c
+            JOIN users cu ON cu.id = c.user_id
+            WHERE c.reminded_at IS NULL AND c.status = $1 AND c.revoked_at IS NULL
+                AND c.expires_at > NOW() AND c.expires_at <= $2
+                AND cu.anonymized_at IS NULL
+            ORDER BY c.expires_at, c.id
+            LIMIT $3
+            FOR UPDATE OF c SKIP LOCKED
+        )
+        RETURNING rc.id, rc.user_id, rc.code, COALESCE(rc.label, ''), rc.expires_at, u.username, u.email, u.timezone`,
+		CodeStatusActive, until, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	codes := []ExpiringCode{}
+	for rows.Next() {
+		var c ExpiringCode
+		if err := rows.Scan(&c.ID, &c.UserID, &c.Code, &c.Label, &c.ExpiresAt, &c.Username, &c.Email, &c.Timezone); err != nil {
+			return nil, err
+		}
+		codes = append(codes, c)
+	}
+	return codes, rows.Err()
+}
+
+// Снятие отметки о напоминании, чтобы код был выбран снова
+func (db *DB) ReleaseExpiringCode(ctx context.Context, codeID int) (err error) {
+	defer wrapError(&err, "release expiring code id=%d", codeID)
+	_, err = db.pool.Exec(ctx, `UPDATE referral_codes SET reminded_at = NULL WHERE id = $1`, codeID)
+	return err
+}
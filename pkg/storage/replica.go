@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	pgxv4 "github.com/jackc/pgx/v4"
+)
+
+// Чтение с реплики.
+//
+// На реплику направляются только запросы отчетов и списков, которым не
+// страшно отставание репликации на несколько секунд:
+//
+//	GetReferralsByReferrerID, GetReferralCodeDetails, GetProgramReport,
+//	GetCohortStats, GetCodeStats, CompareReferralCodes, ListReferralCodes,
+//	ListLoginEvents, ListRedemptions, GetReferrerActivity,
+//	ListReferrerFlags, CountSignups, CountActiveCodes,
+//	ListWebhookDeliveries, WebhookStats.
+//
+// Остальные чтения остаются на основной БД. Это поиск пользователей и кодов
+// (GetUserBy*, EmailExists, GetReferralCodeBy*, TermsAccepted), который
+// регистрация и вход выполняют сразу после записи, баланс и статистика
+// пользователя (GetReferralStats, GetProfile), выгрузка данных, проверка
+// ключей API, проверки согласованности и схемы. Записи и транзакции
+// выполняются только на основной БД.
+
+// querier - запросы без транзакции. Реализуется *pgxpool.Pool.
+type querier interface {
+	Query(ctx context.Context, sql string, args ...interface{}) (pgxv4.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgxv4.Row
+}
+
+// WithReadReplica задает строку подключения к реплике для чтения. Пустая
+// строка - все запросы выполняются на основной БД.
+func WithReadReplica(connstr string) Option {
+	return func(db *DB) {
+		db.replicaConnstr = connstr
+	}
+}
+
+// readPool выполняет запросы на реплике, а если реплика недоступна -
+// на основной БД.
+type readPool struct {
+	replica querier
+	primary querier
+}
+
+// Query повторяет запрос на основной БД, если реплика вернула ошибку до
+// получения строк: нет соединения, реплика перезапускается и т.п.
+func (p readPool) Query(ctx context.Context, sql string, args ...interface{}) (pgxv4.Rows, error) {
+	rows, err := p.replica.Query(ctx, sql, args...)
+	if err == nil || ctx.Err() != nil {
+		return rows, err
+	}
+	log.Printf("Предупреждение: запрос к реплике не выполнен, повтор на основной БД: %v", err)
+	return p.primary.Query(ctx, sql, args...)
+}
+
+func (p readPool) QueryRow(ctx context.Context, sql string, args ...interface{}) pgxv4.Row {
+	return fallbackRow{
+		ctx:     ctx,
+		row:     p.replica.QueryRow(ctx, sql, args...),
+		primary: p.primary,
+		sql:     sql,
+		args:    args,
+	}
+}
+
+// fallbackRow - строка с реплики. Ошибка запроса у pgx проявляется только
+// в Scan, поэтому повтор на основной БД выполняется там. Отсутствие строки
+// - ответ, а не сбой, и не повторяется.
+type fallbackRow struct {
+	ctx     context.Context
+	row     pgxv4.Row
+	primary querier
+	sql     string
+	args    []interface{}
+}
+
+func (r fallbackRow) Scan(dest ...interface{}) error {
+	err := r.row.Scan(dest...)
+	if err == nil || errors.Is(err, pgxv4.ErrNoRows) || r.ctx.Err() != nil {
+		return err
+	}
+	log.Printf("Предупреждение: запрос к реплике не выполнен, повтор на основной БД: %v", err)
+	return r.primary.QueryRow(r.ctx, r.sql, r.args...).Scan(dest...)
+}
@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	pgxv4 "github.com/jackc/pgx/v4"
+)
+
+// fakeQuerier считает запросы и отвечает пустым результатом или err
+type fakeQuerier struct {
+	err     error // ошибка Query и Scan
+	queries int
+}
+
+func (q *fakeQuerier) Query(ctx context.Context, sql string, args ...interface{}) (pgxv4.Rows, error) {
+	q.queries++
+	if q.err != nil {
+		return nil, q.err
+	}
+	return emptyRows{}, nil
+}
+
+func (q *fakeQuerier) QueryRow(ctx context.Context, sql string, args ...interface{}) pgxv4.Row {
+	q.queries++
+	return fakeRow{err: q.err}
+}
+
+// emptyRows - результат без строк
+type emptyRows struct{ pgxv4.Rows }
+
+func (emptyRows) Next() bool { return false }
+func (emptyRows) Close()     {}
+func (emptyRows) Err() error { return nil }
+
+type fakeRow struct{ err error }
+
+func (r fakeRow) Scan(dest ...interface{}) error { return r.err }
+
+func TestReadPool_Fallback(t *testing.T) {
+	errReplica := errors.New("replica is down")
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name        string
+		ctx         context.Context
+		replicaErr  error
+		wantPrimary int
+		wantErr     error
+	}{
+		{"replica ok", context.Background(), nil, 0, nil},
+		{"replica error", context.Background(), errReplica, 1, nil},
+		{"no rows is an answer", context.Background(), pgxv4.ErrNoRows, 0, pgxv4.ErrNoRows},
+		{"canceled request", canceled, errReplica, 0, errReplica},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+"/Query", func(t *testing.T) {
+			if tt.replicaErr == pgxv4.ErrNoRows {
+				t.Skip("Query returns no rows without error")
+			}
+			replica, primary := &fakeQuerier{err: tt.replicaErr}, &fakeQuerier{}
+			_, err := readPool{replica: replica, primary: primary}.Query(tt.ctx, "SELECT 1")
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+			if replica.queries != 1 || primary.queries != tt.wantPrimary {
+				t.Errorf("replica/primary queries = %d/%d, want 1/%d", replica.queries, primary.queries, tt.wantPrimary)
+			}
+		})
+		t.Run(tt.name+"/QueryRow", func(t *testing.T) {
+			replica, primary := &fakeQuerier{err: tt.replicaErr}, &fakeQuerier{}
+			err := readPool{replica: replica, primary: primary}.QueryRow(tt.ctx, "SELECT 1").Scan()
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+			if replica.queries != 1 || primary.queries != tt.wantPrimary {
+				t.Errorf("replica/primary queries = %d/%d, want 1/%d", replica.queries, primary.queries, tt.wantPrimary)
+			}
+		})
+	}
+}
+
+// Запросы, допускающие отставание реплики, идут на реплику, а при ее
+// сбое - на основную БД. Пул основной БД здесь не нужен: обращение к
+// нему мимо db.read завершилось бы паникой.
+func TestDB_ReadRouting(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	reads := map[string]func(db *DB) error{
+		"GetReferralsByReferrerID": func(db *DB) error { _, err := db.GetReferralsByReferrerID(ctx, 1, 10, 0); return err },
+		"GetReferralCodeDetails":   func(db *DB) error { _, err := db.GetReferralCodeDetails(ctx, "CODE"); return err },
+		"GetProgramReport":         func(db *DB) error { _, err := db.GetProgramReport(ctx, now.AddDate(0, 0, -7), now); return err },
+		"GetCohortStats":           func(db *DB) error { _, err := db.GetCohortStats(ctx, now.AddDate(0, -1, 0), now); return err },
+		"GetCodeStats":             func(db *DB) error { _, err := db.GetCodeStats(ctx, 1, true); return err },
+		"CompareReferralCodes":     func(db *DB) error { _, err := db.CompareReferralCodes(ctx, 1, true); return err },
+		"ListReferralCodes":        func(db *DB) error { _, err := db.ListReferralCodes(ctx, ReferralCodeFilter{}, 10, 0); return err },
+		"ListLoginEvents":          func(db *DB) error { _, err := db.ListLoginEvents(ctx, 1, 10, 0); return err },
+		"ListRedemptions":          func(db *DB) error { _, err := db.ListRedemptions(ctx, 1, 10, 0); return err },
+		"GetReferrerActivity":      func(db *DB) error { _, err := db.GetReferrerActivity(ctx, now); return err },
+		"ListReferrerFlags":        func(db *DB) error { _, err := db.ListReferrerFlags(ctx); return err },
+		"CountSignups":             func(db *DB) error { _, err := db.CountSignups(ctx, now); return err },
+		"CountActiveCodes":         func(db *DB) error { _, err := db.CountActiveCodes(ctx); return err },
+		"ListWebhookDeliveries": func(db *DB) error {
+			_, err := db.ListWebhookDeliveries(ctx, WebhookDeliveryFilter{}, 10, 0)
+			return err
+		},
+		"WebhookStats": func(db *DB) error { _, err := db.WebhookStats(ctx); return err },
+	}
+	for name, read := range reads {
+		t.Run(name, func(t *testing.T) {
+			replica, primary := &fakeQuerier{}, &fakeQuerier{}
+			if err := read(&DB{read: readPool{replica: replica, primary: primary}}); err != nil {
+				t.Fatal(err)
+			}
+			if replica.queries == 0 || primary.queries != 0 {
+				t.Errorf("replica/primary queries = %d/%d, want replica only", replica.queries, primary.queries)
+			}
+
+			replica, primary = &fakeQuerier{err: errors.New("replica is down")}, &fakeQuerier{}
+			if err := read(&DB{read: readPool{replica: replica, primary: primary}}); err != nil {
+				t.Fatalf("no fallback to primary: %v", err)
+			}
+			if primary.queries != replica.queries {
+				t.Errorf("replica/primary queries = %d/%d, want every query retried on primary", replica.queries, primary.queries)
+			}
+		})
+	}
+}
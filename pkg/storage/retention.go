@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Таблицы, в которых очищаются устаревшие персональные данные: IP-адреса
+// и User-Agent. Переходы по ссылкам и журнал аудита их не хранят.
+const (
+	ScrubLoginEvents      = "login_events"      // ip, user_agent попыток входа
+	ScrubSignups          = "users"             // signup_ip, user_agent регистрации
+	ScrubTermsAcceptances = "terms_acceptances" // ip принятия условий
+)
+
+// ScrubTargets - все таблицы очистки по порядку
+var ScrubTargets = []string{ScrubLoginEvents, ScrubSignups, ScrubTermsAcceptances}
+
+// Запросы очистки по таблице: $1 - граница по времени записи, $2 -
+// предельное число строк. Строки, которые держит другая транзакция,
+// пропускаются до следующего прохода.
+var scrubQueries = map[string]string{
+	ScrubLoginEvents: `
+        UPDATE login_events SET ip = NULL, user_agent = NULL
+        WHERE id IN (
+            SELECT id FROM login_events
+            WHERE created_at < $1 AND (ip IS NOT NULL OR user_agent IS NOT NULL)
+            ORDER BY created_at
+            LIMIT $2
+            FOR UPDATE SKIP LOCKED
+        )`,
+	ScrubSignups: `
+        UPDATE users SET signup_ip = NULL, user_agent = NULL
+        WHERE id IN (
+            SELECT id FROM users
+            WHERE created_at < $1 AND (signup_ip IS NOT NULL OR user_agent IS NOT NULL)
+            ORDER BY created_at
+            LIMIT $2
+            FOR UPDATE SKIP LOCKED
+        )`,
+	ScrubTermsAcceptances: `
+        UPDATE terms_acceptances SET ip = NULL
+        WHERE id IN (
+            SELECT id FROM terms_acceptances
+            WHERE accepted_at < $1 AND ip IS NOT NULL
+            ORDER BY accepted_at
+            LIMIT $2
+            FOR UPDATE SKIP LOCKED
+        )`,
+}
+
+// Очистка IP-адресов и User-Agent в не более чем limit строках таблицы
+// target, записанных раньше before. Возвращает число очищенных строк;
+// меньше limit - устаревших строк не осталось.
+func (db *DB) ScrubPersonalData(ctx context.Context, target string, before time.Time, limit int) (_ int, err error) {
+	defer wrapError(&err, "scrub %s before=%s", target, before.Format(time.RFC3339))
+	query, ok := scrubQueries[target]
+	if !ok {
+		return 0, fmt.Errorf("unknown scrub target %q", target)
+	}
+	tag, err := db.pool.Exec(ctx, query, before, limit)
+	if err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), nil
+}
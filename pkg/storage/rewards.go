@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	pgxv4 "github.com/jackc/pgx/v4"
+
+	"gorefer.go/pkg/rewards"
+)
+
+// Реферальная статистика пользователя
+type ReferralStats struct {
+	Referrals   int   `json:"referrals"`
+	RewardTotal int64 `json:"reward_total"` // зачислено
+	// ожидает, пока приглашенные выполнят обязательные шаги, см. WithOnboarding
+	RewardPending int64 `json:"reward_pending,omitempty"`
+	// удержано до разбора отметки о подозрительной активности
+	RewardHeld int64           `json:"reward_held,omitempty"`
+	Balance    int64           `json:"balance"`     // зачислено за вычетом списаний
+	ActiveTier *rewards.Active `json:"active_tier"` // nil - вознаграждений больше нет
+	// разбивка по кодам, если у пользователя может быть несколько кодов
+	Codes []ReferralCodeStats `json:"codes,omitempty"`
+}
+
+// ErrInsufficientBalance возвращается при списании суммы больше баланса
+var ErrInsufficientBalance = errors.New("недостаточно вознаграждений для списания")
+
+// Списание вознаграждений пользователя
+type Redemption struct {
+	ID           int       `json:"id"`
+	UserID       int       `json:"user_id"`
+	Amount       int64     `json:"amount"`        // отрицательное
+	BalanceAfter int64     `json:"balance_after"` // баланс после списания
+	Note         string    `json:"note"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Баланс пользователя: зачисленные вознаграждения и списания
+const balanceQuery = `
+        SELECT
+            (SELECT COALESCE(SUM(amount), 0) FROM referral_rewards WHERE referrer_id = $1 AND vested_at IS NOT NULL) +
+            (SELECT COALESCE(SUM(amount), 0) FROM reward_redemptions WHERE user_id = $1)`
+
+// creditReferral начисляет рефереру вознаграждение за приглашенного
+// refereeID по ступени, соответствующей номеру реферала. Строка
+// реферера блокируется до конца транзакции, поэтому одновременные
+// регистрации по разным его кодам считаются последовательно.
+// Повторное начисление за того же приглашенного не выполняется.
+func (db *DB) creditReferral(ctx context.Context, tx pgxv4.Tx, referrerID, refereeID int) error {
+	if len(db.rewardTiers) == 0 {
+		return nil
+	}
+	if _, err := tx.Exec(ctx, `SELECT id FROM users WHERE id = $1 FOR UPDATE`, referrerID); err != nil {
+		return err
+	}
+
+	// связь с refereeID уже создана, поэтому счетчик - его номер
+	var n int
+	err := tx.QueryRow(ctx, `SELECT COUNT(*) FROM referral_links WHERE referrer_id = $1`, referrerID).Scan(&n)
+	if err != nil {
+		return err
+	}
+	tier, amount, ok := db.rewardTiers.For(n)
+	if !ok {
+		return nil
+	}
+
+	return db.insertReward(ctx, tx, referrerID, refereeID, tier, amount)
+}
+
+// Реферальная статистика пользователя: число приглашенных, суммы
+// зачисленных и ожидающих вознаграждений и ступень для следующего
+// приглашенного
+func (db *DB) GetReferralStats(ctx context.Context, userID int) (_ ReferralStats, err error) {
+	defer wrapError(&err, "referral stats user=%d", userID)
+	var stats ReferralStats
+	err = db.pool.QueryRow(ctx, `
+        SELECT
+            (SELECT COUNT(*) FROM referral_links WHERE referrer_id = $1),
+            (SELECT COALESCE(SUM(amount) FILTER (WHERE vested_at IS NOT NULL), 0) FROM referral_rewards WHERE referrer_id = $1),
+            (SELECT COALESCE(SUM(amount) FILTER (WHERE vested_at IS NULL AND review_status IS NULL), 0) FROM referral_rewards WHERE referrer_id = $1),
+            (SELECT COALESCE(SUM(amount) FILTER (WHERE review_status = $2), 0) FROM referral_rewards WHERE referrer_id = $1),
+            (SELECT COALESCE(SUM(amount), 0) FROM reward_redemptions WHERE user_id = $1)`, userID, RewardPendingReview).
+		Scan(&stats.Referrals, &stats.RewardTotal, &stats.RewardPending, &stats.RewardHeld, &stats.Balance)
+	if err != nil {
+		return ReferralStats{}, err
+	}
+	stats.Balance += stats.RewardTotal
+	stats.ActiveTier = db.rewardTiers.Active(stats.Referrals)
+	return stats, nil
+}
+
+// Списание amount (больше нуля) с баланса пользователя. Строка
+// пользователя блокируется, как при начислении, поэтому одновременные
+// списания и начисления проверяют баланс последовательно и не уводят
+// его в минус.
+func (db *DB) RedeemReward(ctx context.Context, userID int, amount int64, note string) (_ Redemption, err error) {
+	defer wrapError(&err, "redeem reward user=%d amount=%d", userID, amount)
+	var redemption Redemption
+	err = db.pool.BeginFunc(ctx, func(tx pgxv4.Tx) error {
+		tag, err := tx.Exec(ctx, `SELECT id FROM users WHERE id = $1 FOR UPDATE`, userID)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return ErrNotFound
+		}
+		var balance int64
+		if err := tx.QueryRow(ctx, balanceQuery, userID).Scan(&balance); err != nil {
+			return err
+		}
+		if balance < amount {
+			return ErrInsufficientBalance
+		}
+		return tx.QueryRow(ctx, `
+        INSERT INTO reward_redemptions (user_id, amount, balance_after, note)
+        VALUES ($1, $2, $3, $4)
+        RETURNING id, user_id, amount, balance_after, note, created_at`,
+			userID, -amount, balance-amount, note).
+			Scan(&redemption.ID, &redemption.UserID, &redemption.Amount,
+				&redemption.BalanceAfter, &redemption.Note, &redemption.CreatedAt)
+	})
+	if err != nil {
+		return Redemption{}, err
+	}
+	return redemption, nil
+}
+
+// Списания вознаграждений, новые первыми; userID 0 - всех пользователей
+func (db *DB) ListRedemptions(ctx context.Context, userID, limit, offset int) (_ []Redemption, err error) {
+	defer wrapError(&err, "list redemptions user=%d", userID)
+	rows, err := db.read.Query(ctx, `
+        SELECT id, user_id, amount, balance_after, note, created_at
+        FROM reward_redemptions
+        WHERE $1 = 0 OR user_id = $1
+        ORDER BY id DESC
+        LIMIT $2 OFFSET $3`, userID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	redemptions := []Redemption{}
+	for rows.Next() {
+		var r Redemption
+		if err := rows.Scan(&r.ID, &r.UserID, &r.Amount, &r.BalanceAfter, &r.Note, &r.CreatedAt); err != nil {
+			return nil, err
+		}
+		redemptions = append(redemptions, r)
+	}
+	return redemptions, rows.Err()
+}
@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrSchemaDrift - в базе нет таблиц или колонок, которые использует код.
+// Обычно означает пропущенную миграцию.
+var ErrSchemaDrift = errors.New("схема БД не соответствует коду")
+
+// Таблица и колонки, к которым обращаются запросы хранилища
+type schemaTable struct {
+	name    string
+	columns []string
+}
+
+// requiredSchema - таблицы и колонки, которые ожидает код хранилища.
+// Список сверяется с миграциями тестом: новая колонка в миграции или
+// модели должна быть добавлена и сюда.
+var requiredSchema = []schemaTable{
+	{"users", []string{
+		"id", "username", "email", "password", "created_at", "role",
+		"anonymized_at", "signup_source", "user_agent", "timezone", "signup_ip",
+		"username_flagged_at", "last_login_at", "vanity_link_opt_out",
+	}},
+	{"referral_codes", []string{
+		"id", "user_id", "code", "expires_at", "created_at", "uses", "max_uses",
+		"revoked_at", "status", "reserved_email", "client_token", "metadata", "label",
+		"allowed_domain", "allow_subdomains", "reminded_at",
+	}},
+	{"referral_links", []string{
+		"id", "referrer_id", "referee_id", "created_at", "code", "channel", "click_id", "depth",
+	}},
+	{"referral_clicks", []string{"id", "referral_code_id", "created_at"}},
+	{"referral_codes_archive", []string{
+		"id", "user_id", "code", "expires_at", "created_at", "uses", "max_uses",
+		"revoked_at", "status", "reserved_email", "client_token", "metadata", "label",
+		"allowed_domain", "allow_subdomains", "reminded_at", "clicks", "archived_at",
+	}},
+	{"audit_log", []string{"id", "actor_id", "action", "target_user_id", "payload", "created_at"}},
+	{"referrer_flags", []string{
+		"id", "referrer_id", "score", "reasons", "created_at", "updated_at", "reviewed_at", "resolution",
+	}},
+	{"referral_rewards", []string{
+		"id", "referrer_id", "referee_id", "tier", "amount", "created_at", "vested_at", "review_status",
+	}},
+	{"reward_redemptions", []string{"id", "user_id", "amount", "balance_after", "note", "created_at"}},
+	{"login_events", []string{"id", "user_id", "ip", "user_agent", "success", "created_at"}},
+	{"terms_acceptances", []string{"id", "user_id", "version", "accepted_at", "ip"}},
+	{"api_keys", []string{
+		"id", "name", "prefix", "key_hash", "scopes", "created_by", "created_at", "last_used_at", "revoked_at",
+	}},
+	{"code_creations", []string{"id", "user_id", "created_at"}},
+	{"user_limits", []string{"user_id", "codes_per_day", "invites_per_day", "active_codes", "updated_at"}},
+	{"onboarding_steps", []string{"user_id", "step", "completed_at"}},
+	{"reward_statements", []string{
+		"id", "user_id", "period", "earned", "redeemed", "entries", "claimed_until", "sent_at", "created_at",
+	}},
+	{"magic_link_tokens", []string{"jti", "email", "expires_at", "consumed_at"}},
+	{"action_tokens", []string{"nonce", "user_id", "action", "expires_at", "used_at"}},
+	{"webhook_deliveries", []string{
+		"id", "target", "event", "payload", "status", "attempts", "next_attempt_at",
+		"last_status_code", "last_response", "last_error", "created_at", "updated_at",
+	}},
+	{"registration_queue", []string{
+		"id", "status", "payload", "result", "error_code", "attempts", "next_attempt_at",
+		"created_at", "updated_at",
+	}},
+	{"referral_disputes", []string{
+		"id", "filed_by", "referrer_id", "referee_id", "code", "message", "status",
+		"resolution", "resolution_note", "resolved_by", "resolved_at", "created_at",
+	}},
+}
+
+// VerifySchema проверяет, что в текущей схеме БД есть все таблицы и
+// колонки из requiredSchema. Ошибка оборачивает ErrSchemaDrift и
+// перечисляет все недостающие объекты.
+func (db *DB) VerifySchema(ctx context.Context) (err error) {
+	defer wrapError(&err, "verify schema")
+	tables := make([]string, len(requiredSchema))
+	for i, t := range requiredSchema {
+		tables[i] = t.name
+	}
+
+	rows, err := db.pool.Query(ctx, `
+        SELECT table_name, column_name FROM information_schema.columns
+        WHERE table_schema = current_schema() AND table_name = ANY($1)`, tables)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	present := make(map[string]map[string]bool)
+	for rows.Next() {
+		var table, column string
+		if err := rows.Scan(&table, &column); err != nil {
+			return err
+		}
+		if present[table] == nil {
+			present[table] = make(map[string]bool)
+		}
+		present[table][column] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if missing := missingSchema(requiredSchema, present); len(missing) > 0 {
+		return fmt.Errorf("%w: отсутствуют %s", ErrSchemaDrift, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// missingSchema возвращает недостающие объекты в порядке required:
+// "таблица name" для отсутствующей таблицы и "table.column" для колонки.
+func missingSchema(required []schemaTable, present map[string]map[string]bool) []string {
+	var missing []string
+	for _, t := range required {
+		columns, ok := present[t.name]
+		if !ok {
+			missing = append(missing, "таблица "+t.name)
+			continue
+		}
+		for _, c := range t.columns {
+			if !columns[c] {
+				missing = append(missing, t.name+"."+c)
+			}
+		}
+	}
+	return missing
+}
@@ -0,0 +1,175 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Каталог миграций относительно пакета
+const migrationsDir = "../../migrations"
+
+var (
+	createTableRe = regexp.MustCompile(`(?is)^CREATE TABLE (?:IF NOT EXISTS )?(\w+)\s*\((.*)\)$`)
+	addColumnRe   = regexp.MustCompile(`(?i)^ALTER TABLE (\w+) ADD COLUMN (?:IF NOT EXISTS )?(\w+)`)
+	dropColumnRe  = regexp.MustCompile(`(?i)^ALTER TABLE (\w+) DROP COLUMN (?:IF EXISTS )?(\w+)`)
+	dropTableRe   = regexp.MustCompile(`(?i)^DROP TABLE (?:IF EXISTS )?(\w+)`)
+	renameRe      = regexp.MustCompile(`(?i)^ALTER TABLE \w+ RENAME`)
+	constraintRe  = regexp.MustCompile(`(?i)^(PRIMARY|UNIQUE|CONSTRAINT|FOREIGN|CHECK)\b`)
+)
+
+// migratedSchema применяет секции Up всех миграций по порядку и
+// возвращает итоговые таблицы и колонки.
+func migratedSchema(t *testing.T) map[string]map[string]bool {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(migrationsDir, "*.sql"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("migrations not found in %s: %v", migrationsDir, err)
+	}
+	sort.Strings(files)
+
+	schema := make(map[string]map[string]bool)
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		up, _, _ := strings.Cut(string(b), "-- +goose Down")
+		for _, stmt := range splitStatements(up) {
+			switch {
+			case createTableRe.MatchString(stmt):
+				m := createTableRe.FindStringSubmatch(stmt)
+				columns := make(map[string]bool)
+				for _, def := range splitTopLevel(m[2]) {
+					if !constraintRe.MatchString(def) {
+						columns[strings.Fields(def)[0]] = true
+					}
+				}
+				schema[m[1]] = columns
+			case addColumnRe.MatchString(stmt):
+				m := addColumnRe.FindStringSubmatch(stmt)
+				schema[m[1]][m[2]] = true
+			case dropColumnRe.MatchString(stmt):
+				m := dropColumnRe.FindStringSubmatch(stmt)
+				delete(schema[m[1]], m[2])
+			case dropTableRe.MatchString(stmt):
+				delete(schema, dropTableRe.FindStringSubmatch(stmt)[1])
+			case renameRe.MatchString(stmt):
+				t.Fatalf("%s: renames are not supported by the schema check, update migratedSchema", filepath.Base(f))
+			}
+		}
+	}
+	return schema
+}
+
+// splitStatements делит SQL на операторы без комментариев
+func splitStatements(sql string) []string {
+	var b strings.Builder
+	for _, line := range strings.Split(sql, "\n") {
+		line, _, _ = strings.Cut(line, "--")
+		b.WriteString(line + "\n")
+	}
+	var stmts []string
+	for _, s := range strings.Split(b.String(), ";") {
+		if s = strings.TrimSpace(s); s != "" {
+			stmts = append(stmts, s)
+		}
+	}
+	return stmts
+}
+
+// splitTopLevel делит определение таблицы по запятым вне скобок
+func splitTopLevel(s string) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i, r := range s {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, strings.TrimSpace(s[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, strings.TrimSpace(s[start:]))
+}
+
+// Список requiredSchema должен совпадать со схемой после миграций:
+// недостающая в миграциях колонка сломает запуск, а не внесенная в
+// список останется без проверки.
+func TestRequiredSchema_MatchesMigrations(t *testing.T) {
+	migrated := migratedSchema(t)
+
+	if missing := missingSchema(requiredSchema, migrated); len(missing) > 0 {
+		t.Errorf("requiredSchema lists objects not created by migrations: %v", missing)
+	}
+
+	required := make(map[string]map[string]bool)
+	for _, table := range requiredSchema {
+		required[table.name] = make(map[string]bool)
+		for _, c := range table.columns {
+			required[table.name][c] = true
+		}
+	}
+	var unlisted []string
+	for table, columns := range migrated {
+		if _, ok := required[table]; !ok {
+			unlisted = append(unlisted, "таблица "+table)
+			continue
+		}
+		for c := range columns {
+			if !required[table][c] {
+				unlisted = append(unlisted, table+"."+c)
+			}
+		}
+	}
+	if len(unlisted) > 0 {
+		sort.Strings(unlisted)
+		t.Errorf("migrations create objects missing from requiredSchema: %v", unlisted)
+	}
+}
+
+func TestMissingSchema(t *testing.T) {
+	required := []schemaTable{
+		{"users", []string{"id", "timezone"}},
+		{"referrer_flags", []string{"id"}},
+	}
+
+	tests := []struct {
+		name    string
+		present map[string]map[string]bool
+		want    []string
+	}{
+		{
+			"Complete",
+			map[string]map[string]bool{"users": {"id": true, "timezone": true, "extra": true}, "referrer_flags": {"id": true}},
+			nil,
+		},
+		{
+			"Missing column",
+			map[string]map[string]bool{"users": {"id": true}, "referrer_flags": {"id": true}},
+			[]string{"users.timezone"},
+		},
+		{
+			"Missing table",
+			map[string]map[string]bool{"users": {"id": true, "timezone": true}},
+			[]string{"таблица referrer_flags"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := missingSchema(required, tt.present); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("missingSchema() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
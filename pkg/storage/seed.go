@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	pgxv4 "github.com/jackc/pgx/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Профили тестовых данных, см. SeedProfile
+const (
+	SeedMinimal = "minimal" // администратор и реферер с одним рефералом
+	SeedDemo    = "demo"    // несколько рефереров, переходы и рефералы по разным каналам
+)
+
+// Пароль всех пользователей тестовых данных
+const SeedPassword = "gorefer-demo"
+
+// Срок действия кодов тестовых данных: фиксированная дата, чтобы
+// повторная загрузка давала те же данные
+var SeedCodeExpiresAt = time.Date(2099, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// Ключ рекомендательной блокировки, сериализующей одновременные загрузки
+const seedLockID = 7_204_519
+
+// ErrUnknownSeedProfile возвращается для профиля тестовых данных, которого
+// нет среди SeedMinimal и SeedDemo
+var ErrUnknownSeedProfile = errors.New("неизвестный профиль тестовых данных")
+
+// Пользователь тестовых данных
+type SeedUser struct {
+	Username string
+	Email    string
+	Role     string // пустая - RoleUser
+	Code     string // реферальный код пользователя; пустой - без кода
+	Clicks   int    // число переходов по Code
+	Referrer string // код, по которому пользователь зарегистрирован; пустой - без реферера
+	Channel  string // канал атрибуции; пустой - ChannelManualCode
+}
+
+// Тестовые данные профиля. Реферер всегда предшествует своим рефералам.
+type SeedData struct {
+	Users []SeedUser
+}
+
+// SeedProfile возвращает тестовые данные профиля. Данные одинаковы при
+// каждом вызове, поэтому хранилище в памяти и БД заполняются одинаково.
+func SeedProfile(profile string) (SeedData, error) {
+	minimal := []SeedUser{
+		{Username: "demo_admin", Email: "admin@demo.gorefer.test", Role: RoleAdmin},
+		{Username: "alice", Email: "alice@demo.gorefer.test", Code: "ALICE2026", Clicks: 3},
+		{Username: "bob", Email: "bob@demo.gorefer.test", Referrer: "ALICE2026"},
+	}
+	switch profile {
+	case SeedMinimal:
+		return SeedData{Users: minimal}, nil
+	case SeedDemo:
+		users := append([]SeedUser(nil), minimal...)
+		users[1].Clicks = 12
+		users[2].Code = "BOB2026"
+		users[2].Clicks = 4
+		users = append(users,
+			SeedUser{Username: "carol", Email: "carol@demo.gorefer.test", Referrer: "ALICE2026", Channel: ChannelLinkClick},
+			SeedUser{Username: "dave", Email: "dave@demo.gorefer.test", Referrer: "ALICE2026", Channel: ChannelLinkClick},
+			SeedUser{Username: "erin", Email: "erin@demo.gorefer.test", Code: "ERIN2026", Referrer: "BOB2026"},
+			SeedUser{Username: "frank", Email: "frank@demo.gorefer.test", Referrer: "BOB2026", Channel: ChannelLinkClick},
+			SeedUser{Username: "grace", Email: "grace@demo.gorefer.test"},
+		)
+		return SeedData{Users: users}, nil
+	}
+	return SeedData{}, fmt.Errorf("%w: %q", ErrUnknownSeedProfile, profile)
+}
+
+// Seed загружает тестовые данные профиля. Пользователь, email которого
+// уже есть в БД, вместе с его кодом, переходами и реферальной связью
+// пропускается, поэтому повторная загрузка ничего не меняет. Загрузка
+// выполняется в одной транзакции; вознаграждения начисляются по
+// ступеням хранилища, как при обычной регистрации.
+func (db *DB) Seed(ctx context.Context, profile string) (err error) {
+	defer wrapError(&err, "seed profile=%s", profile)
+	data, err := SeedProfile(profile)
+	if err != nil {
+		return err
+	}
+	password, err := bcrypt.GenerateFromPassword([]byte(SeedPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	return db.pool.BeginFunc(ctx, func(tx pgxv4.Tx) error {
+		if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, seedLockID); err != nil {
+			return err
+		}
+		for _, u := range data.Users {
+			if err := db.seedUser(ctx, tx, u, string(password)); err != nil {
+				return fmt.Errorf("%s: %w", u.Username, err)
+			}
+		}
+		return nil
+	})
+}
+
+// seedUser создает пользователя тестовых данных, если его еще нет.
+func (db *DB) seedUser(ctx context.Context, tx pgxv4.Tx, u SeedUser, password string) error {
+	role := u.Role
+	if role == "" {
+		role = RoleUser
+	}
+	var userID int
+	err := tx.QueryRow(ctx, `
+        INSERT INTO users (username, email, password, role, signup_source)
+        VALUES ($1, $2, $3, $4, $5)
+        ON CONFLICT (email) DO NOTHING
+        RETURNING id`,
+		u.Username, u.Email, password, role, SourceWeb).
+		Scan(&userID)
+	if errors.Is(err, pgxv4.ErrNoRows) {
+		return nil // загружен ранее
+	}
+	if isUniqueViolation(err, usernameUniqueConstraint) {
+		return ErrUsernameTaken
+	}
+	if err != nil {
+		return err
+	}
+
+	if u.Code != "" {
+		var codeID int
+		err := tx.QueryRow(ctx, `
+        INSERT INTO referral_codes (user_id, code, expires_at)
+        VALUES ($1, $2, $3)
+        RETURNING id`, userID, u.Code, SeedCodeExpiresAt).
+			Scan(&codeID)
+		if isUniqueViolation(err, codeUniqueConstraint) {
+			return ErrCodeTaken
+		}
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `
+        INSERT INTO referral_clicks (referral_code_id)
+        SELECT $1 FROM generate_series(1, $2)`, codeID, u.Clicks)
+		if err != nil {
+			return err
+		}
+	}
+
+	if u.Referrer == "" {
+		return nil
+	}
+	var referrerID int
+	err = tx.QueryRow(ctx, `
+        UPDATE referral_codes SET uses = uses + 1
+        WHERE code = $1
+        RETURNING user_id`, u.Referrer).
+		Scan(&referrerID)
+	if errors.Is(err, pgxv4.ErrNoRows) {
+		return ErrCodeInvalid
+	}
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `
+        INSERT INTO referral_links (referrer_id, referee_id, code, channel)
+        VALUES ($1, $2, $3, $4)`,
+		referrerID, userID, u.Referrer, CreateUserParams{Channel: u.Channel}.channel())
+	if err != nil {
+		return err
+	}
+	return db.creditReferral(ctx, tx, referrerID, userID)
+}
@@ -0,0 +1,203 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	pgxv4 "github.com/jackc/pgx/v4"
+)
+
+// Формат месяца выписки, например 2026-09
+const StatementPeriodLayout = "2006-01"
+
+// Типы операций выписки
+const (
+	EntryReward     = "reward"     // зачисленное вознаграждение за приглашенного
+	EntryRedemption = "redemption" // списание
+)
+
+// Выписка по вознаграждениям пользователя за месяц
+type RewardStatement struct {
+	ID        int        `json:"id"`
+	UserID    int        `json:"-"`
+	Period    string     `json:"period"` // месяц в формате StatementPeriodLayout
+	Earned    int64      `json:"earned"`
+	Redeemed  int64      `json:"redeemed"` // сумма списаний, положительная
+	Entries   int        `json:"entries"`
+	SentAt    *time.Time `json:"sent_at"` // nil - письмо еще не отправлено
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// Выписка, выбранная для отправки, с адресатом
+type ClaimedStatement struct {
+	RewardStatement
+	Username string
+	Email    string
+	Timezone string // часовой пояс адресата для дат операций
+}
+
+// Операция выписки
+type LedgerEntry struct {
+	At      time.Time `json:"at"`
+	Type    string    `json:"type"`
+	Amount  int64     `json:"amount"`  // списания отрицательные
+	Details string    `json:"details"` // имя приглашенного или комментарий к списанию
+}
+
+// StatementPeriod возвращает месяц выписки, в который попадает t: первое
+// число месяца по UTC.
+func StatementPeriod(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// Создание выписок за месяц period всем пользователям с операциями в этом
+// месяце, кроме обезличенных. Уже созданные выписки не меняются, поэтому
+// повторный вызов безопасен. Возвращает число созданных выписок.
+func (db *DB) GenerateStatements(ctx context.Context, period time.Time) (_ int, err error) {
+	period = StatementPeriod(period)
+	defer wrapError(&err, "generate reward statements period=%s", period.Format(StatementPeriodLayout))
+	tag, err := db.pool.Exec(ctx, `
+        INSERT INTO reward_statements (user_id, period, earned, redeemed, entries)
+        SELECT e.user_id, $3::date, SUM(e.earned), SUM(e.redeemed), COUNT(*)
+        FROM (
+            SELECT referrer_id AS user_id, amount AS earned, 0::bigint AS redeemed
+            FROM referral_rewards WHERE vested_at >= $1 AND vested_at < $2
+            UNION ALL
+            SELECT user_id, 0, -amount
+            FROM reward_redemptions WHERE created_at >= $1 AND created_at < $2
+        ) e
+        JOIN users u ON u.id = e.user_id
+        WHERE u.anonymized_at IS NULL
+        GROUP BY e.user_id
+        ON CONFLICT (user_id, period) DO NOTHING`,
+		period, period.AddDate(0, 1, 0), period.Format("2006-01-02"))
+	if err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+// Выбор неотправленных выписок. Выбранные выписки закрепляются за
+// вызывающим на lease, чтобы другие экземпляры сервиса их не отправили;
+// если отправка прервется, по истечении lease выписка будет выбрана снова.
+func (db *DB) ClaimStatements(ctx context.Context, limit int, lease time.Duration) (_ []ClaimedStatement, err error) {
+	defer wrapError(&err, "claim reward statements")
+	rows, err := db.pool.Query(ctx, `
+        UPDATE reward_statements rs SET claimed_until = NOW() + make_interval(secs => $2)
+        FROM users u
+        WHERE u.id = rs.user_id AND rs.id IN (
+            SELECT s.id FROM reward_statements s
+            JOIN users su ON su.id = s.user_id
+            WHERE s.sent_at IS NULL AND (s.claimed_until IS NULL OR s.claimed_until <= NOW())
+                AND su.anonymized_at IS NULL
+            ORDER BY s.id
+            LIMIT $1
+            FOR UPDATE OF s SKIP LOCKED
+        )
+        RETURNING rs.id, rs.user_id, rs.period, rs.earned, rs.redeemed, rs.entries, rs.sent_at, rs.created_at,
+            u.username, u.email, u.timezone`, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	statements := []ClaimedStatement{}
+	for rows.Next() {
+		var s ClaimedStatement
+		var period time.Time
+		if err := rows.Scan(&s.ID, &s.UserID, &period, &s.Earned, &s.Redeemed, &s.Entries, &s.SentAt, &s.CreatedAt,
+			&s.Username, &s.Email, &s.Timezone); err != nil {
+			return nil, err
+		}
+		s.Period = period.Format(StatementPeriodLayout)
+		statements = append(statements, s)
+	}
+	return statements, rows.Err()
+}
+
+// Отметка об отправке письма с выпиской
+func (db *DB) MarkStatementSent(ctx context.Context, id int) (err error) {
+	defer wrapError(&err, "mark reward statement id=%d sent", id)
+	_, err = db.pool.Exec(ctx, `UPDATE reward_statements SET sent_at = NOW(), claimed_until = NULL WHERE id = $1`, id)
+	return err
+}
+
+// Снятие закрепления выписки, письмо с которой не отправлено, чтобы она
+// была выбрана снова
+func (db *DB) ReleaseStatement(ctx context.Context, id int) (err error) {
+	defer wrapError(&err, "release reward statement id=%d", id)
+	_, err = db.pool.Exec(ctx, `UPDATE reward_statements SET claimed_until = NULL WHERE id = $1 AND sent_at IS NULL`, id)
+	return err
+}
+
+// Выписки пользователя, начиная с последней
+func (db *DB) ListRewardStatements(ctx context.Context, userID int) (_ []RewardStatement, err error) {
+	defer wrapError(&err, "list reward statements user=%d", userID)
+	rows, err := db.read.Query(ctx, `
+        SELECT id, user_id, period, earned, redeemed, entries, sent_at, created_at
+        FROM reward_statements WHERE user_id = $1
+        ORDER BY period DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	statements := []RewardStatement{}
+	for rows.Next() {
+		s, err := scanRewardStatement(rows)
+		if err != nil {
+			return nil, err
+		}
+		statements = append(statements, s)
+	}
+	return statements, rows.Err()
+}
+
+// Выписка пользователя за месяц period; ErrNotFound, если ее нет
+func (db *DB) GetRewardStatement(ctx context.Context, userID int, period time.Time) (_ RewardStatement, err error) {
+	period = StatementPeriod(period)
+	defer wrapError(&err, "get reward statement user=%d period=%s", userID, period.Format(StatementPeriodLayout))
+	s, err := scanRewardStatement(db.read.QueryRow(ctx, `
+        SELECT id, user_id, period, earned, redeemed, entries, sent_at, created_at
+        FROM reward_statements WHERE user_id = $1 AND period = $2::date`, userID, period.Format("2006-01-02")))
+	if errors.Is(err, pgxv4.ErrNoRows) {
+		return RewardStatement{}, ErrNotFound
+	}
+	return s, err
+}
+
+func scanRewardStatement(row pgxv4.Row) (RewardStatement, error) {
+	var s RewardStatement
+	var period time.Time
+	err := row.Scan(&s.ID, &s.UserID, &period, &s.Earned, &s.Redeemed, &s.Entries, &s.SentAt, &s.CreatedAt)
+	s.Period = period.Format(StatementPeriodLayout)
+	return s, err
+}
+
+// Операции пользователя за месяц period по времени
+func (db *DB) ListLedgerEntries(ctx context.Context, userID int, period time.Time) (_ []LedgerEntry, err error) {
+	period = StatementPeriod(period)
+	defer wrapError(&err, "list ledger entries user=%d period=%s", userID, period.Format(StatementPeriodLayout))
+	rows, err := db.read.Query(ctx, `
+        SELECT rr.vested_at, $4::text, rr.amount, u.username
+        FROM referral_rewards rr JOIN users u ON u.id = rr.referee_id
+        WHERE rr.referrer_id = $1 AND rr.vested_at >= $2 AND rr.vested_at < $3
+        UNION ALL
+        SELECT created_at, $5::text, amount, note
+        FROM reward_redemptions
+        WHERE user_id = $1 AND created_at >= $2 AND created_at < $3
+        ORDER BY 1, 2`, userID, period, period.AddDate(0, 1, 0), EntryReward, EntryRedemption)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := []LedgerEntry{}
+	for rows.Next() {
+		var e LedgerEntry
+		if err := rows.Scan(&e.At, &e.Type, &e.Amount, &e.Details); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
@@ -3,25 +3,312 @@ package storage
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
+	"net"
+	"strings"
 	"time"
 
-	"github.com/jackc/pgx"
+	"github.com/jackc/pgconn"
+	pgxv4 "github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
+	"golang.org/x/crypto/bcrypt"
+
+	"gorefer.go/pkg/onboarding"
+	"gorefer.go/pkg/rewards"
 )
 
-// Интерфейс для работы с базой данных
-type DBInterface interface {
-	CreateUser(ctx context.Context, user User) (int, error)
+// Роли пользователей
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// Каналы атрибуции реферала
+const (
+	ChannelManualCode = "manual_code" // код введен при регистрации
+	ChannelLinkClick  = "link_click"  // код сохранен при переходе по ссылке /r/{code}
+)
+
+// Состояния реферального кода
+const (
+	CodeStatusActive   = "active"
+	CodeStatusReserved = "reserved"
+)
+
+// Платформы, с которых выполняется регистрация
+const (
+	SourceIOS     = "ios"
+	SourceAndroid = "android"
+	SourceWeb     = "web"
+	SourceUnknown = "unknown"
+)
+
+// NormalizeSource приводит платформу регистрации к одному из известных
+// значений. Пустые и неизвестные значения становятся SourceUnknown.
+func NormalizeSource(source string) string {
+	switch source = strings.ToLower(strings.TrimSpace(source)); source {
+	case SourceIOS, SourceAndroid, SourceWeb:
+		return source
+	}
+	return SourceUnknown
+}
+
+// Максимальная длина сохраняемого User-Agent
+const maxUserAgentLen = 512
+
+// Окно, в течение которого повторная регистрация по реферальному коду
+// достраивает реферальную связь уже созданного пользователя
+const registrationRetryWindow = 10 * time.Minute
+
+// ErrNotFound возвращается, когда запрошенная запись отсутствует
+var ErrNotFound = errors.New("запись не найдена")
+
+// ErrAlreadyAnonymized возвращается при повторной анонимизации пользователя
+var ErrAlreadyAnonymized = errors.New("пользователь уже анонимизирован")
+
+// ErrCodeTaken возвращается, если реферальный код уже существует
+var ErrCodeTaken = errors.New("реферальный код уже занят")
+
+// ErrEmailTaken возвращается при регистрации с уже зарегистрированным
+// email, а также при резервировании кода для email, который уже
+// зарегистрирован или для которого код уже зарезервирован
+var ErrEmailTaken = errors.New("email уже используется")
+
+// ErrUsernameTaken возвращается при регистрации или смене имени на имя,
+// которое уже занято с точностью до регистра
+var ErrUsernameTaken = errors.New("имя пользователя уже занято")
+
+// ErrClientTokenUsed возвращается при повторном создании кода с тем же
+// токеном клиента: код уже создан и ротация не выполняется
+var ErrClientTokenUsed = errors.New("код с этим токеном клиента уже создан")
+
+// ErrCodeLimit возвращается при создании кода сверх допустимого числа
+// активных кодов пользователя
+var ErrCodeLimit = errors.New("достигнут предел активных реферальных кодов")
+
+// ErrTokenUsed возвращается при повторном использовании одноразовой
+// ссылки входа или ссылки действия из письма
+var ErrTokenUsed = errors.New("одноразовая ссылка уже использована")
+
+// ErrCodeInvalid возвращается при регистрации по коду, который не
+// существует, истек, отозван, исчерпал лимит использований или владелец
+// которого не принял текущие условия программы
+var ErrCodeInvalid = errors.New("реферальный код недействителен")
+
+// Код ошибки PostgreSQL при нарушении уникальности
+const uniqueViolation = "23505"
+
+// Ограничение уникальности значения реферального кода
+const codeUniqueConstraint = "referral_codes_code_key"
+
+// Ограничение уникальности email пользователя без учета регистра.
+// Одновременные регистрации с одним email разрешает только оно:
+// предварительные проверки не видят незавершенных транзакций.
+const emailUniqueConstraint = "users_email_lower_key"
+
+// Ограничение уникальности имени пользователя без учета регистра
+const usernameUniqueConstraint = "users_username_lower_key"
+
+// isUniqueViolation сообщает, нарушено ли ограничение уникальности name
+func isUniqueViolation(err error, name string) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == uniqueViolation && pgErr.ConstraintName == name
+}
+
+// Действия, записываемые в журнал аудита
+const (
+	AuditUserAnonymized   = "user.anonymized"
+	AuditUserImpersonated = "user.impersonated"
+	AuditCodeDeleted      = "referral_code.deleted"
+	AuditCodeTransferred  = "referral_code.transferred"
+	AuditAPIKeyCreated    = "api_key.created"
+	AuditAPIKeyRevoked    = "api_key.revoked"
+	AuditUserLimitsSet    = "user.limits_set"
+	AuditDisputeResolved  = "referral_dispute.resolved"
+	AuditFlagReviewed     = "referrer_flag.reviewed"
+)
+
+// Хранилище пользователей
+type UserStore interface {
+	CreateUser(ctx context.Context, params CreateUserParams) (int, error)
 	GetUserByEmail(ctx context.Context, email string) (User, error)
-	CreateReferralCode(ctx context.Context, userID int, code string, expiresAt int64) error
+	GetUserByID(ctx context.Context, id int) (User, error)
+	EmailExists(ctx context.Context, email string) (bool, error)
+	SetTimezone(ctx context.Context, userID int, timezone string) error
+	SetUsername(ctx context.Context, userID int, username string) error
+	SetVanityLinkOptOut(ctx context.Context, userID int, optOut bool) error
+	UpdateProfile(ctx context.Context, userID int, u ProfileUpdate) error
+	GetProfile(ctx context.Context, userID int) (Profile, error)
+	RecordLogin(ctx context.Context, e LoginEvent) error
+	ListLoginEvents(ctx context.Context, userID, limit, offset int) ([]LoginEvent, error)
+	AnonymizeUser(ctx context.Context, userID, actorID int) error
+	ExportUserData(ctx context.Context, userID int) (UserExport, error)
+}
+
+// Хранилище реферальных кодов
+type ReferralCodeStore interface {
+	CreateReferralCode(ctx context.Context, userID int, code string, expiresAt int64, clientToken string, metadata json.RawMessage, domain DomainRestriction) error
+	UpdateReferralCode(ctx context.Context, userID int, u ReferralCodeUpdate) error
+	ListReferralCodes(ctx context.Context, filter ReferralCodeFilter, limit, offset int) ([]ReferralCode, error)
 	DeleteReferralCode(ctx context.Context, userID int) error
+	DeleteReferralCodeByCode(ctx context.Context, code string, actorID int) (DeletedReferralCode, error)
+	TransferReferralCode(ctx context.Context, code string, newOwnerID int, includeHistory bool, actorID int) (CodeTransfer, error)
 	GetReferralCodeByEmail(ctx context.Context, email string) (ReferralCode, error)
-	GetReferralsByReferrerID(ctx context.Context, referrerID int) ([]User, error)
-	RegisterWithReferralCode(ctx context.Context, referralCode string, user User) error
+	GetActiveReferralCodeByUsername(ctx context.Context, username string) (ReferralCode, error)
+	GetReferralCodeByUserID(ctx context.Context, userID int) (ReferralCode, error)
+	GetReferralCodeByClientToken(ctx context.Context, userID int, clientToken string) (ReferralCode, error)
+	GetReferralCodeDetails(ctx context.Context, code string) (ReferralCodeDetails, error)
+	ReserveReferralCode(ctx context.Context, email, code string, expiresAt int64, domain DomainRestriction) error
+	AddReferralCode(ctx context.Context, c NewReferralCode, limit int) error
+	ListUserReferralCodes(ctx context.Context, userID int) ([]ReferralCode, error)
+	GetCodeStats(ctx context.Context, userID int, includeArchived bool) ([]ReferralCodeStats, error)
+	CompareReferralCodes(ctx context.Context, userID int, includeArchived bool) ([]CodeComparison, error)
+}
+
+// Хранилище рефералов: регистрации по кодам и отчеты по ним
+type ReferralStore interface {
+	RegisterWithReferralCode(ctx context.Context, referralCode string, params CreateUserParams) (ReferralRegistration, error)
+	RecordClick(ctx context.Context, code string) (int, error)
+	GetReferralsByReferrerID(ctx context.Context, referrerID, limit, offset int) ([]ReferralSummary, error)
+	GetProgramReport(ctx context.Context, from, to time.Time) (ProgramReport, error)
+	GetCohortStats(ctx context.Context, from, to time.Time) ([]CohortStat, error)
+}
+
+// Журнал аудита
+type AuditStore interface {
+	RecordAudit(ctx context.Context, actorID int, action string, targetUserID int, payload interface{}) error
+}
+
+// Хранилище данных для выявления подозрительной активности
+type FraudStore interface {
+	GetReferrerActivity(ctx context.Context, since time.Time) ([]ReferrerActivity, error)
+	FlagReferrer(ctx context.Context, flag ReferrerFlag) error
+	ListReferrerFlags(ctx context.Context) ([]ReferrerFlag, error)
+	ReviewReferrerFlag(ctx context.Context, id int, resolution string, actorID int) (ReferrerFlag, error)
+}
+
+// Хранилище использованных одноразовых ссылок входа и действий
+type TokenStore interface {
+	ConsumeMagicLinkToken(ctx context.Context, jti, email string, expiresAt time.Time) error
+	ConsumeActionToken(ctx context.Context, nonce string, userID int, action string, expiresAt time.Time) error
+}
+
+// Хранилище вознаграждений рефереров
+type RewardStore interface {
+	GetReferralStats(ctx context.Context, userID int) (ReferralStats, error)
+	RedeemReward(ctx context.Context, userID int, amount int64, note string) (Redemption, error)
+	ListRedemptions(ctx context.Context, userID, limit, offset int) ([]Redemption, error)
+}
+
+// Обслуживание данных
+type MaintenanceStore interface {
+	ConsistencyCheck(ctx context.Context, fix bool) (ConsistencyReport, error)
+}
+
+// Сводные показатели для панели администратора
+type OverviewStore interface {
+	CountSignups(ctx context.Context, since time.Time) (int, error)
+	CountActiveCodes(ctx context.Context) (int, error)
+}
+
+// Очередь доставки событий внешним получателям
+type WebhookStore interface {
+	EnqueueWebhook(ctx context.Context, event string, payload json.RawMessage, targets []string) error
+	ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]WebhookDelivery, error)
+	GetWebhookDelivery(ctx context.Context, id int) (WebhookDelivery, error)
+	RecordWebhookAttempt(ctx context.Context, id int, attempt WebhookAttempt) (WebhookDelivery, error)
+	ListWebhookDeliveries(ctx context.Context, filter WebhookDeliveryFilter, limit, offset int) ([]WebhookDelivery, error)
+	WebhookStats(ctx context.Context) ([]WebhookTargetStats, error)
+}
+
+// Очередь регистраций при пиковой нагрузке
+type RegistrationQueueStore interface {
+	EnqueueRegistration(ctx context.Context, id string, payload json.RawMessage, maxPending int) error
+	ClaimRegistrations(ctx context.Context, limit int, lease time.Duration) ([]QueuedRegistration, error)
+	FinishRegistration(ctx context.Context, id, status string, result json.RawMessage, errorCode string) error
+	GetQueuedRegistration(ctx context.Context, id string) (QueuedRegistration, error)
+	PurgeRegistrations(ctx context.Context, before time.Time, limit int) (int, error)
+}
+
+// Хранилище споров об атрибуции рефералов
+type DisputeStore interface {
+	FileDispute(ctx context.Context, nd NewDispute) (ReferralDispute, error)
+	ListDisputes(ctx context.Context, filter DisputeFilter, limit, offset int) ([]ReferralDispute, error)
+	ResolveDispute(ctx context.Context, id int, action, note string, actorID int) (ReferralDispute, error)
+}
+
+// Интерфейс для работы с базой данных
+type DBInterface interface {
+	UserStore
+	ReferralCodeStore
+	ReferralStore
+	AuditStore
+	FraudStore
+	RewardStore
+	TokenStore
+	MaintenanceStore
+	OverviewStore
+	WebhookStore
+	TermsStore
+	ReminderStore
+	APIKeyStore
+	QuotaStore
+	StatementStore
+	RetentionStore
+	RegistrationQueueStore
+	DisputeStore
+}
+
+// Хранилище квот пользователей
+type QuotaStore interface {
+	GetQuotaUsage(ctx context.Context, userID int, since time.Time) (QuotaUsage, error)
+	GetUserLimits(ctx context.Context, userID int) (UserLimits, error)
+	SetUserLimits(ctx context.Context, userID int, limits UserLimits, actorID int) (UserLimits, error)
+}
+
+// Хранилище ключей API
+type APIKeyStore interface {
+	CreateAPIKey(ctx context.Context, k NewAPIKey) (APIKey, error)
+	UseAPIKey(ctx context.Context, keyHash string) (APIKey, error)
+	ListAPIKeys(ctx context.Context) ([]APIKey, error)
+	RevokeAPIKey(ctx context.Context, id, actorID int) error
 }
 
+// Хранилище напоминаний об истечении срока кодов
+type ReminderStore interface {
+	ClaimExpiringCodes(ctx context.Context, until time.Time, limit int) ([]ExpiringCode, error)
+	ReleaseExpiringCode(ctx context.Context, codeID int) error
+}
+
+// Хранилище для очистки устаревших персональных данных
+type RetentionStore interface {
+	ScrubPersonalData(ctx context.Context, target string, before time.Time, limit int) (int, error)
+	PurgeCodeArchive(ctx context.Context, before time.Time, limit int) (int, error)
+	PurgeWebhookDeliveries(ctx context.Context, before time.Time, limit int) (int, error)
+}
+
+// Хранилище ежемесячных выписок по вознаграждениям
+type StatementStore interface {
+	GenerateStatements(ctx context.Context, period time.Time) (int, error)
+	ClaimStatements(ctx context.Context, limit int, lease time.Duration) ([]ClaimedStatement, error)
+	MarkStatementSent(ctx context.Context, id int) error
+	ReleaseStatement(ctx context.Context, id int) error
+	ListRewardStatements(ctx context.Context, userID int) ([]RewardStatement, error)
+	GetRewardStatement(ctx context.Context, userID int, period time.Time) (RewardStatement, error)
+	ListLedgerEntries(ctx context.Context, userID int, period time.Time) ([]LedgerEntry, error)
+}
+
+// Хранилище принятий условий реферальной программы
+type TermsStore interface {
+	AcceptTerms(ctx context.Context, userID int, version, ip string) (TermsAcceptance, error)
+	TermsAccepted(ctx context.Context, userID int, version string) (bool, error)
+}
+
+var _ DBInterface = (*DB)(nil)
+
 // Конфигурация БД
 type DBConfig struct {
 	Host     string `json:"host"`
@@ -30,11 +317,48 @@ type DBConfig struct {
 	DBName   string `json:"dbname"`
 	Port     int    `json:"port"`
 	SSLMode  string `json:"sslmode"`
+	// строка подключения к реплике для чтения отчетов и списков; пусто -
+	// все запросы идут в основную БД
+	ReadReplica string `json:"read_replica"`
 }
 
 // База данных
 type DB struct {
 	pool *pgxpool.Pool
+	// реплика для чтения, см. WithReadReplica; nil - реплики нет
+	replica        *pgxpool.Pool
+	replicaConnstr string
+	// пул для запросов, допускающих чтение с реплики, см. replica.go
+	read querier
+
+	// beforeReferralLink вызывается перед созданием реферальной связи;
+	// ошибка прерывает регистрацию. Используется тестами для внедрения сбоев.
+	beforeReferralLink func() error
+
+	// ступени вознаграждения рефереров, см. WithRewardTiers
+	rewardTiers rewards.Tiers
+	// шаги, после которых зачисляется вознаграждение, см. WithOnboarding
+	onboarding onboarding.Rules
+
+	// ограничения глубины реферальных цепочек, см. WithChainDepth
+	chainDepth ChainDepth
+	// версия условий программы, которую должен принять реферер, см.
+	// WithTermsVersion
+	termsVersion string
+	// наибольший срок действия кода, см. WithMaxCodeLifetime
+	codeLifetime time.Duration
+}
+
+// Option - параметр хранилища
+type Option func(*DB)
+
+// WithRewardTiers задает ступени вознаграждения, по которым начисляется
+// награда рефереру при регистрации по его коду. Без ступеней награды
+// не начисляются.
+func WithRewardTiers(tiers rewards.Tiers) Option {
+	return func(db *DB) {
+		db.rewardTiers = tiers
+	}
 }
 
 // Модель пользователя
@@ -43,18 +367,168 @@ type User struct {
 	Username string `json:"username"`
 	Email    string `json:"email"`
 	Password string `json:"password"` // Хэшированный пароль
+	Role     string `json:"-"`
+}
+
+// Параметры регистрации пользователя
+type CreateUserParams struct {
+	User
+	UserAgent string // заголовок User-Agent клиента
+	Source    string // платформа регистрации, см. NormalizeSource
+	IP        string // IP-адрес клиента; некорректный адрес не сохраняется
+	Channel   string // канал атрибуции реферала; пустой - ChannelManualCode
+	ClickID   int    // переход по ссылке, приведший к регистрации; 0 - нет
+	// PlainPassword - пароль запроса в открытом виде, User.Password - его
+	// хеш. Не сохраняется: по нему повторная регистрация проверяет, что
+	// пользователь прерванной попытки - тот же, см. RegisterWithReferralCode.
+	PlainPassword string `json:"-"`
+}
+
+// signupColumns возвращает нормализованные платформу, User-Agent и IP
+func (p CreateUserParams) signupColumns() (string, string, string) {
+	userAgent, ip := clientColumns(p.UserAgent, p.IP)
+	return NormalizeSource(p.Source), userAgent, ip
+}
+
+// clientColumns обрезает User-Agent до maxUserAgentLen и возвращает IP
+// в канонической форме; некорректный IP заменяется пустой строкой.
+func clientColumns(userAgent, ip string) (string, string) {
+	if len(userAgent) > maxUserAgentLen {
+		userAgent = strings.ToValidUTF8(userAgent[:maxUserAgentLen], "")
+	}
+	if parsed := net.ParseIP(ip); parsed != nil {
+		return userAgent, parsed.String()
+	}
+	return userAgent, ""
+}
+
+// passwordMatches сообщает, подходит ли PlainPassword к хешу hash
+func (p CreateUserParams) passwordMatches(hash string) bool {
+	return p.PlainPassword != "" && bcrypt.CompareHashAndPassword([]byte(hash), []byte(p.PlainPassword)) == nil
+}
+
+// channel возвращает канал атрибуции, по умолчанию ChannelManualCode
+func (p CreateUserParams) channel() string {
+	if p.Channel == ChannelLinkClick {
+		return ChannelLinkClick
+	}
+	return ChannelManualCode
+}
+
+// Пользователь в ответах, где email не раскрывается: только ID и имя
+type UserRef struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+}
+
+// Результат регистрации по реферальному коду
+type ReferralRegistration struct {
+	UserID   int     // зарегистрированный пользователь
+	Referrer UserRef // владелец кода
+}
+
+// Приглашенный пользователь в списках рефералов: только ID, имя и дата
+// регистрации. Запросы, возвращающие ReferralSummary, не читают
+// контактные данные, поэтому их может выполнять роль БД без доступа к
+// users.email (например, пользователь аналитической реплики).
+type ReferralSummary struct {
+	ID       int       `json:"id"`
+	Username string    `json:"username"`
+	JoinedAt time.Time `json:"joined_at"`
+	// выполненные и оставшиеся шаги знакомства с сервисом; nil - шаги не
+	// заданы, см. WithOnboarding
+	Onboarding *onboarding.Progress `json:"onboarding,omitempty"`
+	// RewardPending, RewardVested; пусто - вознаграждение не начислено
+	Reward string `json:"reward,omitempty"`
 }
 
 // Модель реферального кода
 type ReferralCode struct {
-	ID        int       `json:"id"`
-	UserID    int       `json:"user_id"`
-	Code      string    `json:"code"`
-	ExpiresAt time.Time `json:"expires_at"`
+	ID        int             `json:"id"`
+	UserID    int             `json:"user_id"`
+	Code      string          `json:"code"`
+	ExpiresAt time.Time       `json:"expires_at"`
+	Uses      int             `json:"uses"`
+	Metadata  json.RawMessage `json:"metadata,omitempty"` // JSON-объект произвольных меток
+	Label     string          `json:"label,omitempty"`    // подпись кода, если их у пользователя несколько
+	DomainRestriction
+}
+
+// Удаленный реферальный код и его владелец. Для зарезервированного кода
+// UserID равен 0, а OwnerEmail - email резервирования.
+type DeletedReferralCode struct {
+	ReferralCode
+	Status        string `json:"status"`
+	OwnerUsername string `json:"owner_username"`
+	OwnerEmail    string `json:"owner_email"`
+}
+
+// Подробная информация о реферальном коде для администратора
+type ReferralCodeDetails struct {
+	ReferralCode
+	Status        string     `json:"status"`
+	OwnerUsername string     `json:"owner_username"`
+	OwnerEmail    string     `json:"owner_email"`
+	MaxUses       *int       `json:"max_uses"`
+	Clicks        int        `json:"clicks"`
+	RevokedAt     *time.Time `json:"revoked_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+// Expired сообщает, истек ли срок действия кода на момент now.
+func (d ReferralCodeDetails) Expired(now time.Time) bool {
+	return !d.ExpiresAt.After(now)
+}
+
+// Revoked сообщает, отозван ли код.
+func (d ReferralCodeDetails) Revoked() bool {
+	return d.RevokedAt != nil
+}
+
+// Reserved сообщает, ожидает ли код регистрации владельца.
+func (d ReferralCodeDetails) Reserved() bool {
+	return d.Status == CodeStatusReserved
+}
+
+// Exhausted сообщает, исчерпан ли лимит использований кода.
+func (d ReferralCodeDetails) Exhausted() bool {
+	return d.MaxUses != nil && d.Uses >= *d.MaxUses
+}
+
+// Сводный отчет по реферальной программе за период
+type ProgramReport struct {
+	From            time.Time    `json:"from"`
+	To              time.Time    `json:"to"`
+	TotalSignups    int          `json:"total_signups"`
+	ReferralSignups int          `json:"referral_signups"`
+	ConversionRate  float64      `json:"conversion_rate"` // доля регистраций по рефералам
+	TopCodes        []CodeStat   `json:"top_codes"`
+	Sources         []SourceStat `json:"sources"`
+	Days            []DayStat    `json:"days"`
+}
+
+// Регистрации с одной платформы
+type SourceStat struct {
+	Source          string `json:"source"`
+	Signups         int    `json:"signups"`
+	ReferralSignups int    `json:"referral_signups"`
+}
+
+// Число регистраций по коду
+type CodeStat struct {
+	Code    string `json:"code"`
+	Signups int    `json:"signups"`
+}
+
+// Регистрации за один день
+type DayStat struct {
+	Date            time.Time `json:"date"`
+	Signups         int       `json:"signups"`
+	ReferralSignups int       `json:"referral_signups"`
 }
 
 // Конструктор для инициализации соединения с БД
-func New(connstr string) (*DB, error) {
+func New(connstr string, opts ...Option) (*DB, error) {
 	if connstr == "" {
 		return nil, errors.New("не указано подключение к БД")
 	}
@@ -63,23 +537,69 @@ func New(connstr string) (*DB, error) {
 		return nil, err
 	}
 	db := DB{
-		pool: pool,
+		pool:       pool,
+		read:       pool,
+		chainDepth: DefaultChainDepth,
+	}
+	for _, opt := range opts {
+		opt(&db)
+	}
+	if db.replicaConnstr != "" {
+		db.replica, err = pgxpool.Connect(context.Background(), db.replicaConnstr)
+		if err != nil {
+			pool.Close()
+			return nil, fmt.Errorf("подключение к реплике: %w", err)
+		}
+		db.read = readPool{replica: db.replica, primary: pool}
 	}
 
 	return &db, nil
 }
 
+// Проверка соединения с БД
+func (db *DB) Ping(ctx context.Context) (err error) {
+	defer wrapError(&err, "ping")
+	return db.pool.Ping(ctx)
+}
+
+// Закрытие пула соединений
+func (db *DB) Close() {
+	db.pool.Close()
+	if db.replica != nil {
+		db.replica.Close()
+	}
+}
+
 // Создание пользователя
-func (db *DB) CreateUser(ctx context.Context, user User) (int, error) {
+func (db *DB) CreateUser(ctx context.Context, params CreateUserParams) (_ int, err error) {
+	defer wrapError(&err, "create user email=%s", redactEmail(params.Email))
 	var userID int
-	err := db.pool.QueryRow(ctx, `
-        INSERT INTO users (username, email, password)
-        VALUES ($1, $2, $3)
+	source, userAgent, ip := params.signupColumns()
+	err = db.pool.BeginFunc(ctx, func(tx pgxv4.Tx) error {
+		err := tx.QueryRow(ctx, `
+        INSERT INTO users (username, email, password, signup_source, user_agent, signup_ip)
+        VALUES ($1, $2, $3, $4, NULLIF($5, ''), NULLIF($6, '')::inet)
         RETURNING id`,
-		user.Username,
-		user.Email,
-		user.Password,
-	).Scan(&userID) // Получаем ID нового пользователя
+			params.Username,
+			params.Email,
+			params.Password,
+			source,
+			userAgent,
+			ip,
+		).Scan(&userID) // Получаем ID нового пользователя
+		if isUniqueViolation(err, emailUniqueConstraint) {
+			return ErrEmailTaken
+		}
+		if isUniqueViolation(err, usernameUniqueConstraint) {
+			return ErrUsernameTaken
+		}
+		if err != nil {
+			return err
+		}
+
+		// Зарезервированный для этого email код становится кодом пользователя
+		return activateReservedCode(ctx, tx, params.Email)
+	})
 
 	if err != nil {
 		return 0, err // Возвращаем 0 и ошибку, если произошла ошибка
@@ -88,58 +608,265 @@ func (db *DB) CreateUser(ctx context.Context, user User) (int, error) {
 	return userID, nil // Возвращаем ID и nil, если все прошло успешно
 }
 
-// Получение пользователя по email
-func (db *DB) GetUserByEmail(ctx context.Context, email string) (User, error) {
+// Получение пользователя по email без учета регистра
+func (db *DB) GetUserByEmail(ctx context.Context, email string) (_ User, err error) {
+	defer wrapError(&err, "get user email=%s", redactEmail(email))
+	var user User
+	err = db.pool.QueryRow(ctx, `
+        SELECT id, username, email, COALESCE(password, ''), role FROM users WHERE lower(email) = lower($1)`, email).
+		Scan(&user.ID, &user.Username, &user.Email, &user.Password, &user.Role)
+	if err != nil {
+		if errors.Is(err, pgxv4.ErrNoRows) {
+			return User{}, ErrNotFound
+		}
+		return User{}, err
+	}
+	return user, nil
+}
+
+// Получение пользователя по ID
+func (db *DB) GetUserByID(ctx context.Context, id int) (_ User, err error) {
+	defer wrapError(&err, "get user id=%d", id)
 	var user User
-	err := db.pool.QueryRow(ctx, `
-        SELECT id, username, email, password FROM users WHERE email = $1`, email).
-		Scan(&user.ID, &user.Username, &user.Email, &user.Password)
+	err = db.pool.QueryRow(ctx, `
+        SELECT id, username, email, COALESCE(password, ''), role FROM users WHERE id = $1`, id).
+		Scan(&user.ID, &user.Username, &user.Email, &user.Password, &user.Role)
 	if err != nil {
+		if errors.Is(err, pgxv4.ErrNoRows) {
+			return User{}, ErrNotFound
+		}
 		return User{}, err
 	}
 	return user, nil
 }
 
+// Проверка, зарегистрирован ли email. Только чтение.
+func (db *DB) EmailExists(ctx context.Context, email string) (_ bool, err error) {
+	defer wrapError(&err, "check email=%s", redactEmail(email))
+	var exists bool
+	err = db.pool.QueryRow(ctx, `
+        SELECT EXISTS (SELECT 1 FROM users WHERE lower(email) = lower($1))`, email).
+		Scan(&exists)
+	return exists, err
+}
+
+// Сохранение часового пояса пользователя. Имя пояса проверяется
+// вызывающим. Указанный пояс отмечает шаг onboarding.StepProfileCompleted.
+func (db *DB) SetTimezone(ctx context.Context, userID int, timezone string) (err error) {
+	defer wrapError(&err, "set timezone user=%d", userID)
+	return db.pool.BeginFunc(ctx, func(tx pgxv4.Tx) error {
+		tag, err := tx.Exec(ctx, `
+        UPDATE users SET timezone = $2 WHERE id = $1`, userID, timezone)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return ErrNotFound
+		}
+		return db.completeStep(ctx, tx, userID, onboarding.StepProfileCompleted)
+	})
+}
+
+// Смена имени пользователя. Имя проверяется вызывающим, поэтому отметка
+// о нарушении правил для имен, заведенных до их введения, снимается.
+func (db *DB) SetUsername(ctx context.Context, userID int, username string) (err error) {
+	defer wrapError(&err, "set username user=%d", userID)
+	tag, err := db.pool.Exec(ctx, `
+        UPDATE users SET username = $2, username_flagged_at = NULL WHERE id = $1`, userID, username)
+	if isUniqueViolation(err, usernameUniqueConstraint) {
+		return ErrUsernameTaken
+	}
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Изменение профиля пользователя. Пустые и nil поля не меняются.
+type ProfileUpdate struct {
+	Username         string // имя, проверенное вызывающим
+	Timezone         string // имя пояса IANA, проверенное вызывающим
+	VanityLinkOptOut *bool  // отключение ссылки /r/@username
+}
+
+// Изменение профиля пользователя одной транзакцией: либо все поля, либо
+// ничего. Имя и пояс сохраняются, как в SetUsername и SetTimezone; если
+// имя занято - ErrUsernameTaken, и прочие поля тоже не меняются.
+func (db *DB) UpdateProfile(ctx context.Context, userID int, u ProfileUpdate) (err error) {
+	defer wrapError(&err, "update profile user=%d", userID)
+	return db.pool.BeginFunc(ctx, func(tx pgxv4.Tx) error {
+		tag, err := tx.Exec(ctx, `
+        UPDATE users SET
+            username = COALESCE(NULLIF($2, ''), username),
+            username_flagged_at = CASE WHEN $2 = '' THEN username_flagged_at END,
+            timezone = COALESCE(NULLIF($3, ''), timezone),
+            vanity_link_opt_out = COALESCE($4, vanity_link_opt_out)
+        WHERE id = $1`, userID, u.Username, u.Timezone, u.VanityLinkOptOut)
+		if isUniqueViolation(err, usernameUniqueConstraint) {
+			return ErrUsernameTaken
+		}
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return ErrNotFound
+		}
+		if u.Timezone == "" {
+			return nil
+		}
+		return db.completeStep(ctx, tx, userID, onboarding.StepProfileCompleted)
+	})
+}
+
 // Создание реферального кода с проверкой на существующий код
-func (db *DB) CreateReferralCode(ctx context.Context, userID int, code string, expiresAt int64) error {
-	// Удаляем существующий активный код перед созданием нового
-	if err := db.DeleteReferralCode(ctx, userID); err != nil {
+// metadata - JSON-объект меток кода, nil - пустой объект; domain -
+// ограничение регистрации по коду доменом email.
+// Если clientToken не пуст и код с этим токеном у пользователя уже есть,
+// возвращается ErrClientTokenUsed. Если код занят другим пользователем -
+// ErrCodeTaken.
+// Срок действия проверяется CheckCodeExpiry.
+func (db *DB) CreateReferralCode(ctx context.Context, userID int, code string, expiresAt int64, clientToken string, metadata json.RawMessage, domain DomainRestriction) (err error) {
+	defer wrapError(&err, "create referral code user=%d code=%s", userID, code)
+	if err := db.checkExpiry(expiresAt); err != nil {
 		return err
 	}
+	return db.pool.BeginFunc(ctx, func(tx pgxv4.Tx) error {
+		// Блокировка пользователя сериализует одновременные запросы
+		if _, err := tx.Exec(ctx, `SELECT id FROM users WHERE id = $1 FOR UPDATE`, userID); err != nil {
+			return err
+		}
 
-	_, err := db.pool.Exec(ctx, `
-    INSERT INTO referral_codes (user_id, code, expires_at)
-    VALUES ($1, $2, to_timestamp($3))`,
-		userID,
-		code,
-		expiresAt,
-	)
-	return err
+		if err := checkClientToken(ctx, tx, userID, clientToken); err != nil {
+			return err
+		}
+
+		// Удаляем существующий активный код перед созданием нового,
+		// сохраняя его в архиве
+		if err := archiveCodes(ctx, tx, `user_id = $1`, userID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `DELETE FROM referral_codes WHERE user_id = $1`, userID); err != nil {
+			return err
+		}
+
+		_, err := tx.Exec(ctx, `
+    INSERT INTO referral_codes (user_id, code, expires_at, client_token, metadata, allowed_domain, allow_subdomains)
+    VALUES ($1, $2, to_timestamp($3), NULLIF($4, ''), COALESCE($5::jsonb, '{}'), NULLIF($6, ''), $7)`,
+			userID,
+			code,
+			expiresAt,
+			clientToken,
+			jsonbParam(metadata),
+			domain.Domain,
+			domain.Subdomains,
+		)
+		if isUniqueViolation(err, codeUniqueConstraint) {
+			return ErrCodeTaken
+		}
+		if err != nil {
+			return err
+		}
+		return recordCodeCreation(ctx, tx, userID)
+	})
+}
+
+// Получение кода пользователя, созданного с указанным токеном клиента
+func (db *DB) GetReferralCodeByClientToken(ctx context.Context, userID int, clientToken string) (_ ReferralCode, err error) {
+	defer wrapError(&err, "get referral code user=%d by client token", userID)
+	var referralCode ReferralCode
+	err = db.pool.QueryRow(ctx, `
+        SELECT id, user_id, code, expires_at, uses, metadata, COALESCE(allowed_domain, ''), allow_subdomains
+        FROM referral_codes
+        WHERE user_id = $1 AND client_token = $2`, userID, clientToken).
+		Scan(&referralCode.ID, &referralCode.UserID, &referralCode.Code, &referralCode.ExpiresAt, &referralCode.Uses, &referralCode.Metadata,
+			&referralCode.Domain, &referralCode.Subdomains)
+	if err != nil {
+		if errors.Is(err, pgxv4.ErrNoRows) {
+			return ReferralCode{}, ErrNotFound
+		}
+		return ReferralCode{}, err
+	}
+	return referralCode, nil
 }
 
-// Удаление реферального кода
-func (db *DB) DeleteReferralCode(ctx context.Context, userID int) error {
-	_, err := db.pool.Exec(ctx, `
+// Удаление реферальных кодов пользователя с сохранением в архиве
+func (db *DB) DeleteReferralCode(ctx context.Context, userID int) (err error) {
+	defer wrapError(&err, "delete referral codes user=%d", userID)
+	return db.pool.BeginFunc(ctx, func(tx pgxv4.Tx) error {
+		if err := archiveCodes(ctx, tx, `user_id = $1`, userID); err != nil {
+			return err
+		}
+		_, err := tx.Exec(ctx, `
         DELETE FROM referral_codes WHERE user_id = $1`,
-		userID,
-	)
-	return err
+			userID,
+		)
+		return err
+	})
+}
+
+// Удаление реферального кода по его значению с сохранением в архиве.
+// Действие фиксируется в журнале аудита от имени администратора actorID.
+// Если кода нет - ErrNotFound.
+func (db *DB) DeleteReferralCodeByCode(ctx context.Context, code string, actorID int) (_ DeletedReferralCode, err error) {
+	defer wrapError(&err, "delete referral code code=%s", code)
+	var d DeletedReferralCode
+	err = db.pool.BeginFunc(ctx, func(tx pgxv4.Tx) error {
+		if err := archiveCodes(ctx, tx, `code = $1`, code); err != nil {
+			return err
+		}
+		err := tx.QueryRow(ctx, `
+        WITH deleted AS (
+            DELETE FROM referral_codes WHERE code = $1
+            RETURNING id, user_id, code, expires_at, uses, metadata, status, reserved_email
+        )
+        SELECT d.id, COALESCE(d.user_id, 0), d.code, d.expires_at, d.uses, d.metadata, d.status,
+            COALESCE(u.username, ''), COALESCE(u.email, d.reserved_email, '')
+        FROM deleted d
+        LEFT JOIN users u ON u.id = d.user_id`, code).
+			Scan(&d.ID, &d.UserID, &d.Code, &d.ExpiresAt, &d.Uses, &d.Metadata, &d.Status, &d.OwnerUsername, &d.OwnerEmail)
+		if err != nil {
+			if errors.Is(err, pgxv4.ErrNoRows) {
+				return ErrNotFound
+			}
+			return err
+		}
+
+		_, err = tx.Exec(ctx, `
+        INSERT INTO audit_log (actor_id, action, target_user_id, payload)
+        VALUES ($1, $2, NULLIF($3, 0), $4)`,
+			actorID,
+			AuditCodeDeleted,
+			d.UserID,
+			map[string]string{"code": d.Code, "owner_email": d.OwnerEmail},
+		)
+		return err
+	})
+	if err != nil {
+		return DeletedReferralCode{}, err
+	}
+	return d, nil
 }
 
 // Получение реферального кода по email
-func (db *DB) GetReferralCodeByEmail(ctx context.Context, email string) (ReferralCode, error) {
+func (db *DB) GetReferralCodeByEmail(ctx context.Context, email string) (_ ReferralCode, err error) {
+	defer wrapError(&err, "get referral code email=%s", redactEmail(email))
 	var referralCode ReferralCode
 	var userID int
-	err := db.pool.QueryRow(ctx, `
-        SELECT rc.id, rc.user_id, rc.code, rc.expires_at 
+	err = db.pool.QueryRow(ctx, `
+        SELECT rc.id, rc.user_id, rc.code, rc.expires_at, rc.uses, rc.metadata, COALESCE(rc.allowed_domain, ''), rc.allow_subdomains
         FROM referral_codes rc 
         JOIN users u ON rc.user_id = u.id 
-        WHERE u.email = $1`, email).
-		Scan(&referralCode.ID, &userID, &referralCode.Code, &referralCode.ExpiresAt)
-
+        WHERE lower(u.email) = lower($1)
+        ORDER BY rc.created_at DESC, rc.id DESC
+        LIMIT 1`, email).
+		Scan(&referralCode.ID, &userID, &referralCode.Code, &referralCode.ExpiresAt, &referralCode.Uses, &referralCode.Metadata,
+			&referralCode.Domain, &referralCode.Subdomains)
 	if err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
-			return ReferralCode{}, errors.New("реферальный код не найден для данного email")
+		if errors.Is(err, pgxv4.ErrNoRows) {
+			return ReferralCode{}, ErrNotFound
 		}
 		return ReferralCode{}, err
 	}
@@ -148,51 +875,514 @@ func (db *DB) GetReferralCodeByEmail(ctx context.Context, email string) (Referra
 	return referralCode, nil
 }
 
-// Получение рефералов по ID реферера
-func (db *DB) GetReferralsByReferrerID(ctx context.Context, referrerID int) ([]User, error) {
-	rows, err := db.pool.Query(ctx, `
-        SELECT u.id, u.username, u.email FROM referral_links rl
+// Получение реферального кода пользователя по его ID. Если кодов
+// несколько, возвращается последний созданный.
+func (db *DB) GetReferralCodeByUserID(ctx context.Context, userID int) (_ ReferralCode, err error) {
+	defer wrapError(&err, "get referral code user=%d", userID)
+	var referralCode ReferralCode
+	err = db.pool.QueryRow(ctx, `
+        SELECT id, user_id, code, expires_at, uses, metadata, COALESCE(allowed_domain, ''), allow_subdomains
+        FROM referral_codes
+        WHERE user_id = $1
+        ORDER BY created_at DESC, id DESC
+        LIMIT 1`, userID).
+		Scan(&referralCode.ID, &referralCode.UserID, &referralCode.Code, &referralCode.ExpiresAt, &referralCode.Uses, &referralCode.Metadata,
+			&referralCode.Domain, &referralCode.Subdomains)
+	if err != nil {
+		if errors.Is(err, pgxv4.ErrNoRows) {
+			return ReferralCode{}, ErrNotFound
+		}
+		return ReferralCode{}, err
+	}
+	return referralCode, nil
+}
+
+// Получение страницы рефералов по ID реферера без контактных данных
+func (db *DB) GetReferralsByReferrerID(ctx context.Context, referrerID, limit, offset int) (_ []ReferralSummary, err error) {
+	defer wrapError(&err, "list referrals referrer=%d", referrerID)
+	rows, err := db.read.Query(ctx, `
+        SELECT u.id, u.username, rl.created_at,
+            ARRAY(SELECT step FROM onboarding_steps s WHERE s.user_id = u.id ORDER BY s.completed_at),
+            CASE WHEN rr.id IS NULL THEN '' WHEN rr.review_status IS NOT NULL THEN rr.review_status
+                WHEN rr.vested_at IS NULL THEN $4 ELSE $5 END
+        FROM referral_links rl
         JOIN users u ON rl.referee_id = u.id
-        WHERE rl.referrer_id = $1`, referrerID)
+        LEFT JOIN referral_rewards rr ON rr.referee_id = u.id
+        WHERE rl.referrer_id = $1
+        ORDER BY rl.created_at, rl.id
+        LIMIT $2 OFFSET $3`, referrerID, limit, offset, RewardPending, RewardVested)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var referrals []User
+	var referrals []ReferralSummary
 	for rows.Next() {
-		var user User
-		if err := rows.Scan(&user.ID, &user.Username, &user.Email); err != nil {
+		var referee ReferralSummary
+		var steps []string
+		if err := rows.Scan(&referee.ID, &referee.Username, &referee.JoinedAt, &steps, &referee.Reward); err != nil {
 			return nil, err
 		}
-		referrals = append(referrals, user)
+		if len(db.onboarding) > 0 {
+			progress := db.onboarding.Progress(steps)
+			referee.Onboarding = &progress
+		}
+		referrals = append(referrals, referee)
 	}
 	return referrals, rows.Err()
 }
 
-// В обработчике регистрации с реферальным кодом
-func (db *DB) RegisterWithReferralCode(ctx context.Context, referralCode string, user User) error {
-	// Проверка реферального кода
-	var referrerID int
-	var userID int
-	err := db.pool.QueryRow(ctx, `
-        SELECT user_id FROM referral_codes WHERE code = $1 AND expires_at > NOW()`, referralCode).
-		Scan(&referrerID)
+// Регистрация пользователя по реферальному коду. Пользователь и
+// реферальная связь создаются в одной транзакции. Возвращает ID
+// пользователя и реферера.
+//
+// Повтор регистрации идемпотентен: если пользователь с тем же email и
+// именем создан не раньше registrationRetryWindow назад, реферальной связи
+// у него нет (например, предыдущая попытка создала его через CreateUser и
+// прервалась) и params.PlainPassword подходит к его паролю, создается
+// только связь. Иначе регистрация завершается ErrEmailTaken. Если этот
+// пользователь - сам владелец кода или входит в цепочку его рефереров
+// (например, код был зарезервирован для его email), возвращается
+// ErrSelfReferral.
+func (db *DB) RegisterWithReferralCode(ctx context.Context, referralCode string, params CreateUserParams) (_ ReferralRegistration, err error) {
+	defer wrapError(&err, "register email=%s code=%s", redactEmail(params.Email), referralCode)
+	source, userAgent, ip := params.signupColumns()
+	var reg ReferralRegistration
+	err = db.pool.BeginFunc(ctx, func(tx pgxv4.Tx) error {
+		// Проверка реферального кода и учет использования
+		var referrerID int
+		var userID int
+		var domain DomainRestriction
+		err := tx.QueryRow(ctx, `
+        UPDATE referral_codes rc SET uses = uses + 1
+        WHERE code = $1 AND status = 'active' AND expires_at > NOW() AND revoked_at IS NULL
+            AND (max_uses IS NULL OR uses < max_uses)
+            AND ($2 = '' OR EXISTS (
+                SELECT 1 FROM terms_acceptances ta WHERE ta.user_id = rc.user_id AND ta.version = $2))
+        RETURNING user_id, (SELECT u.username FROM users u WHERE u.id = rc.user_id),
+            COALESCE(allowed_domain, ''), allow_subdomains`, referralCode, db.termsVersion).
+			Scan(&referrerID, &reg.Referrer.Username, &domain.Domain, &domain.Subdomains)
+		if err != nil {
+			log.Printf("Ошибка при проверке реферального кода: %v", err) // Логируем ошибку
+			if errors.Is(err, pgxv4.ErrNoRows) {
+				return ErrCodeInvalid
+			}
+			return err
+		}
+		// откат транзакции отменяет и учет использования кода
+		if !domain.Allows(params.Email) {
+			return ErrCodeDomainMismatch
+		}
+		depth, err := db.linkDepth(ctx, tx, referrerID)
+		if err != nil {
+			return err
+		}
+
+		// Пользователь, оставшийся без связи после прерванной попытки.
+		// Связь достраивается, только если пароль запроса совпадает с его
+		// паролем: иначе по email и имени чужую регистрацию можно было бы
+		// привязать к своему коду.
+		var storedHash string
+		err = tx.QueryRow(ctx, `
+        SELECT u.id, u.password FROM users u
+        WHERE lower(u.email) = lower($1) AND u.username = $2
+            AND u.created_at > NOW() - make_interval(secs => $3)
+            AND NOT EXISTS (SELECT 1 FROM referral_links rl WHERE rl.referee_id = u.id)
+        FOR UPDATE`,
+			params.Email,
+			params.Username,
+			registrationRetryWindow.Seconds(),
+		).Scan(&userID, &storedHash)
+		if err == nil && !params.passwordMatches(storedHash) {
+			err = pgxv4.ErrNoRows
+		}
+		switch {
+		case err == nil:
+			cycle, err := db.inReferrerChain(ctx, tx, referrerID, userID)
+			if err != nil {
+				return err
+			}
+			if cycle {
+				return ErrSelfReferral
+			}
+			log.Printf("Повторная регистрация пользователя %d: создается только реферальная связь", userID)
+		case errors.Is(err, pgxv4.ErrNoRows):
+			// Создание пользователя
+			err = tx.QueryRow(ctx, `
+        INSERT INTO users (username, email, password, signup_source, user_agent, signup_ip)
+        VALUES ($1, $2, $3, $4, NULLIF($5, ''), NULLIF($6, '')::inet)
+        RETURNING id`,
+				params.Username,
+				params.Email,
+				params.Password,
+				source,
+				userAgent,
+				ip,
+			).Scan(&userID)
+			if isUniqueViolation(err, emailUniqueConstraint) {
+				// откат транзакции отменяет и учет использования кода
+				return ErrEmailTaken
+			}
+			if isUniqueViolation(err, usernameUniqueConstraint) {
+				return ErrUsernameTaken
+			}
+			if err != nil {
+				log.Printf("Ошибка при создании пользователя: %v", err) // Логируем ошибку
+				return err
+			}
+
+			if err := activateReservedCode(ctx, tx, params.Email); err != nil {
+				return err
+			}
+		default:
+			return err
+		}
+
+		if db.beforeReferralLink != nil {
+			if err := db.beforeReferralLink(); err != nil {
+				return err
+			}
+		}
+
+		// Создание записи о реферале. Переход из cookie мог быть удален
+		// или относиться к другому коду: тогда связь сохраняется без него.
+		_, err = tx.Exec(ctx, `
+        INSERT INTO referral_links (referrer_id, referee_id, code, channel, click_id, depth)
+        VALUES ($1, $2, $3, $4, (
+            SELECT c.id FROM referral_clicks c
+            JOIN referral_codes rc ON rc.id = c.referral_code_id
+            WHERE c.id = $5 AND rc.code = $3
+        ), $6)`,
+			referrerID,
+			userID,
+			referralCode,
+			params.channel(),
+			params.ClickID,
+			depth)
+		if err != nil {
+			return err
+		}
+		reg.UserID, reg.Referrer.ID = userID, referrerID
+		return db.creditReferral(ctx, tx, referrerID, userID)
+	})
 	if err != nil {
-		log.Printf("Ошибка при проверке реферального кода: %v", err) // Логируем ошибку
-		return err                                                   // Код недействителен
+		return ReferralRegistration{}, err
 	}
+	return reg, nil
+}
 
-	// Создание пользователя
-	if userID, err = db.CreateUser(ctx, user); err != nil {
-		log.Printf("Ошибка при создании пользователя: %v", err) // Логируем ошибку
+// Учет перехода по реферальной ссылке. Возвращает ID перехода;
+// для недействительного кода - ErrNotFound.
+func (db *DB) RecordClick(ctx context.Context, code string) (_ int, err error) {
+	defer wrapError(&err, "record click code=%s", code)
+	var clickID int
+	err = db.pool.QueryRow(ctx, `
+        INSERT INTO referral_clicks (referral_code_id)
+        SELECT id FROM referral_codes
+        WHERE code = $1 AND status = 'active' AND expires_at > NOW() AND revoked_at IS NULL
+        RETURNING id`, code).
+		Scan(&clickID)
+	if errors.Is(err, pgxv4.ErrNoRows) {
+		return 0, ErrNotFound
+	}
+	return clickID, err
+}
+
+// Получение подробной информации о реферальном коде по его значению
+func (db *DB) GetReferralCodeDetails(ctx context.Context, code string) (_ ReferralCodeDetails, err error) {
+	defer wrapError(&err, "get referral code details code=%s", code)
+	var d ReferralCodeDetails
+	err = db.read.QueryRow(ctx, `
+        SELECT rc.id, COALESCE(rc.user_id, 0), rc.code, rc.expires_at, rc.uses, rc.metadata, rc.max_uses,
+            rc.revoked_at, rc.created_at, rc.status, COALESCE(rc.allowed_domain, ''), rc.allow_subdomains,
+            COALESCE(u.username, ''), COALESCE(u.email, rc.reserved_email),
+            (SELECT COUNT(*) FROM referral_clicks c WHERE c.referral_code_id = rc.id)
+        FROM referral_codes rc
+        LEFT JOIN users u ON rc.user_id = u.id
+        WHERE rc.code = $1`, code).
+		Scan(&d.ID, &d.UserID, &d.Code, &d.ExpiresAt, &d.Uses, &d.Metadata, &d.MaxUses,
+			&d.RevokedAt, &d.CreatedAt, &d.Status, &d.Domain, &d.Subdomains, &d.OwnerUsername, &d.OwnerEmail, &d.Clicks)
+	if err != nil {
+		if errors.Is(err, pgxv4.ErrNoRows) {
+			return ReferralCodeDetails{}, ErrNotFound
+		}
+		return ReferralCodeDetails{}, err
+	}
+	return d, nil
+}
+
+// Анонимизация пользователя: персональные данные заменяются заглушками,
+// реферальные коды удаляются, а записи о рефералах сохраняются, чтобы
+// не искажать статистику рефереров. Действие фиксируется в журнале аудита
+// от имени администратора actorID.
+func (db *DB) AnonymizeUser(ctx context.Context, userID, actorID int) (err error) {
+	defer wrapError(&err, "anonymize user=%d", userID)
+	return db.pool.BeginFunc(ctx, func(tx pgxv4.Tx) error {
+		var anonymizedAt *time.Time
+		var email string
+		err := tx.QueryRow(ctx, `
+        SELECT anonymized_at, email FROM users WHERE id = $1 FOR UPDATE`, userID).
+			Scan(&anonymizedAt, &email)
+		if err != nil {
+			if errors.Is(err, pgxv4.ErrNoRows) {
+				return ErrNotFound
+			}
+			return err
+		}
+		if anonymizedAt != nil {
+			return ErrAlreadyAnonymized
+		}
+
+		_, err = tx.Exec(ctx, `
+        UPDATE users
+        SET username = 'deleted-user-' || id,
+            email = 'deleted-' || id || '@anonymized.invalid',
+            password = NULL,
+            user_agent = NULL,
+            signup_ip = NULL,
+            anonymized_at = NOW()
+        WHERE id = $1`, userID)
+		if err != nil {
+			return err
+		}
+
+		// принятие условий сохраняется как факт, без адреса
+		_, err = tx.Exec(ctx, `
+        UPDATE terms_acceptances SET ip = NULL WHERE user_id = $1`, userID)
+		if err != nil {
+			return err
+		}
+
+		// коды не архивируются: метки и зарезервированные email кодов -
+		// данные пользователя
+		_, err = tx.Exec(ctx, `
+        DELETE FROM referral_codes WHERE user_id = $1`, userID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `
+        DELETE FROM referral_codes_archive WHERE user_id = $1`, userID)
+		if err != nil {
+			return err
+		}
+
+		// IP и User-Agent входов - персональные данные
+		_, err = tx.Exec(ctx, `
+        DELETE FROM login_events WHERE user_id = $1`, userID)
+		if err != nil {
+			return err
+		}
+
+		// события о пользователе содержат его email и имя; недоставленные
+		// события тоже удаляются - получателю нечего сообщать о стертом
+		// пользователе
+		_, err = tx.Exec(ctx, `
+        DELETE FROM webhook_deliveries
+        WHERE payload->'data'->'id' = to_jsonb($1::int)
+            OR payload->'data'->'referee'->'id' = to_jsonb($1::int)`, userID)
+		if err != nil {
+			return err
+		}
+
+		// использованные ссылки входа хранят email; повтор ссылки после
+		// удаления записи отклоняется - пользователя с этим email больше нет
+		_, err = tx.Exec(ctx, `
+        DELETE FROM magic_link_tokens WHERE lower(email) = lower($1)`, email)
+		if err != nil {
+			return err
+		}
+
+		// текст споров о пользователе свободный и может содержать его данные
+		_, err = tx.Exec(ctx, `
+        UPDATE referral_disputes SET message = '', resolution_note = NULL
+        WHERE $1 IN (filed_by, referrer_id, referee_id)`, userID)
+		if err != nil {
+			return err
+		}
+
+		// Очищаем данные пользователя в журнале аудита
+		_, err = tx.Exec(ctx, `
+        UPDATE audit_log SET payload = NULL
+        WHERE target_user_id = $1 OR actor_id = $1`, userID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(ctx, `
+        INSERT INTO audit_log (actor_id, action, target_user_id)
+        VALUES ($1, $2, $3)`,
+			actorID,
+			AuditUserAnonymized,
+			userID)
 		return err
+	})
+}
+
+// Получение отчета по реферальной программе за период [from, to)
+func (db *DB) GetProgramReport(ctx context.Context, from, to time.Time) (_ ProgramReport, err error) {
+	defer wrapError(&err, "program report from=%s to=%s", from.Format(time.DateOnly), to.Format(time.DateOnly))
+	report := ProgramReport{From: from, To: to, TopCodes: []CodeStat{}, Sources: []SourceStat{}, Days: []DayStat{}}
+
+	err = db.read.QueryRow(ctx, `
+        SELECT
+            (SELECT COUNT(*) FROM users WHERE created_at >= $1 AND created_at < $2),
+            (SELECT COUNT(*) FROM referral_links WHERE created_at >= $1 AND created_at < $2)`,
+		from, to).
+		Scan(&report.TotalSignups, &report.ReferralSignups)
+	if err != nil {
+		return ProgramReport{}, err
+	}
+	if report.TotalSignups > 0 {
+		report.ConversionRate = float64(report.ReferralSignups) / float64(report.TotalSignups)
 	}
 
-	// Создание записи о реферале
+	rows, err := db.read.Query(ctx, `
+        SELECT code, COUNT(*) FROM referral_links
+        WHERE code IS NOT NULL AND created_at >= $1 AND created_at < $2
+        GROUP BY code
+        ORDER BY COUNT(*) DESC, code
+        LIMIT 20`, from, to)
+	if err != nil {
+		return ProgramReport{}, err
+	}
+	for rows.Next() {
+		var stat CodeStat
+		if err := rows.Scan(&stat.Code, &stat.Signups); err != nil {
+			rows.Close()
+			return ProgramReport{}, err
+		}
+		report.TopCodes = append(report.TopCodes, stat)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return ProgramReport{}, err
+	}
+
+	rows, err = db.read.Query(ctx, `
+        SELECT u.signup_source, COUNT(*), COUNT(rl.id)
+        FROM users u
+        LEFT JOIN referral_links rl ON rl.referee_id = u.id
+        WHERE u.created_at >= $1 AND u.created_at < $2
+        GROUP BY u.signup_source
+        ORDER BY COUNT(*) DESC, u.signup_source`, from, to)
+	if err != nil {
+		return ProgramReport{}, err
+	}
+	for rows.Next() {
+		var stat SourceStat
+		if err := rows.Scan(&stat.Source, &stat.Signups, &stat.ReferralSignups); err != nil {
+			rows.Close()
+			return ProgramReport{}, err
+		}
+		report.Sources = append(report.Sources, stat)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return ProgramReport{}, err
+	}
+
+	rows, err = db.read.Query(ctx, `
+        SELECT d::date, COALESCE(u.cnt, 0), COALESCE(l.cnt, 0)
+        FROM generate_series($1::date, $2::date - 1, interval '1 day') d
+        LEFT JOIN (
+            SELECT created_at::date AS day, COUNT(*) AS cnt FROM users
+            WHERE created_at >= $1 AND created_at < $2 GROUP BY 1
+        ) u ON u.day = d::date
+        LEFT JOIN (
+            SELECT created_at::date AS day, COUNT(*) AS cnt FROM referral_links
+            WHERE created_at >= $1 AND created_at < $2 GROUP BY 1
+        ) l ON l.day = d::date
+        ORDER BY d`, from, to)
+	if err != nil {
+		return ProgramReport{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var day DayStat
+		if err := rows.Scan(&day.Date, &day.Signups, &day.ReferralSignups); err != nil {
+			return ProgramReport{}, err
+		}
+		report.Days = append(report.Days, day)
+	}
+	return report, rows.Err()
+}
+
+// Резервирование реферального кода для email до регистрации пользователя.
+// Зарезервированный код нельзя использовать, пока он не активирован.
+// domain ограничивает регистрацию по коду доменом email, как у
+// CreateReferralCode, срок действия проверяется CheckCodeExpiry.
+func (db *DB) ReserveReferralCode(ctx context.Context, email, code string, expiresAt int64, domain DomainRestriction) (err error) {
+	defer wrapError(&err, "reserve referral code code=%s email=%s", code, redactEmail(email))
+	if err := db.checkExpiry(expiresAt); err != nil {
+		return err
+	}
+	return db.pool.BeginFunc(ctx, func(tx pgxv4.Tx) error {
+		var registered bool
+		err := tx.QueryRow(ctx, `
+        SELECT EXISTS (SELECT 1 FROM users WHERE lower(email) = lower($1))`, email).
+			Scan(&registered)
+		if err != nil {
+			return err
+		}
+		if registered {
+			return ErrEmailTaken
+		}
+
+		_, err = tx.Exec(ctx, `
+        INSERT INTO referral_codes (code, expires_at, status, reserved_email, allowed_domain, allow_subdomains)
+        VALUES ($1, to_timestamp($2), $3, $4, NULLIF($5, ''), $6)`,
+			code,
+			expiresAt,
+			CodeStatusReserved,
+			email,
+			domain.Domain,
+			domain.Subdomains,
+		)
+		switch {
+		case isUniqueViolation(err, codeUniqueConstraint):
+			return ErrCodeTaken
+		case isUniqueViolation(err, "idx_referral_codes_reserved_email"):
+			return ErrEmailTaken
+		}
+		return err
+	})
+}
+
+// Активация кода, зарезервированного для email уже зарегистрированного
+// пользователя. Отсутствие зарезервированного кода ошибкой не считается.
+func (db *DB) ActivateReservedCode(ctx context.Context, email string) (err error) {
+	defer wrapError(&err, "activate reserved code email=%s", redactEmail(email))
+	return db.pool.BeginFunc(ctx, func(tx pgxv4.Tx) error {
+		return activateReservedCode(ctx, tx, email)
+	})
+}
+
+// activateReservedCode привязывает зарезервированный для email код к
+// пользователю с этим email в рамках транзакции tx.
+func activateReservedCode(ctx context.Context, tx pgxv4.Tx, email string) error {
+	_, err := tx.Exec(ctx, `
+        UPDATE referral_codes rc
+        SET status = $2, user_id = u.id, reserved_email = NULL
+        FROM users u
+        WHERE lower(u.email) = lower($1) AND rc.status = $3
+            AND lower(rc.reserved_email) = lower(u.email)`,
+		email,
+		CodeStatusActive,
+		CodeStatusReserved,
+	)
+	return err
+}
+
+// Запись действия в журнал аудита. payload сохраняется как JSON, nil - NULL.
+func (db *DB) RecordAudit(ctx context.Context, actorID int, action string, targetUserID int, payload interface{}) (err error) {
+	defer wrapError(&err, "record audit action=%s target=%d", action, targetUserID)
 	_, err = db.pool.Exec(ctx, `
-        INSERT INTO referral_links (referrer_id, referee_id) VALUES ($1, $2)`,
-		referrerID,
-		userID)
+        INSERT INTO audit_log (actor_id, action, target_user_id, payload)
+        VALUES ($1, $2, $3, $4)`,
+		actorID,
+		action,
+		targetUserID,
+		payload,
+	)
 	return err
 }
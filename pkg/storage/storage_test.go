@@ -2,10 +2,15 @@ package storage
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
 	gomock "github.com/golang/mock/gomock"
+	"github.com/jackc/pgconn"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -28,12 +33,12 @@ func TestDB_CreateUser(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			if !tt.wantErr {
-				mockDB.EXPECT().CreateUser(gomock.Any(), tt.user).Return(tt.wantID, nil)
+				mockDB.EXPECT().CreateUser(gomock.Any(), CreateUserParams{User: tt.user}).Return(tt.wantID, nil)
 			} else {
-				mockDB.EXPECT().CreateUser(gomock.Any(), tt.user).Return(0, assert.AnError)
+				mockDB.EXPECT().CreateUser(gomock.Any(), CreateUserParams{User: tt.user}).Return(0, assert.AnError)
 			}
 
-			gotID, err := mockDB.CreateUser(context.Background(), tt.user)
+			gotID, err := mockDB.CreateUser(context.Background(), CreateUserParams{User: tt.user})
 			if (err != nil) != tt.wantErr {
 				t.Errorf("CreateUser() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -111,12 +116,12 @@ func TestDB_CreateReferralCode(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			if !tt.wantErr {
-				mockDB.EXPECT().CreateReferralCode(gomock.Any(), tt.userID, tt.code, tt.expires).Return(nil)
+				mockDB.EXPECT().CreateReferralCode(gomock.Any(), tt.userID, tt.code, tt.expires, "", gomock.Nil(), DomainRestriction{}).Return(nil)
 			} else {
-				mockDB.EXPECT().CreateReferralCode(gomock.Any(), tt.userID, tt.code, tt.expires).Return(assert.AnError)
+				mockDB.EXPECT().CreateReferralCode(gomock.Any(), tt.userID, tt.code, tt.expires, "", gomock.Nil(), DomainRestriction{}).Return(assert.AnError)
 			}
 
-			err := mockDB.CreateReferralCode(context.Background(), tt.userID, tt.code, tt.expires)
+			err := mockDB.CreateReferralCode(context.Background(), tt.userID, tt.code, tt.expires, "", nil, DomainRestriction{})
 			if (err != nil) != tt.wantErr {
 				t.Errorf("CreateReferralCode() error = %v, wantErr %v", err, tt.wantErr)
 			}
@@ -180,7 +185,7 @@ func TestDB_GetReferralCodeByEmail(t *testing.T) {
 				t.Errorf("GetReferralCodeByEmail() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
-			if got != tt.want {
+			if !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("GetReferralCodeByEmail() = %v, want %v", got, tt.want)
 			}
 		})
@@ -206,15 +211,263 @@ func TestDB_RegisterWithReferralCode(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			if !tt.wantErr {
-				mockDB.EXPECT().RegisterWithReferralCode(gomock.Any(), tt.referralCode, tt.user).Return(nil)
+				mockDB.EXPECT().RegisterWithReferralCode(gomock.Any(), tt.referralCode, CreateUserParams{User: tt.user}).Return(ReferralRegistration{UserID: 2, Referrer: UserRef{ID: 1, Username: "referrer"}}, nil)
 			} else {
-				mockDB.EXPECT().RegisterWithReferralCode(gomock.Any(), tt.referralCode, tt.user).Return(assert.AnError)
+				mockDB.EXPECT().RegisterWithReferralCode(gomock.Any(), tt.referralCode, CreateUserParams{User: tt.user}).Return(ReferralRegistration{}, assert.AnError)
 			}
 
-			err := mockDB.RegisterWithReferralCode(context.Background(), tt.referralCode, tt.user)
+			reg, err := mockDB.RegisterWithReferralCode(context.Background(), tt.referralCode, CreateUserParams{User: tt.user})
 			if (err != nil) != tt.wantErr {
 				t.Errorf("RegisterWithReferralCode() error = %v, wantErr %v", err, tt.wantErr)
 			}
+			if !tt.wantErr && reg.Referrer.Username != "referrer" {
+				t.Errorf("RegisterWithReferralCode() referrer = %+v", reg.Referrer)
+			}
+		})
+	}
+}
+
+func TestNormalizeSource(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"ios", SourceIOS},
+		{" Android ", SourceAndroid},
+		{"WEB", SourceWeb},
+		{"", SourceUnknown},
+		{"smart-fridge", SourceUnknown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			if got := NormalizeSource(tt.source); got != tt.want {
+				t.Errorf("NormalizeSource(%q) = %q, want %q", tt.source, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckCodeExpiry(t *testing.T) {
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name        string
+		expiresAt   int64
+		maxLifetime time.Duration
+		want        error
+	}{
+		{"Zero", 0, 0, ErrExpiryInPast},
+		{"Past", now.Add(-time.Hour).Unix(), 0, ErrExpiryInPast},
+		{"Now", now.Unix(), 0, ErrExpiryInPast},
+		{"Next second", now.Add(time.Second).Unix(), 0, nil},
+		{"Default maximum", now.Add(DefaultCodeLifetime).Unix(), 0, nil},
+		{"Beyond default maximum", now.Add(DefaultCodeLifetime + time.Second).Unix(), 0, ErrExpiryTooFar},
+		{"Beyond configured maximum", now.Add(8 * 24 * time.Hour).Unix(), 7 * 24 * time.Hour, ErrExpiryTooFar},
+		{"Hundred years", now.AddDate(100, 0, 0).Unix(), 0, ErrExpiryTooFar},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := CheckCodeExpiry(tt.expiresAt, now, tt.maxLifetime); !errors.Is(err, tt.want) || (err == nil) != (tt.want == nil) {
+				t.Errorf("CheckCodeExpiry() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsUniqueViolation(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"Duplicate code", &pgconn.PgError{Code: uniqueViolation, ConstraintName: codeUniqueConstraint}, true},
+		{"Wrapped duplicate code", fmt.Errorf("insert: %w", &pgconn.PgError{Code: uniqueViolation, ConstraintName: codeUniqueConstraint}), true},
+		{"Other constraint", &pgconn.PgError{Code: uniqueViolation, ConstraintName: "users_email_key"}, false},
+		{"Other error", assert.AnError, false},
+		{"No error", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isUniqueViolation(tt.err, codeUniqueConstraint); got != tt.want {
+				t.Errorf("isUniqueViolation() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWrapError(t *testing.T) {
+	pgErr := &pgconn.PgError{Code: uniqueViolation, ConstraintName: codeUniqueConstraint}
+
+	tests := []struct {
+		name    string
+		err     error
+		wantMsg string
+		target  error
+	}{
+		{"Not found", ErrNotFound, "storage: get user email=j***@example.com: запись не найдена", ErrNotFound},
+		{"Code taken", fmt.Errorf("insert: %w", ErrCodeTaken), "storage: get user email=j***@example.com: insert: реферальный код уже занят", ErrCodeTaken},
+		{"Deadline", context.DeadlineExceeded, "storage: get user email=j***@example.com: context deadline exceeded", context.DeadlineExceeded},
+		{"Postgres error", pgErr, "storage: get user email=j***@example.com: " + pgErr.Error(), nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.err
+			wrapError(&err, "get user email=%s", redactEmail("john.doe@example.com"))
+			if err.Error() != tt.wantMsg {
+				t.Errorf("wrapped error = %q, want %q", err.Error(), tt.wantMsg)
+			}
+			if tt.target != nil && !errors.Is(err, tt.target) {
+				t.Errorf("errors.Is(%v, %v) = false", err, tt.target)
+			}
+			var got *pgconn.PgError
+			if errors.As(err, &got) != (tt.err == error(pgErr)) {
+				t.Errorf("errors.As(*pgconn.PgError) mismatch for %v", err)
+			}
+		})
+	}
+
+	var err error
+	wrapError(&err, "ping")
+	if err != nil {
+		t.Errorf("wrapError(nil) = %v, want nil", err)
+	}
+}
+
+func TestRedactEmail(t *testing.T) {
+	tests := []struct {
+		email string
+		want  string
+	}{
+		{"john.doe@example.com", "j***@example.com"},
+		{"a@b.c", "a***@b.c"},
+		{"юля@example.com", "ю***@example.com"},
+		{"@example.com", "***"},
+		{"not-an-email", "***"},
+		{"", "***"},
+		{"a@" + strings.Repeat("d", 100), "a***@" + strings.Repeat("d", 64) + "..."},
+		{"a@" + strings.Repeat("д", 40), "a***@" + strings.Repeat("д", 32) + "..."},
+	}
+
+	for _, tt := range tests {
+		if got := redactEmail(tt.email); got != tt.want {
+			t.Errorf("redactEmail(%q) = %q, want %q", tt.email, got, tt.want)
+		}
+	}
+}
+
+func TestSeedProfile(t *testing.T) {
+	for _, profile := range []string{SeedMinimal, SeedDemo} {
+		t.Run(profile, func(t *testing.T) {
+			data, err := SeedProfile(profile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			again, _ := SeedProfile(profile)
+			if !reflect.DeepEqual(data, again) {
+				t.Error("SeedProfile() is not deterministic")
+			}
+
+			// реферер предшествует рефералам, email и коды не повторяются
+			codes := map[string]bool{}
+			emails := map[string]bool{}
+			for _, u := range data.Users {
+				if u.Referrer != "" && !codes[u.Referrer] {
+					t.Errorf("%s refers to code %q defined later or not at all", u.Username, u.Referrer)
+				}
+				if emails[u.Email] || (u.Code != "" && codes[u.Code]) {
+					t.Errorf("%s duplicates email or code", u.Username)
+				}
+				emails[u.Email] = true
+				if u.Code != "" {
+					codes[u.Code] = true
+				}
+			}
+		})
+	}
+
+	if _, err := SeedProfile("huge"); !errors.Is(err, ErrUnknownSeedProfile) {
+		t.Errorf("SeedProfile(huge) error = %v, want ErrUnknownSeedProfile", err)
+	}
+}
+
+func TestChainDepth_Check(t *testing.T) {
+	tests := []struct {
+		name    string
+		limits  ChainDepth
+		depth   int
+		wantErr bool
+	}{
+		{"Below alert", ChainDepth{Max: 5, Alert: 3}, 2, false},
+		{"At maximum", ChainDepth{Max: 5, Alert: 3}, 5, false},
+		{"Above maximum", ChainDepth{Max: 5, Alert: 3}, 6, true},
+		{"Zero limits use defaults", ChainDepth{}, DefaultChainDepth.Max, false},
+		{"Above default maximum", ChainDepth{}, DefaultChainDepth.Max + 1, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.limits.Check(1, tt.depth)
+			if errors.Is(err, ErrChainTooDeep) != tt.wantErr {
+				t.Errorf("Check(%d) = %v, want ErrChainTooDeep: %v", tt.depth, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNormalizeDomain(t *testing.T) {
+	tests := []struct {
+		name    string
+		domain  string
+		want    string
+		wantErr bool
+	}{
+		{"Empty means no restriction", "", "", false},
+		{"Lowercased", "Acme.COM", "acme.com", false},
+		{"At sign and trailing dot trimmed", " @acme.com. ", "acme.com", false},
+		{"Subdomain kept", "eu.acme.com", "eu.acme.com", false},
+		{"Single label", "localhost", "", true},
+		{"Empty label", "acme..com", "", true},
+		{"Hyphen at label edge", "-acme.com", "", true},
+		{"Invalid character", "acme_corp.com", "", true},
+		{"Email instead of domain", "bob@acme.com", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NormalizeDomain(tt.domain)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("NormalizeDomain(%q) = %q, %v; want %q, error: %v", tt.domain, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDomainRestriction_Allows(t *testing.T) {
+	tests := []struct {
+		name   string
+		domain DomainRestriction
+		email  string
+		want   bool
+	}{
+		{"No restriction", DomainRestriction{}, "bob@example.com", true},
+		{"Exact match", DomainRestriction{Domain: "acme.com"}, "bob@acme.com", true},
+		{"Case-insensitive", DomainRestriction{Domain: "acme.com"}, "Bob@ACME.Com", true},
+		{"Mismatch", DomainRestriction{Domain: "acme.com"}, "bob@example.com", false},
+		{"Subdomain not allowed", DomainRestriction{Domain: "acme.com"}, "bob@eu.acme.com", false},
+		{"Subdomain allowed", DomainRestriction{Domain: "acme.com", Subdomains: true}, "bob@eu.acme.com", true},
+		{"Suffix without dot is another domain", DomainRestriction{Domain: "acme.com", Subdomains: true}, "bob@notacme.com", false},
+		{"Exact match with subdomains allowed", DomainRestriction{Domain: "acme.com", Subdomains: true}, "bob@acme.com", true},
+		{"Domain in local part", DomainRestriction{Domain: "acme.com"}, "bob@acme.com@example.com", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.domain.Allows(tt.email); got != tt.want {
+				t.Errorf("%+v.Allows(%q) = %v, want %v", tt.domain, tt.email, got, tt.want)
+			}
 		})
 	}
 }
@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// Принятие пользователем версии условий реферальной программы
+type TermsAcceptance struct {
+	Version    string    `json:"version"`
+	AcceptedAt time.Time `json:"accepted_at"`
+	IP         string    `json:"-"`
+}
+
+// WithTermsVersion включает проверку условий программы: регистрация по
+// коду реферера, не принявшего версию version, отклоняется с
+// ErrCodeInvalid. Пустая версия - проверка выключена. Смена версии
+// требует от всех рефереров принять условия заново.
+func WithTermsVersion(version string) Option {
+	return func(db *DB) {
+		db.termsVersion = version
+	}
+}
+
+// Запись принятия условий версии version. Повторное принятие той же
+// версии возвращает первую запись.
+func (db *DB) AcceptTerms(ctx context.Context, userID int, version, ip string) (_ TermsAcceptance, err error) {
+	defer wrapError(&err, "accept terms user=%d version=%s", userID, version)
+	_, ip = clientColumns("", ip)
+	a := TermsAcceptance{Version: version}
+	err = db.pool.QueryRow(ctx, `
+        INSERT INTO terms_acceptances (user_id, version, ip)
+        VALUES ($1, $2, NULLIF($3, '')::inet)
+        ON CONFLICT (user_id, version) DO UPDATE SET version = EXCLUDED.version
+        RETURNING accepted_at, COALESCE(host(ip), '')`, userID, version, ip).
+		Scan(&a.AcceptedAt, &a.IP)
+	return a, err
+}
+
+// Проверка, принял ли пользователь условия версии version. Только чтение.
+func (db *DB) TermsAccepted(ctx context.Context, userID int, version string) (_ bool, err error) {
+	defer wrapError(&err, "check terms user=%d version=%s", userID, version)
+	var accepted bool
+	err = db.pool.QueryRow(ctx, `
+        SELECT EXISTS (SELECT 1 FROM terms_acceptances WHERE user_id = $1 AND version = $2)`, userID, version).
+		Scan(&accepted)
+	return accepted, err
+}
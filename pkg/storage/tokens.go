@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	pgxv4 "github.com/jackc/pgx/v4"
+
+	"gorefer.go/pkg/onboarding"
+)
+
+// ConsumeMagicLinkToken отмечает одноразовую ссылку входа jti как
+// использованную. Повторный вызов с тем же jti возвращает ErrTokenUsed.
+// Записи об истекших ссылках удаляются: их повтор отсекается проверкой
+// срока в подписи. Переход по ссылке подтверждает email, поэтому у
+// пользователя с этим email отмечается шаг onboarding.StepEmailVerified.
+func (db *DB) ConsumeMagicLinkToken(ctx context.Context, jti, email string, expiresAt time.Time) (err error) {
+	defer wrapError(&err, "consume magic link email=%s", redactEmail(email))
+	return db.pool.BeginFunc(ctx, func(tx pgxv4.Tx) error {
+		if _, err := tx.Exec(ctx, `DELETE FROM magic_link_tokens WHERE expires_at < NOW()`); err != nil {
+			return err
+		}
+		tag, err := tx.Exec(ctx, `
+        INSERT INTO magic_link_tokens (jti, email, expires_at) VALUES ($1, $2, $3)
+        ON CONFLICT (jti) DO NOTHING`, jti, email, expiresAt)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return ErrTokenUsed
+		}
+		var userID int
+		err = tx.QueryRow(ctx, `SELECT id FROM users WHERE lower(email) = lower($1)`, email).Scan(&userID)
+		if errors.Is(err, pgxv4.ErrNoRows) {
+			return nil // пользователя нет, вход отклонит вызывающий
+		}
+		if err != nil {
+			return err
+		}
+		return db.completeStep(ctx, tx, userID, onboarding.StepEmailVerified)
+	})
+}
+
+// ConsumeActionToken отмечает токен действия из письма с nonce как
+// использованный. Повторный вызов с тем же nonce возвращает ErrTokenUsed.
+// Записи об истекших токенах удаляются: их повтор отсекается проверкой
+// срока в подписи, см. auth.ActionToken.
+func (db *DB) ConsumeActionToken(ctx context.Context, nonce string, userID int, action string, expiresAt time.Time) (err error) {
+	defer wrapError(&err, "consume action token user=%d action=%s", userID, action)
+	return db.pool.BeginFunc(ctx, func(tx pgxv4.Tx) error {
+		if _, err := tx.Exec(ctx, `DELETE FROM action_tokens WHERE expires_at < NOW()`); err != nil {
+			return err
+		}
+		tag, err := tx.Exec(ctx, `
+        INSERT INTO action_tokens (nonce, user_id, action, expires_at) VALUES ($1, $2, $3, $4)
+        ON CONFLICT (nonce) DO NOTHING`, nonce, userID, action, expiresAt)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return ErrTokenUsed
+		}
+		return nil
+	})
+}
@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"context"
+	"errors"
+
+	pgxv4 "github.com/jackc/pgx/v4"
+)
+
+// ErrOwnerHasActiveCode возвращается при передаче кода пользователю, у
+// которого уже есть действующий реферальный код
+var ErrOwnerHasActiveCode = errors.New("у нового владельца уже есть действующий реферальный код")
+
+// ErrTransferInvalid возвращается, если код нельзя передать: он уже
+// принадлежит этому пользователю, зарезервирован за email или новый
+// владелец сам зарегистрировался по нему
+var ErrTransferInvalid = errors.New("реферальный код нельзя передать этому пользователю")
+
+// Итог передачи реферального кода другому пользователю
+type CodeTransfer struct {
+	Code           string `json:"code"`
+	FromUserID     int    `json:"from_user_id"`
+	ToUserID       int    `json:"to_user_id"`
+	IncludeHistory bool   `json:"include_history"`
+	LinksMoved     int64  `json:"links_moved"`   // перенесенные связи с приглашенными
+	RewardsMoved   int64  `json:"rewards_moved"` // перенесенные начисления
+	AmountMoved    int64  `json:"amount_moved"`  // их сумма
+}
+
+// Передача реферального кода пользователю newOwnerID. Новые регистрации
+// по коду засчитываются новому владельцу; прежние приглашенные и
+// начисления за них остаются у старого, если не задан includeHistory.
+// С includeHistory переносятся связи, созданные по этому коду, и
+// начисления за них; если у старого владельца после этого баланс уйдет
+// в минус - ErrInsufficientBalance. Передача фиксируется в журнале
+// аудита от имени администратора actorID. Если кода или пользователя
+// нет - ErrNotFound.
+func (db *DB) TransferReferralCode(ctx context.Context, code string, newOwnerID int, includeHistory bool, actorID int) (_ CodeTransfer, err error) {
+	defer wrapError(&err, "transfer referral code code=%s to=%d", code, newOwnerID)
+	t := CodeTransfer{Code: code, ToUserID: newOwnerID, IncludeHistory: includeHistory}
+	err = db.pool.BeginFunc(ctx, func(tx pgxv4.Tx) error {
+		var ownerID *int
+		err := tx.QueryRow(ctx, `
+        SELECT user_id FROM referral_codes WHERE code = $1 FOR UPDATE`, code).Scan(&ownerID)
+		if err != nil {
+			if errors.Is(err, pgxv4.ErrNoRows) {
+				return ErrNotFound
+			}
+			return err
+		}
+		if ownerID == nil || *ownerID == newOwnerID {
+			return ErrTransferInvalid
+		}
+		t.FromUserID = *ownerID
+
+		// строки пользователей блокируются в порядке id, как при
+		// начислениях, чтобы балансы не менялись до конца передачи
+		var locked int
+		err = tx.QueryRow(ctx, `
+        WITH l AS (
+            SELECT id FROM users WHERE id IN ($1, $2) ORDER BY id FOR UPDATE
+        )
+        SELECT COUNT(*) FROM l`, t.FromUserID, newOwnerID).Scan(&locked)
+		if err != nil {
+			return err
+		}
+		if locked < 2 {
+			return ErrNotFound
+		}
+
+		var hasActive bool
+		err = tx.QueryRow(ctx, `
+        SELECT EXISTS(
+            SELECT 1 FROM referral_codes
+            WHERE user_id = $1 AND status = $2 AND expires_at > NOW() AND revoked_at IS NULL
+        )`, newOwnerID, CodeStatusActive).Scan(&hasActive)
+		if err != nil {
+			return err
+		}
+		if hasActive {
+			return ErrOwnerHasActiveCode
+		}
+
+		if includeHistory {
+			if err := moveCodeHistory(ctx, tx, &t); err != nil {
+				return err
+			}
+		}
+
+		_, err = tx.Exec(ctx, `
+        UPDATE referral_codes SET user_id = $2, client_token = NULL WHERE code = $1`,
+			code, newOwnerID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(ctx, `
+        INSERT INTO audit_log (actor_id, action, target_user_id, payload)
+        VALUES ($1, $2, $3, $4)`,
+			actorID,
+			AuditCodeTransferred,
+			t.FromUserID,
+			t,
+		)
+		return err
+	})
+	if err != nil {
+		return CodeTransfer{}, err
+	}
+	return t, nil
+}
+
+// moveCodeHistory переносит на нового владельца связи, созданные по коду
+// t.Code, и начисления за этих приглашенных
+func moveCodeHistory(ctx context.Context, tx pgxv4.Tx, t *CodeTransfer) error {
+	var selfReferred bool
+	err := tx.QueryRow(ctx, `
+        SELECT EXISTS(
+            SELECT 1 FROM referral_links WHERE code = $1 AND referrer_id = $2 AND referee_id = $3
+        )`, t.Code, t.FromUserID, t.ToUserID).Scan(&selfReferred)
+	if err != nil {
+		return err
+	}
+	if selfReferred {
+		return ErrTransferInvalid
+	}
+
+	tag, err := tx.Exec(ctx, `
+        UPDATE referral_links SET referrer_id = $3
+        WHERE code = $1 AND referrer_id = $2`, t.Code, t.FromUserID, t.ToUserID)
+	if err != nil {
+		return err
+	}
+	t.LinksMoved = tag.RowsAffected()
+
+	err = tx.QueryRow(ctx, `
+        WITH moved AS (
+            UPDATE referral_rewards rr SET referrer_id = $3
+            FROM referral_links rl
+            WHERE rl.referee_id = rr.referee_id AND rl.code = $1 AND rl.referrer_id = $3
+                AND rr.referrer_id = $2
+            RETURNING rr.amount
+        )
+        SELECT COUNT(*), COALESCE(SUM(amount), 0) FROM moved`, t.Code, t.FromUserID, t.ToUserID).
+		Scan(&t.RewardsMoved, &t.AmountMoved)
+	if err != nil {
+		return err
+	}
+
+	var balance int64
+	if err := tx.QueryRow(ctx, balanceQuery, t.FromUserID).Scan(&balance); err != nil {
+		return err
+	}
+	if balance < 0 {
+		return ErrInsufficientBalance
+	}
+	return nil
+}
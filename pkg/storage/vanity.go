@@ -0,0 +1,47 @@
+package storage
+
+import (
+	"context"
+	"errors"
+
+	pgxv4 "github.com/jackc/pgx/v4"
+)
+
+// Действующий код пользователя для ссылки /r/@username. Имя сравнивается
+// без учета регистра. Если пользователь отключил ссылку, анонимизирован
+// или у него нет действующего кода - ErrNotFound. Из нескольких кодов
+// выбирается последний созданный.
+func (db *DB) GetActiveReferralCodeByUsername(ctx context.Context, username string) (_ ReferralCode, err error) {
+	defer wrapError(&err, "get active referral code username=%s", username)
+	var c ReferralCode
+	err = db.pool.QueryRow(ctx, `
+        SELECT rc.id, rc.user_id, rc.code, rc.expires_at, rc.uses, rc.metadata,
+            COALESCE(rc.allowed_domain, ''), rc.allow_subdomains
+        FROM users u
+        JOIN referral_codes rc ON rc.user_id = u.id
+        WHERE lower(u.username) = lower($1)
+            AND u.anonymized_at IS NULL AND NOT u.vanity_link_opt_out
+            AND rc.status = 'active' AND rc.expires_at > NOW() AND rc.revoked_at IS NULL
+            AND (rc.max_uses IS NULL OR rc.uses < rc.max_uses)
+        ORDER BY rc.created_at DESC, rc.id DESC
+        LIMIT 1`, username).
+		Scan(&c.ID, &c.UserID, &c.Code, &c.ExpiresAt, &c.Uses, &c.Metadata, &c.Domain, &c.Subdomains)
+	if errors.Is(err, pgxv4.ErrNoRows) {
+		return ReferralCode{}, ErrNotFound
+	}
+	return c, err
+}
+
+// Отключение или включение ссылки /r/@username пользователя.
+func (db *DB) SetVanityLinkOptOut(ctx context.Context, userID int, optOut bool) (err error) {
+	defer wrapError(&err, "set vanity link opt-out user=%d", userID)
+	tag, err := db.pool.Exec(ctx, `
+        UPDATE users SET vanity_link_opt_out = $2 WHERE id = $1`, userID, optOut)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	pgxv4 "github.com/jackc/pgx/v4"
+)
+
+// Статусы доставки события получателю
+const (
+	WebhookPending   = "pending"   // ожидает первой или повторной попытки
+	WebhookDelivered = "delivered" // получатель ответил 2xx
+	WebhookFailed    = "failed"    // попытки исчерпаны, доставка только вручную
+)
+
+// WebhookDeliveries - таблица очереди доставки. Тело события содержит
+// данные пользователя, поэтому завершенные доставки удаляются очисткой
+// по сроку хранения персональных данных, см. PurgeWebhookDeliveries.
+const WebhookDeliveries = "webhook_deliveries"
+
+// Доставка события одному получателю с результатом последней попытки
+type WebhookDelivery struct {
+	ID             int             `json:"id"`
+	Target         string          `json:"target"`
+	Event          string          `json:"event"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  time.Time       `json:"next_attempt_at"`
+	LastStatusCode int             `json:"last_status_code,omitempty"` // 0 - ответа не было
+	LastResponse   string          `json:"last_response,omitempty"`
+	LastError      string          `json:"last_error,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	UpdatedAt      time.Time       `json:"updated_at"`
+}
+
+// Результат попытки доставки. Статус и время следующей попытки
+// определяет отправитель.
+type WebhookAttempt struct {
+	StatusCode    int    // 0 - ответа не было
+	Response      string // тело ответа, уже обрезанное отправителем
+	Error         string
+	Status        string    // статус доставки после попытки
+	NextAttemptAt time.Time // для WebhookPending
+}
+
+// Фильтр списка доставок; пустые поля не ограничивают выборку
+type WebhookDeliveryFilter struct {
+	Status string
+	Target string
+}
+
+// Число недоставленных событий получателя
+type WebhookTargetStats struct {
+	Target  string `json:"target"`
+	Pending int    `json:"pending"`
+	Failed  int    `json:"failed"`
+}
+
+// Постановка события в очередь доставки: по строке на каждого получателя
+func (db *DB) EnqueueWebhook(ctx context.Context, event string, payload json.RawMessage, targets []string) (err error) {
+	defer wrapError(&err, "enqueue webhook event=%s", event)
+	if len(targets) == 0 {
+		return nil
+	}
+	_, err = db.pool.Exec(ctx, `
+        INSERT INTO webhook_deliveries (target, event, payload)
+        SELECT t, $2, $3::jsonb FROM unnest($1::text[]) AS t`,
+		targets, event, string(payload))
+	return err
+}
+
+// Выбор доставок, время попытки которых наступило. Выбранные доставки
+// откладываются на lease, чтобы другие экземпляры сервиса не отправили
+// их повторно, пока попытка не записана.
+func (db *DB) ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) (_ []WebhookDelivery, err error) {
+	defer wrapError(&err, "claim webhook deliveries")
+	rows, err := db.pool.Query(ctx, `
+        UPDATE webhook_deliveries SET next_attempt_at = NOW() + make_interval(secs => $2)
+        WHERE id IN (
+            SELECT id FROM webhook_deliveries
+            WHERE status = 'pending' AND next_attempt_at <= NOW()
+            ORDER BY next_attempt_at, id
+            LIMIT $1
+            FOR UPDATE SKIP LOCKED
+        )
+        RETURNING `+webhookDeliveryColumns, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	return scanWebhookDeliveries(rows)
+}
+
+// Доставка по ID; ErrNotFound, если ее нет
+func (db *DB) GetWebhookDelivery(ctx context.Context, id int) (_ WebhookDelivery, err error) {
+	defer wrapError(&err, "get webhook delivery id=%d", id)
+	d, err := scanWebhookDelivery(db.pool.QueryRow(ctx, `
+        SELECT `+webhookDeliveryColumns+` FROM webhook_deliveries WHERE id = $1`, id))
+	if errors.Is(err, pgxv4.ErrNoRows) {
+		return WebhookDelivery{}, ErrNotFound
+	}
+	return d, err
+}
+
+// Запись результата попытки доставки; ErrNotFound, если доставки нет
+func (db *DB) RecordWebhookAttempt(ctx context.Context, id int, a WebhookAttempt) (_ WebhookDelivery, err error) {
+	defer wrapError(&err, "record webhook attempt id=%d", id)
+	d, err := scanWebhookDelivery(db.pool.QueryRow(ctx, `
+        UPDATE webhook_deliveries SET
+            attempts = attempts + 1,
+            status = $2,
+            next_attempt_at = COALESCE($3, next_attempt_at),
+            last_status_code = NULLIF($4, 0),
+            last_response = NULLIF($5, ''),
+            last_error = NULLIF($6, ''),
+            updated_at = NOW()
+        WHERE id = $1
+        RETURNING `+webhookDeliveryColumns,
+		id, a.Status, nullTime(a.NextAttemptAt), a.StatusCode, a.Response, a.Error))
+	if errors.Is(err, pgxv4.ErrNoRows) {
+		return WebhookDelivery{}, ErrNotFound
+	}
+	return d, err
+}
+
+// Страница доставок, новые первыми
+func (db *DB) ListWebhookDeliveries(ctx context.Context, filter WebhookDeliveryFilter, limit, offset int) (_ []WebhookDelivery, err error) {
+	defer wrapError(&err, "list webhook deliveries status=%s", filter.Status)
+	rows, err := db.read.Query(ctx, `
+        SELECT `+webhookDeliveryColumns+` FROM webhook_deliveries
+        WHERE ($1 = '' OR status = $1) AND ($2 = '' OR target = $2)
+        ORDER BY id DESC
+        LIMIT $3 OFFSET $4`, filter.Status, filter.Target, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	return scanWebhookDeliveries(rows)
+}
+
+// Число ожидающих и неудавшихся доставок по получателям. Получатели,
+// у которых все доставлено, не возвращаются.
+func (db *DB) WebhookStats(ctx context.Context) (_ []WebhookTargetStats, err error) {
+	defer wrapError(&err, "webhook stats")
+	rows, err := db.read.Query(ctx, `
+        SELECT target,
+            COUNT(*) FILTER (WHERE status = 'pending'),
+            COUNT(*) FILTER (WHERE status = 'failed')
+        FROM webhook_deliveries
+        WHERE status IN ('pending', 'failed')
+        GROUP BY target
+        ORDER BY target`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := []WebhookTargetStats{}
+	for rows.Next() {
+		var s WebhookTargetStats
+		if err := rows.Scan(&s.Target, &s.Pending, &s.Failed); err != nil {
+			return nil, err
+		}
+		stats = append(stats, s)
+	}
+	return stats, rows.Err()
+}
+
+const webhookDeliveryColumns = `id, target, event, payload, status, attempts, next_attempt_at,
+            COALESCE(last_status_code, 0), COALESCE(last_response, ''), COALESCE(last_error, ''),
+            created_at, updated_at`
+
+// Удаление не более limit завершенных доставок - доставленных или
+// неудавшихся, - последняя попытка которых была раньше before. Ожидающие
+// доставки не удаляются. Возвращает число удаленных доставок; меньше limit
+// - устаревших доставок не осталось.
+func (db *DB) PurgeWebhookDeliveries(ctx context.Context, before time.Time, limit int) (_ int, err error) {
+	defer wrapError(&err, "purge webhook deliveries before=%s", before.Format(time.RFC3339))
+	tag, err := db.pool.Exec(ctx, `
+        DELETE FROM webhook_deliveries
+        WHERE id IN (
+            SELECT id FROM webhook_deliveries
+            WHERE status <> $1 AND updated_at < $2
+            ORDER BY updated_at
+            LIMIT $3
+            FOR UPDATE SKIP LOCKED
+        )`, WebhookPending, before, limit)
+	if err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+func scanWebhookDelivery(row pgxv4.Row) (WebhookDelivery, error) {
+	var d WebhookDelivery
+	err := row.Scan(&d.ID, &d.Target, &d.Event, &d.Payload, &d.Status, &d.Attempts, &d.NextAttemptAt,
+		&d.LastStatusCode, &d.LastResponse, &d.LastError, &d.CreatedAt, &d.UpdatedAt)
+	return d, err
+}
+
+func scanWebhookDeliveries(rows pgxv4.Rows) ([]WebhookDelivery, error) {
+	defer rows.Close()
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		d, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// nullTime передает нулевое время как NULL
+func nullTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
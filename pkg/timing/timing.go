@@ -0,0 +1,90 @@
+// Пакет timing замеряет этапы обработки запроса для заголовка
+// Server-Timing. Замеры пишутся в Recorder из контекста запроса; без
+// него Start ничего не делает и не выделяет память, поэтому вызовы можно
+// оставлять в обработчиках постоянно.
+package timing
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type key struct{}
+
+// Phase - суммарная длительность этапа.
+type Phase struct {
+	Name string
+	Dur  time.Duration
+}
+
+// Recorder накапливает длительности этапов одного запроса. Безопасен для
+// использования из нескольких горутин.
+type Recorder struct {
+	mu     sync.Mutex
+	phases []Phase
+}
+
+// NewContext возвращает контекст с новым Recorder.
+func NewContext(ctx context.Context) (context.Context, *Recorder) {
+	rec := &Recorder{}
+	return context.WithValue(ctx, key{}, rec), rec
+}
+
+// FromContext возвращает Recorder контекста; nil, если замеры выключены.
+func FromContext(ctx context.Context) *Recorder {
+	rec, _ := ctx.Value(key{}).(*Recorder)
+	return rec
+}
+
+func noop() {}
+
+// Start начинает замер этапа name и возвращает функцию его завершения:
+//
+//	defer timing.Start(ctx, "db")()
+//
+// Без Recorder в контексте возвращает пустую функцию.
+func Start(ctx context.Context, name string) func() {
+	rec := FromContext(ctx)
+	if rec == nil {
+		return noop
+	}
+	start := time.Now()
+	return func() { rec.Add(name, time.Since(start)) }
+}
+
+// Add добавляет d к длительности этапа name. Повторные этапы с тем же
+// именем суммируются и сохраняют место первого.
+func (r *Recorder) Add(name string, d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.phases {
+		if r.phases[i].Name == name {
+			r.phases[i].Dur += d
+			return
+		}
+	}
+	r.phases = append(r.phases, Phase{Name: name, Dur: d})
+}
+
+// Phases возвращает этапы в порядке первого замера.
+func (r *Recorder) Phases() []Phase {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Phase(nil), r.phases...)
+}
+
+// Header возвращает значение заголовка Server-Timing, например
+// "hash;dur=180.2, db;dur=22.05"; длительности - в миллисекундах с
+// точностью до микросекунды. Пустая строка - замеров не было.
+func (r *Recorder) Header() string {
+	phases := r.Phases()
+	parts := make([]string, len(phases))
+	for i, p := range phases {
+		ms := float64(p.Dur.Microseconds()) / 1000
+		parts[i] = p.Name + ";dur=" + strconv.FormatFloat(ms, 'f', -1, 64)
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,69 @@
+package timing
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStart_Disabled(t *testing.T) {
+	ctx := context.Background()
+	allocs := testing.AllocsPerRun(100, func() {
+		Start(ctx, "db")()
+	})
+	if allocs != 0 {
+		t.Errorf("Start without recorder allocates %v times, want 0", allocs)
+	}
+}
+
+func TestRecorder_Header(t *testing.T) {
+	tests := []struct {
+		name   string
+		phases []Phase
+		want   string
+	}{
+		{"No phases", nil, ""},
+		{"Whole milliseconds", []Phase{{"hash", 180 * time.Millisecond}}, "hash;dur=180"},
+		{"Microsecond precision", []Phase{{"db", 22050 * time.Microsecond}}, "db;dur=22.05"},
+		{"Sub-microsecond dropped", []Phase{{"decode", 999 * time.Nanosecond}}, "decode;dur=0"},
+		{
+			"Repeated phase is summed in place",
+			[]Phase{{"db", time.Millisecond}, {"hash", 2 * time.Millisecond}, {"db", 3 * time.Millisecond}},
+			"db;dur=4, hash;dur=2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, rec := NewContext(context.Background())
+			for _, p := range tt.phases {
+				rec.Add(p.Name, p.Dur)
+			}
+			if got := rec.Header(); got != tt.want {
+				t.Errorf("Header() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStart_Concurrent(t *testing.T) {
+	ctx, rec := NewContext(context.Background())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stop := Start(ctx, "db")
+			time.Sleep(time.Millisecond)
+			stop()
+		}()
+	}
+	wg.Wait()
+
+	phases := rec.Phases()
+	if len(phases) != 1 || phases[0].Name != "db" || phases[0].Dur < 10*time.Millisecond {
+		t.Errorf("phases = %+v, want a single db phase of at least 10ms", phases)
+	}
+}
@@ -0,0 +1,274 @@
+// Пакет webhooks доставляет доменные события внешним получателям по HTTP.
+// События ставятся в очередь в хранилище, по строке на получателя, и
+// отправляются фоновым компонентом с повторами; доставки, для которых
+// попытки исчерпаны, помечаются неудавшимися и повторяются только вручную.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gorefer.go/pkg/api"
+	"gorefer.go/pkg/storage"
+)
+
+// События, которые доставляются получателям
+const (
+	EventUserRegistered  = "user.registered"
+	EventReferralCreated = "referral.created"
+)
+
+// Наибольшая длина сохраняемого тела ответа получателя, в байтах
+const maxResponse = 1024
+
+// Наибольшая пауза между попытками
+const maxBackoff = 24 * time.Hour
+
+// Число доставок, выбираемых из очереди за один проход
+const batchSize = 50
+
+// Target - получатель событий.
+type Target struct {
+	URL string
+	// Secret - ключ подписи тела запроса в заголовке X-Gorefer-Signature;
+	// пустой - запросы не подписываются
+	Secret string
+}
+
+// Config - получатели и параметры повторов.
+type Config struct {
+	Targets     []Target
+	MaxAttempts int           // после стольких неудачных попыток доставка помечается неудавшейся
+	Backoff     time.Duration // пауза после первой неудачи, удваивается с каждой следующей
+	Interval    time.Duration // период проверки очереди
+	Timeout     time.Duration // время ожидания ответа получателя
+}
+
+// Параметры по умолчанию, если конфигурация их не задает.
+var DefaultConfig = Config{
+	MaxAttempts: 5,
+	Backoff:     30 * time.Second,
+	Interval:    5 * time.Second,
+	Timeout:     10 * time.Second,
+}
+
+// withFallback подставляет значения по умолчанию вместо незаданных.
+func (c Config) withFallback() Config {
+	if c.MaxAttempts <= 0 {
+		c.MaxAttempts = DefaultConfig.MaxAttempts
+	}
+	if c.Backoff <= 0 {
+		c.Backoff = DefaultConfig.Backoff
+	}
+	if c.Interval <= 0 {
+		c.Interval = DefaultConfig.Interval
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = DefaultConfig.Timeout
+	}
+	return c
+}
+
+// errUnknownTarget - получателя доставки больше нет в конфигурации
+var errUnknownTarget = errors.New("target is not configured")
+
+// Dispatcher - фоновый компонент доставки событий. Подходит для
+// api.API.Register и api.WithWebhooks.
+type Dispatcher struct {
+	store   storage.WebhookStore
+	config  Config
+	targets map[string]Target
+	client  *http.Client
+	now     func() time.Time
+}
+
+// NewDispatcher создает компонент доставки событий получателям config.
+func NewDispatcher(store storage.WebhookStore, config Config) *Dispatcher {
+	config = config.withFallback()
+	targets := make(map[string]Target, len(config.Targets))
+	for _, t := range config.Targets {
+		targets[t.URL] = t
+	}
+	return &Dispatcher{
+		store:   store,
+		config:  config,
+		targets: targets,
+		client:  &http.Client{Timeout: config.Timeout},
+		now:     time.Now,
+	}
+}
+
+// Тело запроса к получателю
+type envelope struct {
+	Event     string      `json:"event"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// Enqueue ставит событие в очередь доставки всем получателям.
+func (d *Dispatcher) Enqueue(ctx context.Context, event string, data interface{}) error {
+	if len(d.config.Targets) == 0 {
+		return nil
+	}
+	payload, err := json.Marshal(envelope{Event: event, CreatedAt: d.now().UTC(), Data: data})
+	if err != nil {
+		return err
+	}
+	urls := make([]string, len(d.config.Targets))
+	for i, t := range d.config.Targets {
+		urls[i] = t.URL
+	}
+	return d.store.EnqueueWebhook(ctx, event, payload, urls)
+}
+
+// Hooks возвращает обработчики событий API, ставящие события в очередь.
+func (d *Dispatcher) Hooks() api.Hooks {
+	enqueue := func(ctx context.Context, event string, data interface{}) {
+		if err := d.Enqueue(ctx, event, data); err != nil {
+			log.Printf("Ошибка постановки события %s в очередь доставки: %v", event, err)
+		}
+	}
+	return api.Hooks{
+		OnUserRegistered: func(ctx context.Context, user storage.User) {
+			enqueue(ctx, EventUserRegistered, user)
+		},
+		OnReferralCreated: func(ctx context.Context, referral api.Referral) {
+			enqueue(ctx, EventReferralCreated, referral)
+		},
+	}
+}
+
+// Run доставляет события из очереди каждые Interval до отмены ctx.
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.config.Interval)
+	defer ticker.Stop()
+	for {
+		if err := d.DeliverDue(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Ошибка доставки событий: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// DeliverDue выполняет одну попытку для каждой доставки, время которой
+// наступило. Получатели обслуживаются параллельно, поэтому недоступный
+// получатель не задерживает остальных.
+func (d *Dispatcher) DeliverDue(ctx context.Context) error {
+	// доставка откладывается на время попытки с запасом
+	due, err := d.store.ClaimWebhookDeliveries(ctx, batchSize, 2*d.config.Timeout)
+	if err != nil {
+		return err
+	}
+	var wg sync.WaitGroup
+	for _, dl := range due {
+		wg.Add(1)
+		go func(dl storage.WebhookDelivery) {
+			defer wg.Done()
+			if _, err := d.deliver(ctx, dl); err != nil {
+				log.Printf("Ошибка записи попытки доставки %d: %v", dl.ID, err)
+			}
+		}(dl)
+	}
+	wg.Wait()
+	return nil
+}
+
+// Redeliver немедленно повторяет доставку id независимо от ее статуса и
+// возвращает доставку с результатом попытки. Неудавшаяся доставка,
+// которая снова не прошла, остается неудавшейся.
+func (d *Dispatcher) Redeliver(ctx context.Context, id int) (storage.WebhookDelivery, error) {
+	dl, err := d.store.GetWebhookDelivery(ctx, id)
+	if err != nil {
+		return storage.WebhookDelivery{}, err
+	}
+	return d.deliver(ctx, dl)
+}
+
+// deliver выполняет попытку доставки и записывает ее результат.
+func (d *Dispatcher) deliver(ctx context.Context, dl storage.WebhookDelivery) (storage.WebhookDelivery, error) {
+	attempt := d.send(ctx, dl)
+	switch {
+	case attempt.Error == "" && attempt.StatusCode >= 200 && attempt.StatusCode < 300:
+		attempt.Status = storage.WebhookDelivered
+	case dl.Attempts+1 >= d.config.MaxAttempts:
+		attempt.Status = storage.WebhookFailed
+		log.Printf("Доставка %d события %s получателю %s не удалась после %d попыток", dl.ID, dl.Event, dl.Target, dl.Attempts+1)
+	default:
+		attempt.Status = storage.WebhookPending
+		attempt.NextAttemptAt = d.now().Add(d.backoff(dl.Attempts))
+	}
+	// результат записывается и после отмены ctx, иначе попытка потеряется
+	return d.store.RecordWebhookAttempt(context.WithoutCancel(ctx), dl.ID, attempt)
+}
+
+// backoff возвращает паузу перед следующей попыткой после attempts
+// предыдущих неудачных.
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	b := d.config.Backoff
+	for i := 0; i < attempts && b < maxBackoff; i++ {
+		b *= 2
+	}
+	return min(b, maxBackoff)
+}
+
+// send отправляет событие получателю.
+func (d *Dispatcher) send(ctx context.Context, dl storage.WebhookDelivery) storage.WebhookAttempt {
+	target, ok := d.targets[dl.Target]
+	if !ok {
+		return storage.WebhookAttempt{Error: errUnknownTarget.Error()}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target.URL, bytes.NewReader(dl.Payload))
+	if err != nil {
+		return storage.WebhookAttempt{Error: err.Error()}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gorefer-Event", dl.Event)
+	req.Header.Set("X-Gorefer-Delivery", strconv.Itoa(dl.ID))
+	if target.Secret != "" {
+		req.Header.Set("X-Gorefer-Signature", Sign(target.Secret, dl.Payload))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return storage.WebhookAttempt{Error: err.Error()}
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponse))
+	attempt := storage.WebhookAttempt{StatusCode: resp.StatusCode, Response: sanitize(body)}
+	if err != nil {
+		attempt.Error = fmt.Sprintf("read response: %v", err)
+	}
+	return attempt
+}
+
+// Sign возвращает подпись тела запроса для заголовка X-Gorefer-Signature:
+// "sha256=" и HMAC-SHA256 в шестнадцатеричном виде.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// sanitize приводит тело ответа к тексту, который примет PostgreSQL:
+// обрезанный последний символ и некорректный UTF-8 удаляются, как и
+// нулевые байты.
+func sanitize(body []byte) string {
+	return strings.ReplaceAll(strings.ToValidUTF8(string(body), ""), "\x00", "")
+}
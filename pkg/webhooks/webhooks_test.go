@@ -0,0 +1,203 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gorefer.go/pkg/api"
+	"gorefer.go/pkg/api/apitest"
+	"gorefer.go/pkg/storage"
+)
+
+// flakyTarget - получатель, который отвечает 500 с длинным телом, пока
+// не переключен на 200, и запоминает заголовки запросов.
+type flakyTarget struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	healthy    bool
+	requests   int
+	signatures []string
+}
+
+func newFlakyTarget(t *testing.T) *flakyTarget {
+	ft := &flakyTarget{}
+	ft.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ft.mu.Lock()
+		defer ft.mu.Unlock()
+		ft.requests++
+		ft.signatures = append(ft.signatures, r.Header.Get("X-Gorefer-Signature"))
+		if !ft.healthy {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, strings.Repeat("x", 2*maxResponse))
+			return
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	t.Cleanup(ft.Close)
+	return ft
+}
+
+func (ft *flakyTarget) setHealthy(healthy bool) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	ft.healthy = healthy
+}
+
+func (ft *flakyTarget) calls() int {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	return ft.requests
+}
+
+// redeliverFunc позволяет передать в API компонент, созданный после сервера
+type redeliverFunc func(ctx context.Context, id int) (storage.WebhookDelivery, error)
+
+func (f redeliverFunc) Redeliver(ctx context.Context, id int) (storage.WebhookDelivery, error) {
+	return f(ctx, id)
+}
+
+func TestDispatcher_FailsAfterMaxAttemptsAndRedelivers(t *testing.T) {
+	ctx := context.Background()
+	target := newFlakyTarget(t)
+
+	var d *Dispatcher
+	srv := apitest.NewServer(t, apitest.WithAdmin(), apitest.WithAPIOptions(
+		api.WithWebhooks(redeliverFunc(func(ctx context.Context, id int) (storage.WebhookDelivery, error) {
+			return d.Redeliver(ctx, id)
+		}))))
+	d = NewDispatcher(srv.Store, Config{
+		Targets:     []Target{{URL: target.URL, Secret: "s3cret"}},
+		MaxAttempts: 3,
+		Backoff:     time.Nanosecond, // повторная попытка доступна сразу
+	})
+
+	if err := d.Enqueue(ctx, EventUserRegistered, storage.User{ID: 7, Username: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := d.DeliverDue(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// попытки исчерпаны, очередь больше не отправляет доставку
+	if err := d.DeliverDue(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if target.calls() != 3 {
+		t.Fatalf("target received %d requests, want 3", target.calls())
+	}
+
+	var failed []storage.WebhookDelivery
+	resp := srv.Do(t, "GET", "/admin/webhooks/deliveries?status=failed&target="+target.URL, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("list status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&failed); err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 1 {
+		t.Fatalf("failed deliveries = %+v, want one", failed)
+	}
+	dl := failed[0]
+	if dl.Attempts != 3 || dl.LastStatusCode != http.StatusInternalServerError || len(dl.LastResponse) != maxResponse {
+		t.Errorf("failed delivery = attempts %d, code %d, response %d bytes; want 3, 500, %d bytes",
+			dl.Attempts, dl.LastStatusCode, len(dl.LastResponse), maxResponse)
+	}
+	if want := Sign("s3cret", dl.Payload); target.signatures[0] != want {
+		t.Errorf("signature = %q, want %q", target.signatures[0], want)
+	}
+
+	var stats []storage.WebhookTargetStats
+	resp = srv.Do(t, "GET", "/admin/metrics/webhooks", nil)
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 1 || stats[0] != (storage.WebhookTargetStats{Target: target.URL, Failed: 1}) {
+		t.Errorf("stats = %+v, want one failed delivery for %s", stats, target.URL)
+	}
+
+	target.setHealthy(true)
+	resp = srv.Do(t, "POST", fmt.Sprintf("/admin/webhooks/deliveries/%d/retry", dl.ID), nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("retry status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&dl); err != nil {
+		t.Fatal(err)
+	}
+	if dl.Status != storage.WebhookDelivered || dl.Attempts != 4 || dl.LastResponse != "ok" {
+		t.Errorf("retried delivery = status %s, attempts %d, response %q; want delivered, 4, ok",
+			dl.Status, dl.Attempts, dl.LastResponse)
+	}
+
+	resp = srv.Do(t, "POST", "/admin/webhooks/deliveries/999/retry", nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("retry of unknown delivery status = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+	resp = srv.Do(t, "GET", "/admin/webhooks/deliveries?status=lost", nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown status filter = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestDispatcher_PendingUntilBackoff(t *testing.T) {
+	ctx := context.Background()
+	target := newFlakyTarget(t)
+	store := apitest.NewStore()
+	d := NewDispatcher(store, Config{Targets: []Target{{URL: target.URL}}, Backoff: time.Hour})
+
+	if err := d.Enqueue(ctx, EventReferralCreated, api.Referral{}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := d.DeliverDue(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if target.calls() != 1 {
+		t.Fatalf("target received %d requests before backoff elapsed, want 1", target.calls())
+	}
+
+	stats, err := store.WebhookStats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 1 || stats[0].Pending != 1 || stats[0].Failed != 0 {
+		t.Errorf("stats = %+v, want one pending delivery", stats)
+	}
+	deliveries, err := store.ListWebhookDeliveries(ctx, storage.WebhookDeliveryFilter{}, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dl := deliveries[0]; dl.Status != storage.WebhookPending || time.Until(dl.NextAttemptAt) < 59*time.Minute {
+		t.Errorf("delivery = status %s, next attempt %v; want pending in an hour", dl.Status, dl.NextAttemptAt)
+	}
+}
+
+func TestDispatcher_Backoff(t *testing.T) {
+	d := NewDispatcher(apitest.NewStore(), Config{Backoff: time.Minute})
+
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, time.Minute},
+		{1, 2 * time.Minute},
+		{3, 8 * time.Minute},
+		{20, maxBackoff},
+		{1000, maxBackoff},
+	}
+
+	for _, tt := range tests {
+		if got := d.backoff(tt.attempts); got != tt.want {
+			t.Errorf("backoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}